@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Default time a partner has to acknowledge an X12 interchange with a 997 or
+// 999; partners override it with ack_sla_minutes. 0 only tracks partners
+// that set their own.
+var ackSLA = getEnvDuration("ACK_SLA", 24*time.Hour)
+
+// Webhook POSTed an ack_overdue alert for every interchange past its SLA
+var ackAlertURL = getEnv("ACK_ALERT_WEBHOOK_URL", "")
+
+// Acknowledgment states of an outbound interchange
+const (
+	ackPending  = "pending"
+	ackAccepted = "accepted"
+	ackPartial  = "partial"  // some transaction sets rejected
+	ackRejected = "rejected" // the whole group rejected
+	ackOverdue  = "overdue"  // no ack within the partner's SLA
+)
+
+// Transaction status set from the acknowledgment of its interchange
+const (
+	statusAcknowledged = "Acknowledged"
+	statusRejected     = "Rejected"
+)
+
+var acksOverdue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "edi_acks_overdue",
+	Help: "Outbound interchanges not acknowledged within the partner's SLA.",
+}, []string{"tenant", "partner"})
+
+// An outbound X12 interchange waiting for, or matched to, the partner's
+// functional acknowledgment. Sent interchanges carry their control number
+// in ISA13 and GS06, which the 997's AK1 echoes.
+type OutboundAck struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	TenantID         string     `json:"tenant_id" gorm:"index"`
+	PartnerID        string     `json:"partner_id" gorm:"uniqueIndex:idx_outbound_acks_partner_control"`
+	ControlNumber    int64      `json:"control_number" gorm:"uniqueIndex:idx_outbound_acks_partner_control"`
+	DeliveryID       string     `json:"delivery_id,omitempty"`
+	TransactionIDs   string     `json:"transaction_ids"` // JSON array, in ST02 order
+	Status           string     `json:"status" gorm:"index"`
+	SentAt           time.Time  `json:"sent_at"`
+	DueAt            time.Time  `json:"due_at" gorm:"index"`
+	AckTransactionID string     `json:"ack_transaction_id,omitempty" gorm:"index"` // the inbound 997 or 999
+	AckedAt          *time.Time `json:"acked_at,omitempty"`
+	AlertedAt        *time.Time `json:"alerted_at,omitempty"`
+	Error            string     `json:"error,omitempty"` // rejected sets and their error codes
+}
+
+// A transaction sent in a tracked interchange, finding the interchange's
+// acknowledgment from the transaction by index rather than by scanning
+// transaction_ids
+type OutboundAckTransaction struct {
+	AckID         uint   `gorm:"primaryKey"`
+	TransactionID string `gorm:"primaryKey;index"`
+	TenantID      string `gorm:"index"`
+}
+
+// Index the transactions of a tracked interchange
+func linkAckTransactions(tx *gorm.DB, a OutboundAck) error {
+	var ids []string
+	if err := json.Unmarshal([]byte(a.TransactionIDs), &ids); err != nil || len(ids) == 0 {
+		return err
+	}
+	links := make([]OutboundAckTransaction, len(ids))
+	for i, id := range ids {
+		links[i] = OutboundAckTransaction{AckID: a.ID, TransactionID: id}
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error
+}
+
+// A parsed 997 or 999 for one functional group
+type functionalAck struct {
+	GroupControl string // AK102
+	GroupStatus  string // AK901: A, E, P, R, M, W or X
+	Sets         map[string]string
+	Errors       []string
+}
+
+// Read the AK1/AK2/AK5 (IK5)/AK9 segments of a 997 or 999 set
+func parseFunctionalAck(set X12Set) *functionalAck {
+	ack := &functionalAck{Sets: map[string]string{}}
+	setControl := ""
+	for _, seg := range set.Segments {
+		switch seg[0] {
+		case "AK1":
+			ack.GroupControl = seg.el(2)
+		case "AK2":
+			setControl = seg.el(2)
+		case "AK5", "IK5":
+			ack.Sets[setControl] = seg.el(1)
+			if ackRejects(seg.el(1)) {
+				ack.Errors = append(ack.Errors, strings.TrimSpace(fmt.Sprintf("set %s %s %s", setControl, seg.el(1), strings.Join(seg[2:], " "))))
+			}
+		case "AK9":
+			ack.GroupStatus = seg.el(1)
+		}
+	}
+	if ack.GroupControl == "" {
+		return nil
+	}
+	return ack
+}
+
+// Implementation guide of the 999 acknowledging HIPAA groups
+const ack999Version = "005010X231A1"
+
+// TA1 interchange acknowledgment codes (TA104) and notes (TA105)
+const (
+	ta1Accepted = "A"
+	ta1Rejected = "R"
+
+	ta1NoError                   = "000"
+	ta1ControlMismatch           = "001" // ISA13 and IEA02 differ
+	ta1InvalidSender             = "006"
+	ta1InvalidReceiver           = "008"
+	ta1InvalidDate               = "014"
+	ta1InvalidTime               = "015"
+	ta1InvalidVersion            = "017"
+	ta1InvalidControl            = "018" // ISA13 is not a control number
+	ta1InvalidAckRequested       = "019"
+	ta1InvalidTestIndicator      = "020"
+	ta1InvalidGroupCount         = "021" // IEA01 does not count the groups
+	ta1InvalidStructure          = "022"
+	ta1PrematureEnd              = "023" // no IEA before the end or the next ISA
+	ta1InvalidContent            = "024" // e.g. a GS, GE or segment out of place
+	ta1DuplicateControl          = "025" // duplicate interchange control number
+	ta1InvalidElementSeparator   = "026"
+	ta1InvalidComponentSeparator = "027"
+)
+
+// Build the acknowledgment we would return for an inbound interchange: a TA1
+// when ISA14 requests one or the interchange is rejected as a duplicate, and
+// one 997, or 999 for HIPAA groups, per functional group accepting or
+// rejecting each transaction set as in results. A 999 reports the SNIP
+// findings of rejected sets in IK3/IK4. It is addressed to the interchange
+// sender and reuses its control number; test marks it a test interchange.
+func buildFunctionalAck(ic X12Interchange, results []batchResult, now time.Time, test bool) string {
+	failed := map[string]bool{}
+	findings := map[string][]snipFinding{}
+	duplicate := len(results) > 0
+	for _, res := range results {
+		if res.InterchangeControl != ic.ControlNumber() {
+			continue
+		}
+		if res.Status == "failed" {
+			failed[res.ControlNumber] = true
+			findings[res.ControlNumber] = res.Findings
+		}
+		if res.Code != codeDuplicateInterchange {
+			duplicate = false
+		}
+	}
+	control, _ := strconv.ParseInt(ic.ControlNumber(), 10, 64)
+	env := x12Envelope{
+		ReceiverQualifier: ic.ISA.el(5),
+		ReceiverID:        ic.SenderID(),
+		FunctionalID:      "FA",
+		Version:           "00401",
+		ControlNumber:     control,
+		Time:              now,
+		Test:              test,
+	}
+	if len(ic.Groups) > 0 {
+		env.ReceiverGSID, env.Version = ic.Groups[0].GS.el(2), ic.Groups[0].GS.el(8)
+		if hipaaGroup(ic.Groups[0]) {
+			env.Version = ack999Version
+		} else if len(env.Version) < 5 {
+			env.Version = "00401"
+		}
+	}
+	w := newX12Writer(ic.Delimiters)
+	defer w.release()
+	w.openInterchange(env)
+	if duplicate {
+		w.seg("TA1", ic.ControlNumber(), ic.ISA.el(9), ic.ISA.el(10), ta1Rejected, ta1DuplicateControl)
+		w.closeInterchange(env, 0)
+		return w.String()
+	}
+	if ic.ISA.el(14) == "1" {
+		w.seg("TA1", ic.ControlNumber(), ic.ISA.el(9), ic.ISA.el(10), ta1Accepted, ta1NoError)
+	}
+	w.openGroup(env)
+	for i, g := range ic.Groups {
+		start := w.segments
+		hipaa := hipaaGroup(g)
+		if hipaa {
+			w.seg("ST", "999", fmt.Sprintf("%04d", i+1), ack999Version)
+			w.seg("AK1", g.GS.el(1), g.GS.el(6), g.GS.el(8))
+		} else {
+			w.seg("ST", "997", fmt.Sprintf("%04d", i+1))
+			w.seg("AK1", g.GS.el(1), g.GS.el(6))
+		}
+		accepted := 0
+		for _, set := range g.Sets {
+			setStatus := "AK5"
+			if hipaa {
+				w.seg("AK2", set.Type(), set.ControlNumber(), set.Segments[0].el(3))
+				writeSetErrors(w, findings[set.ControlNumber()])
+				setStatus = "IK5"
+			} else {
+				w.seg("AK2", set.Type(), set.ControlNumber())
+			}
+			if failed[set.ControlNumber()] {
+				w.seg(setStatus, "R", "5") // one or more segments in error
+			} else {
+				w.seg(setStatus, "A")
+				accepted++
+			}
+		}
+		status := "A"
+		if accepted == 0 && len(g.Sets) > 0 {
+			status = "R"
+		} else if accepted < len(g.Sets) {
+			status = "P"
+		}
+		n := fmt.Sprint(len(g.Sets))
+		w.seg("AK9", status, n, n, fmt.Sprint(accepted))
+		w.seg("SE", fmt.Sprint(w.segments-start+1), fmt.Sprintf("%04d", i+1))
+	}
+	w.closeEnvelope(env, len(ic.Groups))
+	return w.String()
+}
+
+// Whether a functional group carries HIPAA transactions, whose GS08 names
+// an implementation guide such as 005010X222A1
+func hipaaGroup(g X12Group) bool {
+	return strings.Contains(g.GS.el(8), "X") && len(g.Sets) > 0 && hipaaSet(g.Sets[0].Type())
+}
+
+// Write the IK3 segment errors of a set, each followed by the IK4 errors of
+// its elements
+func writeSetErrors(w *x12Writer, findings []snipFinding) {
+	for i, f := range findings {
+		if i == 0 || f.Position != findings[i-1].Position || f.Segment != findings[i-1].Segment {
+			code := ik3ElementErrors
+			if f.Element == 0 {
+				code = f.Code
+			}
+			w.seg("IK3", f.Segment, fmt.Sprint(f.Position), f.Loop, code)
+		}
+		if f.Element > 0 {
+			w.seg("IK4", fmt.Sprint(f.Element), "", f.Code)
+		}
+	}
+}
+
+// Acknowledgments of the X12 interchanges of an inbound payload, given the
+// results of processing it: the TA1 of an interchange rejected at its
+// envelope, else their 997s or 999s; none for other formats, nor for
+// interchanges whose sets document rules all kept from being acknowledged
+func interchangeAcks(contentType string, data []byte, results []batchResult, now time.Time, test bool) []string {
+	if detectFormat(contentType, data) != formatX12 {
+		return nil
+	}
+	var ta1s []string
+	for _, res := range results {
+		if res.ta1 != "" {
+			ta1s = append(ta1s, res.ta1)
+		}
+	}
+	if len(ta1s) > 0 {
+		return ta1s
+	}
+	interchanges, err := parseX12(data)
+	if err != nil {
+		return nil // reported in the results
+	}
+	var acks []string
+	for _, ic := range interchanges {
+		if !ackSkipped(ic, results) {
+			acks = append(acks, buildFunctionalAck(ic, results, now, test))
+		}
+	}
+	return acks
+}
+
+// Whether every result of an interchange had its acknowledgment turned off
+func ackSkipped(ic X12Interchange, results []batchResult) bool {
+	skipped := false
+	for _, res := range results {
+		if res.InterchangeControl != ic.ControlNumber() {
+			continue
+		}
+		if !res.skipAck {
+			return false
+		}
+		skipped = true
+	}
+	return skipped
+}
+
+// Whether an inbound request asks for the X12 acknowledgments of its
+// interchanges instead of the JSON results
+func wantsX12Acks(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/edi-x12")
+}
+
+// Respond with the acknowledgments of the interchanges processed, or with
+// the results when there are none
+func writeAcks(w http.ResponseWriter, acks []string, results []batchResult) {
+	if len(acks) == 0 {
+		writeBatchResults(w, results)
+		return
+	}
+	w.Header().Set("Content-Type", "application/edi-x12")
+	w.Write([]byte(strings.Join(acks, "")))
+}
+
+// Whether an AK5/AK9 code rejects the set or group
+func ackRejects(status string) bool {
+	return status == "R" || status == "M" || status == "W" || status == "X"
+}
+
+// Start waiting for the partner's acknowledgment of an X12 interchange that
+// was just sent
+func expectAck(ctx context.Context, p Partner, doc outboundDocument, deliveryID string) {
+	sla := ackSLA
+	if p.AckSLAMinutes > 0 {
+		sla = time.Duration(p.AckSLAMinutes) * time.Minute
+	}
+	if sla <= 0 || p.AckSLAMinutes < 0 || doc.ContentType != "application/edi-x12" ||
+		doc.Number == 0 || p.ID == defaultPartner.ID {
+		return
+	}
+	idList, _ := json.Marshal(doc.TransactionIDs)
+	now := time.Now()
+	a := OutboundAck{PartnerID: p.ID, ControlNumber: doc.Number, DeliveryID: deliveryID, TransactionIDs: string(idList),
+		Status: ackPending, SentAt: now, DueAt: now.Add(sla)}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&a).Error; err != nil {
+			return err
+		}
+		return linkAckTransactions(tx, a)
+	})
+	if err != nil {
+		log.Printf("ERROR: ack tracking %s %d: %v\n", p.ID, doc.Number, err)
+	}
+}
+
+// Match a received 997/999 to the interchange it acknowledges and update the
+// interchange's transactions. A stray ack is logged and otherwise ignored.
+func reconcileAck(ctx context.Context, t Transaction) {
+	ack := t.ack
+	number, err := strconv.ParseInt(ack.GroupControl, 10, 64)
+	if err != nil {
+		log.Printf("ERROR: %s %s: AK1 group control %q is not a number\n", t.Type, t.ID, ack.GroupControl)
+		return
+	}
+	var a OutboundAck
+	res := db.WithContext(ctx).Where("partner_id = ? AND control_number = ?", t.PartnerID, number).Limit(1).Find(&a)
+	if res.Error != nil {
+		log.Printf("ERROR: ack %s: %v\n", t.ID, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		log.Printf("Ack %s from partner %q matches no outbound interchange %d", t.ID, t.PartnerID, number)
+		return
+	}
+	var ids []string
+	json.Unmarshal([]byte(a.TransactionIDs), &ids)
+	now := time.Now()
+	before := a
+	a.AckTransactionID, a.AckedAt, a.Error = t.ID, &now, strings.Join(ack.Errors, "; ")
+	switch {
+	case ackRejects(ack.GroupStatus):
+		a.Status = ackRejected
+	case ack.GroupStatus == "P" || len(ack.Errors) > 0:
+		a.Status = ackPartial
+	default:
+		a.Status = ackAccepted
+	}
+	if err := db.WithContext(ctx).Model(&a).Select("status", "ack_transaction_id", "acked_at", "error").Updates(&a).Error; err != nil {
+		log.Printf("ERROR: ack %s: %v\n", t.ID, err)
+		return
+	}
+	auditChange(ctx, auditUpdate, "outbound_ack", fmt.Sprintf("%s/%d", a.PartnerID, a.ControlNumber), before, a)
+	for i, id := range ids {
+		status, event := statusAcknowledged, txEventAcknowledged
+		// Outbound sets are numbered 0001.. in interchange order
+		if ackRejects(ack.GroupStatus) || ackRejects(ack.Sets[fmt.Sprintf("%04d", i+1)]) {
+			status, event = statusRejected, txEventRejected
+		}
+		if err := recordTransactionEvent(ctx, id, event, status, map[string]interface{}{"ack_transaction_id": t.ID}); err != nil {
+			log.Printf("ERROR: ack %s transaction %s: %v\n", t.ID, id, err)
+			continue
+		}
+		auditChange(ctx, auditUpdate, "transaction", id, nil, map[string]string{"status": status, "ack_transaction_id": t.ID})
+		updateViewStatus(ctx, id, status)
+	}
+}
+
+// Periodically flag interchanges past their SLA and refresh the overdue gauge
+func runAckMonitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := checkOverdueAcks(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: ack monitor: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Mark pending acks of every tenant due before now overdue and alert once
+func checkOverdueAcks(ctx context.Context, now time.Time) error {
+	scoped := db.WithContext(withTenant(ctx, allTenants))
+	var due []OutboundAck
+	if err := scoped.Where("status = ? AND due_at < ?", ackPending, now).Order("due_at").Limit(1000).Find(&due).Error; err != nil {
+		return err
+	}
+	for _, a := range due {
+		a.Status, a.AlertedAt = ackOverdue, &now
+		res := scoped.Model(&a).Where("status = ?", ackPending).Select("status", "alerted_at").Updates(&a)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue // acked meanwhile
+		}
+		log.Printf("ALERT: partner %s has not acknowledged interchange %d sent %s", a.PartnerID, a.ControlNumber, a.SentAt.Format(time.RFC3339))
+		if ackAlertURL != "" {
+			go notifyAckOverdue(a)
+		}
+	}
+
+	var counts []struct {
+		TenantID  string
+		PartnerID string
+		N         int
+	}
+	if err := scoped.Model(&OutboundAck{}).Select("tenant_id, partner_id, count(*) AS n").Where("status = ?", ackOverdue).
+		Group("tenant_id, partner_id").Scan(&counts).Error; err != nil {
+		return err
+	}
+	acksOverdue.Reset()
+	for _, c := range counts {
+		acksOverdue.WithLabelValues(c.TenantID, c.PartnerID).Set(float64(c.N))
+	}
+	return nil
+}
+
+// POST an ack_overdue alert, retrying a few times like job callbacks
+func notifyAckOverdue(a OutboundAck) {
+	body, _ := json.Marshal(struct {
+		Event string `json:"event"`
+		OutboundAck
+	}{"ack_overdue", a})
+	client := &http.Client{Timeout: 10 * time.Second}
+	for attempt, delay := 1, time.Second; attempt <= 3; attempt, delay = attempt+1, delay*2 {
+		resp, err := client.Post(ackAlertURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		log.Printf("Ack alert for %s %d attempt %d failed: %v", a.PartnerID, a.ControlNumber, attempt, err)
+		time.Sleep(delay)
+	}
+}
+
+// List a partner's outbound interchanges and their acknowledgment, by status
+func listAcksHandler(w http.ResponseWriter, r *http.Request) {
+	query := db.WithContext(r.Context()).Where("partner_id = ?", mux.Vars(r)["id"]).Order("id DESC").Limit(1000)
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	acks := []OutboundAck{}
+	if err := query.Find(&acks).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch acknowledgments", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(acks)
+}
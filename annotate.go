@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Where one canonical field's value came from: an X12 element the
+// translator read, or a rule of the partner's map or fixed-width layout
+type fieldAnnotation struct {
+	Field    string   `json:"field"` // e.g. ship_to or items[2].uom
+	Value    string   `json:"value,omitempty"`
+	Segment  string   `json:"segment,omitempty"`  // X12 element, e.g. N1*ST.02
+	Position int      `json:"position,omitempty"` // of that segment in its set, ST being 1
+	Map      string   `json:"map,omitempty"`      // e.g. inbound map v3
+	Rule     int      `json:"rule,omitempty"`     // 1-based, in the map's order
+	MapRule  *MapRule `json:"map_rule,omitempty"`
+	Before   string   `json:"before,omitempty"` // value the rule replaced
+	Error    string   `json:"error,omitempty"`  // of the rule the map stopped at
+}
+
+type mappingDebugKey struct{}
+
+// Context whose translations annotate every field they set
+func withMappingDebug(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mappingDebugKey{}, true)
+}
+
+func mappingDebug(ctx context.Context) bool {
+	on, _ := ctx.Value(mappingDebugKey{}).(bool)
+	return on
+}
+
+// Request context, annotating translations with ?debug=true
+func debugContext(r *http.Request) context.Context {
+	if r.URL.Query().Get("debug") == "true" {
+		return withMappingDebug(r.Context())
+	}
+	return r.Context()
+}
+
+// Check documents like a sandbox submission, whatever partner sends them:
+// nothing is saved, archived or published
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	sandboxInboundHandler(w, r.WithContext(debugContext(r)))
+}
+
+// Translate one inbound document into canonical transactions, with the
+// partner's inbound map applied, without processing it. Responds 422 when
+// the document cannot be read at all.
+func convertHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := readInbound(w, r, false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer in.release()
+	ctx := withSandbox(debugContext(r))
+	doc, _ := parseDocument(ctx, "", r.Header.Get("Content-Type"), partnerHint(ctx), in.buf.Bytes())
+	w.Header().Set("Content-Type", "application/json")
+	if doc.Error != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(doc)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Exact bytes received or sent for a transaction
+type RawPayload struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TenantID      string    `json:"tenant_id" gorm:"index"`
+	TransactionID string    `json:"transaction_id" gorm:"index"`
+	Direction     string    `json:"direction"` // inbound or outbound
+	ContentType   string    `json:"content_type"`
+	StorageKey    string    `json:"storage_key"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	CreatedAt     time.Time `json:"created_at" gorm:"index"`
+}
+
+// Storage backend for archived payloads and other large blobs: the database
+// keeps only their keys
+type blobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error) // streams a blob instead of reading it whole
+	Delete(ctx context.Context, key string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+var archiveSampledOut = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "archive_sampled_out_total",
+	Help: "Raw payloads not archived because of partner sampling.",
+})
+
+// Configured archive backend; nil when archival is disabled
+var archive blobStore
+
+// How long raw payloads are kept (0 keeps them forever)
+var archiveRetention = getEnvDuration("ARCHIVE_RETENTION", 90*24*time.Hour)
+
+// Job results over this many bytes are kept in the archive backend instead
+// of the database; raw payloads and attachments always are
+var blobThreshold = int64(getEnvInt("BLOB_THRESHOLD", 256<<10))
+
+// Initialize the archive backend from ARCHIVE_BACKEND (fs, s3 or none)
+func initArchive() error {
+	switch backend := getEnv("ARCHIVE_BACKEND", "fs"); backend {
+	case "fs":
+		dir := getEnv("ARCHIVE_DIR", "/var/lib/edigateway/archive")
+		if edgeMode {
+			// Raw payloads double as the local spool at the edge
+			dir = getEnv("ARCHIVE_DIR", filepath.Join(edgeDataDir, "spool"))
+		}
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return err
+		}
+		archive = fsStore{root: dir}
+	case "s3":
+		archive = newS3Store()
+	case "none":
+		archive = nil
+	default:
+		return fmt.Errorf("unknown ARCHIVE_BACKEND %q", backend)
+	}
+	return nil
+}
+
+// Filesystem (local disk or NFS) archive backend
+type fsStore struct {
+	root string
+}
+
+func (s fsStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s fsStore) Put(ctx context.Context, key string, data []byte) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s fsStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s fsStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s fsStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Whether the raw payload of a successfully processed transaction is kept.
+// Sampling is keyed on the transaction ID so the decision is reproducible.
+func sampleArchive(ctx context.Context, partnerID, transactionID string) bool {
+	p, err := loadPartner(ctx, partnerID)
+	if err != nil || p.ArchiveSample <= 0 || p.ArchiveSample >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(transactionID))
+	if float64(h.Sum32())/math.MaxUint32 < p.ArchiveSample {
+		return true
+	}
+	archiveSampledOut.Inc()
+	return false
+}
+
+// Store a raw payload once and link it to every transaction it carried
+func archivePayload(ctx context.Context, direction, contentType string, data []byte, transactionIDs ...string) error {
+	if archive == nil || len(transactionIDs) == 0 {
+		return nil
+	}
+	key, err := putPayload(ctx, direction, data)
+	if err != nil {
+		return err
+	}
+	if err := linkPayload(db.WithContext(ctx), key, direction, contentType, data, transactionIDs...); err != nil {
+		return err
+	}
+	addStorageUsage(tenantID(ctx), int64(len(data)))
+	return nil
+}
+
+// Store a raw payload under a new key, to be linked with linkPayload
+func putPayload(ctx context.Context, direction string, data []byte) (string, error) {
+	key := fmt.Sprintf("%s/%s/%s", direction, time.Now().UTC().Format("2006/01/02"), uuid.New().String())
+	return key, archive.Put(ctx, key, data)
+}
+
+// Record with tx that the payload stored under key carried transactionIDs
+func linkPayload(tx *gorm.DB, key, direction, contentType string, data []byte, transactionIDs ...string) error {
+	now, sum := time.Now().UTC(), sha256Hex(data)
+	rows := make([]RawPayload, 0, len(transactionIDs))
+	for _, id := range transactionIDs {
+		rows = append(rows, RawPayload{
+			TransactionID: id,
+			Direction:     direction,
+			ContentType:   contentType,
+			StorageKey:    key,
+			Size:          int64(len(data)),
+			SHA256:        sum,
+			CreatedAt:     now,
+		})
+	}
+	return tx.Create(&rows).Error
+}
+
+// Stream the archived raw payload of a transaction
+func rawPayloadHandler(w http.ResponseWriter, r *http.Request) {
+	meta, err := archivedPayloadMeta(r.Context(), mux.Vars(r)["id"], r.URL.Query().Get("direction"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rc, err := archive.Open(r.Context(), meta.StorageKey)
+	if errors.Is(err, errBlobNotFound) {
+		writeProblem(w, "Raw payload purged", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: archive open %s: %v\n", meta.StorageKey, err)
+		writeProblem(w, "Failed to read raw payload", http.StatusInternalServerError)
+		return
+	}
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.Header().Set("X-Payload-SHA256", meta.SHA256)
+	w.Header().Set("X-Archived-At", meta.CreatedAt.Format(time.RFC3339))
+	streamBlob(w, rc, meta.StorageKey)
+}
+
+// Copy an opened blob to w, whose headers are written, and close it
+func streamBlob(w io.Writer, rc io.ReadCloser, key string) {
+	defer rc.Close()
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("ERROR: archive stream %s: %v\n", key, err)
+	}
+}
+
+// Latest payload archived for a transaction in direction, inbound by
+// default
+func archivedPayloadMeta(ctx context.Context, transactionID, direction string) (RawPayload, error) {
+	var meta RawPayload
+	if archive == nil {
+		return meta, &httpError{Status: http.StatusNotFound, Message: "Archival is disabled"}
+	}
+	if direction == "" {
+		direction = "inbound"
+	}
+	err := db.WithContext(ctx).Where("transaction_id = ? AND direction = ?", transactionID, direction).
+		Order("created_at DESC").First(&meta).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return meta, &httpError{Status: http.StatusNotFound, Message: "Raw payload not found"}
+	} else if err != nil {
+		return meta, &httpError{Status: http.StatusInternalServerError, Message: "Failed to fetch raw payload"}
+	}
+	return meta, nil
+}
+
+// Latest payload archived for a transaction in direction and its bytes
+func archivedPayload(ctx context.Context, transactionID, direction string) (RawPayload, []byte, error) {
+	meta, err := archivedPayloadMeta(ctx, transactionID, direction)
+	if err != nil {
+		return meta, nil, err
+	}
+	data, err := archive.Get(ctx, meta.StorageKey)
+	if errors.Is(err, errBlobNotFound) {
+		return meta, nil, &httpError{Status: http.StatusGone, Message: "Raw payload purged"}
+	} else if err != nil {
+		log.Printf("ERROR: archive get %s: %v\n", meta.StorageKey, err)
+		return meta, nil, &httpError{Status: http.StatusInternalServerError, Message: "Failed to read raw payload"}
+	}
+	return meta, data, nil
+}
+
+// Periodically purge payloads past the retention window
+func runArchivePurger(ctx context.Context, interval time.Duration) {
+	if archive == nil || archiveRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := purgeArchive(ctx, time.Now().Add(-archiveRetention)); err != nil {
+			log.Printf("ERROR: archive purge: %v\n", err)
+		} else if n > 0 {
+			log.Printf("Archive purge removed %d payloads", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Delete payloads of every tenant archived before cutoff, blobs first
+func purgeArchive(ctx context.Context, cutoff time.Time) (int, error) {
+	scoped := db.WithContext(withTenant(ctx, allTenants))
+	var expired []RawPayload
+	if err := scoped.Where("created_at < ?", cutoff).Limit(1000).Find(&expired).Error; err != nil {
+		return 0, err
+	}
+	removed := map[string]bool{}
+	for _, p := range expired {
+		if removed[p.StorageKey] {
+			continue
+		}
+		if err := archive.Delete(ctx, p.StorageKey); err != nil {
+			return 0, err
+		}
+		removed[p.StorageKey] = true
+	}
+	for key := range removed {
+		if err := scoped.Where("storage_key = ?", key).Delete(&RawPayload{}).Error; err != nil {
+			return 0, err
+		}
+	}
+	return len(removed), nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mozilla.org/pkcs7"
+)
+
+// Our AS2 identity and the public URL partners POST asynchronous MDNs to
+var (
+	as2ID     = getEnv("AS2_ID", "EDIGATEWAY")
+	as2MDNURL = getEnv("AS2_MDN_URL", "")
+)
+
+// MDN request modes on a partner profile
+const (
+	mdnNone  = ""
+	mdnSync  = "sync"
+	mdnAsync = "async"
+)
+
+// Delivery states while an MDN is outstanding
+const (
+	deliveryDelivered   = "delivered"
+	deliveryFailed      = "failed"
+	deliveryAwaitingMDN = "awaiting_mdn"
+)
+
+// Set AS2 headers on an outbound request and return the Message-ID and the
+// MIC the partner should report back
+func prepareAS2(req *http.Request, p Partner, contentType string, payload []byte) (string, string) {
+	messageID := fmt.Sprintf("<%s@%s>", uuid.New().String(), as2ID)
+	req.Header.Set("AS2-Version", "1.2")
+	req.Header.Set("AS2-From", as2ID)
+	req.Header.Set("AS2-To", p.AS2ID)
+	req.Header.Set("Message-ID", messageID)
+	req.Header.Set("Subject", "EDI delivery")
+	if p.MDNMode != mdnNone {
+		req.Header.Set("Disposition-Notification-To", as2ID)
+		req.Header.Set("Disposition-Notification-Options",
+			"signed-receipt-protocol=required, pkcs7-signature; signed-receipt-micalg=required, sha-256")
+		if p.MDNMode == mdnAsync {
+			req.Header.Set("Receipt-Delivery-Option", as2MDNURL)
+		}
+	}
+	// Unsigned messages: the MIC covers the MIME header and content (RFC 4130 7.3.1)
+	sum := sha256.Sum256(append([]byte("Content-Type: "+contentType+"\r\n\r\n"), payload...))
+	return messageID, base64.StdEncoding.EncodeToString(sum[:]) + ", sha-256"
+}
+
+// Fields of a message/disposition-notification part
+type mdnReport struct {
+	OriginalMessageID string
+	Disposition       string
+	ReceivedMIC       string
+	Signed            bool
+}
+
+// Whether the disposition reports successful processing; warnings count as success
+func (m mdnReport) processed() bool {
+	_, outcome, _ := strings.Cut(m.Disposition, ";")
+	outcome = strings.ToLower(strings.TrimSpace(outcome))
+	return strings.HasPrefix(outcome, "processed") &&
+		!strings.Contains(outcome, "/error") && !strings.Contains(outcome, "/failure")
+}
+
+// Parse an MDN, which must be signed with one of certs, the partner's
+// certificates: an unsigned one, or one from a partner without a
+// certificate, could come from anybody
+func parseMDN(contentType string, body []byte, certs []*x509.Certificate) (mdnReport, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return mdnReport{}, fmt.Errorf("invalid Content-Type: %w", err)
+	}
+	if len(certs) == 0 {
+		return mdnReport{}, errors.New("partner has no as2_certificate to verify the MDN with")
+	}
+	signed := false
+	if mediaType == "multipart/signed" {
+		content, sig, err := splitSigned(body, params["boundary"])
+		if err != nil {
+			return mdnReport{}, err
+		}
+		if err := verifySignature(content, sig, certs); err != nil {
+			return mdnReport{}, err
+		}
+		if contentType, body, err = signedEntity(content); err != nil {
+			return mdnReport{}, fmt.Errorf("signed MDN: %w", err)
+		}
+		if mediaType, params, err = mime.ParseMediaType(contentType); err != nil {
+			return mdnReport{}, fmt.Errorf("signed MDN: invalid Content-Type: %w", err)
+		}
+		signed = true
+	} else {
+		return mdnReport{}, errors.New("MDN must be signed")
+	}
+	if mediaType != "multipart/report" {
+		return mdnReport{}, fmt.Errorf("unexpected MDN type %s", mediaType)
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return mdnReport{}, errors.New("MDN has no disposition-notification part")
+		} else if err != nil {
+			return mdnReport{}, fmt.Errorf("invalid MDN body: %w", err)
+		}
+		if t, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); t != "message/disposition-notification" {
+			continue
+		}
+		fields, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+		if err != nil && len(fields) == 0 {
+			return mdnReport{}, fmt.Errorf("invalid disposition-notification: %w", err)
+		}
+		return mdnReport{
+			OriginalMessageID: strings.TrimSpace(fields.Get("Original-Message-ID")),
+			Disposition:       strings.TrimSpace(fields.Get("Disposition")),
+			ReceivedMIC:       strings.TrimSpace(fields.Get("Received-Content-MIC")),
+			Signed:            signed,
+		}, nil
+	}
+}
+
+// Raw bytes of the signed entity (headers included) and the DER signature of
+// a multipart/signed body. The signature covers the entity byte for byte, so
+// it is cut out by boundary rather than re-serialised by mime/multipart.
+func splitSigned(body []byte, boundary string) ([]byte, []byte, error) {
+	if boundary == "" {
+		return nil, nil, errors.New("multipart/signed without boundary")
+	}
+	delim := []byte("--" + boundary)
+	start := bytes.Index(body, delim)
+	if start < 0 {
+		return nil, nil, errors.New("multipart/signed: boundary not found")
+	}
+	rest := body[start+len(delim):]
+	rest = bytes.TrimPrefix(bytes.TrimPrefix(rest, []byte("\r")), []byte("\n"))
+	end := bytes.Index(rest, append([]byte("\r\n"), delim...))
+	if end < 0 {
+		return nil, nil, errors.New("multipart/signed: missing signature part")
+	}
+	content := rest[:end]
+
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	if _, err := reader.NextPart(); err != nil {
+		return nil, nil, fmt.Errorf("multipart/signed: %w", err)
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("multipart/signed: missing signature part: %w", err)
+	}
+	raw, err := io.ReadAll(part)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+		if raw, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(raw)), "")); err != nil {
+			return nil, nil, fmt.Errorf("signature: %w", err)
+		}
+	}
+	return content, raw, nil
+}
+
+// Content type and body of a signed MIME entity, which has headers of its own
+func signedEntity(content []byte) (string, []byte, error) {
+	msg, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(content))).ReadMIMEHeader()
+	if err != nil {
+		return "", nil, err
+	}
+	i := bytes.Index(content, []byte("\r\n\r\n"))
+	if i < 0 {
+		return "", nil, errors.New("missing body")
+	}
+	body := content[i+4:]
+	if strings.EqualFold(msg.Get("Content-Transfer-Encoding"), "base64") {
+		if body, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), "")); err != nil {
+			return "", nil, fmt.Errorf("body: %w", err)
+		}
+	}
+	return msg.Get("Content-Type"), body, nil
+}
+
+// Verify the S/MIME signature of an inbound AS2 message against the
+// partner's certificates and return the content type and payload it signed.
+// Partners without a certificate cannot send signed messages, since nothing
+// would tie the signer to them.
+func openSignedAS2(ctx context.Context, p Partner, contentType string, body []byte) (string, []byte, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid Content-Type: %w", err)
+	}
+	certs, err := partnerCertificates(ctx, p)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(certs) == 0 {
+		return "", nil, fmt.Errorf("partner %s has no as2_certificate to verify the signature with", p.ID)
+	}
+	content, sig, err := splitSigned(body, params["boundary"])
+	if err != nil {
+		return "", nil, err
+	}
+	if err := verifySignature(content, sig, certs); err != nil {
+		return "", nil, err
+	}
+	return signedEntity(content)
+}
+
+// Check a detached PKCS#7 signature over content made by one of certs
+// itself, not merely by a certificate one of them issued
+func verifySignature(content, sig []byte, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate to verify the signature with")
+	}
+	p7, err := pkcs7.Parse(sig)
+	if err != nil {
+		return fmt.Errorf("signature: %w", err)
+	}
+	p7.Content = content
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return errors.New("signature must have exactly one signer")
+	}
+	pinned := false
+	for _, cert := range certs {
+		if cert.Equal(signer) {
+			pinned = true
+			break
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("signature is by %s, not a certificate of the partner", signer.Subject)
+	}
+	if err := p7.Verify(); err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	return nil
+}
+
+// Partner certificate from the profile's PEM, or nil when none is configured
+func partnerCertificate(p Partner) (*x509.Certificate, error) {
+	if p.AS2Certificate == "" {
+		return nil, nil
+	}
+	block, _ := pem.Decode([]byte(p.AS2Certificate))
+	if block == nil {
+		return nil, fmt.Errorf("partner %s: as2_certificate is not PEM", p.ID)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Record an MDN on its delivery
+func applyMDN(d *Delivery, mdn mdnReport) {
+	now := time.Now()
+	d.MDNDisposition, d.MDNReceivedAt, d.MDNSigned = mdn.Disposition, &now, mdn.Signed
+	switch {
+	case !mdn.processed():
+		d.Status, d.Error = deliveryFailed, "MDN: "+mdn.Disposition
+	case mdn.ReceivedMIC == "":
+		d.Status, d.Error = deliveryFailed, "MDN: Received-Content-MIC is missing"
+	case !strings.EqualFold(normaliseMIC(mdn.ReceivedMIC), normaliseMIC(d.MIC)):
+		d.Status, d.Error = deliveryFailed, "MDN: Received-Content-MIC does not match"
+	default:
+		d.Status, d.Error = deliveryDelivered, ""
+	}
+}
+
+func normaliseMIC(mic string) string {
+	return strings.ReplaceAll(mic, " ", "")
+}
+
+// Receive an asynchronous MDN, correlate it to its delivery by original
+// Message-ID and update the delivery state, once: only a delivery still
+// awaiting its MDN takes one
+func asyncMDNHandler(w http.ResponseWriter, r *http.Request) {
+	buf, err := readPooled(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	if err != nil {
+		writeError(w, bodyError(r.Context(), err, &httpError{Status: http.StatusBadRequest, Message: "Failed to read request body"}))
+		return
+	}
+	defer releaseBuffer(buf)
+
+	// AS2 peers know nothing of tenants; the partner found by AS2-From decides
+	var p Partner
+	if from := r.Header.Get("AS2-From"); from != "" {
+		db.WithContext(allTenantsContext()).Where("as2_id = ?", from).Limit(1).Find(&p)
+	}
+	if p.ID == "" {
+		writeError(w, &httpError{Status: http.StatusForbidden, Code: codePartnerUnknown, Message: "Unknown AS2-From"})
+		return
+	}
+	ctx := withTenant(r.Context(), p.TenantID)
+	certs, err := partnerCertificates(ctx, p)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Partner certificate is invalid", http.StatusInternalServerError)
+		return
+	}
+	mdn, err := parseMDN(r.Header.Get("Content-Type"), buf.Bytes(), certs)
+	if err != nil {
+		writeProblem(w, "Invalid MDN: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var d Delivery
+	res := db.WithContext(ctx).Where("message_id = ? AND partner_id = ?", mdn.OriginalMessageID, p.ID).Limit(1).Find(&d)
+	if res.Error != nil {
+		writeProblem(w, "Failed to fetch delivery", http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		writeProblem(w, "No delivery with Original-Message-ID "+mdn.OriginalMessageID, http.StatusNotFound)
+		return
+	}
+	if d.Status != deliveryAwaitingMDN {
+		writeProblem(w, "Delivery "+d.ID+" is not awaiting an MDN", http.StatusConflict)
+		return
+	}
+	applyMDN(&d, mdn)
+	res = db.WithContext(ctx).Model(&d).Where("status = ?", deliveryAwaitingMDN).
+		Select("status", "error", "mdn_disposition", "mdn_signed", "mdn_received_at").Updates(&d)
+	if res.Error != nil {
+		log.Printf("ERROR: delivery %s: %v\n", d.ID, res.Error)
+		writeProblem(w, "Failed to update delivery", http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		// Another MDN for it got there first
+		writeProblem(w, "Delivery "+d.ID+" is not awaiting an MDN", http.StatusConflict)
+		return
+	}
+	var ids []string
+	json.Unmarshal([]byte(d.TransactionIDs), &ids)
+	recordDeliveryEvents(ctx, ids, txEventMDNReceived, map[string]interface{}{"delivery_id": d.ID, "delivery_status": d.Status, "disposition": d.MDNDisposition})
+	var txs []Transaction
+	if err := db.WithContext(ctx).Where("id IN ?", ids).Find(&txs).Error; err != nil {
+		log.Printf("ERROR: delivery %s: %v\n", d.ID, err)
+	} else if err := readItems(ctx, txs); err != nil {
+		log.Printf("ERROR: delivery %s: %v\n", d.ID, err)
+	}
+	publishDelivery(ctx, p, d, txs)
+	fmt.Fprintf(w, "MDN recorded for delivery %s: %s\n", d.ID, d.Status)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// A certificate and its key, issued by parent or self-signed when nil
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign, BasicConstraintsValid: true, IsCA: parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// An MDN for messageID reporting mic, signed with key and cert unless nil
+func testMDN(t *testing.T, messageID, mic string, cert *x509.Certificate, key crypto.Signer) (string, []byte) {
+	t.Helper()
+	report := "--report\r\nContent-Type: text/plain\r\n\r\nReceipt\r\n" +
+		"--report\r\nContent-Type: message/disposition-notification\r\n\r\n" +
+		"Original-Message-ID: " + messageID + "\r\nDisposition: automatic-action/MDN-sent-automatically; processed\r\n"
+	if mic != "" {
+		report += "Received-Content-MIC: " + mic + "\r\n"
+	}
+	report += "\r\n--report--\r\n"
+	reportType := `multipart/report; report-type=disposition-notification; boundary="report"`
+	if cert == nil {
+		return reportType, []byte(report)
+	}
+	entity := "Content-Type: " + reportType + "\r\n\r\n" + report
+	sd, err := pkcs7.NewSignedData([]byte(entity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	sd.Detach()
+	sig, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "--signed\r\n" + entity + "\r\n--signed\r\nContent-Type: application/pkcs7-signature\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(sig) + "\r\n--signed--\r\n"
+	return `multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary="signed"`, []byte(body)
+}
+
+func TestParseMDNRequiresPartnerSignature(t *testing.T) {
+	partner, partnerKey := testCertificate(t, "Acme AS2", nil, nil)
+	issued, issuedKey := testCertificate(t, "Issued by Acme", partner, partnerKey)
+	other, otherKey := testCertificate(t, "Someone else", nil, nil)
+	tests := []struct {
+		name  string
+		cert  *x509.Certificate
+		key   crypto.Signer
+		certs []*x509.Certificate
+		ok    bool
+	}{
+		{"signed by the partner", partner, partnerKey, []*x509.Certificate{partner}, true},
+		{"unsigned", nil, nil, []*x509.Certificate{partner}, false},
+		{"partner without a certificate", partner, partnerKey, nil, false},
+		{"signed by a certificate the partner issued", issued, issuedKey, []*x509.Certificate{partner}, false},
+		{"signed by someone else", other, otherKey, []*x509.Certificate{partner}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, body := testMDN(t, "<msg-1@acme>", "abc=, sha-256", tt.cert, tt.key)
+			mdn, err := parseMDN(contentType, body, tt.certs)
+			if tt.ok && (err != nil || mdn.OriginalMessageID != "<msg-1@acme>" || !mdn.Signed) {
+				t.Errorf("parse: %+v %v", mdn, err)
+			} else if !tt.ok && err == nil {
+				t.Errorf("accepted: %+v", mdn)
+			}
+		})
+	}
+}
+
+func TestApplyMDNRequiresMIC(t *testing.T) {
+	processed := "automatic-action/MDN-sent-automatically; processed"
+	for _, tt := range []struct {
+		mic, want string
+	}{
+		{"abc=, sha-256", deliveryDelivered},
+		{"abc=,sha-256", deliveryDelivered},
+		{"", deliveryFailed},
+		{"xyz=, sha-256", deliveryFailed},
+	} {
+		d := Delivery{Status: deliveryAwaitingMDN, MIC: "abc=, sha-256"}
+		applyMDN(&d, mdnReport{Disposition: processed, ReceivedMIC: tt.mic})
+		if d.Status != tt.want {
+			t.Errorf("MIC %q: %s (%s), want %s", tt.mic, d.Status, d.Error, tt.want)
+		}
+	}
+}
+
+// An asynchronous MDN settles a delivery awaiting it, and nothing else
+func TestAsyncMDNOnlyForAwaitingDeliveries(t *testing.T) {
+	url := startSignatureGateway(t)
+	cert, key := testCertificate(t, "Acme AS2", nil, nil)
+	pemCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	p := map[string]interface{}{"id": "initech", "name": "Initech", "as2_id": "INITECH", "mdn_mode": mdnAsync, "as2_certificate": pemCert}
+	if status := doJSON(t, "POST", url+"/partners", p, nil); status != http.StatusCreated {
+		t.Fatalf("create partner: %d", status)
+	}
+	tdb := db.WithContext(withTenant(context.Background(), defaultTenant))
+	for _, d := range []Delivery{
+		{ID: "awaiting", PartnerID: "initech", TransactionIDs: "[]", Status: deliveryAwaitingMDN, MessageID: "<awaiting@gw>", MIC: "abc=, sha-256"},
+		{ID: "failed", PartnerID: "initech", TransactionIDs: "[]", Status: deliveryFailed, MessageID: "<failed@gw>", MIC: "abc=, sha-256"},
+	} {
+		if err := tdb.Create(&d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	post := func(messageID string) int {
+		contentType, body := testMDN(t, messageID, "abc=, sha-256", cert, key)
+		req, _ := http.NewRequest("POST", url+"/as2/mdn", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("AS2-From", "INITECH")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, tt := range []struct {
+		messageID string
+		want      int
+	}{
+		{"<awaiting@gw>", http.StatusOK},
+		{"<awaiting@gw>", http.StatusConflict},
+		{"<failed@gw>", http.StatusConflict},
+	} {
+		if status := post(tt.messageID); status != tt.want {
+			t.Errorf("MDN for %s: %d, want %d", tt.messageID, status, tt.want)
+		}
+	}
+	var d Delivery
+	if err := tdb.First(&d, "id = ?", "failed").Error; err != nil || d.Status != deliveryFailed || d.MDNReceivedAt != nil {
+		t.Errorf("failed delivery took an MDN: %+v %v", d, err)
+	}
+	var settled Delivery
+	if err := tdb.First(&settled, "id = ?", "awaiting").Error; err != nil || settled.Status != deliveryDelivered {
+		t.Errorf("awaiting delivery: %+v %v", settled, err)
+	}
+}
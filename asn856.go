@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// One line of a transaction's ItemList
+type Item struct {
+	SKU         string  `json:"sku"`
+	Description string  `json:"description,omitempty"`
+	Quantity    float64 `json:"quantity"`
+	UOM         string  `json:"uom,omitempty"`
+	PONumber    string  `json:"po_number,omitempty"`
+	Carton      string  `json:"carton,omitempty"` // SSCC-18 or carton label
+	Weight      float64 `json:"weight,omitempty"`
+}
+
+// Decode the JSON item list stored on a transaction
+func (t *Transaction) Items() ([]Item, error) {
+	if strings.TrimSpace(t.ItemList) == "" {
+		return nil, nil
+	}
+	var items []Item
+	if err := json.Unmarshal([]byte(t.ItemList), &items); err != nil {
+		return nil, fmt.Errorf("transaction %s: invalid item list: %w", t.ID, err)
+	}
+	return items, nil
+}
+
+// Build a complete 856 interchange (ISA..IEA) for a partner
+func build856Interchange(ctx context.Context, p Partner, transactions []Transaction) (string, error) {
+	if !validX12Version(p.X12Version) {
+		return "", fmt.Errorf("partner %s: x12_version must be 004010 or 005010, not %q", p.ID, p.X12Version)
+	}
+	control, err := nextControlNumber(ctx, &p)
+	if err != nil {
+		return "", err
+	}
+	env := x12Envelope{
+		ReceiverQualifier: p.ISAQualifier,
+		ReceiverID:        p.ISAID,
+		ReceiverGSID:      p.GSID,
+		FunctionalID:      "SH",
+		Version:           p.X12Version,
+		ControlNumber:     control,
+		Time:              time.Now(),
+	}
+	w := newX12Writer(defaultDelimiters)
+	defer w.release()
+	w.openEnvelope(env)
+	for i, t := range transactions {
+		if err := write856(ctx, w, p, t, fmt.Sprintf("%04d", i+1)); err != nil {
+			settleControlNumber(ctx, p.ID, control, controlVoided, "", err.Error())
+			return "", err
+		}
+	}
+	w.closeEnvelope(env, len(transactions))
+	return w.String(), nil
+}
+
+// Write one 856 transaction set (ST..SE)
+func write856(ctx context.Context, w *x12Writer, p Partner, t Transaction, setControl string) error {
+	if err := applyPartnerMap(ctx, "outbound", &t, nil); err != nil {
+		return err
+	}
+	items, err := t.Items()
+	if err != nil {
+		return err
+	}
+	required := map[string]bool{}
+	for _, s := range splitList(strings.ToUpper(p.ASNRequired)) {
+		required[s] = true
+	}
+
+	start := w.segments
+	w.seg("ST", "856", setControl)
+	w.seg("BSN", "00", shipmentID(t), t.Date.Format("20060102"), t.Date.Format("1504"), "0001")
+
+	// Shipment level
+	hl := 1
+	w.seg("HL", "1", "", "S", "1")
+	var weight float64
+	cartons := map[string]bool{}
+	for _, it := range items {
+		weight += it.Weight
+		if it.Carton != "" {
+			cartons[it.Carton] = true
+		}
+	}
+	if len(cartons) > 0 || weight > 0 {
+		packages := len(cartons)
+		if packages == 0 {
+			packages = 1
+		}
+		w.seg("TD1", "CTN25", fmt.Sprint(packages), "", "", "", "G", formatQty(weight), "LB")
+	} else if required["TD1"] {
+		return fmt.Errorf("transaction %s: partner %s requires TD1 but no carton or weight data", t.ID, p.ID)
+	}
+	if t.Carrier != "" {
+		w.seg("TD5", "B", "2", t.Carrier)
+	} else if required["TD5"] {
+		return fmt.Errorf("transaction %s: partner %s requires TD5 but no carrier", t.ID, p.ID)
+	}
+	if t.BOL != "" {
+		w.seg("REF", "BM", t.BOL)
+	} else if required["REF"] {
+		return fmt.Errorf("transaction %s: partner %s requires REF but no bill of lading", t.ID, p.ID)
+	}
+	w.seg("DTM", "011", t.Date.Format("20060102"))
+	if t.ShipTo != "" {
+		w.seg("N1", "ST", t.ShipTo)
+	} else if required["N1"] {
+		return fmt.Errorf("transaction %s: partner %s requires N1 but no ship-to", t.ID, p.ID)
+	}
+
+	// Order / (pack) / item levels, grouped in input order
+	for _, po := range groupBy(items, func(it Item) string { return it.PONumber }) {
+		hl++
+		orderHL := hl
+		w.seg("HL", fmt.Sprint(orderHL), "1", "O", "1")
+		if po.key != "" {
+			w.seg("PRF", po.key)
+		}
+		if p.ASNHierarchy == "SOI" {
+			for _, it := range po.items {
+				hl++
+				writeItem(w, hl, orderHL, it)
+			}
+			continue
+		}
+		for _, pack := range groupBy(po.items, func(it Item) string { return it.Carton }) {
+			hl++
+			packHL := hl
+			w.seg("HL", fmt.Sprint(packHL), fmt.Sprint(orderHL), "P", "1")
+			if pack.key != "" {
+				w.seg("MAN", "GM", pack.key)
+			}
+			for _, it := range pack.items {
+				hl++
+				writeItem(w, hl, packHL, it)
+			}
+		}
+	}
+
+	w.seg("CTT", fmt.Sprint(hl))
+	w.seg("SE", fmt.Sprint(w.segments-start+1), setControl)
+	return nil
+}
+
+// Write an item-level HL loop
+func writeItem(w *x12Writer, hl, parent int, it Item) {
+	w.seg("HL", fmt.Sprint(hl), fmt.Sprint(parent), "I", "0")
+	w.seg("LIN", "", "SK", it.SKU)
+	uom := it.UOM
+	if uom == "" {
+		uom = "EA"
+	}
+	w.seg("SN1", "", formatQty(it.Quantity), uom)
+	if it.Description != "" {
+		w.seg("PID", "F", "", "", "", it.Description)
+	}
+}
+
+type itemGroup struct {
+	key   string
+	items []Item
+}
+
+// Group items by key, preserving first-seen order
+func groupBy(items []Item, key func(Item) string) []itemGroup {
+	var groups []itemGroup
+	index := map[string]int{}
+	for _, it := range items {
+		k := key(it)
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, itemGroup{key: k})
+		}
+		groups[i].items = append(groups[i].items, it)
+	}
+	return groups
+}
+
+// BSN02 shipment identifier (max 30 chars)
+func shipmentID(t Transaction) string {
+	id := strings.ReplaceAll(t.ID, "-", "")
+	if len(id) > 30 {
+		id = id[:30]
+	}
+	return id
+}
+
+// Format a quantity without trailing zeros
+func formatQty(q float64) string {
+	return strconv.FormatFloat(q, 'f', -1, 64)
+}
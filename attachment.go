@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Largest supporting file accepted
+var attachmentMaxSize = int64(getEnvInt("ATTACHMENT_MAX_SIZE", 25<<20))
+
+// A supporting file attached to a transaction, e.g. a proof of delivery scan
+// or a packing list, kept in the archive store next to its raw payload.
+// Attachments are evidence, so the archive retention does not purge them.
+type Attachment struct {
+	ID            string    `json:"id" gorm:"primaryKey"`
+	TenantID      string    `json:"tenant_id" gorm:"index"`
+	TransactionID string    `json:"transaction_id" gorm:"index"`
+	FileName      string    `json:"file_name"`
+	ContentType   string    `json:"content_type"`
+	Kind          string    `json:"kind,omitempty"` // free form, e.g. pod or packing_list
+	Description   string    `json:"description,omitempty"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	StorageKey    string    `json:"-"`
+	UploadedBy    string    `json:"uploaded_by"` // actor, as in the audit log
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Read the file of an upload: the file part of a multipart/form-data body,
+// with kind and description fields, or the whole body, named by ?name=
+func readAttachment(w http.ResponseWriter, r *http.Request, a *Attachment) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, attachmentMaxSize+1<<20)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var data []byte
+	var err error
+	if mediaType == "multipart/form-data" {
+		data, err = readAttachmentForm(r, a)
+	} else {
+		q := r.URL.Query()
+		a.FileName, a.Kind, a.Description, a.ContentType = q.Get("name"), q.Get("kind"), q.Get("description"), r.Header.Get("Content-Type")
+		data, err = io.ReadAll(io.LimitReader(r.Body, attachmentMaxSize+1))
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || int64(len(data)) > attachmentMaxSize {
+		return nil, tooLargeError(attachmentMaxSize)
+	} else if err != nil {
+		return nil, &httpError{Status: http.StatusBadRequest, Message: "Failed to read upload"}
+	}
+	if len(data) == 0 {
+		return nil, &httpError{Status: http.StatusBadRequest, Message: "The attachment is empty"}
+	}
+	a.FileName = path.Base(strings.ReplaceAll(a.FileName, "\\", "/"))
+	if a.FileName == "." || a.FileName == "/" {
+		a.FileName = ""
+	}
+	if a.ContentType == "" || a.ContentType == "application/octet-stream" {
+		a.ContentType = http.DetectContentType(data)
+		if ext := path.Ext(a.FileName); ext != "" {
+			if byExt := mime.TypeByExtension(ext); byExt != "" {
+				a.ContentType = byExt
+			}
+		}
+	}
+	return data, nil
+}
+
+// Read a form upload: its kind and description fields, then its file part
+func readAttachmentForm(r *http.Request, a *Attachment) ([]byte, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, &httpError{Status: http.StatusBadRequest, Message: "Invalid multipart body"}
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, &httpError{Status: http.StatusBadRequest, Message: "No file part in the upload"}
+		} else if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			a.FileName, a.ContentType = part.FileName(), part.Header.Get("Content-Type")
+			return io.ReadAll(io.LimitReader(part, attachmentMaxSize+1))
+		}
+		v, err := io.ReadAll(io.LimitReader(part, 4096))
+		if err != nil {
+			return nil, err
+		}
+		switch part.FormName() {
+		case "kind":
+			a.Kind = string(v)
+		case "description":
+			a.Description = string(v)
+		}
+	}
+}
+
+// Attach a supporting file to a transaction
+func createAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if archive == nil {
+		writeProblem(w, "Archival is disabled, so attachments cannot be stored", http.StatusNotFound)
+		return
+	}
+	var t Transaction
+	err := db.WithContext(r.Context()).Select("id").First(&t, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch transaction", http.StatusInternalServerError)
+		return
+	}
+	a := Attachment{ID: uuid.New().String(), TransactionID: t.ID, UploadedBy: auditorFrom(r.Context()).actor}
+	data, err := readAttachment(w, r, &a)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if a.FileName == "" {
+		a.FileName = a.ID
+	}
+	if err := checkStorageQuota(r.Context(), int64(len(data))); err != nil {
+		writeError(w, err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	a.Size, a.SHA256 = int64(len(data)), hex.EncodeToString(sum[:])
+	a.StorageKey = fmt.Sprintf("attachments/%s/%s", t.ID, a.ID)
+	if err := archive.Put(r.Context(), a.StorageKey, data); err != nil {
+		log.Printf("ERROR: archive put %s: %v\n", a.StorageKey, err)
+		writeProblem(w, "Failed to store attachment", http.StatusInternalServerError)
+		return
+	}
+	if err := db.WithContext(r.Context()).Create(&a).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save attachment", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "attachment", a.ID, nil, a)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// List the files attached to a transaction, oldest first
+func listAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	attachments := []Attachment{}
+	if err := db.WithContext(r.Context()).Where("transaction_id = ?", mux.Vars(r)["id"]).Order("created_at").Find(&attachments).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch attachments", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// Download an attached file
+func getAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var a Attachment
+	err := db.WithContext(r.Context()).First(&a, "id = ? AND transaction_id = ?", vars["attachment"], vars["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch attachment", http.StatusInternalServerError)
+		return
+	}
+	if archive == nil {
+		writeProblem(w, "Archival is disabled", http.StatusNotFound)
+		return
+	}
+	rc, err := archive.Open(r.Context(), a.StorageKey)
+	if errors.Is(err, errBlobNotFound) {
+		writeProblem(w, "Attachment content is missing from the archive", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: archive open %s: %v\n", a.StorageKey, err)
+		writeProblem(w, "Failed to read attachment", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.FileName}))
+	w.Header().Set("X-Payload-SHA256", a.SHA256)
+	streamBlob(w, rc, a.StorageKey)
+}
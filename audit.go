@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Append-only record of one change: who made it, through which endpoint,
+// what it touched and the state before and after. Entries are never updated
+// or deleted; on PostgreSQL a trigger rejects both.
+type AuditEntry struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TenantID      string    `json:"tenant_id" gorm:"index"`
+	Actor         string    `json:"actor" gorm:"index"`   // X-Actor user, partner:ID, ip:address or system
+	PartnerID     string    `json:"partner_id,omitempty"` // partner owning the API key used
+	APIKey        string    `json:"api_key,omitempty"`    // fingerprint of the API key used, never the key
+	ClientIP      string    `json:"client_ip,omitempty"`
+	Method        string    `json:"method,omitempty"`
+	Endpoint      string    `json:"endpoint"` // route, e.g. /partners/{id}, or kafka, grpc, cli
+	Path          string    `json:"path,omitempty"`
+	Action        string    `json:"action" gorm:"index"`     // create, update, replay, release or request
+	ResourceType  string    `json:"resource_type,omitempty"` // partner, transaction, partner_map, ...
+	ResourceID    string    `json:"resource_id,omitempty" gorm:"index"`
+	Before        string    `json:"-" gorm:"serializer:encrypted"` // JSON state before the change
+	After         string    `json:"-" gorm:"serializer:encrypted"` // JSON state after the change
+	Status        int       `json:"status,omitempty"`              // HTTP status of the request
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at" gorm:"index"`
+
+	BeforeState json.RawMessage `json:"before,omitempty" gorm:"-"`
+	AfterState  json.RawMessage `json:"after,omitempty" gorm:"-"`
+}
+
+// Audit actions
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditReplay  = "replay"
+	auditRelease = "release"
+	auditRequest = "request" // a mutating request that recorded no change, e.g. a rejected one
+)
+
+// Create or update, for saves that replace what existed
+func auditAction(existed bool) string {
+	if existed {
+		return auditUpdate
+	}
+	return auditCreate
+}
+
+// Who is behind a request or background task, and the entries it recorded.
+// A request's entries are written together when it ends so they carry its
+// status; later ones (async jobs) are written as they come.
+type auditor struct {
+	actor, partner, apiKey, ip string
+	method, endpoint, path     string
+
+	mu      sync.Mutex
+	entries []AuditEntry
+	done    bool
+}
+
+type auditorKey struct{}
+
+func withAuditor(ctx context.Context, a *auditor) context.Context {
+	return context.WithValue(ctx, auditorKey{}, a)
+}
+
+// Auditor of ctx; work outside any request is recorded as the system
+func auditorFrom(ctx context.Context) *auditor {
+	if a, ok := ctx.Value(auditorKey{}).(*auditor); ok {
+		return a
+	}
+	return &auditor{actor: "system", done: true}
+}
+
+// Auditor for background work, e.g. the Kafka consumer or the CLI
+func systemAuditor(actor, endpoint string) *auditor {
+	return &auditor{actor: actor, endpoint: endpoint, done: true}
+}
+
+// Who is making a request: X-Actor from the admin proxy, else the partner
+// owning the API key, else the client address
+func requestActor(r *http.Request) (actor, partner, apiKey string) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		partner = limiter.limitFor(key, time.Now()).partner
+		apiKey = keyFingerprint(key)
+	}
+	switch {
+	case r.Header.Get("X-Actor") != "":
+		actor = r.Header.Get("X-Actor")
+	case partner != "":
+		actor = "partner:" + partner
+	default:
+		actor = "ip:" + clientIP(r)
+	}
+	return actor, partner, apiKey
+}
+
+// Short stable fingerprint of a secret, enough to tell keys apart
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// Record a change to a resource. before and after are marshalled to JSON;
+// nil leaves them empty. API keys in them are replaced by their fingerprint.
+func auditChange(ctx context.Context, action, resourceType, resourceID string, before, after interface{}) {
+	a := auditorFrom(ctx)
+	e := a.entry(ctx, action)
+	e.ResourceType, e.ResourceID = resourceType, resourceID
+	e.Before, e.After = auditState(before), auditState(after)
+	a.mu.Lock()
+	if !a.done {
+		a.entries = append(a.entries, e)
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+	writeAuditEntries(ctx, []AuditEntry{e})
+}
+
+func (a *auditor) entry(ctx context.Context, action string) AuditEntry {
+	return AuditEntry{
+		Actor: a.actor, PartnerID: a.partner, APIKey: a.apiKey, ClientIP: a.ip,
+		Method: a.method, Endpoint: a.endpoint, Path: a.path, Action: action,
+		CorrelationID: correlationID(ctx),
+	}
+}
+
+func auditState(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("ERROR: audit state: %v\n", err)
+		return ""
+	}
+	if string(b) == "null" {
+		return "" // typed nil, e.g. a profile that did not exist
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(b, &fields) == nil {
+		changed := false
+		if key, ok := fields["api_key"].(string); ok && key != "" {
+			fields["api_key"], changed = keyFingerprint(key), true
+		}
+		if secret, ok := fields["signing_secret"].(string); ok && secret != "" && secret != passwordMask {
+			fields["signing_secret"], changed = passwordMask, true
+		}
+		if changed {
+			b, _ = json.Marshal(fields)
+		}
+	}
+	return string(b)
+}
+
+func writeAuditEntries(ctx context.Context, entries []AuditEntry) {
+	if db == nil || len(entries) == 0 {
+		return
+	}
+	if err := db.WithContext(ctx).CreateInBatches(&entries, 500).Error; err != nil {
+		log.Printf("ERROR: audit: %v\n", err)
+	}
+}
+
+// Response writer keeping the status for the audit log
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Record every POST, PUT, PATCH and DELETE in the audit log, with the changes
+// its handler reported or, when there are none, the request alone
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		endpoint := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				endpoint = tmpl
+			}
+		}
+		actor, partner, apiKey := requestActor(r)
+		a := &auditor{actor: actor, partner: partner, apiKey: apiKey, ip: clientIP(r),
+			method: r.Method, endpoint: endpoint, path: r.URL.Path}
+		aw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(withAuditor(r.Context(), a)))
+
+		a.mu.Lock()
+		a.done = true
+		entries := a.entries
+		a.mu.Unlock()
+		if len(entries) == 0 {
+			entries = []AuditEntry{a.entry(r.Context(), auditRequest)}
+		}
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		for i := range entries {
+			entries[i].Status = status
+		}
+		writeAuditEntries(r.Context(), entries)
+	})
+}
+
+const maxAuditPage = 1000
+
+// List audit entries, newest first. Filters: actor, partner_id, action,
+// resource_type, resource_id, transaction_id, endpoint, from, to (RFC 3339),
+// before (an entry ID, for paging) and limit (default 100).
+func listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := db.WithContext(r.Context()).Order("id DESC")
+	for param, column := range map[string]string{"actor": "actor", "partner_id": "partner_id", "action": "action",
+		"resource_type": "resource_type", "resource_id": "resource_id", "endpoint": "endpoint"} {
+		if v := q.Get(param); v != "" {
+			query = query.Where(column+" = ?", v)
+		}
+	}
+	if id := q.Get("transaction_id"); id != "" {
+		query = query.Where("resource_type = ? AND resource_id = ?", "transaction", id)
+	}
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if v := q.Get(param); v != "" {
+			ts, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeProblem(w, param+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			query = query.Where("created_at "+op+" ?", ts)
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeProblem(w, "before must be an entry ID", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("id < ?", id)
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeProblem(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxAuditPage {
+		limit = maxAuditPage
+	}
+	entries := []AuditEntry{}
+	if err := query.Limit(limit).Find(&entries).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	for i := range entries {
+		if entries[i].Before != "" {
+			entries[i].BeforeState = json.RawMessage(entries[i].Before)
+		}
+		if entries[i].After != "" {
+			entries[i].AfterState = json.RawMessage(entries[i].After)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Seeding a new deployment: historical files from a directory or an S3
+// bucket go through the inbound pipeline as if they had just been received
+
+// File of a backfill source
+type backfillFile struct {
+	name string // path, or s3://bucket/key
+	size int64
+	open func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Files under each source, in name order. A source is a file, a directory
+// (walked recursively, skipping dot files) or s3://bucket/prefix using the
+// S3_* credentials.
+func listBackfillFiles(ctx context.Context, sources []string) ([]backfillFile, error) {
+	var files []backfillFile
+	for _, src := range sources {
+		if rest, ok := strings.CutPrefix(src, "s3://"); ok {
+			bucket, prefix, _ := strings.Cut(rest, "/")
+			store := newS3Store()
+			store.bucket = bucket
+			objects, err := store.list(ctx, prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range objects {
+				if strings.HasSuffix(o.Key, "/") {
+					continue // folder placeholder
+				}
+				key := o.Key
+				files = append(files, backfillFile{
+					name: "s3://" + bucket + "/" + key,
+					size: o.Size,
+					open: func(ctx context.Context) (io.ReadCloser, error) { return store.Open(ctx, key) },
+				})
+			}
+			continue
+		}
+		err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != src && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files = append(files, backfillFile{
+				name: path,
+				size: info.Size(),
+				open: func(context.Context) (io.ReadCloser, error) { return os.Open(path) },
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Run one file through the pipeline. Large X12 files are streamed like big
+// /inbound requests.
+func backfillOne(ctx context.Context, f backfillFile, contentType string) []batchResult {
+	rc, err := f.open(ctx)
+	if err != nil {
+		return []batchResult{{File: f.name, Status: "failed", Error: err.Error()}}
+	}
+	defer rc.Close()
+	br := bufio.NewReaderSize(rc, 64<<10)
+	head, _ := br.Peek(512)
+	if f.size > inboundStreamThreshold && detectFormat(contentType, head) == formatX12 {
+		return processX12Stream(ctx, f.name, contentType, br, f.size)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(br); err != nil {
+		return []batchResult{{File: f.name, Status: "failed", Error: err.Error()}}
+	}
+	return processDocument(ctx, nil, f.name, contentType, buf.Bytes())
+}
+
+// Counters of a backfill run, shared by its workers
+type backfillProgress struct {
+	total        int
+	files        atomic.Int64
+	bytes        atomic.Int64
+	transactions atomic.Int64
+	failed       atomic.Int64
+	started      time.Time
+}
+
+func (p *backfillProgress) String() string {
+	files := p.files.Load()
+	elapsed := time.Since(p.started)
+	rate := float64(files) / elapsed.Seconds()
+	eta := "-"
+	if files > 0 && int(files) < p.total {
+		eta = time.Duration(float64(int64(p.total)-files) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%d/%d files, %d MiB, %d transactions (%d failed), %.1f files/s, ETA %s",
+		files, p.total, p.bytes.Load()>>20, p.transactions.Load(), p.failed.Load(), rate, eta)
+}
+
+// Files already backfilled, one name per line, so an interrupted run can be
+// resumed without ingesting anything twice
+type backfillState struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+func openBackfillState(path string) (*backfillState, error) {
+	s := &backfillState{done: map[string]bool{}}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			s.done[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+func (s *backfillState) record(name string) error {
+	if s.file == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintln(s.file, name)
+	return err
+}
+
+func (s *backfillState) close() {
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+func backfillCommand(fs *flag.FlagSet, args []string) error {
+	var tenant, partner, contentType, statePath string
+	fs.StringVar(&tenant, "tenant", defaultTenant, "Tenant the files are ingested for")
+	fs.StringVar(&partner, "partner", "", "Partner that sent the files, for formats that do not name their sender")
+	fs.StringVar(&contentType, "content-type", "", "Content-Type to assume when the format cannot be sniffed")
+	fs.StringVar(&statePath, "state", "", "File recording backfilled files; a rerun with the same file skips them")
+	noDeliver := fs.Bool("no-deliver", false, "Save and index transactions without publishing events or filling partner inboxes")
+	rate := fs.Float64("rate", 0, "Most files started per second (0 is unlimited)")
+	workers := fs.Int("workers", 1, "Files processed at once")
+	every := fs.Duration("progress", 10*time.Second, "How often progress is printed to stderr")
+	actor := fs.String("actor", "cli:"+getEnv("USER", "unknown"), "Actor recorded in the audit log")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no sources given")
+	}
+	if *workers < 1 {
+		return errors.New("--workers must be positive")
+	}
+	if *rate < 0 {
+		return errors.New("--rate must not be negative")
+	}
+	if !knownTenant(tenant) {
+		return fmt.Errorf("unknown tenant %s", tenant)
+	}
+
+	if err := openDB(); err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := initArchive(); err != nil {
+		return fmt.Errorf("failed to initialize archive: %w", err)
+	}
+	if !*noDeliver && !edgeMode {
+		if err := initKafka(); err != nil {
+			return fmt.Errorf("failed to initialize Kafka: %w", err)
+		}
+	}
+	ctx := withoutSignatureCheck(withAuditor(withTenant(context.Background(), tenant), systemAuditor(*actor, "backfill")))
+	if partner != "" {
+		ctx = withPartnerHint(ctx, partner)
+	}
+	if *noDeliver {
+		ctx = withoutDelivery(ctx)
+	}
+
+	state, err := openBackfillState(statePath)
+	if err != nil {
+		return err
+	}
+	defer state.close()
+	listed, err := listBackfillFiles(ctx, fs.Args())
+	if err != nil {
+		return err
+	}
+	var files []backfillFile
+	for _, f := range listed {
+		if !state.done[f.name] {
+			files = append(files, f)
+		}
+	}
+	if skipped := len(listed) - len(files); skipped > 0 {
+		fmt.Fprintf(os.Stderr, "backfill: skipping %d files already done\n", skipped)
+	}
+
+	// An interrupt stops starting new files; those in progress finish and are
+	// recorded so the run can be resumed
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	var throttle <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	progress := &backfillProgress{total: len(files), started: time.Now()}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fmt.Fprintf(os.Stderr, "backfill: %s\n", progress)
+			}
+		}
+	}()
+
+	queue := make(chan backfillFile)
+	var wg sync.WaitGroup
+	var out sync.Mutex
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				results := backfillOne(ctx, f, contentType)
+				failed := 0
+				out.Lock()
+				for _, res := range results {
+					if res.Status == "failed" {
+						failed++
+						fmt.Printf("%s: %s %s: %s\n", f.name, res.Type, res.ControlNumber, res.Error)
+					}
+				}
+				out.Unlock()
+				progress.transactions.Add(int64(len(results)))
+				progress.failed.Add(int64(failed))
+				progress.bytes.Add(f.size)
+				progress.files.Add(1)
+				if err := state.record(f.name); err != nil {
+					fmt.Fprintf(os.Stderr, "backfill: state: %v\n", err)
+				}
+			}
+		}()
+	}
+dispatch:
+	for _, f := range files {
+		if throttle != nil {
+			select {
+			case <-stop.Done():
+				break dispatch
+			case <-throttle:
+			}
+		}
+		select {
+		case <-stop.Done():
+			break dispatch
+		case queue <- f:
+		}
+	}
+	close(queue)
+	wg.Wait()
+	close(done)
+	fmt.Printf("backfill: %s in %s\n", progress, time.Since(progress.started).Round(time.Second))
+	if stop.Err() != nil {
+		return errors.New("interrupted; rerun with the same --state to resume")
+	}
+	if progress.failed.Load() > 0 {
+		return errFailures
+	}
+	return nil
+}
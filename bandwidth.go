@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Bandwidth caps of outbound deliveries in bytes per second, so large
+// pushes do not saturate an uplink shared with other systems: over
+// everything this replica delivers, and over each delivery channel. Partners
+// may cap their own deliveries further with delivery_bandwidth. 0 leaves
+// the cap off.
+var (
+	deliveryBandwidth     = getEnvInt("DELIVERY_BANDWIDTH", 0)
+	deliveryBandwidthHTTP = getEnvInt("DELIVERY_BANDWIDTH_HTTP", 0)
+	deliveryBandwidthAS2  = getEnvInt("DELIVERY_BANDWIDTH_AS2", 0)
+)
+
+// Delivery over plain HTTP; AS2 deliveries use channelAS2
+const deliveryHTTP = "http"
+
+// Bytes sent between two waits for bandwidth
+const bandwidthChunk = 32 << 10
+
+var deliveryThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_delivery_throttled_seconds_total",
+	Help: "Time deliveries waited for bandwidth under the delivery caps.",
+}, []string{"channel", "partner"})
+
+// Token buckets of the caps, in bytes, each holding up to a second's worth
+type bandwidthCaps struct {
+	total    *tokenBucket
+	channels map[string]*tokenBucket
+
+	mu       sync.Mutex
+	partners map[string]*tokenBucket // tenant/partner
+}
+
+var deliveryCaps = newBandwidthCaps(deliveryBandwidth, map[string]int{deliveryHTTP: deliveryBandwidthHTTP, channelAS2: deliveryBandwidthAS2})
+
+func newBandwidthCaps(total int, channels map[string]int) *bandwidthCaps {
+	c := &bandwidthCaps{total: bandwidthBucket(total), channels: map[string]*tokenBucket{}, partners: map[string]*tokenBucket{}}
+	for channel, rate := range channels {
+		c.channels[channel] = bandwidthBucket(rate)
+	}
+	return c
+}
+
+// Bucket for a cap, nil when there is none
+func bandwidthBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < bandwidthChunk {
+		burst = bandwidthChunk
+	}
+	return newTokenBucket(float64(rate), burst)
+}
+
+// Channel deliveries to p go over
+func deliveryChannel(p Partner) string {
+	if p.AS2ID != "" {
+		return channelAS2
+	}
+	return deliveryHTTP
+}
+
+// Buckets a delivery to p draws from; the partner's bucket is replaced
+// when its cap changed
+func (c *bandwidthCaps) buckets(ctx context.Context, p Partner) []*tokenBucket {
+	var list []*tokenBucket
+	for _, b := range []*tokenBucket{c.total, c.channels[deliveryChannel(p)]} {
+		if b != nil {
+			list = append(list, b)
+		}
+	}
+	key := tenantID(ctx) + "/" + p.ID
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.partners[key]
+	if p.DeliveryBandwidth <= 0 {
+		delete(c.partners, key)
+		return list
+	}
+	if b == nil || b.rate != float64(p.DeliveryBandwidth) {
+		b = bandwidthBucket(p.DeliveryBandwidth)
+		c.partners[key] = b
+	}
+	return append(list, b)
+}
+
+// Request body sent no faster than its buckets allow
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*tokenBucket
+	waited  prometheus.Counter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := t.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	var wait time.Duration
+	now := time.Now()
+	for _, b := range t.buckets {
+		if d := b.reserve(float64(n), now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		t.waited.Add(wait.Seconds())
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
+
+// Throttle the body of a delivery request to p under the delivery caps and
+// return the client to send it with: its timeout is extended by the time
+// the tightest cap needs for the payload
+func throttleDelivery(ctx context.Context, req *http.Request, p Partner, payload []byte) *http.Client {
+	buckets := deliveryCaps.buckets(ctx, p)
+	if len(buckets) == 0 {
+		return deliveryClient
+	}
+	waited := deliveryThrottled.WithLabelValues(deliveryChannel(p), p.ID)
+	body := func() io.ReadCloser {
+		return io.NopCloser(&throttledReader{ctx: ctx, r: bytes.NewReader(payload), buckets: buckets, waited: waited})
+	}
+	req.Body = body()
+	req.GetBody = func() (io.ReadCloser, error) { return body(), nil }
+	slowest := buckets[0].rate
+	for _, b := range buckets[1:] {
+		if b.rate < slowest {
+			slowest = b.rate
+		}
+	}
+	client := *deliveryClient
+	if client.Timeout > 0 {
+		client.Timeout += time.Duration(float64(len(payload)) / slowest * float64(time.Second))
+	}
+	return &client
+}
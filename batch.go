@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Outcome for one transaction of a batch submission
+type batchResult struct {
+	File               string            `json:"file,omitempty"`
+	Format             string            `json:"format,omitempty"`
+	InterchangeControl string            `json:"interchange_control,omitempty"`
+	ControlNumber      string            `json:"control_number,omitempty"`
+	Type               string            `json:"type,omitempty"`
+	ID                 string            `json:"id,omitempty"`
+	Status             string            `json:"status"` // created, held, failed, or validated for sandbox partners
+	Error              string            `json:"error,omitempty"`
+	Code               string            `json:"code,omitempty"`        // error code, as in problem responses
+	Findings           []snipFinding     `json:"findings,omitempty"`    // of HIPAA sets failing SNIP validation
+	Annotations        []fieldAnnotation `json:"annotations,omitempty"` // with mapping debug on
+	TA1Note            string            `json:"ta1_note,omitempty"`    // of an interchange rejected at its envelope
+	RejectionID        string            `json:"rejection_id,omitempty"`
+
+	skipAck bool   // a document rule turned its interchange's acknowledgment off
+	ta1     string // answering an interchange rejected at its envelope
+}
+
+// Accept one or more documents in the body, or as parts of a multipart/mixed
+// or multipart/form-data upload, and process every transaction on its own.
+// X12, EDIFACT, JSON and XML payloads are recognised whatever their declared
+// Content-Type. Multipart uploads are recorded as a submission linking the
+// transactions they create (X-Submission-ID).
+// Responds 200 when all sets succeed and 207 Multi-Status otherwise, or 202
+// with a job when asynchronous processing is requested.
+func batchInboundHandler(w http.ResponseWriter, r *http.Request) {
+	if sandboxRequest(r) {
+		sandboxInboundHandler(w, r)
+		return
+	}
+	inboundCounter.WithLabelValues(tenantID(r.Context())).Inc()
+
+	var files []jobFile
+	var sub *Submission
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		// Every part is held in memory until the upload is processed
+		r.Body = http.MaxBytesReader(w, r.Body, inboundMaxBuffered)
+		var err error
+		if files, sub, err = readSubmission(r, mediaType == "multipart/mixed"); err != nil {
+			writeError(w, err)
+			return
+		}
+		if queueInbound() {
+			w.Header().Set("X-Submission-ID", sub.ID)
+			acceptQueued(w, r, sub, files, false)
+			return
+		}
+		if err := db.WithContext(r.Context()).Create(sub).Error; err != nil {
+			log.Printf("ERROR: %v\n", err)
+			writeProblem(w, "Failed to save submission", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Submission-ID", sub.ID)
+	}
+
+	if sub == nil && queueInbound() {
+		in, err := readInbound(w, r, false)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer in.release()
+		acceptQueued(w, r, nil, []jobFile{newJobFile("", r.Header.Get("Content-Type"), in.buf.Bytes())}, false)
+		return
+	}
+
+	if wantsAsync(r) {
+		if sub == nil {
+			in, err := readInbound(w, r, false)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			files = []jobFile{newJobFile("", r.Header.Get("Content-Type"), in.buf.Bytes())}
+			in.release()
+		}
+		callback, err := callbackURL(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		job, err := enqueueJob(r.Context(), jobBatch, sub, files, callback)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		acceptJob(w, job)
+		return
+	}
+
+	var results []batchResult
+	if sub == nil {
+		in, err := readInbound(w, r, true)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if in.stream != nil {
+			results = processX12Stream(detachedContext(r), "", r.Header.Get("Content-Type"), in.stream, r.ContentLength)
+		} else {
+			results = processDocument(detachedContext(r), nil, "", r.Header.Get("Content-Type"), in.buf.Bytes())
+		}
+		in.release()
+	}
+	for _, f := range files {
+		results = append(results, processDocument(detachedContext(r), sub, f.name, f.contentType, f.data)...)
+	}
+	writeBatchResults(w, results)
+}
+
+// Respond 200 when every transaction was created (or validated) and 207
+// Multi-Status otherwise
+func writeBatchResults(w http.ResponseWriter, results []batchResult) {
+	status := http.StatusOK
+	for _, res := range results {
+		if res.Status != "created" && res.Status != "validated" {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// Detect the format of one uploaded payload, split it and run each
+// transaction through the pipeline. sub, when set, links the transactions to
+// their submission.
+func processDocument(ctx context.Context, sub *Submission, file, contentType string, data []byte) []batchResult {
+	format := detectFormat(contentType, data)
+	partnerID := partnerHint(ctx)
+	if sub != nil && sub.PartnerID != "" {
+		partnerID = sub.PartnerID
+	}
+	split, err := splitDocument(ctx, format, partnerID, data, time.Now())
+	var envErr *envelopeError
+	if errors.As(err, &envErr) {
+		return []batchResult{rejectInterchange(ctx, file, contentType, data, envErr)}
+	} else if err != nil {
+		return []batchResult{{File: file, Format: format, Status: "failed", Error: err.Error(), Code: resultCode(err)}}
+	}
+	if len(split) == 0 {
+		return []batchResult{{File: file, Format: format, Status: "failed", Error: "no transactions found", Code: codeValidationFailed}}
+	}
+	format = split[0].Transaction.Format // text/plain resolves to a flat file format
+
+	// Assign IDs up front so the interchange is archived once for all sampled
+	// sets, and check for duplicates before any set is saved
+	var ids []string
+	archived := map[string]bool{}
+	dups := map[string]error{}
+	validated := map[int]batchResult{} // sets of sandbox partners, never saved
+	for i := range split {
+		t := &split[i].Transaction
+		if sub != nil && split[i].Err == nil {
+			t.SubmissionID = sub.ID
+			if t.PartnerID == "" {
+				t.PartnerID = sub.PartnerID
+			}
+		}
+		if res, ok := validateSandboxed(ctx, split[i], file, format); ok {
+			validated[i] = res
+			continue
+		}
+		if split[i].Err == nil {
+			if split[i].Err = checkDuplicateInterchange(ctx, *t, dups); split[i].Err != nil {
+				continue
+			}
+			newInboundTransaction(ctx, t, t.Date)
+			if sampleArchive(ctx, t.PartnerID, t.ID) {
+				ids = append(ids, t.ID)
+				archived[t.ID] = true
+			}
+		}
+	}
+	archiveErr := archivePayload(ctx, "inbound", contentType, data, ids...)
+	if archiveErr != nil {
+		log.Printf("ERROR: archive: %v\n", archiveErr)
+	}
+
+	results := make([]batchResult, len(split))
+	limited := make([]bool, len(split))
+	bulk := bulkInsertMinSets > 0 && len(split)-len(validated) >= bulkInsertMinSets
+	var saving []*Transaction // with bulk, the sets passing their checks
+	var saved []int
+	for i, s := range split {
+		if res, ok := validated[i]; ok {
+			results[i] = res
+			continue
+		}
+		if archiveErr != nil && archived[s.Transaction.ID] && s.Err == nil {
+			s.Err = errArchiveFailed
+		}
+		if !bulk {
+			results[i], limited[i] = admitSplit(ctx, s, file, format, len(data))
+			continue
+		}
+		t := &split[i].Transaction
+		results[i] = splitResultFor(file, format, *t)
+		var err error
+		if limited[i], err = checkSplit(ctx, t, s.Err, len(data)); err != nil {
+			setOutcome(&results[i], *t, err)
+			continue
+		}
+		saving, saved = append(saving, t), append(saved, i)
+	}
+	for j, err := range processTransactions(ctx, saving) {
+		setOutcome(&results[saved[j]], *saving[j], err)
+	}
+	var failed []string
+	for i, res := range results {
+		// Documents over a guardrail are not archived so a flood cannot fill the store
+		if id := split[i].Transaction.ID; res.Status == "failed" && id != "" && !archived[id] && !limited[i] {
+			failed = append(failed, id)
+		}
+	}
+
+	// Failures are always kept for debugging, even when sampled out
+	if err := archivePayload(ctx, "inbound", contentType, data, failed...); err != nil {
+		log.Printf("ERROR: archive: %v\n", err)
+	}
+	return results
+}
+
+var errArchiveFailed = errors.New("failed to archive payload")
+
+// How long a partner may not reuse an X12 interchange control number
+// (ISA13); 0, the default, accepts repeats
+var duplicateInterchangeWindow = getEnvDuration("DUPLICATE_INTERCHANGE_WINDOW", 0)
+
+// Reject a set whose interchange its partner already sent within the window.
+// seen caches the answer per interchange of the payload, so its first set
+// being saved does not make the others duplicates.
+func checkDuplicateInterchange(ctx context.Context, t Transaction, seen map[string]error) error {
+	if duplicateInterchangeWindow <= 0 || t.Format != formatX12 || t.PartnerID == "" || t.InterchangeControl == "" {
+		return nil
+	}
+	key := t.PartnerID + "/" + t.InterchangeControl
+	if err, ok := seen[key]; ok {
+		return err
+	}
+	var earlier []string
+	err := db.WithContext(ctx).Model(&Transaction{}).Select("id").
+		Where("partner_id = ? AND interchange_control = ? AND format = ? AND date >= ?", t.PartnerID, t.InterchangeControl, formatX12, time.Now().Add(-duplicateInterchangeWindow)).
+		Limit(1).Find(&earlier).Error
+	if err != nil {
+		log.Printf("ERROR: duplicate check: %v\n", err)
+	} else if len(earlier) > 0 {
+		seen[key] = &httpError{Status: http.StatusConflict, Code: codeDuplicateInterchange,
+			Message: fmt.Sprintf("interchange %s was already received from partner %s", t.InterchangeControl, t.PartnerID)}
+	} else {
+		seen[key] = nil
+	}
+	return seen[key]
+}
+
+// Code reported with a failed result
+func resultCode(err error) string {
+	if code := errorCode(err); code != "" {
+		return code
+	}
+	var snip *snipError
+	switch {
+	case errors.As(err, &snip):
+		return codeSNIPFailed
+	case isTimeout(err):
+		return codeDownstreamTimeout
+	case errors.Is(err, errPublishFailed):
+		return codeDownstreamFailed
+	case errors.Is(err, errSaveFailed), errors.Is(err, errArchiveFailed):
+		return codeInternal
+	}
+	return codeValidationFailed
+}
+
+// Result of a split transaction before it is run
+func splitResultFor(file, format string, t Transaction) batchResult {
+	return batchResult{
+		File:               file,
+		Format:             format,
+		InterchangeControl: t.InterchangeControl,
+		ControlNumber:      t.ControlNumber,
+		Type:               t.Type,
+		Status:             "failed",
+	}
+}
+
+// Run a split transaction, whose split failed with splitErr if at all,
+// through the checks before it is saved and publish its failure. limited
+// reports a guardrail violation.
+func checkSplit(ctx context.Context, t *Transaction, splitErr error, size int) (limited bool, err error) {
+	err = splitErr
+	if err == nil {
+		err = checkPartnerActive(ctx, t)
+	}
+	if err == nil {
+		err = checkSender(ctx, t)
+	}
+	if err == nil {
+		err = checkSignatureRequired(ctx, t)
+	}
+	if err == nil {
+		if err = checkTenantQuotas(ctx); err != nil {
+			limited = true
+		}
+	}
+	if err == nil {
+		err = applyDocumentRules(ctx, t)
+	}
+	if err == nil {
+		if err = applyGuardrails(ctx, t, size); err != nil {
+			limited = true
+		}
+	}
+	if err == nil {
+		err = prePersistHooks(ctx, t)
+	}
+	if err != nil {
+		publishFailure(ctx, *t, err)
+	}
+	return limited, err
+}
+
+// Record how a split transaction ended in its result
+func setOutcome(res *batchResult, t Transaction, err error) {
+	res.skipAck = t.skipAck
+	switch {
+	case err != nil:
+		res.Error, res.Code, res.Findings = err.Error(), resultCode(err), snipFindings(err)
+	case t.Status == statusHeld:
+		res.ID = t.ID
+		res.Status = "held"
+	default:
+		res.ID = t.ID
+		res.Status = "created"
+	}
+}
+
+// Run one split transaction through the guardrails and the pipeline. limited
+// reports a guardrail violation.
+func admitSplit(ctx context.Context, s splitResult, file, format string, size int) (res batchResult, limited bool) {
+	t := s.Transaction
+	res = splitResultFor(file, format, t)
+	limited, err := checkSplit(ctx, &t, s.Err, size)
+	if err == nil {
+		if err = processTransaction(ctx, &t); err != nil {
+			log.Printf("ERROR: %v\n", err)
+			publishFailure(ctx, t, err)
+		}
+	}
+	setOutcome(&res, t, err)
+	return res, limited
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// Buffered payloads of at least BULK_INSERT_MIN_SETS transactions (0 never)
+// are saved in one database transaction instead of one per transaction.
+// Rows are inserted BULK_INSERT_BATCH at a time, line items of single
+// transactions included.
+var (
+	bulkInsertMinSets = getEnvInt("BULK_INSERT_MIN_SETS", 50)
+	bulkInsertBatch   = getEnvInt("BULK_INSERT_BATCH", 500)
+)
+
+// Persist and publish the transactions of one payload like
+// processTransaction does, saving them, their received events, their outbox
+// events and their line items together: either all are saved or, with the error of every
+// one, none. Failures are published.
+func processTransactions(ctx context.Context, txs []*Transaction) []error {
+	errs := make([]error, len(txs))
+	if len(txs) == 0 {
+		return errs
+	}
+	version := processingConfigVersion(ctx)
+	for _, t := range txs {
+		t.SearchText = searchText(*t)
+		t.ConfigVersion = version
+	}
+	save := func() error {
+		// Rows and their keys are built on every attempt: a rolled back
+		// insert leaves its generated IDs behind
+		events := make([]TransactionEvent, len(txs))
+		var items []LineItem
+		for i, t := range txs {
+			events[i] = newTransactionEvent(ctx, t.ID, txEventReceived, t.Status, receivedDelta(*t))
+			if itemsStorage == itemsJSON {
+				continue
+			}
+			if rows, err := lineItemRows(t); err == nil {
+				items = append(items, rows...) // invalid lists stay as received
+			}
+		}
+		return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			// Line items all go in one insert below, not per transaction
+			if err := tx.Session(&gorm.Session{SkipHooks: true}).CreateInBatches(txs, bulkInsertBatch).Error; err != nil {
+				return err
+			}
+			if err := tx.CreateInBatches(&events, bulkInsertBatch).Error; err != nil {
+				return err
+			}
+			var outbox []EventOutbox
+			for _, t := range txs {
+				e, err := stageEvent(ctx, *t)
+				if err != nil {
+					return err
+				}
+				if t.event = e; e != nil {
+					outbox = append(outbox, e.row)
+				}
+			}
+			if len(outbox) > 0 {
+				if err := tx.CreateInBatches(&outbox, bulkInsertBatch).Error; err != nil {
+					return err
+				}
+			}
+			if len(items) == 0 {
+				return nil
+			}
+			return tx.CreateInBatches(&items, bulkInsertBatch).Error
+		})
+	}
+	if err := withDBRetry(ctx, save); err != nil {
+		err = fmt.Errorf("%w: %w", errSaveFailed, err)
+		log.Printf("ERROR: saving %d transactions: %v\n", len(txs), err)
+		for i, t := range txs {
+			errs[i] = err
+			publishFailure(ctx, *t, err)
+		}
+		return errs
+	}
+	for i, t := range txs {
+		if errs[i] = transactionSaved(ctx, t); errs[i] != nil {
+			log.Printf("ERROR: %v\n", errs[i])
+			publishFailure(ctx, *t, errs[i])
+		}
+	}
+	return errs
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A gateway on SQLite and the memory publisher writing line item rows, as
+// the bulk save only differs from the per-set one with them
+func startBulkGateway(tb testing.TB) {
+	setForTest(tb, &databaseDriver, "sqlite")
+	setForTest(tb, &eventsBackend, "memory")
+	setForTest(tb, &itemsStorage, itemsDualWrite)
+	tb.Setenv("DATABASE_DSN", filepath.Join(tb.TempDir(), "edi.db"))
+	startGateway(tb)
+}
+
+// n received 856s with IDs prefix-0.. and a few items each
+func bulkTransactions(prefix string, n int) []*Transaction {
+	txs := make([]*Transaction, n)
+	for i := range txs {
+		items, _ := json.Marshal([]Item{
+			{SKU: fmt.Sprint("SKU-", i), Quantity: 4, UOM: "EA", Carton: "00012345670000000001"},
+			{SKU: "SKU-X", Description: "Widget", Quantity: 1.5, UOM: "CS", PONumber: "PO-1", Weight: 2.25},
+		})
+		txs[i] = &Transaction{
+			ID: fmt.Sprintf("%s-%d", prefix, i), PartnerID: "acme", Type: "856", Format: "x12",
+			Status: "Processed", Date: time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC),
+			BOL: fmt.Sprint("BOL-", i), ShipTo: "Store 12", Carrier: "UPSN", ItemList: string(items),
+		}
+	}
+	return txs
+}
+
+// What saving and publishing a transaction left behind, less its own IDs
+type savedEffects struct {
+	Items  []LineItem
+	Events []TransactionEvent
+	Audit  []string
+	Topics []string
+}
+
+func effectsOf(t *testing.T, id string) savedEffects {
+	t.Helper()
+	db := db.WithContext(withTenant(context.Background(), defaultTenant))
+	var e savedEffects
+	if err := db.Where("transaction_id = ?", id).Order("line").Find(&e.Items).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range e.Items {
+		e.Items[i].ID, e.Items[i].TransactionID = 0, ""
+	}
+	if err := db.Where("transaction_id = ?", id).Order("id").Find(&e.Events).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range e.Events {
+		e.Events[i].ID, e.Events[i].TransactionID, e.Events[i].CreatedAt = 0, "", time.Time{}
+	}
+	var audit []AuditEntry
+	if err := db.Where("resource_id = ?", id).Order("id").Find(&audit).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range audit {
+		e.Audit = append(e.Audit, a.Actor+" "+a.Action+" "+a.ResourceType)
+	}
+	for _, pe := range publisher.(*memoryPublisher).list(-1, "", "", defaultTenant, memoryEventsMax) {
+		var about struct {
+			Data struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(pe.Value, &about) == nil && about.Data.ID == id {
+			e.Topics = append(e.Topics, pe.Topic+" "+pe.Headers["event_type"])
+		}
+	}
+	return e
+}
+
+// A bulk save leaves the same rows, audit entries and events as saving the
+// sets one at a time; line items in particular, which the per-set path
+// writes from Transaction.AfterCreate and the bulk one itself
+func TestProcessTransactionsMatchesPerSet(t *testing.T) {
+	startBulkGateway(t)
+	ctx := withTenant(context.Background(), defaultTenant)
+	bulk, single := bulkTransactions("bulk", 5), bulkTransactions("single", 5)
+	for i, err := range processTransactions(ctx, bulk) {
+		if err != nil {
+			t.Fatalf("bulk %d: %v", i, err)
+		}
+	}
+	for i, tx := range single {
+		if err := processTransaction(ctx, tx); err != nil {
+			t.Fatalf("single %d: %v", i, err)
+		}
+	}
+	for i := range bulk {
+		got, want := effectsOf(t, bulk[i].ID), effectsOf(t, single[i].ID)
+		if len(want.Items) != 2 || len(want.Events) != 1 || len(want.Audit) == 0 || len(want.Topics) == 0 {
+			t.Fatalf("per-set save left too little to compare: %+v", want)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("set %d: bulk save left\n%+v\nper-set save\n%+v", i, got, want)
+		}
+		var saved Transaction
+		if err := db.WithContext(ctx).First(&saved, "id = ?", bulk[i].ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if saved.Status != single[i].Status || saved.SearchText != single[i].SearchText || saved.ConfigVersion != single[i].ConfigVersion || saved.TenantID != single[i].TenantID {
+			t.Errorf("set %d: bulk saved %+v, per-set %+v", i, saved, *single[i])
+		}
+	}
+}
+
+func BenchmarkSaveBulk(b *testing.B) {
+	startBulkGateway(b)
+	ctx := withTenant(context.Background(), defaultTenant)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, err := range processTransactions(ctx, bulkTransactions(fmt.Sprint("bulk", i), 100)) {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSavePerSet(b *testing.B) {
+	startBulkGateway(b)
+	ctx := withTenant(context.Background(), defaultTenant)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, tx := range bulkTransactions(fmt.Sprint("single", i), 100) {
+			if err := processTransaction(ctx, tx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Documents a partner sends, in order, to be certified, unless a run names
+// its own: the kinds of documentKind, comma separated
+var certificationScript, certificationScriptErr = parseCertificationScript(getEnv("CERTIFICATION_SCRIPT", "order,order_ack,shipment,invoice"))
+
+// Certification run states
+const (
+	certificationRunning = "running"
+	certificationPassed  = "passed"
+	certificationFailed  = "failed"
+)
+
+// A partner's run through a script of test documents: an order and the
+// acknowledgment, shipment and invoice answering it. Each document is
+// validated like a sandbox submission, nothing being saved or published,
+// and must be the script's next kind and refer to the run's order. The
+// first failing document fails the run; passing every step certifies the
+// partner.
+type Certification struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	TenantID    string     `json:"tenant_id" gorm:"index"`
+	PartnerID   string     `json:"partner_id" gorm:"index"`
+	Status      string     `json:"status" gorm:"index"` // running, passed or failed
+	Step        int        `json:"step"`                // index of the next step while running
+	PONumber    string     `json:"po_number,omitempty"` // of the order the documents answer
+	Results     string     `json:"-"`                   // JSON array of certificationStep
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	Steps []certificationStep `json:"steps" gorm:"-"`
+}
+
+// One document of a certification script and how it fared
+type certificationStep struct {
+	Kind            string     `json:"kind"`   // order, order_ack, order_change, shipment or invoice
+	Status          string     `json:"status"` // pending, passed or failed
+	Format          string     `json:"format,omitempty"`
+	Type            string     `json:"type,omitempty"`
+	ControlNumber   string     `json:"control_number,omitempty"`
+	Quantity        float64    `json:"quantity,omitempty"` // ordered, shipped or invoiced
+	Errors          []string   `json:"errors,omitempty"`
+	Acknowledgments []string   `json:"acknowledgments,omitempty"` // the 997 or 999 the partner would get back
+	SubmittedAt     *time.Time `json:"submitted_at,omitempty"`
+}
+
+// Body of POST /partners/{id}/certifications
+type certificationRequest struct {
+	Steps []string `json:"steps,omitempty"` // kinds of documents, default CERTIFICATION_SCRIPT
+}
+
+func parseCertificationScript(s string) ([]string, error) {
+	kinds := splitList(s)
+	if len(kinds) == 0 {
+		return nil, errors.New("a certification script needs at least one step")
+	}
+	for _, kind := range kinds {
+		switch kind {
+		case kindOrder, kindOrderAck, kindOrderChange, kindShipment, kindInvoice:
+		default:
+			return nil, fmt.Errorf("certification steps must be order, order_ack, order_change, shipment or invoice, not %q", kind)
+		}
+	}
+	return kinds, nil
+}
+
+func (c *Certification) parse() error {
+	c.Steps = []certificationStep{}
+	if c.Results == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(c.Results), &c.Steps)
+}
+
+// Start certifying a partner; a partner has one run at a time
+func createCertificationHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	var req certificationRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	kinds := certificationScript
+	if len(req.Steps) > 0 {
+		var err error
+		if kinds, err = parseCertificationScript(strings.Join(req.Steps, ",")); err != nil {
+			writeProblem(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var running int64
+	if err := db.WithContext(r.Context()).Model(&Certification{}).Where("partner_id = ? AND status = ?", p.ID, certificationRunning).Count(&running).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch certifications", http.StatusInternalServerError)
+		return
+	}
+	if running > 0 {
+		writeProblem(w, "Partner "+p.ID+" is already being certified", http.StatusConflict)
+		return
+	}
+	c := Certification{PartnerID: p.ID, Status: certificationRunning}
+	for _, kind := range kinds {
+		c.Steps = append(c.Steps, certificationStep{Kind: kind, Status: "pending"})
+	}
+	results, _ := json.Marshal(c.Steps)
+	c.Results = string(results)
+	err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&c).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Partner{}).Where("id = ?", p.ID).Update("certification_status", certificationRunning).Error
+	})
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save certification", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "certification", fmt.Sprint(c.ID), nil, c)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// List a partner's certification runs, newest first
+func listCertificationsHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	list := []Certification{}
+	if err := db.WithContext(r.Context()).Where("partner_id = ?", p.ID).Order("id DESC").Find(&list).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch certifications", http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		if err := list[i].parse(); err != nil {
+			log.Printf("ERROR: certification %d: %v\n", list[i].ID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Load the certification of the request's partner and ID
+func requestCertification(w http.ResponseWriter, r *http.Request) (Certification, bool) {
+	var c Certification
+	err := db.WithContext(r.Context()).First(&c, "id = ? AND partner_id = ?", mux.Vars(r)["certification"], mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Certification not found", http.StatusNotFound)
+		return c, false
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch certification", http.StatusInternalServerError)
+		return c, false
+	}
+	if err := c.parse(); err != nil {
+		log.Printf("ERROR: certification %d: %v\n", c.ID, err)
+	}
+	return c, true
+}
+
+// The certification report: every step and how it fared
+func getCertificationHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := requestCertification(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// Submit the document of a certification's next step, in any inbound
+// format. Responds with the updated report, whether the document passed or
+// failed the step.
+func submitCertificationDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	c, ok := requestCertification(w, r)
+	if !ok {
+		return
+	}
+	if c.Status != certificationRunning || c.Step >= len(c.Steps) {
+		writeProblem(w, fmt.Sprintf("Certification %d has already %s", c.ID, c.Status), http.StatusConflict)
+		return
+	}
+	in, err := readInbound(w, r, false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer in.release()
+
+	now := time.Now().UTC()
+	ctx := withSandbox(withPartnerHint(r.Context(), p.ID))
+	step := checkCertificationStep(ctx, &c, p, r.Header.Get("Content-Type"), in.buf.Bytes(), now)
+	step.SubmittedAt = &now
+	before := c.Step
+	c.Steps[c.Step] = step
+	c.Step++
+	if step.Status == certificationFailed {
+		c.Status, c.CompletedAt = certificationFailed, &now
+	} else if c.Step == len(c.Steps) {
+		c.Status, c.CompletedAt = certificationPassed, &now
+	}
+	if err := saveCertification(ctx, c, before, now); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Certification %d of partner %s: %s step %d (%s), run %s", c.ID, p.ID, step.Status, before+1, step.Kind, c.Status)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// Validate one step's document against the run so far, recording the PO
+// number the first document names
+func checkCertificationStep(ctx context.Context, c *Certification, p Partner, contentType string, data []byte, now time.Time) certificationStep {
+	step := c.Steps[c.Step]
+	step.Status = certificationPassed
+	fail := func(format string, args ...interface{}) {
+		step.Status = certificationFailed
+		step.Errors = append(step.Errors, fmt.Sprintf(format, args...))
+	}
+	step.Format = detectFormat(contentType, data)
+	split, err := splitDocument(ctx, step.Format, p.ID, data, now)
+	if err == nil && len(split) != 1 {
+		err = fmt.Errorf("a step takes one transaction set, not %d", len(split))
+	}
+	if err != nil {
+		fail("%v", err)
+		return step
+	}
+	s := split[0]
+	if s.Transaction.PartnerID == "" {
+		s.Transaction.PartnerID = p.ID
+	}
+	t := s.Transaction
+	step.Format, step.Type, step.ControlNumber = t.Format, t.Type, t.ControlNumber
+	res, _ := validateSandboxed(ctx, s, "", t.Format)
+	step.Acknowledgments = interchangeAcks(contentType, data, []batchResult{res}, now, true)
+	if res.Status != "validated" {
+		fail("%s", res.Error)
+		return step
+	}
+	if t.PartnerID != p.ID {
+		fail("the document is from partner %s, not %s", t.PartnerID, p.ID)
+	}
+	if kind := documentKind(t.Type); kind != step.Kind {
+		fail("expected a %s document, got transaction type %q", step.Kind, t.Type)
+	}
+
+	items, err := t.Items()
+	if err != nil {
+		fail("items: %v", err)
+		return step
+	}
+	pos := map[string]bool{}
+	if t.refs.PONumber != "" {
+		pos[t.refs.PONumber] = true
+	}
+	for _, it := range items {
+		step.Quantity += it.Quantity
+		if it.PONumber != "" {
+			pos[it.PONumber] = true
+		}
+	}
+	switch {
+	case len(pos) == 0:
+		fail("the document names no PO number")
+	case c.PONumber == "" && len(pos) > 1:
+		fail("the document names %d PO numbers; certification follows one order", len(pos))
+	case c.PONumber == "":
+		for po := range pos {
+			c.PONumber = po
+		}
+	case !pos[c.PONumber] || len(pos) > 1:
+		fail("the document must refer to PO %s only", c.PONumber)
+	}
+
+	// Quantities answering the order may not exceed what came before
+	var ordered, shipped float64
+	for _, prev := range c.Steps[:c.Step] {
+		switch prev.Kind {
+		case kindOrder, kindOrderChange:
+			ordered = prev.Quantity
+		case kindShipment:
+			shipped += prev.Quantity
+		}
+	}
+	switch step.Kind {
+	case kindShipment:
+		if ordered > 0 && shipped+step.Quantity > ordered {
+			fail("ships %g of the %g ordered", shipped+step.Quantity, ordered)
+		}
+	case kindInvoice:
+		if limit := shipped; limit > 0 && step.Quantity > limit {
+			fail("invoices %g of the %g shipped", step.Quantity, limit)
+		} else if limit == 0 && ordered > 0 && step.Quantity > ordered {
+			fail("invoices %g of the %g ordered", step.Quantity, ordered)
+		}
+	}
+	return step
+}
+
+// Save a certification's progress from step before, and its outcome on the
+// partner once the run completes. Another document submitted for the same
+// step meanwhile answers 409.
+func saveCertification(ctx context.Context, c Certification, before int, now time.Time) error {
+	results, _ := json.Marshal(c.Steps)
+	c.Results = string(results)
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&Certification{}).Where("id = ? AND status = ? AND step = ?", c.ID, certificationRunning, before).
+			Updates(map[string]interface{}{"status": c.Status, "step": c.Step, "po_number": c.PONumber, "results": c.Results, "completed_at": c.CompletedAt})
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return &httpError{Status: http.StatusConflict, Message: fmt.Sprintf("Certification %d moved on meanwhile", c.ID)}
+		}
+		switch c.Status {
+		case certificationPassed:
+			return tx.Model(&Partner{}).Where("id = ?", c.PartnerID).
+				Updates(map[string]interface{}{"certification_status": certificationPassed, "certified_at": now}).Error
+		case certificationFailed:
+			return tx.Model(&Partner{}).Where("id = ?", c.PartnerID).Update("certification_status", certificationFailed).Error
+		}
+		return nil
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Subcommand of the edi_gateway binary
+type command struct {
+	usage string
+	help  string
+	run   func(fs *flag.FlagSet, args []string) error // fs prints the usage line on -h
+}
+
+var commands = map[string]command{
+	"serve": {
+		usage: "serve",
+		help:  "Run the gateway (the default when no command is given)",
+		run:   serveCommand,
+	},
+	"migrate": {
+		usage: "migrate [up|down|status|version|redo|up-to N|down-to N]",
+		help:  "Run database schema migrations (default up)",
+		run:   migrateCommand,
+	},
+	"validate": {
+		usage: "validate [--content-type TYPE] [--db] [--tenant T] [--partner ID] FILE...",
+		help:  "Check documents parse and translate; exits 1 when any transaction fails",
+		run:   validateCommand,
+	},
+	"parse": {
+		usage: "parse [--json] [--content-type TYPE] [--db] [--tenant T] [--partner ID] FILE...",
+		help:  "Translate documents and print the canonical transactions",
+		run:   parseCommand,
+	},
+	"replay": {
+		usage: "replay [--tenant T] [--from T] [--to T] [--partner ID] [--status S] [--target kafka,delivery] [--reason R] [--limit N]",
+		help:  "Re-emit events or re-run deliveries for matching transactions",
+		run:   replayCommand,
+	},
+	"backfill": {
+		usage: "backfill [--tenant T] [--partner ID] [--content-type TYPE] [--no-deliver] [--rate N] [--workers N] [--state FILE] DIR|FILE|s3://BUCKET/PREFIX...",
+		help:  "Ingest historical files through the pipeline to seed a deployment",
+		run:   backfillCommand,
+	},
+	"openapi": {
+		usage: "openapi",
+		help:  "Print the OpenAPI description of the HTTP API served at /openapi.json",
+		run:   openAPICommand,
+	},
+	"search-index": {
+		usage: "search-index [--batch N] [--rebuild]",
+		help:  "Index transactions saved before text search for GET /transactions/search",
+		run:   searchIndexCommand,
+	},
+	"reencrypt": {
+		usage: "reencrypt [--batch N]",
+		help:  "Encrypt sensitive fields with the current FIELD_ENCRYPTION_KEYS key",
+		run:   reencryptCommand,
+	},
+}
+
+// Reported by commands whose work completed with failures: exit 1 without
+// printing the error again
+var errFailures = errors.New("failures reported")
+
+// Dispatch to a subcommand and return the process exit code
+func runCLI(args []string) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return 2
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: edi_gateway %s\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+	var pusher *metricsPusher
+	if name != "serve" {
+		pusher = startMetricsPush(name)
+	}
+	err := cmd.run(fs, args)
+	if kafkaRouter != nil {
+		kafkaRouter.flush() // events the command published without waiting
+	}
+	if pusher != nil && !errors.Is(err, flag.ErrHelp) {
+		pusher.finish(err)
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if errors.Is(err, errFailures) {
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "edi_gateway %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Usage: edi_gateway <command> [arguments]")
+	fmt.Fprintln(w)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].help)
+	}
+}
+
+func serveCommand(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	serve()
+	return nil
+}
+
+func migrateCommand(fs *flag.FlagSet, args []string) error {
+	if edgeMode || databaseDriver == "sqlite" {
+		return errors.New("SQLite databases are migrated automatically")
+	}
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if err := openDB(); err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return runMigrations(command, args...)
+}
+
+// Flags shared by validate and parse
+type documentFlags struct {
+	contentType string
+	useDB       bool
+	tenant      string
+	partner     string
+}
+
+func (f *documentFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.contentType, "content-type", "", "Content-Type to assume when the format cannot be sniffed")
+	fs.BoolVar(&f.useDB, "db", false, "Connect to DATABASE_DSN to resolve partners and apply partner maps")
+	fs.StringVar(&f.tenant, "tenant", defaultTenant, "Tenant whose partners, maps and profiles apply (with --db)")
+	fs.StringVar(&f.partner, "partner", "", "Partner sending the files; flat files use its profile (needs --db)")
+}
+
+// Translated transactions of one file ("-" reads stdin)
+type parsedDocument struct {
+	File         string              `json:"file"`
+	Format       string              `json:"format,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Transactions []parsedTransaction `json:"transactions,omitempty"`
+}
+
+type parsedTransaction struct {
+	Transaction
+	Error       string            `json:"error,omitempty"`
+	Annotations []fieldAnnotation `json:"annotations,omitempty"` // with mapping debug on
+}
+
+// Translate one document, reporting whether every transaction is valid
+func parseDocument(ctx context.Context, name, contentType, partnerID string, data []byte) (parsedDocument, bool) {
+	ok := true
+	doc := parsedDocument{File: name, Format: detectFormat(contentType, data)}
+	split, err := splitDocument(ctx, doc.Format, partnerID, data, time.Now())
+	if err == nil && len(split) == 0 {
+		err = errors.New("no transactions found")
+	} else if len(split) > 0 {
+		doc.Format = split[0].Transaction.Format
+	}
+	if err != nil {
+		doc.Error, ok = err.Error(), false
+	}
+	for _, s := range split {
+		pt := parsedTransaction{Transaction: s.Transaction, Annotations: s.Transaction.annotations}
+		if s.Err != nil {
+			pt.Error, ok = s.Err.Error(), false
+		}
+		doc.Transactions = append(doc.Transactions, pt)
+	}
+	return doc, ok
+}
+
+// Read and translate each file; the database is only used with --db
+func parseFiles(f documentFlags, files []string) ([]parsedDocument, bool, error) {
+	if len(files) == 0 {
+		return nil, false, errors.New("no files given")
+	}
+	if f.useDB {
+		if err := openDB(); err != nil {
+			return nil, false, fmt.Errorf("failed to connect to database: %w", err)
+		}
+	}
+	if !knownTenant(f.tenant) {
+		return nil, false, fmt.Errorf("unknown tenant %s", f.tenant)
+	}
+	ctx := withTenant(context.Background(), f.tenant)
+	ok := true
+	var docs []parsedDocument
+	for _, name := range files {
+		var data []byte
+		var err error
+		if name == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		doc, valid := parseDocument(ctx, name, f.contentType, f.partner, data)
+		ok = ok && valid
+		docs = append(docs, doc)
+	}
+	return docs, ok, nil
+}
+
+func validateCommand(fs *flag.FlagSet, args []string) error {
+	var f documentFlags
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	docs, ok, err := parseFiles(f, fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if doc.Error != "" {
+			fmt.Printf("%s: INVALID %s: %s\n", doc.File, doc.Format, doc.Error)
+			continue
+		}
+		for _, t := range doc.Transactions {
+			status := "OK"
+			if t.Error != "" {
+				status = "INVALID: " + t.Error
+			}
+			fmt.Printf("%s: %s %s ISA13 %s ST02 %s: %s\n", doc.File, doc.Format, t.Type, t.InterchangeControl, t.ControlNumber, status)
+		}
+	}
+	if !ok {
+		return errFailures
+	}
+	return nil
+}
+
+func parseCommand(fs *flag.FlagSet, args []string) error {
+	var f documentFlags
+	f.register(fs)
+	asJSON := fs.Bool("json", false, "Print the canonical transactions as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	docs, ok, err := parseFiles(f, fs.Args())
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(docs); err != nil {
+			return err
+		}
+	} else {
+		for _, doc := range docs {
+			fmt.Printf("%s (%s)\n", doc.File, doc.Format)
+			if doc.Error != "" {
+				fmt.Printf("  error: %s\n", doc.Error)
+			}
+			for _, t := range doc.Transactions {
+				if t.Error != "" {
+					fmt.Printf("  %s %s: error: %s\n", t.Type, t.ControlNumber, t.Error)
+					continue
+				}
+				items, _ := t.Items()
+				fmt.Printf("  %s %s partner=%s ship_to=%q carrier=%s bol=%s items=%d\n",
+					t.Type, t.ControlNumber, t.PartnerID, t.ShipTo, t.Carrier, t.BOL, len(items))
+			}
+		}
+	}
+	if !ok {
+		return errFailures
+	}
+	return nil
+}
+
+func replayCommand(fs *flag.FlagSet, args []string) error {
+	var req replayRequest
+	var tenant, from, to, targets string
+	fs.StringVar(&tenant, "tenant", defaultTenant, "Tenant whose transactions are replayed")
+	fs.StringVar(&from, "from", "", "Only transactions dated at or after this time (RFC 3339 or YYYY-MM-DD)")
+	fs.StringVar(&to, "to", "", "Only transactions dated before this time (RFC 3339 or YYYY-MM-DD)")
+	fs.StringVar(&req.PartnerID, "partner", "", "Only this partner's transactions")
+	fs.StringVar(&req.Status, "status", "", "Only transactions with this status")
+	fs.StringVar(&targets, "target", replayKafka, "Comma separated targets: kafka, delivery")
+	fs.StringVar(&req.Reason, "reason", "", "Reason recorded in the replay audit trail")
+	fs.IntVar(&req.Limit, "limit", maxReplayBatch, "Maximum number of transactions")
+	actor := fs.String("actor", "cli:"+getEnv("USER", "unknown"), "Actor recorded in the replay audit trail")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if req.From, err = parseCLITime(from); err != nil {
+		return fmt.Errorf("--from: %w", err)
+	}
+	if req.To, err = parseCLITime(to); err != nil {
+		return fmt.Errorf("--to: %w", err)
+	}
+	req.Targets = splitList(targets)
+	if err := req.checkTargets(); err != nil {
+		return err
+	}
+	if !knownTenant(tenant) {
+		return fmt.Errorf("unknown tenant %s", tenant)
+	}
+	ctx := withTenant(context.Background(), tenant)
+
+	if err := openDB(); err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if !edgeMode {
+		if err := initEvents(); err != nil {
+			return fmt.Errorf("failed to initialize events: %w", err)
+		}
+	}
+	transactions, err := findReplayTransactions(ctx, req)
+	if err != nil {
+		return err
+	}
+	replays := replayTransactions(withAuditor(ctx, systemAuditor(*actor, "cli")), transactions, req, *actor, "")
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(replays); err != nil {
+		return err
+	}
+	for _, rep := range replays {
+		if rep.Status != "replayed" {
+			return errFailures
+		}
+	}
+	return nil
+}
+
+func reencryptCommand(fs *flag.FlagSet, args []string) error {
+	batch := fs.Int("batch", 500, "Rows read per query")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batch <= 0 {
+		return errors.New("--batch must be positive")
+	}
+	if err := openDB(); err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	reports, err := reencryptAll(context.Background(), *batch)
+	for _, rep := range reports {
+		fmt.Printf("%s: %d rows checked, %d re-encrypted\n", rep.Table, rep.Checked, rep.Reencrypted)
+	}
+	return err
+}
+
+func searchIndexCommand(fs *flag.FlagSet, args []string) error {
+	batch := fs.Int("batch", 500, "Rows read per query")
+	rebuild := fs.Bool("rebuild", false, "Reindex every transaction, e.g. after changing SEARCH_INDEX_SENSITIVE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batch <= 0 {
+		return errors.New("--batch must be positive")
+	}
+	if err := openDB(); err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	n, err := indexTransactions(context.Background(), *batch, *rebuild)
+	fmt.Printf("%d transactions indexed\n", n)
+	return err
+}
+
+// Parse an RFC 3339 timestamp or a date; empty means unset
+func parseCLITime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	layout := time.RFC3339
+	if !strings.Contains(s, "T") {
+		layout = "2006-01-02"
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
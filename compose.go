@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Outbound documents composed by hand: a draft holds a canonical
+// transaction for a partner, previews as the exact bytes the partner would
+// get, is approved when its partner has outbound_approval, and is then sent,
+// which creates its transaction, with the draft's ID, and delivers it like
+// an outbound request.
+// The draft can be changed until it is sent; a change withdraws an approval.
+type OutboundDraft struct {
+	ID        string `json:"id" gorm:"primaryKey"`
+	TenantID  string `json:"tenant_id" gorm:"index"`
+	PartnerID string `json:"partner_id" gorm:"index"`
+	Type      string `json:"type"`
+	ShipTo    string `json:"ship_to" gorm:"serializer:encrypted"`
+	Carrier   string `json:"carrier"`
+	BOL       string `json:"bol"`
+	ItemList  string `json:"items" gorm:"serializer:encrypted"` // JSON string of items
+	Status    string `json:"status" gorm:"index"`               // draft, approved or sent
+
+	ComposedBy     string     `json:"composed_by"`
+	ApprovedBy     string     `json:"approved_by,omitempty"` // never the composer
+	ApprovedAt     *time.Time `json:"approved_at,omitempty"`
+	SentBy         string     `json:"sent_by,omitempty"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	TransactionID  string     `json:"transaction_id,omitempty"` // created when sent
+	DeliveryID     string     `json:"delivery_id,omitempty"`
+	DeliveryStatus string     `json:"delivery_status,omitempty"`
+	Error          string     `json:"error,omitempty"` // of the delivery
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Statuses of a draft
+const (
+	draftComposed = "draft"
+	draftApproved = "approved"
+	draftSent     = "sent"
+)
+
+// Audit actions on drafts
+const (
+	auditApprove = "approve"
+	auditSend    = "send"
+)
+
+// Canonical transaction composed for a partner, as a draft or to preview
+type outboundComposition struct {
+	PartnerID string `json:"partner_id"`
+	Type      string `json:"type,omitempty"` // 856 when empty
+	ShipTo    string `json:"ship_to"`
+	Carrier   string `json:"carrier"`
+	BOL       string `json:"bol"`
+	ItemList  string `json:"items"` // JSON string of items
+}
+
+type previewKey struct{}
+
+// Context whose outbound documents are rendered to be looked at: they take
+// the partner's next control number without using it up
+func withPreview(ctx context.Context) context.Context {
+	return context.WithValue(ctx, previewKey{}, true)
+}
+
+func previewing(ctx context.Context) bool {
+	on, _ := ctx.Value(previewKey{}).(bool)
+	return on
+}
+
+func (c *outboundComposition) validate() error {
+	c.PartnerID, c.Type = strings.TrimSpace(c.PartnerID), strings.TrimSpace(c.Type)
+	switch {
+	case c.PartnerID == "":
+		return errors.New("partner_id is required")
+	case c.ShipTo == "":
+		return errors.New("ship_to is required")
+	case strings.TrimSpace(c.ItemList) == "":
+		return errors.New("items is required")
+	}
+	var items []Item
+	if err := json.Unmarshal([]byte(c.ItemList), &items); err != nil {
+		return fmt.Errorf("items must be a JSON array of items: %v", err)
+	}
+	if c.Type == "" {
+		c.Type = "856"
+	}
+	return nil
+}
+
+// Partner a composition is for, which must be active
+func compositionPartner(ctx context.Context, c outboundComposition) (Partner, error) {
+	p, err := loadPartner(ctx, c.PartnerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return p, &httpError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Unknown partner %s", c.PartnerID)}
+	} else if err != nil {
+		log.Printf("ERROR: partner %q: %v\n", c.PartnerID, err)
+		return p, &httpError{Status: http.StatusInternalServerError, Message: "Failed to load partner profile"}
+	} else if p.deactivated() {
+		return p, &httpError{Status: http.StatusConflict, Message: fmt.Sprintf("Partner %s is deactivated", p.ID)}
+	}
+	return p, nil
+}
+
+func (c outboundComposition) transaction() Transaction {
+	return Transaction{PartnerID: c.PartnerID, Type: c.Type, ShipTo: c.ShipTo, Carrier: c.Carrier, BOL: c.BOL, ItemList: c.ItemList, Format: formatJSON}
+}
+
+func (d OutboundDraft) composition() outboundComposition {
+	return outboundComposition{PartnerID: d.PartnerID, Type: d.Type, ShipTo: d.ShipTo, Carrier: d.Carrier, BOL: d.BOL, ItemList: d.ItemList}
+}
+
+// Document the partner would get for a composition, rendered without
+// taking a control number, saving or archiving anything
+func previewOutbound(ctx context.Context, c outboundComposition, id string) (outboundDocument, error) {
+	p, err := compositionPartner(ctx, c)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	t := c.transaction()
+	t.ID, t.TenantID, t.Date, t.Status = id, tenantID(ctx), time.Now(), "Processed"
+	doc, err := buildOutbound(withPreview(ctx), p, []Transaction{t})
+	if err != nil {
+		return doc, &httpError{Status: http.StatusUnprocessableEntity, Message: "Failed to build interchange: " + err.Error()}
+	}
+	return doc, nil
+}
+
+func writePreview(w http.ResponseWriter, doc outboundDocument) {
+	w.Header().Set("Content-Type", doc.ContentType)
+	if doc.Control != "" {
+		w.Header().Set("X-Control-Number", doc.Control) // the partner's next, taken again when sent
+	}
+	w.Write(doc.Data)
+}
+
+// Drafts are composed and decided by our users; partner API keys may not
+func draftUser(ctx context.Context) error {
+	if auditorFrom(ctx).partner != "" {
+		return &httpError{Status: http.StatusForbidden, Message: "Partner API keys cannot compose outbound documents"}
+	}
+	return nil
+}
+
+// Composition of a request, writing the problem when it fails
+func requestComposition(w http.ResponseWriter, r *http.Request) (outboundComposition, bool) {
+	var c outboundComposition
+	if err := draftUser(r.Context()); err != nil {
+		writeError(w, err)
+		return c, false
+	}
+	if err := decodeJSON(w, r, &c); err != nil {
+		writeError(w, err)
+		return c, false
+	}
+	if err := c.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return c, false
+	}
+	return c, true
+}
+
+// Draft of a request, writing the problem when it fails
+func requestDraft(w http.ResponseWriter, r *http.Request) *OutboundDraft {
+	var d OutboundDraft
+	err := db.WithContext(r.Context()).First(&d, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Draft not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch draft", http.StatusInternalServerError)
+		return nil
+	}
+	return &d
+}
+
+// Draft of a request that is not sent yet, writing the problem when it fails
+func requestUnsentDraft(w http.ResponseWriter, r *http.Request) *OutboundDraft {
+	if err := draftUser(r.Context()); err != nil {
+		writeError(w, err)
+		return nil
+	}
+	d := requestDraft(w, r)
+	if d != nil && d.Status == draftSent {
+		writeProblem(w, fmt.Sprintf("Draft %s was sent as transaction %s", d.ID, d.TransactionID), http.StatusConflict)
+		return nil
+	}
+	return d
+}
+
+// Change a draft's status from the one it was read with; false when another
+// request changed it first
+func moveDraft(tx *gorm.DB, d *OutboundDraft, from string, fields ...string) (bool, error) {
+	res := tx.Model(d).Where("status = ?", from).Select(append(fields, "status", "updated_at")).Updates(d)
+	return res.RowsAffected == 1, res.Error
+}
+
+// Render a composition as the partner would get it, without sending or
+// saving it
+func previewOutboundHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := requestComposition(w, r)
+	if !ok {
+		return
+	}
+	doc, err := previewOutbound(r.Context(), c, "preview")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writePreview(w, doc)
+}
+
+// List drafts, newest first. Filters: partner_id, status and limit (default
+// 100, at most 1000).
+func listDraftsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeProblem(w, "limit must be 1 to 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query := db.WithContext(r.Context()).Order("created_at DESC").Limit(limit)
+	if v := q.Get("partner_id"); v != "" {
+		query = query.Where("partner_id = ?", v)
+	}
+	if v := q.Get("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+	drafts := []OutboundDraft{}
+	if err := query.Find(&drafts).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch drafts", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drafts)
+}
+
+// Compose a draft for a partner; it must render
+func createDraftHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := requestComposition(w, r)
+	if !ok {
+		return
+	}
+	d := OutboundDraft{ID: uuid.New().String(), Status: draftComposed, ComposedBy: auditorFrom(r.Context()).actor}
+	if _, err := previewOutbound(r.Context(), c, d.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	d.PartnerID, d.Type, d.ShipTo, d.Carrier, d.BOL, d.ItemList = c.PartnerID, c.Type, c.ShipTo, c.Carrier, c.BOL, c.ItemList
+	if err := db.WithContext(r.Context()).Create(&d).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save draft", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "outbound_draft", d.ID, nil, d)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// Fetch one draft
+func getDraftHandler(w http.ResponseWriter, r *http.Request) {
+	d := requestDraft(w, r)
+	if d == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// Replace the composition of a draft that is not sent; an approved draft
+// goes back to draft
+func updateDraftHandler(w http.ResponseWriter, r *http.Request) {
+	existing := requestUnsentDraft(w, r)
+	if existing == nil {
+		return
+	}
+	c, ok := requestComposition(w, r)
+	if !ok {
+		return
+	}
+	if _, err := previewOutbound(r.Context(), c, existing.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	d := *existing
+	d.PartnerID, d.Type, d.ShipTo, d.Carrier, d.BOL, d.ItemList = c.PartnerID, c.Type, c.ShipTo, c.Carrier, c.BOL, c.ItemList
+	d.Status, d.ApprovedBy, d.ApprovedAt = draftComposed, "", nil
+	moved, err := moveDraft(db.WithContext(r.Context()), &d, existing.Status,
+		"partner_id", "type", "ship_to", "carrier", "bol", "item_list", "approved_by", "approved_at")
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save draft", http.StatusInternalServerError)
+		return
+	} else if !moved {
+		writeProblem(w, fmt.Sprintf("Draft %s changed meanwhile", d.ID), http.StatusConflict)
+		return
+	}
+	auditChange(r.Context(), auditUpdate, "outbound_draft", d.ID, existing, d)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// Render a draft as its partner would get it now
+func previewDraftHandler(w http.ResponseWriter, r *http.Request) {
+	d := requestDraft(w, r)
+	if d == nil {
+		return
+	}
+	doc, err := previewOutbound(r.Context(), d.composition(), d.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writePreview(w, doc)
+}
+
+// Approve a draft for sending; the composer cannot approve their own draft
+func approveDraftHandler(w http.ResponseWriter, r *http.Request) {
+	d := requestUnsentDraft(w, r)
+	if d == nil {
+		return
+	}
+	actor := auditorFrom(r.Context()).actor
+	if d.Status == draftApproved {
+		writeProblem(w, fmt.Sprintf("Draft %s is already approved by %s", d.ID, d.ApprovedBy), http.StatusConflict)
+		return
+	} else if actor == d.ComposedBy {
+		writeProblem(w, "A draft must be approved by someone other than its composer", http.StatusForbidden)
+		return
+	}
+	now := time.Now()
+	d.Status, d.ApprovedBy, d.ApprovedAt = draftApproved, actor, &now
+	moved, err := moveDraft(db.WithContext(r.Context()), d, draftComposed, "approved_by", "approved_at")
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save draft", http.StatusInternalServerError)
+		return
+	} else if !moved {
+		writeProblem(w, fmt.Sprintf("Draft %s changed meanwhile", d.ID), http.StatusConflict)
+		return
+	}
+	auditChange(r.Context(), auditApprove, "outbound_draft", d.ID,
+		map[string]string{"status": draftComposed}, map[string]string{"status": d.Status})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// Send a draft: create its transaction and deliver it like an outbound
+// request. A partner with outbound_approval only gets approved drafts.
+func sendDraftHandler(w http.ResponseWriter, r *http.Request) {
+	d := requestUnsentDraft(w, r)
+	if d == nil {
+		return
+	}
+	ctx := detachedContext(r)
+	c := d.composition()
+	p, err := compositionPartner(ctx, c)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if p.OutboundApproval && d.Status != draftApproved {
+		writeProblem(w, fmt.Sprintf("Partner %s needs drafts approved before they are sent", p.ID), http.StatusConflict)
+		return
+	}
+
+	t := c.transaction()
+	now := time.Now()
+	newInboundTransaction(ctx, &t, now)
+	t.ID = d.ID // as previewed
+	t.ConfigVersion = processingConfigVersion(ctx)
+	from := d.Status
+	d.Status, d.SentBy, d.SentAt, d.TransactionID = draftSent, auditorFrom(ctx).actor, &now, t.ID
+	changed := false
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&t).Error; err != nil {
+			return err
+		}
+		if err := appendReceivedEvent(ctx, tx, t, map[string]interface{}{"partner_id": t.PartnerID, "type": t.Type, "draft_id": d.ID}); err != nil {
+			return err
+		}
+		moved, err := moveDraft(tx, d, from, "sent_by", "sent_at", "transaction_id")
+		if err == nil && !moved {
+			changed = true
+			return errors.New("draft changed")
+		}
+		return err
+	})
+	if changed {
+		writeProblem(w, fmt.Sprintf("Draft %s changed meanwhile", d.ID), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: send draft %s: %v\n", d.ID, err)
+		writeProblem(w, "Failed to save transaction", http.StatusInternalServerError)
+		return
+	}
+	auditChange(ctx, auditCreate, "transaction", t.ID, nil, nil)
+	auditChange(ctx, auditSend, "outbound_draft", d.ID,
+		map[string]string{"status": from}, map[string]string{"status": d.Status, "transaction_id": t.ID})
+	postToMailbox(ctx, mailboxOutbox, p.ID, t.ID)
+	projectTransaction(ctx, t)
+	if err := publishTransaction(ctx, eventTransactionCreated, t); err != nil {
+		log.Printf("ERROR: %v: %v\n", errPublishFailed, err)
+	}
+
+	if p.BatchOutbound {
+		d.DeliveryStatus = deliveryBatched
+	} else if p.DeliveryURL != "" {
+		delivery, err := deliverOutbound(ctx, p, []Transaction{t})
+		if err != nil {
+			log.Printf("ERROR: delivery for draft %s: %v\n", d.ID, err)
+			d.Error = err.Error()
+		}
+		d.DeliveryID, d.DeliveryStatus = delivery.ID, delivery.Status
+	}
+	if d.DeliveryStatus != "" {
+		if err := db.WithContext(ctx).Model(d).Select("delivery_id", "delivery_status", "error").Updates(d).Error; err != nil {
+			log.Printf("ERROR: draft %s: %v\n", d.ID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CPUs available to the process; automaxprocs has already applied any
+// container CPU quota by the time package variables are initialized
+var cpus = runtime.GOMAXPROCS(0)
+
+// Concurrency caps, scaled from available CPUs by default
+var (
+	maxConcurrentRequests = getEnvInt("MAX_CONCURRENT_REQUESTS", 64*cpus)
+	requestQueueTimeout   = getEnvDuration("REQUEST_QUEUE_TIMEOUT", 5*time.Second)
+	kafkaMaxInFlight      = getEnvInt("KAFKA_MAX_INFLIGHT", 4*cpus)
+	kafkaMaxInFlightHigh  = getEnvInt("KAFKA_MAX_INFLIGHT_HIGH", 2*cpus) // slots of their own for high priority transactions
+	kafkaMaxInFlightLow   = getEnvInt("KAFKA_MAX_INFLIGHT_LOW", cpus)    // and for low priority ones
+)
+
+var (
+	requestSlots = make(chan struct{}, atLeastOne(maxConcurrentRequests))
+	kafkaLanes   = newPriorityLanes("kafka", kafkaMaxInFlightHigh, kafkaMaxInFlight, kafkaMaxInFlightLow)
+)
+
+var inFlightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "inflight_operations",
+	Help: "Operations currently holding a concurrency slot.",
+}, []string{"kind"})
+
+// Cap the number of requests handled at once. Requests wait briefly for a
+// slot and get 503 when the gateway stays saturated.
+func concurrencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timer := time.NewTimer(requestQueueTimeout)
+		defer timer.Stop()
+		select {
+		case requestSlots <- struct{}{}:
+		case <-timer.C:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, "Server busy, retry later", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		inFlightGauge.WithLabelValues("http").Inc()
+		defer func() {
+			inFlightGauge.WithLabelValues("http").Dec()
+			<-requestSlots
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Bound concurrent Kafka writes, in the lane of priority
+func acquireKafkaSlot(ctx context.Context, priority string) (func(), error) {
+	return kafkaLanes.acquire(ctx, priority)
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings read so far and their raw values, compared across replicas by
+// the consistency check
+var settingsRead sync.Map
+
+// Read a string setting from the environment
+func getEnv(key, def string) string {
+	v, ok := os.LookupEnv(key)
+	settingsRead.Store(key, v)
+	if ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Read an integer setting from the environment
+func getEnvInt(key string, def int) int {
+	if v, err := strconv.Atoi(getEnv(key, "")); err == nil {
+		return v
+	}
+	return def
+}
+
+// Read a floating point setting from the environment
+func getEnvFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(getEnv(key, ""), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+// Read a boolean setting from the environment
+func getEnvBool(key string, def bool) bool {
+	if v, err := strconv.ParseBool(getEnv(key, "")); err == nil {
+		return v
+	}
+	return def
+}
+
+// Read a duration setting (e.g. "30s", "5m") from the environment
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(getEnv(key, "")); err == nil {
+		return v
+	}
+	return def
+}
+
+// Split a comma separated setting into trimmed, non-empty values
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
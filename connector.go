@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Kinds of inbound connector
+const (
+	connectorFTPS = "ftps"
+	connectorFTP  = "ftp" // plain text credentials and data; only for partners that cannot do TLS
+	connectorDir  = "dir" // local or NFS mounted directory
+)
+
+// Default poll interval of connectors that set none
+var connectorPollInterval = getEnvDuration("CONNECTOR_POLL_INTERVAL", time.Minute)
+
+var connectorFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_connector_files_total",
+	Help: "Files picked up by inbound connectors, by outcome.",
+}, []string{"partner", "kind", "outcome"})
+
+// A location a partner drops its documents in, polled for new files. Each
+// picked up file goes through the pipeline like a POST /inbound/batch from
+// the partner and is then deleted; files that are not documents, or keep
+// failing to be read, are moved to the quarantine directory.
+type Connector struct {
+	ID             string     `json:"id" gorm:"primaryKey"`
+	TenantID       string     `json:"tenant_id" gorm:"index"`
+	PartnerID      string     `json:"partner_id" gorm:"index"`
+	Kind           string     `json:"kind"`                                           // ftps, ftp or dir
+	Address        string     `json:"address,omitempty"`                              // FTP server host[:port]
+	ImplicitTLS    bool       `json:"implicit_tls,omitempty"`                         // TLS on connect (port 990) instead of AUTH TLS
+	CACertificate  string     `json:"ca_certificate,omitempty"`                       // PEM trusted for the server instead of the system roots
+	Username       string     `json:"username,omitempty"`                             // default anonymous
+	Password       string     `json:"password,omitempty" gorm:"serializer:encrypted"` // write only
+	Path           string     `json:"path"`                                           // directory polled; on the server for FTP(S)
+	FilePattern    string     `json:"file_pattern,omitempty"`                         // glob on file names, default *
+	TempSuffixes   string     `json:"temp_suffixes,omitempty"`                        // comma separated; files still being written, default .tmp,.part,.filepart
+	DoneSuffix     string     `json:"done_suffix,omitempty"`                          // e.g. .done: a file is only picked up once its done file exists
+	QuarantinePath string     `json:"quarantine_path,omitempty"`                      // default the quarantine directory in path
+	ContentType    string     `json:"content_type,omitempty"`                         // of the files; default from the extension, then the content
+	MaxAttempts    int        `json:"max_attempts"`                                   // failed reads before a file is quarantined; 0 uses 3
+	PollSeconds    int        `json:"poll_seconds"`                                   // 0 uses CONNECTOR_POLL_INTERVAL
+	Disabled       bool       `json:"disabled"`
+	LastPollAt     *time.Time `json:"last_poll_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (c *Connector) validate() error {
+	switch c.Kind {
+	case connectorFTPS, connectorFTP:
+		if c.Address == "" {
+			return errors.New("address is required for FTP connectors")
+		}
+		if c.CACertificate != "" {
+			if _, err := ftpTLSConfig("", c.CACertificate); err != nil {
+				return err
+			}
+		}
+	case connectorDir:
+		if !filepath.IsAbs(c.Path) {
+			return errors.New("path must be absolute for dir connectors")
+		}
+	default:
+		return errors.New("kind must be ftps, ftp or dir")
+	}
+	if c.Path == "" {
+		return errors.New("path is required")
+	}
+	if _, err := path.Match(c.FilePattern, ""); err != nil {
+		return fmt.Errorf("file_pattern: %w", err)
+	}
+	if c.MaxAttempts < 0 || c.PollSeconds < 0 {
+		return errors.New("max_attempts and poll_seconds must not be negative")
+	}
+	return nil
+}
+
+func (c *Connector) pollInterval() time.Duration {
+	if c.PollSeconds > 0 {
+		return time.Duration(c.PollSeconds) * time.Second
+	}
+	return connectorPollInterval
+}
+
+func (c *Connector) quarantineDir() string {
+	if c.QuarantinePath != "" {
+		return c.QuarantinePath
+	}
+	if c.Kind == connectorDir {
+		return filepath.Join(c.Path, "quarantine")
+	}
+	return path.Join(c.Path, "quarantine")
+}
+
+// Whether a directory entry is a document ready to be picked up
+func (c *Connector) ready(name string, present map[string]bool) bool {
+	if strings.HasPrefix(name, ".") || c.Kind != connectorDir && name == path.Base(c.quarantineDir()) {
+		return false
+	}
+	suffixes := splitList(c.TempSuffixes)
+	if c.TempSuffixes == "" {
+		suffixes = []string{".tmp", ".part", ".filepart"}
+	}
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, s) {
+			return false
+		}
+	}
+	if c.DoneSuffix != "" {
+		if strings.HasSuffix(name, c.DoneSuffix) || !present[name+c.DoneSuffix] {
+			return false
+		}
+	}
+	pattern := c.FilePattern
+	if pattern == "" {
+		pattern = "*"
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func (c *Connector) contentType(name string) string {
+	if c.ContentType != "" {
+		return c.ContentType
+	}
+	return mime.TypeByExtension(path.Ext(name))
+}
+
+// Shown instead of a connector's password
+const passwordMask = "********"
+
+// Copy without the password, for responses and the audit log
+func (c Connector) redacted() Connector {
+	if c.Password != "" {
+		c.Password = passwordMask
+	}
+	return c
+}
+
+// Operations a connector needs from its location
+type connectorSession interface {
+	list(ctx context.Context) ([]string, error)
+	read(ctx context.Context, name string) ([]byte, error)
+	remove(name string) error
+	quarantine(name string) error
+	Close() error
+}
+
+var errFileTooLarge = errors.New("file is larger than INBOUND_MAX_BUFFERED_SIZE")
+
+func openConnector(ctx context.Context, c *Connector) (connectorSession, error) {
+	if c.Kind == connectorDir {
+		return dirSession{c}, nil
+	}
+	f, err := dialFTP(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return ftpSession{f, c}, nil
+}
+
+type dirSession struct{ c *Connector }
+
+func (s dirSession) list(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.c.Path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s dirSession) read(ctx context.Context, name string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(s.c.Path, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, inboundMaxBuffered+1))
+	if err == nil && int64(len(b)) > inboundMaxBuffered {
+		err = errFileTooLarge
+	}
+	return b, err
+}
+
+func (s dirSession) remove(name string) error {
+	return os.Remove(filepath.Join(s.c.Path, name))
+}
+
+func (s dirSession) quarantine(name string) error {
+	dir := s.c.quarantineDir()
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(s.c.Path, name), filepath.Join(dir, name))
+}
+
+func (s dirSession) Close() error { return nil }
+
+type ftpSession struct {
+	f *ftpConn
+	c *Connector
+}
+
+func (s ftpSession) list(ctx context.Context) ([]string, error) { return s.f.list(ctx, s.c.Path) }
+
+func (s ftpSession) read(ctx context.Context, name string) ([]byte, error) {
+	return s.f.retrieve(ctx, path.Join(s.c.Path, name))
+}
+
+func (s ftpSession) remove(name string) error { return s.f.remove(path.Join(s.c.Path, name)) }
+
+func (s ftpSession) quarantine(name string) error {
+	dir := s.c.quarantineDir()
+	s.f.mkdir(dir)
+	return s.f.rename(path.Join(s.c.Path, name), path.Join(dir, name))
+}
+
+func (s ftpSession) Close() error { return s.f.Close() }
+
+// Failed reads per connector file, so a file that keeps failing is
+// quarantined instead of being retried forever
+var connectorAttempts = struct {
+	sync.Mutex
+	byFile map[string]int
+}{byFile: map[string]int{}}
+
+func failedAttempt(c *Connector, name string) int {
+	connectorAttempts.Lock()
+	defer connectorAttempts.Unlock()
+	connectorAttempts.byFile[c.ID+"/"+name]++
+	return connectorAttempts.byFile[c.ID+"/"+name]
+}
+
+func clearAttempts(c *Connector, name string) {
+	connectorAttempts.Lock()
+	delete(connectorAttempts.byFile, c.ID+"/"+name)
+	connectorAttempts.Unlock()
+}
+
+// Outcome of one poll
+type connectorPoll struct {
+	ConnectorID string          `json:"connector_id"`
+	Files       []connectorFile `json:"files"`
+	Error       string          `json:"error,omitempty"`
+}
+
+type connectorFile struct {
+	Name    string        `json:"name"`
+	Outcome string        `json:"outcome"` // processed, quarantined or failed (retried at the next poll)
+	Error   string        `json:"error,omitempty"`
+	Results []batchResult `json:"results,omitempty"`
+}
+
+// Pick up the files ready in a connector's location
+func pollConnector(ctx context.Context, c *Connector) connectorPoll {
+	poll := connectorPoll{ConnectorID: c.ID, Files: []connectorFile{}}
+	s, err := openConnector(ctx, c)
+	if err != nil {
+		poll.Error = err.Error()
+		return poll
+	}
+	defer s.Close()
+	names, err := s.list(ctx)
+	if err != nil {
+		poll.Error = err.Error()
+		return poll
+	}
+	sort.Strings(names) // oldest first for the usual timestamped names
+	present := map[string]bool{}
+	for _, name := range names {
+		present[name] = true
+	}
+	ctx = withChannel(withPartnerHint(ctx, c.PartnerID), channelIdentity{Kind: channelConnector, Partner: c.PartnerID})
+	ctx = withoutSignatureCheck(ctx)
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		if !c.ready(name, present) {
+			continue
+		}
+		f := pickUp(withCorrelationID(ctx, uuid.New().String()), c, s, name)
+		connectorFiles.WithLabelValues(c.PartnerID, c.Kind, f.Outcome).Inc()
+		poll.Files = append(poll.Files, f)
+	}
+	return poll
+}
+
+// Process one file and remove it, or quarantine it when it is poison
+func pickUp(ctx context.Context, c *Connector, s connectorSession, name string) connectorFile {
+	f := connectorFile{Name: name, Outcome: "failed"}
+	data, err := s.read(ctx, name)
+	poison := ""
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		poison = err.Error()
+	case err != nil:
+		f.Error = err.Error()
+		maxAttempts := c.MaxAttempts
+		if maxAttempts == 0 {
+			maxAttempts = 3
+		}
+		if n := failedAttempt(c, name); n < maxAttempts {
+			log.Printf("ERROR: connector %s: %s: %v (attempt %d)\n", c.ID, name, err, n)
+			return f
+		}
+		poison = fmt.Sprintf("%d failed reads, last: %v", maxAttempts, err)
+	default:
+		inboundCounter.WithLabelValues(tenantID(ctx)).Inc()
+		f.Results = processDocument(ctx, nil, name, c.contentType(name), data)
+		if res := f.Results; len(res) == 1 && res[0].Status == "failed" && res[0].Type == "" {
+			poison = res[0].Error // not a document at all
+		} else if transientFailure(res) {
+			f.Error = "no transaction was saved; retrying at the next poll"
+			return f
+		}
+	}
+	clearAttempts(c, name)
+
+	if poison != "" {
+		f.Error = poison
+		log.Printf("ALERT: connector %s: quarantining %s: %s", c.ID, name, poison)
+		if err := s.quarantine(name); err != nil {
+			log.Printf("ERROR: connector %s: quarantine %s: %v\n", c.ID, name, err)
+			f.Error += "; quarantine: " + err.Error()
+			return f
+		}
+		f.Outcome = "quarantined"
+	} else {
+		f.Outcome = "processed"
+		if err := s.remove(name); err != nil {
+			// Picked up again at the next poll and caught as a duplicate
+			// only by DUPLICATE_INTERCHANGE_WINDOW
+			log.Printf("ERROR: connector %s: remove %s: %v\n", c.ID, name, err)
+			f.Error = "remove: " + err.Error()
+		}
+	}
+	if c.DoneSuffix != "" {
+		if err := s.remove(name + c.DoneSuffix); err != nil {
+			log.Printf("ERROR: connector %s: remove %s: %v\n", c.ID, name+c.DoneSuffix, err)
+		}
+	}
+	return f
+}
+
+// Whether every transaction of a file failed on our side (database, archive,
+// Kafka), so the file is better left for the next poll than removed
+func transientFailure(results []batchResult) bool {
+	for _, res := range results {
+		switch res.Code {
+		case codeInternal, codeUnavailable, codeDownstreamFailed, codeDownstreamTimeout:
+		default:
+			return false
+		}
+	}
+	return len(results) > 0
+}
+
+// Periodically poll the connectors that are due. Polls are claimed by
+// moving last_poll_at, so only one instance polls each connector.
+func runConnectors(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := pollDueConnectors(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: connectors: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pollDueConnectors(ctx context.Context, now time.Time) error {
+	if queueInbound() {
+		return nil // files wait where they are until the database is back
+	}
+	var connectors []Connector
+	if err := db.WithContext(withTenant(ctx, allTenants)).Where("disabled = ?", false).Find(&connectors).Error; err != nil {
+		return err
+	}
+	for i := range connectors {
+		c := &connectors[i]
+		if c.LastPollAt != nil && now.Sub(*c.LastPollAt) < c.pollInterval() {
+			continue
+		}
+		cctx := withAuditor(withTenant(ctx, c.TenantID), systemAuditor("system", "connector"))
+		if !claimPoll(cctx, c, now) {
+			continue
+		}
+		poll := pollConnector(cctx, c)
+		finishPoll(cctx, c, poll)
+	}
+	return nil
+}
+
+// Move last_poll_at from the value read, failing when another instance
+// already did
+func claimPoll(ctx context.Context, c *Connector, now time.Time) bool {
+	q := db.WithContext(ctx).Model(&Connector{}).Where("id = ?", c.ID)
+	if c.LastPollAt == nil {
+		q = q.Where("last_poll_at IS NULL")
+	} else {
+		q = q.Where("last_poll_at = ?", *c.LastPollAt)
+	}
+	res := q.UpdateColumn("last_poll_at", now)
+	if res.Error != nil {
+		log.Printf("ERROR: connector %s: %v\n", c.ID, res.Error)
+		return false
+	}
+	c.LastPollAt = &now
+	return res.RowsAffected == 1
+}
+
+func finishPoll(ctx context.Context, c *Connector, poll connectorPoll) {
+	if poll.Error != "" {
+		log.Printf("ERROR: connector %s: %s\n", c.ID, poll.Error)
+	} else if len(poll.Files) > 0 {
+		log.Printf("Connector %s: picked up %d files", c.ID, len(poll.Files))
+	}
+	c.LastError = poll.Error
+	if err := db.WithContext(ctx).Model(c).UpdateColumn("last_error", poll.Error).Error; err != nil {
+		log.Printf("ERROR: connector %s: %v\n", c.ID, err)
+	}
+}
+
+func loadConnector(ctx context.Context, partnerID, id string) (*Connector, error) {
+	var c Connector
+	if err := db.WithContext(ctx).First(&c, "id = ? AND partner_id = ?", id, partnerID).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Look up the connector of a request, writing the problem when it fails
+func requestConnector(w http.ResponseWriter, r *http.Request) *Connector {
+	vars := mux.Vars(r)
+	c, err := loadConnector(r.Context(), vars["id"], vars["connector"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Connector not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch connector", http.StatusInternalServerError)
+		return nil
+	}
+	return c
+}
+
+// List a partner's connectors
+func listConnectorsHandler(w http.ResponseWriter, r *http.Request) {
+	var connectors []Connector
+	if err := db.WithContext(r.Context()).Where("partner_id = ?", mux.Vars(r)["id"]).Order("created_at").Find(&connectors).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch connectors", http.StatusInternalServerError)
+		return
+	}
+	for i := range connectors {
+		connectors[i] = connectors[i].redacted()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connectors)
+}
+
+// Add a connector to a partner
+func createConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	partnerID := mux.Vars(r)["id"]
+	if _, err := loadPartner(r.Context(), partnerID); errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	var c Connector
+	if err := decodeJSON(w, r, &c); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := c.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ID, c.PartnerID, c.LastPollAt, c.LastError = uuid.New().String(), partnerID, nil, ""
+	if c.Kind == connectorFTP {
+		log.Printf("ALERT: connector %s of partner %s uses plain FTP: credentials and documents cross the network unencrypted", c.ID, partnerID)
+	}
+	if err := db.WithContext(r.Context()).Create(&c).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save connector", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "connector", c.ID, nil, c.redacted())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c.redacted())
+}
+
+// Fetch one connector
+func getConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	c := requestConnector(w, r)
+	if c == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.redacted())
+}
+
+// Replace a connector, keeping its password when none is given
+func updateConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	existing := requestConnector(w, r)
+	if existing == nil {
+		return
+	}
+	var c Connector
+	if err := decodeJSON(w, r, &c); err != nil {
+		writeError(w, err)
+		return
+	}
+	if c.Password == "" || c.Password == passwordMask {
+		c.Password = existing.Password
+	}
+	if err := c.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ID, c.PartnerID, c.TenantID, c.CreatedAt = existing.ID, existing.PartnerID, existing.TenantID, existing.CreatedAt
+	c.LastPollAt, c.LastError = existing.LastPollAt, existing.LastError
+	if err := db.WithContext(r.Context()).Omit("CreatedAt").Save(&c).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save connector", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditUpdate, "connector", c.ID, existing.redacted(), c.redacted())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.redacted())
+}
+
+// Poll a connector now, whatever its interval
+func pollConnectorHandler(w http.ResponseWriter, r *http.Request) {
+	c := requestConnector(w, r)
+	if c == nil {
+		return
+	}
+	ctx := detachedContext(r)
+	if !claimPoll(ctx, c, time.Now()) {
+		writeProblem(w, "Connector is being polled", http.StatusConflict)
+		return
+	}
+	poll := pollConnector(ctx, c)
+	finishPoll(ctx, c, poll)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm/clause"
+)
+
+// Replicas record what they run in a shared heartbeat table so drift
+// between them, e.g. after a partial rollout or a config change applied to
+// some pods only, is caught before partners see inconsistent behavior
+var (
+	instanceID        = getEnv("INSTANCE_ID", hostname())
+	heartbeatInterval = getEnvDuration("HEARTBEAT_INTERVAL", 30*time.Second)
+
+	// Settings expected to differ between replicas
+	driftIgnored = splitList(getEnv("CONFIG_DRIFT_IGNORE", "INSTANCE_ID,HOSTNAME"))
+)
+
+var configDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "edi_config_drift",
+	Help: "1 while live replicas run different builds, schema versions or settings.",
+}, []string{"item"})
+
+// What one replica runs, as of its last heartbeat. Settings maps every
+// setting it has read to a hash of its value, so values are compared
+// without being stored.
+type InstanceHeartbeat struct {
+	InstanceID string    `json:"instance_id" gorm:"primaryKey"`
+	Build      string    `json:"build"`          // VCS revision of the binary
+	Schema     int64     `json:"schema_version"` // latest migration the binary carries
+	Settings   string    `json:"-"`              // JSON object of setting name to value hash
+	StartedAt  time.Time `json:"started_at"`
+	SeenAt     time.Time `json:"seen_at" gorm:"index"`
+}
+
+// One thing live replicas disagree on, and which replicas have which value
+type configDifference struct {
+	Item   string              `json:"item"` // build, schema_version or a setting name
+	Values map[string][]string `json:"values"`
+}
+
+// Live replicas and how their configuration differs
+type clusterConfig struct {
+	Instances []InstanceHeartbeat `json:"instances"`
+	Drift     []configDifference  `json:"drift"`
+}
+
+var instanceStarted = time.Now().UTC()
+
+// Revision the binary was built from, else its module version
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return info.Main.Version
+}
+
+// Number of the newest migration embedded in the binary
+func embeddedSchemaVersion() int64 {
+	entries, _ := fs.ReadDir(migrationsFS, "migrations")
+	var latest int64
+	for _, e := range entries {
+		prefix, _, _ := strings.Cut(e.Name(), "_")
+		if n, err := strconv.ParseInt(prefix, 10, 64); err == nil && n > latest {
+			latest = n
+		}
+	}
+	return latest
+}
+
+// Hashes of the settings read so far; settings naming a file also cover the
+// file's content
+func settingHashes() map[string]string {
+	hashes := map[string]string{}
+	settingsRead.Range(func(k, v interface{}) bool {
+		key, value := k.(string), v.(string)
+		if strings.HasSuffix(key, "_FILE") && value != "" {
+			if data, err := os.ReadFile(value); err == nil {
+				value += "\x00" + string(data)
+			}
+		}
+		sum := sha256.Sum256([]byte(value))
+		hashes[key] = hex.EncodeToString(sum[:8])
+		return true
+	})
+	for _, key := range driftIgnored {
+		delete(hashes, key)
+	}
+	return hashes
+}
+
+// Record this replica's heartbeat, forgetting replicas gone for a day
+func sendHeartbeat(ctx context.Context, now time.Time) error {
+	if err := db.WithContext(ctx).Where("seen_at < ?", now.Add(-24*time.Hour)).Delete(&InstanceHeartbeat{}).Error; err != nil {
+		return err
+	}
+	settings, _ := json.Marshal(settingHashes())
+	hb := InstanceHeartbeat{InstanceID: instanceID, Build: buildVersion(), Schema: embeddedSchemaVersion(),
+		Settings: string(settings), StartedAt: instanceStarted, SeenAt: now.UTC()}
+	return db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "instance_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"build", "schema", "settings", "started_at", "seen_at"}),
+	}).Create(&hb).Error
+}
+
+// Heartbeats of the replicas seen within three intervals, and how they
+// differ. A setting only one replica has read yet is not drift.
+func checkClusterConfig(ctx context.Context, now time.Time) (clusterConfig, error) {
+	c := clusterConfig{Instances: []InstanceHeartbeat{}, Drift: []configDifference{}}
+	if err := db.WithContext(ctx).Where("seen_at >= ?", now.Add(-3*heartbeatInterval)).Order("instance_id").Find(&c.Instances).Error; err != nil {
+		return c, err
+	}
+	values := map[string]map[string][]string{}
+	add := func(item, value, instance string) {
+		if values[item] == nil {
+			values[item] = map[string][]string{}
+		}
+		values[item][value] = append(values[item][value], instance)
+	}
+	for _, hb := range c.Instances {
+		add("build", hb.Build, hb.InstanceID)
+		add("schema_version", strconv.FormatInt(hb.Schema, 10), hb.InstanceID)
+		var settings map[string]string
+		json.Unmarshal([]byte(hb.Settings), &settings)
+		for key, hash := range settings {
+			add(key, hash, hb.InstanceID)
+		}
+	}
+	for item, byValue := range values {
+		if len(byValue) > 1 {
+			c.Drift = append(c.Drift, configDifference{Item: item, Values: byValue})
+		}
+	}
+	sort.Slice(c.Drift, func(i, j int) bool { return c.Drift[i].Item < c.Drift[j].Item })
+	return c, nil
+}
+
+// Periodically send this replica's heartbeat and compare it with the
+// others'. Drift is logged as an ALERT by the first replica by instance ID
+// whenever what differs changes, and shows in edi_config_drift.
+func runConsistencyCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var alerted string
+	flagged := map[string]bool{}
+	for {
+		now := time.Now()
+		if err := sendHeartbeat(ctx, now); err != nil {
+			log.Printf("ERROR: heartbeat: %v\n", err)
+		} else if c, err := checkClusterConfig(ctx, now); err != nil {
+			log.Printf("ERROR: consistency check: %v\n", err)
+		} else {
+			items := make([]string, len(c.Drift))
+			for i, d := range c.Drift {
+				items[i] = d.Item
+			}
+			for item := range flagged {
+				configDrift.WithLabelValues(item).Set(0)
+			}
+			flagged = map[string]bool{}
+			for _, item := range items {
+				configDrift.WithLabelValues(item).Set(1)
+				flagged[item] = true
+			}
+			signature := strings.Join(items, ",")
+			if signature != alerted && len(c.Instances) > 0 && c.Instances[0].InstanceID == instanceID {
+				if len(items) > 0 {
+					log.Printf("ALERT: %d replicas disagree on %s", len(c.Instances), describeDrift(c.Drift))
+				} else if alerted != "" {
+					log.Printf("Configuration of %d replicas is consistent again", len(c.Instances))
+				}
+			}
+			alerted = signature
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func describeDrift(drift []configDifference) string {
+	parts := make([]string, len(drift))
+	for i, d := range drift {
+		groups := make([]string, 0, len(d.Values))
+		for _, instances := range d.Values {
+			groups = append(groups, strings.Join(instances, "+"))
+		}
+		sort.Strings(groups)
+		parts[i] = fmt.Sprintf("%s (%s)", d.Item, strings.Join(groups, " vs "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// List the live replicas with what they run, and what they disagree on
+func clusterConfigHandler(w http.ResponseWriter, r *http.Request) {
+	c, err := checkClusterConfig(r.Context(), time.Now())
+	if err != nil {
+		log.Printf("ERROR: consistency check: %v\n", err)
+		writeProblem(w, "Failed to fetch heartbeats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
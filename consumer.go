@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+)
+
+// Internal systems may request outbound EDI by publishing canonical JSON to
+// KAFKA_OUTBOUND_TOPIC instead of calling the REST API. The outcome of every
+// request is published to KAFKA_OUTBOUND_RESULTS_TOPIC.
+var (
+	outboundTopic        = getEnv("KAFKA_OUTBOUND_TOPIC", "")
+	outboundGroup        = getEnv("KAFKA_OUTBOUND_GROUP", "edigateway-outbound")
+	outboundResultsTopic = getEnv("KAFKA_OUTBOUND_RESULTS_TOPIC", outboundTopic+".results")
+
+	// How long processed requests are remembered. Past it a redelivered or
+	// republished request is processed again, so it should exceed the
+	// topic's retention.
+	outboundDedupTTL = getEnvDuration("KAFKA_OUTBOUND_DEDUP_TTL", 7*24*time.Hour)
+)
+
+var outboundDuplicates = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_outbound_requests_duplicate_total",
+	Help: "Outbound requests from Kafka answered with the result of an earlier one, by what matched it.",
+}, []string{"tenant", "by"}) // event_id or idempotency_key
+
+// Consumed and published event types
+const (
+	eventOutboundRequested = "outbound.requested"
+	eventOutboundAccepted  = "outbound.accepted"
+	eventOutboundRejected  = "outbound.rejected"
+)
+
+// Envelope of an outbound request; the same shape as published events
+type outboundRequest struct {
+	SchemaVersion  int        `json:"schema_version"`
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	OccurredAt     *time.Time `json:"occurred_at,omitempty"`
+	CorrelationID  string     `json:"correlation_id,omitempty"`
+	TenantID       string     `json:"tenant_id,omitempty"`
+	Source         string     `json:"source,omitempty"`
+	IdempotencyKey string     `json:"idempotency_key,omitempty"` // business key, e.g. an ASN's BOL: a partner's requests with one key are duplicates
+	Data           struct {
+		PartnerID string `json:"partner_id"`
+		Type      string `json:"type,omitempty"`
+		ShipTo    string `json:"ship_to"`
+		Carrier   string `json:"carrier"`
+		BOL       string `json:"bol"`
+		ItemList  string `json:"items"`
+	} `json:"data"`
+}
+
+// Outcome of an outbound request, published back to the requester
+type outboundResult struct {
+	SchemaVersion int           `json:"schema_version"`
+	EventID       string        `json:"event_id"`
+	EventType     string        `json:"event_type"`
+	OccurredAt    time.Time     `json:"occurred_at"`
+	CorrelationID string        `json:"correlation_id,omitempty"`
+	TenantID      string        `json:"tenant_id"`
+	Source        string        `json:"source"`
+	Data          ConsumedEvent `json:"data"`
+}
+
+// Outbound request already processed, keyed by the requester's event ID and
+// any idempotency key so redelivered or republished events do not create a
+// second transaction. Kept for KAFKA_OUTBOUND_DEDUP_TTL.
+type ConsumedEvent struct {
+	EventID        string    `json:"request_event_id" gorm:"primaryKey"`
+	TenantID       string    `json:"tenant_id" gorm:"index"`
+	PartnerID      string    `json:"partner_id" gorm:"uniqueIndex:idx_consumed_events_idempotency_key"`
+	IdempotencyKey *string   `json:"idempotency_key,omitempty" gorm:"uniqueIndex:idx_consumed_events_idempotency_key"`
+	Topic          string    `json:"topic,omitempty"` // where the request was first consumed
+	Partition      int       `json:"partition"`
+	Offset         int64     `json:"offset"`
+	TransactionID  string    `json:"transaction_id,omitempty"`
+	DeliveryID     string    `json:"delivery_id,omitempty"`
+	DeliveryStatus string    `json:"delivery_status,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"created_at" gorm:"index"`
+
+	Duplicate bool `json:"duplicate,omitempty" gorm:"-"`
+}
+
+// Request that can never succeed; reported as rejected and not retried
+type invalidRequestError struct {
+	msg string
+}
+
+func (e *invalidRequestError) Error() string {
+	return e.msg
+}
+
+func invalidRequest(format string, args ...interface{}) error {
+	return &invalidRequestError{fmt.Sprintf(format, args...)}
+}
+
+// Consume outbound requests until ctx is cancelled. Offsets are committed
+// only once the result is published, so requests are processed at least once
+// and deduplicated by event ID.
+func runOutboundConsumer(ctx context.Context) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     kafkaRouter.brokers,
+		GroupID:     outboundGroup,
+		GroupTopics: tenantTopics(outboundTopic),
+		ErrorLogger: log.New(os.Stderr, "KAFKA ERROR: ", log.LstdFlags),
+	})
+	defer reader.Close()
+	log.Printf("Consuming outbound requests from %s, results to %s", strings.Join(tenantTopics(outboundTopic), ","), outboundResultsTopic)
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR: outbound consumer: %v\n", err)
+			continue
+		}
+		// Transient failures (database, Kafka) retry the same message with backoff
+		for backoff := time.Second; ; backoff *= 2 {
+			err = handleOutboundRequest(ctx, msg)
+			if err == nil {
+				break
+			}
+			log.Printf("ERROR: outbound request at %s/%d offset %d: %v\n", msg.Topic, msg.Partition, msg.Offset, err)
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+		}
+		if err := reader.CommitMessages(ctx, msg); err != nil && ctx.Err() == nil {
+			log.Printf("ERROR: outbound consumer commit: %v\n", err)
+		}
+	}
+}
+
+// Process one request and publish its result. Returns an error only for
+// failures worth retrying.
+func handleOutboundRequest(ctx context.Context, msg kafka.Message) error {
+	req, err := decodeOutboundRequest(msg)
+	ctx = withCorrelationID(ctx, requestCorrelationID(req, msg))
+	tenant := requestTenant(req, msg)
+	ctx = withTenant(ctx, tenant)
+	if err == nil && !knownTenant(tenant) {
+		err = invalidRequest("unknown tenant %s", tenant)
+	}
+	if owner := topicTenant(msg.Topic); err == nil && owner != "" && owner != tenant {
+		err = invalidRequest("tenant %s may not publish to %s", tenant, msg.Topic)
+	}
+	if err != nil {
+		return publishOutboundResult(ctx, eventOutboundRejected, ConsumedEvent{
+			EventID: req.EventID, PartnerID: req.Data.PartnerID, Error: err.Error(), CreatedAt: time.Now(),
+		})
+	}
+
+	// Event IDs are unique across tenants, so look for the ID in all of them
+	var done ConsumedEvent
+	res := db.WithContext(allTenantsContext()).Where("event_id = ?", req.EventID).Limit(1).Find(&done)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 && done.TenantID != tenant {
+		return publishOutboundResult(ctx, eventOutboundRejected, ConsumedEvent{
+			EventID: req.EventID, PartnerID: req.Data.PartnerID, Error: "event_id already used by another tenant", CreatedAt: time.Now(),
+		})
+	}
+	if res.RowsAffected > 0 {
+		outboundDuplicates.WithLabelValues(tenant, "event_id").Inc()
+		done.Duplicate = true
+		return publishOutboundResult(ctx, eventOutboundAccepted, done)
+	}
+	key := requestIdempotencyKey(req, msg)
+	if key != "" {
+		res := db.WithContext(ctx).Where("partner_id = ? AND idempotency_key = ?", req.Data.PartnerID, key).Limit(1).Find(&done)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			log.Printf("Outbound request %s duplicates %s (idempotency key %s)", req.EventID, done.EventID, key)
+			outboundDuplicates.WithLabelValues(tenant, "idempotency_key").Inc()
+			done.Duplicate = true
+			return publishOutboundResult(ctx, eventOutboundAccepted, done)
+		}
+	}
+
+	done, err = acceptOutboundRequest(ctx, req, msg, key)
+	var invalid *invalidRequestError
+	if errors.As(err, &invalid) {
+		return publishOutboundResult(ctx, eventOutboundRejected, ConsumedEvent{
+			EventID: req.EventID, PartnerID: req.Data.PartnerID, Error: err.Error(), CreatedAt: time.Now(),
+		})
+	} else if err != nil {
+		return err
+	}
+	return publishOutboundResult(ctx, eventOutboundAccepted, done)
+}
+
+// Decode and validate a request against the outbound.requested schema
+func decodeOutboundRequest(msg kafka.Message) (outboundRequest, error) {
+	var req outboundRequest
+	value := msg.Value
+	if len(value) > 5 && value[0] == 0 {
+		value = value[5:] // schema registry wire format
+	}
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, invalidRequest("invalid JSON: %v", err)
+	}
+	switch {
+	case req.EventID == "":
+		return req, invalidRequest("event_id is required")
+	case req.SchemaVersion != eventSchemaVersion:
+		return req, invalidRequest("unsupported schema_version %d", req.SchemaVersion)
+	case req.EventType != eventOutboundRequested:
+		return req, invalidRequest("event_type must be %s", eventOutboundRequested)
+	case req.Data.PartnerID == "":
+		return req, invalidRequest("data.partner_id is required")
+	case req.Data.ShipTo == "":
+		return req, invalidRequest("data.ship_to is required")
+	case req.Data.ItemList == "":
+		return req, invalidRequest("data.items is required")
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(req.Data.ItemList), &items); err != nil {
+		return req, invalidRequest("data.items must be a JSON array: %v", err)
+	}
+	return req, nil
+}
+
+// Correlation ID from the envelope or header, else the request's event ID
+func requestCorrelationID(req outboundRequest, msg kafka.Message) string {
+	if req.CorrelationID != "" {
+		return req.CorrelationID
+	}
+	for _, h := range msg.Headers {
+		if h.Key == "correlation_id" && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	return req.EventID
+}
+
+// Idempotency key from the envelope or header; "" for none
+func requestIdempotencyKey(req outboundRequest, msg kafka.Message) string {
+	if req.IdempotencyKey != "" {
+		return req.IdempotencyKey
+	}
+	for _, h := range msg.Headers {
+		if h.Key == "idempotency_key" && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Tenant from the envelope or header, else the topic's tenant or DEFAULT_TENANT
+func requestTenant(req outboundRequest, msg kafka.Message) string {
+	if req.TenantID != "" {
+		return req.TenantID
+	}
+	for _, h := range msg.Headers {
+		if h.Key == "tenant_id" && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	if owner := topicTenant(msg.Topic); owner != "" {
+		return owner
+	}
+	return defaultTenant
+}
+
+// Create the transaction, record the event ID and idempotency key and
+// deliver to the partner when it has a delivery URL; otherwise the
+// transaction waits in the outbox for GET /outbound, or for the partner's
+// next batch when it has batch_outbound
+func acceptOutboundRequest(ctx context.Context, req outboundRequest, msg kafka.Message, key string) (ConsumedEvent, error) {
+	p, err := loadPartner(ctx, req.Data.PartnerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ConsumedEvent{}, invalidRequest("unknown partner %s", req.Data.PartnerID)
+	} else if err != nil {
+		return ConsumedEvent{}, err
+	} else if p.deactivated() {
+		return ConsumedEvent{}, invalidRequest("partner %s is deactivated", p.ID)
+	}
+
+	t := Transaction{
+		PartnerID: p.ID,
+		Type:      req.Data.Type,
+		ShipTo:    req.Data.ShipTo,
+		Carrier:   req.Data.Carrier,
+		BOL:       req.Data.BOL,
+		ItemList:  req.Data.ItemList,
+		Format:    formatJSON,
+	}
+	if t.Type == "" {
+		t.Type = "856"
+	}
+	newInboundTransaction(ctx, &t, time.Now())
+	t.ConfigVersion = processingConfigVersion(ctx)
+	done := ConsumedEvent{EventID: req.EventID, PartnerID: p.ID, TransactionID: t.ID, Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}
+	if key != "" {
+		done.IdempotencyKey = &key
+	}
+
+	actx := withAuditor(ctx, systemAuditor("partner:"+p.ID, "kafka"))
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&t).Error; err != nil {
+			return fmt.Errorf("%w: %w", errSaveFailed, err)
+		}
+		if err := appendReceivedEvent(actx, tx, t, map[string]interface{}{"partner_id": t.PartnerID, "type": t.Type, "event_id": req.EventID}); err != nil {
+			return fmt.Errorf("%w: %w", errSaveFailed, err)
+		}
+		return tx.Create(&done).Error
+	})
+	if err != nil {
+		return ConsumedEvent{}, err
+	}
+	auditChange(actx, auditCreate, "transaction", t.ID, nil, nil)
+	postToMailbox(ctx, mailboxOutbox, p.ID, t.ID)
+	projectTransaction(ctx, t)
+	if err := publishTransaction(ctx, eventTransactionCreated, t); err != nil {
+		log.Printf("ERROR: %v: %v\n", errPublishFailed, err)
+	}
+
+	if p.BatchOutbound {
+		done.DeliveryStatus = deliveryBatched
+		if err := db.WithContext(ctx).Model(&done).Update("delivery_status", done.DeliveryStatus).Error; err != nil {
+			log.Printf("ERROR: event %s: %v\n", req.EventID, err)
+		}
+	} else if p.DeliveryURL != "" {
+		d, err := deliverOutbound(ctx, p, []Transaction{t})
+		if err != nil {
+			log.Printf("ERROR: delivery for event %s: %v\n", req.EventID, err)
+			done.Error = err.Error()
+		}
+		done.DeliveryID, done.DeliveryStatus = d.ID, d.Status
+		if err := db.WithContext(ctx).Model(&done).Select("delivery_id", "delivery_status", "error").Updates(&done).Error; err != nil {
+			log.Printf("ERROR: event %s: %v\n", req.EventID, err)
+		}
+	}
+	return done, nil
+}
+
+// Periodically forget requests processed more than KAFKA_OUTBOUND_DEDUP_TTL ago
+func runConsumedEventPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res := db.WithContext(allTenantsContext()).Where("created_at < ?", time.Now().Add(-outboundDedupTTL)).Delete(&ConsumedEvent{})
+		if res.Error != nil {
+			log.Printf("ERROR: consumed event purge: %v\n", res.Error)
+		} else if res.RowsAffected > 0 {
+			log.Printf("Forgot %d outbound requests processed over %s ago", res.RowsAffected, outboundDedupTTL)
+		}
+	}
+}
+
+// Publish the outcome of a request to the results topic
+func publishOutboundResult(ctx context.Context, eventType string, done ConsumedEvent) error {
+	env := outboundResult{
+		SchemaVersion: eventSchemaVersion,
+		EventID:       uuid.New().String(),
+		EventType:     eventType,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: correlationID(ctx),
+		TenantID:      tenantID(ctx),
+		Source:        "edigateway",
+		Data:          done,
+	}
+	value, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	key := done.PartnerID
+	if key == "" {
+		key = done.EventID
+	}
+	release, err := acquireKafkaSlot(ctx, priorityNormal)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return publisher.publish(ctx, tenantTopic(ctx, outboundResultsTopic), kafka.Message{
+		Key:   []byte(key),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "event_id", Value: []byte(env.EventID)},
+			{Key: "event_type", Value: []byte(eventType)},
+			{Key: "schema_version", Value: []byte(strconv.Itoa(eventSchemaVersion))},
+			{Key: "correlation_id", Value: []byte(env.CorrelationID)},
+			{Key: "tenant_id", Value: []byte(env.TenantID)},
+			{Key: "content_type", Value: []byte("application/json")},
+		},
+	})
+}
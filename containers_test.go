@@ -0,0 +1,211 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// The pipeline scenario on PostgreSQL and Kafka in containers, which needs
+// Docker: go test -tags integration -run TestPipelinePostgresKafka
+
+// Start PostgreSQL and return its DSN
+func startPostgres(ctx context.Context, t *testing.T) string {
+	t.Helper()
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "postgres:16-alpine",
+			ExposedPorts: []string{"5432/tcp"},
+			Env:          map[string]string{"POSTGRES_USER": "edi", "POSTGRES_PASSWORD": "edi", "POSTGRES_DB": "edi_gateway"},
+			// The server restarts once after running the init scripts
+			WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("postgres: %v", err)
+	}
+	t.Cleanup(func() { c.Terminate(context.Background()) })
+	host, err := c.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := c.MappedPort(ctx, "5432/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("host=%s port=%s user=edi password=edi dbname=edi_gateway sslmode=disable", host, port.Port())
+}
+
+// Start a single node Kafka and return its broker address. The broker must
+// advertise the port Docker mapped, known only once the container runs, so
+// the container waits for a start script written after that.
+func startKafka(ctx context.Context, t *testing.T) string {
+	t.Helper()
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "confluentinc/confluent-local:7.5.0",
+			ExposedPorts: []string{"9093/tcp"},
+			Env: map[string]string{
+				"KAFKA_LISTENERS":                                "PLAINTEXT://0.0.0.0:9093,BROKER://0.0.0.0:9092,CONTROLLER://0.0.0.0:9094",
+				"KAFKA_LISTENER_SECURITY_PROTOCOL_MAP":           "BROKER:PLAINTEXT,PLAINTEXT:PLAINTEXT,CONTROLLER:PLAINTEXT",
+				"KAFKA_INTER_BROKER_LISTENER_NAME":               "BROKER",
+				"KAFKA_CONTROLLER_LISTENER_NAMES":                "CONTROLLER",
+				"KAFKA_CONTROLLER_QUORUM_VOTERS":                 "1@localhost:9094",
+				"KAFKA_PROCESS_ROLES":                            "broker,controller",
+				"KAFKA_NODE_ID":                                  "1",
+				"KAFKA_BROKER_ID":                                "1",
+				"KAFKA_OFFSETS_TOPIC_REPLICATION_FACTOR":         "1",
+				"KAFKA_OFFSETS_TOPIC_NUM_PARTITIONS":             "1",
+				"KAFKA_TRANSACTION_STATE_LOG_MIN_ISR":            "1",
+				"KAFKA_TRANSACTION_STATE_LOG_REPLICATION_FACTOR": "1",
+				"KAFKA_GROUP_INITIAL_REBALANCE_DELAY_MS":         "0",
+				"KAFKA_AUTO_CREATE_TOPICS_ENABLE":                "false",
+				"CLUSTER_ID":                                     "edigateway-integration",
+			},
+			Entrypoint: []string{"sh"},
+			Cmd:        []string{"-c", "while [ ! -f /tmp/start.sh ]; do sleep 0.1; done; sh /tmp/start.sh"},
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("kafka: %v", err)
+	}
+	t.Cleanup(func() { c.Terminate(context.Background()) })
+	host, err := c.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := c.MappedPort(ctx, "9093/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := net.JoinHostPort(host, port.Port())
+	script := "export KAFKA_ADVERTISED_LISTENERS=PLAINTEXT://" + broker + ",BROKER://$(hostname):9092\nexec /etc/confluent/docker/run\n"
+	if err := c.CopyToContainer(ctx, []byte(script), "/tmp/start.sh", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.ForLog("Kafka Server started").WithStartupTimeout(2*time.Minute).WaitUntilReady(ctx, c); err != nil {
+		t.Fatalf("kafka: %v", err)
+	}
+	return broker
+}
+
+// Create topics with one partition, as the gateway does not create them
+func createTopics(t *testing.T, broker string, topics ...string) {
+	t.Helper()
+	conn, err := kafka.Dial("tcp", broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	controller, err := conn.Controller()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := kafka.Dial("tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	configs := make([]kafka.TopicConfig, len(topics))
+	for i, topic := range topics {
+		configs[i] = kafka.TopicConfig{Topic: topic, NumPartitions: 1, ReplicationFactor: 1}
+	}
+	if err := cc.CreateTopics(configs...); err != nil {
+		t.Fatalf("create topics: %v", err)
+	}
+}
+
+// Collects the messages of topics as they are written
+type topicCollector struct {
+	mu     sync.Mutex
+	events []publishedEvent
+}
+
+func collectTopics(t *testing.T, broker string, topics ...string) *topicCollector {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := &topicCollector{}
+	for _, topic := range topics {
+		reader := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{broker}, Topic: topic, MaxWait: 100 * time.Millisecond})
+		t.Cleanup(func() { reader.Close() })
+		go func() {
+			for {
+				msg, err := reader.ReadMessage(ctx)
+				if err != nil {
+					return
+				}
+				e := publishedEvent{Offset: msg.Offset, Topic: msg.Topic, Key: string(msg.Key), Headers: map[string]string{}, Value: msg.Value, PublishedAt: msg.Time}
+				for _, h := range msg.Headers {
+					e.Headers[h.Key] = string(h.Value)
+				}
+				c.mu.Lock()
+				c.events = append(c.events, e)
+				c.mu.Unlock()
+			}
+		}()
+	}
+	return c
+}
+
+func (c *topicCollector) ofType(eventType string) []publishedEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []publishedEvent
+	for _, e := range c.events {
+		if e.Headers["event_type"] == eventType {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func TestPipelinePostgresKafka(t *testing.T) {
+	ctx := context.Background()
+	dsn := startPostgres(ctx, t)
+	broker := startKafka(ctx, t)
+
+	setForTest(t, &databaseDriver, "postgres")
+	setForTest(t, &migrateOnStart, true)
+	setForTest(t, &eventsBackend, "kafka")
+	setForTest(t, &kafkaAsync, false)
+	setForTest(t, &kafkaMinInsyncReplicas, 1)
+	setForTest(t, &outboundTopic, "edi.outbound.requested")
+	setForTest(t, &outboundResultsTopic, "edi.outbound.requested.results")
+	t.Setenv("DATABASE_DSN", dsn)
+	t.Setenv("KAFKA_BROKERS", broker)
+
+	topics := []string{outboundTopic, outboundResultsTopic}
+	for _, class := range eventClasses {
+		topics = append(topics, defaultEventTopics[class])
+	}
+	createTopics(t, broker, topics...)
+	events := collectTopics(t, broker, topics...)
+
+	srv := startGateway(t)
+	writer := &kafka.Writer{Addr: kafka.TCP(broker), Topic: outboundTopic, RequiredAcks: kafka.RequireAll}
+	defer writer.Close()
+	runPipelineScenario(t, srv, pipelineBackend{
+		events: func(t *testing.T, eventType string) []publishedEvent {
+			return events.ofType(eventType)
+		},
+		requestOutbound: func(t *testing.T, msg kafka.Message) {
+			// The topic is the writer's
+			msg.Topic = ""
+			if err := writer.WriteMessages(ctx, msg); err != nil {
+				t.Fatalf("outbound request: %v", err)
+			}
+		},
+	})
+}
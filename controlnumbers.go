@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// States of an interchange control number in the ledger
+const (
+	controlReserved = "reserved" // taken from the partner's sequence, interchange not sent yet
+	controlUsed     = "used"     // interchange returned by GET /outbound or delivered
+	controlVoided   = "voided"   // never reached the partner, e.g. a failed build or delivery
+	controlSkipped  = "skipped"  // jumped over when the sequence was advanced
+)
+
+// One interchange control number of a partner. Numbers the partner never
+// receives leave a gap in its sequence; the ledger says why.
+type ControlNumber struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	TenantID   string    `json:"tenant_id" gorm:"index"`
+	PartnerID  string    `json:"partner_id" gorm:"uniqueIndex:idx_control_numbers_partner_number"`
+	Number     int64     `json:"number" gorm:"uniqueIndex:idx_control_numbers_partner_number"`
+	Status     string    `json:"status" gorm:"index"`
+	DeliveryID string    `json:"delivery_id,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Record a number just taken from a partner's sequence. The ledger is
+// bookkeeping: failing to write it does not fail the interchange and shows up
+// as a missing number in the gap report.
+func reserveControlNumber(ctx context.Context, p Partner, number int64) {
+	c := ControlNumber{PartnerID: p.ID, Number: number, Status: controlReserved}
+	err := db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "partner_id"}, {Name: "number"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"status": controlReserved, "delivery_id": "", "reason": "", "updated_at": time.Now()}),
+	}).Create(&c).Error
+	if err != nil {
+		log.Printf("ERROR: control number ledger %s %d: %v\n", p.ID, number, err)
+	}
+}
+
+// Move a reserved number to used or voided once its interchange was sent or
+// given up on
+func settleControlNumber(ctx context.Context, partnerID string, number int64, status, deliveryID, reason string) {
+	if partnerID == defaultPartner.ID || number == 0 || previewing(ctx) {
+		return
+	}
+	err := db.WithContext(ctx).Model(&ControlNumber{}).Where("partner_id = ? AND number = ?", partnerID, number).
+		Updates(map[string]interface{}{"status": status, "delivery_id": deliveryID, "reason": reason}).Error
+	if err != nil {
+		log.Printf("ERROR: control number ledger %s %d: %v\n", partnerID, number, err)
+	}
+}
+
+// Settle the numbers of interchanges built for one response
+func settleOutbound(ctx context.Context, docs []outboundDocument, status, reason string) {
+	for _, doc := range docs {
+		settleControlNumber(ctx, doc.PartnerID, doc.Number, status, "", reason)
+	}
+}
+
+const maxControlNumberSpan = 100000
+
+// Query bounds shared by the ledger endpoints
+func controlNumberRange(r *http.Request) (from, to int64, err error) {
+	for param, v := range map[string]*int64{"from": &from, "to": &to} {
+		if s := r.URL.Query().Get(param); s != "" {
+			if *v, err = strconv.ParseInt(s, 10, 64); err != nil || *v < 0 {
+				return 0, 0, errors.New(param + " must be a control number")
+			}
+		}
+	}
+	return from, to, nil
+}
+
+// List a partner's ledger, optionally by status and number range
+func listControlNumbersHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := controlNumberRange(r)
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := db.WithContext(r.Context()).Where("partner_id = ?", mux.Vars(r)["id"]).Order("number").Limit(1000)
+	if from > 0 {
+		query = query.Where("number >= ?", from)
+	}
+	if to > 0 {
+		query = query.Where("number <= ?", to)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	entries := []ControlNumber{}
+	if err := query.Find(&entries).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch control numbers", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Consecutive numbers that did not reach the partner for the same reason
+type controlNumberGap struct {
+	From   int64  `json:"from"`
+	To     int64  `json:"to"`
+	Status string `json:"status"` // reserved, voided, skipped or missing (no ledger entry)
+	Reason string `json:"reason,omitempty"`
+}
+
+type controlNumberReport struct {
+	PartnerID string             `json:"partner_id"`
+	From      int64              `json:"from"`
+	To        int64              `json:"to"`
+	Used      int                `json:"used"`
+	Gaps      []controlNumberGap `json:"gaps"`
+}
+
+// Report every number between from (default the first in the ledger) and to
+// (default the partner's current number) that was not used
+func controlNumberGapsHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := loadPartner(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	from, to, err := controlNumberRange(r)
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scoped := db.WithContext(r.Context()).Model(&ControlNumber{}).Where("partner_id = ?", p.ID)
+	if from == 0 {
+		var first ControlNumber
+		if err := scoped.Session(&gorm.Session{}).Order("number").Limit(1).Find(&first).Error; err != nil {
+			log.Printf("ERROR: %v\n", err)
+			writeProblem(w, "Failed to fetch control numbers", http.StatusInternalServerError)
+			return
+		}
+		from = first.Number
+	}
+	if to == 0 {
+		to = p.ControlNumber % 1000000000
+	}
+	report := controlNumberReport{PartnerID: p.ID, From: from, To: to, Gaps: []controlNumberGap{}}
+	if from == 0 || to < from {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	if to-from >= maxControlNumberSpan {
+		writeProblem(w, "Range is limited to 100000 control numbers", http.StatusBadRequest)
+		return
+	}
+	var entries []ControlNumber
+	if err := scoped.Where("number BETWEEN ? AND ?", from, to).Order("number").Find(&entries).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch control numbers", http.StatusInternalServerError)
+		return
+	}
+	next := 0
+	for n := from; n <= to; n++ {
+		gap := controlNumberGap{From: n, To: n, Status: "missing"}
+		if next < len(entries) && entries[next].Number == n {
+			e := entries[next]
+			next++
+			if e.Status == controlUsed {
+				report.Used++
+				continue
+			}
+			gap.Status, gap.Reason = e.Status, e.Reason
+		}
+		if last := len(report.Gaps) - 1; last >= 0 && report.Gaps[last].To == n-1 &&
+			report.Gaps[last].Status == gap.Status && report.Gaps[last].Reason == gap.Reason {
+			report.Gaps[last].To = n
+			continue
+		}
+		report.Gaps = append(report.Gaps, gap)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Void a number, e.g. for an interchange the partner rejected or a
+// reservation left behind by a crash
+func voidControlNumberHandler(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.ParseInt(mux.Vars(r)["number"], 10, 64)
+	if err != nil {
+		writeProblem(w, "Invalid control number", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := decodeJSON(w, r, &body); err != nil && err != errEmptyBody {
+		writeError(w, err)
+		return
+	}
+	var c ControlNumber
+	err = db.WithContext(r.Context()).First(&c, "partner_id = ? AND number = ?", mux.Vars(r)["id"], number).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Control number not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch control number", http.StatusInternalServerError)
+		return
+	}
+	if c.Status == controlSkipped {
+		writeProblem(w, "Skipped control numbers cannot be voided", http.StatusConflict)
+		return
+	}
+	before := c
+	c.Status, c.Reason = controlVoided, body.Reason
+	if err := db.WithContext(r.Context()).Model(&c).Select("status", "reason").Updates(&c).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to void control number", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditUpdate, "control_number", c.PartnerID+"/"+strconv.FormatInt(number, 10), before, c)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// Advance a partner's sequence so the next interchange uses "next", recording
+// the numbers jumped over as skipped. Used to line up with a partner that
+// expects a higher number, e.g. after migrating from another translator.
+func skipControlNumbersHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Next   int64  `json:"next"`
+		Reason string `json:"reason"`
+	}
+	if err := decodeJSON(w, r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+	var skipped []ControlNumber
+	var p Partner
+	err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&p, "id = ?", mux.Vars(r)["id"]).Error; err != nil {
+			return err
+		}
+		current := p.ControlNumber % 1000000000
+		if body.Next <= current+1 || body.Next-current-1 > maxControlNumberSpan || body.Next > 999999999 {
+			return &httpError{Status: http.StatusBadRequest, Message: "next must be above the current control number " + strconv.FormatInt(current, 10) +
+				" and skip at most 100000 numbers"}
+		}
+		for n := current + 1; n < body.Next; n++ {
+			skipped = append(skipped, ControlNumber{PartnerID: p.ID, Number: n, Status: controlSkipped, Reason: body.Reason})
+		}
+		if err := tx.Model(&p).UpdateColumn("control_number", p.ControlNumber+body.Next-current-1).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&skipped, 1000).Error
+	})
+	var he *httpError
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if errors.As(err, &he) {
+		writeError(w, he)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to skip control numbers", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditUpdate, "partner", p.ID,
+		map[string]int64{"control_number": skipped[0].Number - 1}, map[string]interface{}{"control_number": body.Next - 1, "skipped": len(skipped), "reason": body.Reason})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(controlNumberGap{From: skipped[0].Number, To: body.Next - 1, Status: controlSkipped, Reason: body.Reason})
+}
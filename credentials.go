@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Partner credentials: shared HMAC secrets, AS2 and client certificates and
+// public keys, each with its expiry. Rotating one adds its replacement and
+// keeps accepting the old value for an overlap, so a partner can switch
+// over without failed requests. Signed submissions verify with the
+// profile's signing_secret or any usable signing_secret credential, MDNs
+// with the profile's as2_certificate or any usable as2_certificate one.
+type PartnerCredential struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	TenantID    string     `json:"tenant_id" gorm:"index"`
+	PartnerID   string     `json:"partner_id" gorm:"index"`
+	Kind        string     `json:"kind"` // signing_secret, as2_certificate, client_certificate or public_key
+	Name        string     `json:"name,omitempty"`
+	Value       string     `json:"value,omitempty" gorm:"serializer:encrypted"` // PEM, or the secret when CREDENTIAL_BACKEND is db; secrets read back masked
+	Ref         string     `json:"-"`                                           // where CREDENTIAL_BACKEND vault keeps a secret
+	Fingerprint string     `json:"fingerprint"`                                 // SHA-256 of the DER, or the start of the secret's
+	Subject     string     `json:"subject,omitempty"`
+	Issuer      string     `json:"issuer,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` // a certificate's NotAfter
+	Status      string     `json:"status" gorm:"index"`  // active, retiring or retired
+	RetiresAt   *time.Time `json:"retires_at,omitempty"` // a retiring credential is accepted until then
+	ReplacedBy  uint       `json:"replaced_by,omitempty"`
+	ExpiryAlert string     `json:"expiry_alert,omitempty"` // expiring or expired, the last alert sent
+	CreatedBy   string     `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// Kinds of credential
+const (
+	credentialSigningSecret     = "signing_secret"
+	credentialAS2Certificate    = "as2_certificate"
+	credentialClientCertificate = "client_certificate"
+	credentialPublicKey         = "public_key"
+)
+
+// Credential states
+const (
+	credentialActive   = "active"
+	credentialRetiring = "retiring"
+	credentialRetired  = "retired"
+)
+
+const (
+	auditRotate = "rotate"
+	auditRevoke = "revoke"
+)
+
+var (
+	// Where shared secrets are kept: db, encrypted in the credential's row,
+	// or vault, a HashiCorp Vault KV version 2 engine. Certificates and
+	// public keys are not secret and always stay in the database.
+	credentialBackend = getEnv("CREDENTIAL_BACKEND", "db")
+	// How long a rotated credential is still accepted, unless the rotation
+	// says otherwise
+	credentialRotationOverlap = getEnvDuration("CREDENTIAL_ROTATION_OVERLAP", 24*time.Hour)
+	// Credentials expiring within this are alerted on
+	credentialExpiryWarning = getEnvDuration("CREDENTIAL_EXPIRY_WARNING", 30*24*time.Hour)
+	credentialAlertURL      = getEnv("CREDENTIAL_ALERT_WEBHOOK_URL", "")
+)
+
+var credentialExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "edi_partner_credential_expiry_seconds",
+	Help: "Seconds until each usable partner credential or profile certificate expires, negative once expired.",
+}, []string{"tenant", "partner", "kind", "credential"})
+
+// Keeps the values of secret credentials
+type secretStore interface {
+	// Save a new secret of c, setting c.Value or c.Ref
+	put(ctx context.Context, c *PartnerCredential, value string) error
+	get(ctx context.Context, c PartnerCredential) (string, error)
+}
+
+type dbSecrets struct{}
+
+func (dbSecrets) put(ctx context.Context, c *PartnerCredential, value string) error {
+	c.Value = value
+	return nil
+}
+
+func (dbSecrets) get(ctx context.Context, c PartnerCredential) (string, error) {
+	return c.Value, nil
+}
+
+var secrets = newSecretStore()
+
+func newSecretStore() secretStore {
+	if credentialBackend == "vault" {
+		return newVaultSecrets()
+	}
+	return dbSecrets{}
+}
+
+// Body creating a credential
+type credentialRequest struct {
+	Kind      string     `json:"kind"`
+	Name      string     `json:"name,omitempty"`
+	Value     string     `json:"value"`                // PEM for certificates and public keys
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // for secrets and public keys; certificates carry theirs
+}
+
+// Body rotating a credential
+type credentialRotation struct {
+	Name           string     `json:"name,omitempty"` // defaults to the rotated credential's
+	Value          string     `json:"value"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	OverlapMinutes *int       `json:"overlap_minutes,omitempty"` // how long the old value is still accepted; 0 retires it at once
+}
+
+func secretKind(kind string) bool {
+	return kind == credentialSigningSecret
+}
+
+// Check a credential's value and take what it says about itself: the
+// fingerprint, and a certificate's subject, issuer and validity
+func (c *PartnerCredential) describe(value string) error {
+	switch c.Kind {
+	case credentialSigningSecret:
+		if len(value) < 16 {
+			return errors.New("a signing_secret needs at least 16 characters")
+		}
+		sum := sha256.Sum256([]byte(value))
+		c.Fingerprint = hex.EncodeToString(sum[:8])
+		return nil
+	case credentialAS2Certificate, credentialClientCertificate:
+		cert, err := parseCertificatePEM(value)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(cert.Raw)
+		notBefore, notAfter := cert.NotBefore, cert.NotAfter
+		c.Fingerprint, c.Subject, c.Issuer = hex.EncodeToString(sum[:]), cert.Subject.String(), cert.Issuer.String()
+		c.NotBefore, c.ExpiresAt = &notBefore, &notAfter
+		return nil
+	case credentialPublicKey:
+		block, _ := pem.Decode([]byte(value))
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return errors.New("value must be a PEM PUBLIC KEY")
+		}
+		if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return fmt.Errorf("value: %w", err)
+		}
+		sum := sha256.Sum256(block.Bytes)
+		c.Fingerprint = hex.EncodeToString(sum[:])
+		return nil
+	}
+	return errors.New("kind must be signing_secret, as2_certificate, client_certificate or public_key")
+}
+
+func parseCertificatePEM(value string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(value))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("value must be a PEM CERTIFICATE")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+	return cert, nil
+}
+
+// Build a new active credential of p from its kind, name, value and expiry
+func newCredential(ctx context.Context, p Partner, kind, name, value string, expiresAt *time.Time) (*PartnerCredential, error) {
+	c := &PartnerCredential{PartnerID: p.ID, Kind: kind, Name: strings.TrimSpace(name), Status: credentialActive, CreatedBy: auditorFrom(ctx).actor}
+	value = strings.TrimSpace(value)
+	if err := c.describe(value); err != nil {
+		return nil, &httpError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	if c.ExpiresAt == nil {
+		c.ExpiresAt = expiresAt
+	}
+	if c.ExpiresAt != nil && !c.ExpiresAt.After(time.Now()) {
+		return nil, &httpError{Status: http.StatusBadRequest, Message: "credential is already expired"}
+	}
+	if !secretKind(kind) {
+		c.Value = value
+		return c, nil
+	}
+	if err := secrets.put(ctx, c, value); err != nil {
+		log.Printf("ERROR: credential store: %v\n", err)
+		return nil, &httpError{Status: http.StatusServiceUnavailable, Message: "Failed to store the secret"}
+	}
+	return c, nil
+}
+
+// Whether c is accepted at now: active, or retiring within its overlap,
+// and not expired
+func (c PartnerCredential) usable(now time.Time) bool {
+	if c.ExpiresAt != nil && !c.ExpiresAt.After(now) {
+		return false
+	}
+	return c.Status == credentialActive || (c.Status == credentialRetiring && c.RetiresAt != nil && c.RetiresAt.After(now))
+}
+
+// The credential as the API shows it, a secret masked
+func (c PartnerCredential) redacted() PartnerCredential {
+	if secretKind(c.Kind) {
+		c.Value = passwordMask
+	}
+	return c
+}
+
+// Usable credentials of a partner of one kind
+func usableCredentials(ctx context.Context, partnerID, kind string) ([]PartnerCredential, error) {
+	var list []PartnerCredential
+	now := time.Now()
+	err := db.WithContext(ctx).Where("partner_id = ? AND kind = ? AND status IN ?", partnerID, kind, []string{credentialActive, credentialRetiring}).
+		Order("id DESC").Find(&list).Error
+	usable := list[:0]
+	for _, c := range list {
+		if c.usable(now) {
+			usable = append(usable, c)
+		}
+	}
+	return usable, err
+}
+
+// Secrets a partner may sign submissions with: the profile's, then its
+// usable signing_secret credentials, newest first
+func signingSecrets(ctx context.Context, p Partner) ([]string, error) {
+	var keys []string
+	if p.SigningSecret != "" {
+		keys = append(keys, p.SigningSecret)
+	}
+	list, err := usableCredentials(ctx, p.ID, credentialSigningSecret)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range list {
+		v, err := secrets.get(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("credential %d: %w", c.ID, err)
+		}
+		keys = append(keys, v)
+	}
+	return keys, nil
+}
+
+// Certificates a partner may sign MDNs with: the profile's, then its usable
+// as2_certificate credentials. None means its MDNs cannot be verified.
+func partnerCertificates(ctx context.Context, p Partner) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	if p.AS2Certificate != "" {
+		cert, err := partnerCertificate(p)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	list, err := usableCredentials(ctx, p.ID, credentialAS2Certificate)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range list {
+		cert, err := parseCertificatePEM(c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("credential %d: %w", c.ID, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// Partner API keys cannot see or change credentials
+func credentialManager(ctx context.Context) error {
+	if auditorFrom(ctx).partner != "" {
+		return &httpError{Status: http.StatusForbidden, Message: "Partner API keys cannot manage credentials"}
+	}
+	return nil
+}
+
+// Load the credential of the request's partner and ID, writing the problem
+// when it fails
+func requestCredential(w http.ResponseWriter, r *http.Request) (PartnerCredential, bool) {
+	var c PartnerCredential
+	if err := credentialManager(r.Context()); err != nil {
+		writeError(w, err)
+		return c, false
+	}
+	err := db.WithContext(r.Context()).First(&c, "id = ? AND partner_id = ?", mux.Vars(r)["credential"], mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Credential not found", http.StatusNotFound)
+		return c, false
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch credential", http.StatusInternalServerError)
+		return c, false
+	}
+	return c, true
+}
+
+func writeCredential(w http.ResponseWriter, status int, c PartnerCredential) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(c.redacted())
+}
+
+func credentialID(c PartnerCredential) string {
+	return strconv.FormatUint(uint64(c.ID), 10)
+}
+
+// List a partner's credentials, newest first. Filters: kind and status.
+func listCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := credentialManager(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	query := db.WithContext(r.Context()).Where("partner_id = ?", mux.Vars(r)["id"]).Order("id DESC").Limit(1000)
+	if v := q.Get("kind"); v != "" {
+		query = query.Where("kind = ?", v)
+	}
+	if v := q.Get("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+	list := []PartnerCredential{}
+	if err := query.Find(&list).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch credentials", http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		list[i] = list[i].redacted()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Add a credential to a partner
+func createCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	if err := credentialManager(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	var req credentialRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	c, err := newCredential(r.Context(), p, req.Kind, req.Name, req.Value, req.ExpiresAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := db.WithContext(r.Context()).Create(c).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save credential", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "partner_credential", credentialID(*c), nil, c.redacted())
+	writeCredential(w, http.StatusCreated, *c)
+}
+
+// Fetch one credential; a secret's value is masked
+func getCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := requestCredential(w, r)
+	if !ok {
+		return
+	}
+	writeCredential(w, http.StatusOK, c)
+}
+
+// Replace an active credential with a new value of its kind. The old one is
+// retiring: still accepted until the overlap ends, then retired.
+func rotateCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	old, ok := requestCredential(w, r)
+	if !ok {
+		return
+	}
+	if old.Status != credentialActive {
+		writeProblem(w, fmt.Sprintf("Credential %d is %s, only active credentials rotate", old.ID, old.Status), http.StatusConflict)
+		return
+	}
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	var req credentialRotation
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	overlap := credentialRotationOverlap
+	if req.OverlapMinutes != nil {
+		if *req.OverlapMinutes < 0 {
+			writeProblem(w, "overlap_minutes may not be negative", http.StatusBadRequest)
+			return
+		}
+		overlap = time.Duration(*req.OverlapMinutes) * time.Minute
+	}
+	if req.Name == "" {
+		req.Name = old.Name
+	}
+	c, err := newCredential(r.Context(), p, old.Kind, req.Name, req.Value, req.ExpiresAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if c.Fingerprint == old.Fingerprint {
+		writeProblem(w, "The new value is the one being rotated", http.StatusBadRequest)
+		return
+	}
+	before := old.redacted()
+	retiresAt := time.Now().Add(overlap)
+	err = db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(c).Error; err != nil {
+			return err
+		}
+		old.Status, old.RetiresAt, old.ReplacedBy = credentialRetiring, &retiresAt, c.ID
+		if overlap == 0 {
+			old.Status = credentialRetired
+		}
+		res := tx.Model(&old).Where("status = ?", credentialActive).Select("status", "retires_at", "replaced_by").Updates(&old)
+		if res.Error == nil && res.RowsAffected == 0 {
+			return &httpError{Status: http.StatusConflict, Message: fmt.Sprintf("Credential %d was rotated meanwhile", old.ID)}
+		}
+		return res.Error
+	})
+	var he *httpError
+	if errors.As(err, &he) {
+		writeError(w, err)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: rotate credential %d: %v\n", old.ID, err)
+		writeProblem(w, "Failed to save credential", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditRotate, "partner_credential", credentialID(old), before, old.redacted())
+	auditChange(r.Context(), auditCreate, "partner_credential", credentialID(*c), nil, c.redacted())
+	writeCredential(w, http.StatusCreated, *c)
+}
+
+// Retire a credential at once, ending any overlap
+func revokeCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := requestCredential(w, r)
+	if !ok {
+		return
+	}
+	if c.Status == credentialRetired {
+		writeProblem(w, fmt.Sprintf("Credential %d is already retired", c.ID), http.StatusConflict)
+		return
+	}
+	before := c.redacted()
+	now := time.Now()
+	c.Status, c.RetiresAt = credentialRetired, &now
+	if err := db.WithContext(r.Context()).Model(&c).Select("status", "retires_at").Updates(&c).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save credential", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditRevoke, "partner_credential", credentialID(c), before, c.redacted())
+	writeCredential(w, http.StatusOK, c)
+}
+
+// Usable credentials of every partner expiring within the window, soonest
+// first: within, a duration, defaults to CREDENTIAL_EXPIRY_WARNING
+func expiringCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := credentialManager(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	within := credentialExpiryWarning
+	if v := r.URL.Query().Get("within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeProblem(w, "within must be a positive duration such as 720h", http.StatusBadRequest)
+			return
+		}
+		within = d
+	}
+	now := time.Now()
+	var list []PartnerCredential
+	if err := db.WithContext(r.Context()).Where("status IN ? AND expires_at < ?", []string{credentialActive, credentialRetiring}, now.Add(within)).
+		Order("expires_at").Limit(1000).Find(&list).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch credentials", http.StatusInternalServerError)
+		return
+	}
+	expiring := []PartnerCredential{}
+	for _, c := range list {
+		if c.Status == credentialActive || c.usable(now) {
+			expiring = append(expiring, c.redacted())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(expiring)
+}
+
+// Periodically retire credentials past their overlap, alert on expiring
+// ones and refresh the expiry gauge
+func runCredentialExpiryCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := checkCredentials(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: credential check: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Retire credentials of every tenant whose overlap ended, alert once when a
+// credential comes within CREDENTIAL_EXPIRY_WARNING of its expiry and once
+// when it expires, and set the expiry gauge, profile certificates included
+func checkCredentials(ctx context.Context, now time.Time) error {
+	scoped := db.WithContext(withTenant(ctx, allTenants))
+	if err := scoped.Model(&PartnerCredential{}).Where("status = ? AND retires_at <= ?", credentialRetiring, now).
+		Update("status", credentialRetired).Error; err != nil {
+		return err
+	}
+	var list []PartnerCredential
+	if err := scoped.Where("status IN ? AND expires_at IS NOT NULL", []string{credentialActive, credentialRetiring}).Find(&list).Error; err != nil {
+		return err
+	}
+	credentialExpiry.Reset()
+	for _, c := range list {
+		credentialExpiry.WithLabelValues(c.TenantID, c.PartnerID, c.Kind, credentialID(c)).Set(c.ExpiresAt.Sub(now).Seconds())
+		alert := ""
+		switch {
+		case !c.ExpiresAt.After(now):
+			alert = "expired"
+		case c.ExpiresAt.Sub(now) < credentialExpiryWarning && c.Status == credentialActive:
+			alert = "expiring"
+		}
+		if alert == "" || alert == c.ExpiryAlert {
+			continue
+		}
+		res := scoped.Model(&c).Where("expiry_alert = ?", c.ExpiryAlert).Update("expiry_alert", alert)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue // alerted by another replica
+		}
+		c.ExpiryAlert = alert
+		verb := "expires"
+		if alert == "expired" {
+			verb = "expired"
+		}
+		log.Printf("ALERT: %s credential %d of partner %s %s %s", c.Kind, c.ID, c.PartnerID, verb, c.ExpiresAt.Format(time.RFC3339))
+		if credentialAlertURL != "" {
+			go notifyCredentialExpiry(c.redacted())
+		}
+	}
+
+	var partners []Partner
+	if err := scoped.Where("as2_certificate <> ''").Find(&partners).Error; err != nil {
+		return err
+	}
+	for _, p := range partners {
+		cert, err := partnerCertificate(p)
+		if err != nil {
+			log.Printf("ERROR: %v\n", err)
+			continue
+		}
+		credentialExpiry.WithLabelValues(p.TenantID, p.ID, credentialAS2Certificate, "profile").Set(cert.NotAfter.Sub(now).Seconds())
+	}
+	return nil
+}
+
+// POST a credential_expiring or credential_expired alert, retrying a few
+// times like ack alerts
+func notifyCredentialExpiry(c PartnerCredential) {
+	body, _ := json.Marshal(struct {
+		Event string `json:"event"`
+		PartnerCredential
+	}{"credential_" + c.ExpiryAlert, c})
+	client := &http.Client{Timeout: 10 * time.Second}
+	for attempt, delay := 1, time.Second; attempt <= 3; attempt, delay = attempt+1, delay*2 {
+		resp, err := client.Post(credentialAlertURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		log.Printf("Credential alert for %d attempt %d failed: %v", c.ID, attempt, err)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// One outbound interchange pushed to a partner's delivery URL, over plain
+// HTTP or AS2 when the partner has an as2_id
+type Delivery struct {
+	ID                 string     `json:"id" gorm:"primaryKey"`
+	TenantID           string     `json:"tenant_id" gorm:"index"`
+	PartnerID          string     `json:"partner_id" gorm:"index"`
+	TransactionIDs     string     `json:"transaction_ids"`               // JSON array of transaction IDs
+	InterchangeControl string     `json:"interchange_control,omitempty"` // ISA13, or STX reference for TRADACOMS
+	URL                string     `json:"url"`
+	Status             string     `json:"status" gorm:"index"` // delivered, awaiting_mdn or failed
+	HTTPStatus         int        `json:"http_status,omitempty"`
+	Error              string     `json:"error,omitempty"`
+	MessageID          string     `json:"message_id,omitempty" gorm:"index"` // AS2 Message-ID
+	MIC                string     `json:"mic,omitempty"`                     // MIC the MDN must report
+	MDNDisposition     string     `json:"mdn_disposition,omitempty"`
+	MDNSigned          bool       `json:"mdn_signed,omitempty" gorm:"column:mdn_signed"`
+	MDNReceivedAt      *time.Time `json:"mdn_received_at,omitempty"`
+	Attempt            int        `json:"attempt"`                                  // 1 for a first delivery, then counting its retries
+	FirstDeliveryID    string     `json:"first_delivery_id,omitempty" gorm:"index"` // the first attempt, on retries
+	NextAttemptAt      *time.Time `json:"next_attempt_at,omitempty" gorm:"index"`   // when this failed attempt is retried; nil when it is not
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+// A transaction carried by a delivery attempt, finding a transaction's
+// deliveries by index rather than by scanning transaction_ids
+type DeliveryTransaction struct {
+	DeliveryID    string `gorm:"primaryKey"`
+	TransactionID string `gorm:"primaryKey;index"`
+	TenantID      string `gorm:"index"`
+}
+
+// Save a delivery attempt and index its transactions
+func saveDelivery(ctx context.Context, d Delivery, ids []string) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&d).Error; err != nil || len(ids) == 0 {
+			return err
+		}
+		links := make([]DeliveryTransaction, len(ids))
+		for i, id := range ids {
+			links[i] = DeliveryTransaction{DeliveryID: d.ID, TransactionID: id}
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error
+	})
+}
+
+var deliveryClient = &http.Client{Timeout: getEnvDuration("DELIVERY_TIMEOUT", 30*time.Second), Transport: deliveryTransport()}
+
+// Build the partner's outbound interchange for txs and POST it to the
+// partner's delivery URL, recording the attempt and settling its control
+// number. The returned error is set when the delivery failed; AS2 deliveries
+// awaiting an asynchronous MDN are not failures. Transient failures are
+// retried later under the partner's retry policy.
+func deliverOutbound(ctx context.Context, p Partner, txs []Transaction) (Delivery, error) {
+	return attemptDelivery(ctx, p, txs, nil)
+}
+
+// Make one delivery attempt, the retry of prev when it is set
+func attemptDelivery(ctx context.Context, p Partner, txs []Transaction, prev *Delivery) (Delivery, error) {
+	ids := make([]string, len(txs))
+	for i, t := range txs {
+		ids[i] = t.ID
+	}
+	idList, _ := json.Marshal(ids)
+	d := Delivery{ID: uuid.New().String(), PartnerID: p.ID, TransactionIDs: string(idList), URL: p.DeliveryURL, Status: deliveryFailed, Attempt: 1}
+	if prev != nil {
+		d.Attempt, d.FirstDeliveryID = prev.Attempt+1, prev.FirstDeliveryID
+		if d.FirstDeliveryID == "" {
+			d.FirstDeliveryID = prev.ID
+		}
+	}
+	var doc outboundDocument
+	breaker := deliveryBreakers.get(ctx, p.ID)
+	err := func() error {
+		if p.DeliveryURL == "" {
+			return fmt.Errorf("partner %s has no delivery_url", p.ID)
+		}
+		if err := runHooks(ctx, hookPreDeliver, p.ID, txs); err != nil {
+			return err
+		}
+		if !breaker.allow() {
+			return &deliveryPausedError{partnerID: p.ID, until: breaker.reopensAt()}
+		}
+		if err := takeDeliveryQuota(ctx, p.ID); err != nil {
+			return err
+		}
+		var err error
+		if doc, err = buildOutbound(ctx, p, txs); err != nil {
+			return err
+		}
+		d.InterchangeControl = doc.Control
+		if err := archivePayload(ctx, "outbound", doc.ContentType, doc.Data, ids...); err != nil {
+			return fmt.Errorf("archive: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", p.DeliveryURL, bytes.NewReader(doc.Data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", doc.ContentType)
+		if p.AS2ID != "" {
+			d.MessageID, d.MIC = prepareAS2(req, p, doc.ContentType, doc.Data)
+		}
+		resp, err := throttleDelivery(ctx, req, p, doc.Data).Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		d.HTTPStatus = resp.StatusCode
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("partner endpoint returned %s", resp.Status)
+		}
+
+		switch {
+		case p.AS2ID == "" || p.MDNMode == mdnNone:
+			d.Status = deliveryDelivered
+		case p.MDNMode == mdnAsync:
+			d.Status = deliveryAwaitingMDN
+		default:
+			certs, err := partnerCertificates(ctx, p)
+			if err != nil {
+				return err
+			}
+			mdn, err := parseMDN(resp.Header.Get("Content-Type"), body, certs)
+			if err != nil {
+				return fmt.Errorf("MDN: %w", err)
+			}
+			applyMDN(&d, mdn)
+			if d.Status == deliveryFailed {
+				return errors.New(d.Error)
+			}
+		}
+		return nil
+	}()
+	breaker.record(p.ID, err, d.HTTPStatus)
+	if err != nil {
+		d.Status, d.Error = deliveryFailed, err.Error()
+		d.NextAttemptAt = scheduleRetry(ctx, p, d, err, time.Now())
+		settleControlNumber(ctx, doc.PartnerID, doc.Number, controlVoided, d.ID, d.Error)
+	} else {
+		settleControlNumber(ctx, doc.PartnerID, doc.Number, controlUsed, d.ID, "")
+		expectAck(ctx, p, doc, d.ID)
+		collectOutbox(ctx, p.ID, ids, "delivery", d.ID)
+	}
+	if dbErr := saveDelivery(ctx, d, ids); dbErr != nil {
+		log.Printf("ERROR: delivery %s: %v\n", d.ID, dbErr)
+	}
+	event := map[string]interface{}{"delivery_id": d.ID, "attempt": d.Attempt, "url": d.URL}
+	switch {
+	case d.Status == deliveryDelivered:
+		recordDeliveryEvents(ctx, ids, txEventDelivered, event)
+	case d.Status == deliveryAwaitingMDN:
+		recordDeliveryEvents(ctx, ids, txEventAwaitingMDN, event)
+	default:
+		event["error"], event["http_status"], event["next_attempt_at"] = d.Error, d.HTTPStatus, d.NextAttemptAt
+		recordDeliveryEvents(ctx, ids, txEventDeliveryFailed, event)
+	}
+	publishDelivery(ctx, p, d, txs)
+	return d, err
+}
+
+// Announce the outcome of a delivery for each of its transactions and count
+// it against the partner's delivery SLA; one waiting for an asynchronous MDN
+// is settled when the MDN arrives, and a failure once it is no longer retried
+func publishDelivery(ctx context.Context, p Partner, d Delivery, txs []Transaction) {
+	eventType := eventTransactionDelivered
+	switch d.Status {
+	case deliveryDelivered:
+	case deliveryFailed:
+		if d.NextAttemptAt != nil {
+			return
+		}
+		eventType = eventDeliveryFailed
+	default:
+		return
+	}
+	countDeliverySLA(p, d, txs, time.Now())
+	for _, t := range txs {
+		if err := publishEvent(ctx, eventType, t, d.Error); err != nil {
+			log.Printf("ERROR: delivery %s event: %v\n", d.ID, err)
+		}
+	}
+}
+
+// Report the state of an outbound delivery, including any MDN received
+func getDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	var d Delivery
+	err := db.WithContext(r.Context()).First(&d, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Delivery not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch delivery", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default retry policy of outbound deliveries, and the circuit breaker that
+// pauses deliveries to a partner failing them one after another
+var (
+	deliveryMaxAttempts      = atLeastOne(getEnvInt("DELIVERY_MAX_ATTEMPTS", 5))
+	deliveryBackoff          = getEnvDuration("DELIVERY_BACKOFF", 30*time.Second)
+	deliveryMaxBackoff       = getEnvDuration("DELIVERY_MAX_BACKOFF", time.Hour)
+	deliveryJitter           = getEnvFloat("DELIVERY_JITTER", 0.2)
+	deliveryBreakerThreshold = atLeastOne(getEnvInt("DELIVERY_BREAKER_THRESHOLD", 5))
+	deliveryBreakerCooldown  = getEnvDuration("DELIVERY_BREAKER_COOLDOWN", 5*time.Minute)
+)
+
+var deliveryCircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "edi_delivery_circuit_open",
+	Help: "1 while deliveries to a partner are paused by its circuit breaker.",
+}, []string{"tenant", "partner"})
+
+// A delivery not attempted because the partner's circuit breaker is open
+type deliveryPausedError struct {
+	partnerID string
+	until     time.Time
+	reason    string // "" for an open breaker
+}
+
+func (e *deliveryPausedError) Error() string {
+	reason := e.reason
+	if reason == "" {
+		reason = "after repeated failures"
+	} else {
+		reason = "as " + reason
+	}
+	return fmt.Sprintf("deliveries to partner %s are paused until %s %s", e.partnerID, e.until.UTC().Format(time.RFC3339), reason)
+}
+
+type noDeliveryRetryKey struct{}
+
+// Context whose failed deliveries are not retried, e.g. batches that go back
+// to the outbox for the next window instead
+func withoutDeliveryRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noDeliveryRetryKey{}, true)
+}
+
+// Whether a failed delivery may succeed when tried again: the partner's
+// endpoint could not be reached, timed out, was overloaded or failed, or
+// its breaker was open
+func retryableDelivery(err error, httpStatus int) bool {
+	var paused *deliveryPausedError
+	if errors.As(err, &paused) {
+		return true
+	}
+	switch {
+	case httpStatus >= 500, httpStatus == http.StatusTooManyRequests, httpStatus == http.StatusRequestTimeout:
+		return true
+	case httpStatus != 0:
+		return false
+	}
+	var netErr net.Error
+	return isTimeout(err) || errors.As(err, &netErr)
+}
+
+// Settings of a partner's retry policy, with the defaults filled in
+func (p Partner) retryPolicy() (attempts int, backoff time.Duration, jitter float64) {
+	attempts, backoff, jitter = deliveryMaxAttempts, deliveryBackoff, deliveryJitter
+	if p.DeliveryMaxAttempts > 0 {
+		attempts = p.DeliveryMaxAttempts
+	}
+	if p.DeliveryBackoffSeconds > 0 {
+		backoff = time.Duration(p.DeliveryBackoffSeconds) * time.Second
+	}
+	if p.DeliveryJitter > 0 {
+		jitter = p.DeliveryJitter
+	}
+	return attempts, backoff, jitter
+}
+
+func (p *Partner) validateDelivery() error {
+	if p.DeliveryMaxAttempts < 0 || p.DeliveryMaxAttempts > 100 {
+		return errors.New("delivery_max_attempts must be 0 to 100")
+	}
+	if p.DeliveryBackoffSeconds < 0 {
+		return errors.New("delivery_backoff_seconds must not be negative")
+	}
+	if p.DeliveryJitter < 0 || p.DeliveryJitter > 1 {
+		return errors.New("delivery_jitter must be between 0 and 1")
+	}
+	if p.DeliveryBandwidth < 0 {
+		return errors.New("delivery_bandwidth must not be negative")
+	}
+	return nil
+}
+
+// When the failed attempt d is next tried, or nil when it is not: the
+// failure is permanent, the partner's attempts are used up or the caller
+// retries by other means. The delay doubles with every attempt up to
+// DELIVERY_MAX_BACKOFF, spread by the jitter, and waits out an open breaker.
+func scheduleRetry(ctx context.Context, p Partner, d Delivery, err error, now time.Time) *time.Time {
+	if off, _ := ctx.Value(noDeliveryRetryKey{}).(bool); off || !retryableDelivery(err, d.HTTPStatus) {
+		return nil
+	}
+	attempts, backoff, jitter := p.retryPolicy()
+	if d.Attempt >= attempts {
+		return nil
+	}
+	delay := backoff
+	for i := 1; i < d.Attempt && delay < deliveryMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > deliveryMaxBackoff {
+		delay = deliveryMaxBackoff
+	}
+	delay += time.Duration((rand.Float64()*2 - 1) * jitter * float64(delay))
+	next := now.Add(delay)
+	var paused *deliveryPausedError
+	if errors.As(err, &paused) && next.Before(paused.until) {
+		next = paused.until
+	}
+	return &next
+}
+
+// Circuit breaker of one partner's deliveries: after
+// DELIVERY_BREAKER_THRESHOLD consecutive transient failures it opens for
+// DELIVERY_BREAKER_COOLDOWN, then lets one attempt through to probe
+type deliveryBreaker struct {
+	mu        sync.Mutex
+	tenant    string
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Breakers of every partner delivered to, by tenant and partner
+type deliveryBreakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*deliveryBreaker
+}
+
+var deliveryBreakers = &deliveryBreakerSet{breakers: map[string]*deliveryBreaker{}}
+
+func (s *deliveryBreakerSet) get(ctx context.Context, partnerID string) *deliveryBreaker {
+	key := tenantID(ctx) + "/" + partnerID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[key]
+	if !ok {
+		b = &deliveryBreaker{tenant: tenantID(ctx)}
+		s.breakers[key] = b
+	}
+	return b
+}
+
+// Whether a delivery may be attempted now
+func (b *deliveryBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < deliveryBreakerThreshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Whether deliveries are paused, without claiming the probe
+func (b *deliveryBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= deliveryBreakerThreshold && (b.probing || time.Now().Before(b.openUntil))
+}
+
+func (b *deliveryBreaker) reopensAt() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openUntil
+}
+
+// Record the outcome of an attempt. Failures the partner's endpoint did not
+// cause by being down, such as a rejected document, leave the count alone.
+func (b *deliveryBreaker) record(partnerID string, err error, httpStatus int) {
+	var paused *deliveryPausedError
+	if errors.As(err, &paused) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil && !retryableDelivery(err, httpStatus) {
+		return
+	}
+	if err == nil {
+		if b.failures >= deliveryBreakerThreshold {
+			deliveryCircuitOpen.WithLabelValues(b.tenant, partnerID).Set(0)
+			log.Printf("Deliveries to partner %s resumed", partnerID)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= deliveryBreakerThreshold {
+		b.openUntil = time.Now().Add(deliveryBreakerCooldown)
+		deliveryCircuitOpen.WithLabelValues(b.tenant, partnerID).Set(1)
+		log.Printf("ALERT: deliveries to partner %s paused for %s after %d consecutive failures", partnerID, deliveryBreakerCooldown, b.failures)
+	}
+}
+
+// Periodically retry the failed deliveries that are due
+func runDeliveryRetries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := retryDueDeliveries(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: delivery retries: %v\n", err)
+		}
+	}
+}
+
+// Retry every failed delivery whose next attempt is due, oldest first,
+// skipping partners whose breaker is open
+func retryDueDeliveries(ctx context.Context, now time.Time) error {
+	var due []Delivery
+	if err := db.WithContext(withTenant(ctx, allTenants)).Where("next_attempt_at <= ?", now).Order("next_attempt_at").Limit(100).Find(&due).Error; err != nil {
+		return err
+	}
+	for i := range due {
+		d := &due[i]
+		dctx := withAuditor(withTenant(ctx, d.TenantID), systemAuditor("system", "delivery-retry"))
+		if deliveryBreakers.get(dctx, d.PartnerID).open() || !claimRetry(dctx, d) {
+			continue
+		}
+		retryDelivery(dctx, d)
+	}
+	return nil
+}
+
+// Clear next_attempt_at from the value read, failing when another instance
+// already did
+func claimRetry(ctx context.Context, d *Delivery) bool {
+	res := db.WithContext(ctx).Model(&Delivery{}).Where("id = ? AND next_attempt_at = ?", d.ID, *d.NextAttemptAt).UpdateColumn("next_attempt_at", nil)
+	if res.Error != nil {
+		log.Printf("ERROR: delivery %s: %v\n", d.ID, res.Error)
+		return false
+	}
+	return res.RowsAffected == 1
+}
+
+// Deliver the transactions of a failed attempt again, moving consumed
+// outbound requests that pointed at it on to the new attempt
+func retryDelivery(ctx context.Context, prev *Delivery) {
+	p, err := loadPartner(ctx, prev.PartnerID)
+	if err != nil {
+		log.Printf("ERROR: retry of delivery %s: partner %s: %v\n", prev.ID, prev.PartnerID, err)
+		return
+	}
+	var ids []string
+	if err := json.Unmarshal([]byte(prev.TransactionIDs), &ids); err != nil {
+		log.Printf("ERROR: retry of delivery %s: %v\n", prev.ID, err)
+		return
+	}
+	var txs []Transaction
+	if err := db.WithContext(ctx).Where("id IN ?", ids).Order("date").Find(&txs).Error; err != nil {
+		log.Printf("ERROR: retry of delivery %s: %v\n", prev.ID, err)
+		return
+	}
+	if len(txs) == 0 {
+		return // transactions deleted meanwhile
+	}
+	if err := readItems(ctx, txs); err != nil {
+		log.Printf("ERROR: retry of delivery %s: %v\n", prev.ID, err)
+		return
+	}
+	d, err := attemptDelivery(ctx, p, txs, prev)
+	log.Printf("Delivery %s to partner %s, attempt %d: %s", d.FirstDeliveryID, p.ID, d.Attempt, d.Status)
+	update := map[string]interface{}{"delivery_id": d.ID, "delivery_status": d.Status, "error": ""}
+	if err != nil {
+		update["error"] = err.Error()
+	}
+	if err := db.WithContext(ctx).Model(&ConsumedEvent{}).Where("delivery_id = ?", prev.ID).Updates(update).Error; err != nil {
+		log.Printf("ERROR: delivery %s: %v\n", d.ID, err)
+	}
+}
+
+// List every delivery attempt that carried a transaction, oldest first
+func listTransactionDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	deliveries := []Delivery{}
+	scoped := db.WithContext(r.Context())
+	carried := scoped.Model(&DeliveryTransaction{}).Select("delivery_id").Where("transaction_id = ?", id)
+	if err := scoped.Where("id IN (?)", carried).Order("created_at").Find(&deliveries).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch deliveries", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// A transaction's deliveries are found through delivery_transactions
+func TestTransactionDeliveries(t *testing.T) {
+	url := startSignatureGateway(t)
+	ctx := withTenant(context.Background(), defaultTenant)
+	for _, d := range []struct {
+		id  string
+		ids []string
+	}{
+		{"d-1", []string{"tx-1", "tx-10"}},
+		{"d-2", []string{"tx-10"}},
+		{"d-3", []string{"tx-1"}},
+	} {
+		if err := saveDelivery(ctx, Delivery{ID: d.id, PartnerID: "acme", Status: deliveryDelivered}, d.ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []Delivery
+	if status := doJSON(t, "GET", url+"/transactions/tx-1/deliveries", nil, &got); status != http.StatusOK {
+		t.Fatalf("list deliveries: %d", status)
+	}
+	if len(got) != 2 || got[0].ID != "d-1" || got[1].ID != "d-3" {
+		t.Errorf("deliveries of tx-1: %+v", got)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Edge (store-and-forward) mode settings
+var (
+	edgeMode       = getEnvBool("EDGE_MODE", false)
+	edgeNodeID     = getEnv("EDGE_NODE_ID", hostname())
+	edgeCentralURL = getEnv("EDGE_CENTRAL_URL", "http://edi-gateway:8086")
+	edgeDataDir    = getEnv("EDGE_DATA_DIR", "/var/lib/edigateway/edge")
+	edgeSyncEvery  = getEnvDuration("EDGE_SYNC_INTERVAL", 30*time.Second)
+	edgeSyncSecret = getEnv("EDGE_SYNC_SECRET", "") // this node's key, one of the central gateway's EDGE_NODE_KEYS
+)
+
+// Keys of the edge nodes allowed to sync, comma separated node=key pairs
+var edgeNodeKeys = getEnv("EDGE_NODE_KEYS", "")
+
+// Status of transactions accepted at the edge and not yet synced
+const statusSpooled = "Spooled"
+
+// Payload an edge node forwards to the central gateway
+type edgeEnvelope struct {
+	Node        string      `json:"node"`
+	Transaction Transaction `json:"transaction"`
+	ContentType string      `json:"content_type"`
+	Raw         []byte      `json:"raw"`
+}
+
+// Open the local SQLite database and spool directory used in edge mode
+func openEdgeDB() (*gorm.DB, error) {
+	if err := os.MkdirAll(edgeDataDir, 0o750); err != nil {
+		return nil, err
+	}
+	dsn := filepath.Join(edgeDataDir, "edge.db") + "?_journal_mode=WAL&_busy_timeout=5000"
+	return gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+}
+
+// Forward spooled transactions to the central gateway until ctx is cancelled
+func runEdgeSync(ctx context.Context) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	ticker := time.NewTicker(edgeSyncEvery)
+	defer ticker.Stop()
+	for {
+		if n, err := syncSpooled(ctx, client); err != nil {
+			log.Printf("Edge sync paused after %d transactions: %v", n, err)
+		} else if n > 0 {
+			log.Printf("Edge sync forwarded %d transactions", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Forward spooled transactions of every tenant oldest first, stopping at the
+// first failure
+func syncSpooled(ctx context.Context, client *http.Client) (int, error) {
+	scoped := db.WithContext(withTenant(ctx, allTenants))
+	var pending []Transaction
+	if err := scoped.Where("status = ?", statusSpooled).Order("date").Limit(500).Find(&pending).Error; err != nil {
+		return 0, err
+	}
+	for i, t := range pending {
+		if err := forwardToCentral(ctx, client, t); err != nil {
+			return i, err
+		}
+		if err := recordTransactionEvent(withTenant(ctx, t.TenantID), t.ID, txEventForwarded, "Forwarded", nil); err != nil {
+			return i, err
+		}
+	}
+	return len(pending), nil
+}
+
+// Send one spooled transaction with its raw payload
+func forwardToCentral(ctx context.Context, client *http.Client, t Transaction) error {
+	env := edgeEnvelope{Node: edgeNodeID, Transaction: t}
+	var meta RawPayload
+	err := db.WithContext(withTenant(ctx, t.TenantID)).Where("transaction_id = ? AND direction = ?", t.ID, "inbound").First(&meta).Error
+	if err == nil && archive != nil {
+		env.ContentType = meta.ContentType
+		if env.Raw, err = archive.Get(ctx, meta.StorageKey); err != nil {
+			return fmt.Errorf("read spool %s: %w", meta.StorageKey, err)
+		}
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, edgeCentralURL+"/edge/sync", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant-ID", t.TenantID)
+	signEdgeSync(req, body, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("central gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign an edge sync with the node's key the way partners sign submissions
+// (see signedContent), with the node ID in place of the nonce
+func signEdgeSync(req *http.Request, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(edgeSyncSecret))
+	mac.Write(signedContent(req, timestamp, edgeNodeID, body))
+	req.Header.Set("X-Edge-Node", edgeNodeID)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+}
+
+// Key of an edge node in EDGE_NODE_KEYS
+func edgeNodeKey(node string) (string, bool) {
+	for _, entry := range splitList(edgeNodeKeys) {
+		if id, key, ok := strings.Cut(entry, "="); ok && strings.TrimSpace(id) == node && key != "" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Check that an edge sync is signed with the key of the node in X-Edge-Node
+// and recent. There is no nonce: transaction IDs are kept, so a replayed
+// sync is only acknowledged again.
+func authenticateEdgeNode(r *http.Request, body []byte, now time.Time) (string, error) {
+	node, timestamp := r.Header.Get("X-Edge-Node"), r.Header.Get("X-Signature-Timestamp")
+	key, ok := edgeNodeKey(node)
+	if node == "" || !ok {
+		return "", &httpError{Status: http.StatusUnauthorized, Code: codeSignatureInvalid, Message: "X-Edge-Node is not a node in EDGE_NODE_KEYS"}
+	}
+	got, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(signedContent(r, timestamp, node, body))
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return "", &httpError{Status: http.StatusUnauthorized, Code: codeSignatureInvalid, Message: "X-Signature does not match the edge sync"}
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if skew := now.Sub(time.Unix(secs, 0)); err != nil || skew > signatureClockSkew || skew < -signatureClockSkew {
+		return "", &httpError{Status: http.StatusUnauthorized, Code: codeSignatureInvalid, Message: "X-Signature-Timestamp is missing or more than " + signatureClockSkew.String() + " from the gateway clock"}
+	}
+	return node, nil
+}
+
+// Fields of a forwarded transaction an edge node may set: what it parsed
+// from the document and the signature check it recorded. The rest is the
+// central gateway's to derive, as for any inbound transaction.
+func edgeTransaction(node string, in Transaction) Transaction {
+	return Transaction{
+		ID: in.ID, Date: in.Date, PartnerID: in.PartnerID, Type: in.Type,
+		ControlNumber: in.ControlNumber, InterchangeControl: in.InterchangeControl,
+		ShipTo: in.ShipTo, Carrier: in.Carrier, BOL: in.BOL, ItemList: in.ItemList, Format: in.Format,
+		SignatureStatus: in.SignatureStatus, Signature: in.Signature, SignatureNonce: in.SignatureNonce,
+		SignedAt: in.SignedAt, BodySHA256: in.BodySHA256,
+		Origin: node, Status: "Processed",
+	}
+}
+
+// Checks an edge node skips (see edgeMode), run once its transaction
+// reaches the central gateway. The sender was checked at the edge, against
+// the channel the document arrived on.
+func checkEdgeTransaction(ctx context.Context, t *Transaction, size int) error {
+	if err := checkPartnerActive(ctx, t); err != nil {
+		return err
+	}
+	if err := checkSignatureRecorded(ctx, *t); err != nil {
+		return err
+	}
+	if err := checkTenantQuotas(ctx); err != nil {
+		return err
+	}
+	if err := applyDocumentRules(ctx, t); err != nil {
+		return err
+	}
+	if err := applyGuardrails(ctx, t, size); err != nil {
+		return err
+	}
+	return prePersistHooks(ctx, t)
+}
+
+// Accept a transaction forwarded by an edge node. IDs are assigned at the
+// edge and kept, so a retried sync is recognised and acknowledged again. The
+// transaction joins the tenant of the request.
+func edgeSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > inboundMaxBuffered {
+		writeError(w, tooLargeError(inboundMaxBuffered))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, inboundMaxBuffered))
+	if err != nil {
+		writeError(w, tooLargeError(inboundMaxBuffered))
+		return
+	}
+	node, err := authenticateEdgeNode(r, body, time.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var env edgeEnvelope
+	// Lenient on fields: an edge node may run a newer release than the gateway
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err := decodeJSONBody(w, r, &env, inboundMaxBuffered, false); err != nil {
+		writeError(w, err)
+		return
+	}
+	if env.Transaction.ID == "" || env.Node != node {
+		writeProblem(w, "transaction id is required and node must be X-Edge-Node", http.StatusBadRequest)
+		return
+	}
+	t := edgeTransaction(node, env.Transaction)
+	if err := checkEdgeTransaction(r.Context(), &t, len(env.Raw)); err != nil {
+		writeError(w, err)
+		return
+	}
+	t.SearchText = searchText(t)
+	t.ConfigVersion = processingConfigVersion(r.Context())
+
+	// The payload is stored first and removed again unless the transaction,
+	// its received event, the payload's link and its event all make it
+	var key string
+	if len(env.Raw) > 0 && archive != nil {
+		if key, err = putPayload(r.Context(), "inbound", env.Raw); err != nil {
+			log.Printf("ERROR: archive: %v\n", err)
+			writeProblem(w, "Failed to archive payload", http.StatusInternalServerError)
+			return
+		}
+	}
+	var res *gorm.DB
+	err = db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		if res = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&t); res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		if err := appendReceivedEvent(r.Context(), tx, t, map[string]interface{}{"partner_id": t.PartnerID, "type": t.Type, "origin": t.Origin}); err != nil {
+			return err
+		}
+		if key != "" {
+			if err := linkPayload(tx, key, "inbound", env.ContentType, env.Raw, t.ID); err != nil {
+				return err
+			}
+		}
+		if err := saveStagedEvent(r.Context(), tx, &t); err != nil || t.event != nil || t.Status == statusHeld {
+			return err
+		}
+		// Without the outbox, published before the commit: the edge retries
+		// a failed sync whole, and a sync whose commit fails after this is
+		// published again
+		if err := publishTransaction(r.Context(), eventTransactionCreated, t); err != nil {
+			return fmt.Errorf("%w: %w", errPublishFailed, err)
+		}
+		return nil
+	})
+	if key != "" && (err != nil || res.RowsAffected == 0) {
+		if err := archive.Delete(r.Context(), key); err != nil {
+			log.Printf("ERROR: archive: %v\n", err)
+		}
+	}
+	if errors.Is(err, errPublishFailed) {
+		log.Printf("Kafka publish error: %v\n", err)
+		writeProblem(w, "Failed to publish to Kafka", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save transaction", http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		fmt.Fprintf(w, "Transaction %s already synced\n", t.ID)
+		return
+	}
+	if key != "" {
+		addStorageUsage(tenantID(r.Context()), int64(len(env.Raw)))
+	}
+	if t.event != nil {
+		writeOutboxEvent(r.Context(), t.event)
+	}
+	auditChange(r.Context(), auditCreate, "transaction", t.ID, nil, nil)
+	fmt.Fprintf(w, "Transaction %s synced from %s\n", t.ID, node)
+}
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "edge"
+	}
+	return h
+}
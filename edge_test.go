@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// A gateway node edge-1 may sync to with the key edge-secret
+func startEdgeCentral(t *testing.T) string {
+	url := startSignatureGateway(t)
+	setForTest(t, &edgeNodeKeys, "edge-1=edge-secret")
+	setForTest(t, &edgeNodeID, "edge-1")
+	return url
+}
+
+// POST env to /edge/sync as edge-1, signed with key when set
+func postEdgeSync(t *testing.T, url, key string, env interface{}) int {
+	t.Helper()
+	body, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url+"/edge/sync", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		setForTest(t, &edgeSyncSecret, key)
+		signEdgeSync(req, body, time.Now())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+func edgeEnv(id string) map[string]interface{} {
+	return map[string]interface{}{"node": "edge-1", "transaction": map[string]interface{}{"id": id, "partner_id": "globex", "type": "856"}}
+}
+
+func TestEdgeSyncAuthenticatesNode(t *testing.T) {
+	url := startEdgeCentral(t)
+	tests := []struct {
+		name, key string
+		env       map[string]interface{}
+		want      int
+	}{
+		{"unsigned", "", edgeEnv("edge-tx-1"), http.StatusUnauthorized},
+		{"signed with another key", "other-secret", edgeEnv("edge-tx-2"), http.StatusUnauthorized},
+		{"envelope naming another node", "edge-secret", map[string]interface{}{"node": "edge-2", "transaction": map[string]string{"id": "edge-tx-3"}}, http.StatusBadRequest},
+		{"signed by the node", "edge-secret", edgeEnv("edge-tx-4"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := postEdgeSync(t, url, tt.key, tt.env); status != tt.want {
+				t.Errorf("edge sync: %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+// An edge node sets what it parsed, never what the gateway derives
+func TestEdgeSyncIgnoresServerFields(t *testing.T) {
+	url := startEdgeCentral(t)
+	env := edgeEnv("edge-tx-1")
+	tx := env["transaction"].(map[string]interface{})
+	for k, v := range map[string]interface{}{"status": statusAcknowledged, "origin": "edge-9", "rule_id": 7, "topic": "edi.elsewhere", "priority": "high", "hold_reason": "none", "submission_id": "sub-1", "tenant_id": "other"} {
+		tx[k] = v
+	}
+	if status := postEdgeSync(t, url, "edge-secret", env); status != http.StatusOK {
+		t.Fatalf("edge sync: %d", status)
+	}
+	var saved Transaction
+	if err := db.WithContext(withTenant(context.Background(), defaultTenant)).First(&saved, "id = ?", "edge-tx-1").Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != "Processed" || saved.Origin != "edge-1" || saved.RuleID != 0 || saved.Topic != "" || saved.Priority != "" || saved.HoldReason != "" || saved.SubmissionID != "" || saved.TenantID != defaultTenant {
+		t.Errorf("saved %+v", saved)
+	}
+}
+
+type failingPublisher struct{}
+
+func (failingPublisher) publish(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	return errors.New("broker down")
+}
+
+// A sync that fails to publish leaves nothing behind, so its retry starts over
+func TestEdgeSyncPublishFailureRollsBack(t *testing.T) {
+	url := startEdgeCentral(t)
+	dir := t.TempDir()
+	setForTest(t, &archive, blobStore(fsStore{root: dir}))
+	working := publisher
+	setForTest(t, &publisher, eventPublisher(failingPublisher{}))
+	env := edgeEnv("edge-tx-1")
+	env["content_type"], env["raw"] = "application/edi-x12", []byte(x12ASN("GLOBEX", "000000001", "BOL-1"))
+
+	if status := postEdgeSync(t, url, "edge-secret", env); status != http.StatusInternalServerError {
+		t.Fatalf("edge sync with the broker down: %d", status)
+	}
+	tdb := db.WithContext(withTenant(context.Background(), defaultTenant))
+	count := func(model interface{}) int64 {
+		var n int64
+		if err := tdb.Model(model).Where("transaction_id = ?", "edge-tx-1").Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	var txs int64
+	tdb.Model(&Transaction{}).Where("id = ?", "edge-tx-1").Count(&txs)
+	if txs != 0 || count(&TransactionEvent{}) != 0 || count(&RawPayload{}) != 0 {
+		t.Errorf("failed sync left %d transactions, %d events, %d payloads", txs, count(&TransactionEvent{}), count(&RawPayload{}))
+	}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("failed sync left payload %s", path)
+		}
+		return nil
+	})
+
+	publisher = working
+	if status := postEdgeSync(t, url, "edge-secret", env); status != http.StatusOK {
+		t.Fatalf("edge sync retried: %d", status)
+	}
+	if n, m := count(&TransactionEvent{}), count(&RawPayload{}); n != 1 || m != 1 {
+		t.Errorf("retried sync left %d events, %d payloads", n, m)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UN/EDIFACT service characters, from the UNA string advice when present
+type edifactDelimiters struct {
+	Component, Element, Decimal, Release, Segment byte
+}
+
+var defaultEdifactDelimiters = edifactDelimiters{':', '+', '.', '?', '\''}
+
+// EDIFACT segment: tag followed by data elements, each a list of components
+type edifactSegment [][]string
+
+// Component j of element i, or "" when absent
+func (s edifactSegment) el(i, j int) string {
+	if i < len(s) && j < len(s[i]) {
+		return s[i][j]
+	}
+	return ""
+}
+
+func (s edifactSegment) tag() string {
+	return s.el(0, 0)
+}
+
+// One UNB..UNZ interchange
+type EdifactInterchange struct {
+	UNB      edifactSegment
+	Messages []EdifactMessage
+	UNZ      edifactSegment
+}
+
+// One UNH..UNT message; Err is set when the message envelope is invalid
+type EdifactMessage struct {
+	Segments []edifactSegment
+	Err      error
+}
+
+func (m EdifactMessage) Type() string          { return m.Segments[0].el(2, 0) }
+func (m EdifactMessage) ControlNumber() string { return m.Segments[0].el(1, 0) }
+
+func (ic EdifactInterchange) SenderID() string      { return ic.UNB.el(2, 0) }
+func (ic EdifactInterchange) ControlNumber() string { return ic.UNB.el(5, 0) }
+
+// Split EDIFACT data into segments, honouring the release character
+func splitEdifact(data []byte) ([]edifactSegment, error) {
+	data = bytes.TrimLeft(data, " \t\r\n\ufeff")
+	d := defaultEdifactDelimiters
+	if bytes.HasPrefix(data, []byte("UNA")) {
+		if len(data) < 9 {
+			return nil, fmt.Errorf("UNA service string advice too short")
+		}
+		d = edifactDelimiters{data[3], data[4], data[5], data[6], data[8]}
+		data = data[9:]
+	}
+
+	var segments []edifactSegment
+	var seg edifactSegment
+	var el []string
+	var cur []byte
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == d.Release && d.Release != ' ':
+			if i+1 < len(data) {
+				i++
+				cur = append(cur, data[i])
+			}
+		case c == d.Component:
+			el = append(el, string(cur))
+			cur = cur[:0]
+		case c == d.Element:
+			seg = append(seg, append(el, string(cur)))
+			el, cur = nil, cur[:0]
+		case c == d.Segment:
+			seg = append(seg, append(el, string(cur)))
+			segments = append(segments, seg)
+			seg, el, cur = nil, nil, cur[:0]
+		case c == '\r' || c == '\n':
+			// Line breaks between segments are not data
+			if len(seg) > 0 || len(el) > 0 || len(cur) > 0 {
+				cur = append(cur, c)
+			}
+		default:
+			cur = append(cur, c)
+		}
+	}
+	if len(bytes.TrimSpace(cur)) > 0 || len(seg) > 0 {
+		// The last segment, its terminator left off
+		segments = append(segments, append(seg, append(el, string(bytes.TrimRight(cur, " \r\n")))))
+	}
+	return segments, nil
+}
+
+// Parse one or more UNB..UNZ interchanges. Envelope errors fail the whole
+// payload; UNH/UNT mismatches only fail the affected message.
+func parseEdifact(data []byte) ([]EdifactInterchange, error) {
+	segments, err := splitEdifact(data)
+	if err != nil {
+		return nil, err
+	}
+	var out []EdifactInterchange
+	var ic *EdifactInterchange
+	var msg *EdifactMessage
+	for _, seg := range segments {
+		switch seg.tag() {
+		case "UNB":
+			if ic != nil {
+				return nil, fmt.Errorf("UNB %s: missing UNZ", ic.ControlNumber())
+			}
+			ic = &EdifactInterchange{UNB: seg}
+		case "UNZ":
+			if ic == nil {
+				return nil, fmt.Errorf("UNZ without UNB")
+			}
+			if msg != nil {
+				return nil, fmt.Errorf("UNH %s: missing UNT", msg.ControlNumber())
+			}
+			if seg.el(2, 0) != ic.ControlNumber() {
+				return nil, fmt.Errorf("UNZ control reference %s does not match UNB %s", seg.el(2, 0), ic.ControlNumber())
+			}
+			if n, err := strconv.Atoi(seg.el(1, 0)); err != nil || n != len(ic.Messages) {
+				return nil, fmt.Errorf("UNB %s: UNZ count %s, found %d messages", ic.ControlNumber(), seg.el(1, 0), len(ic.Messages))
+			}
+			ic.UNZ = seg
+			out = append(out, *ic)
+			ic = nil
+		case "UNG", "UNE":
+			// Functional groups are optional and carry nothing the gateway uses
+		case "UNH":
+			if ic == nil {
+				return nil, fmt.Errorf("UNH outside an interchange")
+			}
+			msg = &EdifactMessage{Segments: []edifactSegment{seg}}
+		case "UNT":
+			if msg == nil {
+				return nil, fmt.Errorf("UNT without UNH")
+			}
+			msg.Segments = append(msg.Segments, seg)
+			if seg.el(2, 0) != msg.ControlNumber() {
+				msg.Err = fmt.Errorf("UNT reference %s does not match UNH %s", seg.el(2, 0), msg.ControlNumber())
+			} else if n, err := strconv.Atoi(seg.el(1, 0)); err != nil || n != len(msg.Segments) {
+				msg.Err = fmt.Errorf("UNH %s: UNT count %s, found %d segments", msg.ControlNumber(), seg.el(1, 0), len(msg.Segments))
+			}
+			ic.Messages = append(ic.Messages, *msg)
+			msg = nil
+		default:
+			if msg == nil {
+				return nil, fmt.Errorf("segment %s outside a message", seg.tag())
+			}
+			msg.Segments = append(msg.Segments, seg)
+		}
+	}
+	if ic != nil {
+		return nil, fmt.Errorf("UNB %s: missing UNZ", ic.ControlNumber())
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no UNB interchange found")
+	}
+	return out, nil
+}
+
+// Translate one EDIFACT message (DESADV, ORDERS or INVOIC) into the
+// canonical transaction model
+func translateEdifactMessage(ctx context.Context, ic EdifactInterchange, msg EdifactMessage) (Transaction, error) {
+	if msg.Err != nil {
+		return Transaction{}, msg.Err
+	}
+	t := Transaction{
+		Type:               msg.Type(),
+		ControlNumber:      msg.ControlNumber(),
+		InterchangeControl: ic.ControlNumber(),
+		PartnerID:          partnerIDForSender(ctx, ic.SenderID()),
+		sender:             ic.SenderID(),
+	}
+	var items []Item
+	var current *Item
+	var po, carton string
+	for _, seg := range msg.Segments {
+		switch seg.tag() {
+		case "BGM": // ORDERS document number is the PO
+			if t.Type == "ORDERS" {
+				po = seg.el(2, 0)
+				t.refs.PONumber = po
+			} else {
+				t.refs.Number = seg.el(2, 0)
+			}
+		case "NAD":
+			if seg.el(1, 0) == "ST" {
+				t.ShipTo = seg.el(2, 0)
+			}
+		case "TDT": // TDT05 carrier identification
+			t.Carrier = seg.el(5, 0)
+		case "RFF":
+			switch seg.el(1, 0) {
+			case "BM":
+				t.BOL = seg.el(1, 1)
+			case "ON":
+				po = seg.el(1, 1)
+				if current != nil {
+					current.PONumber = po
+				}
+			}
+		case "GIN": // package serial number (SSCC)
+			carton = seg.el(2, 0)
+		case "LIN":
+			items = append(items, Item{SKU: seg.el(3, 0), PONumber: po, Carton: carton})
+			current = &items[len(items)-1]
+		case "QTY":
+			if current != nil {
+				current.Quantity = parseQty(seg.el(1, 1))
+				current.UOM = seg.el(1, 2)
+			}
+		case "IMD":
+			if current != nil && seg.el(3, 3) != "" {
+				current.Description = seg.el(3, 3)
+			}
+		}
+	}
+	if items != nil {
+		list, err := json.Marshal(items)
+		if err != nil {
+			return Transaction{}, err
+		}
+		t.ItemList = string(list)
+	}
+	if err := applyPartnerMap(ctx, "inbound", &t, nil); err != nil {
+		return Transaction{annotations: t.annotations}, err // shows the failing rule
+	}
+	return t, nil
+}
+
+// Split parsed EDIFACT interchanges into transactions, one per message
+func splitEdifactInterchanges(ctx context.Context, interchanges []EdifactInterchange, now time.Time) []splitResult {
+	var out []splitResult
+	for _, ic := range interchanges {
+		for _, msg := range ic.Messages {
+			t, err := translateEdifactMessage(ctx, ic, msg)
+			t.Date = now
+			if err != nil {
+				t.Type, t.ControlNumber, t.InterchangeControl = msg.Type(), msg.ControlNumber(), ic.ControlNumber()
+			}
+			out = append(out, splitResult{Transaction: t, Err: err})
+		}
+	}
+	return out
+}
+
+// Builds EDIFACT segments with the default service characters
+type edifactWriter struct {
+	sb       bytes.Buffer
+	segments int // in the current message
+}
+
+var edifactEscaper = strings.NewReplacer("?", "??", "+", "?+", ":", "?:", "'", "?'")
+
+// Write one segment; each element is a list of components. Trailing empty
+// elements and components are dropped.
+func (w *edifactWriter) seg(tag string, elements ...[]string) {
+	for len(elements) > 0 && strings.Join(elements[len(elements)-1], "") == "" {
+		elements = elements[:len(elements)-1]
+	}
+	w.sb.WriteString(tag)
+	for _, el := range elements {
+		w.sb.WriteByte(defaultEdifactDelimiters.Element)
+		for len(el) > 0 && el[len(el)-1] == "" {
+			el = el[:len(el)-1]
+		}
+		for j, c := range el {
+			if j > 0 {
+				w.sb.WriteByte(defaultEdifactDelimiters.Component)
+			}
+			w.sb.WriteString(edifactEscaper.Replace(c))
+		}
+	}
+	w.sb.WriteByte(defaultEdifactDelimiters.Segment)
+	w.sb.WriteByte('\n')
+	w.segments++
+}
+
+// Build a DESADV interchange for a partner, one message per transaction,
+// with the segments translateEdifactMessage reads. Returns the interchange
+// and its control reference.
+func buildDesadvInterchange(ctx context.Context, p Partner, transactions []Transaction) (string, string, error) {
+	control, err := nextControlNumber(ctx, &p)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	ref := fmt.Sprint(control)
+	w := &edifactWriter{}
+	w.sb.WriteString("UNA:+.? '\n")
+	w.seg("UNB", tc("UNOC", "3"), tc(senderID, "ZZ"), tc(p.ISAID, p.ISAQualifier), tc(now.Format("060102"), now.Format("1504")), tc(ref))
+	for i, t := range transactions {
+		if err := writeDesadv(ctx, w, t, fmt.Sprint(i+1), now); err != nil {
+			settleControlNumber(ctx, p.ID, control, controlVoided, "", err.Error())
+			return "", "", err
+		}
+	}
+	w.seg("UNZ", tc(fmt.Sprint(len(transactions))), tc(ref))
+	return w.sb.String(), ref, nil
+}
+
+// Write one DESADV message (UNH..UNT)
+func writeDesadv(ctx context.Context, w *edifactWriter, t Transaction, ref string, now time.Time) error {
+	if err := applyPartnerMap(ctx, "outbound", &t, nil); err != nil {
+		return err
+	}
+	items, err := t.Items()
+	if err != nil {
+		return err
+	}
+	date := t.Date
+	if date.IsZero() {
+		date = now
+	}
+	w.segments = 0
+	w.seg("UNH", tc(ref), tc("DESADV", "D", "96A", "UN"))
+	w.seg("BGM", tc("351"), tc(shipmentID(t)), tc("9"))
+	w.seg("DTM", tc("137", date.Format("20060102"), "102"))
+	if t.BOL != "" {
+		w.seg("RFF", tc("BM", t.BOL))
+	}
+	if t.ShipTo != "" {
+		w.seg("NAD", tc("ST"), tc(t.ShipTo))
+	}
+	if t.Carrier != "" {
+		w.seg("TDT", tc("20"), nil, nil, nil, tc(t.Carrier))
+	}
+	w.seg("CPS", tc("1"))
+	line := 0
+	for _, po := range groupBy(items, func(it Item) string { return it.PONumber }) {
+		for _, carton := range groupBy(po.items, func(it Item) string { return it.Carton }) {
+			if carton.key != "" {
+				w.seg("GIN", tc("BJ"), tc(carton.key))
+			}
+			for _, it := range carton.items {
+				line++
+				w.seg("LIN", tc(fmt.Sprint(line)), nil, tc(it.SKU, "SA"))
+				if it.Description != "" {
+					w.seg("IMD", tc("F"), nil, tc("", "", "", it.Description))
+				}
+				w.seg("QTY", tc("12", formatQty(it.Quantity), it.UOM))
+				if po.key != "" {
+					w.seg("RFF", tc("ON", po.key))
+				}
+			}
+		}
+	}
+	w.seg("UNT", tc(fmt.Sprint(w.segments+1)), tc(ref))
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Character encodings of partners' documents. Inbound payloads are decoded
+// from the partner's encoding to UTF-8 before they are parsed; without one,
+// valid UTF-8 is kept and anything else is read as ISO 8859-1. Outbound
+// documents are encoded to it, transliterating what it cannot represent.
+const (
+	encodingUTF8        = "utf-8"
+	encodingLatin1      = "iso-8859-1"
+	encodingWindows1252 = "windows-1252"
+	encodingASCII       = "ascii"
+)
+
+// Other names partners give the encodings
+var encodingAliases = map[string]string{
+	"utf8": encodingUTF8, "latin1": encodingLatin1, "latin-1": encodingLatin1, "iso8859-1": encodingLatin1,
+	"iso-8859-1": encodingLatin1, "cp1252": encodingWindows1252, "us-ascii": encodingASCII,
+}
+
+// What happens to a document with a character illegal in its standard or
+// encoding, see illegalCharacter
+const (
+	illegalFlag   = "flag"   // log and count it (the default)
+	illegalReject = "reject" // fail the document
+	illegalOff    = "off"
+)
+
+var illegalCharacters = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_illegal_characters_total",
+	Help: "Documents with a character illegal in their standard or their partner's encoding, by direction.",
+}, []string{"tenant", "partner", "direction"})
+
+// Replacements of characters an encoding lacks, tried before dropping
+// accents; what neither fits becomes a space
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'ø': "o", 'Ø': "O", 'œ': "oe", 'Œ': "OE",
+	'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "TH", 'ı': "i",
+	'‘': "'", '’': "'", '‚': ",", '“': `"`, '”': `"`, '„': `"`, '–': "-", '—': "-", '−': "-",
+	'…': "...", '€': "EUR", '£': "GBP", '©': "(C)", '®': "(R)", '™': "TM", '\u00a0': " ",
+}
+
+func normalizeEncoding(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := encodingAliases[name]; ok {
+		name = alias
+	}
+	switch name {
+	case "", encodingUTF8, encodingLatin1, encodingWindows1252, encodingASCII:
+		return name, true
+	}
+	return name, false
+}
+
+// Check the character settings of a profile, normalizing its encoding
+func (p *Partner) validateCharacters() error {
+	enc, ok := normalizeEncoding(p.Encoding)
+	if !ok {
+		return errors.New("encoding must be utf-8, iso-8859-1, windows-1252 or ascii")
+	}
+	p.Encoding = enc
+	switch p.IllegalCharacters {
+	case "", illegalFlag, illegalReject, illegalOff:
+	default:
+		return errors.New("illegal_characters must be flag, reject or off")
+	}
+	_, err := parseTransliterations(p.Transliterations)
+	return err
+}
+
+// A partner's own outbound replacements, comma separated from=to pairs such
+// as "ß=ss,€=EUR" where from is one character
+func parseTransliterations(spec string) (map[rune]string, error) {
+	rules := map[rune]string{}
+	for _, entry := range splitList(spec) {
+		from, to, ok := strings.Cut(entry, "=")
+		if !ok || utf8.RuneCountInString(from) != 1 {
+			return nil, fmt.Errorf("transliterations: %q is not from=to with one character to replace", entry)
+		}
+		r, _ := utf8.DecodeRuneInString(from)
+		rules[r] = to
+	}
+	return rules, nil
+}
+
+// Whether the encoding has a character
+func encodable(enc string, r rune) bool {
+	switch enc {
+	case encodingASCII:
+		return r < utf8.RuneSelf
+	case encodingLatin1:
+		return r <= 0xff
+	case encodingWindows1252:
+		_, ok := charmap.Windows1252.EncodeRune(r)
+		return ok
+	}
+	return true
+}
+
+// Separators of an EDI payload, which may be control characters its data
+// may not contain
+func payloadSeparators(format string, data []byte) string {
+	switch format {
+	case formatX12:
+		if d, err := detectDelimiters(bytes.TrimLeft(data, " \t\r\n")); err == nil {
+			separators := []byte{d.Element, d.Component, d.Segment}
+			if validSeparator(d.Repetition) {
+				separators = append(separators, d.Repetition) // not the U of ISA11 before 00501
+			}
+			return string(separators)
+		}
+	case formatEDIFACT:
+		if head := bytes.TrimLeft(data, " \t\r\n"); bytes.HasPrefix(head, []byte("UNA")) && len(head) >= 9 {
+			return string(head[3:9])
+		}
+	}
+	return ""
+}
+
+// UN/EDIFACT syntax identifier (UNB S001), e.g. UNOA or UNOC
+func edifactSyntax(data []byte) string {
+	element, component := byte('+'), byte(':')
+	if head := bytes.TrimLeft(data, " \t\r\n"); bytes.HasPrefix(head, []byte("UNA")) && len(head) >= 9 {
+		component, element = head[3], head[4]
+	}
+	i := bytes.Index(data, []byte{'U', 'N', 'B', element})
+	if i < 0 {
+		return ""
+	}
+	rest := data[i+4:]
+	if end := bytes.IndexAny(rest, string([]byte{component, element})); end >= 0 {
+		rest = rest[:end]
+	}
+	return strings.ToUpper(string(rest))
+}
+
+// The first character of UTF-8 text illegal in the format, or in the
+// encoding enc it came in or goes out in, and its byte offset: control
+// characters other than separators and line breaks, invalid UTF-8, and
+// beyond ASCII, characters X12 and TRADACOMS only carry for partners with an
+// encoding and EDIFACT only under syntax levels above UNOB. UNOA also has no
+// lower case letters and few punctuation marks.
+func illegalCharacter(format, enc string, text []byte) (rune, int, bool) {
+	separators := payloadSeparators(format, text)
+	syntax := ""
+	if format == formatEDIFACT {
+		syntax = edifactSyntax(text)
+	}
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRune(text[i:])
+		illegal := false
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			illegal = true
+		case r < 0x20 || r == 0x7f:
+			illegal = r != '\r' && r != '\n' && !strings.ContainsRune(separators, r)
+		case r >= utf8.RuneSelf:
+			switch format {
+			case formatX12, formatTradacoms:
+				illegal = enc == "" || enc == encodingASCII
+			case formatEDIFACT:
+				illegal = syntax == "UNOA" || syntax == "UNOB" || enc == encodingASCII
+			default:
+				illegal = enc == encodingASCII
+			}
+		case syntax == "UNOA":
+			illegal = unicode.IsLower(r) || strings.ContainsRune("#$@[\\]^_`{|}~", r)
+		}
+		if illegal {
+			return r, i, true
+		}
+		i += size
+	}
+	return 0, 0, false
+}
+
+// Report an illegal character of a document for a partner, failing it when
+// the partner rejects them
+func reportIllegalCharacter(ctx context.Context, p Partner, direction, format string, r rune, at int) error {
+	if p.IllegalCharacters == illegalOff {
+		return nil
+	}
+	illegalCharacters.WithLabelValues(tenantID(ctx), p.ID, direction).Inc()
+	err := fmt.Errorf("%s: character %U at byte %d is illegal", format, r, at)
+	if p.IllegalCharacters == illegalReject {
+		return err
+	}
+	log.Printf("WARNING: %s document of partner %s: %v", direction, p.ID, err)
+	return nil
+}
+
+// Decode an inbound EDI or flat file payload to UTF-8 from the encoding of
+// its partner (partnerID, else for X12 the one its ISA06 names) and check
+// its characters. A UTF-8 byte order mark is dropped.
+func decodeInbound(ctx context.Context, format, partnerID string, data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if partnerID == "" && format == formatX12 {
+		if isa, _, err := readISA(bytes.TrimLeft(data, " \t\r\n")); err == nil {
+			partnerID = partnerIDForSender(ctx, strings.TrimSpace(isa.el(6)))
+		}
+	}
+	p := Partner{ID: partnerID}
+	if partnerID != "" && db != nil {
+		if loaded, err := loadPartner(ctx, partnerID); err == nil {
+			p = loaded
+		}
+	}
+	text := data
+	switch {
+	case p.Encoding == encodingLatin1, p.Encoding == encodingWindows1252:
+		cm := charmap.ISO8859_1
+		if p.Encoding == encodingWindows1252 {
+			cm = charmap.Windows1252
+		}
+		decoded, err := cm.NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not %s: %w", format, p.Encoding, err)
+		}
+		text = decoded
+	case p.Encoding == "" && !utf8.Valid(data):
+		text, _ = charmap.ISO8859_1.NewDecoder().Bytes(data)
+	}
+	if r, at, found := illegalCharacter(format, p.Encoding, text); found {
+		if err := reportIllegalCharacter(ctx, p, "inbound", format, r, at); err != nil {
+			return nil, err
+		}
+	}
+	return text, nil
+}
+
+// Encode a rendered outbound document for its partner. Characters the
+// target encoding lacks go through the partner's transliterations, then the
+// built-in ones, then lose their accents; what still does not fit becomes a
+// space and is illegal. The target is the partner's encoding or, for
+// EDIFACT, the ISO 8859-1 its UNOC syntax level declares; other documents
+// without one stay UTF-8. Replacements never add a separator: in EDIFACT
+// they are released, elsewhere the character becomes a space.
+func encodeOutbound(ctx context.Context, p Partner, format string, data []byte) ([]byte, error) {
+	enc := p.Encoding
+	if enc == "" && format == formatEDIFACT {
+		enc = encodingLatin1
+	}
+	rules, _ := parseTransliterations(p.Transliterations) // validated when saved
+	separators, release := payloadSeparators(format, data), ""
+	switch format {
+	case formatEDIFACT:
+		// The decimal mark and a space need no release; the UNA's reserved
+		// character does when it is the repetition separator
+		d := defaultEdifactDelimiters
+		separators, release = string([]byte{d.Component, d.Element, d.Release, d.Segment}), string(d.Release)
+		if una := payloadSeparators(format, data); una != "" {
+			separators, release = una[0:2]+una[3:4]+una[5:6], una[3:4]
+			if una[4] != ' ' {
+				separators += una[4:5]
+			}
+		}
+	case formatCSV:
+		separators = ",;\t|\""
+	}
+	var out strings.Builder
+	out.Grow(len(data))
+	illegal, illegalAt := rune(0), -1
+	for i, r := range string(data) {
+		replacement, ok := rules[r]
+		if !ok && encodable(enc, r) {
+			out.WriteRune(r)
+			continue
+		}
+		if !ok {
+			if replacement, ok = transliterations[r]; !ok {
+				replacement = stripAccents(r)
+			}
+		}
+		fits := replacement != ""
+		for _, c := range replacement {
+			switch {
+			case strings.ContainsRune(separators, c) && release != "":
+				out.WriteString(release)
+				out.WriteRune(c)
+			case strings.ContainsRune(separators, c):
+				out.WriteByte(' ')
+			case !encodable(enc, c):
+				out.WriteByte(' ')
+				fits = false
+			default:
+				out.WriteRune(c)
+			}
+		}
+		if replacement == "" {
+			out.WriteByte(' ')
+		}
+		if !fits && illegalAt < 0 {
+			illegal, illegalAt = r, i
+		}
+	}
+	text := []byte(out.String())
+	if illegalAt < 0 {
+		if r, at, found := illegalCharacter(format, enc, text); found {
+			illegal, illegalAt = r, at
+		}
+	}
+	if illegalAt >= 0 {
+		if err := reportIllegalCharacter(ctx, p, "outbound", format, illegal, illegalAt); err != nil {
+			return nil, fmt.Errorf("partner %s: %w", p.ID, err)
+		}
+	}
+	switch enc {
+	case encodingLatin1:
+		return charmap.ISO8859_1.NewEncoder().Bytes(text)
+	case encodingWindows1252:
+		return charmap.Windows1252.NewEncoder().Bytes(text)
+	}
+	return text, nil
+}
+
+// A character without its accents, when what is left is ASCII; "" otherwise
+func stripAccents(r rune) string {
+	var base strings.Builder
+	for _, c := range norm.NFD.String(string(r)) {
+		if unicode.Is(unicode.Mn, c) {
+			continue
+		}
+		if c >= utf8.RuneSelf {
+			return ""
+		}
+		base.WriteRune(c)
+	}
+	return base.String()
+}
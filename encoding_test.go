@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEncodeOutboundEdifactRelease(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"ellipsis", "UNB+UNOC:3+A+B'FTX+AAA+++Wait…OK'", "UNB+UNOC:3+A+B'FTX+AAA+++Wait...OK'"},
+		{"no-break space", "UNB+UNOC:3+A+B'FTX+AAA+++Wait\u00a0OK'", "UNB+UNOC:3+A+B'FTX+AAA+++Wait OK'"},
+		{"decimal mark kept", "UNB+UNOC:3+A+B'MOA+203:12.50'FTX+AAA+++1.5…2'", "UNB+UNOC:3+A+B'MOA+203:12.50'FTX+AAA+++1.5...2'"},
+		{"apostrophe released", "UNB+UNOC:3+A+B'NAD+ST+++O’Brien'", "UNB+UNOC:3+A+B'NAD+ST+++O?'Brien'"},
+		{"comma decimal mark", "UNA:+,? 'UNB+UNOC:3+A+B'FTX+AAA+++‚x'", "UNA:+,? 'UNB+UNOC:3+A+B'FTX+AAA+++,x'"},
+		{"unknown character", "UNA:+.?*'UNB+UNOC:4+A+B'FTX+AAA+++a…b×'", "UNA:+.?*'UNB+UNOC:4+A+B'FTX+AAA+++a...b '"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeOutbound(context.Background(), Partner{ID: "p", Encoding: encodingASCII, IllegalCharacters: illegalOff}, formatEDIFACT, []byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeOutboundEdifactReleasesRepetition(t *testing.T) {
+	p := Partner{ID: "p", Encoding: encodingASCII, Transliterations: "×=*"}
+	got, err := encodeOutbound(context.Background(), p, formatEDIFACT, []byte("UNA:+.?*'UNB+UNOC:4+A+B'FTX+AAA+++2×3. 4'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UNA:+.?*'UNB+UNOC:4+A+B'FTX+AAA+++2?*3. 4'"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
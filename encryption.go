@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/schema"
+)
+
+// Keys for fields tagged serializer:encrypted, as comma separated id:key
+// pairs of base64 AES keys (16, 24 or 32 bytes). The first key encrypts; the
+// others stay usable for decryption until `reencrypt` has moved every row to
+// the first. FIELD_ENCRYPTION_KEYS_FILE reads the same list from a file, e.g.
+// one a KMS or secrets agent writes. Without keys fields are stored as plain
+// text.
+var fieldKeys, fieldKeysErr = loadFieldKeys(getEnv("FIELD_ENCRYPTION_KEYS", ""), getEnv("FIELD_ENCRYPTION_KEYS_FILE", ""))
+
+// Prefix of encrypted values; plain text written before encryption was
+// enabled is read as is
+const encryptedPrefix = "enc:v1:"
+
+type fieldKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+type fieldKeyring struct {
+	current *fieldKey
+	byID    map[string]*fieldKey
+}
+
+func loadFieldKeys(spec, file string) (*fieldKeyring, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("FIELD_ENCRYPTION_KEYS_FILE: %w", err)
+		}
+		spec = strings.TrimSpace(string(b))
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	ring := &fieldKeyring{byID: map[string]*fieldKey{}}
+	for _, entry := range splitList(spec) {
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("field encryption key %q is not id:base64key", entry)
+		}
+		if ring.byID[id] != nil {
+			return nil, fmt.Errorf("field encryption key %s is listed twice", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("field encryption key %s: %w", id, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field encryption key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k := &fieldKey{id: id, aead: aead}
+		ring.byID[id] = k
+		if ring.current == nil {
+			ring.current = k
+		}
+	}
+	return ring, nil
+}
+
+// Encrypt a column value with the current key. The column name is bound as
+// additional data so a value cannot be moved to another column.
+func encryptField(column, plain string) (string, error) {
+	if fieldKeysErr != nil {
+		return "", fieldKeysErr
+	}
+	if fieldKeys == nil || plain == "" {
+		return plain, nil
+	}
+	k := fieldKeys.current
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(plain)+k.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(plain), []byte(column))
+	return encryptedPrefix + k.id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a stored column value; plain text is returned unchanged
+func decryptField(column, stored string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, encryptedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if fieldKeysErr != nil {
+		return "", fieldKeysErr
+	}
+	id, encoded, _ := strings.Cut(rest, ":")
+	var k *fieldKey
+	if fieldKeys != nil {
+		k = fieldKeys.byID[id]
+	}
+	if k == nil {
+		return "", fmt.Errorf("%s is encrypted with unknown key %s", column, id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", fmt.Errorf("%s: malformed encrypted value", column)
+	}
+	plain, err := k.aead.Open(nil, sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():], []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", column, err)
+	}
+	return string(plain), nil
+}
+
+// Whether a stored value needs rewriting to end up under the current key
+func needsReencrypt(stored string) bool {
+	if fieldKeys == nil || stored == "" {
+		return false
+	}
+	return !strings.HasPrefix(stored, encryptedPrefix+fieldKeys.current.id+":")
+}
+
+// GORM serializer encrypting string fields tagged serializer:encrypted
+type encryptedSerializer struct{}
+
+func init() {
+	schema.RegisterSerializer("encrypted", encryptedSerializer{})
+}
+
+func (encryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("%s: cannot decrypt %T", field.DBName, dbValue)
+	}
+	plain, err := decryptField(field.DBName, stored)
+	if err != nil {
+		return err
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plain)
+	return nil
+}
+
+func (encryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plain, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: only string fields can be encrypted", field.DBName)
+	}
+	return encryptField(field.DBName, plain)
+}
+
+// Tables and columns of models with encrypted fields
+func encryptedColumns() (map[string][]string, map[string]string, error) {
+	columns, keys := map[string][]string{}, map[string]string{}
+	cache := &sync.Map{}
+	for _, m := range models {
+		s, err := schema.Parse(m, cache, db.NamingStrategy)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range s.Fields {
+			if f.TagSettings["SERIALIZER"] == "encrypted" {
+				columns[s.Table] = append(columns[s.Table], f.DBName)
+			}
+		}
+		if len(columns[s.Table]) > 0 {
+			if s.PrioritizedPrimaryField == nil {
+				return nil, nil, fmt.Errorf("%s has no primary key", s.Table)
+			}
+			keys[s.Table] = s.PrioritizedPrimaryField.DBName
+		}
+	}
+	return columns, keys, nil
+}
+
+// Outcome of re-encrypting one table
+type reencryptReport struct {
+	Table       string `json:"table"`
+	Checked     int    `json:"checked"`
+	Reencrypted int    `json:"reencrypted"`
+}
+
+// Rewrite every encrypted column of every tenant that is plain text or under
+// an old key with the current key, batch rows at a time. Rows are read and
+// written as stored, bypassing the serializer.
+func reencryptAll(ctx context.Context, batch int) ([]reencryptReport, error) {
+	if fieldKeysErr != nil {
+		return nil, fieldKeysErr
+	}
+	if fieldKeys == nil {
+		return nil, errors.New("FIELD_ENCRYPTION_KEYS is not set")
+	}
+	columns, keys, err := encryptedColumns()
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, 0, len(columns))
+	for table := range columns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	scoped := db.WithContext(withTenant(ctx, allTenants))
+	var reports []reencryptReport
+	for _, table := range tables {
+		cols, pk := columns[table], keys[table]
+		rep := reencryptReport{Table: table}
+		var after interface{}
+		for {
+			var rows []map[string]interface{}
+			q := scoped.Table(table).Select(append([]string{pk}, cols...)).Order(pk).Limit(batch)
+			if after != nil {
+				q = q.Where(pk+" > ?", after)
+			}
+			if err := q.Find(&rows).Error; err != nil {
+				return reports, err
+			}
+			if len(rows) == 0 {
+				break
+			}
+			for _, row := range rows {
+				rep.Checked++
+				updates := map[string]interface{}{}
+				for _, col := range cols {
+					stored := storedString(row[col])
+					if !needsReencrypt(stored) {
+						continue
+					}
+					plain, err := decryptField(col, stored)
+					if err != nil {
+						return reports, fmt.Errorf("%s %v: %w", table, row[pk], err)
+					}
+					if updates[col], err = encryptField(col, plain); err != nil {
+						return reports, err
+					}
+				}
+				if len(updates) == 0 {
+					continue
+				}
+				if err := scoped.Table(table).Where(pk+" = ?", row[pk]).Updates(updates).Error; err != nil {
+					return reports, fmt.Errorf("%s %v: %w", table, row[pk], err)
+				}
+				rep.Reencrypted++
+			}
+			after = rows[len(rows)-1][pk]
+		}
+		reports = append(reports, rep)
+	}
+	return reports, nil
+}
+
+func storedString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
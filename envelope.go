@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Inbound X12 interchanges whose envelope is in error (ISA fields, IEA
+// counts and control numbers, segments out of place) are answered with a
+// TA1 naming the note code, recorded with their raw payload and the TA1 sent
+// to the partner's delivery_url. X12_REJECT_UNKNOWN_SENDERS also rejects
+// interchanges whose ISA06 is no partner's isa_id.
+var rejectUnknownSenders = getEnvBool("X12_REJECT_UNKNOWN_SENDERS", false)
+
+var interchangeRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_interchange_rejections_total",
+	Help: "Inbound X12 interchanges rejected at the envelope, by TA1 note code.",
+}, []string{"tenant", "note"})
+
+// An inbound interchange rejected at its envelope and the TA1 answering it.
+// Its raw payload is archived like a transaction's, under the rejection ID.
+type InterchangeRejection struct {
+	ID                 string     `json:"id" gorm:"primaryKey"`
+	TenantID           string     `json:"tenant_id" gorm:"index"`
+	PartnerID          string     `json:"partner_id,omitempty" gorm:"index"`
+	SenderQualifier    string     `json:"sender_qualifier,omitempty"` // ISA05
+	SenderID           string     `json:"sender_id,omitempty"`        // ISA06
+	ReceiverID         string     `json:"receiver_id,omitempty"`      // ISA08
+	InterchangeControl string     `json:"interchange_control,omitempty"`
+	Note               string     `json:"note"` // TA105, e.g. 001 for mismatched control numbers
+	Error              string     `json:"error"`
+	File               string     `json:"file,omitempty"`
+	ContentType        string     `json:"content_type,omitempty"`
+	Size               int        `json:"size"`
+	TA1                string     `json:"ta1"`
+	NotifiedAt         *time.Time `json:"notified_at,omitempty"` // when the TA1 reached the partner's delivery_url
+	NotifyError        string     `json:"notify_error,omitempty"`
+	CreatedAt          time.Time  `json:"created_at" gorm:"index"`
+}
+
+// TA1 rejecting an interchange with note, addressed to its sender and
+// reusing its control number
+func buildTA1(ic X12Interchange, note string, now time.Time) string {
+	control, _ := strconv.ParseInt(ic.ControlNumber(), 10, 64)
+	env := x12Envelope{
+		ReceiverQualifier: ic.ISA.el(5),
+		ReceiverID:        ic.SenderID(),
+		Version:           ic.ISA.el(12),
+		ControlNumber:     control,
+		Time:              now,
+		Test:              ic.ISA.el(15) == "T",
+	}
+	if len(env.Version) != 5 {
+		env.Version = "00401"
+	}
+	w := newX12Writer(ic.Delimiters)
+	defer w.release()
+	w.openInterchange(env)
+	w.seg("TA1", ic.ControlNumber(), ic.ISA.el(9), ic.ISA.el(10), ta1Rejected, note)
+	w.closeInterchange(env, 0)
+	return w.String()
+}
+
+// With X12_REJECT_UNKNOWN_SENDERS, reject the first interchange whose sender
+// is no partner's
+func checkInterchangeSenders(ctx context.Context, interchanges []X12Interchange) error {
+	if !rejectUnknownSenders || db == nil {
+		return nil
+	}
+	for _, ic := range interchanges {
+		if partnerIDForSender(ctx, ic.SenderID()) == "" {
+			return &envelopeError{Note: ta1InvalidSender, Interchange: X12Interchange{Delimiters: ic.Delimiters, ISA: ic.ISA},
+				Err: fmt.Errorf("x12: interchange %s: sender %s is not a partner", ic.ControlNumber(), ic.SenderID())}
+		}
+	}
+	return nil
+}
+
+// Record an interchange rejected at its envelope and send the partner its
+// TA1, returning the failed result reporting it. data is the payload, nil
+// when it was streamed and not kept whole. Sandboxed documents only get the
+// TA1.
+func rejectInterchange(ctx context.Context, file, contentType string, data []byte, envErr *envelopeError) batchResult {
+	ic := envErr.Interchange
+	now := time.Now().UTC()
+	rej := InterchangeRejection{
+		ID:                 uuid.New().String(),
+		PartnerID:          partnerIDForSender(ctx, ic.SenderID()),
+		SenderQualifier:    strings.TrimSpace(ic.ISA.el(5)),
+		SenderID:           ic.SenderID(),
+		ReceiverID:         strings.TrimSpace(ic.ISA.el(8)),
+		InterchangeControl: ic.ControlNumber(),
+		Note:               envErr.Note,
+		Error:              envErr.Error(),
+		File:               file,
+		ContentType:        contentType,
+		Size:               len(data),
+		TA1:                buildTA1(ic, envErr.Note, now),
+		CreatedAt:          now,
+	}
+	if rej.PartnerID == "" {
+		rej.PartnerID = channelFrom(ctx).Partner
+	}
+	res := batchResult{File: file, Format: formatX12, InterchangeControl: rej.InterchangeControl, Status: "failed",
+		Error: rej.Error, Code: codeInterchangeRejected, TA1Note: rej.Note, ta1: rej.TA1}
+	if edgeMode || db == nil || sandboxed(ctx, rej.PartnerID) {
+		return res
+	}
+	interchangeRejections.WithLabelValues(tenantID(ctx), rej.Note).Inc()
+	log.Printf("Interchange %s from %s rejected with TA1 note %s: %s", rej.InterchangeControl, rej.SenderID, rej.Note, rej.Error)
+	if data != nil {
+		if err := archivePayload(ctx, "inbound", contentType, data, rej.ID); err != nil {
+			log.Printf("ERROR: archive: %v\n", err)
+		}
+	}
+	if err := db.WithContext(ctx).Create(&rej).Error; err != nil {
+		log.Printf("ERROR: interchange rejection: %v\n", err)
+		return res
+	}
+	res.RejectionID = rej.ID
+	if rej.PartnerID != "" {
+		go sendTA1(detach(ctx), rej)
+	}
+	return res
+}
+
+// POST a rejection's TA1 to the partner's delivery_url, over AS2 when the
+// partner has an as2_id, and record whether it arrived. Partners without a
+// delivery_url read their rejections from the API.
+func sendTA1(ctx context.Context, rej InterchangeRejection) {
+	p, err := loadPartner(ctx, rej.PartnerID)
+	if err != nil || p.DeliveryURL == "" {
+		return
+	}
+	err = func() error {
+		if !deliveryBreakers.get(ctx, p.ID).allow() {
+			return fmt.Errorf("deliveries to partner %s are paused", p.ID)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", p.DeliveryURL, strings.NewReader(rej.TA1))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/edi-x12")
+		if p.AS2ID != "" {
+			p.MDNMode = mdnNone // nothing would match the MDN of a TA1
+			prepareAS2(req, p, "application/edi-x12", []byte(rej.TA1))
+		}
+		resp, err := deliveryClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("partner endpoint returned %s", resp.Status)
+		}
+		return nil
+	}()
+	updates := map[string]interface{}{}
+	if err != nil {
+		log.Printf("ERROR: TA1 of rejection %s to partner %s: %v\n", rej.ID, p.ID, err)
+		updates["notify_error"] = err.Error()
+	} else {
+		updates["notified_at"] = time.Now().UTC()
+	}
+	if err := db.WithContext(ctx).Model(&InterchangeRejection{}).Where("id = ?", rej.ID).Updates(updates).Error; err != nil {
+		log.Printf("ERROR: interchange rejection %s: %v\n", rej.ID, err)
+	}
+}
+
+// Partner a request may see the rejections of: its API key's, else any
+func rejectionScope(r *http.Request) *gorm.DB {
+	q := db.WithContext(r.Context())
+	if own := auditorFrom(r.Context()).partner; own != "" {
+		q = q.Where("partner_id = ?", own)
+	}
+	return q
+}
+
+// List interchange rejections, newest first
+func listInterchangeRejectionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := rejectionScope(r).Order("created_at DESC")
+	for _, param := range []string{"partner_id", "sender_id", "note"} {
+		if v := q.Get(param); v != "" {
+			query = query.Where(param+" = ?", v)
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeProblem(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("created_at >= ?", since)
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeProblem(w, "limit must be 1 to 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	rejections := []InterchangeRejection{}
+	if err := query.Limit(limit).Find(&rejections).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch interchange rejections", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rejections)
+}
+
+// Look up the interchange rejection of a request, writing the problem when
+// it fails
+func requestInterchangeRejection(w http.ResponseWriter, r *http.Request) *InterchangeRejection {
+	var rej InterchangeRejection
+	err := rejectionScope(r).First(&rej, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Interchange rejection not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch interchange rejection", http.StatusInternalServerError)
+		return nil
+	}
+	return &rej
+}
+
+// Fetch one interchange rejection, or its TA1 with Accept: application/edi-x12
+func getInterchangeRejectionHandler(w http.ResponseWriter, r *http.Request) {
+	rej := requestInterchangeRejection(w, r)
+	if rej == nil {
+		return
+	}
+	if wantsX12Acks(r) {
+		w.Header().Set("Content-Type", "application/edi-x12")
+		io.WriteString(w, rej.TA1)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rej)
+}
+
+// Stream the raw payload of a rejected interchange
+func rejectionPayloadHandler(w http.ResponseWriter, r *http.Request) {
+	if requestInterchangeRejection(w, r) == nil {
+		return
+	}
+	rawPayloadHandler(w, r)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+)
+
+// Published event types
+const (
+	eventTransactionCreated   = "transaction.created"
+	eventTransactionReplayed  = "transaction.replayed"
+	eventTransactionDelivered = "transaction.delivered"       // sent to the partner (and, for AS2, MDN received)
+	eventTransactionFailed    = "transaction.failed"          // received but rejected, e.g. over a guardrail
+	eventDeliveryFailed       = "transaction.delivery_failed" // delivery to the partner failed
+)
+
+// Version of eventEnvelope; bump on incompatible changes and keep consumers
+// switching on schema_version
+const eventSchemaVersion = 1
+
+// Versioned wrapper around every published event
+type eventEnvelope struct {
+	SchemaVersion int         `json:"schema_version"`
+	EventID       string      `json:"event_id"`
+	EventType     string      `json:"event_type"`
+	OccurredAt    time.Time   `json:"occurred_at"`
+	CorrelationID string      `json:"correlation_id,omitempty"`
+	TenantID      string      `json:"tenant_id"`
+	Source        string      `json:"source"`
+	Error         string      `json:"error,omitempty"` // failure events only
+	Data          Transaction `json:"data"`
+}
+
+// Message key: partner keeps each partner's events in order, transaction
+// spreads load evenly
+var kafkaKeyBy = getEnv("KAFKA_KEY", "partner")
+
+// Build the Kafka message for an event about t
+func newEventMessage(ctx context.Context, topic, eventType string, t Transaction, reason string) (kafka.Message, error) {
+	env := eventEnvelope{
+		SchemaVersion: eventSchemaVersion,
+		EventID:       uuid.New().String(),
+		EventType:     eventType,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: correlationID(ctx),
+		TenantID:      t.TenantID,
+		Source:        "edigateway",
+		Error:         reason,
+		Data:          t,
+	}
+	value, err := json.Marshal(env)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	if id, ok := schemaIDs.Load(topic); ok {
+		value = append(schemaPrefix(id.(int)), value...)
+	}
+	key := t.PartnerID
+	if kafkaKeyBy == "transaction" || key == "" {
+		key = t.ID
+	}
+	msg := kafka.Message{
+		Key:   []byte(key),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "event_id", Value: []byte(env.EventID)},
+			{Key: "event_type", Value: []byte(eventType)},
+			{Key: "schema_version", Value: []byte(strconv.Itoa(eventSchemaVersion))},
+			{Key: "correlation_id", Value: []byte(env.CorrelationID)},
+			{Key: "tenant_id", Value: []byte(env.TenantID)},
+			{Key: "partner_id", Value: []byte(t.PartnerID)},
+			{Key: "transaction_date", Value: []byte(t.Date.UTC().Format(time.RFC3339Nano))},
+			{Key: "content_type", Value: []byte("application/json")},
+		},
+	}
+	if t.Priority != "" {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "priority", Value: []byte(t.Priority)})
+	}
+	if tp := traceparent(ctx); tp != "" {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "traceparent", Value: []byte(tp)})
+	}
+	return msg, nil
+}
+
+type correlationKey struct{}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+type traceparentKey struct{}
+
+// W3C trace context of the request, passed on to the events it causes
+func withTraceparent(ctx context.Context, tp string) context.Context {
+	return context.WithValue(ctx, traceparentKey{}, tp)
+}
+
+func traceparent(ctx context.Context) string {
+	tp, _ := ctx.Value(traceparentKey{}).(string)
+	return tp
+}
+
+// Trace ID of a version 00 traceparent, or "" when it is not one
+func traceparentID(tp string) string {
+	parts := strings.Split(tp, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return ""
+	}
+	for _, p := range parts[1:] {
+		if _, err := hex.DecodeString(p); err != nil || strings.ToLower(p) != p {
+			return ""
+		}
+	}
+	return parts[1]
+}
+
+// Trace to link an event's metrics to: the traceparent's, else the
+// correlation ID
+func traceIDOf(tp, correlationID string) string {
+	if id := traceparentID(tp); id != "" {
+		return id
+	}
+	return correlationID
+}
+
+// Context for work that should outlive the request but keep its correlation
+// ID, tenant, auditor and submitting partner
+func detachedContext(r *http.Request) context.Context {
+	return detach(r.Context())
+}
+
+func detach(ctx context.Context) context.Context {
+	out := withCorrelationID(context.Background(), correlationID(ctx))
+	out = withTenant(out, tenantID(ctx))
+	out = withAuditor(out, auditorFrom(ctx))
+	out = withChannel(out, channelFrom(ctx))
+	if tp := traceparent(ctx); tp != "" {
+		out = withTraceparent(out, tp)
+	}
+	if mappingDebug(ctx) {
+		out = withMappingDebug(out)
+	}
+	if s, ok := requestSignatureFrom(ctx); ok {
+		out = withRequestSignature(out, s)
+	}
+	return withPartnerHint(out, partnerHint(ctx))
+}
+
+// Take the correlation ID from X-Correlation-ID (or X-Request-ID), generating
+// one when absent, and echo it on the response. A valid traceparent is kept
+// for the events of the request.
+func correlationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Correlation-ID")
+		if id == "" {
+			id = r.Header.Get("X-Request-ID")
+		}
+		if id == "" {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Correlation-ID", id)
+		ctx := withCorrelationID(r.Context(), id)
+		if tp := r.Header.Get("traceparent"); traceparentID(tp) != "" {
+			ctx = withTraceparent(ctx, tp)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Optional Confluent-compatible schema registry. When configured, the
+// envelope schema is registered at startup and values use the registry wire
+// format (magic byte 0, 4-byte schema ID, JSON).
+var (
+	schemaRegistryURL = getEnv("KAFKA_SCHEMA_REGISTRY_URL", "")
+	schemaIDs         sync.Map // topic -> registered schema ID; routing rule reloads add topics
+)
+
+// JSON Schema of eventEnvelope version 1
+const eventEnvelopeSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "edigateway.event.v1",
+  "type": "object",
+  "required": ["schema_version", "event_id", "event_type", "occurred_at", "source", "data"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "event_id": {"type": "string"},
+    "event_type": {"type": "string"},
+    "occurred_at": {"type": "string", "format": "date-time"},
+    "correlation_id": {"type": "string"},
+    "tenant_id": {"type": "string"},
+    "source": {"type": "string"},
+    "error": {"type": "string"},
+    "data": {
+      "type": "object",
+      "required": ["id", "date", "partner_id", "status"],
+      "properties": {
+        "id": {"type": "string"},
+        "date": {"type": "string", "format": "date-time"},
+        "partner_id": {"type": "string"},
+        "tenant_id": {"type": "string"},
+        "type": {"type": "string"},
+        "control_number": {"type": "string"},
+        "interchange_control": {"type": "string"},
+        "ship_to": {"type": "string"},
+        "carrier": {"type": "string"},
+        "bol": {"type": "string"},
+        "items": {"type": "string"},
+        "status": {"type": "string"},
+        "origin": {"type": "string"},
+        "format": {"type": "string"}
+      }
+    }
+  }
+}`
+
+// Register the envelope schema under <topic>-value
+func registerEventSchema(topic string) error {
+	if schemaRegistryURL == "" {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]string{"schemaType": "JSON", "schema": eventEnvelopeSchema})
+	url := fmt.Sprintf("%s/subjects/%s-value/versions", schemaRegistryURL, topic)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("schema registry returned %s", resp.Status)
+	}
+	var out struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return err
+	}
+	if out.ID > 0 {
+		schemaIDs.Store(topic, out.ID)
+	}
+	return nil
+}
+
+func schemaPrefix(id int) []byte {
+	b := make([]byte, 5)
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	return b
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Transactions move between environments, for a database migration or a
+// disaster recovery drill, as NDJSON in a canonical format: a header line
+// naming the format and its version, one line per transaction with its line
+// items, its event stream and the outbound acknowledgments it is linked to,
+// then a trailer counting the transactions so a cut-off export is noticed.
+// Fields encrypted at rest are exported in clear and encrypted again with
+// the keys of the importing gateway.
+const (
+	canonicalFormat  = "edigateway.transactions"
+	canonicalVersion = 1 // imports refuse newer versions
+)
+
+// Kinds of lines of an export
+const (
+	canonicalHeader      = "header"
+	canonicalTransaction = "transaction"
+	canonicalTrailer     = "trailer"
+)
+
+// Transactions read from the database per query while exporting
+const exportBatch = 500
+
+// One line of an export; which fields are set depends on its kind
+type canonicalLine struct {
+	Kind string `json:"kind"`
+
+	// header
+	Format     string             `json:"format,omitempty"`
+	Version    int                `json:"version,omitempty"`
+	TenantID   string             `json:"tenant_id,omitempty"`
+	ExportedAt *time.Time         `json:"exported_at,omitempty"`
+	Filter     *transactionFilter `json:"filter,omitempty"`
+
+	// transaction
+	Transaction *Transaction       `json:"transaction,omitempty"`
+	SearchText  string             `json:"search_text,omitempty"`
+	LineItems   []LineItem         `json:"line_items,omitempty"`
+	Events      []TransactionEvent `json:"events,omitempty"` // oldest first
+	Acks        []OutboundAck      `json:"acks,omitempty"`   // interchanges it was sent in, or the one it acknowledged
+
+	// trailer
+	Transactions *int `json:"transactions,omitempty"`
+}
+
+// What an import did
+type transactionImport struct {
+	Imported    int      `json:"imported"`
+	Overwritten int      `json:"overwritten"`
+	Skipped     int      `json:"skipped"`
+	ConflictIDs []string `json:"conflict_ids,omitempty"` // of the transactions that already existed, at most 100
+	Complete    bool     `json:"complete"`               // the whole export was read, trailer included
+	Error       string   `json:"error,omitempty"`        // why the import stopped
+}
+
+// How an import treats a transaction whose ID already exists
+const (
+	importSkip      = "skip"      // keep the existing one
+	importFail      = "fail"      // stop the import
+	importOverwrite = "overwrite" // replace its document and line items; its history gains an imported event
+)
+
+const auditImport = "import"
+
+// Partner API keys cannot export or import transactions
+func transferAllowed(ctx context.Context) error {
+	if auditorFrom(ctx).partner != "" {
+		return &httpError{Status: http.StatusForbidden, Message: "Partner API keys cannot export or import transactions"}
+	}
+	return nil
+}
+
+// Stream the transactions matching the search filters (partner_id, type,
+// status, format, control_number, q, unacked, older_than, newer_than, from
+// and to) in the canonical format, oldest ID first
+func exportTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := transferAllowed(ctx); err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	f, err := filterFromQuery(q)
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bounds := map[string]time.Time{}
+	for _, param := range []string{"from", "to"} {
+		if v := q.Get(param); v != "" {
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				writeProblem(w, param+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			bounds[param] = ts
+		}
+	}
+	now := time.Now().UTC()
+	query := func() *gorm.DB {
+		q := f.apply(db.WithContext(ctx).Model(&Transaction{}), now)
+		if ts, ok := bounds["from"]; ok {
+			q = q.Where("transactions.date >= ?", ts)
+		}
+		if ts, ok := bounds["to"]; ok {
+			q = q.Where("transactions.date < ?", ts)
+		}
+		return q
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="transactions-%s.ndjson"`, now.Format("20060102T150405Z")))
+	enc := json.NewEncoder(w)
+	enc.Encode(canonicalLine{Kind: canonicalHeader, Format: canonicalFormat, Version: canonicalVersion,
+		TenantID: tenantID(ctx), ExportedAt: &now, Filter: &f})
+	count, after := 0, ""
+	for {
+		var txs []Transaction
+		if err := query().Where("transactions.id > ?", after).Order("transactions.id").Limit(exportBatch).Find(&txs).Error; err != nil {
+			// Without the trailer the importer knows the export is incomplete
+			log.Printf("ERROR: export: %v\n", err)
+			return
+		}
+		if len(txs) == 0 {
+			break
+		}
+		lines, err := canonicalLines(ctx, txs)
+		if err != nil {
+			log.Printf("ERROR: export: %v\n", err)
+			return
+		}
+		for _, line := range lines {
+			if err := enc.Encode(line); err != nil {
+				return // the client went away
+			}
+		}
+		count += len(txs)
+		after = txs[len(txs)-1].ID
+	}
+	enc.Encode(canonicalLine{Kind: canonicalTrailer, Transactions: &count})
+	log.Printf("Exported %d transactions", count)
+}
+
+// The export lines of a batch of transactions, with their line items,
+// events and acknowledgments
+func canonicalLines(ctx context.Context, txs []Transaction) ([]canonicalLine, error) {
+	if err := readItems(ctx, txs); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(txs))
+	for i, t := range txs {
+		ids[i] = t.ID
+	}
+	scoped := db.WithContext(ctx)
+	var items []LineItem
+	if err := scoped.Where("transaction_id IN ?", ids).Order("transaction_id, line").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	var events []TransactionEvent
+	if err := scoped.Where("transaction_id IN ?", ids).Order("id").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	sent := scoped.Model(&OutboundAckTransaction{}).Select("ack_id").Where("transaction_id IN ?", ids)
+	var acks []OutboundAck
+	if err := scoped.Where("id IN (?) OR ack_transaction_id IN ?", sent, ids).Order("id").Find(&acks).Error; err != nil {
+		return nil, err
+	}
+
+	lines := make([]canonicalLine, len(txs))
+	index := map[string]*canonicalLine{}
+	for i := range txs {
+		lines[i] = canonicalLine{Kind: canonicalTransaction, Transaction: &txs[i], SearchText: txs[i].SearchText}
+		index[txs[i].ID] = &lines[i]
+	}
+	for _, it := range items {
+		index[it.TransactionID].LineItems = append(index[it.TransactionID].LineItems, it)
+	}
+	for _, e := range events {
+		if e.Delta != "" {
+			e.Changes = json.RawMessage(e.Delta)
+		}
+		index[e.TransactionID].Events = append(index[e.TransactionID].Events, e)
+	}
+	for _, a := range acks {
+		var sent []string
+		json.Unmarshal([]byte(a.TransactionIDs), &sent)
+		for _, id := range append(sent, a.AckTransactionID) {
+			if line := index[id]; line != nil {
+				line.Acks = append(line.Acks, a)
+			}
+		}
+	}
+	return lines, nil
+}
+
+// Import an export in the canonical format into the tenant of the request.
+// ?on_conflict= skip (the default), fail or overwrite decides what happens to
+// transactions that already exist. Imported transactions keep their IDs and
+// history and are not published, delivered or acknowledged again. Responds
+// 200 when the whole export was imported and 207 with what was when it
+// stopped short.
+func importTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := transferAllowed(ctx); err != nil {
+		writeError(w, err)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, _ := mime.ParseMediaType(ct)
+		if mediaType != "application/x-ndjson" && mediaType != "application/jsonl" && !jsonMediaType(ct) {
+			writeProblem(w, "Content-Type must be application/x-ndjson", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	onConflict := r.URL.Query().Get("on_conflict")
+	switch onConflict {
+	case "":
+		onConflict = importSkip
+	case importSkip, importFail, importOverwrite:
+	default:
+		writeProblem(w, "on_conflict must be skip, fail or overwrite", http.StatusBadRequest)
+		return
+	}
+
+	// Lenient on fields: the export may come from a newer release writing
+	// the same version
+	dec := json.NewDecoder(r.Body)
+	var header canonicalLine
+	if err := dec.Decode(&header); err != nil {
+		writeError(w, jsonError(err))
+		return
+	}
+	if header.Kind != canonicalHeader || header.Format != canonicalFormat {
+		writeProblem(w, "Not an export of transactions: the first line must be its "+canonicalFormat+" header", http.StatusBadRequest)
+		return
+	}
+	if header.Version < 1 || header.Version > canonicalVersion {
+		writeProblem(w, fmt.Sprintf("Export version %d is not supported; this gateway reads up to version %d", header.Version, canonicalVersion), http.StatusBadRequest)
+		return
+	}
+
+	var report transactionImport
+	read := 0
+	err := func() error {
+		for n := 2; ; n++ {
+			var line canonicalLine
+			if err := dec.Decode(&line); err == io.EOF {
+				return errors.New("the export ends without its trailer")
+			} else if err != nil {
+				return fmt.Errorf("line %d: %s", n, jsonError(err).Message)
+			}
+			switch line.Kind {
+			case canonicalTransaction:
+				if line.Transaction == nil || line.Transaction.ID == "" {
+					return fmt.Errorf("line %d: transaction without an id", n)
+				}
+				read++
+				existed, err := importTransaction(ctx, line, onConflict)
+				if err != nil {
+					return fmt.Errorf("line %d: transaction %s: %w", n, line.Transaction.ID, err)
+				}
+				if existed {
+					if len(report.ConflictIDs) < 100 {
+						report.ConflictIDs = append(report.ConflictIDs, line.Transaction.ID)
+					}
+					if onConflict == importSkip {
+						report.Skipped++
+					} else {
+						report.Overwritten++
+					}
+				} else {
+					report.Imported++
+				}
+			case canonicalTrailer:
+				if line.Transactions == nil || *line.Transactions != read {
+					return fmt.Errorf("line %d: the trailer does not count the %d transactions read", n, read)
+				}
+				report.Complete = true
+				return nil
+			default:
+				return fmt.Errorf("line %d: unknown kind %q", n, line.Kind)
+			}
+		}
+	}()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	log.Printf("Imported transactions: %d new, %d overwritten, %d skipped (on_conflict %s)", report.Imported, report.Overwritten, report.Skipped, onConflict)
+	if err != nil {
+		log.Printf("Transaction import stopped: %v", err)
+	}
+	auditChange(ctx, auditImport, "transactions", "", nil, report)
+	status := http.StatusOK
+	if !report.Complete {
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Save one transaction of an export with its events and acknowledgments,
+// telling whether it already existed. A conflict fails with importFail.
+func importTransaction(ctx context.Context, line canonicalLine, onConflict string) (bool, error) {
+	t := *line.Transaction
+	t.TenantID = tenantID(ctx)
+	if t.ItemList == "" && len(line.LineItems) > 0 {
+		list, err := json.Marshal(rowItems(line.LineItems))
+		if err != nil {
+			return false, err
+		}
+		t.ItemList = string(list)
+	}
+	if t.SearchText = line.SearchText; t.SearchText == "" {
+		t.SearchText = searchText(t)
+	}
+	if status := statusFromEvents(line.Events); status != "" {
+		t.Status = status // the stream, not the cached column, decides
+	}
+	if err := checkSignatureRecorded(ctx, t); err != nil {
+		return false, err
+	}
+
+	existed := false
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&t)
+		if res.Error != nil {
+			return res.Error
+		}
+		if existed = res.RowsAffected == 0; existed {
+			switch onConflict {
+			case importSkip:
+				return nil
+			case importFail:
+				return &httpError{Status: http.StatusConflict, Message: "already exists"}
+			}
+			return overwriteTransaction(ctx, tx, t)
+		}
+		events := make([]TransactionEvent, 0, len(line.Events))
+		for _, e := range line.Events {
+			// IDs are the importing database's; the order is kept
+			e.ID, e.TransactionID, e.Delta = 0, t.ID, string(e.Changes)
+			events = append(events, e)
+		}
+		if len(events) == 0 {
+			events = append(events, newTransactionEvent(ctx, t.ID, txEventImported, t.Status, map[string]interface{}{"source": "import"}))
+		}
+		return tx.CreateInBatches(&events, bulkInsertBatch).Error
+	})
+	if err != nil || (existed && onConflict == importSkip) {
+		return existed, err
+	}
+	for _, a := range line.Acks {
+		a.ID = 0
+		// The interchange may be linked to several exported transactions
+		err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&a).Error; err != nil {
+				return err
+			}
+			if a.ID == 0 {
+				if err := tx.Model(&OutboundAck{}).Select("id").Where("partner_id = ? AND control_number = ?", a.PartnerID, a.ControlNumber).
+					Scan(&a.ID).Error; err != nil {
+					return err
+				}
+			}
+			return linkAckTransactions(tx, a)
+		})
+		if err != nil {
+			return existed, fmt.Errorf("acknowledgment %s/%d: %w", a.PartnerID, a.ControlNumber, err)
+		}
+	}
+	return existed, nil
+}
+
+// Replace an existing transaction's document and line items with t, and
+// record the status it now has as an imported event
+func overwriteTransaction(ctx context.Context, tx *gorm.DB, t Transaction) error {
+	res := tx.Model(&Transaction{}).Where("id = ?", t.ID).Select("*").Omit("id", "tenant_id").Updates(&t)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &httpError{Status: http.StatusConflict, Message: "exists in another tenant"}
+	}
+	if err := tx.Where("transaction_id = ?", t.ID).Delete(&LineItem{}).Error; err != nil {
+		return err
+	}
+	if itemsStorage != itemsJSON {
+		if rows, err := lineItemRows(&t); err == nil && len(rows) > 0 {
+			if err := tx.CreateInBatches(&rows, bulkInsertBatch).Error; err != nil {
+				return err
+			}
+		}
+	}
+	e := newTransactionEvent(ctx, t.ID, txEventImported, t.Status, map[string]interface{}{"source": "import", "overwritten": true})
+	return tx.Create(&e).Error
+}
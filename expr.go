@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Small expression language used by mapping rules, e.g.
+//
+//	upper(trim(value))
+//	quantity * 12
+//	concat(po_number, "-", sku)
+//
+// Values are strings; arithmetic operands must parse as numbers.
+type exprParser struct {
+	tokens []string
+	pos    int
+	vars   func(name string) (string, bool)
+}
+
+// Evaluate expr, resolving identifiers through vars
+func evalExpr(expr string, vars func(string) (string, bool)) (string, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return "", err
+	}
+	p := &exprParser{tokens: tokens, vars: vars}
+	v, err := p.sum()
+	if err != nil {
+		return "", err
+	}
+	if p.pos != len(p.tokens) {
+		return "", fmt.Errorf("expr %q: unexpected %q", expr, p.tokens[p.pos])
+	}
+	return v, nil
+}
+
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("()+-*/,", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"' || c == '\'':
+			j := strings.IndexRune(s[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("expr %q: unterminated string", s)
+			}
+			tokens = append(tokens, s[i:i+j+2])
+			i += j + 2
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_' || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("expr %q: unexpected character %q", s, c)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// sum := product (('+'|'-') product)*
+func (p *exprParser) sum() (string, error) {
+	left, err := p.product()
+	if err != nil {
+		return "", err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()
+		right, err := p.product()
+		if err != nil {
+			return "", err
+		}
+		if left, err = arith(op, left, right); err != nil {
+			return "", err
+		}
+	}
+	return left, nil
+}
+
+// product := term (('*'|'/') term)*
+func (p *exprParser) product() (string, error) {
+	left, err := p.term()
+	if err != nil {
+		return "", err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.next()
+		right, err := p.term()
+		if err != nil {
+			return "", err
+		}
+		if left, err = arith(op, left, right); err != nil {
+			return "", err
+		}
+	}
+	return left, nil
+}
+
+// term := string | number | ident | ident '(' args ')' | '(' sum ')' | '-' term
+func (p *exprParser) term() (string, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return "", fmt.Errorf("expr: unexpected end")
+	case t == "(":
+		v, err := p.sum()
+		if err != nil {
+			return "", err
+		}
+		if p.next() != ")" {
+			return "", fmt.Errorf("expr: missing )")
+		}
+		return v, nil
+	case t == "-":
+		v, err := p.term()
+		if err != nil {
+			return "", err
+		}
+		return arith("-", "0", v)
+	case t[0] == '"' || t[0] == '\'':
+		return t[1 : len(t)-1], nil
+	case unicode.IsDigit(rune(t[0])):
+		return t, nil
+	case p.peek() == "(":
+		p.next()
+		var args []string
+		for p.peek() != ")" {
+			v, err := p.sum()
+			if err != nil {
+				return "", err
+			}
+			args = append(args, v)
+			if p.peek() == "," {
+				p.next()
+			} else if p.peek() != ")" {
+				return "", fmt.Errorf("expr: expected , or ) in call to %s", t)
+			}
+		}
+		p.next()
+		return callFunc(t, args)
+	default:
+		v, ok := p.vars(t)
+		if !ok {
+			return "", fmt.Errorf("expr: unknown field %q", t)
+		}
+		return v, nil
+	}
+}
+
+func arith(op, a, b string) (string, error) {
+	x, err1 := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	y, err2 := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("expr: %q %s %q needs numbers", a, op, b)
+	}
+	switch op {
+	case "+":
+		x += y
+	case "-":
+		x -= y
+	case "*":
+		x *= y
+	case "/":
+		if y == 0 {
+			return "", fmt.Errorf("expr: division by zero")
+		}
+		x /= y
+	}
+	return formatQty(x), nil
+}
+
+// Built-in functions
+func callFunc(name string, args []string) (string, error) {
+	want := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("expr: %s takes %d arguments, got %d", name, n, len(args))
+		}
+		return nil
+	}
+	switch name {
+	case "upper", "lower", "trim":
+		if err := want(1); err != nil {
+			return "", err
+		}
+		switch name {
+		case "upper":
+			return strings.ToUpper(args[0]), nil
+		case "lower":
+			return strings.ToLower(args[0]), nil
+		}
+		return strings.TrimSpace(args[0]), nil
+	case "concat":
+		return strings.Join(args, ""), nil
+	case "replace":
+		if err := want(3); err != nil {
+			return "", err
+		}
+		return strings.ReplaceAll(args[0], args[1], args[2]), nil
+	case "substr":
+		if err := want(3); err != nil {
+			return "", err
+		}
+		start, err1 := strconv.Atoi(args[1])
+		n, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil || start < 0 || n < 0 {
+			return "", fmt.Errorf("expr: substr needs non-negative integer bounds")
+		}
+		s := args[0]
+		if start > len(s) {
+			return "", nil
+		}
+		if start+n > len(s) {
+			n = len(s) - start
+		}
+		return s[start : start+n], nil
+	case "coalesce":
+		for _, a := range args {
+			if a != "" {
+				return a, nil
+			}
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("expr: unknown function %s", name)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"gorm.io/gorm"
+)
+
+// Fault injection for staging: with FAULT_INJECTION set, /admin/faults can
+// slow down or fail Kafka publishes, database queries and partner deliveries
+// on demand, so the outbox, retries and circuit breakers can be watched at
+// work without breaking the real infrastructure. Faults live in the memory
+// of the replica that was asked and never reach the dependencies
+// themselves. Never enable it in production.
+var faultInjection = getEnvBool("FAULT_INJECTION", false)
+
+// What a fault can target
+const (
+	faultKafka    = "kafka"    // produce requests to the brokers, or the memory events backend
+	faultDatabase = "database" // every GORM operation
+	faultDelivery = "delivery" // HTTP and AS2 requests to partner endpoints
+)
+
+// A fault injected into calls to one dependency
+type injectedFault struct {
+	Target          string     `json:"target"`
+	ErrorRate       float64    `json:"error_rate"`                 // share of calls failed, 0 to 1
+	LatencyMS       int        `json:"latency_ms"`                 // added to every call first
+	Timeout         bool       `json:"timeout,omitempty"`          // delivery: failed calls hang until the client times out
+	Status          int        `json:"status,omitempty"`           // delivery: failed calls are answered with this status instead of a connection error
+	Table           string     `json:"table,omitempty"`            // database: only operations on this table
+	Host            string     `json:"host,omitempty"`             // delivery: only requests to this host
+	DurationSeconds int        `json:"duration_seconds,omitempty"` // the fault clears itself after this, 0 never
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	Injected        int64      `json:"injected"` // calls failed so far
+	CreatedBy       string     `json:"created_by,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+var faultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_injected_faults_total",
+	Help: "Calls to a dependency failed by fault injection.",
+}, []string{"target"})
+
+// The faults in force, by target
+var faults = struct {
+	sync.Mutex
+	active map[string]*injectedFault
+}{active: map[string]*injectedFault{}}
+
+func (f *injectedFault) validate() error {
+	switch f.Target {
+	case faultKafka, faultDatabase, faultDelivery:
+	default:
+		return fmt.Errorf("target must be kafka, database or delivery, not %q", f.Target)
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return fmt.Errorf("error_rate must be 0 to 1")
+	}
+	if f.LatencyMS < 0 || f.DurationSeconds < 0 {
+		return fmt.Errorf("latency_ms and duration_seconds may not be negative")
+	}
+	if f.ErrorRate == 0 && f.LatencyMS == 0 {
+		return fmt.Errorf("a fault needs an error_rate or a latency_ms")
+	}
+	if f.Target != faultDelivery && (f.Timeout || f.Status != 0 || f.Host != "") {
+		return fmt.Errorf("timeout, status and host only apply to delivery faults")
+	}
+	if f.Target != faultDatabase && f.Table != "" {
+		return fmt.Errorf("table only applies to database faults")
+	}
+	if f.Status != 0 && (f.Status < 400 || f.Status > 599) {
+		return fmt.Errorf("status must be an HTTP error status, 400 to 599")
+	}
+	if f.Timeout && f.Status != 0 {
+		return fmt.Errorf("a fault times out or answers a status, not both")
+	}
+	return nil
+}
+
+// The fault of target in force at now, clearing an expired one
+func activeFault(target string, now time.Time) *injectedFault {
+	faults.Lock()
+	defer faults.Unlock()
+	f := faults.active[target]
+	if f != nil && f.ExpiresAt != nil && !f.ExpiresAt.After(now) {
+		log.Printf("Fault injection: %s fault expired", target)
+		delete(faults.active, target)
+		return nil
+	}
+	return f
+}
+
+// Delay a call by the fault of target and tell whether to fail it. The
+// fault is copied, so it can change while the call waits.
+func injectFault(ctx context.Context, target string, applies func(injectedFault) bool) (injectedFault, bool) {
+	if !faultInjection {
+		return injectedFault{}, false
+	}
+	active := activeFault(target, time.Now())
+	if active == nil {
+		return injectedFault{}, false
+	}
+	faults.Lock()
+	f := *active
+	faults.Unlock()
+	if applies != nil && !applies(f) {
+		return f, false
+	}
+	if f.LatencyMS > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(f.LatencyMS) * time.Millisecond):
+		}
+	}
+	if rand.Float64() >= f.ErrorRate {
+		return f, false
+	}
+	faults.Lock()
+	active.Injected++
+	faults.Unlock()
+	faultsInjected.WithLabelValues(target).Inc()
+	return f, true
+}
+
+// Kafka transport failing produce requests that a fault picks
+type faultyKafkaTransport struct {
+	next kafka.RoundTripper
+}
+
+func (t faultyKafkaTransport) RoundTrip(ctx context.Context, addr net.Addr, req kafka.Request) (kafka.Response, error) {
+	if _, fail := injectFault(ctx, faultKafka, func(injectedFault) bool { return req.ApiKey() == protocol.Produce }); fail {
+		return nil, fmt.Errorf("injected fault: kafka produce to %s failed", addr)
+	}
+	return t.next.RoundTrip(ctx, addr, req)
+}
+
+// Transport of Kafka writers: the default one, wrapped while fault
+// injection is enabled
+func kafkaTransport() kafka.RoundTripper {
+	if !faultInjection {
+		return nil
+	}
+	return faultyKafkaTransport{next: kafka.DefaultTransport}
+}
+
+// Publisher of the memory backend failing publishes that a fault picks
+type faultyPublisher struct {
+	next eventPublisher
+}
+
+func (p faultyPublisher) publish(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	if _, fail := injectFault(ctx, faultKafka, nil); fail {
+		return fmt.Errorf("injected fault: publish to %s failed", topic)
+	}
+	return p.next.publish(ctx, topic, msgs...)
+}
+
+// HTTP transport of deliveries failing requests that a fault picks: with a
+// connection error, a hang until the client gives up or an error status
+type faultyDeliveryTransport struct {
+	next http.RoundTripper
+}
+
+func (t faultyDeliveryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, fail := injectFault(req.Context(), faultDelivery, func(f injectedFault) bool {
+		return f.Host == "" || strings.EqualFold(f.Host, req.URL.Hostname())
+	})
+	if !fail {
+		return t.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	switch {
+	case f.Timeout:
+		<-req.Context().Done()
+		return nil, fmt.Errorf("injected fault: %s timed out: %w", req.URL.Host, req.Context().Err())
+	case f.Status != 0:
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+			StatusCode: f.Status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("injected fault\n")),
+			Request:    req,
+		}, nil
+	}
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("injected fault: connection to %s refused", req.URL.Host)}
+}
+
+// Transport of the delivery client, wrapped while fault injection is enabled
+func deliveryTransport() http.RoundTripper {
+	if !faultInjection {
+		return http.DefaultTransport
+	}
+	return faultyDeliveryTransport{next: http.DefaultTransport}
+}
+
+// Fail GORM operations that a fault picks with a lost connection, which the
+// retries and the database circuit breaker treat as transient
+func registerFaults(gdb *gorm.DB) error {
+	if !faultInjection {
+		return nil
+	}
+	inject := func(tx *gorm.DB) {
+		if tx.Error != nil {
+			return
+		}
+		_, fail := injectFault(tx.Statement.Context, faultDatabase, func(f injectedFault) bool {
+			return f.Table == "" || f.Table == tx.Statement.Table
+		})
+		if fail {
+			tx.AddError(fmt.Errorf("injected fault: %w", driver.ErrBadConn))
+		}
+	}
+	cb := gdb.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("faults:create", inject),
+		cb.Query().Before("gorm:query").Register("faults:query", inject),
+		cb.Update().Before("gorm:update").Register("faults:update", inject),
+		cb.Delete().Before("gorm:delete").Register("faults:delete", inject),
+		cb.Row().Before("gorm:row").Register("faults:row", inject),
+		cb.Raw().Before("gorm:raw").Register("faults:raw", inject),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("WARNING: fault injection is enabled, see /admin/faults")
+	return nil
+}
+
+// Whether the faults endpoints may be used by the request, writing the
+// problem when not
+func faultsAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if !faultInjection {
+		writeProblem(w, "Fault injection is disabled; set FAULT_INJECTION", http.StatusNotFound)
+		return false
+	}
+	if auditorFrom(r.Context()).partner != "" {
+		writeProblem(w, "Partner API keys cannot inject faults", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func writeFaults(w http.ResponseWriter) {
+	faults.Lock()
+	list := []injectedFault{}
+	for _, target := range []string{faultKafka, faultDatabase, faultDelivery} {
+		if f := faults.active[target]; f != nil {
+			list = append(list, *f)
+		}
+	}
+	faults.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// List the faults in force on this replica
+func listFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !faultsAllowed(w, r) {
+		return
+	}
+	now := time.Now()
+	for _, target := range []string{faultKafka, faultDatabase, faultDelivery} {
+		activeFault(target, now)
+	}
+	writeFaults(w)
+}
+
+// Inject a fault into calls to the target, replacing the one in force
+func putFaultHandler(w http.ResponseWriter, r *http.Request) {
+	if !faultsAllowed(w, r) {
+		return
+	}
+	var f injectedFault
+	if err := decodeJSON(w, r, &f); err != nil {
+		writeError(w, err)
+		return
+	}
+	f.Target = mux.Vars(r)["target"]
+	if err := f.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Injected, f.CreatedBy, f.CreatedAt, f.ExpiresAt = 0, auditorFrom(r.Context()).actor, time.Now().UTC(), nil
+	if f.DurationSeconds > 0 {
+		expires := f.CreatedAt.Add(time.Duration(f.DurationSeconds) * time.Second)
+		f.ExpiresAt = &expires
+	}
+	faults.Lock()
+	faults.active[f.Target] = &f
+	faults.Unlock()
+	log.Printf("Fault injection: %s fault set by %s: error_rate %g, latency %dms", f.Target, f.CreatedBy, f.ErrorRate, f.LatencyMS)
+	auditChange(r.Context(), auditUpdate, "fault", f.Target, nil, f)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// Clear the fault of the target, or of every target
+func clearFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !faultsAllowed(w, r) {
+		return
+	}
+	target := mux.Vars(r)["target"]
+	faults.Lock()
+	if target == "" {
+		faults.active = map[string]*injectedFault{}
+	} else {
+		delete(faults.active, target)
+	}
+	faults.Unlock()
+	if target == "" {
+		target = "all"
+	}
+	log.Printf("Fault injection: %s cleared by %s", target, auditorFrom(r.Context()).actor)
+	auditChange(r.Context(), auditUpdate, "fault", target, nil, map[string]bool{"cleared": true})
+	writeFaults(w)
+}
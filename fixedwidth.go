@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Layout of a partner's fixed-width (positional) files. Each line is one
+// record whose type code sits at RecordTypeStart; header records start a
+// transaction and item records add an item line to it. Extracted values go
+// through the layout's map rules before the partner's inbound map.
+type FixedWidthLayout struct {
+	PartnerID        string    `json:"partner_id" gorm:"primaryKey"`
+	TenantID         string    `json:"tenant_id" gorm:"index"`
+	Type             string    `json:"type,omitempty"`               // transaction type, default 856
+	RecordTypeStart  int       `json:"record_type_start,omitempty"`  // 1-based column of the record type code
+	RecordTypeLength int       `json:"record_type_length,omitempty"` // 0 when every line uses the only record
+	Records          string    `json:"-"`                            // JSON array of FixedWidthRecord
+	Rules            string    `json:"-"`                            // JSON array of MapRule
+	UpdatedAt        time.Time `json:"updated_at"`
+
+	ParsedRecords []FixedWidthRecord `json:"records" gorm:"-"`
+	ParsedRules   []MapRule          `json:"rules,omitempty" gorm:"-"`
+}
+
+// Kinds of fixed-width record
+const (
+	recordHeader = "header" // starts a transaction; may also carry one item line
+	recordItem   = "item"   // adds an item line to the current transaction
+	recordSkip   = "skip"   // ignored, e.g. file header and trailer records
+)
+
+type FixedWidthRecord struct {
+	Code   string            `json:"code,omitempty"` // record type value, e.g. H or 10
+	Kind   string            `json:"kind"`
+	Fields []FixedWidthField `json:"fields,omitempty"`
+}
+
+type FixedWidthField struct {
+	Field    string `json:"field"`              // canonical field, e.g. bol or items.quantity
+	Start    int    `json:"start"`              // 1-based column
+	Length   int    `json:"length"`             // in bytes
+	Type     string `json:"type,omitempty"`     // string (default, trimmed) or number
+	Decimals int    `json:"decimals,omitempty"` // implied decimal places of a number
+}
+
+func (l *FixedWidthLayout) validate() error {
+	if len(l.ParsedRecords) == 0 {
+		return errors.New("records are required")
+	}
+	if l.RecordTypeLength < 0 || l.RecordTypeLength > 0 && l.RecordTypeStart < 1 {
+		return errors.New("record_type_start must be at least 1 when record_type_length is set")
+	}
+	if l.RecordTypeLength == 0 && len(l.ParsedRecords) > 1 {
+		return errors.New("several records need record_type_start and record_type_length")
+	}
+	known := map[string]bool{}
+	for _, f := range headerFields {
+		known[f] = true
+	}
+	for _, f := range itemFields {
+		known["items."+f] = true
+	}
+	codes := map[string]bool{}
+	for i, rec := range l.ParsedRecords {
+		if l.RecordTypeLength > 0 {
+			if rec.Code == "" || len(rec.Code) > l.RecordTypeLength {
+				return fmt.Errorf("record %d: code must be 1 to %d characters", i+1, l.RecordTypeLength)
+			}
+			if codes[rec.Code] {
+				return fmt.Errorf("record %d: duplicate code %q", i+1, rec.Code)
+			}
+			codes[rec.Code] = true
+		}
+		switch rec.Kind {
+		case recordHeader, recordItem, recordSkip:
+		default:
+			return fmt.Errorf("record %d: kind must be header, item or skip", i+1)
+		}
+		for j, f := range rec.Fields {
+			if !known[f.Field] {
+				return fmt.Errorf("record %d field %d: unknown field %q", i+1, j+1, f.Field)
+			}
+			if rec.Kind == recordItem && !strings.HasPrefix(f.Field, "items.") {
+				return fmt.Errorf("record %d field %d: item records only set items fields", i+1, j+1)
+			}
+			if f.Start < 1 || f.Length < 1 {
+				return fmt.Errorf("record %d field %d: start and length must be at least 1", i+1, j+1)
+			}
+			if f.Type != "" && f.Type != "string" && f.Type != "number" {
+				return fmt.Errorf("record %d field %d: type must be string or number", i+1, j+1)
+			}
+			if f.Decimals < 0 || f.Decimals > 9 || f.Decimals > 0 && f.Type != "number" {
+				return fmt.Errorf("record %d field %d: decimals must be 0 to 9 and need type number", i+1, j+1)
+			}
+		}
+	}
+	if l.RecordTypeLength == 0 && l.ParsedRecords[0].Kind != recordHeader {
+		return errors.New("a single record must be a header record")
+	}
+	if err := validateRules(l.ParsedRules); err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+	return nil
+}
+
+// Record definition for a line, or nil when its type code is unknown
+func (l *FixedWidthLayout) record(line string) *FixedWidthRecord {
+	if l.RecordTypeLength == 0 {
+		return &l.ParsedRecords[0]
+	}
+	code := strings.TrimSpace(column(line, l.RecordTypeStart, l.RecordTypeLength))
+	for i := range l.ParsedRecords {
+		if l.ParsedRecords[i].Code == code {
+			return &l.ParsedRecords[i]
+		}
+	}
+	return nil
+}
+
+// Bytes start..start+length-1 (1-based) of line, or what a short line has of them
+func column(line string, start, length int) string {
+	if start > len(line) {
+		return ""
+	}
+	end := start - 1 + length
+	if end > len(line) {
+		end = len(line)
+	}
+	return line[start-1 : end]
+}
+
+// Value of a field as a canonical string. Numbers may be zero padded and
+// carry a leading or trailing sign, as COBOL writes them.
+func (f *FixedWidthField) value(line string) (string, error) {
+	v := strings.TrimSpace(column(line, f.Start, f.Length))
+	if f.Type != "number" || v == "" {
+		return v, nil
+	}
+	neg := false
+	if strings.HasSuffix(v, "-") || strings.HasPrefix(v, "-") {
+		neg = true
+	}
+	digits := strings.Trim(v, "+- ")
+	n, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a number for %s", v, f.Field)
+	}
+	if f.Decimals > 0 && !strings.Contains(digits, ".") {
+		n /= math.Pow10(f.Decimals)
+	}
+	if neg {
+		n = -n
+	}
+	return formatQty(n), nil
+}
+
+// Fixed-width layout of a partner; nil when none is configured
+func loadFixedWidthLayout(ctx context.Context, partnerID string) (*FixedWidthLayout, error) {
+	if partnerID == "" || db == nil {
+		return nil, nil
+	}
+	var l FixedWidthLayout
+	res := db.WithContext(ctx).Where("partner_id = ?", partnerID).Limit(1).Find(&l)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	if err := json.Unmarshal([]byte(l.Records), &l.ParsedRecords); err != nil {
+		return nil, fmt.Errorf("partner %s fixed-width layout: %w", partnerID, err)
+	}
+	if l.Rules != "" {
+		if err := json.Unmarshal([]byte(l.Rules), &l.ParsedRules); err != nil {
+			return nil, fmt.Errorf("partner %s fixed-width layout rules: %w", partnerID, err)
+		}
+	}
+	return &l, nil
+}
+
+// Parse a fixed-width file into transactions for partnerID using its layout
+func parseFixedWidth(ctx context.Context, partnerID string, data []byte) ([]Transaction, []error, error) {
+	if partnerID == "" {
+		return nil, nil, errors.New("fixed-width files need a partner: send X-Partner-ID or a partner API key")
+	}
+	layout, err := loadFixedWidthLayout(ctx, partnerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if layout == nil {
+		return nil, nil, fmt.Errorf("partner %s has no fixed-width layout", partnerID)
+	}
+	trace := ""
+	if mappingDebug(ctx) {
+		trace = "fixed-width layout"
+	}
+
+	var txs []Transaction
+	var errs []error
+	var items []Item
+	flush := func() {
+		if len(txs) == 0 {
+			return
+		}
+		t := &txs[len(txs)-1]
+		if items != nil {
+			list, err := json.Marshal(items)
+			if err != nil && errs[len(errs)-1] == nil {
+				errs[len(errs)-1] = err
+			}
+			t.ItemList = string(list)
+		}
+		items = nil
+		if errs[len(errs)-1] == nil {
+			if err := applyRules(layout.ParsedRules, t, nil, trace); err != nil {
+				errs[len(errs)-1] = err
+			}
+		}
+	}
+	lines := strings.Split(string(bytes.TrimLeft(data, "\ufeff")), "\n")
+	for n, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rec := layout.record(line)
+		if rec == nil || rec.Kind == recordItem && len(txs) == 0 {
+			msg := fmt.Errorf("line %d: unknown record type %q", n+1,
+				strings.TrimSpace(column(line, layout.RecordTypeStart, layout.RecordTypeLength)))
+			if rec != nil {
+				msg = fmt.Errorf("line %d: item record before any header record", n+1)
+			}
+			if len(txs) == 0 {
+				return nil, nil, msg
+			}
+			if errs[len(errs)-1] == nil {
+				errs[len(errs)-1] = msg
+			}
+			continue
+		}
+		if rec.Kind == recordSkip {
+			continue
+		}
+		if rec.Kind == recordHeader {
+			flush()
+			txs = append(txs, Transaction{PartnerID: partnerID, Type: layout.Type})
+			errs = append(errs, nil)
+		}
+		t := &txs[len(txs)-1]
+		var it Item
+		hasItem := false
+		for _, f := range rec.Fields {
+			v, err := f.value(line)
+			if err == nil {
+				if name, ok := strings.CutPrefix(f.Field, "items."); ok {
+					err = setItemField(&it, name, v)
+					hasItem = hasItem || v != ""
+				} else {
+					err = setHeaderField(t, f.Field, v)
+				}
+			}
+			if err != nil && errs[len(errs)-1] == nil {
+				errs[len(errs)-1] = fmt.Errorf("line %d: %w", n+1, err)
+			}
+		}
+		if hasItem {
+			items = append(items, it)
+		}
+	}
+	flush()
+	for i := range txs {
+		if txs[i].Type == "" {
+			txs[i].Type = "856"
+		}
+	}
+	return txs, errs, nil
+}
+
+// Fetch a partner's fixed-width layout
+func getFixedWidthLayoutHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := loadFixedWidthLayout(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch fixed-width layout", http.StatusInternalServerError)
+		return
+	}
+	if l == nil {
+		writeProblem(w, "Fixed-width layout not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// Create or replace a partner's fixed-width layout
+func putFixedWidthLayoutHandler(w http.ResponseWriter, r *http.Request) {
+	partnerID := mux.Vars(r)["id"]
+	if _, err := loadPartner(r.Context(), partnerID); errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	var l FixedWidthLayout
+	if err := decodeJSON(w, r, &l); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := l.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before, err := loadFixedWidthLayout(r.Context(), partnerID)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch fixed-width layout", http.StatusInternalServerError)
+		return
+	}
+	l.PartnerID = partnerID
+	records, _ := json.Marshal(l.ParsedRecords)
+	l.Records = string(records)
+	l.Rules = ""
+	if len(l.ParsedRules) > 0 {
+		rules, _ := json.Marshal(l.ParsedRules)
+		l.Rules = string(rules)
+	}
+	if err := db.WithContext(r.Context()).Save(&l).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save fixed-width layout", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditAction(before != nil), "fixed_width_layout", partnerID, before, l)
+	recordConfigChange(r.Context(), "fixed_width_layout", partnerID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Layout of a partner's delimited flat files. Each record is one item line;
+// consecutive records with the same GroupBy value form one transaction whose
+// header fields come from its first record.
+type FlatFileProfile struct {
+	PartnerID string    `json:"partner_id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	Delimiter string    `json:"delimiter"`          // one character, default ","
+	Header    bool      `json:"header"`             // first record holds column names
+	GroupBy   string    `json:"group_by,omitempty"` // header field starting a new transaction when it changes; default bol, "-" for one per record
+	Type      string    `json:"type,omitempty"`     // transaction type, default 856
+	Columns   string    `json:"-"`                  // JSON array of FlatFileColumn
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ParsedColumns []FlatFileColumn `json:"columns" gorm:"-"`
+}
+
+// One column. With a header, columns are matched by Name; otherwise by
+// position.
+type FlatFileColumn struct {
+	Name  string `json:"name,omitempty"`
+	Field string `json:"field"` // canonical field, e.g. ship_to or items.sku; empty ignores the column
+}
+
+func (p *FlatFileProfile) delimiter() rune {
+	r, _ := utf8.DecodeRuneInString(p.Delimiter)
+	if r == utf8.RuneError {
+		return ','
+	}
+	return r
+}
+
+func (p *FlatFileProfile) groupBy() string {
+	if p.GroupBy == "" {
+		return "bol"
+	}
+	return p.GroupBy
+}
+
+func (p *FlatFileProfile) validate() error {
+	if utf8.RuneCountInString(p.Delimiter) > 1 || p.Delimiter == "\"" || p.Delimiter == "\n" {
+		return fmt.Errorf("delimiter must be a single character other than quote or newline")
+	}
+	if len(p.ParsedColumns) == 0 {
+		return errors.New("columns are required")
+	}
+	known := map[string]bool{}
+	for _, f := range headerFields {
+		known[f] = true
+	}
+	for _, f := range itemFields {
+		known["items."+f] = true
+	}
+	for i, c := range p.ParsedColumns {
+		if c.Field != "" && !known[c.Field] {
+			return fmt.Errorf("column %d: unknown field %q", i+1, c.Field)
+		}
+		if p.Header && c.Name == "" {
+			return fmt.Errorf("column %d: name is required when header is set", i+1)
+		}
+	}
+	if g := p.GroupBy; g != "" && g != "-" && !known[g] {
+		return fmt.Errorf("group_by: unknown field %q", g)
+	}
+	return nil
+}
+
+// Flat file profile of a partner; nil when none is configured
+func loadFlatFileProfile(ctx context.Context, partnerID string) (*FlatFileProfile, error) {
+	if partnerID == "" || db == nil {
+		return nil, nil
+	}
+	var p FlatFileProfile
+	res := db.WithContext(ctx).Where("partner_id = ?", partnerID).Limit(1).Find(&p)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	if err := json.Unmarshal([]byte(p.Columns), &p.ParsedColumns); err != nil {
+		return nil, fmt.Errorf("partner %s flat file profile: %w", partnerID, err)
+	}
+	return &p, nil
+}
+
+// Parse a flat file into transactions for partnerID using its profile
+func parseFlatFile(ctx context.Context, partnerID string, data []byte) ([]Transaction, []error, error) {
+	if partnerID == "" {
+		return nil, nil, errors.New("flat files need a partner: send X-Partner-ID or a partner API key")
+	}
+	profile, err := loadFlatFileProfile(ctx, partnerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if profile == nil {
+		return nil, nil, fmt.Errorf("partner %s has no flat file profile", partnerID)
+	}
+
+	r := csv.NewReader(bytes.NewReader(bytes.TrimLeft(data, "\ufeff")))
+	r.Comma = profile.delimiter()
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+
+	fields := make([]string, len(profile.ParsedColumns)) // field per record position
+	for i, c := range profile.ParsedColumns {
+		fields[i] = c.Field
+	}
+	if profile.Header {
+		names, err := r.Read()
+		if err != nil {
+			return nil, nil, fmt.Errorf("flat file header: %w", err)
+		}
+		fields = make([]string, len(names))
+		for i, name := range names {
+			for _, c := range profile.ParsedColumns {
+				if strings.EqualFold(strings.TrimSpace(name), c.Name) {
+					fields[i] = c.Field
+				}
+			}
+		}
+	}
+
+	var txs []Transaction
+	var errs []error
+	var items []Item
+	group := ""
+	flush := func() {
+		if len(txs) == 0 {
+			return
+		}
+		t := &txs[len(txs)-1]
+		if items != nil {
+			list, err := json.Marshal(items)
+			if err != nil {
+				errs[len(errs)-1] = err
+			}
+			t.ItemList = string(list)
+		}
+		items = nil
+	}
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("flat file: %w", err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		var row Transaction
+		var it Item
+		hasItem := false
+		var rowErr error
+		for i, v := range record {
+			if i >= len(fields) || fields[i] == "" {
+				continue
+			}
+			v = strings.TrimSpace(v)
+			if name, ok := strings.CutPrefix(fields[i], "items."); ok {
+				if err := setItemField(&it, name, v); err != nil && rowErr == nil {
+					rowErr = fmt.Errorf("record %d: %q is not a number for items.%s", line, v, name)
+				}
+				hasItem = hasItem || v != ""
+			} else {
+				setHeaderField(&row, fields[i], v)
+			}
+		}
+		key, _ := headerField(&row, profile.groupBy())
+		if len(txs) == 0 || profile.groupBy() == "-" || key != group {
+			flush()
+			row.PartnerID = partnerID
+			if row.Type == "" {
+				row.Type = profile.Type
+			}
+			if row.Type == "" {
+				row.Type = "856"
+			}
+			txs = append(txs, row)
+			errs = append(errs, nil)
+			group = key
+		}
+		if rowErr != nil && errs[len(errs)-1] == nil {
+			errs[len(errs)-1] = rowErr
+		}
+		if hasItem {
+			items = append(items, it)
+		}
+	}
+	flush()
+	return txs, errs, nil
+}
+
+// Render transactions in a partner's flat file layout
+func renderFlatFile(profile *FlatFileProfile, txs []Transaction) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = profile.delimiter()
+	cols := profile.ParsedColumns
+	if profile.Header {
+		names := make([]string, len(cols))
+		for i, c := range cols {
+			names[i] = c.Name
+		}
+		w.Write(names)
+	}
+	for i := range txs {
+		t := &txs[i]
+		items, err := t.Items()
+		if err != nil {
+			return nil, err
+		}
+		noItems := len(items) == 0
+		if noItems {
+			items = []Item{{}} // one record carrying the header fields
+		}
+		for j := range items {
+			record := make([]string, len(cols))
+			for k, c := range cols {
+				if name, ok := strings.CutPrefix(c.Field, "items."); ok {
+					if !noItems {
+						record[k], _ = itemField(&items[j], name)
+					}
+				} else if c.Field != "" {
+					record[k], _ = headerField(t, c.Field)
+				}
+			}
+			w.Write(record)
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Respond with a partner's transactions in its flat file layout
+func writeFlatFile(w http.ResponseWriter, r *http.Request, partnerID string, txs []Transaction) {
+	profile, err := loadFlatFileProfile(r.Context(), partnerID)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch flat file profile", http.StatusInternalServerError)
+		return
+	}
+	if profile == nil {
+		writeProblem(w, "Partner has no flat file profile", http.StatusUnprocessableEntity)
+		return
+	}
+	out, err := renderFlatFile(profile, txs)
+	if err != nil {
+		writeProblem(w, "Failed to render flat file: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	ids := make([]string, len(txs))
+	for i, t := range txs {
+		ids[i] = t.ID
+	}
+	if err := archivePayload(r.Context(), "outbound", "text/csv", out, ids...); err != nil {
+		log.Printf("ERROR: archive: %v\n", err)
+		writeProblem(w, "Failed to archive payload", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Write(out)
+}
+
+// Fetch a partner's flat file profile
+func getFlatFileProfileHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := loadFlatFileProfile(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch flat file profile", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		writeProblem(w, "Flat file profile not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// Create or replace a partner's flat file profile
+func putFlatFileProfileHandler(w http.ResponseWriter, r *http.Request) {
+	partnerID := mux.Vars(r)["id"]
+	if _, err := loadPartner(r.Context(), partnerID); errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	var p FlatFileProfile
+	if err := decodeJSON(w, r, &p); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := p.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before, err := loadFlatFileProfile(r.Context(), partnerID)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch flat file profile", http.StatusInternalServerError)
+		return
+	}
+	p.PartnerID = partnerID
+	cols, _ := json.Marshal(p.ParsedColumns)
+	p.Columns = string(cols)
+	if err := db.WithContext(r.Context()).Save(&p).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save flat file profile", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditAction(before != nil), "flat_file_profile", partnerID, before, p)
+	recordConfigChange(r.Context(), "flat_file_profile", partnerID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+// Inbound document formats
+const (
+	formatJSON       = "json"
+	formatX12        = "x12"
+	formatEDIFACT    = "edifact"
+	formatTradacoms  = "tradacoms"
+	formatXML        = "xml"
+	formatCSV        = "csv"         // delimited flat file, parsed with the partner's profile
+	formatFixedWidth = "fixed_width" // positional records, parsed with the partner's layout
+	formatFlat       = "flat"        // text/plain: fixed width when the partner has a layout, otherwise delimited
+	formatGRPC       = "protobuf"    // Transaction message submitted over gRPC
+)
+
+// Detect a payload's format from its first bytes, falling back to the declared
+// Content-Type. Legacy systems often send no or the wrong Content-Type, so the
+// payload itself wins when it is recognisable.
+func detectFormat(contentType string, data []byte) string {
+	head := bytes.TrimLeft(data, " \t\r\n\ufeff")
+	switch {
+	case bytes.HasPrefix(head, []byte("ISA")):
+		return formatX12
+	case bytes.HasPrefix(head, []byte("UNA")), bytes.HasPrefix(head, []byte("UNB")):
+		return formatEDIFACT
+	case bytes.HasPrefix(head, []byte("STX=")):
+		return formatTradacoms
+	case bytes.HasPrefix(head, []byte("{")), bytes.HasPrefix(head, []byte("[")):
+		return formatJSON
+	case bytes.HasPrefix(head, []byte("<")):
+		return formatXML
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/edi-x12":
+		return formatX12
+	case mediaType == "application/edifact":
+		return formatEDIFACT
+	case mediaType == "application/edi-tradacoms", mediaType == "application/x-tradacoms":
+		return formatTradacoms
+	case strings.HasSuffix(mediaType, "json"):
+		return formatJSON
+	case strings.HasSuffix(mediaType, "xml"):
+		return formatXML
+	case mediaType == "text/csv", mediaType == "application/csv", mediaType == "text/tab-separated-values":
+		return formatCSV
+	case mediaType == "text/x-fixed-width", mediaType == "application/x-fixed-width":
+		return formatFixedWidth
+	case mediaType == "text/plain":
+		return formatFlat
+	}
+	return ""
+}
+
+// Whether the payload is a single JSON transaction, the original /inbound
+// contract. Undetectable payloads are treated as JSON so they get the
+// familiar "Invalid JSON" response.
+func singleJSON(format string, data []byte) bool {
+	head := bytes.TrimLeft(data, " \t\r\n\ufeff")
+	return format == "" || format == formatJSON && !bytes.HasPrefix(head, []byte("["))
+}
+
+// Split a payload of the given format into canonical transactions. partnerID
+// is the submitting partner, needed by formats without an envelope.
+func splitDocument(ctx context.Context, format, partnerID string, data []byte, now time.Time) ([]splitResult, error) {
+	if format == formatFlat {
+		format = formatCSV
+		if l, err := loadFixedWidthLayout(ctx, partnerID); err == nil && l != nil {
+			format = formatFixedWidth
+		}
+	}
+	switch format {
+	case formatX12, formatEDIFACT, formatTradacoms, formatCSV, formatFixedWidth:
+		decoded, err := decodeInbound(ctx, format, partnerID, data)
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	}
+	var split []splitResult
+	switch format {
+	case formatX12:
+		interchanges, err := parseX12(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkInterchangeSenders(ctx, interchanges); err != nil {
+			return nil, err
+		}
+		split = splitInterchanges(ctx, interchanges, now)
+	case formatEDIFACT:
+		interchanges, err := parseEdifact(data)
+		if err != nil {
+			return nil, err
+		}
+		split = splitEdifactInterchanges(ctx, interchanges, now)
+	case formatTradacoms:
+		transmissions, err := parseTradacoms(data)
+		if err != nil {
+			return nil, err
+		}
+		split = splitTradacomsTransmissions(ctx, transmissions, now)
+	case formatJSON:
+		var list []Transaction
+		if !singleJSON(format, data) {
+			if err := decodeInboundJSON(data, &list); err != nil {
+				return nil, err
+			}
+		} else {
+			var t Transaction
+			if err := decodeInboundJSON(data, &t); err != nil {
+				return nil, err
+			}
+			list = []Transaction{t}
+		}
+		for i := range list {
+			clearServerFields(&list[i])
+		}
+		split = canonicalSplit(ctx, list, now)
+	case formatXML:
+		list, err := decodeXMLTransactions(data)
+		if err != nil {
+			return nil, err
+		}
+		split = canonicalSplit(ctx, list, now)
+	case formatCSV, formatFixedWidth:
+		parse := parseFlatFile
+		if format == formatFixedWidth {
+			parse = parseFixedWidth
+		}
+		list, errs, err := parse(ctx, partnerID, data)
+		if err != nil {
+			return nil, err
+		}
+		split = canonicalSplit(ctx, list, now)
+		for i, err := range errs {
+			if err != nil {
+				split[i].Err = err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unrecognised document format")
+	}
+	for i := range split {
+		split[i].Transaction.Format = format
+	}
+	return split, nil
+}
+
+// Outbound interchange or document for a partner in the format of its
+// profile
+type outboundDocument struct {
+	Data           []byte
+	ContentType    string
+	Control        string // ISA13, UNB0020 or STX sender's reference; empty for formats without an envelope
+	PartnerID      string
+	Number         int64 // control number in the partner's ledger
+	TransactionIDs []string
+}
+
+// Canonical documents only need the partner's inbound map applied
+func canonicalSplit(ctx context.Context, list []Transaction, now time.Time) []splitResult {
+	out := make([]splitResult, len(list))
+	for i, t := range list {
+		t.Date = now
+		err := applyPartnerMap(ctx, "inbound", &t, nil)
+		out[i] = splitResult{Transaction: t, Err: err}
+	}
+	return out
+}
+
+// Canonical XML form: <transaction> or <transactions><transaction>...
+type xmlTransaction struct {
+	PartnerID string    `xml:"partner_id"`
+	ShipTo    string    `xml:"ship_to"`
+	Carrier   string    `xml:"carrier"`
+	BOL       string    `xml:"bol"`
+	Type      string    `xml:"type"`
+	Items     []xmlItem `xml:"items>item"`
+}
+
+type xmlItem struct {
+	SKU         string  `xml:"sku"`
+	Description string  `xml:"description"`
+	Quantity    float64 `xml:"quantity"`
+	UOM         string  `xml:"uom"`
+	PONumber    string  `xml:"po_number"`
+	Carton      string  `xml:"carton"`
+	Weight      float64 `xml:"weight"`
+}
+
+func decodeXMLTransactions(data []byte) ([]Transaction, error) {
+	var doc struct {
+		XMLName xml.Name
+		xmlTransaction
+		Transactions []xmlTransaction `xml:"transaction"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid XML: %w", err)
+	}
+	list := doc.Transactions
+	switch doc.XMLName.Local {
+	case "transaction":
+		list = []xmlTransaction{doc.xmlTransaction}
+	case "transactions":
+	default:
+		return nil, fmt.Errorf("unsupported XML document <%s>", doc.XMLName.Local)
+	}
+	out := make([]Transaction, len(list))
+	for i, x := range list {
+		items := make([]Item, len(x.Items))
+		for j, it := range x.Items {
+			items[j] = Item(it)
+		}
+		t := Transaction{PartnerID: x.PartnerID, ShipTo: x.ShipTo, Carrier: x.Carrier, BOL: x.BOL, Type: x.Type}
+		if len(items) > 0 {
+			b, _ := json.Marshal(items)
+			t.ItemList = string(b)
+		}
+		out[i] = t
+	}
+	return out, nil
+}
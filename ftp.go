@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ftpTimeout = getEnvDuration("FTP_TIMEOUT", 30*time.Second)
+
+// Minimal FTP client for the connectors (RFC 959, with RFC 4217 TLS and
+// RFC 2428 extended passive mode): list, retrieve, delete and rename, over
+// passive data connections only
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+	tls  *tls.Config // nil for plain FTP
+	host string
+}
+
+// Connect and log in. FTPS upgrades with AUTH TLS unless implicit is set, in
+// which case TLS starts on connect (port 990).
+func dialFTP(ctx context.Context, c *Connector) (*ftpConn, error) {
+	addr := c.Address
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "21"
+		if c.ImplicitTLS {
+			port = "990"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	d := net.Dialer{Timeout: ftpTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &ftpConn{conn: conn, host: host}
+	if c.Kind == connectorFTPS {
+		if f.tls, err = ftpTLSConfig(host, c.CACertificate); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := f.login(c); err != nil {
+		f.conn.Close()
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+	return f, nil
+}
+
+func ftpTLSConfig(host, caPEM string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+		// Servers commonly require data connections to resume the control
+		// connection's session
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+	if caPEM != "" {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, errors.New("ca_certificate holds no PEM certificate")
+		}
+	}
+	return cfg, nil
+}
+
+func (f *ftpConn) login(c *Connector) error {
+	f.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if f.tls != nil && c.ImplicitTLS {
+		f.conn = tls.Client(f.conn, f.tls)
+	}
+	f.text = textproto.NewConn(f.conn)
+	if _, _, err := f.text.ReadResponse(220); err != nil {
+		return err
+	}
+	if f.tls != nil && !c.ImplicitTLS {
+		if _, err := f.cmd(234, "AUTH TLS"); err != nil {
+			return err
+		}
+		tc := tls.Client(f.conn, f.tls)
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		f.conn = tc
+		f.text = textproto.NewConn(f.conn)
+	}
+	user := c.Username
+	if user == "" {
+		user = "anonymous"
+	}
+	code, err := f.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, err := f.cmd(230, "PASS %s", c.Password); err != nil {
+			return err
+		}
+	} else if code != 230 {
+		return fmt.Errorf("USER: unexpected reply %d", code)
+	}
+	if f.tls != nil {
+		if _, err := f.cmd(200, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, err := f.cmd(200, "PROT P"); err != nil {
+			return err
+		}
+	}
+	_, err = f.cmd(200, "TYPE I")
+	return err
+}
+
+// Send a command and read its reply, which must have the expected code
+// (or, for a single digit, class); 0 accepts any complete reply
+func (f *ftpConn) cmd(expect int, format string, args ...interface{}) (int, error) {
+	f.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if err := f.text.PrintfLine(format, args...); err != nil {
+		return 0, err
+	}
+	code, _, err := f.text.ReadResponse(expect)
+	if err != nil {
+		verb, _, _ := strings.Cut(format, " ")
+		return code, fmt.Errorf("%s: %w", verb, err)
+	}
+	return code, nil
+}
+
+// Open a passive data connection: EPSV, falling back to PASV
+func (f *ftpConn) dataConn(ctx context.Context) (net.Conn, error) {
+	addr, err := f.epsv()
+	if err != nil {
+		if addr, err = f.pasv(); err != nil {
+			return nil, err
+		}
+	}
+	d := net.Dialer{Timeout: ftpTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if f.tls != nil {
+		return tls.Client(conn, f.tls), nil
+	}
+	return conn, nil
+}
+
+// 229 Entering Extended Passive Mode (|||port|)
+func (f *ftpConn) epsv() (string, error) {
+	f.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if err := f.text.PrintfLine("EPSV"); err != nil {
+		return "", err
+	}
+	_, msg, err := f.text.ReadResponse(229)
+	if err != nil {
+		return "", err
+	}
+	start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+	if start < 0 || end <= start+4 {
+		return "", fmt.Errorf("EPSV: unexpected reply %q", msg)
+	}
+	port, err := strconv.Atoi(msg[start+4 : end])
+	if err != nil {
+		return "", fmt.Errorf("EPSV: unexpected reply %q", msg)
+	}
+	return net.JoinHostPort(f.host, strconv.Itoa(port)), nil
+}
+
+// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2). The address is ignored for
+// the control connection's host, as servers behind NAT report private ones.
+func (f *ftpConn) pasv() (string, error) {
+	f.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if err := f.text.PrintfLine("PASV"); err != nil {
+		return "", err
+	}
+	_, msg, err := f.text.ReadResponse(227)
+	if err != nil {
+		return "", fmt.Errorf("PASV: %w", err)
+	}
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end <= start {
+		return "", fmt.Errorf("PASV: unexpected reply %q", msg)
+	}
+	parts := strings.Split(msg[start+1:end], ",")
+	if len(parts) != 6 {
+		return "", fmt.Errorf("PASV: unexpected reply %q", msg)
+	}
+	hi, err1 := strconv.Atoi(strings.TrimSpace(parts[4]))
+	lo, err2 := strconv.Atoi(strings.TrimSpace(parts[5]))
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("PASV: unexpected reply %q", msg)
+	}
+	return net.JoinHostPort(f.host, strconv.Itoa(hi<<8|lo)), nil
+}
+
+// Run a transfer command and read its data, at most limit bytes
+func (f *ftpConn) transfer(ctx context.Context, limit int64, format string, args ...interface{}) ([]byte, error) {
+	data, err := f.dataConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	if _, err := f.cmd(1, format, args...); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(data, limit+1))
+	data.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, errFileTooLarge
+	}
+	f.conn.SetDeadline(time.Now().Add(ftpTimeout))
+	if _, _, err := f.text.ReadResponse(2); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Names of the entries of a directory
+func (f *ftpConn) list(ctx context.Context, dir string) ([]string, error) {
+	b, err := f.transfer(ctx, inboundMaxBuffered, "NLST %s", dir)
+	var te *textproto.Error
+	if errors.As(err, &te) && te.Code == 450 {
+		return nil, nil // no files
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			names = append(names, path.Base(line))
+		}
+	}
+	return names, nil
+}
+
+func (f *ftpConn) retrieve(ctx context.Context, file string) ([]byte, error) {
+	return f.transfer(ctx, inboundMaxBuffered, "RETR %s", file)
+}
+
+func (f *ftpConn) remove(file string) error {
+	_, err := f.cmd(250, "DELE %s", file)
+	return err
+}
+
+func (f *ftpConn) rename(from, to string) error {
+	if _, err := f.cmd(350, "RNFR %s", from); err != nil {
+		return err
+	}
+	_, err := f.cmd(250, "RNTO %s", to)
+	return err
+}
+
+// Create a directory, ignoring failure as it usually already exists
+func (f *ftpConn) mkdir(dir string) {
+	f.cmd(0, "MKD %s", dir)
+}
+
+func (f *ftpConn) Close() error {
+	f.cmd(0, "QUIT")
+	return f.conn.Close()
+}
@@ -0,0 +1,232 @@
+// gRPC API for internal submitters. It shares the pipeline of POST /inbound
+// and POST /inbound/batch. Regenerate gatewaypb after editing:
+//
+//   protoc --go_out=. --go_opt=module=edi_gateway \
+//     --go-grpc_out=. --go-grpc_opt=module=edi_gateway proto/gateway.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.23.4
+// source: proto/gateway.proto
+
+package gatewaypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Gateway_SubmitTransaction_FullMethodName  = "/edigateway.v1.Gateway/SubmitTransaction"
+	Gateway_SubmitDocument_FullMethodName     = "/edigateway.v1.Gateway/SubmitDocument"
+	Gateway_SubmitTransactions_FullMethodName = "/edigateway.v1.Gateway/SubmitTransactions"
+)
+
+// GatewayClient is the client API for Gateway service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type GatewayClient interface {
+	// Submit one canonical transaction, like a JSON POST /inbound
+	SubmitTransaction(ctx context.Context, in *Transaction, opts ...grpc.CallOption) (*SubmissionResult, error)
+	// Submit one document in any inbound format, like POST /inbound/batch
+	SubmitDocument(ctx context.Context, in *Document, opts ...grpc.CallOption) (*DocumentResult, error)
+	// Submit a stream of transactions; each is processed as it arrives and
+	// the results are returned when the client closes the stream
+	SubmitTransactions(ctx context.Context, opts ...grpc.CallOption) (Gateway_SubmitTransactionsClient, error)
+}
+
+type gatewayClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGatewayClient(cc grpc.ClientConnInterface) GatewayClient {
+	return &gatewayClient{cc}
+}
+
+func (c *gatewayClient) SubmitTransaction(ctx context.Context, in *Transaction, opts ...grpc.CallOption) (*SubmissionResult, error) {
+	out := new(SubmissionResult)
+	err := c.cc.Invoke(ctx, Gateway_SubmitTransaction_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gatewayClient) SubmitDocument(ctx context.Context, in *Document, opts ...grpc.CallOption) (*DocumentResult, error) {
+	out := new(DocumentResult)
+	err := c.cc.Invoke(ctx, Gateway_SubmitDocument_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gatewayClient) SubmitTransactions(ctx context.Context, opts ...grpc.CallOption) (Gateway_SubmitTransactionsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Gateway_ServiceDesc.Streams[0], Gateway_SubmitTransactions_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gatewaySubmitTransactionsClient{stream}
+	return x, nil
+}
+
+type Gateway_SubmitTransactionsClient interface {
+	Send(*Transaction) error
+	CloseAndRecv() (*BulkSubmissionResult, error)
+	grpc.ClientStream
+}
+
+type gatewaySubmitTransactionsClient struct {
+	grpc.ClientStream
+}
+
+func (x *gatewaySubmitTransactionsClient) Send(m *Transaction) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *gatewaySubmitTransactionsClient) CloseAndRecv() (*BulkSubmissionResult, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BulkSubmissionResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GatewayServer is the server API for Gateway service.
+// All implementations must embed UnimplementedGatewayServer
+// for forward compatibility
+type GatewayServer interface {
+	// Submit one canonical transaction, like a JSON POST /inbound
+	SubmitTransaction(context.Context, *Transaction) (*SubmissionResult, error)
+	// Submit one document in any inbound format, like POST /inbound/batch
+	SubmitDocument(context.Context, *Document) (*DocumentResult, error)
+	// Submit a stream of transactions; each is processed as it arrives and
+	// the results are returned when the client closes the stream
+	SubmitTransactions(Gateway_SubmitTransactionsServer) error
+	mustEmbedUnimplementedGatewayServer()
+}
+
+// UnimplementedGatewayServer must be embedded to have forward compatible implementations.
+type UnimplementedGatewayServer struct {
+}
+
+func (UnimplementedGatewayServer) SubmitTransaction(context.Context, *Transaction) (*SubmissionResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitTransaction not implemented")
+}
+func (UnimplementedGatewayServer) SubmitDocument(context.Context, *Document) (*DocumentResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitDocument not implemented")
+}
+func (UnimplementedGatewayServer) SubmitTransactions(Gateway_SubmitTransactionsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubmitTransactions not implemented")
+}
+func (UnimplementedGatewayServer) mustEmbedUnimplementedGatewayServer() {}
+
+// UnsafeGatewayServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GatewayServer will
+// result in compilation errors.
+type UnsafeGatewayServer interface {
+	mustEmbedUnimplementedGatewayServer()
+}
+
+func RegisterGatewayServer(s grpc.ServiceRegistrar, srv GatewayServer) {
+	s.RegisterService(&Gateway_ServiceDesc, srv)
+}
+
+func _Gateway_SubmitTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Transaction)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GatewayServer).SubmitTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gateway_SubmitTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GatewayServer).SubmitTransaction(ctx, req.(*Transaction))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gateway_SubmitDocument_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Document)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GatewayServer).SubmitDocument(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gateway_SubmitDocument_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GatewayServer).SubmitDocument(ctx, req.(*Document))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gateway_SubmitTransactions_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GatewayServer).SubmitTransactions(&gatewaySubmitTransactionsServer{stream})
+}
+
+type Gateway_SubmitTransactionsServer interface {
+	SendAndClose(*BulkSubmissionResult) error
+	Recv() (*Transaction, error)
+	grpc.ServerStream
+}
+
+type gatewaySubmitTransactionsServer struct {
+	grpc.ServerStream
+}
+
+func (x *gatewaySubmitTransactionsServer) SendAndClose(m *BulkSubmissionResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *gatewaySubmitTransactionsServer) Recv() (*Transaction, error) {
+	m := new(Transaction)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Gateway_ServiceDesc is the grpc.ServiceDesc for Gateway service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Gateway_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "edigateway.v1.Gateway",
+	HandlerType: (*GatewayServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitTransaction",
+			Handler:    _Gateway_SubmitTransaction_Handler,
+		},
+		{
+			MethodName: "SubmitDocument",
+			Handler:    _Gateway_SubmitDocument_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubmitTransactions",
+			Handler:       _Gateway_SubmitTransactions_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/gateway.proto",
+}
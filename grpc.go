@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"edi_gateway/gatewaypb"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Address of the gRPC API (proto/gateway.proto); unset disables it
+var grpcAddr = getEnv("GRPC_ADDR", "")
+
+// Serve the Gateway service until the listener fails
+func serveGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	)
+	gatewaypb.RegisterGatewayServer(s, &grpcGateway{})
+	log.Printf("gRPC server listening on %s", addr)
+	return s.Serve(lis)
+}
+
+// Gateway service sharing the pipeline of the HTTP handlers
+type grpcGateway struct {
+	gatewaypb.UnimplementedGatewayServer
+}
+
+func (g *grpcGateway) SubmitTransaction(ctx context.Context, in *gatewaypb.Transaction) (*gatewaypb.SubmissionResult, error) {
+	inboundCounter.WithLabelValues(tenantID(ctx)).Inc()
+	if err := checkUnsignedAllowed(ctx); err != nil {
+		return nil, grpcError(err)
+	}
+	res, err := submitGRPCTransaction(ctx, in)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return res, nil
+}
+
+func (g *grpcGateway) SubmitDocument(ctx context.Context, in *gatewaypb.Document) (*gatewaypb.DocumentResult, error) {
+	inboundCounter.WithLabelValues(tenantID(ctx)).Inc()
+	if err := checkUnsignedAllowed(ctx); err != nil {
+		return nil, grpcError(err)
+	}
+	if len(in.Data) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "document is empty")
+	}
+	if dbBreaker.open() {
+		return nil, grpcError(errDBUnavailable)
+	}
+	out := &gatewaypb.DocumentResult{}
+	for _, res := range processDocument(detach(ctx), nil, in.File, in.ContentType, in.Data) {
+		out.Results = append(out.Results, grpcResult(res))
+	}
+	return out, nil
+}
+
+// Process each streamed transaction as it arrives. A failed transaction is
+// reported in the results and does not end the stream.
+func (g *grpcGateway) SubmitTransactions(stream gatewaypb.Gateway_SubmitTransactionsServer) error {
+	if err := checkUnsignedAllowed(stream.Context()); err != nil {
+		return grpcError(err)
+	}
+	out := &gatewaypb.BulkSubmissionResult{}
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(out)
+		} else if err != nil {
+			return err
+		}
+		inboundCounter.WithLabelValues(tenantID(stream.Context())).Inc()
+		res, err := submitGRPCTransaction(stream.Context(), in)
+		if err != nil {
+			res = &gatewaypb.SubmissionResult{Format: formatGRPC, Type: in.Type, ControlNumber: in.ControlNumber, Status: "failed", Error: status.Convert(grpcError(err)).Message()}
+		}
+		switch res.Status {
+		case "created":
+			out.Created++
+		case "held":
+			out.Held++
+		default:
+			out.Failed++
+		}
+		out.Results = append(out.Results, res)
+	}
+}
+
+// Run one Transaction message through the pipeline, archiving its protobuf
+// encoding as the raw payload
+func submitGRPCTransaction(ctx context.Context, in *gatewaypb.Transaction) (*gatewaypb.SubmissionResult, error) {
+	if dbBreaker.open() {
+		return nil, errDBUnavailable
+	}
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	t, err := transactionFromProto(in)
+	if err != nil {
+		return nil, err
+	}
+	t, err = ingestTransaction(detach(ctx), t, "application/protobuf", body)
+	if err != nil {
+		return nil, err
+	}
+	res := &gatewaypb.SubmissionResult{Format: t.Format, Type: t.Type, ControlNumber: t.ControlNumber,
+		InterchangeControl: t.InterchangeControl, Id: t.ID, Status: "created"}
+	switch t.Status {
+	case statusHeld:
+		res.Status = "held"
+	case statusValidated:
+		res.Status = "validated"
+	}
+	return res, nil
+}
+
+// Canonical transaction of a submitted message; gateway-owned fields are ignored
+func transactionFromProto(in *gatewaypb.Transaction) (Transaction, error) {
+	items := make([]Item, len(in.Items))
+	for i, it := range in.Items {
+		items[i] = Item{SKU: it.Sku, Description: it.Description, Quantity: it.Quantity, UOM: it.Uom,
+			PONumber: it.PoNumber, Carton: it.Carton, Weight: it.Weight}
+	}
+	list, err := json.Marshal(items)
+	if err != nil {
+		return Transaction{}, err
+	}
+	t := Transaction{
+		PartnerID: in.PartnerId, Type: in.Type, ControlNumber: in.ControlNumber,
+		InterchangeControl: in.InterchangeControl, ShipTo: in.ShipTo, Carrier: in.Carrier,
+		BOL: in.Bol, ItemList: string(list), Format: formatGRPC,
+	}
+	if in.Date != nil {
+		t.Date = in.Date.AsTime()
+	}
+	return t, nil
+}
+
+func grpcResult(res batchResult) *gatewaypb.SubmissionResult {
+	return &gatewaypb.SubmissionResult{File: res.File, Format: res.Format, InterchangeControl: res.InterchangeControl,
+		ControlNumber: res.ControlNumber, Type: res.Type, Id: res.ID, Status: res.Status, Error: res.Error}
+}
+
+// Status for a pipeline error, hiding internal details like writeError
+func grpcError(err error) error {
+	if errors.Is(err, errDBUnavailable) {
+		return status.Error(codes.Unavailable, "Database unavailable, retry later")
+	}
+	var he *httpError
+	if !errors.As(err, &he) {
+		log.Printf("ERROR: %v\n", err)
+		return status.Error(codes.Internal, "Internal error")
+	}
+	code := codes.Internal
+	switch he.Status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		code = codes.InvalidArgument
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, he.Message)
+}
+
+// Apply the HTTP middlewares' correlation ID, tenant, partner hint, auditor,
+// rate limit and concurrency cap, reading x-correlation-id, x-tenant-id,
+// x-partner-id, x-actor and x-api-key metadata. Streams hold their slot and count as
+// one request.
+func grpcAdmit(ctx context.Context) (context.Context, func(), error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	id := get("x-correlation-id")
+	if id == "" {
+		id = get("x-request-id")
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-correlation-id", id))
+	ctx = withCorrelationID(ctx, id)
+
+	now := time.Now()
+	partner, apiKey := get("x-partner-id"), get("x-api-key")
+	tenant, err := resolveTenant(get("x-tenant-id"), apiKey)
+	if err != nil {
+		return nil, nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	ctx = withTenant(ctx, tenant)
+	ip := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			ip = host
+		}
+	}
+	key, rate, burst := "ip:"+ip, keyRateLimit, keyRateBurst
+	a := &auditor{actor: "ip:" + ip, ip: ip, endpoint: "grpc", done: true}
+	if apiKey != "" {
+		c := limiter.limitFor(apiKey, now)
+		a.partner, a.apiKey = c.partner, keyFingerprint(apiKey)
+		if c.partner != "" {
+			ctx = withChannel(ctx, channelIdentity{Kind: channelAPIKey, Partner: c.partner})
+			a.actor = "partner:" + c.partner
+			key, rate, burst = "partner:"+c.partner, c.rate, c.burst
+			if partner == "" {
+				partner = c.partner
+			}
+		}
+	}
+	if partner != "" {
+		ctx = withPartnerHint(ctx, partner)
+	}
+	if actor := get("x-actor"); actor != "" {
+		a.actor = actor
+	}
+	ctx = withAuditor(ctx, a)
+	if rate > 0 {
+		if ok, _ := limiter.bucket(key, rate, burst).take(now); !ok {
+			throttledCounter.WithLabelValues("partner", partner).Inc()
+			return nil, nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+		}
+	}
+	if limiter.global != nil {
+		if ok, _ := limiter.global.take(now); !ok {
+			throttledCounter.WithLabelValues("global", partner).Inc()
+			return nil, nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+		}
+	}
+
+	timer := time.NewTimer(requestQueueTimeout)
+	defer timer.Stop()
+	select {
+	case requestSlots <- struct{}{}:
+	case <-timer.C:
+		return nil, nil, status.Error(codes.Unavailable, "Server busy, retry later")
+	case <-ctx.Done():
+		return nil, nil, status.FromContextError(ctx.Err()).Err()
+	}
+	inFlightGauge.WithLabelValues("grpc").Inc()
+	return ctx, func() {
+		inFlightGauge.WithLabelValues("grpc").Dec()
+		<-requestSlots
+	}, nil
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, release, err := grpcAdmit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return handler(ctx, req)
+}
+
+func grpcStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, release, err := grpcAdmit(ss.Context())
+	if err != nil {
+		return err
+	}
+	defer release()
+	return handler(srv, &admittedStream{ss, ctx})
+}
+
+// Server stream carrying the context built by grpcAdmit
+type admittedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *admittedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for partners that do not set their own guardrails; 0 disables a limit
+var (
+	guardrailMaxSize    = int64(getEnvInt("GUARDRAIL_MAX_DOCUMENT_SIZE", 0))
+	guardrailMaxPerHour = getEnvInt("GUARDRAIL_MAX_DOCUMENTS_PER_HOUR", 0)
+	guardrailActionDflt = getEnv("GUARDRAIL_ACTION", guardrailReject)
+)
+
+// What happens to a document over a partner limit
+const (
+	guardrailReject = "reject" // fail it (413 or 429)
+	guardrailQueue  = "queue"  // save it as Held without publishing, for release after review
+	guardrailAlert  = "alert"  // process it and raise an alert
+)
+
+// Status of transactions held by a guardrail
+const statusHeld = "Held"
+
+var guardrailViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "guardrail_violations_total",
+	Help: "Documents over a partner size or volume limit.",
+}, []string{"partner", "limit", "action"})
+
+// Documents seen per partner in the current clock hour
+type volumeWindow struct {
+	start   time.Time
+	count   int
+	alerted map[string]bool // limits already logged this hour
+}
+
+var volumes = struct {
+	mu      sync.Mutex
+	windows map[string]*volumeWindow
+}{windows: map[string]*volumeWindow{}}
+
+// Window for partner's current clock hour, reset when the hour turns.
+// Callers hold volumes.mu.
+func volumeWindowFor(partner string, now time.Time) *volumeWindow {
+	hour := now.Truncate(time.Hour)
+	w, ok := volumes.windows[partner]
+	if !ok || !w.start.Equal(hour) {
+		w = &volumeWindow{start: hour, alerted: map[string]bool{}}
+		volumes.windows[partner] = w
+	}
+	return w
+}
+
+// Count one document for partner and return this hour's total
+func countDocument(partner string, now time.Time) int {
+	volumes.mu.Lock()
+	defer volumes.mu.Unlock()
+	w := volumeWindowFor(partner, now)
+	w.count++
+	return w.count
+}
+
+// Whether limit is hit for the first time this hour, so a flood logs one
+// alert per hour rather than one per document
+func firstViolation(partner, limit string, now time.Time) bool {
+	volumes.mu.Lock()
+	defer volumes.mu.Unlock()
+	w := volumeWindowFor(partner, now)
+	first := !w.alerted[limit]
+	w.alerted[limit] = true
+	return first
+}
+
+func validGuardrailAction(action string) bool {
+	switch action {
+	case "", guardrailReject, guardrailQueue, guardrailAlert:
+		return true
+	}
+	return false
+}
+
+// Check a document of size bytes against its partner's limits. Rejected
+// documents return an *httpError; queued ones are marked Held.
+func applyGuardrails(ctx context.Context, t *Transaction, size int) error {
+	if edgeMode {
+		return nil
+	}
+	p, err := loadPartner(ctx, t.PartnerID)
+	if err != nil {
+		p = Partner{ID: t.PartnerID}
+	}
+	maxSize, maxPerHour, action := p.MaxDocumentSize, p.MaxDocumentsPerHour, p.GuardrailAction
+	if maxSize == 0 {
+		maxSize = guardrailMaxSize
+	}
+	if maxPerHour == 0 {
+		maxPerHour = guardrailMaxPerHour
+	}
+	if action == "" {
+		action = guardrailActionDflt
+	}
+
+	now := time.Now()
+	var violation *httpError
+	limit := ""
+	if n := countDocument(p.ID, now); maxPerHour > 0 && n > maxPerHour {
+		limit = "documents_per_hour"
+		violation = &httpError{Status: http.StatusTooManyRequests, Message: fmt.Sprintf("Partner %s is over its limit of %d documents per hour", p.ID, maxPerHour)}
+	}
+	if maxSize > 0 && int64(size) > maxSize {
+		limit = "document_size"
+		violation = &httpError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Document of %d bytes is over partner %s limit of %d bytes", size, p.ID, maxSize)}
+	}
+	if violation == nil {
+		return nil
+	}
+
+	guardrailViolations.WithLabelValues(p.ID, limit, action).Inc()
+	if firstViolation(p.ID, limit, now) {
+		log.Printf("ALERT: guardrail %s: %s (action %s)", limit, violation.Message, action)
+	}
+	switch action {
+	case guardrailQueue:
+		t.Status, t.HoldReason = statusHeld, "guardrail "+limit+": "+violation.Message
+	case guardrailAlert:
+	default:
+		return violation
+	}
+	return nil
+}
+
+// Publish a partner's held transactions and mark them processed
+func releaseHeldHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var held []Transaction
+	if err := db.WithContext(r.Context()).Where("partner_id = ? AND status = ?", id, statusHeld).Order("date").Find(&held).Error; err != nil {
+		writeProblem(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+	if err := readItems(r.Context(), held); err != nil {
+		writeProblem(w, "Failed to fetch line items", http.StatusInternalServerError)
+		return
+	}
+	released := 0
+	for _, t := range held {
+		t.Status = "Processed"
+		if err := releaseHeld(detachedContext(r), &t, nil); err != nil {
+			log.Printf("ERROR: release %s: %v\n", t.ID, err)
+			writeProblem(w, fmt.Sprintf("Released %d of %d held transactions: %v", released, len(held), err), http.StatusInternalServerError)
+			return
+		}
+		auditChange(r.Context(), auditRelease, "transaction", t.ID, map[string]string{"status": statusHeld}, map[string]string{"status": t.Status})
+		released++
+	}
+	fmt.Fprintf(w, "Released %d held transactions for partner %s\n", released, id)
+}
+
+// Record a held transaction's release and publish it; delta is what the
+// released event adds
+func releaseHeld(ctx context.Context, t *Transaction, delta map[string]interface{}) error {
+	if err := recordTransactionEvent(ctx, t.ID, txEventReleased, t.Status, delta); err != nil {
+		return fmt.Errorf("%w: %w", errSaveFailed, err)
+	}
+	projectTransaction(ctx, *t)
+	if err := publishTransaction(ctx, eventTransactionCreated, *t); err != nil {
+		return fmt.Errorf("%w: %w", errPublishFailed, err)
+	}
+	return nil
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SNIP validation levels of HIPAA transaction sets; each level includes the
+// ones below it
+const (
+	snipIntegrity   = 1 // X12 syntax: valid segments, element presence, length and type
+	snipRequirement = 2 // implementation guide: loops, required segments, usage limits and codes
+	snipBalancing   = 3 // amounts balance: claim lines, remittance claims and the payment
+)
+
+// Level HIPAA sets are validated to unless their partner sets snip_level
+var hipaaSNIPLevel = getEnvInt("HIPAA_SNIP_LEVEL", snipRequirement)
+
+// Findings recorded for one set at most; validation stops after
+const maxSNIPFindings = 100
+
+// One problem SNIP validation found. Findings name segments, elements and
+// loops but never carry element values, which may be PHI.
+type snipFinding struct {
+	Level    int    `json:"level"`
+	Position int    `json:"position"` // of the segment in the set, ST being 1
+	Segment  string `json:"segment"`
+	Loop     string `json:"loop,omitempty"`
+	Element  int    `json:"element,omitempty"`
+	Code     string `json:"code"` // IK403 code for element errors, else IK304
+	Message  string `json:"message"`
+}
+
+// A HIPAA transaction set that failed SNIP validation
+type snipError struct {
+	Level    int
+	Findings []snipFinding
+}
+
+func (e *snipError) Error() string {
+	f := e.Findings[0]
+	where := fmt.Sprintf("segment %d", f.Position)
+	if f.Loop != "" {
+		where += " in loop " + f.Loop
+	}
+	msg := fmt.Sprintf("SNIP level %d validation failed at %s: %s", e.Level, where, f.Message)
+	if len(e.Findings) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Findings)-1)
+	}
+	return msg
+}
+
+// Findings of a SNIP validation error, if err is one
+func snipFindings(err error) []snipFinding {
+	var se *snipError
+	if errors.As(err, &se) {
+		return se.Findings
+	}
+	return nil
+}
+
+// An implementation guide the validator knows, found by ST03
+type hipaaGuide struct {
+	Type      string // ST01
+	Version   string // ST03, also GS08
+	Structure string // BHT01, "" for sets without BHT
+	Purposes  []string
+	Root      *hipaaLoop
+}
+
+// A loop of an implementation guide, started by its trigger segment. The
+// trigger is matched on a qualifier element when Element is set.
+type hipaaLoop struct {
+	ID       string
+	Trigger  string
+	Element  int
+	Codes    []string
+	Required bool
+	Max      int // occurrences within the parent loop; 0 is unbounded
+	Wrapped  bool
+	Segments []hipaaSegment
+	Loops    []*hipaaLoop
+}
+
+// Use of a segment within a loop, the trigger excepted
+type hipaaSegment struct {
+	ID       string
+	Required bool
+	Max      int
+}
+
+// Parse an ID with usage, as in "2010AA!/1": ! marks it required and /n
+// caps its occurrences
+func parseUsage(token string) (id string, required bool, max int) {
+	id, limit, _ := strings.Cut(token, "/")
+	if strings.HasSuffix(id, "!") {
+		id, required = strings.TrimSuffix(id, "!"), true
+	}
+	max, _ = strconv.Atoi(limit)
+	return id, required, max
+}
+
+// Build a loop from its ID and usage, its trigger with an optional
+// qualifier such as "NM1*1=85,87", the other segments it holds and its
+// child loops
+func loop(id, trigger, segments string, loops ...*hipaaLoop) *hipaaLoop {
+	l := &hipaaLoop{Loops: loops}
+	l.ID, l.Required, l.Max = parseUsage(id)
+	if strings.HasPrefix(l.ID, "~") {
+		l.ID, l.Wrapped = l.ID[1:], true
+	}
+	l.Trigger = trigger
+	if seg, qualifier, ok := strings.Cut(trigger, "*"); ok {
+		element, codes, _ := strings.Cut(qualifier, "=")
+		l.Trigger, l.Codes = seg, strings.Split(codes, ",")
+		l.Element, _ = strconv.Atoi(element)
+	}
+	for _, token := range strings.Fields(segments) {
+		var s hipaaSegment
+		s.ID, s.Required, s.Max = parseUsage(token)
+		l.Segments = append(l.Segments, s)
+	}
+	return l
+}
+
+// Child loop seg starts, if any. Wrapped loops only start between LS and LE.
+func (l *hipaaLoop) child(seg Segment, wrapped bool) *hipaaLoop {
+	for _, c := range l.Loops {
+		if c.Trigger != seg[0] || (c.Wrapped && !wrapped) {
+			continue
+		}
+		if c.Element == 0 || contains(c.Codes, seg.el(c.Element)) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (l *hipaaLoop) segment(id string) *hipaaSegment {
+	for i := range l.Segments {
+		if l.Segments[i].ID == id {
+			return &l.Segments[i]
+		}
+	}
+	return nil
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Billing provider, subscriber and patient levels of an 837, around its claim
+func header837(claim *hipaaLoop, subscriber string) *hipaaLoop {
+	patient := loop("2000C", "HL*3=23", "PAT!/1",
+		loop("2010CA!/1", "NM1*1=QC", "N3!/1 N4!/1 DMG!/1 REF/2 PER/1"),
+		claim)
+	return loop("", "ST", "BHT!/1",
+		loop("1000A!/1", "NM1*1=41", "PER!/2"),
+		loop("1000B!/1", "NM1*1=40", ""),
+		loop("2000A!", "HL*3=20", "PRV/1 CUR/1",
+			loop("2010AA!/1", "NM1*1=85", "N3!/1 N4!/1 REF/2 PER/2"),
+			loop("2010AB/1", "NM1*1=87", "N3!/1 N4!/1"),
+			loop("2010AC/1", "NM1*1=PE", "N3/1 N4/1 REF/2"),
+			loop("2000B!", "HL*3=22", subscriber,
+				loop("2010BA!/1", "NM1*1=IL", "N3/1 N4/1 DMG/1 REF/2 PER/1"),
+				loop("2010BB!/1", "NM1*1=PR", "N3/1 N4/1 REF/5"),
+				claim, patient)))
+}
+
+// Other subscriber loop of an 837 claim, with the other payer's providers
+func otherSubscriber837(segments string, providers ...*hipaaLoop) *hipaaLoop {
+	loops := append([]*hipaaLoop{
+		loop("2330A!/1", "NM1*1=IL", "N3/1 N4/1 REF/1"),
+		loop("2330B!/1", "NM1*1=PR", "N3/1 N4/1 DTP/1 REF/6"),
+	}, providers...)
+	return loop("2320/10", "SBR", segments, loops...)
+}
+
+var guide837P = header837(loop("2300/100", "CLM", "DTP/20 PWK/10 CN1/1 AMT/1 REF/14 K3/10 NTE/1 CR1/1 CR2/1 CRC/8 HI!/4 HCP/1",
+	loop("2310A/1", "NM1*1=DN,P3", "REF/3"),
+	loop("2310B/1", "NM1*1=82", "PRV/1 REF/4"),
+	loop("2310C/1", "NM1*1=77", "N3!/1 N4!/1 REF/3 PER/1"),
+	loop("2310D/1", "NM1*1=DQ", "REF/3"),
+	loop("2310E/1", "NM1*1=PW", "N3!/1 N4!/1"),
+	loop("2310F/1", "NM1*1=45", "N3!/1 N4!/1"),
+	otherSubscriber837("CAS/5 AMT/3 OI!/1 MOA/1",
+		loop("2330C/1", "NM1*1=DN,P3", "REF/3"),
+		loop("2330D/1", "NM1*1=82", "REF/3"),
+		loop("2330E/1", "NM1*1=77", "REF/3"),
+		loop("2330F/1", "NM1*1=DQ", "REF/3"),
+		loop("2330G/1", "NM1*1=85", "REF/2")),
+	loop("2400!/50", "LX", "SV1!/1 SV5/1 PWK/10 CR1/1 CR3/1 CRC/3 DTP/10 QTY/2 MEA/5 CN1/1 REF/17 AMT/2 K3/10 NTE/2 PS1/1 HCP/1",
+		loop("2410/1", "LIN", "CTP!/1 REF/1"),
+		loop("2420A/1", "NM1*1=82", "PRV/1 REF/20"),
+		loop("2420B/1", "NM1*1=QB", "REF/20"),
+		loop("2420C/1", "NM1*1=77", "N3!/1 N4!/1 REF/3"),
+		loop("2420D/1", "NM1*1=DQ", "REF/20"),
+		loop("2420E/1", "NM1*1=DK", "N3/1 N4/1 REF/20 PER/1"),
+		loop("2420F/2", "NM1*1=DN,P3", "REF/20"),
+		loop("2420G/1", "NM1*1=PW", "N3!/1 N4!/1"),
+		loop("2420H/1", "NM1*1=45", "N3!/1 N4!/1"),
+		loop("2430/15", "SVD", "CAS/5 DTP!/1 AMT/1"),
+		loop("2440/10", "LQ", "FRM!/99"))), "SBR!/1 PAT/1")
+
+var guide837I = header837(loop("2300/100", "CLM", "DTP!/10 CL1!/1 PWK/10 CN1/1 AMT/1 REF/15 K3/10 NTE/11 CRC/1 HI!/25 HCP/1",
+	loop("2310A/1", "NM1*1=71", "PRV/1 REF/4"),
+	loop("2310B/1", "NM1*1=72", "REF/4"),
+	loop("2310C/1", "NM1*1=ZZ", "REF/4"),
+	loop("2310D/1", "NM1*1=82", "REF/4"),
+	loop("2310E/1", "NM1*1=77", "N3!/1 N4!/1 REF/3"),
+	loop("2310F/1", "NM1*1=DN", "REF/3"),
+	otherSubscriber837("CAS/5 AMT/3 OI/1 MIA/1 MOA/1",
+		loop("2330C/1", "NM1*1=71", "REF/3"),
+		loop("2330D/1", "NM1*1=72", "REF/3"),
+		loop("2330E/1", "NM1*1=ZZ", "REF/3"),
+		loop("2330F/1", "NM1*1=77", "REF/3"),
+		loop("2330G/1", "NM1*1=82", "REF/3"),
+		loop("2330H/1", "NM1*1=DN", "REF/3"),
+		loop("2330I/1", "NM1*1=85", "REF/2")),
+	loop("2400!/999", "LX", "SV2!/1 PWK/1 DTP/1 AMT/2 HCP/1 REF/1 NTE/1",
+		loop("2410/1", "LIN", "CTP!/1 REF/1"),
+		loop("2420A/1", "NM1*1=72", "REF/20"),
+		loop("2420B/1", "NM1*1=ZZ", "REF/20"),
+		loop("2420C/1", "NM1*1=82", "REF/20"),
+		loop("2420D/1", "NM1*1=DN", "REF/20"),
+		loop("2430/15", "SVD", "CAS/5 DTP!/1 AMT/1"))), "SBR!/1")
+
+var guide837D = header837(loop("2300/100", "CLM", "DTP/10 DN1/1 DN2/35 PWK/10 CN1/1 AMT/1 REF/5 NTE/1 HI/2 HCP/1",
+	loop("2310A/2", "NM1*1=DN,P3", "REF/3"),
+	loop("2310B/1", "NM1*1=82", "PRV/1 REF/4"),
+	loop("2310C/1", "NM1*1=77", "N3!/1 N4!/1 REF/3"),
+	loop("2310D/1", "NM1*1=DD", "PRV/1 REF/4"),
+	loop("2310E/1", "NM1*1=DQ", "REF/4"),
+	otherSubscriber837("CAS/5 AMT/3 OI!/1 MOA/1",
+		loop("2330C/2", "NM1*1=DN,P3", "REF/3"),
+		loop("2330D/1", "NM1*1=82", "REF/3"),
+		loop("2330E/1", "NM1*1=DQ", "REF/3"),
+		loop("2330F/1", "NM1*1=DD", "REF/3"),
+		loop("2330G/1", "NM1*1=77", "REF/3"),
+		loop("2330H/1", "NM1*1=85", "REF/2")),
+	loop("2400!/50", "LX", "SV3!/1 TOO/32 DTP/3 QTY/5 REF/6 AMT/2 NTE/1 HCP/1",
+		loop("2420A/1", "NM1*1=82", "PRV/1 REF/20"),
+		loop("2420B/1", "NM1*1=DD", "PRV/1 REF/20"),
+		loop("2420C/1", "NM1*1=DQ", "REF/20"),
+		loop("2420D/1", "NM1*1=77", "N3!/1 N4!/1 REF/3"),
+		loop("2430/15", "SVD", "CAS/5 DTP!/1"))), "SBR!/1")
+
+var guide835 = loop("", "ST", "BPR!/1 TRN!/1 CUR/1 REF/2 DTM/1 PLB",
+	loop("1000A!/1", "N1*1=PR", "N3!/1 N4!/1 REF/4 PER/3"),
+	loop("1000B!/1", "N1*1=PE", "N3/1 N4/1 REF/3 RDM/1"),
+	loop("2000", "LX", "TS3/1 TS2/1",
+		loop("2100!", "CLP", "CAS/99 NM1!/9 MIA/1 MOA/1 REF/15 DTM/4 PER/2 AMT/13 QTY/14",
+			loop("2110/999", "SVC", "DTM/2 CAS/99 REF/16 AMT/9 QTY/8 LQ/99"))))
+
+var guide270 = loop("", "ST", "BHT!/1",
+	loop("2000A!", "HL*3=20", "",
+		loop("2100A!/1", "NM1", ""),
+		loop("2000B!", "HL*3=21", "",
+			loop("2100B!/1", "NM1", "REF/9 N3/1 N4/1 PRV/1"),
+			loop("2000C!", "HL*3=22", "TRN/2",
+				loop("2100C!/1", "NM1", "REF/9 N3/1 N4/1 PRV/1 DMG/1 INS/1 HI/1 DTP/2",
+					loop("2110C/99", "EQ", "AMT/2 III/1 REF/1 DTP/1")),
+				loop("2000D", "HL*3=23", "TRN/2",
+					loop("2100D!/1", "NM1", "REF/9 N3/1 N4/1 PRV/1 DMG/1 INS/1 HI/1 DTP/2",
+						loop("2110D/99", "EQ", "III/1 REF/1 DTP/1")))))))
+
+// Benefit loop of a 271 subscriber or dependent, with the benefit related
+// entities between LS and LE
+func benefits271(id string) *hipaaLoop {
+	return loop("2110"+id+"/99", "EB", "HSD/9 REF/9 DTP/20 AAA/9 MSG/10 LS/1 LE/1",
+		loop("2115"+id+"/10", "III", ""),
+		loop("~2120"+id+"/23", "NM1", "N3/1 N4/1 PER/3 PRV/1"))
+}
+
+var guide271 = loop("", "ST", "BHT!/1",
+	loop("2000A!", "HL*3=20", "AAA/9",
+		loop("2100A!/1", "NM1", "PER/3 AAA/9"),
+		loop("2000B", "HL*3=21", "",
+			loop("2100B!/1", "NM1", "REF/9 AAA/9 PRV/1"),
+			loop("2000C", "HL*3=22", "TRN/3",
+				loop("2100C!/1", "NM1", "REF/9 N3/1 N4/1 AAA/9 PRV/1 DMG/1 INS/1 HI/1 DTP/9 MPI/1", benefits271("C")),
+				loop("2000D", "HL*3=23", "TRN/3",
+					loop("2100D!/1", "NM1", "REF/9 N3/1 N4/1 AAA/9 PRV/1 DMG/1 INS/1 HI/1 DTP/9 MPI/1", benefits271("D")))))))
+
+// The 005010 implementation guides HIPAA sets are validated against
+var hipaaGuides = []hipaaGuide{
+	{Type: "837", Version: "005010X222A1", Structure: "0019", Purposes: []string{"00", "18"}, Root: guide837P},
+	{Type: "837", Version: "005010X223A2", Structure: "0019", Purposes: []string{"00", "18"}, Root: guide837I},
+	{Type: "837", Version: "005010X224A2", Structure: "0019", Purposes: []string{"00", "18"}, Root: guide837D},
+	{Type: "835", Version: "005010X221A1", Root: guide835},
+	{Type: "270", Version: "005010X279A1", Structure: "0022", Purposes: []string{"01", "13"}, Root: guide270},
+	{Type: "271", Version: "005010X279A1", Structure: "0022", Purposes: []string{"06", "11"}, Root: guide271},
+}
+
+// Whether sets of a type are HIPAA transactions
+func hipaaSet(setType string) bool {
+	for _, g := range hipaaGuides {
+		if g.Type == setType {
+			return true
+		}
+	}
+	return false
+}
+
+func hipaaGuideFor(setType, version string) *hipaaGuide {
+	for i, g := range hipaaGuides {
+		if g.Type == setType && g.Version == version {
+			return &hipaaGuides[i]
+		}
+	}
+	return nil
+}
+
+// Level a partner's HIPAA sets are validated to; 0 for none
+func snipLevel(ctx context.Context, partnerID string) int {
+	level := hipaaSNIPLevel
+	if db != nil && partnerID != "" {
+		if p, err := loadPartner(ctx, partnerID); err == nil && p.SNIPLevel != 0 {
+			level = p.SNIPLevel
+		}
+	}
+	if level < 0 {
+		return 0
+	}
+	if level > snipBalancing {
+		return snipBalancing
+	}
+	return level
+}
+
+// Validate a HIPAA transaction set to its partner's SNIP level
+func validateHIPAA(ctx context.Context, ic X12Interchange, set X12Set, partnerID string) error {
+	level := snipLevel(ctx, partnerID)
+	if level == 0 {
+		return nil
+	}
+	if findings := checkHIPAASet(set, ic.Delimiters, level); len(findings) > 0 {
+		return &snipError{Level: level, Findings: findings}
+	}
+	return nil
+}
+
+// Position reached in the loops of a set being validated
+type hipaaNode struct {
+	loop     *hipaaLoop
+	parent   *hipaaNode
+	start    int            // position of the trigger
+	segments map[string]int // uses of each segment
+	loops    map[string]int // occurrences of each child loop
+	hl       Segment        // the HL of a hierarchical level
+	children bool           // has subordinate levels
+}
+
+// State of one set's validation
+type snipCheck struct {
+	level    int
+	guide    *hipaaGuide
+	cur      *hipaaNode
+	findings []snipFinding
+	hls      int    // HL segments seen
+	ls       string // LS01 of the open LS, if any
+
+	// Balancing state: the open 837 claim, and the open 835 claim and service
+	claimPos, servicePos                    int
+	claimCharge, lineCharges                int64
+	claimPaid, claimAdjusted                int64
+	serviceCharge, servicePaid, serviceAdj  int64
+	paymentPos                              int
+	payment, claimPayments, providerAdjusts int64
+}
+
+func (c *snipCheck) add(level, pos int, segment string, element int, code, message string) {
+	if level > c.level || len(c.findings) >= maxSNIPFindings {
+		return
+	}
+	f := snipFinding{Level: level, Position: pos, Segment: segment, Element: element, Code: code, Message: message}
+	if c.cur != nil {
+		f.Loop = c.cur.loop.ID
+	}
+	c.findings = append(c.findings, f)
+}
+
+// Findings of a HIPAA set validated up to level
+func checkHIPAASet(set X12Set, d X12Delimiters, level int) []snipFinding {
+	c := &snipCheck{level: level}
+	st := set.Segments[0]
+	version := st.el(3)
+	if version == "" {
+		version = set.Version
+	}
+	if c.guide = hipaaGuideFor(set.Type(), version); c.guide != nil {
+		c.cur = &hipaaNode{loop: c.guide.Root, start: 1, segments: map[string]int{}, loops: map[string]int{}}
+	}
+	last := len(set.Segments) - 1
+	for i, seg := range set.Segments {
+		pos := i + 1
+		if _, ok := x12Segments[seg[0]]; !ok {
+			c.add(snipIntegrity, pos, seg[0], 0, ik3Unrecognized, "segment "+seg[0]+" is not defined")
+			continue
+		}
+		if c.guide != nil && i > 0 && i < last {
+			c.place(seg, pos)
+			c.checkCodes(seg, pos)
+			if level >= snipBalancing {
+				c.balance(seg, pos)
+			}
+		}
+		checkSegmentSyntax(seg, d, func(element int, code, message string) {
+			c.add(snipIntegrity, pos, seg[0], element, code, fmt.Sprintf("%s%02d %s", seg[0], element, message))
+		})
+	}
+	if c.guide == nil {
+		c.add(snipRequirement, 1, "ST", 3, ik4InvalidCode, fmt.Sprintf("ST03 must name a supported implementation guide for %s", set.Type()))
+		return c.findings
+	}
+	for c.cur != nil {
+		c.close(c.cur, last+1)
+		c.cur = c.cur.parent
+	}
+	if level >= snipBalancing {
+		c.balance(Segment{"SE"}, last+1)
+	}
+	sort.SliceStable(c.findings, func(i, j int) bool { return c.findings[i].Position < c.findings[j].Position })
+	return c.findings
+}
+
+// Find the loop seg belongs to: the innermost open loop, or one of its
+// ancestors, that either holds the segment or starts a child loop with it.
+// Loops left behind are closed.
+func (c *snipCheck) place(seg Segment, pos int) {
+	for n := c.cur; n != nil; n = n.parent {
+		if child := n.loop.child(seg, c.ls != ""); child != nil {
+			c.leave(n, pos)
+			n.loops[child.ID]++
+			node := &hipaaNode{loop: child, parent: n, start: pos, segments: map[string]int{}, loops: map[string]int{}}
+			c.cur = node
+			if child.Max > 0 && n.loops[child.ID] > child.Max {
+				c.add(snipRequirement, pos, seg[0], 0, ik3LoopOverMax, fmt.Sprintf("loop %s occurs more than %d times", child.ID, child.Max))
+			}
+			if seg[0] == "HL" {
+				c.enterLevel(node, seg, pos)
+			}
+			return
+		}
+		if s := n.loop.segment(seg[0]); s != nil {
+			c.leave(n, pos)
+			n.segments[s.ID]++
+			if s.Max > 0 && n.segments[s.ID] > s.Max {
+				c.add(snipRequirement, pos, seg[0], 0, ik3SegmentOverMax, fmt.Sprintf("segment %s occurs more than %d times", s.ID, s.Max))
+			}
+			return
+		}
+	}
+	c.add(snipRequirement, pos, seg[0], 0, ik3Unexpected, "segment "+seg[0]+" is not allowed here")
+}
+
+// Close the open loops below n
+func (c *snipCheck) leave(n *hipaaNode, pos int) {
+	for c.cur != n {
+		c.close(c.cur, pos)
+		c.cur = c.cur.parent
+	}
+}
+
+// Report what a loop being closed lacks
+func (c *snipCheck) close(n *hipaaNode, pos int) {
+	for _, s := range n.loop.Segments {
+		if s.Required && n.segments[s.ID] == 0 {
+			c.add(snipRequirement, pos, s.ID, 0, ik3MissingSegment, fmt.Sprintf("required segment %s is missing from loop %s", s.ID, loopName(n.loop)))
+		}
+	}
+	for _, l := range n.loop.Loops {
+		if l.Required && n.loops[l.ID] == 0 {
+			c.add(snipRequirement, pos, l.Trigger, 0, ik3LoopUnderMin, fmt.Sprintf("required loop %s is missing from loop %s", l.ID, loopName(n.loop)))
+		}
+	}
+	if n.hl != nil {
+		want, message := "0", "HL04 must be 0 as the level has no subordinate levels"
+		if n.children {
+			want, message = "1", "HL04 must be 1 as the level has subordinate levels"
+		}
+		if code := n.hl.el(4); code != "" && code != want {
+			c.add(snipRequirement, n.start, "HL", 4, ik4InvalidCode, message)
+		}
+	}
+}
+
+func loopName(l *hipaaLoop) string {
+	if l.ID == "" {
+		return "header"
+	}
+	return l.ID
+}
+
+// Check the numbering of a new hierarchical level and its parent
+func (c *snipCheck) enterLevel(n *hipaaNode, seg Segment, pos int) {
+	c.hls++
+	n.hl = seg
+	if seg.el(1) != strconv.Itoa(c.hls) {
+		c.add(snipRequirement, pos, "HL", 1, ik4InvalidCode, "HL01 must number the levels 1, 2, 3 and so on")
+	}
+	parent := ""
+	for p := n.parent; p != nil; p = p.parent {
+		if p.hl != nil {
+			parent, p.children = p.hl.el(1), true
+			break
+		}
+	}
+	if seg.el(2) != parent {
+		c.add(snipRequirement, pos, "HL", 2, ik4InvalidCode, "HL02 must be the HL01 of the parent level")
+	}
+}
+
+// Check the codes the implementation guides restrict
+func (c *snipCheck) checkCodes(seg Segment, pos int) {
+	switch seg[0] {
+	case "BHT":
+		if c.guide.Structure != "" && seg.el(1) != c.guide.Structure {
+			c.add(snipRequirement, pos, "BHT", 1, ik4InvalidCode, "BHT01 must be "+c.guide.Structure)
+		}
+		if len(c.guide.Purposes) > 0 && !contains(c.guide.Purposes, seg.el(2)) {
+			c.add(snipRequirement, pos, "BHT", 2, ik4InvalidCode, "BHT02 must be "+strings.Join(c.guide.Purposes, " or "))
+		}
+	case "NM1":
+		if v := seg.el(2); v != "1" && v != "2" {
+			c.add(snipRequirement, pos, "NM1", 2, ik4InvalidCode, "NM102 must be 1 (person) or 2 (non-person entity)")
+		}
+	case "DTP":
+		if !validDatePeriod(seg.el(2), seg.el(3)) {
+			c.add(snipRequirement, pos, "DTP", 3, ik4InvalidDate, "DTP03 must be a date in the DTP02 format")
+		}
+	case "LS":
+		c.ls = seg.el(1)
+	case "LE":
+		if c.ls == "" || seg.el(1) != c.ls {
+			c.add(snipRequirement, pos, "LE", 1, ik4InvalidCode, "LE01 must close an open LS with the same loop identifier")
+		}
+		c.ls = ""
+	}
+}
+
+// Whether a DTP date is in its format D8 (CCYYMMDD) or RD8
+// (CCYYMMDD-CCYYMMDD); other formats are not checked
+func validDatePeriod(format, v string) bool {
+	date := x12Element{Type: "DT", Min: 8, Max: 8}
+	switch format {
+	case "D8":
+		code, _ := checkElement(date, v)
+		return code == "" && len(v) == 8
+	case "RD8":
+		from, to, ok := strings.Cut(v, "-")
+		return ok && validDatePeriod("D8", from) && validDatePeriod("D8", to) && from <= to
+	}
+	return true
+}
+
+// Amount of an R element in cents
+func cents(v string) int64 {
+	f, _ := strconv.ParseFloat(v, 64)
+	return int64(math.Round(f * 100))
+}
+
+// Adjustment amounts of a CAS segment, in CAS03, CAS06 .. CAS18
+func casTotal(seg Segment) int64 {
+	var total int64
+	for i := 3; i <= 18; i += 3 {
+		total += cents(seg.el(i))
+	}
+	return total
+}
+
+// Check the balancing rules (SNIP level 3) as the segments go by: 837 claim
+// charges are the sum of their service lines; in an 835 every service pays
+// its charge less its adjustments, every claim its charge less the claim and
+// service adjustments, and BPR02 is the sum of the claim payments less the
+// provider level adjustments in PLB.
+func (c *snipCheck) balance(seg Segment, pos int) {
+	loop := ""
+	if c.cur != nil {
+		loop = c.cur.loop.ID
+	}
+	switch seg[0] {
+	case "SVC", "CLP", "LX", "PLB", "SE":
+		c.closeService()
+	}
+	switch seg[0] {
+	case "CLM", "HL", "CLP", "PLB", "SE":
+		c.closeClaim()
+	case "LX": // starts a service line in an 837
+		if c.guide.Type == "835" {
+			c.closeClaim()
+		}
+	}
+	switch seg[0] {
+	case "CLM":
+		c.claimPos, c.claimCharge, c.lineCharges = pos, cents(seg.el(2)), 0
+	case "SV1", "SV3":
+		c.lineCharges += cents(seg.el(2))
+	case "SV2":
+		c.lineCharges += cents(seg.el(3))
+	case "BPR":
+		c.paymentPos, c.payment = pos, cents(seg.el(2))
+	case "CLP":
+		c.claimPos, c.claimCharge, c.claimPaid, c.claimAdjusted = pos, cents(seg.el(3)), cents(seg.el(4)), 0
+		c.claimPayments += c.claimPaid
+	case "SVC":
+		c.servicePos, c.serviceCharge, c.servicePaid, c.serviceAdj = pos, cents(seg.el(2)), cents(seg.el(3)), 0
+	case "CAS":
+		if loop == "2110" {
+			c.serviceAdj += casTotal(seg)
+		}
+		if loop == "2100" || loop == "2110" {
+			c.claimAdjusted += casTotal(seg)
+		}
+	case "PLB":
+		for i := 4; i <= 14; i += 2 {
+			c.providerAdjusts += cents(seg.el(i))
+		}
+	case "SE":
+		if c.paymentPos > 0 && c.payment != c.claimPayments-c.providerAdjusts {
+			c.addAt(c.paymentPos, "BPR", "", 2, "BPR02 does not equal the claim payments less the provider adjustments")
+		}
+	}
+}
+
+func (c *snipCheck) closeService() {
+	if c.servicePos == 0 {
+		return
+	}
+	if c.serviceCharge-c.serviceAdj != c.servicePaid {
+		c.addAt(c.servicePos, "SVC", "2110", 3, "SVC03 does not equal SVC02 less the service adjustments")
+	}
+	c.servicePos = 0
+}
+
+func (c *snipCheck) closeClaim() {
+	if c.claimPos == 0 {
+		return
+	}
+	if c.guide.Type == "837" && c.claimCharge != c.lineCharges {
+		c.addAt(c.claimPos, "CLM", "2300", 2, "CLM02 does not equal the sum of the service line charges")
+	}
+	if c.guide.Type == "835" && c.claimCharge-c.claimAdjusted != c.claimPaid {
+		c.addAt(c.claimPos, "CLP", "2100", 4, "CLP04 does not equal CLP03 less the claim and service adjustments")
+	}
+	c.claimPos = 0
+}
+
+// Record a balancing finding against an earlier segment
+func (c *snipCheck) addAt(pos int, segment, loop string, element int, message string) {
+	if len(c.findings) >= maxSNIPFindings {
+		return
+	}
+	c.findings = append(c.findings, snipFinding{Level: snipBalancing, Position: pos, Segment: segment, Loop: loop,
+		Element: element, Code: ik4PatternFailure, Message: message})
+}
+
+// Component j (1-based) of a composite element value
+func component(v string, sep byte, j int) string {
+	parts := strings.Split(v, string(sep))
+	if j <= len(parts) {
+		return parts[j-1]
+	}
+	return ""
+}
+
+// Reference and service lines of a HIPAA set: the BHT or TRN reference and
+// the procedure codes with their units. Patient and subscriber names, IDs,
+// account numbers and diagnoses are not copied out of the interchange.
+func translateHIPAASet(t *Transaction, set X12Set, d X12Delimiters) []Item {
+	var items []Item
+	for _, seg := range set.Segments {
+		switch seg[0] {
+		case "BHT": // 837, 270 and 271 originator reference
+			t.refs.Number = seg.el(3)
+		case "TRN": // 835 check or EFT trace number
+			if t.refs.Number == "" {
+				t.refs.Number = seg.el(2)
+			}
+		case "SV1": // professional and dental service lines
+			items = append(items, Item{SKU: component(seg.el(1), d.Component, 2), Quantity: parseQty(seg.el(4)), UOM: seg.el(3)})
+		case "SV3":
+			units := parseQty(seg.el(6))
+			if units == 0 {
+				units = 1
+			}
+			items = append(items, Item{SKU: component(seg.el(1), d.Component, 2), Quantity: units, UOM: "UN"})
+		case "SV2": // institutional lines: the procedure, else the revenue code
+			sku := component(seg.el(2), d.Component, 2)
+			if sku == "" {
+				sku = seg.el(1)
+			}
+			items = append(items, Item{SKU: sku, Quantity: parseQty(seg.el(5)), UOM: seg.el(4)})
+		case "SVC": // 835 paid service
+			items = append(items, Item{SKU: component(seg.el(1), d.Component, 2), Quantity: parseQty(seg.el(5)), UOM: "UN"})
+		}
+	}
+	return items
+}
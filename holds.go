@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Held transactions wait for review: a guardrail, the sender check or a
+// document rule saved them Held without publishing them. A reviewer
+// approves one, which resumes its pipeline, or rejects it, which
+// acknowledges its set as rejected and announces the rejection. Only actors
+// in HOLD_REVIEWERS may decide when it is set; partner API keys never may.
+var holdReviewers = splitList(getEnv("HOLD_REVIEWERS", ""))
+
+const auditReject = "reject"
+
+var holdDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_hold_decisions_total",
+	Help: "Held transactions approved or rejected in review.",
+}, []string{"tenant", "decision"})
+
+// Reason a reviewer gives for a decision
+type holdDecision struct {
+	Reason string `json:"reason"`
+}
+
+// Outcome of a rejection, with the acknowledgment rejecting an X12 set
+type holdRejection struct {
+	Transaction     Transaction `json:"transaction"`
+	Acknowledgment  string      `json:"acknowledgment,omitempty"` // 997 or 999, also archived as the outbound payload
+	AcknowledgedSet string      `json:"acknowledged_set,omitempty"`
+}
+
+// Whether the actor of ctx may decide on held transactions
+func holdReviewer(ctx context.Context) error {
+	a := auditorFrom(ctx)
+	if a.partner != "" {
+		return &httpError{Status: http.StatusForbidden, Message: "Partner API keys cannot review held transactions"}
+	}
+	if len(holdReviewers) == 0 {
+		return nil
+	}
+	for _, actor := range holdReviewers {
+		if actor == a.actor {
+			return nil
+		}
+	}
+	return &httpError{Status: http.StatusForbidden, Message: fmt.Sprintf("%s is not in HOLD_REVIEWERS", a.actor)}
+}
+
+// Held transaction of a request, writing the problem when it fails
+func requestHeld(w http.ResponseWriter, r *http.Request) *Transaction {
+	var t Transaction
+	err := db.WithContext(r.Context()).First(&t, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Transaction not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch transaction", http.StatusInternalServerError)
+		return nil
+	}
+	if t.Status != statusHeld {
+		writeProblem(w, fmt.Sprintf("Transaction %s is %s, not held", t.ID, t.Status), http.StatusConflict)
+		return nil
+	}
+	txs := []Transaction{t}
+	if err := readItems(r.Context(), txs); err != nil {
+		writeProblem(w, "Failed to fetch line items", http.StatusInternalServerError)
+		return nil
+	}
+	return &txs[0]
+}
+
+// Reviewer's decision of a request, writing the problem when it fails; a
+// rejection needs a reason
+func requestHoldDecision(w http.ResponseWriter, r *http.Request, reasonRequired bool) (holdDecision, bool) {
+	var d holdDecision
+	if err := holdReviewer(r.Context()); err != nil {
+		writeError(w, err)
+		return d, false
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &d); err != nil {
+			writeError(w, err)
+			return d, false
+		}
+	}
+	d.Reason = strings.TrimSpace(d.Reason)
+	if reasonRequired && d.Reason == "" {
+		writeProblem(w, "reason is required", http.StatusBadRequest)
+		return d, false
+	}
+	return d, true
+}
+
+// List held transactions, oldest first. Filters: partner_id, type and limit
+// (default 100, at most 1000).
+func listHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeProblem(w, "limit must be 1 to 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query := db.WithContext(r.Context()).Where("status = ?", statusHeld).Order("date").Limit(limit)
+	if v := q.Get("partner_id"); v != "" {
+		query = query.Where("partner_id = ?", v)
+	}
+	if v := q.Get("type"); v != "" {
+		query = query.Where("type = ?", v)
+	}
+	held := []Transaction{}
+	if err := query.Find(&held).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch held transactions", http.StatusInternalServerError)
+		return
+	}
+	if err := readItems(r.Context(), held); err != nil {
+		writeProblem(w, "Failed to fetch line items", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(held)
+}
+
+// Approve a held transaction: it is processed and published as if it had
+// never been held
+func approveHoldHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := requestHoldDecision(w, r, false)
+	if !ok {
+		return
+	}
+	t := requestHeld(w, r)
+	if t == nil {
+		return
+	}
+	var delta map[string]interface{}
+	if d.Reason != "" {
+		delta = map[string]interface{}{"reason": d.Reason}
+	}
+	t.Status = "Processed"
+	if err := releaseHeld(detachedContext(r), t, delta); err != nil {
+		log.Printf("ERROR: approve %s: %v\n", t.ID, err)
+		writeError(w, err)
+		return
+	}
+	holdDecisions.WithLabelValues(tenantID(r.Context()), "approved").Inc()
+	auditChange(r.Context(), auditRelease, "transaction", t.ID,
+		map[string]string{"status": statusHeld, "hold_reason": t.HoldReason}, map[string]string{"status": t.Status, "reason": d.Reason})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// Reject a held transaction: it ends Rejected, an X12 set is acknowledged as
+// rejected and a transaction.failed event gives the reason
+func rejectHoldHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := requestHoldDecision(w, r, true)
+	if !ok {
+		return
+	}
+	t := requestHeld(w, r)
+	if t == nil {
+		return
+	}
+	ctx := detachedContext(r)
+	if err := recordTransactionEvent(ctx, t.ID, txEventRejected, statusRejected, map[string]interface{}{"reason": d.Reason}); err != nil {
+		log.Printf("ERROR: reject %s: %v\n", t.ID, err)
+		writeProblem(w, "Failed to save transaction", http.StatusInternalServerError)
+		return
+	}
+	t.Status = statusRejected
+	holdDecisions.WithLabelValues(tenantID(ctx), "rejected").Inc()
+	auditChange(r.Context(), auditReject, "transaction", t.ID,
+		map[string]string{"status": statusHeld, "hold_reason": t.HoldReason}, map[string]string{"status": t.Status, "reason": d.Reason})
+	res := holdRejection{Transaction: *t}
+	if t.Format == formatX12 {
+		res.Acknowledgment, res.AcknowledgedSet = rejectionAck(ctx, *t)
+	}
+	if err := publishEvent(ctx, eventTransactionFailed, *t, "Rejected in review: "+d.Reason); err != nil {
+		log.Printf("ERROR: failure event: %v\n", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Acknowledgment rejecting a held X12 transaction's set, built from its
+// archived interchange and archived as its outbound payload; none when the
+// interchange is no longer archived
+func rejectionAck(ctx context.Context, t Transaction) (ack, set string) {
+	_, data, err := archivedPayload(ctx, t.ID, "inbound")
+	if err != nil {
+		log.Printf("Rejected transaction %s has no archived interchange to acknowledge: %v", t.ID, err)
+		return "", ""
+	}
+	ic, g, s, err := payloadSet(t, data)
+	if err != nil {
+		log.Printf("ERROR: rejection ack %s: %v\n", t.ID, err)
+		return "", ""
+	}
+	g.Sets = []X12Set{s}
+	ic.Groups = []X12Group{g}
+	ack = buildFunctionalAck(ic, []batchResult{{InterchangeControl: ic.ControlNumber(), ControlNumber: s.ControlNumber(), Status: "failed"}}, time.Now(), false)
+	if err := archivePayload(ctx, "outbound", "application/edi-x12", []byte(ack), t.ID); err != nil {
+		log.Printf("ERROR: archive: %v\n", err)
+	}
+	return ack, s.ControlNumber()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Pipeline points workflow hooks run at
+const (
+	hookPrePersist = "pre_persist" // a received transaction, once it passed the guardrails and before it is saved
+	hookPreDeliver = "pre_deliver" // the transactions of an outbound interchange, before it is built and sent
+)
+
+// Answer of a hook stopping the document
+const hookVeto = "veto"
+
+// How long a hook may take to answer when it sets no timeout_ms
+var hookTimeoutDflt = getEnvDuration("HOOK_TIMEOUT", 5*time.Second)
+
+var hookCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_hook_calls_total",
+	Help: "Workflow hook calls, by point and outcome.",
+}, []string{"point", "outcome"})
+
+// A synchronous policy webhook called at a pipeline point. It can change
+// some fields of the transactions it is shown or veto them; hooks of a point
+// run in position order and each sees what the one before it changed.
+type WorkflowHook struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	Name      string    `json:"name"`
+	Point     string    `json:"point"`                                        // pre_persist or pre_deliver
+	PartnerID string    `json:"partner_id,omitempty" gorm:"index"`            // empty: every partner
+	URL       string    `json:"url"`                                          // POSTed a hookRequest
+	Secret    string    `json:"secret,omitempty" gorm:"serializer:encrypted"` // signs requests with X-Signature; write only
+	TimeoutMS int       `json:"timeout_ms"`                                   // 0 uses HOOK_TIMEOUT
+	FailOpen  bool      `json:"fail_open"`                                    // let documents through when the hook fails; by default they are rejected
+	Position  int       `json:"position"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (h *WorkflowHook) validate() error {
+	if strings.TrimSpace(h.Name) == "" {
+		return errors.New("name is required")
+	}
+	if h.Point != hookPrePersist && h.Point != hookPreDeliver {
+		return errors.New("point must be pre_persist or pre_deliver")
+	}
+	if !strings.HasPrefix(h.URL, "https://") && !strings.HasPrefix(h.URL, "http://") {
+		return errors.New("url must be an http(s) URL")
+	}
+	if h.TimeoutMS < 0 || h.TimeoutMS > 60000 {
+		return errors.New("timeout_ms must be 0 to 60000")
+	}
+	return nil
+}
+
+// Copy without the secret, for responses and the audit log
+func (h WorkflowHook) redacted() WorkflowHook {
+	if h.Secret != "" {
+		h.Secret = passwordMask
+	}
+	return h
+}
+
+func (h WorkflowHook) timeout() time.Duration {
+	if h.TimeoutMS > 0 {
+		return time.Duration(h.TimeoutMS) * time.Millisecond
+	}
+	return hookTimeoutDflt
+}
+
+// Body POSTed to a hook
+type hookRequest struct {
+	HookID        string        `json:"hook_id"`
+	Point         string        `json:"point"`
+	TenantID      string        `json:"tenant_id"`
+	PartnerID     string        `json:"partner_id"`
+	CorrelationID string        `json:"correlation_id,omitempty"`
+	Transactions  []Transaction `json:"transactions"`
+}
+
+// A hook's answer: decision veto stops the document, anything else lets it
+// through with the changes in transactions, given in request order
+type hookResponse struct {
+	Decision     string           `json:"decision"` // allow (the default) or veto
+	Reason       string           `json:"reason,omitempty"`
+	Transactions []hookEnrichment `json:"transactions,omitempty"`
+}
+
+// Fields a hook may set on a transaction; absent ones are left alone
+type hookEnrichment struct {
+	ShipTo  *string `json:"ship_to"`
+	Carrier *string `json:"carrier"`
+	BOL     *string `json:"bol"`
+	Items   *string `json:"items"`
+}
+
+func (e hookEnrichment) apply(t *Transaction) error {
+	if e.Items != nil {
+		var items []interface{}
+		if err := json.Unmarshal([]byte(*e.Items), &items); err != nil {
+			return errors.New("items must be a JSON array")
+		}
+		t.ItemList = *e.Items
+	}
+	for _, f := range []struct {
+		v   *string
+		dst *string
+	}{{e.ShipTo, &t.ShipTo}, {e.Carrier, &t.Carrier}, {e.BOL, &t.BOL}} {
+		if f.v != nil {
+			*f.dst = *f.v
+		}
+	}
+	return nil
+}
+
+// Run the enabled hooks of point for partnerID over txs, applying their
+// changes in place. The error is the veto, or the failure of a hook that
+// does not fail open.
+func runHooks(ctx context.Context, point, partnerID string, txs []Transaction) error {
+	if edgeMode || len(txs) == 0 {
+		return nil
+	}
+	var hooks []WorkflowHook
+	err := db.WithContext(ctx).Where("point = ? AND disabled = ? AND (partner_id = '' OR partner_id = ?)", point, false, partnerID).
+		Order("position, created_at").Find(&hooks).Error
+	if err != nil {
+		log.Printf("ERROR: hooks %s: %v\n", point, err)
+		return &httpError{Status: http.StatusServiceUnavailable, Message: "Failed to fetch workflow hooks"}
+	}
+	for _, h := range hooks {
+		res, err := callHook(ctx, h, partnerID, txs)
+		if err != nil {
+			if h.FailOpen {
+				hookCalls.WithLabelValues(point, "failed_open").Inc()
+				log.Printf("Hook %s (%s) failed open for partner %s: %v", h.Name, point, partnerID, err)
+				continue
+			}
+			hookCalls.WithLabelValues(point, "failed").Inc()
+			log.Printf("ERROR: hook %s (%s): %v\n", h.Name, point, err)
+			if isTimeout(err) {
+				return &httpError{Status: http.StatusGatewayTimeout, Message: fmt.Sprintf("Workflow hook %s did not answer within %s", h.Name, h.timeout())}
+			}
+			return &httpError{Status: http.StatusBadGateway, Message: fmt.Sprintf("Workflow hook %s failed: %v", h.Name, err)}
+		}
+		if res.Decision == hookVeto {
+			hookCalls.WithLabelValues(point, "vetoed").Inc()
+			msg := "Vetoed by workflow hook " + h.Name
+			if res.Reason != "" {
+				msg += ": " + res.Reason
+			}
+			return &httpError{Status: http.StatusUnprocessableEntity, Code: codePolicyVetoed, Message: msg}
+		}
+		hookCalls.WithLabelValues(point, "allowed").Inc()
+		for i, e := range res.Transactions {
+			if i == len(txs) {
+				break
+			}
+			if err := e.apply(&txs[i]); err != nil {
+				return &httpError{Status: http.StatusBadGateway, Message: fmt.Sprintf("Workflow hook %s answered badly: %v", h.Name, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// POST txs to a hook and read its answer
+func callHook(ctx context.Context, h WorkflowHook, partnerID string, txs []Transaction) (hookResponse, error) {
+	body, err := json.Marshal(hookRequest{
+		HookID:        h.ID,
+		Point:         h.Point,
+		TenantID:      tenantID(ctx),
+		PartnerID:     partnerID,
+		CorrelationID: correlationID(ctx),
+		Transactions:  txs,
+	})
+	if err != nil {
+		return hookResponse{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return hookResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Correlation-ID", correlationID(ctx))
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return hookResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return hookResponse{}, errors.New("hook returned " + resp.Status)
+	}
+	var res hookResponse
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return hookResponse{}, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &res); err != nil {
+			return hookResponse{}, fmt.Errorf("invalid answer: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// Run the pre-persist hooks over one received transaction
+func prePersistHooks(ctx context.Context, t *Transaction) error {
+	txs := []Transaction{*t}
+	err := runHooks(ctx, hookPrePersist, t.PartnerID, txs)
+	*t = txs[0]
+	return err
+}
+
+func requestHook(w http.ResponseWriter, r *http.Request) *WorkflowHook {
+	var h WorkflowHook
+	err := db.WithContext(r.Context()).First(&h, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Workflow hook not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch workflow hook", http.StatusInternalServerError)
+		return nil
+	}
+	return &h
+}
+
+// List workflow hooks in the order they run
+func listHooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks := []WorkflowHook{}
+	if err := db.WithContext(r.Context()).Order("point, position, created_at").Find(&hooks).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch workflow hooks", http.StatusInternalServerError)
+		return
+	}
+	for i := range hooks {
+		hooks[i] = hooks[i].redacted()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// Add a workflow hook
+func createHookHandler(w http.ResponseWriter, r *http.Request) {
+	var h WorkflowHook
+	if err := decodeJSON(w, r, &h); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.ID = uuid.New().String()
+	if err := db.WithContext(r.Context()).Create(&h).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save workflow hook", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "workflow_hook", h.ID, nil, h.redacted())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h.redacted())
+}
+
+// Fetch one workflow hook
+func getHookHandler(w http.ResponseWriter, r *http.Request) {
+	h := requestHook(w, r)
+	if h == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.redacted())
+}
+
+// Replace a workflow hook, keeping its secret when none is given
+func updateHookHandler(w http.ResponseWriter, r *http.Request) {
+	existing := requestHook(w, r)
+	if existing == nil {
+		return
+	}
+	var h WorkflowHook
+	if err := decodeJSON(w, r, &h); err != nil {
+		writeError(w, err)
+		return
+	}
+	if h.Secret == "" || h.Secret == passwordMask {
+		h.Secret = existing.Secret
+	}
+	if err := h.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.ID, h.TenantID, h.CreatedAt = existing.ID, existing.TenantID, existing.CreatedAt
+	if err := db.WithContext(r.Context()).Omit("CreatedAt").Save(&h).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save workflow hook", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditUpdate, "workflow_hook", h.ID, existing.redacted(), h.redacted())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.redacted())
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Integration tests run documents through the HTTP API, the database and the
+// events backend: inbound, persist, publish, outbound. Here they use SQLite
+// and the memory publisher; containers_test.go runs the same scenario on
+// PostgreSQL and Kafka with -tags integration.
+
+// Set a package variable for the rest of a test
+func setForTest[T any](t testing.TB, v *T, value T) {
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+// Set up the database, archive and events backend the test configured, as
+// serve does, and serve the API with its middleware
+func startGateway(t testing.TB) *httptest.Server {
+	t.Helper()
+	t.Setenv("ARCHIVE_BACKEND", "none")
+	setForTest(t, &db, db)
+	setForTest(t, &publisher, publisher)
+	setForTest(t, &kafkaRouter, kafkaRouter)
+	if err := initDB(); err != nil {
+		t.Fatalf("database: %v", err)
+	}
+	if err := initArchive(); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	if err := initEvents(); err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	r := newRouter()
+	r.Use(routeMiddleware...)
+	srv := httptest.NewServer(chain(r, globalMiddleware...))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// One side of the pipeline scenario that differs by events backend
+type pipelineBackend struct {
+	// Events of a type published so far, oldest first
+	events func(t *testing.T, eventType string) []publishedEvent
+	// Hand an outbound.requested event to the outbound consumer
+	requestOutbound func(t *testing.T, msg kafka.Message)
+}
+
+// An 856 interchange from sender with one shipment
+func x12ASN(sender, control, bol string) string {
+	return fmt.Sprintf("ISA*00*          *00*          *ZZ*%-15s*ZZ*EDIGATEWAY     *240502*0900*U*00401*%s*0*T*>~", sender, control) +
+		"GS*SH*" + sender + "*EDIGATEWAY*20240502*0900*1*X*004010~" +
+		"ST*856*0001~BSN*00*SHP1*20240502*0900~" +
+		"TD5**2*UPSN~REF*BM*" + bol + "~N1*ST*Store 12~" +
+		"LIN**VN*SKU-1~SN1**4*EA~SE*8*0001~GE*1*1~IEA*1*" + control + "~"
+}
+
+func doJSON(t *testing.T, method, url string, body interface{}, out interface{}) int {
+	t.Helper()
+	var payload io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = bytes.NewReader(b)
+	}
+	return doRequest(t, method, url, "application/json", payload, out)
+}
+
+func doRequest(t *testing.T, method, url, contentType string, body io.Reader, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil {
+		if s, ok := out.(*string); ok {
+			*s = string(data)
+		} else if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, url, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Wait for an event of a type about id: a transaction's, or for outbound
+// results the request's event ID
+func waitForEvent(t *testing.T, b pipelineBackend, eventType, id string) publishedEvent {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		for _, e := range b.events(t, eventType) {
+			var about struct {
+				Data struct {
+					ID             string `json:"id"`
+					RequestEventID string `json:"request_event_id"`
+				} `json:"data"`
+			}
+			if json.Unmarshal(e.Value, &about) == nil && (about.Data.ID == id || about.Data.RequestEventID == id) {
+				return e
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s event for %s", eventType, id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Receive an X12 856 from a partner, check it was saved and published, then
+// have an outbound request delivered to the partner's endpoint
+func runPipelineScenario(t *testing.T, srv *httptest.Server, b pipelineBackend) {
+	delivered := make(chan string, 4)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		delivered <- string(body)
+	}))
+	defer endpoint.Close()
+
+	partner := map[string]interface{}{"id": "acme", "name": "Acme", "isa_id": "ACME", "delivery_url": endpoint.URL}
+	if status := doJSON(t, "POST", srv.URL+"/partners", partner, nil); status != http.StatusCreated {
+		t.Fatalf("create partner: %d", status)
+	}
+
+	// Inbound and persist
+	var results []batchResult
+	status := doRequest(t, "POST", srv.URL+"/inbound", "application/edi-x12", strings.NewReader(x12ASN("ACME", "000000101", "BOL-101")), &results)
+	if status != http.StatusOK || len(results) != 1 || results[0].Status != "created" {
+		t.Fatalf("inbound: %d %+v", status, results)
+	}
+	id := results[0].ID
+	var saved Transaction
+	if status := doJSON(t, "GET", srv.URL+"/transactions/"+id, nil, &saved); status != http.StatusOK {
+		t.Fatalf("get transaction: %d", status)
+	}
+	if saved.PartnerID != "acme" || saved.Type != "856" || saved.BOL != "BOL-101" || saved.ShipTo != "Store 12" || saved.Carrier != "UPSN" {
+		t.Errorf("saved transaction: %+v", saved)
+	}
+	if items, err := saved.Items(); err != nil || len(items) != 1 || items[0].SKU != "SKU-1" || items[0].Quantity != 4 {
+		t.Errorf("saved items: %+v %v", items, err)
+	}
+
+	// Publish
+	created := waitForEvent(t, b, eventTransactionCreated, id)
+	var envelope struct {
+		EventType string      `json:"event_type"`
+		TenantID  string      `json:"tenant_id"`
+		Data      Transaction `json:"data"`
+	}
+	if err := json.Unmarshal(created.Value, &envelope); err != nil {
+		t.Fatalf("transaction.created: %v", err)
+	}
+	if envelope.EventType != eventTransactionCreated || envelope.TenantID != defaultTenant || envelope.Data.BOL != "BOL-101" {
+		t.Errorf("transaction.created envelope: %+v", envelope)
+	}
+
+	// Outbound on request
+	var edi string
+	if status := doRequest(t, "GET", srv.URL+"/outbound?partner=acme", "", nil, &edi); status != http.StatusOK {
+		t.Fatalf("outbound: %d %s", status, edi)
+	}
+	if !strings.HasPrefix(edi, "ISA") || !strings.Contains(edi, "ST*856") || !strings.Contains(edi, "BOL-101") {
+		t.Errorf("outbound interchange: %q", edi)
+	}
+
+	// Outbound from an outbound.requested event, delivered to the partner
+	request := map[string]interface{}{
+		"schema_version": eventSchemaVersion, "event_id": "req-1", "event_type": eventOutboundRequested,
+		"data": map[string]string{"partner_id": "acme", "ship_to": "Store 7", "carrier": "FDEG", "bol": "BOL-202", "items": `[{"sku":"SKU-2","quantity":3}]`},
+	}
+	value, _ := json.Marshal(request)
+	b.requestOutbound(t, kafka.Message{Topic: outboundTopic, Key: []byte("req-1"), Value: value})
+	select {
+	case body := <-delivered:
+		if !strings.HasPrefix(body, "ISA") || !strings.Contains(body, "BOL-202") || !strings.Contains(body, "SKU-2") {
+			t.Errorf("delivered interchange: %q", body)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("outbound request was not delivered")
+	}
+	accepted := waitForEvent(t, b, eventOutboundAccepted, "req-1")
+	var result outboundResult
+	if err := json.Unmarshal(accepted.Value, &result); err != nil {
+		t.Fatalf("outbound.accepted: %v", err)
+	}
+	if result.Data.TransactionID == "" || result.Data.DeliveryStatus != deliveryDelivered {
+		t.Errorf("outbound.accepted: %+v", result.Data)
+	}
+	var sent Transaction
+	if status := doJSON(t, "GET", srv.URL+"/transactions/"+result.Data.TransactionID, nil, &sent); status != http.StatusOK || sent.BOL != "BOL-202" {
+		t.Errorf("outbound transaction: %d %+v", status, sent)
+	}
+}
+
+func TestPipelineSQLiteMemory(t *testing.T) {
+	setForTest(t, &databaseDriver, "sqlite")
+	setForTest(t, &eventsBackend, "memory")
+	t.Setenv("DATABASE_DSN", filepath.Join(t.TempDir(), "edi.db"))
+	srv := startGateway(t)
+	runPipelineScenario(t, srv, pipelineBackend{
+		events: func(t *testing.T, eventType string) []publishedEvent {
+			var events []publishedEvent
+			if status := doJSON(t, "GET", srv.URL+"/admin/events?limit=1000&type="+eventType, nil, &events); status != http.StatusOK {
+				t.Fatalf("events: %d", status)
+			}
+			return events
+		},
+		requestOutbound: func(t *testing.T, msg kafka.Message) {
+			if err := handleOutboundRequest(context.Background(), msg); err != nil {
+				t.Fatalf("outbound request: %v", err)
+			}
+		},
+	})
+}
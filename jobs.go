@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Kinds of asynchronous work
+const (
+	jobInbound = "inbound"
+	jobBatch   = "batch"
+)
+
+// Asynchronous processing job, polled via GET /jobs/{id}
+type Job struct {
+	ID            string     `json:"id" gorm:"primaryKey"`
+	TenantID      string     `json:"tenant_id" gorm:"index"`
+	Kind          string     `json:"kind"`
+	Status        string     `json:"status" gorm:"index"` // queued, running, succeeded, partial, failed
+	Priority      string     `json:"priority,omitempty"`  // lane it was queued in: high, normal or low
+	HTTPStatus    int        `json:"http_status,omitempty"`
+	Result        string     `json:"result,omitempty"` // JSON of the synchronous response
+	ResultKey     string     `json:"-"`                // archive key of a result over BLOB_THRESHOLD, kept there instead
+	Error         string     `json:"error,omitempty"`
+	CallbackURL   string     `json:"callback_url,omitempty"`
+	CorrelationID string     `json:"correlation_id,omitempty"` // X-Correlation-ID of the submitting request
+	SubmissionID  string     `json:"submission_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+// Work item handed to the pool; the payload only lives in memory
+type jobTask struct {
+	job        Job
+	submission *Submission
+	files      []jobFile
+	partner    string // submitting partner, see partnerHint
+	channel    channelIdentity
+	signature  *requestSignature // see signatureMiddleware
+}
+
+// One submitted document, copied out of the pooled request buffer
+type jobFile struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+func newJobFile(name, contentType string, data []byte) jobFile {
+	return jobFile{name: name, contentType: contentType, data: append([]byte(nil), data...)}
+}
+
+var (
+	jobWorkers     = atLeastOne(getEnvInt("JOB_WORKERS", cpus))
+	jobWorkersHigh = atLeastOne(getEnvInt("JOB_WORKERS_HIGH", cpus))
+	jobWorkersLow  = atLeastOne(getEnvInt("JOB_WORKERS_LOW", 1))
+	jobQueueSize   = getEnvInt("JOB_QUEUE_SIZE", 100) // per lane
+	jobQueues      map[string]chan jobTask
+)
+
+// Job callbacks are POSTed by their own workers, so a slow webhook holds up
+// other callbacks at worst and never the jobs
+var (
+	jobCallbackWorkers = atLeastOne(getEnvInt("JOB_CALLBACK_WORKERS", 2))
+	jobCallbacks       = make(chan Job, jobQueueSize)
+	// Hosts a callback may name whatever their scheme and address, e.g. an
+	// internal webhook receiver
+	jobCallbackHosts = splitList(getEnv("JOB_CALLBACK_ALLOWED_HOSTS", ""))
+)
+
+// Start a bounded worker pool per priority lane. Jobs left queued or
+// running by a previous process lost their payload and are marked failed.
+func initJobs() {
+	db.WithContext(allTenantsContext()).Model(&Job{}).Where("status IN ?", []string{"queued", "running"}).
+		Updates(map[string]interface{}{"status": "failed", "error": "interrupted by restart"})
+	workers := map[string]int{priorityHigh: jobWorkersHigh, priorityNormal: jobWorkers, priorityLow: jobWorkersLow}
+	jobQueues = map[string]chan jobTask{}
+	for _, priority := range priorities {
+		queue := make(chan jobTask, jobQueueSize)
+		jobQueues[priority] = queue
+		for i := 0; i < workers[priority]; i++ {
+			go jobWorker(priority, queue)
+		}
+	}
+	for i := 0; i < jobCallbackWorkers; i++ {
+		go func() {
+			for job := range jobCallbacks {
+				notifyJobCallback(job)
+			}
+		}()
+	}
+}
+
+// Whether the caller asked for asynchronous processing
+func wantsAsync(r *http.Request) bool {
+	return r.URL.Query().Get("async") == "true" ||
+		strings.Contains(r.Header.Get("Prefer"), "respond-async")
+}
+
+// Webhook to notify when the job completes: an https URL of a public host,
+// or any URL of a host in JOB_CALLBACK_ALLOWED_HOSTS
+func callbackURL(r *http.Request) (string, error) {
+	raw := r.URL.Query().Get("callback")
+	if raw == "" {
+		raw = r.Header.Get("X-Callback-URL")
+	}
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", &httpError{Status: http.StatusBadRequest, Message: "callback must be an absolute http(s) URL"}
+	}
+	if allowedCallbackHost(u.Hostname()) {
+		return raw, nil
+	}
+	if u.Scheme != "https" {
+		return "", &httpError{Status: http.StatusBadRequest, Message: "callback must use https"}
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); (ip != nil && !publicAddress(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return "", &httpError{Status: http.StatusBadRequest, Message: "callback must not name a private or loopback host"}
+	}
+	return raw, nil
+}
+
+func allowedCallbackHost(host string) bool {
+	for _, h := range jobCallbackHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether ip is routable on the internet, rather than loopback, private,
+// link-local (cloud metadata included) or unspecified
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// Client for job callbacks. The address a callback's host resolves to is
+// checked when connecting, so a name cannot point at a private address after
+// the URL was accepted, and redirects are not followed.
+func callbackClient(host string) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowedCallbackHost(host) {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			h, _, err := net.SplitHostPort(address)
+			if ip := net.ParseIP(h); err != nil || ip == nil || !publicAddress(ip) {
+				return fmt.Errorf("callback host %s resolves to private address %s", host, address)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:       10 * time.Second,
+		Transport:     &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// Record a job and queue it in the lane of its priority; 503 when the lane
+// is full
+func enqueueJob(ctx context.Context, kind string, sub *Submission, files []jobFile, callback string) (Job, error) {
+	job := Job{ID: uuid.New().String(), Kind: kind, Status: "queued", Priority: jobPriority(ctx, files), CallbackURL: callback, CorrelationID: correlationID(ctx)}
+	if sub != nil {
+		job.SubmissionID = sub.ID
+	}
+	if err := db.WithContext(ctx).Create(&job).Error; err != nil {
+		return job, err
+	}
+	task := jobTask{job: job, submission: sub, files: files, partner: partnerHint(ctx), channel: channelFrom(ctx)}
+	if sig, ok := requestSignatureFrom(ctx); ok {
+		task.signature = &sig
+	}
+	select {
+	case jobQueues[job.Priority] <- task:
+		priorityQueueDepth.WithLabelValues("jobs", job.Priority).Inc()
+		return job, nil
+	default:
+		db.WithContext(ctx).Model(&job).Updates(map[string]interface{}{"status": "failed", "error": "queue full"})
+		return job, &httpError{Status: http.StatusServiceUnavailable, Message: "Processing queue is full, retry later"}
+	}
+}
+
+// Respond 202 pointing at the job status resource
+func acceptJob(w http.ResponseWriter, job Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func jobWorker(priority string, queue chan jobTask) {
+	for task := range queue {
+		priorityQueueDepth.WithLabelValues("jobs", priority).Dec()
+		priorityWait.WithLabelValues("jobs", priority).Observe(time.Since(task.job.CreatedAt).Seconds())
+		runJob(task)
+	}
+}
+
+// Run one job to completion and record the outcome
+func runJob(task jobTask) {
+	job := task.job
+	ctx := withPartnerHint(withCorrelationID(context.Background(), job.CorrelationID), task.partner)
+	ctx = withChannel(ctx, task.channel)
+	if task.signature != nil {
+		ctx = withRequestSignature(ctx, *task.signature)
+	}
+	ctx = withTenant(ctx, job.TenantID)
+	db.WithContext(ctx).Model(&job).Update("status", "running")
+
+	var result interface{}
+	job.Status, job.HTTPStatus = "succeeded", http.StatusOK
+	switch job.Kind {
+	case jobInbound:
+		f := task.files[0]
+		t, err := ingestJSON(ctx, f.contentType, f.data)
+		result = t
+		if err != nil {
+			job.Status, job.Error, job.HTTPStatus = "failed", err.Error(), http.StatusInternalServerError
+			var he *httpError
+			if errors.As(err, &he) {
+				job.HTTPStatus = he.Status
+			}
+		}
+	case jobBatch:
+		var results []batchResult
+		for _, f := range task.files {
+			results = append(results, processDocument(ctx, task.submission, f.name, f.contentType, f.data)...)
+		}
+		result = results
+		failed := 0
+		for _, res := range results {
+			if res.Status == "failed" {
+				failed++
+			}
+		}
+		if failed == len(results) {
+			job.Status, job.HTTPStatus = "failed", http.StatusMultiStatus
+		} else if failed > 0 {
+			job.Status, job.HTTPStatus = "partial", http.StatusMultiStatus
+		}
+	}
+	if b, err := json.Marshal(result); err == nil {
+		job.Result = string(b)
+	}
+	now := time.Now()
+	job.CompletedAt = &now
+	saved := job
+	if archive != nil && int64(len(job.Result)) > blobThreshold {
+		key := fmt.Sprintf("jobs/%s/%s.json", job.TenantID, job.ID)
+		if err := archive.Put(ctx, key, []byte(job.Result)); err != nil {
+			log.Printf("ERROR: job %s result: %v\n", job.ID, err)
+		} else {
+			saved.Result, saved.ResultKey = "", key
+		}
+	}
+	if err := db.WithContext(ctx).Model(&saved).Select("status", "http_status", "result", "result_key", "error", "completed_at").Updates(&saved).Error; err != nil {
+		log.Printf("ERROR: job %s: %v\n", job.ID, err)
+	}
+	if job.CallbackURL != "" {
+		select {
+		case jobCallbacks <- job:
+		default:
+			log.Printf("Job %s callback dropped: callback queue full", job.ID)
+		}
+	}
+}
+
+// POST the finished job to its callback, retrying a few times
+func notifyJobCallback(job Job) {
+	body, _ := json.Marshal(job)
+	u, err := url.Parse(job.CallbackURL)
+	if err != nil {
+		log.Printf("Job %s callback: %v", job.ID, err)
+		return
+	}
+	client := callbackClient(u.Hostname())
+	for attempt, delay := 1, time.Second; attempt <= 3; attempt, delay = attempt+1, delay*2 {
+		resp, err := client.Post(job.CallbackURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		log.Printf("Job %s callback attempt %d failed: %v", job.ID, attempt, err)
+		time.Sleep(delay)
+	}
+}
+
+// Report the status of an asynchronous job
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	var job Job
+	err := db.WithContext(r.Context()).First(&job, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Job not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch job", http.StatusInternalServerError)
+		return
+	}
+	if job.ResultKey == "" || archive == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+	rc, err := archive.Open(r.Context(), job.ResultKey)
+	if errors.Is(err, errBlobNotFound) {
+		writeProblem(w, "Job result is missing from the archive", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: archive open %s: %v\n", job.ResultKey, err)
+		writeProblem(w, "Failed to read job result", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	// The job as usual, its result streamed from the archive into the
+	// string it is in the JSON
+	head, _ := json.Marshal(job)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(head[:len(head)-1])
+	io.WriteString(w, `,"result":"`)
+	if _, err := io.Copy(jsonStringWriter{w}, rc); err != nil {
+		log.Printf("ERROR: archive stream %s: %v\n", job.ResultKey, err)
+	}
+	io.WriteString(w, "\"}\n")
+}
+
+// Writer escaping what it is given as the contents of a JSON string
+type jsonStringWriter struct {
+	w io.Writer
+}
+
+func (s jsonStringWriter) Write(p []byte) (int, error) {
+	const hex = "0123456789abcdef"
+	buf := make([]byte, 0, len(p)+16)
+	for _, c := range p {
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	if _, err := s.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
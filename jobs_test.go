@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCallbackURLValidated(t *testing.T) {
+	setForTest(t, &jobCallbackHosts, []string{"hooks.internal"})
+	tests := []struct {
+		callback string
+		ok       bool
+	}{
+		{"", true},
+		{"https://example.com/hooks/edi", true},
+		{"https://hooks.internal/edi", true},
+		{"http://hooks.internal:8080/edi", true},
+		{"http://example.com/hooks/edi", false},
+		{"ftp://example.com/edi", false},
+		{"/hooks/edi", false},
+		{"https://localhost/edi", false},
+		{"https://127.0.0.1/edi", false},
+		{"https://[::1]/edi", false},
+		{"https://10.1.2.3/edi", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/inbound?async=true&callback="+url.QueryEscape(tt.callback), nil)
+		got, err := callbackURL(r)
+		if tt.ok && (err != nil || got != tt.callback) {
+			t.Errorf("%q: %q %v, want it accepted", tt.callback, got, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%q accepted", tt.callback)
+		}
+	}
+}
+
+// A callback whose host resolves to a private address is refused when
+// connecting, unless the host is allowed
+func TestJobCallbackChecksAddress(t *testing.T) {
+	called := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		called <- struct{}{}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	if _, err := callbackClient(u.Hostname()).Post(srv.URL, "application/json", nil); err == nil {
+		t.Fatal("callback to a loopback address was sent")
+	}
+
+	setForTest(t, &jobCallbackHosts, []string{u.Hostname()})
+	notifyJobCallback(Job{ID: "job-1", CallbackURL: srv.URL})
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("callback to an allowed host was not sent")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Migration of Transaction.ItemList (a JSON string) to line_items rows, in
+// phases that can each be rolled back by going to the previous mode:
+//
+//	json         read and write ItemList only (legacy)
+//	dual_write   also write line_items; read ItemList
+//	shadow_read  dual write; read ItemList and compare with line_items
+//	read_rows    dual write; read line_items, falling back to ItemList for
+//	             transactions without rows
+//
+// The consistency checker backfills and compares existing transactions in
+// every mode but json.
+const (
+	itemsJSON       = "json"
+	itemsDualWrite  = "dual_write"
+	itemsShadowRead = "shadow_read"
+	itemsReadRows   = "read_rows"
+)
+
+var (
+	itemsStorage       = getEnv("ITEMS_STORAGE", itemsJSON)
+	itemsCheckInterval = getEnvDuration("ITEMS_CHECK_INTERVAL", time.Hour)
+)
+
+// One line of a transaction, the row form of Item
+type LineItem struct {
+	ID            int64   `json:"-" gorm:"primaryKey"`
+	TenantID      string  `json:"-" gorm:"index"`
+	TransactionID string  `json:"transaction_id" gorm:"index"`
+	Line          int     `json:"line"`
+	SKU           string  `json:"sku"`
+	Description   string  `json:"description,omitempty" gorm:"serializer:encrypted"`
+	Quantity      float64 `json:"quantity"`
+	UOM           string  `json:"uom,omitempty"`
+	PONumber      string  `json:"po_number,omitempty"`
+	Carton        string  `json:"carton,omitempty"`
+	Weight        float64 `json:"weight,omitempty"`
+}
+
+var itemsMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "items_consistency_mismatches_total",
+	Help: "Transactions whose line_items rows differ from ItemList.",
+}, []string{"source"})
+
+func validItemsStorage(mode string) bool {
+	switch mode {
+	case itemsJSON, itemsDualWrite, itemsShadowRead, itemsReadRows:
+		return true
+	}
+	return false
+}
+
+func lineItemRows(t *Transaction) ([]LineItem, error) {
+	items, err := t.Items()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]LineItem, len(items))
+	for i, it := range items {
+		rows[i] = LineItem{
+			TransactionID: t.ID, Line: i + 1, SKU: it.SKU, Description: it.Description,
+			Quantity: it.Quantity, UOM: it.UOM, PONumber: it.PONumber, Carton: it.Carton, Weight: it.Weight,
+		}
+	}
+	return rows, nil
+}
+
+func rowItems(rows []LineItem) []Item {
+	items := make([]Item, len(rows))
+	for i, r := range rows {
+		items[i] = Item{
+			SKU: r.SKU, Description: r.Description, Quantity: r.Quantity, UOM: r.UOM,
+			PONumber: r.PONumber, Carton: r.Carton, Weight: r.Weight,
+		}
+	}
+	return items
+}
+
+// Dual write: store line_items in the same database transaction as the
+// transaction itself
+func (t *Transaction) AfterCreate(tx *gorm.DB) error {
+	if itemsStorage == itemsJSON || tx.Statement.RowsAffected == 0 {
+		return nil // legacy mode, or skipped by ON CONFLICT DO NOTHING
+	}
+	rows, err := lineItemRows(t)
+	if err != nil || len(rows) == 0 {
+		return nil // invalid lists stay as received; the checker reports them
+	}
+	// In batches: one insert of a long list would exceed PostgreSQL's 65535
+	// bind parameters
+	return tx.Session(&gorm.Session{NewDB: true}).CreateInBatches(&rows, bulkInsertBatch).Error
+}
+
+// Apply the read side of the current mode to transactions fetched for use
+func readItems(ctx context.Context, txs []Transaction) error {
+	if len(txs) == 0 || (itemsStorage != itemsShadowRead && itemsStorage != itemsReadRows) {
+		return nil
+	}
+	ids := make([]string, len(txs))
+	for i, t := range txs {
+		ids[i] = t.ID
+	}
+	byTx := map[string][]LineItem{}
+	for start := 0; start < len(ids); start += 1000 {
+		end := start + 1000
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var rows []LineItem
+		if err := db.WithContext(ctx).Where("transaction_id IN ?", ids[start:end]).Order("transaction_id, line").Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, r := range rows {
+			byTx[r.TransactionID] = append(byTx[r.TransactionID], r)
+		}
+	}
+	for i := range txs {
+		t := &txs[i]
+		rows, ok := byTx[t.ID]
+		if itemsStorage == itemsShadowRead {
+			if !itemsMatch(t, rows) {
+				itemsMismatches.WithLabelValues("shadow_read").Inc()
+				log.Printf("ERROR: line_items of transaction %s differ from its item list\n", t.ID)
+			}
+			continue
+		}
+		if ok {
+			list, err := json.Marshal(rowItems(rows))
+			if err != nil {
+				return err
+			}
+			t.ItemList = string(list)
+		}
+	}
+	return nil
+}
+
+// Whether rows hold the same items as t's ItemList
+func itemsMatch(t *Transaction, rows []LineItem) bool {
+	items, err := t.Items()
+	if err != nil {
+		return false
+	}
+	if len(items) == 0 && len(rows) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(items, rowItems(rows))
+}
+
+// Result of a consistency checker run
+type itemsCheckReport struct {
+	Mode       string     `json:"mode"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Checked    int        `json:"checked"`
+	Backfilled int        `json:"backfilled"`        // rows written for transactions that had none
+	Repaired   int        `json:"repaired"`          // rows rewritten from ItemList
+	Mismatched int        `json:"mismatched"`        // differences left in place (read_rows)
+	Invalid    []string   `json:"invalid,omitempty"` // transactions whose ItemList does not decode
+	Error      string     `json:"error,omitempty"`
+}
+
+var itemsCheck = struct {
+	mu      sync.Mutex
+	running bool
+	last    *itemsCheckReport // last finished run
+}{}
+
+// Run the checker every interval until the process exits
+func runItemsChecker(interval time.Duration) {
+	for {
+		checkItems()
+		time.Sleep(interval)
+	}
+}
+
+// Compare every transaction with its line_items, oldest first in batches.
+// Before read_rows ItemList is the source of truth, so missing or differing
+// rows are rewritten; once rows are read, differences are only reported.
+func checkItems() {
+	if itemsStorage == itemsJSON {
+		return
+	}
+	itemsCheck.mu.Lock()
+	if itemsCheck.running {
+		itemsCheck.mu.Unlock()
+		return
+	}
+	itemsCheck.running = true
+	itemsCheck.mu.Unlock()
+	report := &itemsCheckReport{Mode: itemsStorage, StartedAt: time.Now()}
+
+	err := func() error {
+		after := ""
+		for {
+			var txs []Transaction
+			if err := db.WithContext(allTenantsContext()).Select("id", "tenant_id", "item_list").Where("id > ?", after).Order("id").Limit(500).Find(&txs).Error; err != nil {
+				return err
+			}
+			if len(txs) == 0 {
+				return nil
+			}
+			after = txs[len(txs)-1].ID
+			if err := checkItemsBatch(txs, report); err != nil {
+				return err
+			}
+		}
+	}()
+
+	if err != nil {
+		log.Printf("ERROR: items check: %v\n", err)
+		report.Error = err.Error()
+	}
+	now := time.Now()
+	report.FinishedAt = &now
+	itemsCheck.mu.Lock()
+	itemsCheck.running, itemsCheck.last = false, report
+	itemsCheck.mu.Unlock()
+	log.Printf("Items check (%s): %d checked, %d backfilled, %d repaired, %d mismatched, %d invalid",
+		report.Mode, report.Checked, report.Backfilled, report.Repaired, report.Mismatched, len(report.Invalid))
+}
+
+func checkItemsBatch(txs []Transaction, report *itemsCheckReport) error {
+	ids := make([]string, len(txs))
+	for i, t := range txs {
+		ids[i] = t.ID
+	}
+	var rows []LineItem
+	if err := db.WithContext(allTenantsContext()).Where("transaction_id IN ?", ids).Order("transaction_id, line").Find(&rows).Error; err != nil {
+		return err
+	}
+	byTx := map[string][]LineItem{}
+	for _, r := range rows {
+		byTx[r.TransactionID] = append(byTx[r.TransactionID], r)
+	}
+	for i := range txs {
+		t := &txs[i]
+		report.Checked++
+		want, err := lineItemRows(t)
+		if err != nil {
+			if len(report.Invalid) < 100 {
+				report.Invalid = append(report.Invalid, t.ID)
+			}
+			continue
+		}
+		have := byTx[t.ID]
+		if itemsMatch(t, have) {
+			continue
+		}
+		itemsMismatches.WithLabelValues("checker").Inc()
+		if itemsStorage == itemsReadRows && len(have) > 0 {
+			report.Mismatched++
+			log.Printf("ERROR: line_items of transaction %s differ from its item list\n", t.ID)
+			continue
+		}
+		err = db.WithContext(withTenant(context.Background(), t.TenantID)).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("transaction_id = ?", t.ID).Delete(&LineItem{}).Error; err != nil {
+				return err
+			}
+			if len(want) == 0 {
+				return nil
+			}
+			return tx.Create(&want).Error
+		})
+		if err != nil {
+			return fmt.Errorf("transaction %s: %w", t.ID, err)
+		}
+		if len(have) == 0 {
+			report.Backfilled++
+		} else {
+			report.Repaired++
+		}
+	}
+	return nil
+}
+
+// Report the current migration mode and the last checker run
+func itemsMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	itemsCheck.mu.Lock()
+	out := struct {
+		Mode    string            `json:"mode"`
+		Running bool              `json:"running"`
+		Last    *itemsCheckReport `json:"last_check,omitempty"`
+	}{itemsStorage, itemsCheck.running, itemsCheck.last}
+	b, err := json.Marshal(out)
+	itemsCheck.mu.Unlock()
+	if err != nil {
+		writeProblem(w, "Failed to encode report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// Start a checker run in the background
+func itemsCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if itemsStorage == itemsJSON {
+		writeProblem(w, "ITEMS_STORAGE is json; nothing to check", http.StatusConflict)
+		return
+	}
+	go checkItems()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Items check started")
+}
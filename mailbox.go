@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Every partner has a logical inbox and outbox, as on a VAN: the inbox holds
+// documents received from the partner until a back-office system pulls them,
+// the outbox documents for the partner until it collects them with GET
+// /outbound or they are delivered to its delivery URL.
+const (
+	mailboxInbox  = "inbox"
+	mailboxOutbox = "outbox"
+)
+
+// Mailbox message states
+const (
+	mailboxPending = "pending"
+	mailboxPulled  = "pulled"
+)
+
+// One document in a partner's mailbox
+type MailboxMessage struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	TenantID      string     `json:"tenant_id" gorm:"index"`
+	PartnerID     string     `json:"partner_id" gorm:"index:idx_mailbox_messages_box"`
+	Box           string     `json:"box" gorm:"index:idx_mailbox_messages_box"`
+	Status        string     `json:"status" gorm:"index:idx_mailbox_messages_box"`
+	TransactionID string     `json:"transaction_id" gorm:"index"`
+	CreatedAt     time.Time  `json:"created_at"`
+	PulledAt      *time.Time `json:"pulled_at,omitempty"`
+	PulledBy      string     `json:"pulled_by,omitempty"` // actor, or delivery:ID
+	DeliveryID    string     `json:"delivery_id,omitempty"`
+
+	Transaction *Transaction `json:"transaction,omitempty" gorm:"-"`
+}
+
+// Put a transaction in a partner's inbox or outbox. Like the control number
+// ledger this is bookkeeping and never fails the transaction.
+func postToMailbox(ctx context.Context, box, partnerID, transactionID string) {
+	if partnerID == "" || db == nil {
+		return
+	}
+	m := MailboxMessage{PartnerID: partnerID, Box: box, Status: mailboxPending, TransactionID: transactionID}
+	if err := db.WithContext(ctx).Create(&m).Error; err != nil {
+		log.Printf("ERROR: mailbox %s %s: %v\n", partnerID, box, err)
+	}
+}
+
+// Mark the outbox messages of transactions the partner received as pulled
+func collectOutbox(ctx context.Context, partnerID string, transactionIDs []string, by, deliveryID string) {
+	if partnerID == "" || len(transactionIDs) == 0 {
+		return
+	}
+	err := db.WithContext(ctx).Model(&MailboxMessage{}).
+		Where("partner_id = ? AND box = ? AND status = ? AND transaction_id IN ?", partnerID, mailboxOutbox, mailboxPending, transactionIDs).
+		Updates(map[string]interface{}{"status": mailboxPulled, "pulled_at": time.Now(), "pulled_by": by, "delivery_id": deliveryID}).Error
+	if err != nil {
+		log.Printf("ERROR: mailbox %s outbox: %v\n", partnerID, err)
+	}
+}
+
+// Pending documents of one box
+type mailboxCounts struct {
+	Pending       int        `json:"pending"`
+	OldestPending *time.Time `json:"oldest_pending_at,omitempty"`
+	OldestAge     float64    `json:"oldest_pending_age_seconds"`
+}
+
+type mailboxSummary struct {
+	PartnerID string        `json:"partner_id"`
+	Inbox     mailboxCounts `json:"inbox"`
+	Outbox    mailboxCounts `json:"outbox"`
+}
+
+// Pending counts and oldest pending message of each partner's boxes, all
+// partners when partnerID is empty
+func mailboxSummaries(ctx context.Context, partnerID string) ([]mailboxSummary, error) {
+	query := db.WithContext(ctx).Model(&MailboxMessage{}).Select("partner_id, box, count(*) AS n, min(id) AS oldest").
+		Where("status = ?", mailboxPending).Group("partner_id, box").Order("partner_id")
+	if partnerID != "" {
+		query = query.Where("partner_id = ?", partnerID)
+	}
+	var groups []struct {
+		PartnerID string
+		Box       string
+		N         int
+		Oldest    uint
+	}
+	if err := query.Scan(&groups).Error; err != nil {
+		return nil, err
+	}
+	// IDs grow with time, so the lowest pending ID is the oldest message
+	oldestIDs := make([]uint, len(groups))
+	for i, g := range groups {
+		oldestIDs[i] = g.Oldest
+	}
+	created := map[uint]time.Time{}
+	if len(oldestIDs) > 0 {
+		var oldest []MailboxMessage
+		if err := db.WithContext(ctx).Select("id, created_at").Where("id IN ?", oldestIDs).Find(&oldest).Error; err != nil {
+			return nil, err
+		}
+		for _, m := range oldest {
+			created[m.ID] = m.CreatedAt
+		}
+	}
+
+	now := time.Now()
+	summaries := []mailboxSummary{}
+	for _, g := range groups {
+		if len(summaries) == 0 || summaries[len(summaries)-1].PartnerID != g.PartnerID {
+			summaries = append(summaries, mailboxSummary{PartnerID: g.PartnerID})
+		}
+		s := &summaries[len(summaries)-1]
+		counts := &s.Inbox
+		if g.Box == mailboxOutbox {
+			counts = &s.Outbox
+		}
+		counts.Pending = g.N
+		if at, ok := created[g.Oldest]; ok {
+			counts.OldestPending, counts.OldestAge = &at, now.Sub(at).Seconds()
+		}
+	}
+	return summaries, nil
+}
+
+// Summarise the mailboxes of every partner with pending documents
+func listMailboxesHandler(w http.ResponseWriter, r *http.Request) {
+	summaries, err := mailboxSummaries(r.Context(), "")
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch mailboxes", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// Summarise one partner's inbox and outbox
+func getMailboxHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := loadPartner(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	summaries, err := mailboxSummaries(r.Context(), p.ID)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch mailbox", http.StatusInternalServerError)
+		return
+	}
+	summary := mailboxSummary{PartnerID: p.ID}
+	if len(summaries) > 0 {
+		summary = summaries[0]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+const maxMailboxPage = 100
+
+// Box and limit (default 10) of a peek or pull request
+func mailboxRequest(r *http.Request) (box string, limit int, err error) {
+	box = mux.Vars(r)["box"]
+	if box != mailboxInbox && box != mailboxOutbox {
+		return "", 0, errors.New("box must be inbox or outbox")
+	}
+	limit = 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return "", 0, errors.New("limit must be a positive number")
+		}
+	}
+	if limit > maxMailboxPage {
+		limit = maxMailboxPage
+	}
+	return box, limit, nil
+}
+
+// Oldest pending messages of a box, with their transactions
+func pendingMessages(ctx context.Context, partnerID, box string, limit int) ([]MailboxMessage, error) {
+	messages := []MailboxMessage{}
+	err := db.WithContext(ctx).Where("partner_id = ? AND box = ? AND status = ?", partnerID, box, mailboxPending).
+		Order("id").Limit(limit).Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	return messages, attachTransactions(ctx, messages)
+}
+
+func attachTransactions(ctx context.Context, messages []MailboxMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.TransactionID
+	}
+	var txs []Transaction
+	if err := db.WithContext(ctx).Where("id IN ?", ids).Find(&txs).Error; err != nil {
+		return err
+	}
+	if err := readItems(ctx, txs); err != nil {
+		return err
+	}
+	byID := map[string]*Transaction{}
+	for i := range txs {
+		byID[txs[i].ID] = &txs[i]
+	}
+	for i := range messages {
+		messages[i].Transaction = byID[messages[i].TransactionID]
+	}
+	return nil
+}
+
+// List the oldest pending messages of a box without taking them
+func peekMailboxHandler(w http.ResponseWriter, r *http.Request) {
+	box, limit, err := mailboxRequest(r)
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := pendingMessages(r.Context(), mux.Vars(r)["id"], box, limit)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch mailbox", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// Take the oldest pending messages of a box: they are returned once and
+// marked pulled. Concurrent pulls never return the same message.
+func pullMailboxHandler(w http.ResponseWriter, r *http.Request) {
+	box, limit, err := mailboxRequest(r)
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	candidates, err := pendingMessages(r.Context(), mux.Vars(r)["id"], box, limit)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch mailbox", http.StatusInternalServerError)
+		return
+	}
+	actor, _, _ := requestActor(r)
+	now := time.Now()
+	pulled := []MailboxMessage{}
+	for _, m := range candidates {
+		m.Status, m.PulledAt, m.PulledBy = mailboxPulled, &now, actor
+		res := db.WithContext(r.Context()).Model(&m).Where("status = ?", mailboxPending).Select("status", "pulled_at", "pulled_by").Updates(&m)
+		if res.Error != nil {
+			log.Printf("ERROR: %v\n", res.Error)
+			writeProblem(w, "Failed to pull from mailbox", http.StatusInternalServerError)
+			return
+		}
+		if res.RowsAffected == 0 {
+			continue // pulled meanwhile
+		}
+		auditChange(r.Context(), auditUpdate, "mailbox_message", strconv.FormatUint(uint64(m.ID), 10),
+			map[string]string{"status": mailboxPending}, map[string]string{"status": mailboxPulled, "transaction_id": m.TransactionID})
+		pulled = append(pulled, m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pulled)
+}
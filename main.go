@@ -2,95 +2,271 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"github.com/segmentio/kafka-go"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	_ "go.uber.org/automaxprocs"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 // Database connection
 var db *gorm.DB
 
-// Kafka Writer
-var kafkaWriter *kafka.Writer
+// Kafka topic router and writers; nil when running without Kafka
+var kafkaRouter *topicRouter
+
+// Database: postgres, or sqlite to run without a database server, e.g. in
+// tests and local development
+var databaseDriver = getEnv("DATABASE_DRIVER", "postgres")
 
 // Metrics
-var inboundCounter = prometheus.NewCounter(prometheus.CounterOpts{
+var inboundCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "inbound_requests_total",
 	Help: "Total number of inbound EDI transactions.",
-})
-var outboundCounter = prometheus.NewCounter(prometheus.CounterOpts{
+}, []string{"tenant"})
+var outboundCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "outbound_requests_total",
 	Help: "Total number of outbound EDI transactions.",
-})
+}, []string{"tenant"})
 
 // Transaction model for PostgreSQL
 type Transaction struct {
-	ID       string    `json:"id" gorm:"primaryKey"`
-	Date     time.Time `json:"date"`
-	ShipTo   string    `json:"ship_to"`
-	ItemList string    `json:"items"` // JSON string of items
-	Status   string    `json:"status"`
+	ID                 string    `json:"id" gorm:"primaryKey"`
+	TenantID           string    `json:"tenant_id" gorm:"index"`
+	Date               time.Time `json:"date" gorm:"index"`
+	PartnerID          string    `json:"partner_id" gorm:"index"`
+	Type               string    `json:"type,omitempty"`                // X12 transaction set, e.g. 850 or 856
+	ControlNumber      string    `json:"control_number,omitempty"`      // ST02
+	InterchangeControl string    `json:"interchange_control,omitempty"` // ISA13
+	ShipTo             string    `json:"ship_to" gorm:"serializer:encrypted"`
+	Carrier            string    `json:"carrier"`                           // SCAC code
+	BOL                string    `json:"bol"`                               // bill of lading number
+	ItemList           string    `json:"items" gorm:"serializer:encrypted"` // JSON string of items
+	Status             string    `json:"status" gorm:"index"`
+	Origin             string    `json:"origin,omitempty"`                     // edge node that accepted the transaction
+	Format             string    `json:"format,omitempty"`                     // detected inbound format: json, x12, edifact or xml
+	SubmissionID       string    `json:"submission_id,omitempty" gorm:"index"` // multipart submission the transaction arrived in
+	ConfigVersion      uint      `json:"config_version,omitempty"`             // configuration version it was processed with, see ConfigChange
+	SearchText         string    `json:"-"`                                    // words found by text search, see searchText
+
+	// Signature check of the submission it arrived in (see signatureMiddleware)
+	SignatureStatus string     `json:"signature_status,omitempty"` // verified, or unsigned from a partner with a signing_secret
+	Signature       string     `json:"signature,omitempty"`        // X-Signature of the verified request, hex
+	SignatureNonce  string     `json:"signature_nonce,omitempty"`
+	SignedAt        *time.Time `json:"signed_at,omitempty"`   // X-Signature-Timestamp
+	BodySHA256      string     `json:"body_sha256,omitempty"` // hex SHA-256 of the signed body
+
+	// Document rule it matched when received (see DocumentRule) and what the rule set
+	RuleID   uint   `json:"rule_id,omitempty" gorm:"index"`
+	Topic    string `json:"topic,omitempty"` // of its events, before routing
+	Priority string `json:"priority,omitempty"`
+
+	HoldReason string `json:"hold_reason,omitempty"` // why it was saved Held for review, see holds.go
+
+	ack         *functionalAck    // parsed 997 or 999, reconciled once the transaction is saved
+	refs        documentRefs      // header references for the order, shipment and invoice views
+	sender      string            // envelope sender ID (ISA06, UNB02, STX sender), checked against the channel
+	annotations []fieldAnnotation // where each field came from, with mapping debug on
+	set         *X12Set           // X12 set it was translated from, for document rule conditions
+	skipAck     bool              // a document rule turned its acknowledgment off
+	event       *outboxEvent      // its transaction.created event, saved to the outbox with it (see stageEvent)
 }
 
-// Initialize database
-func initDB() error {
+// Connect to the database
+func openDB() error {
 	var err error
-	dsn := "host=postgres user=postgres password=postgres dbname=edi_gateway port=5432 sslmode=disable"
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if edgeMode {
+		db, err = openEdgeDB()
+	} else if databaseDriver == "sqlite" {
+		db, err = gorm.Open(sqlite.Open(getEnv("DATABASE_DSN", "edigateway.db?_journal_mode=WAL&_busy_timeout=5000")), &gorm.Config{})
+	} else if databaseDriver != "postgres" {
+		return fmt.Errorf("DATABASE_DRIVER must be postgres or sqlite, not %q", databaseDriver)
+	} else {
+		dsn := getEnv("DATABASE_DSN", "host=postgres user=postgres password=postgres dbname=edi_gateway port=5432 sslmode=disable")
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err == nil {
+			err = configurePool(db)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	return db.AutoMigrate(&Transaction{})
+	if err := registerTenantScope(db); err != nil {
+		return err
+	}
+	if err := registerBreaker(db); err != nil {
+		return err
+	}
+	return registerFaults(db)
+}
+
+// Initialize database: connect and bring the schema up to date
+func initDB() error {
+	if err := openDB(); err != nil {
+		return err
+	}
+	if edgeMode || databaseDriver == "sqlite" {
+		return db.AutoMigrate(models...)
+	}
+	if migrateOnStart {
+		return runMigrations("up")
+	}
+	return nil
 }
 
 // Initialize Kafka
-func initKafka() {
-	kafkaWriter = kafka.NewWriter(kafka.WriterConfig{
-		Brokers: []string{"broker:9092"},
-		Topic:   "edi_topic",
-		BatchBytes: 200 * 1024 * 1024, // Allow larger batches
-		ErrorLogger: log.New(os.Stderr, "KAFKA ERROR: ", log.LstdFlags), // Log Kafka errors
-	})
+func initKafka() error {
+	classes, err := parseEventTopics(getEnv("KAFKA_EVENT_TOPICS", ""), getEnv("KAFKA_TOPIC", ""))
+	if err != nil {
+		return err
+	}
+	acks, compression, err := checkProducerConfig()
+	if err != nil {
+		return err
+	}
+	kafkaRouter, err = newTopicRouter(splitList(getEnv("KAFKA_BROKERS", "broker:9092")), classes, getEnv("KAFKA_TOPIC_ROUTES", ""))
+	if err != nil {
+		return err
+	}
+	kafkaRouter.acks, kafkaRouter.compression = acks, compression
+	var topics []string
+	for _, base := range kafkaRouter.topics() {
+		for _, topic := range tenantTopics(base) {
+			if err := registerEventSchema(topic); err != nil {
+				return fmt.Errorf("schema registry, topic %s: %w", topic, err)
+			}
+			topics = append(topics, topic)
+		}
+	}
+	checkTopicReplication(context.Background(), acks, kafkaRouter.brokers, topics)
+	if outboundTopic != "" {
+		go runOutboundConsumer(context.Background())
+		go runConsumedEventPurger(context.Background(), time.Hour)
+	}
+	return nil
+}
+
+// Publish a transaction event (skipped when running without events, e.g. at the edge)
+func publishTransaction(ctx context.Context, eventType string, t Transaction) error {
+	return publishEvent(ctx, eventType, t, "")
+}
+
+// Topic of an event about t, in its tenant's topics with KAFKA_TENANT_TOPICS
+func eventTopic(eventType string, t Transaction) string {
+	topic := kafkaRouter.topicFor(eventType, t)
+	if kafkaTenantTopics {
+		topic = t.TenantID + "." + topic
+	}
+	return topic
+}
+
+// Publish an event about t, with what went wrong for failure events
+func publishEvent(ctx context.Context, eventType string, t Transaction, reason string) error {
+	if publisher == nil {
+		return nil
+	}
+	release, err := acquireKafkaSlot(ctx, t.Priority)
+	if err != nil {
+		return err
+	}
+	defer release()
+	topic := eventTopic(eventType, t)
+	msg, err := newEventMessage(ctx, topic, eventType, t, reason)
+	if err != nil {
+		return err
+	}
+	err = publisher.publish(ctx, topic, msg)
+	if err != nil || !eventsReported() {
+		trackPublish(eventType, t, err, time.Now()) // else counted by the delivery report
+		if err == nil {
+			observePublished(msg, time.Now())
+		}
+	}
+	return err
 }
 
 // Handle inbound EDI
 func inboundHandler(w http.ResponseWriter, r *http.Request) {
-	inboundCounter.Inc()
+	// Multi-document submissions are handled like batch uploads
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		batchInboundHandler(w, r)
+		return
+	}
+	if sandboxRequest(r) {
+		sandboxInboundHandler(w, r)
+		return
+	}
+	inboundCounter.WithLabelValues(tenantID(r.Context())).Inc()
 
-	var transaction Transaction
-	if err := json.NewDecoder(r.Body).Decode(&transaction); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	// Large X12 interchanges are parsed as they arrive unless they have to
+	// be stored whole for a queue or job
+	in, err := readInbound(w, r, !queueInbound() && !wantsAsync(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer in.release()
+	contentType := r.Header.Get("Content-Type")
+	if in.stream != nil {
+		writeBatchResults(w, processX12Stream(detachedContext(r), "", contentType, in.stream, r.ContentLength))
 		return
 	}
+	body := in.buf.Bytes()
 
-	// Generate a unique ID for the transaction
-	transaction.ID = uuid.New().String()
-	transaction.Status = "Processed"
-	transaction.Date = time.Now()
+	// Legacy senders often omit or mislabel Content-Type, so sniff the payload.
+	// Anything but a single JSON object is handled like a batch upload.
+	format := detectFormat(contentType, body)
+	if format == "" && contentType != "" {
+		writeProblem(w, "Unsupported Content-Type "+contentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	single := singleJSON(format, body)
 
-	// Save to PostgreSQL
-	if err := db.Create(&transaction).Error; err != nil {
-		log.Printf("ERROR: %v\n", err)
-		http.Error(w, "Failed to save transaction", http.StatusInternalServerError)
+	if queueInbound() {
+		acceptQueued(w, r, nil, []jobFile{newJobFile("", contentType, body)}, true)
 		return
 	}
 
-	// Publish event to Kafka
-	event, _ := json.Marshal(transaction)
-	if err := kafkaWriter.WriteMessages(context.Background(), kafka.Message{Value: event}); err != nil {
-		http.Error(w, "Failed to publish to Kafka", http.StatusInternalServerError)
-		log.Printf("Kafka publish error: %v\n", err)
+	if wantsAsync(r) {
+		kind := jobInbound
+		if !single {
+			kind = jobBatch
+		}
+		callback, err := callbackURL(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		job, err := enqueueJob(r.Context(), kind, nil, []jobFile{newJobFile("", contentType, body)}, callback)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		acceptJob(w, job)
+		return
+	}
+
+	if !single {
+		results := processDocument(detachedContext(r), nil, "", contentType, body)
+		if wantsX12Acks(r) {
+			writeAcks(w, interchangeAcks(contentType, body, results, time.Now(), false), results)
+			return
+		}
+		writeBatchResults(w, results)
+		return
+	}
+
+	transaction, err := ingestJSON(detachedContext(r), contentType, body)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -99,37 +275,332 @@ func inboundHandler(w http.ResponseWriter, r *http.Request) {
 
 // Handle outbound EDI
 func outboundHandler(w http.ResponseWriter, r *http.Request) {
-	outboundCounter.Inc()
+	outboundCounter.WithLabelValues(tenantID(r.Context())).Inc()
 
+	query := db.WithContext(r.Context()).Order("partner_id, date")
+	partnerID := r.URL.Query().Get("partner")
+	if partnerID != "" {
+		query = query.Where("partner_id = ?", partnerID)
+	}
+	flat := r.URL.Query().Get("format") == formatCSV
+	if flat && partnerID == "" {
+		writeProblem(w, "format=csv needs a partner", http.StatusBadRequest)
+		return
+	}
 	var transactions []Transaction
-	if err := db.Find(&transactions).Error; err != nil {
-		http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
+	if err := query.Find(&transactions).Error; err != nil {
+		writeProblem(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+	if err := readItems(r.Context(), transactions); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch line items", http.StatusInternalServerError)
 		return
 	}
+	if flat {
+		writeFlatFile(w, r, partnerID, transactions)
+		return
+	}
+
+	// One interchange per partner, in the partner's outbound format
+	var docs []outboundDocument
+	var partners []Partner
+	contentType := ""
+	for len(transactions) > 0 {
+		n := 1
+		for n < len(transactions) && transactions[n].PartnerID == transactions[0].PartnerID {
+			n++
+		}
+		partner, err := loadPartner(r.Context(), transactions[0].PartnerID)
+		if err != nil {
+			log.Printf("ERROR: partner %q: %v\n", transactions[0].PartnerID, err)
+			settleOutbound(r.Context(), docs, controlVoided, "outbound request failed")
+			writeProblem(w, "Failed to load partner profile", http.StatusInternalServerError)
+			return
+		}
+		doc, err := buildOutbound(r.Context(), partner, transactions[:n])
+		if err != nil {
+			log.Printf("ERROR: %v\n", err)
+			settleOutbound(r.Context(), docs, controlVoided, "outbound request failed")
+			writeProblem(w, "Failed to build interchange: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		ids := make([]string, n)
+		for i, t := range transactions[:n] {
+			ids[i] = t.ID
+		}
+		docs = append(docs, doc)
+		partners = append(partners, partner)
+		if err := archivePayload(r.Context(), "outbound", doc.ContentType, doc.Data, ids...); err != nil {
+			log.Printf("ERROR: archive: %v\n", err)
+			settleOutbound(r.Context(), docs, controlVoided, "archive: "+err.Error())
+			writeProblem(w, "Failed to archive payload", http.StatusInternalServerError)
+			return
+		}
+		if contentType == "" {
+			contentType = doc.ContentType
+		} else if contentType != doc.ContentType {
+			contentType = "text/plain" // partners with different formats
+		}
+		transactions = transactions[n:]
+	}
 
-	for _, t := range transactions {
-		edi := fmt.Sprintf("EDI 856: Shipment %s to %s on %s with items: %s\n",
-			t.ID, t.ShipTo, t.Date.Format("2006-01-02 15:04:05"), t.ItemList)
-		fmt.Fprintln(w, edi)
+	if contentType == "" {
+		contentType = "application/edi-x12"
+	}
+	settleOutbound(r.Context(), docs, controlUsed, "")
+	actor, _, _ := requestActor(r)
+	for i, doc := range docs {
+		expectAck(r.Context(), partners[i], doc, "")
+		collectOutbox(r.Context(), doc.PartnerID, doc.TransactionIDs, actor, "")
+	}
+	w.Header().Set("Content-Type", contentType)
+	for _, doc := range docs {
+		w.Write(doc.Data)
 	}
 }
 
 // Main function
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// Register the gateway's metrics with the default registry
+func registerMetrics() {
+	prometheus.MustRegister(inboundCounter, outboundCounter, archiveSampledOut, throttledCounter, inFlightGauge, dbCircuitOpen, inboundQueued, guardrailViolations, itemsMismatches, acksOverdue, inboundPayloadBytes, inboundOversize, senderMismatches, connectorFiles, signatureFailures, hookCalls, deliveryCircuitOpen, configDrift, idlePartners, retentionRemoved, configVersion, deliveryThrottled, eventsBuffered, eventOutboxPending, partnerTransactions, processingLatency, deliverySLAOutcomes, sloObjective, quotaUsed, quotaLimit, quotaExceeded, outboundDuplicates, documentRuleMatches, holdDecisions, httpPanics, credentialExpiry, faultsInjected, priorityQueueDepth, priorityWait, interchangeRejections, illegalCharacters)
+}
+
+// Run the HTTP server
+func serve() {
 	if err := initDB(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	initKafka()
+	if err := initArchive(); err != nil {
+		log.Fatalf("Failed to initialize archive: %v", err)
+	}
+	go runArchivePurger(context.Background(), time.Hour)
+	if edgeMode {
+		log.Printf("Edge mode: node %s forwarding to %s", edgeNodeID, edgeCentralURL)
+		go runEdgeSync(context.Background())
+	} else {
+		if err := initEvents(); err != nil {
+			log.Fatalf("Failed to initialize events: %v", err)
+		}
+		if err := initInboundQueue(); err != nil {
+			log.Fatalf("Failed to initialize inbound queue: %v", err)
+		}
+		go runInboundQueue(context.Background(), dbBreakerCooldown)
+		go runEventOutbox(context.Background(), time.Second)
+		go runAckMonitor(context.Background(), time.Minute)
+		go runBatchScheduler(context.Background(), time.Minute)
+		go runConnectors(context.Background(), 10*time.Second)
+		go runSavedSearches(context.Background(), 30*time.Second)
+		go runDeliveryRetries(context.Background(), 10*time.Second)
+		go runIdlePartnerCheck(context.Background(), time.Hour)
+		go runCredentialExpiryCheck(context.Background(), time.Hour)
+		go runReconciliationReports(context.Background(), time.Minute)
+		go runRetention(context.Background(), retentionInterval)
+		go runConfigWatch(context.Background(), configReloadInterval)
+		go runConsistencyCheck(allTenantsContext(), heartbeatInterval)
+		go runQuotaRefresh(context.Background(), quotaRefreshInterval)
+	}
+	if reconciliationErr != nil {
+		log.Fatalf("Invalid reconciliation settings: %v", reconciliationErr)
+	}
+	if priorityTypesErr != nil {
+		log.Fatalf("Invalid priority settings: %v", priorityTypesErr)
+	}
+	if reportQueriesErr != nil {
+		log.Fatalf("Invalid report queries: %v", reportQueriesErr)
+	}
+	if fieldKeysErr != nil {
+		log.Fatalf("Invalid field encryption keys: %v", fieldKeysErr)
+	}
+	if !validSenderCheck(senderCheckDflt) {
+		log.Fatalf("INBOUND_SENDER_CHECK must be reject, queue, alert or off, not %q", senderCheckDflt)
+	}
+	if !validItemsStorage(itemsStorage) {
+		log.Fatalf("ITEMS_STORAGE must be json, dual_write, shadow_read or read_rows, not %q", itemsStorage)
+	}
+	if certificationScriptErr != nil {
+		log.Fatalf("Invalid CERTIFICATION_SCRIPT: %v", certificationScriptErr)
+	}
+	if tenantQuotasErr != nil {
+		log.Fatalf("Invalid tenant quotas: %v", tenantQuotasErr)
+	}
+	if bulkInsertBatch < 1 {
+		log.Fatalf("BULK_INSERT_BATCH must be positive, not %d", bulkInsertBatch)
+	}
+	if itemsStorage != itemsJSON {
+		go runItemsChecker(itemsCheckInterval)
+	}
+	initJobs()
 
-	// Register metrics
-	prometheus.MustRegister(inboundCounter, outboundCounter)
+	registerMetrics()
 
 	// Setup router
+	r := newRouter()
+	if err := checkOpenAPI(r); err != nil {
+		log.Fatalf("Invalid API description: %v", err)
+	}
+	r.Use(routeMiddleware...)
+	go runLimiterSweeper(10 * time.Minute)
+	go runNoncePurger(context.Background(), time.Minute)
+	if grpcAddr != "" {
+		go func() {
+			log.Fatalf("gRPC server failed: %v", serveGRPC(grpcAddr))
+		}()
+	}
+
+	log.Printf("Concurrency: GOMAXPROCS=%d requests=%d job workers=%d/%d/%d kafka in-flight=%d/%d/%d (high/normal/low)",
+		cpus, maxConcurrentRequests, jobWorkersHigh, jobWorkers, jobWorkersLow, kafkaMaxInFlightHigh, kafkaMaxInFlight, kafkaMaxInFlightLow)
+	log.Printf("Server running on port 8086")
+	log.Fatal(newHTTPServer(":8086", chain(r, globalMiddleware...)).ListenAndServe())
+}
+
+// Router with every route of the HTTP API, before its middleware
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.NotFoundHandler = correlationMiddleware(http.HandlerFunc(notFoundHandler))
+	r.MethodNotAllowedHandler = correlationMiddleware(http.HandlerFunc(methodNotAllowedHandler))
 	r.HandleFunc("/inbound", inboundHandler).Methods("POST")
+	r.HandleFunc("/inbound/batch", batchInboundHandler).Methods("POST")
+	r.HandleFunc("/validate", validateHandler).Methods("POST")
+	r.HandleFunc("/convert", convertHandler).Methods("POST")
+	r.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET")
+	r.HandleFunc("/submissions/{id}", getSubmissionHandler).Methods("GET")
 	r.HandleFunc("/outbound", outboundHandler).Methods("GET")
-	r.Handle("/metrics", promhttp.Handler())
-
-	log.Printf("Server running on port 8086")
-	log.Fatal(http.ListenAndServe(":8086", r))
-}
\ No newline at end of file
+	r.HandleFunc("/outbound/preview", previewOutboundHandler).Methods("POST")
+	r.HandleFunc("/outbound/drafts", listDraftsHandler).Methods("GET")
+	r.HandleFunc("/outbound/drafts", createDraftHandler).Methods("POST")
+	r.HandleFunc("/outbound/drafts/{id}", getDraftHandler).Methods("GET")
+	r.HandleFunc("/outbound/drafts/{id}", updateDraftHandler).Methods("PUT")
+	r.HandleFunc("/outbound/drafts/{id}/preview", previewDraftHandler).Methods("GET")
+	r.HandleFunc("/outbound/drafts/{id}/approve", approveDraftHandler).Methods("POST")
+	r.HandleFunc("/outbound/drafts/{id}/send", sendDraftHandler).Methods("POST")
+	r.HandleFunc("/edge/sync", edgeSyncHandler).Methods("POST")
+	r.HandleFunc("/as2/mdn", asyncMDNHandler).Methods("POST")
+	r.HandleFunc("/deliveries/{id}", getDeliveryHandler).Methods("GET")
+	r.HandleFunc("/transactions/search", searchTransactionsHandler).Methods("GET")
+	r.HandleFunc("/transactions/export", exportTransactionsHandler).Methods("GET")
+	r.HandleFunc("/transactions/import", importTransactionsHandler).Methods("POST")
+	r.HandleFunc("/transactions/{id}", getTransactionHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/raw", rawPayloadHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/segments", transactionSegmentsHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/pretty", transactionPrettyHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/replay", replayTransactionHandler).Methods("POST")
+	r.HandleFunc("/transactions/{id}/replays", listReplaysHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/deliveries", listTransactionDeliveriesHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/events", listTransactionEventsHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/attachments", listAttachmentsHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/attachments", createAttachmentHandler).Methods("POST")
+	r.HandleFunc("/transactions/{id}/attachments/{attachment}", getAttachmentHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/status-links", listStatusLinksHandler).Methods("GET")
+	r.HandleFunc("/transactions/{id}/status-links", createStatusLinkHandler).Methods("POST")
+	r.HandleFunc("/transactions/{id}/status-links/{link}/revoke", revokeStatusLinkHandler).Methods("POST")
+	r.HandleFunc("/status/{token}", statusPageHandler).Methods("GET")
+	r.HandleFunc("/transactions/replay", bulkReplayHandler).Methods("POST")
+	r.HandleFunc("/audit", listAuditHandler).Methods("GET")
+	r.HandleFunc("/orders", listOrdersHandler).Methods("GET")
+	r.HandleFunc("/orders/{id}", getOrderHandler).Methods("GET")
+	r.HandleFunc("/shipments", listShipmentsHandler).Methods("GET")
+	r.HandleFunc("/shipments/{id}", getShipmentHandler).Methods("GET")
+	r.HandleFunc("/invoices", listInvoicesHandler).Methods("GET")
+	r.HandleFunc("/invoices/{id}", getInvoiceHandler).Methods("GET")
+	r.HandleFunc("/admin/migrations/items", itemsMigrationHandler).Methods("GET")
+	r.HandleFunc("/admin/migrations/items/check", itemsCheckHandler).Methods("POST")
+	r.HandleFunc("/admin/partners/{id}/flush", flushBatchHandler).Methods("POST")
+	r.HandleFunc("/admin/events", listEventsHandler).Methods("GET")
+	r.HandleFunc("/admin/stats", statsHandler).Methods("GET")
+	r.HandleFunc("/admin/instances", clusterConfigHandler).Methods("GET")
+	r.HandleFunc("/admin/quotas", tenantQuotasHandler).Methods("GET")
+	r.HandleFunc("/admin/retention/policies", listRetentionPoliciesHandler).Methods("GET")
+	r.HandleFunc("/admin/retention/policies", createRetentionPolicyHandler).Methods("POST")
+	r.HandleFunc("/admin/retention/policies/{id}", getRetentionPolicyHandler).Methods("GET")
+	r.HandleFunc("/admin/retention/policies/{id}", updateRetentionPolicyHandler).Methods("PUT")
+	r.HandleFunc("/admin/retention/runs", listRetentionRunsHandler).Methods("GET")
+	r.HandleFunc("/admin/retention/runs", triggerRetentionRunHandler).Methods("POST")
+	r.HandleFunc("/admin/retention/runs/{id}", getRetentionRunHandler).Methods("GET")
+	r.HandleFunc("/admin/routing-rules", listRoutingRulesHandler).Methods("GET")
+	r.HandleFunc("/admin/routing-rules", createRoutingRuleHandler).Methods("POST")
+	r.HandleFunc("/admin/routing-rules/{id}", updateRoutingRuleHandler).Methods("PUT")
+	r.HandleFunc("/admin/document-rules", listDocumentRulesHandler).Methods("GET")
+	r.HandleFunc("/admin/document-rules", createDocumentRuleHandler).Methods("POST")
+	r.HandleFunc("/admin/document-rules/{id}", getDocumentRuleHandler).Methods("GET")
+	r.HandleFunc("/admin/document-rules/{id}", updateDocumentRuleHandler).Methods("PUT")
+	r.HandleFunc("/admin/config/versions", listConfigVersionsHandler).Methods("GET")
+	r.HandleFunc("/admin/reload", reloadConfigHandler).Methods("POST")
+	r.HandleFunc("/admin/faults", listFaultsHandler).Methods("GET")
+	r.HandleFunc("/admin/faults/clear", clearFaultsHandler).Methods("POST")
+	r.HandleFunc("/admin/faults/{target}", putFaultHandler).Methods("PUT")
+	r.HandleFunc("/admin/faults/{target}/clear", clearFaultsHandler).Methods("POST")
+	r.HandleFunc("/interchange-rejections", listInterchangeRejectionsHandler).Methods("GET")
+	r.HandleFunc("/interchange-rejections/{id}", getInterchangeRejectionHandler).Methods("GET")
+	r.HandleFunc("/interchange-rejections/{id}/raw", rejectionPayloadHandler).Methods("GET")
+	r.HandleFunc("/reports/reconciliation", reconciliationHandler).Methods("GET")
+	r.HandleFunc("/queries", listReportQueriesHandler).Methods("GET")
+	r.HandleFunc("/queries/{name}", runReportQueryHandler).Methods("GET")
+	r.HandleFunc("/partners", createPartnerHandler).Methods("POST")
+	r.HandleFunc("/partners", listPartnersHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}", getPartnerHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}", updatePartnerHandler).Methods("PUT")
+	r.HandleFunc("/partners/{id}/deactivate", deactivatePartnerHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/reactivate", reactivatePartnerHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/archives", listPartnerArchivesHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/flatfile", getFlatFileProfileHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/flatfile", putFlatFileProfileHandler).Methods("PUT")
+	r.HandleFunc("/partners/{id}/fixedwidth", getFixedWidthLayoutHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/fixedwidth", putFixedWidthLayoutHandler).Methods("PUT")
+	r.HandleFunc("/partners/{id}/schedule", getScheduleHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/schedule", putScheduleHandler).Methods("PUT")
+	r.HandleFunc("/partners/{id}/schedule/occurrences", scheduleOccurrencesHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/schedule.ics", partnerCalendarHandler).Methods("GET")
+	r.HandleFunc("/schedules.ics", calendarHandler).Methods("GET")
+	r.HandleFunc("/mailboxes", listMailboxesHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/mailbox", getMailboxHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/mailbox/{box}", peekMailboxHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/mailbox/{box}/pull", pullMailboxHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/held/release", releaseHeldHandler).Methods("POST")
+	r.HandleFunc("/holds", listHoldsHandler).Methods("GET")
+	r.HandleFunc("/holds/{id}/approve", approveHoldHandler).Methods("POST")
+	r.HandleFunc("/holds/{id}/reject", rejectHoldHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/acks", listAcksHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/control-numbers", listControlNumbersHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/control-numbers/gaps", controlNumberGapsHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/control-numbers/skip", skipControlNumbersHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/control-numbers/{number}/void", voidControlNumberHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/upgrade-report", upgradeReportHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/certifications", createCertificationHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/certifications", listCertificationsHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/certifications/{certification}", getCertificationHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/certifications/{certification}/documents", submitCertificationDocumentHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/credentials", listCredentialsHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/credentials", createCredentialHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/credentials/{credential}", getCredentialHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/credentials/{credential}/rotate", rotateCredentialHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/credentials/{credential}/revoke", revokeCredentialHandler).Methods("POST")
+	r.HandleFunc("/credentials/expiring", expiringCredentialsHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/maps/{direction}", getPartnerMapHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/maps/{direction}", putPartnerMapHandler).Methods("PUT")
+	r.HandleFunc("/partners/{id}/connectors", listConnectorsHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/connectors", createConnectorHandler).Methods("POST")
+	r.HandleFunc("/partners/{id}/connectors/{connector}", getConnectorHandler).Methods("GET")
+	r.HandleFunc("/partners/{id}/connectors/{connector}", updateConnectorHandler).Methods("PUT")
+	r.HandleFunc("/partners/{id}/connectors/{connector}/poll", pollConnectorHandler).Methods("POST")
+	r.HandleFunc("/hooks", listHooksHandler).Methods("GET")
+	r.HandleFunc("/hooks", createHookHandler).Methods("POST")
+	r.HandleFunc("/hooks/{id}", getHookHandler).Methods("GET")
+	r.HandleFunc("/hooks/{id}", updateHookHandler).Methods("PUT")
+	r.HandleFunc("/searches", listSearchesHandler).Methods("GET")
+	r.HandleFunc("/searches", createSearchHandler).Methods("POST")
+	r.HandleFunc("/searches/{id}", getSearchHandler).Methods("GET")
+	r.HandleFunc("/searches/{id}", updateSearchHandler).Methods("PUT")
+	r.HandleFunc("/searches/{id}/results", searchResultsHandler).Methods("GET")
+	r.HandleFunc("/searches/{id}/run", runSearchHandler).Methods("POST")
+	r.Handle("/metrics", metricsHandler())
+	r.HandleFunc("/openapi.json", openAPIHandler).Methods("GET")
+	r.HandleFunc("/schemas", listSchemasHandler).Methods("GET")
+	r.HandleFunc("/schemas/{event_type}", getSchemaHandler).Methods("GET")
+	r.HandleFunc("/docs", docsHandler).Methods("GET")
+	return r
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Versioned translation map between a partner's conventions and the canonical
+// model. Saving a map adds a new version; the latest version is applied.
+type PartnerMap struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	PartnerID string    `json:"partner_id" gorm:"index:idx_partner_map"`
+	Direction string    `json:"direction" gorm:"index:idx_partner_map"` // inbound or outbound
+	Version   int       `json:"version"`
+	Rules     string    `json:"-"` // JSON array of MapRule
+	CreatedAt time.Time `json:"created_at"`
+
+	ParsedRules []MapRule `json:"rules" gorm:"-"`
+}
+
+// One mapping rule, applied in order. The value starts as the current value
+// of Field, is replaced by Source and then Expr when set, is translated through
+// CodeList, and falls back to Default when still empty.
+type MapRule struct {
+	Field    string            `json:"field"`               // canonical field, e.g. ship_to or items.uom
+	Source   string            `json:"source,omitempty"`    // canonical field or X12 reference such as REF*IA.02
+	Expr     string            `json:"expr,omitempty"`      // see evalExpr
+	CodeList map[string]string `json:"code_list,omitempty"` // partner code -> canonical code (or reverse outbound)
+	Default  string            `json:"default,omitempty"`
+}
+
+// Canonical fields addressable by rules
+var (
+	headerFields = []string{"ship_to", "carrier", "bol", "type"}
+	itemFields   = []string{"sku", "description", "quantity", "uom", "po_number", "carton", "weight"}
+)
+
+// Latest map for a partner and direction, or nil when none is configured
+func loadPartnerMap(ctx context.Context, partnerID, direction string) (*PartnerMap, error) {
+	if partnerID == "" || db == nil {
+		return nil, nil
+	}
+	var m PartnerMap
+	res := db.WithContext(ctx).Where("partner_id = ? AND direction = ?", partnerID, direction).Order("version DESC").Limit(1).Find(&m)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	if err := json.Unmarshal([]byte(m.Rules), &m.ParsedRules); err != nil {
+		return nil, fmt.Errorf("partner %s %s map v%d: %w", partnerID, direction, m.Version, err)
+	}
+	return &m, nil
+}
+
+// Apply the partner's map for direction to t. set is the source X12
+// transaction set for inbound documents and may be nil.
+func applyPartnerMap(ctx context.Context, direction string, t *Transaction, set *X12Set) error {
+	m, err := loadPartnerMap(ctx, t.PartnerID, direction)
+	if err != nil || m == nil {
+		return err
+	}
+	trace := ""
+	if mappingDebug(ctx) {
+		trace = fmt.Sprintf("%s map v%d", direction, m.Version)
+	}
+	return applyRules(m.ParsedRules, t, set, trace)
+}
+
+// Apply rules in order. With trace naming the rules' map, every field they
+// set is annotated on t, and so is the rule that fails.
+func applyRules(rules []MapRule, t *Transaction, set *X12Set, trace string) error {
+	items, err := t.Items()
+	if err != nil {
+		return err
+	}
+	for n, rule := range rules {
+		annotate := func(field, before, v string, err error) {
+			if trace == "" {
+				return
+			}
+			a := fieldAnnotation{Field: field, Value: v, Before: before, Map: trace, Rule: n + 1, MapRule: &rules[n]}
+			if err != nil {
+				a.Value, a.Error = "", err.Error()
+			}
+			t.annotations = append(t.annotations, a)
+		}
+		if name, ok := strings.CutPrefix(rule.Field, "items."); ok {
+			for i := range items {
+				it := &items[i]
+				lookup := func(f string) (string, bool) {
+					if n, ok := strings.CutPrefix(f, "items."); ok {
+						f = n
+					}
+					if v, ok := itemField(it, f); ok {
+						return v, true
+					}
+					return headerField(t, f)
+				}
+				before, _ := itemField(it, name)
+				v, err := evalRule(rule, name, lookup, set)
+				if err == nil {
+					err = setItemField(it, name, v)
+				}
+				annotate(fmt.Sprintf("items[%d].%s", i, name), before, v, err)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		lookup := func(f string) (string, bool) { return headerField(t, f) }
+		before, _ := headerField(t, rule.Field)
+		v, err := evalRule(rule, rule.Field, lookup, set)
+		if err == nil {
+			err = setHeaderField(t, rule.Field, v)
+		}
+		annotate(rule.Field, before, v, err)
+		if err != nil {
+			return err
+		}
+	}
+	if items != nil {
+		list, err := json.Marshal(items)
+		if err != nil {
+			return err
+		}
+		t.ItemList = string(list)
+	}
+	return nil
+}
+
+// Compute the new value of one field
+func evalRule(rule MapRule, field string, lookup func(string) (string, bool), set *X12Set) (string, error) {
+	v, ok := lookup(field)
+	if !ok {
+		return "", fmt.Errorf("map rule: unknown field %q", rule.Field)
+	}
+	if rule.Source != "" {
+		if src, isX12 := x12Ref(rule.Source, set); isX12 {
+			v = src
+		} else if v, ok = lookup(rule.Source); !ok {
+			return "", fmt.Errorf("map rule %s: unknown source %q", rule.Field, rule.Source)
+		}
+	}
+	if rule.Expr != "" {
+		vars := func(name string) (string, bool) {
+			if name == "value" {
+				return v, true
+			}
+			return lookup(name)
+		}
+		var err error
+		if v, err = evalExpr(rule.Expr, vars); err != nil {
+			return "", fmt.Errorf("map rule %s: %w", rule.Field, err)
+		}
+	}
+	if mapped, ok := rule.CodeList[v]; ok {
+		v = mapped
+	}
+	if v == "" {
+		v = rule.Default
+	}
+	return v, nil
+}
+
+// Resolve an X12 reference of the form SEG.NN or SEG*QUAL.NN (first segment
+// whose first element is QUAL) against the source transaction set
+func x12Ref(ref string, set *X12Set) (string, bool) {
+	segPart, pos, ok := strings.Cut(ref, ".")
+	n, err := strconv.Atoi(pos)
+	if !ok || err != nil || strings.ToUpper(segPart) != segPart {
+		return "", false
+	}
+	id, qual, _ := strings.Cut(segPart, "*")
+	if set == nil {
+		return "", true
+	}
+	for _, seg := range set.Segments {
+		if seg[0] == id && (qual == "" || seg.el(1) == qual) {
+			return seg.el(n), true
+		}
+	}
+	return "", true
+}
+
+func headerField(t *Transaction, name string) (string, bool) {
+	switch name {
+	case "ship_to":
+		return t.ShipTo, true
+	case "carrier":
+		return t.Carrier, true
+	case "bol":
+		return t.BOL, true
+	case "type":
+		return t.Type, true
+	}
+	return "", false
+}
+
+func setHeaderField(t *Transaction, name, v string) error {
+	switch name {
+	case "ship_to":
+		t.ShipTo = v
+	case "carrier":
+		t.Carrier = v
+	case "bol":
+		t.BOL = v
+	case "type":
+		t.Type = v
+	default:
+		return fmt.Errorf("map rule: unknown field %q", name)
+	}
+	return nil
+}
+
+func itemField(it *Item, name string) (string, bool) {
+	switch name {
+	case "sku":
+		return it.SKU, true
+	case "description":
+		return it.Description, true
+	case "quantity":
+		return formatQty(it.Quantity), true
+	case "uom":
+		return it.UOM, true
+	case "po_number":
+		return it.PONumber, true
+	case "carton":
+		return it.Carton, true
+	case "weight":
+		return formatQty(it.Weight), true
+	}
+	return "", false
+}
+
+func setItemField(it *Item, name, v string) error {
+	switch name {
+	case "sku":
+		it.SKU = v
+	case "description":
+		it.Description = v
+	case "uom":
+		it.UOM = v
+	case "po_number":
+		it.PONumber = v
+	case "carton":
+		it.Carton = v
+	case "quantity", "weight":
+		f := 0.0
+		if v != "" {
+			var err error
+			if f, err = strconv.ParseFloat(v, 64); err != nil {
+				return fmt.Errorf("map rule items.%s: %q is not a number", name, v)
+			}
+		}
+		if name == "quantity" {
+			it.Quantity = f
+		} else {
+			it.Weight = f
+		}
+	default:
+		return fmt.Errorf("map rule: unknown field items.%s", name)
+	}
+	return nil
+}
+
+// Check that every rule targets a known field
+func validateRules(rules []MapRule) error {
+	known := map[string]bool{}
+	for _, f := range headerFields {
+		known[f] = true
+	}
+	for _, f := range itemFields {
+		known["items."+f] = true
+	}
+	for i, r := range rules {
+		if !known[r.Field] {
+			return fmt.Errorf("rule %d: unknown field %q", i+1, r.Field)
+		}
+		if r.Expr != "" {
+			if _, err := tokenize(r.Expr); err != nil {
+				return fmt.Errorf("rule %d: %v", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+func mapDirection(r *http.Request) (string, bool) {
+	d := mux.Vars(r)["direction"]
+	return d, d == "inbound" || d == "outbound"
+}
+
+// Fetch the current map for a partner and direction
+func getPartnerMapHandler(w http.ResponseWriter, r *http.Request) {
+	direction, ok := mapDirection(r)
+	if !ok {
+		writeProblem(w, "Direction must be inbound or outbound", http.StatusBadRequest)
+		return
+	}
+	m, err := loadPartnerMap(r.Context(), mux.Vars(r)["id"], direction)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch map", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		writeProblem(w, "Map not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// Save a new version of a partner's map
+func putPartnerMapHandler(w http.ResponseWriter, r *http.Request) {
+	direction, ok := mapDirection(r)
+	if !ok {
+		writeProblem(w, "Direction must be inbound or outbound", http.StatusBadRequest)
+		return
+	}
+	partnerID := mux.Vars(r)["id"]
+	if _, err := loadPartner(r.Context(), partnerID); errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	var body struct {
+		Rules []MapRule `json:"rules"`
+	}
+	if err := decodeJSON(w, r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateRules(body.Rules); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rules, _ := json.Marshal(body.Rules)
+	m := PartnerMap{PartnerID: partnerID, Direction: direction, Rules: string(rules), ParsedRules: body.Rules}
+	var latest PartnerMap
+	err := db.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		tx.Where("partner_id = ? AND direction = ?", partnerID, direction).Order("version DESC").Limit(1).Find(&latest)
+		m.Version = latest.Version + 1
+		return tx.Create(&m).Error
+	})
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save map", http.StatusInternalServerError)
+		return
+	}
+	var before interface{}
+	if latest.Version > 0 {
+		json.Unmarshal([]byte(latest.Rules), &latest.ParsedRules)
+		before = latest
+	}
+	auditChange(r.Context(), auditAction(before != nil), "partner_map", partnerID+"/"+direction, before, m)
+	recordConfigChange(r.Context(), "partner_map", partnerID+"/"+direction)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
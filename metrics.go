@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Command line runs exit before a scrape would see them: they push their
+// metrics to a Pushgateway and/or a remote write endpoint instead, every
+// METRICS_PUSH_INTERVAL and when they finish
+var (
+	metricsPushURL        = getEnv("METRICS_PUSH_URL", "")
+	metricsRemoteWriteURL = getEnv("METRICS_REMOTE_WRITE_URL", "")
+	metricsPushJob        = getEnv("METRICS_PUSH_JOB", "edi_gateway")
+	metricsPushInterval   = getEnvDuration("METRICS_PUSH_INTERVAL", 15*time.Second)
+	metricsOpenMetrics    = getEnvBool("METRICS_OPENMETRICS", true)
+)
+
+// Registered by command line runs only: the push groups them by command
+var (
+	commandDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edi_command_duration_seconds",
+		Help: "How long the last run of the command took.",
+	})
+	commandLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edi_command_last_success_timestamp_seconds",
+		Help: "When the last successful run of the command finished.",
+	})
+	commandLastFailure = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edi_command_last_failure_timestamp_seconds",
+		Help: "When the last failed run of the command finished.",
+	})
+)
+
+var metricsClient = &http.Client{Timeout: 10 * time.Second}
+
+// Pushes the metrics of one command line run
+type metricsPusher struct {
+	command  string
+	instance string
+	started  time.Time
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Register the metrics and start pushing them for command, or nil when no
+// push target is configured
+func startMetricsPush(command string) *metricsPusher {
+	if metricsPushURL == "" && metricsRemoteWriteURL == "" {
+		return nil
+	}
+	registerMetrics()
+	prometheus.MustRegister(commandDuration, commandLastSuccess, commandLastFailure)
+	instance, _ := os.Hostname()
+	p := &metricsPusher{command: command, instance: instance, started: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		if metricsPushInterval <= 0 {
+			<-p.stop
+			return
+		}
+		ticker := time.NewTicker(metricsPushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.push()
+			}
+		}
+	}()
+	return p
+}
+
+// Stop the periodic pushes and push the outcome of the run
+func (p *metricsPusher) finish(err error) {
+	close(p.stop)
+	<-p.done
+	now := time.Now()
+	commandDuration.Set(now.Sub(p.started).Seconds())
+	if err == nil {
+		commandLastSuccess.Set(float64(now.Unix()))
+	} else {
+		commandLastFailure.Set(float64(now.Unix()))
+	}
+	p.push()
+}
+
+// Push to every configured target, logging failures: a run does not fail
+// for want of metrics
+func (p *metricsPusher) push() {
+	if metricsPushURL != "" {
+		// Add rather than replace: a failed run keeps the last success time
+		err := push.New(metricsPushURL, metricsPushJob).Gatherer(prometheus.DefaultGatherer).
+			Grouping("command", p.command).Grouping("instance", p.instance).Client(metricsClient).Add()
+		if err != nil {
+			log.Printf("ERROR: pushing metrics: %v\n", err)
+		}
+	}
+	if metricsRemoteWriteURL != "" {
+		if err := p.remoteWrite(); err != nil {
+			log.Printf("ERROR: remote write of metrics: %v\n", err)
+		}
+	}
+}
+
+// Send the current value of every series in a Prometheus remote write
+// (1.0) request, labelled with the job, instance and command
+func (p *metricsPusher) remoteWrite() error {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	extra := []*dto.LabelPair{labelPair("job", metricsPushJob), labelPair("instance", p.instance), labelPair("command", p.command)}
+	body := snappy.Encode(nil, writeRequest(mfs, extra, time.Now().UnixMilli()))
+	ctx, cancel := context.WithTimeout(context.Background(), metricsClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metricsRemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "edi_gateway")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := metricsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
+
+// Encode a remote write WriteRequest holding one sample per series at ts.
+// Histograms and summaries are split into the series a scrape stores:
+// _bucket (cumulative, with le="+Inf") or quantiles, _sum and _count.
+func writeRequest(mfs []*dto.MetricFamily, extra []*dto.LabelPair, ts int64) []byte {
+	var b []byte
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				b = appendSeries(b, name, m.Label, extra, m.GetCounter().GetValue(), ts)
+			case dto.MetricType_GAUGE:
+				b = appendSeries(b, name, m.Label, extra, m.GetGauge().GetValue(), ts)
+			case dto.MetricType_UNTYPED:
+				b = appendSeries(b, name, m.Label, extra, m.GetUntyped().GetValue(), ts)
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bucket := range h.Bucket {
+					le := labelPair("le", strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64))
+					b = appendSeries(b, name+"_bucket", append(m.Label[:len(m.Label):len(m.Label)], le), extra, float64(bucket.GetCumulativeCount()), ts)
+				}
+				b = appendSeries(b, name+"_bucket", append(m.Label[:len(m.Label):len(m.Label)], labelPair("le", "+Inf")), extra, float64(h.GetSampleCount()), ts)
+				b = appendSeries(b, name+"_sum", m.Label, extra, h.GetSampleSum(), ts)
+				b = appendSeries(b, name+"_count", m.Label, extra, float64(h.GetSampleCount()), ts)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					quantile := labelPair("quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64))
+					b = appendSeries(b, name, append(m.Label[:len(m.Label):len(m.Label)], quantile), extra, q.GetValue(), ts)
+				}
+				b = appendSeries(b, name+"_sum", m.Label, extra, s.GetSampleSum(), ts)
+				b = appendSeries(b, name+"_count", m.Label, extra, float64(s.GetSampleCount()), ts)
+			}
+		}
+	}
+	return b
+}
+
+// Append a TimeSeries (field 1 of WriteRequest) with its labels sorted by
+// name, as remote write requires. Extra labels the metric already has are
+// left out.
+func appendSeries(b []byte, name string, labels, extra []*dto.LabelPair, value float64, ts int64) []byte {
+	pairs := map[string]string{"__name__": name}
+	for _, l := range labels {
+		pairs[l.GetName()] = l.GetValue()
+	}
+	for _, l := range extra {
+		if _, ok := pairs[l.GetName()]; !ok && l.GetValue() != "" {
+			pairs[l.GetName()] = l.GetValue()
+		}
+	}
+	names := make([]string, 0, len(pairs))
+	for n := range pairs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var series []byte
+	for _, n := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, n)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, pairs[n])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, series)
+}
+
+// First gather that saw each counter, histogram and summary series. A
+// series missing from a gather was created after it, so its created time is
+// that of the gather before the one that first saw it (the start of the
+// process for the first).
+var seriesCreated = struct {
+	sync.Mutex
+	last time.Time
+	seen map[string]time.Time
+}{last: time.Now(), seen: map[string]time.Time{}}
+
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		b.WriteString("\xff" + l.GetName() + "\xff" + l.GetValue())
+	}
+	return b.String()
+}
+
+// Created times of the series of mfs, forgetting series that went away
+func createdTimes(mfs []*dto.MetricFamily) map[string]time.Time {
+	seriesCreated.Lock()
+	defer seriesCreated.Unlock()
+	seen := map[string]time.Time{}
+	for _, mf := range mfs {
+		if mf.GetType() == dto.MetricType_GAUGE || mf.GetType() == dto.MetricType_UNTYPED {
+			continue
+		}
+		for _, m := range mf.Metric {
+			key := seriesKey(mf.GetName(), m.Label)
+			if t, ok := seriesCreated.seen[key]; ok {
+				seen[key] = t
+			} else {
+				seen[key] = seriesCreated.last
+			}
+		}
+	}
+	seriesCreated.seen, seriesCreated.last = seen, time.Now()
+	return seen
+}
+
+var openMetricsLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write mfs in OpenMetrics, following each counter, histogram and summary
+// with its _created sample. The client library cannot write those, so each
+// metric is encoded on its own and the family's metadata kept from the
+// first.
+func writeOpenMetrics(w io.Writer, mfs []*dto.MetricFamily, created map[string]time.Time) error {
+	for _, mf := range mfs {
+		if mf.GetType() == dto.MetricType_GAUGE || mf.GetType() == dto.MetricType_UNTYPED {
+			if _, err := expfmt.MetricFamilyToOpenMetrics(w, mf); err != nil {
+				return err
+			}
+			continue
+		}
+		family := strings.TrimSuffix(mf.GetName(), "_total")
+		if mf.GetType() != dto.MetricType_COUNTER {
+			family = mf.GetName()
+		}
+		for i, m := range mf.Metric {
+			var buf bytes.Buffer
+			one := &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: []*dto.Metric{m}}
+			if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, one); err != nil {
+				return err
+			}
+			lines := bufio.NewScanner(&buf)
+			for lines.Scan() {
+				if i > 0 && strings.HasPrefix(lines.Text(), "# ") {
+					continue
+				}
+				fmt.Fprintln(w, lines.Text())
+			}
+			t, ok := created[seriesKey(mf.GetName(), m.Label)]
+			if !ok {
+				continue
+			}
+			labels := make([]string, len(m.Label))
+			for j, l := range m.Label {
+				labels[j] = l.GetName() + `="` + openMetricsLabelValue.Replace(l.GetValue()) + `"`
+			}
+			set := ""
+			if len(labels) > 0 {
+				set = "{" + strings.Join(labels, ",") + "}"
+			}
+			fmt.Fprintf(w, "%s_created%s %s\n", family, set, strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64))
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+// Serve the registered metrics: in OpenMetrics, with created timestamps,
+// to scrapers that ask for it (unless METRICS_OPENMETRICS=false), else in
+// the Prometheus text format
+func metricsHandler() http.Handler {
+	text := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !metricsOpenMetrics || expfmt.NegotiateIncludingOpenMetrics(r.Header) != expfmt.FmtOpenMetrics {
+			text.ServeHTTP(w, r)
+			return
+		}
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			log.Printf("ERROR: gathering metrics: %v\n", err)
+			http.Error(w, "Failed to gather metrics", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if err := writeOpenMetrics(&buf, mfs, createdTimes(mfs)); err != nil {
+			log.Printf("ERROR: encoding metrics: %v\n", err)
+			http.Error(w, "Failed to encode metrics", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtOpenMetrics))
+		w.Write(buf.Bytes())
+	})
+}
+
+// Service level series: inbound outcomes and receive→publish latency per
+// partner, and deliveries settled within the partner's delivery SLA. Latency
+// observations carry the trace ID of their transaction as an exemplar,
+// exposed to OpenMetrics scrapes.
+var (
+	deliverySLA             = getEnvDuration("DELIVERY_SLA", time.Hour)
+	sloSuccessObjective     = getEnvFloat("SLO_SUCCESS_OBJECTIVE", 0.999)
+	sloDeliverySLAObjective = getEnvFloat("SLO_DELIVERY_SLA_OBJECTIVE", 0.99)
+)
+
+var (
+	partnerTransactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edi_partner_transactions_total",
+		Help: "Inbound transactions processed, by outcome (success or failure).",
+	}, []string{"tenant", "partner", "outcome"})
+	processingLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "edi_processing_latency_seconds",
+		Help:    "Time from receiving an inbound transaction to publishing its transaction.created event.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"tenant", "partner"})
+	deliverySLAOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edi_delivery_sla_total",
+		Help: "Outbound deliveries settled, by whether they were delivered within the partner's SLA (met or missed).",
+	}, []string{"tenant", "partner", "outcome"})
+	sloObjective = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edi_slo_objective",
+		Help: "Target ratio of each service level objective, for burn rate queries.",
+	}, []string{"slo"})
+)
+
+func init() {
+	sloObjective.WithLabelValues("success").Set(sloSuccessObjective)
+	sloObjective.WithLabelValues("delivery_sla").Set(sloDeliverySLAObjective)
+}
+
+// Count an inbound transaction towards its partner's success ratio
+func countTransactionOutcome(ctx context.Context, t Transaction, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	partnerTransactions.WithLabelValues(tenantID(ctx), t.PartnerID, outcome).Inc()
+}
+
+// Observe the receive→publish latency of a published transaction.created
+// event from the headers of its message
+func observePublished(msg kafka.Message, now time.Time) {
+	if messageHeader(msg, "event_type") != eventTransactionCreated {
+		return
+	}
+	received, err := time.Parse(time.RFC3339Nano, messageHeader(msg, "transaction_date"))
+	if err != nil {
+		return
+	}
+	o := processingLatency.WithLabelValues(messageHeader(msg, "tenant_id"), messageHeader(msg, "partner_id"))
+	v := now.Sub(received).Seconds()
+	id := traceIDOf(messageHeader(msg, "traceparent"), messageHeader(msg, "correlation_id"))
+	// Exemplar labels are limited to 128 characters of valid UTF-8
+	if id == "" || len(id) > 64 || !utf8.ValidString(id) {
+		o.Observe(v)
+		return
+	}
+	o.(prometheus.ExemplarObserver).ObserveWithExemplar(v, prometheus.Labels{"trace_id": id})
+}
+
+// Count a settled delivery against the partner's delivery SLA, from the
+// oldest of its transactions: delivery_sla_minutes, or DELIVERY_SLA when 0
+// (which then only tracks partners that set one); negative tracks none
+func countDeliverySLA(p Partner, d Delivery, txs []Transaction, now time.Time) {
+	sla := deliverySLA
+	if p.DeliverySLAMinutes > 0 {
+		sla = time.Duration(p.DeliverySLAMinutes) * time.Minute
+	}
+	if sla <= 0 || p.DeliverySLAMinutes < 0 || len(txs) == 0 {
+		return
+	}
+	oldest := txs[0].Date
+	for _, t := range txs[1:] {
+		if t.Date.Before(oldest) {
+			oldest = t.Date
+		}
+	}
+	outcome := "missed"
+	if d.Status == deliveryDelivered && now.Sub(oldest) <= sla {
+		outcome = "met"
+	}
+	deliverySLAOutcomes.WithLabelValues(p.TenantID, p.ID, outcome).Inc()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"compress/gzip"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Wraps a handler in some behaviour shared by many routes
+type middleware func(http.Handler) http.Handler
+
+// Middleware of every request before it is routed, outermost first: it
+// also sees unknown paths and CORS preflights
+var globalMiddleware = []middleware{recoveryMiddleware, corsMiddleware, gzipMiddleware}
+
+// Middleware of the requests a route matched, outermost first: it sees the
+// route's template
+var routeMiddleware = []mux.MiddlewareFunc{
+	correlationMiddleware, tenantMiddleware, partnerHintMiddleware, rateLimitMiddleware,
+	concurrencyMiddleware, signatureMiddleware, auditMiddleware,
+}
+
+// Wrap h in mws, the first outermost
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Server timeouts; the read and write ones cover whole requests and
+// responses, so they leave room for large interchanges
+var (
+	httpReadHeaderTimeout = getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second)
+	httpReadTimeout       = getEnvDuration("HTTP_READ_TIMEOUT", 5*time.Minute)
+	httpWriteTimeout      = getEnvDuration("HTTP_WRITE_TIMEOUT", 10*time.Minute)
+	httpIdleTimeout       = getEnvDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+)
+
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
+
+var httpPanics = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "edi_http_panics_total",
+	Help: "Requests whose handler panicked, answered 500.",
+})
+
+// Response writer noting whether the response was started
+type recoveryResponseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *recoveryResponseWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoveryResponseWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Turn a panicking handler into a 500 and log its stack; a response already
+// started is cut short instead
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoveryResponseWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			httpPanics.Inc()
+			log.Printf("ERROR: panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+			if rw.started {
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Browser-based admin UIs on other origins; CORS is off while
+// CORS_ALLOWED_ORIGINS is empty, * allows any origin
+var (
+	corsOrigins = splitList(getEnv("CORS_ALLOWED_ORIGINS", ""))
+	corsHeaders = getEnv("CORS_ALLOWED_HEADERS",
+		"Content-Type, Accept, X-API-Key, X-Actor, X-Tenant-ID, X-Partner-ID, X-Correlation-ID, X-Request-ID, X-Callback-URL, Prefer, traceparent")
+	corsExposed = getEnv("CORS_EXPOSED_HEADERS",
+		"X-Correlation-ID, X-Submission-ID, X-Payload-SHA256, X-Archived-At, X-Control-Number, Content-Disposition, Retry-After")
+	corsMaxAge = getEnvDuration("CORS_MAX_AGE", 10*time.Minute)
+)
+
+func corsAllowed(origin string) bool {
+	for _, o := range corsOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer CORS preflights and let allowed origins read responses
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(corsOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !corsAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			h.Set("Access-Control-Allow-Headers", corsHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge/time.Second)))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposed)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Responses of at least this many bytes are gzipped for clients accepting
+// it; negative turns compression off
+var gzipMinSize = getEnvInt("HTTP_GZIP_MIN_SIZE", 1024)
+
+// Response writer holding the start of the body until it knows whether to
+// compress it: the body reached gzipMinSize and is not compressed already
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	plain  bool // written as it is
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(b)
+	case w.plain:
+		return w.ResponseWriter.Write(b)
+	case !compressible(w.Header(), w.status):
+		w.plain = true
+		w.ResponseWriter.WriteHeader(w.status)
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= gzipMinSize {
+		h := w.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		buf := w.buf
+		w.buf = nil
+		if _, err := w.gz.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Finish the response: the gzip trailer, or the short body as it is
+func (w *gzipResponseWriter) close() {
+	switch {
+	case w.gz != nil:
+		if err := w.gz.Close(); err != nil {
+			log.Printf("ERROR: gzip: %v\n", err)
+		}
+	case !w.plain:
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+		if len(w.buf) > 0 {
+			w.ResponseWriter.Write(w.buf)
+		}
+	}
+}
+
+// Whether a response with these headers is worth compressing
+func compressible(h http.Header, status int) bool {
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ct := strings.ToLower(h.Get("Content-Type"))
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip", "application/pdf", "text/event-stream"} {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// Gzip responses for clients that accept it. A panicking handler leaves
+// its response unfinished for recoveryMiddleware.
+func gzipMiddleware(next http.Handler) http.Handler {
+	if gzipMinSize < 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+		gw.close()
+	})
+}
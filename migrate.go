@@ -0,0 +1,43 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"log"
+
+	"github.com/pressly/goose/v3"
+)
+
+// Versioned SQL migrations for the central PostgreSQL database. Add a new
+// numbered file for every schema change; edge nodes keep using AutoMigrate on
+// their local SQLite database.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Apply pending migrations at startup unless disabled, e.g. when migrations
+// run as a separate deploy step
+var migrateOnStart = getEnvBool("MIGRATE_ON_START", true)
+
+// Every persisted model, for AutoMigrate on edge nodes
+var models = []interface{}{
+	&Transaction{}, &Partner{}, &RawPayload{}, &Job{}, &PartnerMap{}, &Delivery{}, &Replay{}, &Submission{}, &ConsumedEvent{}, &LineItem{}, &FlatFileProfile{}, &FixedWidthLayout{}, &AuditEntry{}, &ControlNumber{}, &OutboundAck{}, &OutboundAckTransaction{}, &DeliveryTransaction{}, &PartnerSchedule{}, &MailboxMessage{}, &Order{}, &Shipment{}, &Invoice{}, &Connector{}, &RequestNonce{}, &SavedSearch{}, &Attachment{}, &WorkflowHook{}, &StatusLink{}, &InstanceHeartbeat{}, &TransactionEvent{}, &PartnerArchive{}, &RetentionPolicy{}, &RetentionRun{}, &ConfigChange{}, &RoutingRule{}, &EventOutbox{}, &Certification{}, &DocumentRule{}, &OutboundDraft{}, &PartnerCredential{}, &ReconciliationReport{}, &InterchangeRejection{},
+}
+
+// Run a goose command (up, down, status, version, redo, up-to N, down-to N)
+// against the central database
+func runMigrations(command string, args ...string) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	goose.SetBaseFS(migrationsFS)
+	goose.SetLogger(log.Default())
+	if err := goose.SetDialect("postgres"); err != nil {
+		return err
+	}
+	if err := goose.Run(command, sqlDB, "migrations", args...); err != nil {
+		return fmt.Errorf("migrate %s: %w", command, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+-- Schema as previously created by GORM AutoMigrate. IF NOT EXISTS lets
+-- databases created by AutoMigrate adopt migrations without changes.
+
+-- +goose Up
+CREATE TABLE IF NOT EXISTS transactions (
+    id text PRIMARY KEY,
+    date timestamptz,
+    partner_id text,
+    type text,
+    control_number text,
+    interchange_control text,
+    ship_to text,
+    carrier text,
+    bol text,
+    item_list text,
+    status text,
+    origin text,
+    format text,
+    submission_id text
+);
+CREATE INDEX IF NOT EXISTS idx_transactions_partner_id ON transactions (partner_id);
+CREATE INDEX IF NOT EXISTS idx_transactions_submission_id ON transactions (submission_id);
+CREATE INDEX IF NOT EXISTS idx_transactions_date ON transactions (date);
+CREATE INDEX IF NOT EXISTS idx_transactions_status ON transactions (status);
+
+CREATE TABLE IF NOT EXISTS partners (
+    id text PRIMARY KEY,
+    name text,
+    isa_qualifier text,
+    isa_id text,
+    gs_id text,
+    x12_version text,
+    asn_hierarchy text,
+    asn_required text,
+    control_number bigint,
+    archive_sample decimal,
+    api_key text,
+    rate_limit decimal,
+    rate_burst bigint,
+    delivery_url text,
+    as2_id text,
+    as2_certificate text,
+    mdn_mode text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_partners_api_key ON partners (api_key);
+CREATE INDEX IF NOT EXISTS idx_partners_as2_id ON partners (as2_id);
+CREATE INDEX IF NOT EXISTS idx_partners_isa_id ON partners (isa_id);
+
+CREATE TABLE IF NOT EXISTS raw_payloads (
+    id bigserial PRIMARY KEY,
+    transaction_id text,
+    direction text,
+    content_type text,
+    storage_key text,
+    size bigint,
+    sha256 text,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_raw_payloads_transaction_id ON raw_payloads (transaction_id);
+CREATE INDEX IF NOT EXISTS idx_raw_payloads_created_at ON raw_payloads (created_at);
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id text PRIMARY KEY,
+    kind text,
+    status text,
+    http_status bigint,
+    result text,
+    error text,
+    callback_url text,
+    correlation_id text,
+    submission_id text,
+    created_at timestamptz,
+    updated_at timestamptz,
+    completed_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs (status);
+
+CREATE TABLE IF NOT EXISTS partner_maps (
+    id bigserial PRIMARY KEY,
+    partner_id text,
+    direction text,
+    version bigint,
+    rules text,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_partner_map ON partner_maps (partner_id, direction);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+    id text PRIMARY KEY,
+    partner_id text,
+    transaction_ids text,
+    interchange_control text,
+    url text,
+    status text,
+    http_status bigint,
+    error text,
+    message_id text,
+    mic text,
+    mdn_disposition text,
+    mdn_signed boolean,
+    mdn_received_at timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_deliveries_partner_id ON deliveries (partner_id);
+CREATE INDEX IF NOT EXISTS idx_deliveries_message_id ON deliveries (message_id);
+CREATE INDEX IF NOT EXISTS idx_deliveries_status ON deliveries (status);
+
+CREATE TABLE IF NOT EXISTS replays (
+    id bigserial PRIMARY KEY,
+    transaction_id text,
+    target text,
+    actor text,
+    client_ip text,
+    reason text,
+    status text,
+    error text,
+    delivery_id text,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_replays_transaction_id ON replays (transaction_id);
+
+CREATE TABLE IF NOT EXISTS submissions (
+    id text PRIMARY KEY,
+    partner_id text,
+    reference text,
+    metadata text,
+    documents bigint,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_submissions_partner_id ON submissions (partner_id);
+CREATE INDEX IF NOT EXISTS idx_submissions_reference ON submissions (reference);
+
+-- +goose Down
+DROP TABLE IF EXISTS submissions;
+DROP TABLE IF EXISTS replays;
+DROP TABLE IF EXISTS deliveries;
+DROP TABLE IF EXISTS partner_maps;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS raw_payloads;
+DROP TABLE IF EXISTS partners;
+DROP TABLE IF EXISTS transactions;
@@ -0,0 +1,15 @@
+-- Outbound requests consumed from Kafka, deduplicated by event ID
+
+-- +goose Up
+CREATE TABLE consumed_events (
+    event_id text PRIMARY KEY,
+    partner_id text,
+    transaction_id text,
+    delivery_id text,
+    delivery_status text,
+    error text,
+    created_at timestamptz
+);
+
+-- +goose Down
+DROP TABLE consumed_events;
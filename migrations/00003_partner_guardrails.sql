@@ -0,0 +1,11 @@
+-- Per-partner document size and volume guardrails
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN max_document_size bigint;
+ALTER TABLE partners ADD COLUMN max_documents_per_hour bigint;
+ALTER TABLE partners ADD COLUMN guardrail_action text;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN guardrail_action;
+ALTER TABLE partners DROP COLUMN max_documents_per_hour;
+ALTER TABLE partners DROP COLUMN max_document_size;
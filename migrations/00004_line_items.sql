@@ -0,0 +1,20 @@
+-- Row form of transactions.item_list, filled by dual writes and the
+-- consistency checker while ITEMS_STORAGE migrates reads over
+
+-- +goose Up
+CREATE TABLE line_items (
+    id bigserial PRIMARY KEY,
+    transaction_id text,
+    line bigint,
+    sku text,
+    description text,
+    quantity decimal,
+    uom text,
+    po_number text,
+    carton text,
+    weight decimal
+);
+CREATE INDEX idx_line_items_transaction_id ON line_items (transaction_id);
+
+-- +goose Down
+DROP TABLE line_items;
@@ -0,0 +1,15 @@
+-- Per-partner layouts for delimited flat files
+
+-- +goose Up
+CREATE TABLE flat_file_profiles (
+    partner_id text PRIMARY KEY,
+    delimiter text,
+    header boolean,
+    group_by text,
+    type text,
+    columns text,
+    updated_at timestamptz
+);
+
+-- +goose Down
+DROP TABLE flat_file_profiles;
@@ -0,0 +1,15 @@
+-- Per-partner layouts for fixed-width (positional) files
+
+-- +goose Up
+CREATE TABLE fixed_width_layouts (
+    partner_id text PRIMARY KEY,
+    type text,
+    record_type_start bigint,
+    record_type_length bigint,
+    records text,
+    rules text,
+    updated_at timestamptz
+);
+
+-- +goose Down
+DROP TABLE fixed_width_layouts;
@@ -0,0 +1,42 @@
+-- Tenant of every row; existing rows belong to the default tenant
+
+-- +goose Up
+ALTER TABLE transactions ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE partners ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE raw_payloads ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE jobs ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE partner_maps ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE deliveries ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE replays ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE submissions ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE consumed_events ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE line_items ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE flat_file_profiles ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE fixed_width_layouts ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+
+CREATE INDEX idx_transactions_tenant_id ON transactions (tenant_id);
+CREATE INDEX idx_partners_tenant_id ON partners (tenant_id);
+CREATE INDEX idx_raw_payloads_tenant_id ON raw_payloads (tenant_id);
+CREATE INDEX idx_jobs_tenant_id ON jobs (tenant_id);
+CREATE INDEX idx_partner_maps_tenant_id ON partner_maps (tenant_id);
+CREATE INDEX idx_deliveries_tenant_id ON deliveries (tenant_id);
+CREATE INDEX idx_replays_tenant_id ON replays (tenant_id);
+CREATE INDEX idx_submissions_tenant_id ON submissions (tenant_id);
+CREATE INDEX idx_consumed_events_tenant_id ON consumed_events (tenant_id);
+CREATE INDEX idx_line_items_tenant_id ON line_items (tenant_id);
+CREATE INDEX idx_flat_file_profiles_tenant_id ON flat_file_profiles (tenant_id);
+CREATE INDEX idx_fixed_width_layouts_tenant_id ON fixed_width_layouts (tenant_id);
+
+-- +goose Down
+ALTER TABLE fixed_width_layouts DROP COLUMN tenant_id;
+ALTER TABLE flat_file_profiles DROP COLUMN tenant_id;
+ALTER TABLE line_items DROP COLUMN tenant_id;
+ALTER TABLE consumed_events DROP COLUMN tenant_id;
+ALTER TABLE submissions DROP COLUMN tenant_id;
+ALTER TABLE replays DROP COLUMN tenant_id;
+ALTER TABLE deliveries DROP COLUMN tenant_id;
+ALTER TABLE partner_maps DROP COLUMN tenant_id;
+ALTER TABLE jobs DROP COLUMN tenant_id;
+ALTER TABLE raw_payloads DROP COLUMN tenant_id;
+ALTER TABLE partners DROP COLUMN tenant_id;
+ALTER TABLE transactions DROP COLUMN tenant_id;
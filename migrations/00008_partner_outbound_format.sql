@@ -0,0 +1,7 @@
+-- Format of the interchanges generated for a partner
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN outbound_format text;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN outbound_format;
@@ -0,0 +1,43 @@
+-- Append-only audit log of changes
+
+-- +goose Up
+CREATE TABLE audit_entries (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    actor text,
+    partner_id text,
+    api_key text,
+    client_ip text,
+    method text,
+    endpoint text,
+    path text,
+    action text,
+    resource_type text,
+    resource_id text,
+    before text,
+    after text,
+    status bigint,
+    correlation_id text,
+    created_at timestamptz
+);
+CREATE INDEX idx_audit_entries_tenant_id ON audit_entries (tenant_id);
+CREATE INDEX idx_audit_entries_actor ON audit_entries (actor);
+CREATE INDEX idx_audit_entries_action ON audit_entries (action);
+CREATE INDEX idx_audit_entries_resource_id ON audit_entries (resource_id);
+CREATE INDEX idx_audit_entries_created_at ON audit_entries (created_at);
+
+-- +goose StatementBegin
+CREATE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_entries is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER audit_entries_append_only
+    BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_entries
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_entries_append_only();
+
+-- +goose Down
+DROP TABLE audit_entries;
+DROP FUNCTION audit_entries_append_only();
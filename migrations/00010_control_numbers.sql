@@ -0,0 +1,20 @@
+-- Ledger of reserved, used, voided and skipped interchange control numbers
+
+-- +goose Up
+CREATE TABLE control_numbers (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    number bigint,
+    status text,
+    delivery_id text,
+    reason text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE UNIQUE INDEX idx_control_numbers_partner_number ON control_numbers (partner_id, number);
+CREATE INDEX idx_control_numbers_tenant_id ON control_numbers (tenant_id);
+CREATE INDEX idx_control_numbers_status ON control_numbers (status);
+
+-- +goose Down
+DROP TABLE control_numbers;
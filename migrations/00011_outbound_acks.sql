@@ -0,0 +1,27 @@
+-- Functional acknowledgments expected for outbound interchanges
+
+-- +goose Up
+CREATE TABLE outbound_acks (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    control_number bigint,
+    delivery_id text,
+    transaction_ids text,
+    status text,
+    sent_at timestamptz,
+    due_at timestamptz,
+    ack_transaction_id text,
+    acked_at timestamptz,
+    alerted_at timestamptz,
+    error text
+);
+CREATE UNIQUE INDEX idx_outbound_acks_partner_control ON outbound_acks (partner_id, control_number);
+CREATE INDEX idx_outbound_acks_tenant_id ON outbound_acks (tenant_id);
+CREATE INDEX idx_outbound_acks_status ON outbound_acks (status);
+CREATE INDEX idx_outbound_acks_due_at ON outbound_acks (due_at);
+ALTER TABLE partners ADD COLUMN ack_sla_minutes bigint;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN ack_sla_minutes;
+DROP TABLE outbound_acks;
@@ -0,0 +1,14 @@
+-- Delivery windows, maintenance windows and batch cutoffs per partner
+
+-- +goose Up
+CREATE TABLE partner_schedules (
+    partner_id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    time_zone text,
+    windows text,
+    updated_at timestamptz
+);
+CREATE INDEX idx_partner_schedules_tenant_id ON partner_schedules (tenant_id);
+
+-- +goose Down
+DROP TABLE partner_schedules;
@@ -0,0 +1,21 @@
+-- Partner inbox and outbox
+
+-- +goose Up
+CREATE TABLE mailbox_messages (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    box text,
+    status text,
+    transaction_id text,
+    created_at timestamptz,
+    pulled_at timestamptz,
+    pulled_by text,
+    delivery_id text
+);
+CREATE INDEX idx_mailbox_messages_box ON mailbox_messages (partner_id, box, status);
+CREATE INDEX idx_mailbox_messages_tenant_id ON mailbox_messages (tenant_id);
+CREATE INDEX idx_mailbox_messages_transaction_id ON mailbox_messages (transaction_id);
+
+-- +goose Down
+DROP TABLE mailbox_messages;
@@ -0,0 +1,9 @@
+-- Scheduled batching of outbound documents
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN batch_outbound boolean NOT NULL DEFAULT false;
+ALTER TABLE partner_schedules ADD COLUMN last_flush_at timestamptz;
+
+-- +goose Down
+ALTER TABLE partner_schedules DROP COLUMN last_flush_at;
+ALTER TABLE partners DROP COLUMN batch_outbound;
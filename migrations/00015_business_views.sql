@@ -0,0 +1,72 @@
+-- Order, shipment and invoice read models
+
+-- +goose Up
+CREATE TABLE orders (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    po_number text,
+    status text,
+    order_transaction_id text,
+    ordered_quantity decimal,
+    shipped_quantity decimal,
+    invoiced_quantity decimal,
+    history text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE UNIQUE INDEX idx_orders_partner_po ON orders (partner_id, po_number);
+CREATE INDEX idx_orders_tenant_id ON orders (tenant_id);
+CREATE INDEX idx_orders_status ON orders (status);
+CREATE INDEX idx_orders_updated_at ON orders (updated_at);
+
+CREATE TABLE shipments (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    transaction_id text,
+    shipment_number text,
+    bol text,
+    carrier text,
+    ship_to text,
+    po_numbers text,
+    cartons text,
+    carton_count bigint,
+    lines bigint,
+    quantity decimal,
+    status text,
+    shipped_at timestamptz,
+    updated_at timestamptz
+);
+CREATE UNIQUE INDEX idx_shipments_transaction_id ON shipments (transaction_id);
+CREATE INDEX idx_shipments_tenant_id ON shipments (tenant_id);
+CREATE INDEX idx_shipments_partner_id ON shipments (partner_id);
+CREATE INDEX idx_shipments_shipment_number ON shipments (shipment_number);
+CREATE INDEX idx_shipments_status ON shipments (status);
+CREATE INDEX idx_shipments_shipped_at ON shipments (shipped_at);
+
+CREATE TABLE invoices (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    transaction_id text,
+    invoice_number text,
+    po_number text,
+    lines bigint,
+    quantity decimal,
+    status text,
+    invoiced_at timestamptz,
+    updated_at timestamptz
+);
+CREATE UNIQUE INDEX idx_invoices_transaction_id ON invoices (transaction_id);
+CREATE INDEX idx_invoices_tenant_id ON invoices (tenant_id);
+CREATE INDEX idx_invoices_partner_id ON invoices (partner_id);
+CREATE INDEX idx_invoices_invoice_number ON invoices (invoice_number);
+CREATE INDEX idx_invoices_po_number ON invoices (po_number);
+CREATE INDEX idx_invoices_status ON invoices (status);
+CREATE INDEX idx_invoices_invoiced_at ON invoices (invoiced_at);
+
+-- +goose Down
+DROP TABLE invoices;
+DROP TABLE shipments;
+DROP TABLE orders;
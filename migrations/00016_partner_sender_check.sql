@@ -0,0 +1,9 @@
+-- Checking document senders against the partner authenticated by the channel
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN sender_check text;
+ALTER TABLE partners ADD COLUMN allowed_senders text;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN allowed_senders;
+ALTER TABLE partners DROP COLUMN sender_check;
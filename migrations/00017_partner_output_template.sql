@@ -0,0 +1,9 @@
+-- Outbound documents rendered from a partner's own template
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN output_template text;
+ALTER TABLE partners ADD COLUMN output_content_type text;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN output_content_type;
+ALTER TABLE partners DROP COLUMN output_template;
@@ -0,0 +1,32 @@
+-- FTP(S) and directory connectors polled for partner files
+
+-- +goose Up
+CREATE TABLE connectors (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    kind text,
+    address text,
+    implicit_tls boolean NOT NULL DEFAULT false,
+    ca_certificate text,
+    username text,
+    password text,
+    path text,
+    file_pattern text,
+    temp_suffixes text,
+    done_suffix text,
+    quarantine_path text,
+    content_type text,
+    max_attempts bigint NOT NULL DEFAULT 0,
+    poll_seconds bigint NOT NULL DEFAULT 0,
+    disabled boolean NOT NULL DEFAULT false,
+    last_poll_at timestamptz,
+    last_error text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_connectors_tenant_id ON connectors (tenant_id);
+CREATE INDEX idx_connectors_partner_id ON connectors (partner_id);
+
+-- +goose Down
+DROP TABLE connectors;
@@ -0,0 +1,19 @@
+-- Signed submissions: partner signing secrets and the nonces already used
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN signing_secret text;
+ALTER TABLE partners ADD COLUMN require_signature boolean NOT NULL DEFAULT false;
+CREATE TABLE request_nonces (
+    partner_id text NOT NULL,
+    nonce text NOT NULL,
+    tenant_id text NOT NULL DEFAULT 'default',
+    expires_at timestamptz,
+    PRIMARY KEY (partner_id, nonce)
+);
+CREATE INDEX idx_request_nonces_tenant_id ON request_nonces (tenant_id);
+CREATE INDEX idx_request_nonces_expires_at ON request_nonces (expires_at);
+
+-- +goose Down
+DROP TABLE request_nonces;
+ALTER TABLE partners DROP COLUMN require_signature;
+ALTER TABLE partners DROP COLUMN signing_secret;
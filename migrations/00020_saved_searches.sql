@@ -0,0 +1,29 @@
+-- Saved transaction searches, optionally run on a schedule
+
+-- +goose Up
+CREATE TABLE saved_searches (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    name text,
+    filter_partner_id text,
+    filter_type text,
+    filter_status text,
+    filter_format text,
+    filter_older_than text,
+    filter_newer_than text,
+    filter_unacked boolean NOT NULL DEFAULT false,
+    every_minutes bigint NOT NULL DEFAULT 0,
+    notify_webhook text,
+    notify_slack text,
+    notify_email text,
+    disabled boolean NOT NULL DEFAULT false,
+    last_run_at timestamptz,
+    last_count bigint NOT NULL DEFAULT 0,
+    last_error text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_saved_searches_tenant_id ON saved_searches (tenant_id);
+
+-- +goose Down
+DROP TABLE saved_searches;
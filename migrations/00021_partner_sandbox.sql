@@ -0,0 +1,7 @@
+-- Sandbox mode: partners whose inbound documents are only validated
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN sandbox boolean NOT NULL DEFAULT false;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN sandbox;
@@ -0,0 +1,22 @@
+-- Supporting files attached to transactions
+
+-- +goose Up
+CREATE TABLE attachments (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    transaction_id text,
+    file_name text,
+    content_type text,
+    kind text,
+    description text,
+    size bigint NOT NULL DEFAULT 0,
+    sha256 text,
+    storage_key text,
+    uploaded_by text,
+    created_at timestamptz
+);
+CREATE INDEX idx_attachments_tenant_id ON attachments (tenant_id);
+CREATE INDEX idx_attachments_transaction_id ON attachments (transaction_id);
+
+-- +goose Down
+DROP TABLE attachments;
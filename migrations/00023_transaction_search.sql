@@ -0,0 +1,22 @@
+-- Text search over transactions, and the indexes of the structured filters
+
+-- +goose Up
+ALTER TABLE transactions ADD COLUMN search_text text;
+ALTER TABLE transactions ADD COLUMN search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', coalesce(search_text, ''))) STORED;
+CREATE INDEX idx_transactions_search_vector ON transactions USING gin (search_vector);
+CREATE INDEX idx_transactions_control_number ON transactions (control_number);
+CREATE INDEX idx_transactions_interchange_control ON transactions (interchange_control);
+CREATE INDEX idx_transactions_type_date ON transactions (type, date);
+ALTER TABLE saved_searches ADD COLUMN filter_control_number text;
+ALTER TABLE saved_searches ADD COLUMN filter_q text;
+
+-- +goose Down
+ALTER TABLE saved_searches DROP COLUMN filter_q;
+ALTER TABLE saved_searches DROP COLUMN filter_control_number;
+DROP INDEX idx_transactions_type_date;
+DROP INDEX idx_transactions_interchange_control;
+DROP INDEX idx_transactions_control_number;
+DROP INDEX idx_transactions_search_vector;
+ALTER TABLE transactions DROP COLUMN search_vector;
+ALTER TABLE transactions DROP COLUMN search_text;
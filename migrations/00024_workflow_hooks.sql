@@ -0,0 +1,23 @@
+-- Synchronous policy webhooks called before transactions are saved or delivered
+
+-- +goose Up
+CREATE TABLE workflow_hooks (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    name text,
+    point text,
+    partner_id text,
+    url text,
+    secret text,
+    timeout_ms bigint NOT NULL DEFAULT 0,
+    fail_open boolean NOT NULL DEFAULT false,
+    position bigint NOT NULL DEFAULT 0,
+    disabled boolean NOT NULL DEFAULT false,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_workflow_hooks_tenant_id ON workflow_hooks (tenant_id);
+CREATE INDEX idx_workflow_hooks_partner_id ON workflow_hooks (partner_id);
+
+-- +goose Down
+DROP TABLE workflow_hooks;
@@ -0,0 +1,21 @@
+-- Retry policy of outbound deliveries and the attempt history
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN delivery_max_attempts bigint NOT NULL DEFAULT 0;
+ALTER TABLE partners ADD COLUMN delivery_backoff_seconds bigint NOT NULL DEFAULT 0;
+ALTER TABLE partners ADD COLUMN delivery_jitter decimal NOT NULL DEFAULT 0;
+ALTER TABLE deliveries ADD COLUMN attempt bigint NOT NULL DEFAULT 1;
+ALTER TABLE deliveries ADD COLUMN first_delivery_id text;
+ALTER TABLE deliveries ADD COLUMN next_attempt_at timestamptz;
+CREATE INDEX idx_deliveries_first_delivery_id ON deliveries (first_delivery_id);
+CREATE INDEX idx_deliveries_next_attempt_at ON deliveries (next_attempt_at) WHERE next_attempt_at IS NOT NULL;
+
+-- +goose Down
+DROP INDEX idx_deliveries_next_attempt_at;
+DROP INDEX idx_deliveries_first_delivery_id;
+ALTER TABLE deliveries DROP COLUMN next_attempt_at;
+ALTER TABLE deliveries DROP COLUMN first_delivery_id;
+ALTER TABLE deliveries DROP COLUMN attempt;
+ALTER TABLE partners DROP COLUMN delivery_jitter;
+ALTER TABLE partners DROP COLUMN delivery_backoff_seconds;
+ALTER TABLE partners DROP COLUMN delivery_max_attempts;
@@ -0,0 +1,22 @@
+-- Shareable links to the status of a transaction
+
+-- +goose Up
+CREATE TABLE status_links (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    transaction_id text,
+    token_hash text,
+    note text,
+    created_by text,
+    expires_at timestamptz,
+    revoked_at timestamptz,
+    views bigint NOT NULL DEFAULT 0,
+    last_viewed_at timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX idx_status_links_tenant_id ON status_links (tenant_id);
+CREATE INDEX idx_status_links_transaction_id ON status_links (transaction_id);
+CREATE UNIQUE INDEX idx_status_links_token_hash ON status_links (token_hash);
+
+-- +goose Down
+DROP TABLE status_links;
@@ -0,0 +1,15 @@
+-- Heartbeats of the gateway replicas, compared by the consistency check
+
+-- +goose Up
+CREATE TABLE instance_heartbeats (
+    instance_id text PRIMARY KEY,
+    build text,
+    schema bigint NOT NULL DEFAULT 0,
+    settings text,
+    started_at timestamptz,
+    seen_at timestamptz
+);
+CREATE INDEX idx_instance_heartbeats_seen_at ON instance_heartbeats (seen_at);
+
+-- +goose Down
+DROP TABLE instance_heartbeats;
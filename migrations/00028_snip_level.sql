@@ -0,0 +1,7 @@
+-- SNIP validation level of a partner's HIPAA transaction sets
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN snip_level bigint NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN snip_level;
@@ -0,0 +1,36 @@
+-- Append-only stream of transaction state changes
+
+-- +goose Up
+CREATE TABLE transaction_events (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    transaction_id text,
+    type text,
+    status text,
+    actor text,
+    delta text,
+    created_at timestamptz
+);
+CREATE INDEX idx_transaction_events_tenant_id ON transaction_events (tenant_id);
+CREATE INDEX idx_transaction_events_transaction_id ON transaction_events (transaction_id);
+CREATE INDEX idx_transaction_events_created_at ON transaction_events (created_at);
+
+-- Streams of existing transactions start from their current status
+INSERT INTO transaction_events (tenant_id, transaction_id, type, status, actor, delta, created_at)
+SELECT tenant_id, id, 'imported', status, 'system', '{}', date FROM transactions;
+
+-- +goose StatementBegin
+CREATE FUNCTION transaction_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'transaction_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER transaction_events_append_only
+    BEFORE UPDATE OR DELETE OR TRUNCATE ON transaction_events
+    FOR EACH STATEMENT EXECUTE FUNCTION transaction_events_append_only();
+
+-- +goose Down
+DROP TABLE transaction_events;
+DROP FUNCTION transaction_events_append_only();
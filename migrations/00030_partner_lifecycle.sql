@@ -0,0 +1,27 @@
+-- Idle and deactivated partners, and the configuration archived when one
+-- is deactivated
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN status text NOT NULL DEFAULT 'active';
+ALTER TABLE partners ADD COLUMN idle_since timestamptz;
+ALTER TABLE partners ADD COLUMN deactivated_at timestamptz;
+ALTER TABLE partners ADD COLUMN deactivation_reason text;
+
+CREATE TABLE partner_archives (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    reason text,
+    actor text,
+    config text,
+    created_at timestamptz
+);
+CREATE INDEX idx_partner_archives_tenant_id ON partner_archives (tenant_id);
+CREATE INDEX idx_partner_archives_partner_id ON partner_archives (partner_id);
+
+-- +goose Down
+DROP TABLE partner_archives;
+ALTER TABLE partners DROP COLUMN deactivation_reason;
+ALTER TABLE partners DROP COLUMN deactivated_at;
+ALTER TABLE partners DROP COLUMN idle_since;
+ALTER TABLE partners DROP COLUMN status;
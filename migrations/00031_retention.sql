@@ -0,0 +1,56 @@
+-- Retention policies and runs. Retention runs may delete the events of the
+-- transactions they expire; everything else still cannot touch them.
+
+-- +goose Up
+CREATE TABLE retention_policies (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text NOT NULL DEFAULT '',
+    type text NOT NULL DEFAULT '',
+    keep_days bigint NOT NULL,
+    archive text,
+    disabled boolean NOT NULL DEFAULT false,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_retention_policies_tenant_id ON retention_policies (tenant_id);
+
+CREATE TABLE retention_runs (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    slot timestamptz,
+    trigger text,
+    actor text,
+    dry_run boolean NOT NULL DEFAULT false,
+    status text,
+    transactions bigint NOT NULL DEFAULT 0,
+    results text,
+    error text,
+    started_at timestamptz,
+    finished_at timestamptz
+);
+CREATE INDEX idx_retention_runs_tenant_id ON retention_runs (tenant_id);
+CREATE UNIQUE INDEX idx_retention_runs_slot ON retention_runs (tenant_id, slot);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION transaction_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' AND current_setting('edigateway.retention', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+    RAISE EXCEPTION 'transaction_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION transaction_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'transaction_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TABLE retention_runs;
+DROP TABLE retention_policies;
@@ -0,0 +1,32 @@
+-- Configuration versions, routing rules kept in the database, and the
+-- version each transaction was processed with
+
+-- +goose Up
+CREATE TABLE config_changes (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    resource_type text,
+    resource_id text,
+    actor text,
+    created_at timestamptz
+);
+CREATE INDEX idx_config_changes_tenant_id ON config_changes (tenant_id);
+
+CREATE TABLE routing_rules (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    type text,
+    topic text,
+    disabled boolean NOT NULL DEFAULT false,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_routing_rules_tenant_id ON routing_rules (tenant_id);
+
+ALTER TABLE transactions ADD COLUMN config_version bigint;
+
+-- +goose Down
+ALTER TABLE transactions DROP COLUMN config_version;
+DROP TABLE routing_rules;
+DROP TABLE config_changes;
@@ -0,0 +1,7 @@
+-- Bandwidth cap of a partner's deliveries
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN delivery_bandwidth bigint NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN delivery_bandwidth;
@@ -0,0 +1,20 @@
+-- Events written asynchronously to Kafka, kept until Kafka confirms them
+
+-- +goose Up
+CREATE TABLE event_outboxes (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    topic text,
+    key text,
+    headers text,
+    value text,
+    attempts bigint NOT NULL DEFAULT 0,
+    last_error text,
+    claimed_until timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX idx_event_outboxes_tenant_id ON event_outboxes (tenant_id);
+CREATE INDEX idx_event_outboxes_claimed_until ON event_outboxes (claimed_until);
+
+-- +goose Down
+DROP TABLE event_outboxes;
@@ -0,0 +1,7 @@
+-- Delivery SLA of a partner's outbound transactions
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN delivery_sla_minutes bigint NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN delivery_sla_minutes;
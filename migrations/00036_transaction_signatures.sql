@@ -0,0 +1,15 @@
+-- Signature check of the submission each transaction arrived in
+
+-- +goose Up
+ALTER TABLE transactions ADD COLUMN signature_status text;
+ALTER TABLE transactions ADD COLUMN signature text;
+ALTER TABLE transactions ADD COLUMN signature_nonce text;
+ALTER TABLE transactions ADD COLUMN signed_at timestamptz;
+ALTER TABLE transactions ADD COLUMN body_sha256 text;
+
+-- +goose Down
+ALTER TABLE transactions DROP COLUMN body_sha256;
+ALTER TABLE transactions DROP COLUMN signed_at;
+ALTER TABLE transactions DROP COLUMN signature_nonce;
+ALTER TABLE transactions DROP COLUMN signature;
+ALTER TABLE transactions DROP COLUMN signature_status;
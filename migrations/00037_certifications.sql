@@ -0,0 +1,24 @@
+-- Partner certification runs and their outcome on the partner
+
+-- +goose Up
+CREATE TABLE certifications (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    status text,
+    step bigint NOT NULL DEFAULT 0,
+    po_number text,
+    results text,
+    created_at timestamptz,
+    completed_at timestamptz
+);
+CREATE INDEX idx_certifications_tenant_id ON certifications (tenant_id);
+CREATE INDEX idx_certifications_partner_id ON certifications (partner_id);
+CREATE INDEX idx_certifications_status ON certifications (status);
+ALTER TABLE partners ADD COLUMN certification_status text;
+ALTER TABLE partners ADD COLUMN certified_at timestamptz;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN certified_at;
+ALTER TABLE partners DROP COLUMN certification_status;
+DROP TABLE certifications;
@@ -0,0 +1,18 @@
+-- Idempotency keys and positions of consumed outbound requests, forgotten
+-- after KAFKA_OUTBOUND_DEDUP_TTL
+
+-- +goose Up
+ALTER TABLE consumed_events ADD COLUMN idempotency_key text;
+ALTER TABLE consumed_events ADD COLUMN topic text;
+ALTER TABLE consumed_events ADD COLUMN partition bigint NOT NULL DEFAULT 0;
+ALTER TABLE consumed_events ADD COLUMN "offset" bigint NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX idx_consumed_events_idempotency_key ON consumed_events (partner_id, idempotency_key);
+CREATE INDEX idx_consumed_events_created_at ON consumed_events (created_at);
+
+-- +goose Down
+DROP INDEX idx_consumed_events_created_at;
+DROP INDEX idx_consumed_events_idempotency_key;
+ALTER TABLE consumed_events DROP COLUMN "offset";
+ALTER TABLE consumed_events DROP COLUMN partition;
+ALTER TABLE consumed_events DROP COLUMN topic;
+ALTER TABLE consumed_events DROP COLUMN idempotency_key;
@@ -0,0 +1,31 @@
+-- Document rules and the rule each received transaction matched
+
+-- +goose Up
+CREATE TABLE document_rules (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    name text,
+    position bigint NOT NULL DEFAULT 0,
+    partner_id text,
+    type text,
+    conditions text,
+    topic text,
+    auto_acknowledge boolean,
+    hold boolean NOT NULL DEFAULT false,
+    priority text,
+    disabled boolean NOT NULL DEFAULT false,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_document_rules_tenant_id ON document_rules (tenant_id);
+ALTER TABLE transactions ADD COLUMN rule_id bigint;
+ALTER TABLE transactions ADD COLUMN topic text;
+ALTER TABLE transactions ADD COLUMN priority text;
+CREATE INDEX idx_transactions_rule_id ON transactions (rule_id);
+
+-- +goose Down
+DROP INDEX idx_transactions_rule_id;
+ALTER TABLE transactions DROP COLUMN priority;
+ALTER TABLE transactions DROP COLUMN topic;
+ALTER TABLE transactions DROP COLUMN rule_id;
+DROP TABLE document_rules;
@@ -0,0 +1,7 @@
+-- Why a transaction was held for review
+
+-- +goose Up
+ALTER TABLE transactions ADD COLUMN hold_reason text;
+
+-- +goose Down
+ALTER TABLE transactions DROP COLUMN hold_reason;
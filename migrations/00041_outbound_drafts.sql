@@ -0,0 +1,33 @@
+-- Outbound documents composed, approved and sent through the API
+
+-- +goose Up
+CREATE TABLE outbound_drafts (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    type text,
+    ship_to text,
+    carrier text,
+    bol text,
+    item_list text,
+    status text,
+    composed_by text,
+    approved_by text,
+    approved_at timestamptz,
+    sent_by text,
+    sent_at timestamptz,
+    transaction_id text,
+    delivery_id text,
+    delivery_status text,
+    error text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_outbound_drafts_tenant_id ON outbound_drafts (tenant_id);
+CREATE INDEX idx_outbound_drafts_partner_id ON outbound_drafts (partner_id);
+CREATE INDEX idx_outbound_drafts_status ON outbound_drafts (status);
+ALTER TABLE partners ADD COLUMN outbound_approval boolean NOT NULL DEFAULT false;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN outbound_approval;
+DROP TABLE outbound_drafts;
@@ -0,0 +1,7 @@
+-- Archive key of a job result too large to keep in the database
+
+-- +goose Up
+ALTER TABLE jobs ADD COLUMN result_key text;
+
+-- +goose Down
+ALTER TABLE jobs DROP COLUMN result_key;
@@ -0,0 +1,30 @@
+-- Partner secrets, certificates and public keys with expiry and rotation
+
+-- +goose Up
+CREATE TABLE partner_credentials (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    kind text,
+    name text,
+    value text,
+    ref text,
+    fingerprint text,
+    subject text,
+    issuer text,
+    not_before timestamptz,
+    expires_at timestamptz,
+    status text,
+    retires_at timestamptz,
+    replaced_by bigint,
+    expiry_alert text,
+    created_by text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_partner_credentials_tenant_id ON partner_credentials (tenant_id);
+CREATE INDEX idx_partner_credentials_partner_id ON partner_credentials (partner_id);
+CREATE INDEX idx_partner_credentials_status ON partner_credentials (status);
+
+-- +goose Down
+DROP TABLE partner_credentials;
@@ -0,0 +1,17 @@
+-- Daily reconciliation reports and where partners get theirs
+
+-- +goose Up
+CREATE TABLE reconciliation_reports (
+    id bigserial PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    date text,
+    partners text,
+    generated_at timestamptz,
+    notified_at timestamptz
+);
+CREATE UNIQUE INDEX idx_reconciliation_reports_tenant_date ON reconciliation_reports (tenant_id, date);
+ALTER TABLE partners ADD COLUMN reconciliation_email text;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN reconciliation_email;
+DROP TABLE reconciliation_reports;
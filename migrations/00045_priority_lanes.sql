@@ -0,0 +1,9 @@
+-- Partner priorities and the priority lane of each job
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN priority text;
+ALTER TABLE jobs ADD COLUMN priority text;
+
+-- +goose Down
+ALTER TABLE jobs DROP COLUMN priority;
+ALTER TABLE partners DROP COLUMN priority;
@@ -0,0 +1,27 @@
+-- X12 interchanges rejected at their envelope and the TA1 answering each
+
+-- +goose Up
+CREATE TABLE interchange_rejections (
+    id text PRIMARY KEY,
+    tenant_id text NOT NULL DEFAULT 'default',
+    partner_id text,
+    sender_qualifier text,
+    sender_id text,
+    receiver_id text,
+    interchange_control text,
+    note text,
+    error text,
+    file text,
+    content_type text,
+    size integer,
+    ta1 text,
+    notified_at timestamptz,
+    notify_error text,
+    created_at timestamptz
+);
+CREATE INDEX idx_interchange_rejections_tenant_id ON interchange_rejections (tenant_id);
+CREATE INDEX idx_interchange_rejections_partner_id ON interchange_rejections (partner_id);
+CREATE INDEX idx_interchange_rejections_created_at ON interchange_rejections (created_at);
+
+-- +goose Down
+DROP TABLE interchange_rejections;
@@ -0,0 +1,11 @@
+-- Partner character encodings, outbound transliterations and the handling of illegal characters
+
+-- +goose Up
+ALTER TABLE partners ADD COLUMN encoding text;
+ALTER TABLE partners ADD COLUMN transliterations text;
+ALTER TABLE partners ADD COLUMN illegal_characters text;
+
+-- +goose Down
+ALTER TABLE partners DROP COLUMN illegal_characters;
+ALTER TABLE partners DROP COLUMN transliterations;
+ALTER TABLE partners DROP COLUMN encoding;
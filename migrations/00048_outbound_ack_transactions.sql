@@ -0,0 +1,24 @@
+-- Index of the transactions each tracked interchange carried, and of the 997
+-- or 999 acknowledging it
+
+-- +goose Up
+CREATE TABLE outbound_ack_transactions (
+    ack_id bigint NOT NULL,
+    transaction_id text NOT NULL,
+    tenant_id text NOT NULL DEFAULT 'default',
+    PRIMARY KEY (ack_id, transaction_id)
+);
+CREATE INDEX idx_outbound_ack_transactions_transaction_id ON outbound_ack_transactions (transaction_id);
+CREATE INDEX idx_outbound_ack_transactions_tenant_id ON outbound_ack_transactions (tenant_id);
+CREATE INDEX idx_outbound_acks_ack_transaction_id ON outbound_acks (ack_transaction_id);
+
+INSERT INTO outbound_ack_transactions (ack_id, transaction_id, tenant_id)
+SELECT outbound_acks.id, ids.transaction_id, outbound_acks.tenant_id
+FROM outbound_acks CROSS JOIN LATERAL jsonb_array_elements_text(
+    CASE WHEN outbound_acks.transaction_ids LIKE '[%' THEN outbound_acks.transaction_ids::jsonb ELSE '[]'::jsonb END
+) AS ids (transaction_id)
+ON CONFLICT DO NOTHING;
+
+-- +goose Down
+DROP INDEX idx_outbound_acks_ack_transaction_id;
+DROP TABLE outbound_ack_transactions;
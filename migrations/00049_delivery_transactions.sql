@@ -0,0 +1,21 @@
+-- Index of the transactions each delivery attempt carried
+
+-- +goose Up
+CREATE TABLE delivery_transactions (
+    delivery_id text NOT NULL,
+    transaction_id text NOT NULL,
+    tenant_id text NOT NULL DEFAULT 'default',
+    PRIMARY KEY (delivery_id, transaction_id)
+);
+CREATE INDEX idx_delivery_transactions_transaction_id ON delivery_transactions (transaction_id);
+CREATE INDEX idx_delivery_transactions_tenant_id ON delivery_transactions (tenant_id);
+
+INSERT INTO delivery_transactions (delivery_id, transaction_id, tenant_id)
+SELECT deliveries.id, ids.transaction_id, deliveries.tenant_id
+FROM deliveries CROSS JOIN LATERAL jsonb_array_elements_text(
+    CASE WHEN deliveries.transaction_ids LIKE '[%' THEN deliveries.transaction_ids::jsonb ELSE '[]'::jsonb END
+) AS ids (transaction_id)
+ON CONFLICT DO NOTHING;
+
+-- +goose Down
+DROP TABLE delivery_transactions;
@@ -0,0 +1,307 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// The API description served at /openapi.json. Paths are maintained in
+// api/openapi.json; the schemas of request and response bodies are generated
+// from the Go types below so field names cannot drift from the code.
+//
+//go:embed api/openapi.json
+var openAPIPaths []byte
+
+// Swagger UI assets loaded by /docs
+var swaggerUIURL = strings.TrimSuffix(getEnv("SWAGGER_UI_URL", "https://unpkg.com/swagger-ui-dist@5"), "/")
+
+// Types published under components/schemas, by schema name
+var openAPITypes = []interface{}{
+	Transaction{}, batchResult{}, problem{}, Job{}, Submission{}, Delivery{},
+	Partner{}, FlatFileProfile{}, FixedWidthLayout{}, PartnerSchedule{}, scheduleOccurrence{}, PartnerMap{},
+	Replay{}, replayRequest{}, AuditEntry{}, Order{}, Shipment{}, Invoice{},
+	OutboundAck{}, ControlNumber{}, controlNumberReport{}, controlNumberGap{},
+	mailboxSummary{}, MailboxMessage{}, upgradeReport{}, batchFlush{}, itemsCheckReport{}, edgeEnvelope{},
+	Connector{}, connectorPoll{}, SavedSearch{}, searchRun{}, Attachment{}, publishedEvent{}, WorkflowHook{}, gatewayStats{}, reportQuery{}, reportResult{},
+	StatusLink{}, statusLinkRequest{}, statusPage{}, clusterConfig{},
+	TransactionEvent{}, transactionHistory{}, transactionSnapshot{}, PartnerArchive{}, partnerDeactivation{},
+	RetentionPolicy{}, RetentionRun{}, retentionRunRequest{},
+	ConfigChange{}, RoutingRule{}, configReload{}, eventSchema{}, sandboxReport{}, parsedDocument{}, tenantQuotaReport{},
+	Certification{}, certificationRequest{}, segmentTree{}, DocumentRule{}, holdDecision{}, holdRejection{}, OutboundDraft{}, outboundComposition{}, PartnerCredential{}, credentialRequest{}, credentialRotation{}, injectedFault{}, reconciliationReport{}, InterchangeRejection{}, canonicalLine{}, transactionImport{},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Name of a type's schema: its Go name, exported
+func schemaName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// JSON Schemas of Go types as encoding/json marshals them. Named structs
+// become components referenced by $ref.
+type schemaSet map[string]interface{}
+
+func (s schemaSet) add(t reflect.Type) interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		return s.add(t.Elem())
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.add(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.add(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := s[name]; !ok {
+			s[name] = nil // placeholder for recursive types
+			s[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{} // interface{}: any JSON value
+}
+
+func (s schemaSet) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	s.fields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (s schemaSet) fields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.fields(ft, props)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if opts == "string" || strings.Contains(opts, ",string") {
+			props[name] = map[string]interface{}{"type": "string"}
+			continue
+		}
+		props[name] = s.add(f.Type)
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPISpec []byte
+	openAPIErr  error
+)
+
+// The complete document: the maintained paths with generated schemas
+func openAPIDocument() ([]byte, error) {
+	openAPIOnce.Do(func() {
+		var doc map[string]interface{}
+		if openAPIErr = json.Unmarshal(openAPIPaths, &doc); openAPIErr != nil {
+			openAPIErr = fmt.Errorf("api/openapi.json: %w", openAPIErr)
+			return
+		}
+		schemas := schemaSet{}
+		for _, v := range openAPITypes {
+			schemas.add(reflect.TypeOf(v))
+		}
+		components, _ := doc["components"].(map[string]interface{})
+		if components == nil {
+			components = map[string]interface{}{}
+			doc["components"] = components
+		}
+		if extra, ok := components["schemas"].(map[string]interface{}); ok {
+			for name, schema := range extra {
+				schemas[name] = schema
+			}
+		}
+		components["schemas"] = map[string]interface{}(schemas)
+		if openAPIErr = checkRefs(doc, doc); openAPIErr != nil {
+			return
+		}
+		openAPISpec, openAPIErr = json.MarshalIndent(doc, "", "  ")
+	})
+	return openAPISpec, openAPIErr
+}
+
+// Every $ref in the document must point into it
+func checkRefs(doc, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok && resolveRef(doc, ref) == nil {
+			return fmt.Errorf("api/openapi.json: unresolved $ref %s", ref)
+		}
+		for _, child := range v {
+			if err := checkRefs(doc, child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if err := checkRefs(doc, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Target of a local reference such as #/components/schemas/Partner
+func resolveRef(doc interface{}, ref string) interface{} {
+	pointer, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil
+	}
+	for _, key := range strings.Split(pointer, "/") {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		doc = m[key]
+	}
+	return doc
+}
+
+// Compare the documented operations with the routes served, so an endpoint
+// cannot be added or changed without its description
+func checkOpenAPI(r *mux.Router) error {
+	spec, err := openAPIDocument()
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return err
+	}
+	documented := map[string]bool{}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			switch method {
+			case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	var problems []string
+	served := map[string]bool{}
+	err = r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || path == "/metrics" {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, m := range methods {
+			op := m + " " + path
+			served[op] = true
+			if !documented[op] {
+				problems = append(problems, op+" is not documented")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for op := range documented {
+		if !served[op] {
+			problems = append(problems, op+" is documented but not served")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("api/openapi.json: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	spec, err := openAPIDocument()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
+
+func openAPICommand(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	spec, err := openAPIDocument()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", spec)
+	return err
+}
+
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>EDI Gateway API</title>
+<link rel="stylesheet" href="{{.}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.}}/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui", deepLinking: true});
+</script>
+</body>
+</html>
+`))
+
+// Swagger UI over /openapi.json
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	docsPage.Execute(w, swaggerUIURL)
+}
@@ -0,0 +1,10 @@
+package main
+
+import "testing"
+
+// api/openapi.json must describe exactly the routes the gateway serves
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	if err := checkOpenAPI(newRouter()); err != nil {
+		t.Fatal(err)
+	}
+}
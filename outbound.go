@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Outbound formats without an inbound counterpart
+const (
+	formatCXML     = "cxml"     // one ShipNoticeRequest per transaction
+	formatTemplate = "template" // the partner's output_template
+)
+
+// Renders a partner's outbound document from canonical transactions. EDI
+// formats reserve a control number in the partner's ledger; the others leave
+// Control and Number unset.
+type outboundRenderer func(ctx context.Context, p Partner, txs []Transaction) (outboundDocument, error)
+
+// Renderers selected by a partner's outbound_format
+var outboundRenderers = map[string]outboundRenderer{
+	formatX12:       renderX12,
+	formatEDIFACT:   renderEdifact,
+	formatTradacoms: renderTradacoms,
+	formatCSV:       renderCSV,
+	formatCXML:      renderCXML,
+	formatTemplate:  renderTemplate,
+}
+
+func validOutboundFormat(format string) bool {
+	_, ok := outboundRenderers[format]
+	return format == "" || ok
+}
+
+// Check the output settings of a profile
+func (p *Partner) validateOutput() error {
+	if !validOutboundFormat(p.OutboundFormat) {
+		return errors.New("outbound_format must be x12, edifact, tradacoms, csv, cxml or template")
+	}
+	if p.OutboundFormat == formatTemplate && strings.TrimSpace(p.OutputTemplate) == "" {
+		return errors.New("output_template is required with outbound_format template")
+	}
+	if p.OutputTemplate != "" {
+		if _, err := parseOutputTemplate(p.OutputTemplate); err != nil {
+			return fmt.Errorf("output_template: %w", err)
+		}
+	}
+	return nil
+}
+
+func buildOutbound(ctx context.Context, p Partner, transactions []Transaction) (outboundDocument, error) {
+	format := p.OutboundFormat
+	if format == "" {
+		format = formatX12
+	}
+	render, ok := outboundRenderers[format]
+	if !ok {
+		return outboundDocument{}, fmt.Errorf("partner %s: unknown outbound_format %q", p.ID, format)
+	}
+	doc, err := render(ctx, p, transactions)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	switch format {
+	case formatX12, formatEDIFACT, formatTradacoms, formatCSV:
+		if doc.Data, err = encodeOutbound(ctx, p, format, doc.Data); err != nil {
+			return outboundDocument{}, err
+		}
+	}
+	doc.PartnerID = p.ID
+	doc.TransactionIDs = make([]string, len(transactions))
+	for i, t := range transactions {
+		doc.TransactionIDs[i] = t.ID
+	}
+	return doc, nil
+}
+
+func renderX12(ctx context.Context, p Partner, txs []Transaction) (outboundDocument, error) {
+	edi, err := build856Interchange(ctx, p, txs)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	doc := outboundDocument{Data: []byte(edi), ContentType: "application/edi-x12"}
+	if len(edi) >= 99 {
+		doc.Control = edi[90:99] // ISA is fixed width
+		doc.Number, _ = strconv.ParseInt(doc.Control, 10, 64)
+	}
+	return doc, nil
+}
+
+func renderTradacoms(ctx context.Context, p Partner, txs []Transaction) (outboundDocument, error) {
+	out, ref, err := buildTradacomsTransmission(ctx, p, txs)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	number, _ := strconv.ParseInt(ref, 10, 64)
+	return outboundDocument{Data: []byte(out), ContentType: "application/edi-tradacoms", Control: ref, Number: number}, nil
+}
+
+func renderEdifact(ctx context.Context, p Partner, txs []Transaction) (outboundDocument, error) {
+	out, ref, err := buildDesadvInterchange(ctx, p, txs)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	number, _ := strconv.ParseInt(ref, 10, 64)
+	return outboundDocument{Data: []byte(out), ContentType: "application/edifact", Control: ref, Number: number}, nil
+}
+
+// Delimited file in the partner's flat file profile, one record per item line
+func renderCSV(ctx context.Context, p Partner, txs []Transaction) (outboundDocument, error) {
+	profile, err := loadFlatFileProfile(ctx, p.ID)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	if profile == nil {
+		return outboundDocument{}, fmt.Errorf("partner %s has no flat file profile", p.ID)
+	}
+	mapped := make([]Transaction, len(txs))
+	for i, t := range txs {
+		if err := applyPartnerMap(ctx, "outbound", &t, nil); err != nil {
+			return outboundDocument{}, err
+		}
+		mapped[i] = t
+	}
+	out, err := renderFlatFile(profile, mapped)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	return outboundDocument{Data: out, ContentType: "text/csv"}, nil
+}
+
+// What output templates are executed with
+type templateData struct {
+	Partner      Partner
+	SenderID     string // EDI_SENDER_ID
+	Now          time.Time
+	Transactions []templateTransaction
+}
+
+// A transaction after the partner's outbound map, with its items decoded
+type templateTransaction struct {
+	Transaction
+	Items      []Item
+	Orders     []templateOrder // items by purchase order, in order of appearance
+	ShipmentID string          // as in BSN02: the transaction ID without dashes
+}
+
+type templateOrder struct {
+	PONumber string
+	Items    []Item
+}
+
+var outputTemplateFuncs = template.FuncMap{
+	"xml": func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	},
+	"qty":  formatQty,
+	"date": func(layout string, t time.Time) string { return t.Format(layout) },
+	"add":  func(a, b int) int { return a + b },
+}
+
+func parseOutputTemplate(text string) (*template.Template, error) {
+	return template.New("output").Funcs(outputTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func newTemplateData(ctx context.Context, p Partner, txs []Transaction, now time.Time) (templateData, error) {
+	data := templateData{Partner: p, SenderID: senderID, Now: now, Transactions: make([]templateTransaction, len(txs))}
+	for i, t := range txs {
+		if err := applyPartnerMap(ctx, "outbound", &t, nil); err != nil {
+			return data, err
+		}
+		items, err := t.Items()
+		if err != nil {
+			return data, err
+		}
+		if t.Date.IsZero() {
+			t.Date = now
+		}
+		tt := templateTransaction{Transaction: t, Items: items, ShipmentID: shipmentID(t)}
+		for _, g := range groupBy(items, func(it Item) string { return it.PONumber }) {
+			tt.Orders = append(tt.Orders, templateOrder{PONumber: g.key, Items: g.items})
+		}
+		data.Transactions[i] = tt
+	}
+	return data, nil
+}
+
+// Any text format, from the partner's output_template
+func renderTemplate(ctx context.Context, p Partner, txs []Transaction) (outboundDocument, error) {
+	tmpl, err := parseOutputTemplate(p.OutputTemplate)
+	if err != nil {
+		return outboundDocument{}, fmt.Errorf("partner %s: output_template: %w", p.ID, err)
+	}
+	data, err := newTemplateData(ctx, p, txs, time.Now())
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return outboundDocument{}, fmt.Errorf("partner %s: output_template: %w", p.ID, err)
+	}
+	contentType := p.OutputContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	return outboundDocument{Data: buf.Bytes(), ContentType: contentType}, nil
+}
+
+// cXML ShipNoticeRequest, addressed to the partner's isa_id. Partners can
+// replace it with their own output_template.
+var cxmlShipNotice = template.Must(parseOutputTemplate(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE cXML SYSTEM "http://xml.cxml.org/schemas/cXML/1.2.060/Fulfill.dtd">
+{{- $now := .Now}}{{$sender := .SenderID}}{{$to := .Partner.ISAID}}{{with index .Transactions 0}}
+<cXML payloadID="{{$now.UnixNano}}.{{xml .ID}}@{{xml $sender}}" timestamp="{{date "2006-01-02T15:04:05-07:00" $now}}" xml:lang="en-US">
+<Header>
+<From><Credential domain="NetworkID"><Identity>{{xml $sender}}</Identity></Credential></From>
+<To><Credential domain="NetworkID"><Identity>{{xml $to}}</Identity></Credential></To>
+<Sender><Credential domain="NetworkID"><Identity>{{xml $sender}}</Identity></Credential><UserAgent>edi-gateway</UserAgent></Sender>
+</Header>
+<Request>
+<ShipNoticeRequest>
+<ShipNoticeHeader shipmentID="{{xml .ShipmentID}}" operation="new" noticeDate="{{date "2006-01-02T15:04:05-07:00" $now}}" shipmentDate="{{date "2006-01-02T15:04:05-07:00" .Date}}">
+{{- if .ShipTo}}
+<Contact role="shipTo"><Name xml:lang="en">{{xml .ShipTo}}</Name></Contact>
+{{- end}}
+</ShipNoticeHeader>
+<ShipControl>
+<CarrierIdentifier domain="SCAC">{{xml .Carrier}}</CarrierIdentifier>
+<ShipmentIdentifier>{{xml .BOL}}</ShipmentIdentifier>
+</ShipControl>
+{{- range .Orders}}
+<ShipNoticePortion>
+<OrderReference orderID="{{xml .PONumber}}"><DocumentReference payloadID=""/></OrderReference>
+{{- range $i, $it := .Items}}
+<ShipNoticeItem quantity="{{qty $it.Quantity}}" lineNumber="{{add $i 1}}">
+<ItemID><SupplierPartID>{{xml $it.SKU}}</SupplierPartID></ItemID>
+<UnitOfMeasure>{{if $it.UOM}}{{xml $it.UOM}}{{else}}EA{{end}}</UnitOfMeasure>
+{{- if $it.Description}}
+<Description xml:lang="en">{{xml $it.Description}}</Description>
+{{- end}}
+</ShipNoticeItem>
+{{- end}}
+</ShipNoticePortion>
+{{- end}}
+</ShipNoticeRequest>
+</Request>
+</cXML>
+{{end}}`))
+
+// cXML carries one request per document, so several transactions are sent
+// as the parts of a multipart/mixed body
+func renderCXML(ctx context.Context, p Partner, txs []Transaction) (outboundDocument, error) {
+	now := time.Now()
+	data, err := newTemplateData(ctx, p, txs, now)
+	if err != nil {
+		return outboundDocument{}, err
+	}
+	docs := make([][]byte, len(data.Transactions))
+	for i, t := range data.Transactions {
+		var buf bytes.Buffer
+		one := data
+		one.Transactions = []templateTransaction{t}
+		if err := cxmlShipNotice.Execute(&buf, one); err != nil {
+			return outboundDocument{}, err
+		}
+		docs[i] = buf.Bytes()
+	}
+	const contentType = "text/xml; charset=UTF-8"
+	if len(docs) == 1 {
+		return outboundDocument{Data: docs[0], ContentType: contentType}, nil
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, doc := range docs {
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return outboundDocument{}, err
+		}
+		part.Write(doc)
+	}
+	if err := mw.Close(); err != nil {
+		return outboundDocument{}, err
+	}
+	return outboundDocument{Data: body.Bytes(), ContentType: "multipart/mixed; boundary=" + mw.Boundary()}, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Partners with batch_outbound collect their outbound documents in the
+// outbox; at the start of each delivery window of their schedule (or on a
+// manual flush) the outbox goes out as one combined interchange.
+
+// Delivery status reported for a document waiting for its partner's next batch
+const deliveryBatched = "batched"
+
+// Most documents combined into one interchange; a bigger outbox is sent as
+// several
+const maxBatchDocuments = 1000
+
+// Result of flushing a partner's outbox
+type batchFlush struct {
+	PartnerID  string     `json:"partner_id"`
+	Documents  int        `json:"documents"`
+	Deliveries []Delivery `json:"deliveries"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Periodically flush the outboxes of batching partners whose delivery window
+// started since their last flush
+func runBatchScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := flushDueBatches(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: batch scheduler: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func flushDueBatches(ctx context.Context, now time.Time) error {
+	var partners []Partner
+	if err := db.WithContext(withTenant(ctx, allTenants)).Where("batch_outbound = ?", true).Find(&partners).Error; err != nil {
+		return err
+	}
+	for _, p := range partners {
+		pctx := withAuditor(withTenant(ctx, p.TenantID), systemAuditor("system", "batch"))
+		s, err := loadPartnerSchedule(pctx, p.ID)
+		if err != nil {
+			log.Printf("ERROR: batch %s: %v\n", p.ID, err)
+			continue
+		}
+		if s == nil || !s.deliveryWindowSince(now) {
+			continue
+		}
+		if err := db.WithContext(pctx).Model(s).UpdateColumn("last_flush_at", now).Error; err != nil {
+			log.Printf("ERROR: batch %s: %v\n", p.ID, err)
+			continue
+		}
+		f := flushOutbox(pctx, p)
+		if f.Error != "" {
+			log.Printf("ERROR: batch %s: %s\n", p.ID, f.Error)
+		} else if f.Documents > 0 {
+			log.Printf("Batch %s: delivered %d documents in %d interchanges", p.ID, f.Documents, len(f.Deliveries))
+		}
+	}
+	return nil
+}
+
+// Whether a delivery window started after the last flush (or, before the
+// first one, after the schedule was saved) and no later than now
+func (s *PartnerSchedule) deliveryWindowSince(now time.Time) bool {
+	since := s.UpdatedAt
+	if s.LastFlushAt != nil {
+		since = *s.LastFlushAt
+	}
+	loc := s.location()
+	for i := range s.ParsedWindows {
+		win := &s.ParsedWindows[i]
+		if win.Kind != windowDelivery {
+			continue
+		}
+		for _, o := range win.occurrences(loc, since, now.Add(time.Nanosecond), maxOccurrences) {
+			if o.Start.After(since) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Deliver everything pending in a partner's outbox, at most maxBatchDocuments
+// per interchange. Documents of a failed delivery go back to the outbox for
+// the next window.
+func flushOutbox(ctx context.Context, p Partner) batchFlush {
+	f := batchFlush{PartnerID: p.ID, Deliveries: []Delivery{}}
+	if p.DeliveryURL == "" {
+		f.Error = fmt.Sprintf("partner %s has no delivery_url", p.ID)
+		return f
+	}
+	for {
+		claimed, err := claimOutbox(ctx, p.ID, maxBatchDocuments)
+		if err != nil {
+			f.Error = err.Error()
+			return f
+		}
+		if len(claimed) == 0 {
+			return f
+		}
+		txs := make([]Transaction, 0, len(claimed))
+		for _, m := range claimed {
+			if m.Transaction != nil {
+				txs = append(txs, *m.Transaction)
+			}
+		}
+		if len(txs) == 0 {
+			continue // transactions deleted meanwhile
+		}
+		d, err := deliverOutbound(withoutDeliveryRetry(ctx), p, txs)
+		f.Deliveries = append(f.Deliveries, d)
+		if err != nil {
+			releaseOutbox(ctx, claimed)
+			f.Error = err.Error()
+			return f
+		}
+		f.Documents += len(txs)
+		ids := make([]uint, len(claimed))
+		for i, m := range claimed {
+			ids[i] = m.ID
+		}
+		if err := db.WithContext(ctx).Model(&MailboxMessage{}).Where("id IN ?", ids).Update("delivery_id", d.ID).Error; err != nil {
+			log.Printf("ERROR: batch %s: %v\n", p.ID, err)
+		}
+		if len(claimed) < maxBatchDocuments {
+			return f
+		}
+	}
+}
+
+// Take up to limit pending outbox messages for a batch, like a pull
+func claimOutbox(ctx context.Context, partnerID string, limit int) ([]MailboxMessage, error) {
+	candidates, err := pendingMessages(ctx, partnerID, mailboxOutbox, limit)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var claimed []MailboxMessage
+	for _, m := range candidates {
+		m.Status, m.PulledAt, m.PulledBy = mailboxPulled, &now, "batch"
+		res := db.WithContext(ctx).Model(&m).Where("status = ?", mailboxPending).Select("status", "pulled_at", "pulled_by").Updates(&m)
+		if res.Error != nil {
+			releaseOutbox(ctx, claimed)
+			return nil, res.Error
+		}
+		if res.RowsAffected > 0 {
+			claimed = append(claimed, m)
+		}
+	}
+	return claimed, nil
+}
+
+// Put claimed messages back in the outbox
+func releaseOutbox(ctx context.Context, claimed []MailboxMessage) {
+	if len(claimed) == 0 {
+		return
+	}
+	ids := make([]uint, len(claimed))
+	for i, m := range claimed {
+		ids[i] = m.ID
+	}
+	err := db.WithContext(ctx).Model(&MailboxMessage{}).Where("id IN ?", ids).
+		Updates(map[string]interface{}{"status": mailboxPending, "pulled_at": nil, "pulled_by": ""}).Error
+	if err != nil {
+		log.Printf("ERROR: outbox release: %v\n", err)
+	}
+}
+
+// Flush a batching partner's outbox now instead of at its next window
+func flushBatchHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := loadPartner(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	if p.DeliveryURL == "" {
+		writeProblem(w, "Partner has no delivery_url", http.StatusConflict)
+		return
+	}
+	f := flushOutbox(r.Context(), p)
+	if f.Documents > 0 || len(f.Deliveries) > 0 {
+		auditChange(r.Context(), auditUpdate, "partner_outbox", p.ID, nil, f)
+	}
+	status := http.StatusOK
+	if f.Error != "" {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(f)
+}
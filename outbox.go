@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+)
+
+// Asynchronous writes go through the event outbox: each event is saved
+// before it is handed to the writer and deleted once Kafka confirms it, so
+// an event the writer fails or a replica loses is written again by the
+// relay. Rows are claimed by the replica writing them until the lease ends.
+var eventOutboxLease = time.Duration(kafkaMaxAttempts)*kafkaWriteTimeout + kafkaLinger
+
+var (
+	eventsBuffered = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edi_events_buffered",
+		Help: "Events handed to the Kafka writer and not yet confirmed.",
+	})
+	eventOutboxPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edi_event_outbox_pending",
+		Help: "Events in the outbox, waiting to be written or confirmed.",
+	})
+)
+
+// Event waiting in the outbox. Value is the message value, base64 encoded
+// as it may carry a schema registry prefix.
+type EventOutbox struct {
+	ID           string    `json:"id" gorm:"primaryKey"` // event_id header
+	TenantID     string    `json:"tenant_id" gorm:"index"`
+	Topic        string    `json:"topic"`
+	Key          string    `json:"-"`
+	Headers      string    `json:"-"` // JSON array of the message headers
+	Value        string    `json:"-" gorm:"serializer:encrypted"`
+	Attempts     int       `json:"attempts"`
+	LastError    string    `json:"last_error,omitempty"`
+	ClaimedUntil time.Time `json:"claimed_until" gorm:"index"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Events handed to the writer, by event ID, until their delivery report
+var eventBuffer = struct {
+	sync.Mutex
+	pending map[string]bufferedEvent
+}{pending: map[string]bufferedEvent{}}
+
+type bufferedEvent struct {
+	eventType string
+	queuedAt  time.Time
+}
+
+// Whether the delivery reports of the events backend count publishes
+func eventsReported() bool {
+	return kafkaAsync && eventsBackend == "kafka"
+}
+
+// Reject new documents while the writer holds KAFKA_BUFFER unconfirmed
+// events; their events would only pile up in the outbox
+func checkEventBuffer() error {
+	if !eventsReported() {
+		return nil
+	}
+	eventBuffer.Lock()
+	full := len(eventBuffer.pending) >= kafkaBuffer
+	eventBuffer.Unlock()
+	if full {
+		return &httpError{Status: http.StatusServiceUnavailable, Message: "Event buffer is full, retry later"}
+	}
+	return nil
+}
+
+// Take room in the buffer for events, unless it is full
+func bufferEvents(ids []string, types []string, queuedAt []time.Time) bool {
+	eventBuffer.Lock()
+	defer eventBuffer.Unlock()
+	if len(eventBuffer.pending)+len(ids) > kafkaBuffer {
+		return false
+	}
+	for i, id := range ids {
+		eventBuffer.pending[id] = bufferedEvent{eventType: types[i], queuedAt: queuedAt[i]}
+	}
+	eventsBuffered.Set(float64(len(eventBuffer.pending)))
+	return true
+}
+
+// Give back the room of events, returning what was buffered for them
+func unbufferEvents(ids []string) []bufferedEvent {
+	eventBuffer.Lock()
+	defer eventBuffer.Unlock()
+	events := make([]bufferedEvent, 0, len(ids))
+	for _, id := range ids {
+		if e, ok := eventBuffer.pending[id]; ok {
+			events = append(events, e)
+			delete(eventBuffer.pending, id)
+		}
+	}
+	eventsBuffered.Set(float64(len(eventBuffer.pending)))
+	return events
+}
+
+func messageHeader(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Outbox row of msg, given an event_id header when it has none
+func outboxRow(topic string, msg *kafka.Message, claimedUntil time.Time) EventOutbox {
+	if messageHeader(*msg, "event_id") == "" {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "event_id", Value: []byte(uuid.New().String())})
+	}
+	headers, _ := json.Marshal(msg.Headers)
+	return EventOutbox{ID: messageHeader(*msg, "event_id"), TenantID: messageHeader(*msg, "tenant_id"), Topic: topic, Key: string(msg.Key),
+		Headers: string(headers), Value: base64.StdEncoding.EncodeToString(msg.Value), ClaimedUntil: claimedUntil}
+}
+
+// Save msgs to the outbox and hand them to the asynchronous writer. When
+// the buffer is full they are left unclaimed for the relay.
+func enqueueEvents(ctx context.Context, router *topicRouter, topic string, msgs []kafka.Message) error {
+	now := time.Now()
+	rows := make([]EventOutbox, len(msgs))
+	ids, types, times := make([]string, len(msgs)), make([]string, len(msgs)), make([]time.Time, len(msgs))
+	for i := range msgs {
+		rows[i] = outboxRow(topic, &msgs[i], now)
+		ids[i], types[i], times[i] = rows[i].ID, messageHeader(msgs[i], "event_type"), now
+	}
+	buffered := bufferEvents(ids, types, times)
+	if buffered {
+		for i := range rows {
+			rows[i].Attempts, rows[i].ClaimedUntil = 1, now.Add(eventOutboxLease)
+		}
+	}
+	if err := db.WithContext(ctx).Create(&rows).Error; err != nil {
+		unbufferEvents(ids)
+		return err
+	}
+	if !buffered {
+		return nil
+	}
+	if err := router.writer(topic).WriteMessages(ctx, msgs...); err != nil {
+		// Failing to find the topic's partitions, say: the relay retries
+		eventsWritten(msgs, err)
+	}
+	return nil
+}
+
+// An event saved to the outbox in the same database transaction as the
+// transaction it is about, and handed to the writer once that commits
+type outboxEvent struct {
+	topic string
+	msg   kafka.Message
+	row   EventOutbox
+}
+
+// The transaction.created event of a just inserted t, for its row to go in
+// the same database transaction; nil when events are not written through
+// the outbox or t is not published. It is claimed from the start, so the relay only
+// writes it if the writer is not handed it within the lease.
+func stageEvent(ctx context.Context, t Transaction) (*outboxEvent, error) {
+	if publisher == nil || !eventsReported() || deliverySuppressed(ctx) || t.Status == statusHeld {
+		return nil, nil
+	}
+	e := &outboxEvent{topic: eventTopic(eventTransactionCreated, t)}
+	msg, err := newEventMessage(ctx, e.topic, eventTransactionCreated, t, "")
+	if err != nil {
+		return nil, err
+	}
+	e.msg = msg
+	e.row = outboxRow(e.topic, &e.msg, time.Now().Add(eventOutboxLease))
+	e.row.Attempts = 1
+	return e, nil
+}
+
+// Hand a committed outbox event to the writer; with the buffer full it is
+// released to the relay instead
+func writeOutboxEvent(ctx context.Context, e *outboxEvent) {
+	now := time.Now()
+	if !bufferEvents([]string{e.row.ID}, []string{eventTransactionCreated}, []time.Time{now}) {
+		if err := db.WithContext(ctx).Model(&EventOutbox{}).Where("id = ?", e.row.ID).Update("claimed_until", now).Error; err != nil {
+			log.Printf("ERROR: event outbox: %v\n", err)
+		}
+		return
+	}
+	if err := kafkaRouter.writer(e.topic).WriteMessages(ctx, e.msg); err != nil {
+		eventsWritten([]kafka.Message{e.msg}, err)
+	}
+}
+
+// Delivery report of the asynchronous writer: confirmed events leave the
+// outbox, failed ones are released to the relay at once
+func eventsWritten(msgs []kafka.Message, err error) {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = messageHeader(msg, "event_id")
+	}
+	now := time.Now()
+	for _, e := range unbufferEvents(ids) {
+		trackPublish(e.eventType, Transaction{Date: e.queuedAt}, err, now)
+	}
+	q := db.WithContext(allTenantsContext()).Where("id IN ?", ids)
+	if err == nil {
+		for _, msg := range msgs {
+			observePublished(msg, now)
+		}
+		if dbErr := q.Delete(&EventOutbox{}).Error; dbErr != nil {
+			log.Printf("ERROR: event outbox: %v\n", dbErr)
+		}
+		return
+	}
+	log.Printf("ERROR: writing %d events: %v\n", len(msgs), err)
+	if dbErr := q.Model(&EventOutbox{}).Updates(map[string]interface{}{"last_error": err.Error(), "claimed_until": now}).Error; dbErr != nil {
+		log.Printf("ERROR: event outbox: %v\n", dbErr)
+	}
+}
+
+// Claim an unclaimed outbox row for this replica
+func claimOutboxEvent(ctx context.Context, e *EventOutbox, now time.Time) bool {
+	res := db.WithContext(ctx).Model(&EventOutbox{}).Where("id = ? AND claimed_until = ?", e.ID, e.ClaimedUntil).
+		Updates(map[string]interface{}{"claimed_until": now.Add(eventOutboxLease), "attempts": gorm.Expr("attempts + 1")})
+	if res.Error != nil {
+		log.Printf("ERROR: event outbox: %v\n", res.Error)
+	}
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// Write the outbox events no replica holds, oldest first, as far as the
+// buffer has room
+func relayOutboxEvents(ctx context.Context, now time.Time) error {
+	var pending int64
+	if err := db.WithContext(ctx).Model(&EventOutbox{}).Count(&pending).Error; err != nil {
+		return err
+	}
+	eventOutboxPending.Set(float64(pending))
+	eventBuffer.Lock()
+	room := kafkaBuffer - len(eventBuffer.pending)
+	eventBuffer.Unlock()
+	if pending == 0 || room <= 0 {
+		return nil
+	}
+	var rows []EventOutbox
+	if err := db.WithContext(ctx).Where("claimed_until < ?", now).Order("created_at").Limit(room).Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, e := range rows {
+		value, err := base64.StdEncoding.DecodeString(e.Value)
+		if err != nil {
+			log.Printf("ERROR: outbox event %s: %v\n", e.ID, err)
+			continue
+		}
+		msg := kafka.Message{Key: []byte(e.Key), Value: value}
+		json.Unmarshal([]byte(e.Headers), &msg.Headers)
+		if !bufferEvents([]string{e.ID}, []string{messageHeader(msg, "event_type")}, []time.Time{e.CreatedAt}) {
+			return nil
+		}
+		if !claimOutboxEvent(ctx, &e, now) {
+			unbufferEvents([]string{e.ID})
+			continue
+		}
+		if err := kafkaRouter.writer(e.Topic).WriteMessages(ctx, msg); err != nil {
+			eventsWritten([]kafka.Message{msg}, err)
+		}
+	}
+	return nil
+}
+
+// Relay the outbox every interval while writes are asynchronous. Every
+// replica relays; claims keep them from writing the same event at once.
+func runEventOutbox(ctx context.Context, interval time.Duration) {
+	if !eventsReported() {
+		return
+	}
+	ctx = withTenant(ctx, allTenants)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := relayOutboxEvents(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: event outbox: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Events written through the outbox, with a buffer that is always full so
+// none is handed to a writer
+func startOutboxGateway(t *testing.T) {
+	startBulkGateway(t)
+	setForTest(t, &eventsBackend, "kafka")
+	setForTest(t, &kafkaAsync, true)
+	setForTest(t, &kafkaBuffer, 0)
+}
+
+// A transaction's outbox event is saved in the same database transaction
+// as the transaction, one at a time and in bulk
+func TestOutboxEventSavedWithTransaction(t *testing.T) {
+	startOutboxGateway(t)
+	ctx := withTenant(context.Background(), defaultTenant)
+	for i, err := range processTransactions(ctx, bulkTransactions("bulk", 3)) {
+		if err != nil {
+			t.Fatalf("bulk %d: %v", i, err)
+		}
+	}
+	for i, tx := range bulkTransactions("single", 3) {
+		if err := processTransaction(ctx, tx); err != nil {
+			t.Fatalf("single %d: %v", i, err)
+		}
+	}
+	var rows []EventOutbox
+	if err := db.WithContext(ctx).Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 {
+		t.Fatalf("%d outbox events, want 6", len(rows))
+	}
+	for _, e := range rows {
+		if e.Topic == "" || e.ClaimedUntil.After(time.Now()) {
+			t.Errorf("outbox event %+v not released to the relay", e)
+		}
+	}
+
+	// Without the outbox table nothing is saved at all
+	if err := db.Migrator().DropTable(&EventOutbox{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := processTransaction(ctx, bulkTransactions("lost", 1)[0]); !errors.Is(err, errSaveFailed) {
+		t.Errorf("single save without the outbox: %v", err)
+	}
+	if errs := processTransactions(ctx, bulkTransactions("lost-bulk", 2)); !errors.Is(errs[0], errSaveFailed) {
+		t.Errorf("bulk save without the outbox: %v", errs)
+	}
+	var saved int64
+	if err := db.WithContext(ctx).Model(&Transaction{}).Where("id LIKE ?", "lost%").Count(&saved).Error; err != nil || saved != 0 {
+		t.Errorf("%d transactions saved without their events: %v", saved, err)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Trading partner profile
+type Partner struct {
+	ID                     string     `json:"id" gorm:"primaryKey"`
+	TenantID               string     `json:"tenant_id" gorm:"index"`
+	Name                   string     `json:"name"`
+	ISAQualifier           string     `json:"isa_qualifier"`
+	ISAID                  string     `json:"isa_id" gorm:"index"`
+	GSID                   string     `json:"gs_id"`
+	X12Version             string     `json:"x12_version"`           // 004010 or 005010
+	ASNHierarchy           string     `json:"asn_hierarchy"`         // SOPI or SOI
+	ASNRequired            string     `json:"asn_required_segments"` // comma separated, e.g. "TD1,TD5,REF"
+	ControlNumber          int64      `json:"control_number"`        // last interchange control number used
+	ArchiveSample          float64    `json:"archive_sample_rate"`   // fraction of raw payloads archived; 0 archives all
+	APIKey                 string     `json:"api_key,omitempty" gorm:"index"`
+	SigningSecret          string     `json:"signing_secret,omitempty" gorm:"serializer:encrypted"` // HMAC key of signed submissions
+	RequireSignature       bool       `json:"require_signature"`                                    // reject unsigned submissions on every channel
+	RateLimit              float64    `json:"rate_limit"`                                           // requests per second; 0 uses RATE_LIMIT_KEY_RPS
+	RateBurst              int        `json:"rate_burst"`
+	DeliveryURL            string     `json:"delivery_url,omitempty"`         // endpoint outbound interchanges are POSTed to
+	AS2ID                  string     `json:"as2_id,omitempty" gorm:"index"`  // deliver over AS2 when set
+	AS2Certificate         string     `json:"as2_certificate,omitempty"`      // PEM; MDNs must be signed by it when set
+	MDNMode                string     `json:"mdn_mode,omitempty"`             // "", sync or async
+	MaxDocumentSize        int64      `json:"max_document_size"`              // bytes; 0 uses GUARDRAIL_MAX_DOCUMENT_SIZE
+	MaxDocumentsPerHour    int        `json:"max_documents_per_hour"`         // 0 uses GUARDRAIL_MAX_DOCUMENTS_PER_HOUR
+	GuardrailAction        string     `json:"guardrail_action,omitempty"`     // reject, queue or alert; "" uses GUARDRAIL_ACTION
+	SenderCheck            string     `json:"sender_check,omitempty"`         // reject, queue, alert or off; "" uses INBOUND_SENDER_CHECK
+	AllowedSenders         string     `json:"allowed_senders,omitempty"`      // comma separated partners this partner may submit for, or *
+	OutboundFormat         string     `json:"outbound_format,omitempty"`      // x12 (default), edifact, tradacoms, csv, cxml or template
+	OutputTemplate         string     `json:"output_template,omitempty"`      // text/template rendering outbound_format template
+	OutputContentType      string     `json:"output_content_type,omitempty"`  // of the template's output, default text/plain
+	AckSLAMinutes          int        `json:"ack_sla_minutes"`                // 997/999 due within; 0 uses ACK_SLA, negative expects none
+	BatchOutbound          bool       `json:"batch_outbound"`                 // deliver the outbox in the delivery windows of the schedule
+	OutboundApproval       bool       `json:"outbound_approval"`              // outbound drafts need approving before they are sent
+	ReconciliationEmail    string     `json:"reconciliation_email,omitempty"` // comma separated; the partner's daily reconciliation is emailed there
+	Priority               string     `json:"priority,omitempty"`             // high, normal or low; of its transactions no document rule gives one
+	Encoding               string     `json:"encoding,omitempty"`             // of its documents: utf-8, iso-8859-1, windows-1252 or ascii; "" reads UTF-8, else ISO 8859-1
+	Transliterations       string     `json:"transliterations,omitempty"`     // comma separated outbound replacements, e.g. "ß=ss,€=EUR"
+	IllegalCharacters      string     `json:"illegal_characters,omitempty"`   // flag (default), reject or off
+	Sandbox                bool       `json:"sandbox"`                        // validate inbound documents without saving or publishing them
+	DeliveryMaxAttempts    int        `json:"delivery_max_attempts"`          // attempts per delivery; 0 uses DELIVERY_MAX_ATTEMPTS, 1 never retries
+	DeliveryBackoffSeconds int        `json:"delivery_backoff_seconds"`       // wait before the first retry, doubling after; 0 uses DELIVERY_BACKOFF
+	DeliveryJitter         float64    `json:"delivery_jitter"`                // spread of the retry waits, as a fraction; 0 uses DELIVERY_JITTER
+	SNIPLevel              int        `json:"snip_level"`                     // HIPAA sets validated to SNIP level 1-3; 0 uses HIPAA_SNIP_LEVEL, negative skips
+	DeliveryBandwidth      int        `json:"delivery_bandwidth"`             // bytes per second to delivery_url, within DELIVERY_BANDWIDTH*; 0 is uncapped
+	DeliverySLAMinutes     int        `json:"delivery_sla_minutes"`           // outbound transactions delivered within; 0 uses DELIVERY_SLA, negative tracks none
+	Status                 string     `json:"status" gorm:"default:active"`   // active, idle or deactivated; changed by the idle check and POST .../deactivate and .../reactivate
+	IdleSince              *time.Time `json:"idle_since,omitempty"`
+	DeactivatedAt          *time.Time `json:"deactivated_at,omitempty"`
+	DeactivationReason     string     `json:"deactivation_reason,omitempty"`
+	CertificationStatus    string     `json:"certification_status,omitempty"` // running, passed or failed: the last certification run
+	CertifiedAt            *time.Time `json:"certified_at,omitempty"`         // when a certification run last passed
+	CreatedAt              time.Time  `json:"created_at"`
+	UpdatedAt              time.Time  `json:"updated_at"`
+}
+
+// Profile used for transactions that are not tied to a partner
+var defaultPartner = Partner{
+	ID:           "default",
+	ISAQualifier: "ZZ",
+	ISAID:        getEnv("EDI_DEFAULT_RECEIVER_ID", "RECEIVER"),
+	X12Version:   "004010",
+	ASNHierarchy: "SOPI",
+}
+
+// Copy with the signing secret masked, for responses and the audit log
+func (p Partner) redacted() Partner {
+	if p.SigningSecret != "" {
+		p.SigningSecret = passwordMask
+	}
+	return p
+}
+
+// Fill unset profile fields with defaults
+func (p *Partner) applyDefaults() {
+	if p.ISAQualifier == "" {
+		p.ISAQualifier = "ZZ"
+	}
+	if p.ISAID == "" {
+		p.ISAID = p.ID
+	}
+	if p.GSID == "" {
+		p.GSID = p.ISAID
+	}
+	if p.X12Version == "" {
+		p.X12Version = "004010"
+	}
+	if p.ASNHierarchy == "" {
+		p.ASNHierarchy = "SOPI"
+	}
+}
+
+// Look up a partner profile, falling back to the default profile
+func loadPartner(ctx context.Context, id string) (Partner, error) {
+	if id == "" {
+		return defaultPartner, nil
+	}
+	var p Partner
+	if err := db.WithContext(ctx).First(&p, "id = ?", id).Error; err != nil {
+		return Partner{}, err
+	}
+	return p, nil
+}
+
+// Reserve the next interchange control number for a partner and record it
+// in the ledger
+func nextControlNumber(ctx context.Context, p *Partner) (int64, error) {
+	if p.ID == defaultPartner.ID {
+		return time.Now().Unix() % 1000000000, nil
+	}
+	if previewing(ctx) {
+		return (p.ControlNumber + 1) % 1000000000, nil
+	}
+	err := db.WithContext(ctx).Model(p).Clauses(clause.Returning{Columns: []clause.Column{{Name: "control_number"}}}).
+		UpdateColumn("control_number", gorm.Expr("control_number + 1")).Error
+	if err != nil {
+		return 0, err
+	}
+	number := p.ControlNumber % 1000000000
+	reserveControlNumber(ctx, *p, number)
+	return number, nil
+}
+
+// Create a partner profile
+func createPartnerHandler(w http.ResponseWriter, r *http.Request) {
+	var p Partner
+	if err := decodeJSON(w, r, &p); err != nil {
+		writeError(w, err)
+		return
+	}
+	if p.ID == "" {
+		writeProblem(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	if !validGuardrailAction(p.GuardrailAction) {
+		writeProblem(w, "guardrail_action must be reject, queue or alert", http.StatusBadRequest)
+		return
+	}
+	if !validPriority(p.Priority) {
+		writeProblem(w, "priority must be high, normal or low", http.StatusBadRequest)
+		return
+	}
+	if p.X12Version != "" && !validX12Version(p.X12Version) {
+		writeProblem(w, "x12_version must be 004010 or 005010", http.StatusBadRequest)
+		return
+	}
+	if p.SenderCheck != "" && !validSenderCheck(p.SenderCheck) {
+		writeProblem(w, "sender_check must be reject, queue, alert or off", http.StatusBadRequest)
+		return
+	}
+	if p.SNIPLevel > snipBalancing {
+		writeProblem(w, "snip_level must be at most 3", http.StatusBadRequest)
+		return
+	}
+	if err := p.validateOutput(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validateCharacters(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validateDelivery(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validateReconciliation(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.applyDefaults()
+	p.Status, p.IdleSince, p.DeactivatedAt, p.DeactivationReason = partnerActive, nil, nil, ""
+	if err := db.WithContext(r.Context()).Create(&p).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save partner", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "partner", p.ID, nil, p.redacted())
+	recordConfigChange(r.Context(), "partner", p.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p.redacted())
+}
+
+// List partner profiles, without deactivated ones unless ?status asks for
+// them (deactivated or all)
+func listPartnersHandler(w http.ResponseWriter, r *http.Request) {
+	var partners []Partner
+	q := db.WithContext(r.Context()).Order("id")
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+		q = q.Where("status <> ?", partnerDeactivated)
+	case partnerActive, partnerIdle, partnerDeactivated:
+		q = q.Where("status = ?", status)
+	case "all":
+	default:
+		writeProblem(w, "status must be active, idle, deactivated or all", http.StatusBadRequest)
+		return
+	}
+	if err := q.Find(&partners).Error; err != nil {
+		writeProblem(w, "Failed to fetch partners", http.StatusInternalServerError)
+		return
+	}
+	for i := range partners {
+		partners[i] = partners[i].redacted()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(partners)
+}
+
+// Fetch one partner profile
+func getPartnerHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := loadPartner(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.redacted())
+}
+
+// Replace a partner profile, keeping its control number sequence
+func updatePartnerHandler(w http.ResponseWriter, r *http.Request) {
+	existing, err := loadPartner(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	var p Partner
+	if err := decodeJSON(w, r, &p); err != nil {
+		writeError(w, err)
+		return
+	}
+	p.ID = existing.ID
+	p.ControlNumber = existing.ControlNumber
+	p.CreatedAt = existing.CreatedAt
+	p.Status, p.IdleSince, p.DeactivatedAt, p.DeactivationReason = existing.Status, existing.IdleSince, existing.DeactivatedAt, existing.DeactivationReason
+	p.CertificationStatus, p.CertifiedAt = existing.CertificationStatus, existing.CertifiedAt
+	if p.SigningSecret == "" || p.SigningSecret == passwordMask {
+		p.SigningSecret = existing.SigningSecret
+	}
+	if !validGuardrailAction(p.GuardrailAction) {
+		writeProblem(w, "guardrail_action must be reject, queue or alert", http.StatusBadRequest)
+		return
+	}
+	if !validPriority(p.Priority) {
+		writeProblem(w, "priority must be high, normal or low", http.StatusBadRequest)
+		return
+	}
+	if p.X12Version != "" && !validX12Version(p.X12Version) {
+		writeProblem(w, "x12_version must be 004010 or 005010", http.StatusBadRequest)
+		return
+	}
+	if p.SenderCheck != "" && !validSenderCheck(p.SenderCheck) {
+		writeProblem(w, "sender_check must be reject, queue, alert or off", http.StatusBadRequest)
+		return
+	}
+	if p.SNIPLevel > snipBalancing {
+		writeProblem(w, "snip_level must be at most 3", http.StatusBadRequest)
+		return
+	}
+	if err := p.validateOutput(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validateCharacters(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validateDelivery(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validateReconciliation(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.applyDefaults()
+	if err := db.WithContext(r.Context()).Omit("ControlNumber", "CreatedAt").Save(&p).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save partner", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditUpdate, "partner", p.ID, existing.redacted(), p.redacted())
+	recordConfigChange(r.Context(), "partner", p.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.redacted())
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Partners without traffic for PARTNER_IDLE_MONTHS are flagged idle, and
+// deactivated after PARTNER_IDLE_DEACTIVATE_MONTHS; 0 disables either
+var (
+	partnerIdleMonths       = getEnvInt("PARTNER_IDLE_MONTHS", 6)
+	partnerDeactivateMonths = getEnvInt("PARTNER_IDLE_DEACTIVATE_MONTHS", 0)
+)
+
+// States of a partner
+const (
+	partnerActive      = "active"
+	partnerIdle        = "idle"        // no traffic lately; documents are still accepted
+	partnerDeactivated = "deactivated" // documents are rejected and connectors stopped
+)
+
+// Audit actions of the partner lifecycle
+const (
+	auditDeactivate = "deactivate"
+	auditReactivate = "reactivate"
+)
+
+var idlePartners = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "edi_idle_partners",
+	Help: "Partners flagged idle for lack of traffic.",
+}, []string{"tenant"})
+
+// Snapshot of a partner's configuration taken when it was deactivated,
+// encrypted at rest as it holds its credentials
+type PartnerArchive struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	PartnerID string    `json:"partner_id" gorm:"index"`
+	Reason    string    `json:"reason,omitempty"`
+	Actor     string    `json:"actor"`
+	Config    string    `json:"-" gorm:"serializer:encrypted"` // JSON partnerConfiguration
+	CreatedAt time.Time `json:"created_at"`
+
+	Configuration *partnerConfiguration `json:"configuration,omitempty" gorm:"-"`
+}
+
+// Everything configured for a partner
+type partnerConfiguration struct {
+	Partner     Partner           `json:"partner"`
+	InboundMap  *PartnerMap       `json:"inbound_map,omitempty"`
+	OutboundMap *PartnerMap       `json:"outbound_map,omitempty"`
+	FlatFile    *FlatFileProfile  `json:"flatfile,omitempty"`
+	FixedWidth  *FixedWidthLayout `json:"fixedwidth,omitempty"`
+	Schedule    *PartnerSchedule  `json:"schedule,omitempty"`
+	Connectors  []Connector       `json:"connectors"` // without passwords
+}
+
+type partnerDeactivation struct {
+	Reason string `json:"reason"`
+}
+
+func (p Partner) deactivated() bool {
+	return p.Status == partnerDeactivated
+}
+
+// Reject documents for a deactivated partner
+func (p Partner) checkActive() error {
+	if !p.deactivated() {
+		return nil
+	}
+	msg := fmt.Sprintf("Partner %s is deactivated", p.ID)
+	if p.DeactivatedAt != nil {
+		msg += " since " + p.DeactivatedAt.UTC().Format(time.RFC3339)
+	}
+	return &httpError{Status: http.StatusForbidden, Code: codePartnerDeactivated, Message: msg + "; it must be reactivated before it can exchange documents"}
+}
+
+// Reject a document whose partner, or the partner its channel
+// authenticated, is deactivated
+func checkPartnerActive(ctx context.Context, t *Transaction) error {
+	if edgeMode {
+		return nil
+	}
+	for _, id := range []string{t.PartnerID, channelFrom(ctx).Partner} {
+		if id == "" {
+			continue
+		}
+		p, err := loadPartner(ctx, id)
+		if err != nil {
+			continue // unknown partners are the sender check's concern
+		}
+		if err := p.checkActive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Current configuration of a partner
+func loadPartnerConfiguration(ctx context.Context, p Partner) (partnerConfiguration, error) {
+	c := partnerConfiguration{Partner: p, Connectors: []Connector{}}
+	var err error
+	if c.InboundMap, err = loadPartnerMap(ctx, p.ID, "inbound"); err != nil {
+		return c, err
+	}
+	if c.OutboundMap, err = loadPartnerMap(ctx, p.ID, "outbound"); err != nil {
+		return c, err
+	}
+	if c.FlatFile, err = loadFlatFileProfile(ctx, p.ID); err != nil {
+		return c, err
+	}
+	if c.FixedWidth, err = loadFixedWidthLayout(ctx, p.ID); err != nil {
+		return c, err
+	}
+	if c.Schedule, err = loadPartnerSchedule(ctx, p.ID); err != nil {
+		return c, err
+	}
+	if err := db.WithContext(ctx).Where("partner_id = ?", p.ID).Order("created_at").Find(&c.Connectors).Error; err != nil {
+		return c, err
+	}
+	for i := range c.Connectors {
+		c.Connectors[i] = c.Connectors[i].redacted()
+	}
+	return c, nil
+}
+
+// Archive a partner's configuration, stop its connectors and mark it
+// deactivated
+func deactivatePartner(ctx context.Context, p Partner, reason string, now time.Time) (Partner, error) {
+	config, err := loadPartnerConfiguration(ctx, p)
+	if err != nil {
+		return p, err
+	}
+	data, _ := json.Marshal(config)
+	archived := PartnerArchive{TenantID: p.TenantID, PartnerID: p.ID, Reason: reason, Actor: auditorFrom(ctx).actor, Config: string(data)}
+	before := p
+	p.Status, p.DeactivatedAt, p.DeactivationReason = partnerDeactivated, &now, reason
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&Partner{}).Where("id = ? AND status <> ?", p.ID, partnerDeactivated).
+			Updates(map[string]interface{}{"status": p.Status, "deactivated_at": now, "deactivation_reason": reason})
+		if res.Error != nil {
+			return res.Error
+		} else if res.RowsAffected == 0 {
+			return &httpError{Status: http.StatusConflict, Message: "Partner " + p.ID + " is already deactivated"}
+		}
+		if err := tx.Create(&archived).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Connector{}).Where("partner_id = ?", p.ID).Update("disabled", true).Error
+	})
+	if err != nil {
+		return before, err
+	}
+	auditChange(ctx, auditDeactivate, "partner", p.ID, before.redacted(), p.redacted())
+	recordConfigChange(ctx, "partner", p.ID)
+	return p, nil
+}
+
+// Mark a deactivated partner active again and restart the connectors its
+// deactivation stopped
+func reactivatePartner(ctx context.Context, p Partner) (Partner, error) {
+	if !p.deactivated() {
+		return p, &httpError{Status: http.StatusConflict, Message: "Partner " + p.ID + " is not deactivated"}
+	}
+	var last PartnerArchive
+	res := db.WithContext(ctx).Where("partner_id = ?", p.ID).Order("id DESC").Limit(1).Find(&last)
+	if res.Error != nil {
+		return p, res.Error
+	}
+	var enabled []string
+	if res.RowsAffected > 0 {
+		var config partnerConfiguration
+		json.Unmarshal([]byte(last.Config), &config)
+		for _, c := range config.Connectors {
+			if !c.Disabled {
+				enabled = append(enabled, c.ID)
+			}
+		}
+	}
+	before := p
+	p.Status, p.IdleSince, p.DeactivatedAt, p.DeactivationReason = partnerActive, nil, nil, ""
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Partner{}).Where("id = ?", p.ID).
+			Updates(map[string]interface{}{"status": p.Status, "idle_since": nil, "deactivated_at": nil, "deactivation_reason": ""}).Error
+		if err != nil || len(enabled) == 0 {
+			return err
+		}
+		return tx.Model(&Connector{}).Where("partner_id = ? AND id IN ?", p.ID, enabled).Update("disabled", false).Error
+	})
+	if err != nil {
+		return before, err
+	}
+	auditChange(ctx, auditReactivate, "partner", p.ID, before.redacted(), p.redacted())
+	recordConfigChange(ctx, "partner", p.ID)
+	return p, nil
+}
+
+// SQL condition on partners: traffic in or out since ? (received
+// transactions or delivery attempts)
+const partnerTrafficSince = `(EXISTS (SELECT 1 FROM transactions t WHERE t.tenant_id = partners.tenant_id AND t.partner_id = partners.id AND t.date >= ?)
+	OR EXISTS (SELECT 1 FROM deliveries d WHERE d.tenant_id = partners.tenant_id AND d.partner_id = partners.id AND d.created_at >= ?))`
+
+// Flag active partners of every tenant without traffic for
+// PARTNER_IDLE_MONTHS, clear the flag of idle ones with traffic again and
+// deactivate those idle for PARTNER_IDLE_DEACTIVATE_MONTHS. Partners newer
+// than the window are left alone.
+func checkIdlePartners(ctx context.Context, now time.Time) error {
+	if partnerIdleMonths <= 0 {
+		return nil
+	}
+	actx := withTenant(ctx, allTenants)
+	cutoff := now.AddDate(0, -partnerIdleMonths, 0)
+
+	var idle []Partner
+	err := db.WithContext(actx).Where("status = ? AND created_at < ? AND NOT "+partnerTrafficSince, partnerActive, cutoff, cutoff, cutoff).Find(&idle).Error
+	if err != nil {
+		return err
+	}
+	for _, p := range idle {
+		res := db.WithContext(actx).Model(&Partner{}).Where("tenant_id = ? AND id = ? AND status = ?", p.TenantID, p.ID, partnerActive).
+			Updates(map[string]interface{}{"status": partnerIdle, "idle_since": now})
+		if res.Error != nil {
+			log.Printf("ERROR: flag partner %s idle: %v\n", p.ID, res.Error)
+		} else if res.RowsAffected > 0 {
+			log.Printf("ALERT: partner %s of tenant %s had no traffic for %d months and is flagged idle", p.ID, p.TenantID, partnerIdleMonths)
+		}
+	}
+
+	err = db.WithContext(actx).Model(&Partner{}).Where("status = ? AND "+partnerTrafficSince, partnerIdle, cutoff, cutoff).
+		Updates(map[string]interface{}{"status": partnerActive, "idle_since": nil}).Error
+	if err != nil {
+		return err
+	}
+
+	if partnerDeactivateMonths > 0 {
+		var stale []Partner
+		if err := db.WithContext(actx).Where("status = ? AND idle_since < ?", partnerIdle, now.AddDate(0, -partnerDeactivateMonths, 0)).Find(&stale).Error; err != nil {
+			return err
+		}
+		for _, p := range stale {
+			pctx := withAuditor(withTenant(ctx, p.TenantID), systemAuditor("system", "idle-partners"))
+			reason := fmt.Sprintf("idle since %s", p.IdleSince.UTC().Format("2006-01-02"))
+			if _, err := deactivatePartner(pctx, p, reason, now); err != nil {
+				var he *httpError
+				if !errors.As(err, &he) {
+					log.Printf("ERROR: deactivate idle partner %s: %v\n", p.ID, err)
+				}
+				continue
+			}
+			log.Printf("ALERT: partner %s of tenant %s was deactivated, %s", p.ID, p.TenantID, reason)
+		}
+	}
+
+	var counts []struct {
+		TenantID string
+		N        float64
+	}
+	if err := db.WithContext(actx).Model(&Partner{}).Select("tenant_id, count(*) AS n").Where("status = ?", partnerIdle).Group("tenant_id").Scan(&counts).Error; err != nil {
+		return err
+	}
+	idlePartners.Reset()
+	for _, c := range counts {
+		idlePartners.WithLabelValues(c.TenantID).Set(c.N)
+	}
+	return nil
+}
+
+// Periodically look for idle partners
+func runIdlePartnerCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := checkIdlePartners(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: idle partners: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Partner of the request path, writing the error response when there is none
+func requestPartner(w http.ResponseWriter, r *http.Request) (Partner, bool) {
+	p, err := loadPartner(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return p, false
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return p, false
+	}
+	return p, true
+}
+
+func writePartnerChange(w http.ResponseWriter, p Partner, err error) {
+	var he *httpError
+	if errors.As(err, &he) {
+		writeError(w, err)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save partner", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.redacted())
+}
+
+// Deactivate a partner, archiving its configuration
+func deactivatePartnerHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	var req partnerDeactivation
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	p, err := deactivatePartner(r.Context(), p, req.Reason, time.Now().UTC())
+	writePartnerChange(w, p, err)
+}
+
+// Reactivate a deactivated partner
+func reactivatePartnerHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	p, err := reactivatePartner(r.Context(), p)
+	writePartnerChange(w, p, err)
+}
+
+// List the configuration archived at each of a partner's deactivations,
+// newest first
+func listPartnerArchivesHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := requestPartner(w, r)
+	if !ok {
+		return
+	}
+	archives := []PartnerArchive{}
+	if err := db.WithContext(r.Context()).Where("partner_id = ?", p.ID).Order("id DESC").Find(&archives).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch archives", http.StatusInternalServerError)
+		return
+	}
+	for i := range archives {
+		var config partnerConfiguration
+		if err := json.Unmarshal([]byte(archives[i].Config), &config); err == nil {
+			config.Partner = config.Partner.redacted()
+			archives[i].Configuration = &config
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archives)
+}
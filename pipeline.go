@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Pipeline failures, wrapped with the underlying cause
+var (
+	errSaveFailed    = errors.New("failed to save transaction")
+	errPublishFailed = errors.New("failed to publish to Kafka")
+)
+
+type partnerKey struct{}
+
+// Partner submitting the request, for formats that do not name their sender
+func withPartnerHint(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, partnerKey{}, id)
+}
+
+func partnerHint(ctx context.Context) string {
+	id, _ := ctx.Value(partnerKey{}).(string)
+	return id
+}
+
+// Identify the submitting partner from X-Partner-ID, the partner the
+// channel authenticated or an unsigned AS2-From (see requestChannel)
+func partnerHintMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch, hint, err := requestChannel(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		id := r.Header.Get("X-Partner-ID")
+		if id == "" {
+			id = ch.Partner
+		}
+		if id == "" {
+			id = hint
+		}
+		ctx := withChannel(r.Context(), ch)
+		if id != "" {
+			ctx = withPartnerHint(ctx, id)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type noDeliveryKey struct{}
+
+// Context whose transactions are saved without being published or put in
+// the partner's inbox, e.g. history backfilled from archives
+func withoutDelivery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noDeliveryKey{}, true)
+}
+
+func deliverySuppressed(ctx context.Context) bool {
+	off, _ := ctx.Value(noDeliveryKey{}).(bool)
+	return off
+}
+
+// Assign identity and initial state to a newly received transaction
+func newInboundTransaction(ctx context.Context, t *Transaction, now time.Time) {
+	t.ID = uuid.New().String()
+	t.Status = "Processed"
+	t.Date = now
+	recordSignature(ctx, t)
+	if edgeMode {
+		// Held locally until the link to the central gateway is up
+		t.Status = statusSpooled
+		t.Origin = edgeNodeID
+	}
+}
+
+// Persist and publish one inbound transaction
+func processTransaction(ctx context.Context, t *Transaction) error {
+	t.SearchText = searchText(*t)
+	t.ConfigVersion = processingConfigVersion(ctx)
+	save := func() error {
+		return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(t).Error; err != nil {
+				return err
+			}
+			if err := appendReceivedEvent(ctx, tx, *t, receivedDelta(*t)); err != nil {
+				return err
+			}
+			return saveStagedEvent(ctx, tx, t)
+		})
+	}
+	if err := withDBRetry(ctx, save); err != nil {
+		return fmt.Errorf("%w: %w", errSaveFailed, err)
+	}
+	return transactionSaved(ctx, t)
+}
+
+// Steps after a transaction is saved: audit, mailbox, acknowledgment,
+// projections and its event
+func transactionSaved(ctx context.Context, t *Transaction) error {
+	auditChange(ctx, auditCreate, "transaction", t.ID, nil, nil)
+	if !deliverySuppressed(ctx) {
+		postToMailbox(ctx, mailboxInbox, t.PartnerID, t.ID)
+	}
+	if t.ack != nil {
+		reconcileAck(ctx, *t)
+	}
+	if t.Status == statusHeld {
+		return nil
+	}
+	projectTransaction(ctx, *t)
+	if deliverySuppressed(ctx) {
+		return nil
+	}
+	if t.event != nil {
+		writeOutboxEvent(ctx, t.event)
+	} else if err := publishTransaction(ctx, eventTransactionCreated, *t); err != nil {
+		return fmt.Errorf("%w: %w", errPublishFailed, err)
+	}
+	countTransactionOutcome(ctx, *t, nil)
+	return nil
+}
+
+// Save the outbox event of a just inserted t with tx, see stageEvent
+func saveStagedEvent(ctx context.Context, tx *gorm.DB, t *Transaction) error {
+	e, err := stageEvent(ctx, *t)
+	if err != nil || e == nil {
+		t.event = nil
+		return err
+	}
+	if err := tx.Create(&e.row).Error; err != nil {
+		return err
+	}
+	t.event = e
+	return nil
+}
+
+// Announce a received transaction that was rejected. Like the mailbox this
+// is bookkeeping: a failure to publish is only logged, and when publishing
+// itself failed there is nothing to announce it on.
+func publishFailure(ctx context.Context, t Transaction, cause error) {
+	if deliverySuppressed(ctx) || sandboxed(ctx, t.PartnerID) {
+		return
+	}
+	countTransactionOutcome(ctx, t, cause)
+	if errors.Is(cause, errPublishFailed) {
+		return
+	}
+	if err := publishEvent(ctx, eventTransactionFailed, t, cause.Error()); err != nil {
+		log.Printf("ERROR: failure event: %v\n", err)
+	}
+}
+
+// Decode, archive, persist and publish one JSON transaction
+func ingestJSON(ctx context.Context, contentType string, body []byte) (Transaction, error) {
+	var transaction Transaction
+	if err := decodeInboundJSON(body, &transaction); err != nil {
+		return transaction, err
+	}
+	clearServerFields(&transaction)
+	transaction.Format = formatJSON
+	return ingestTransaction(ctx, transaction, contentType, body)
+}
+
+// Map, archive, persist and publish one canonical transaction decoded from body
+func ingestTransaction(ctx context.Context, transaction Transaction, contentType string, body []byte) (Transaction, error) {
+	if err := checkEventBuffer(); err != nil {
+		return transaction, err
+	}
+	if err := checkPartnerActive(ctx, &transaction); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, err
+	}
+	if err := checkSender(ctx, &transaction); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, err
+	}
+	if err := checkSignatureRequired(ctx, &transaction); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, err
+	}
+	if err := checkTenantQuotas(ctx); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, err
+	}
+	if err := applyPartnerMap(ctx, "inbound", &transaction, nil); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, &httpError{Status: http.StatusUnprocessableEntity, Message: "Mapping failed: " + err.Error()}
+	}
+
+	if sandboxed(ctx, transaction.PartnerID) {
+		transaction.Status = statusValidated
+		return transaction, nil
+	}
+
+	// Generate a unique ID for the transaction
+	newInboundTransaction(ctx, &transaction, time.Now())
+	if err := applyDocumentRules(ctx, &transaction); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, err
+	}
+	if err := applyGuardrails(ctx, &transaction, len(body)); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, err
+	}
+	if err := prePersistHooks(ctx, &transaction); err != nil {
+		publishFailure(ctx, transaction, err)
+		return transaction, err
+	}
+
+	// Keep the exact bytes received (sampled for high-volume partners)
+	archived := sampleArchive(ctx, transaction.PartnerID, transaction.ID)
+	if archived {
+		if err := archivePayload(ctx, "inbound", contentType, body, transaction.ID); err != nil {
+			log.Printf("ERROR: archive: %v\n", err)
+			return transaction, &httpError{Status: http.StatusInternalServerError, Message: "Failed to archive payload"}
+		}
+	}
+
+	// Save to PostgreSQL and publish event to Kafka
+	if err := processTransaction(ctx, &transaction); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		publishFailure(ctx, transaction, err)
+		if !archived {
+			// Failures are always kept for debugging
+			if err := archivePayload(ctx, "inbound", contentType, body, transaction.ID); err != nil {
+				log.Printf("ERROR: archive: %v\n", err)
+			}
+		}
+		if isTimeout(err) {
+			return transaction, &httpError{Status: http.StatusGatewayTimeout, Message: "Timed out saving or publishing the transaction"}
+		}
+		if errors.Is(err, errPublishFailed) {
+			return transaction, &httpError{Status: http.StatusInternalServerError, Code: codeDownstreamFailed, Message: "Failed to publish to Kafka"}
+		}
+		return transaction, &httpError{Status: http.StatusInternalServerError, Message: "Failed to save transaction"}
+	}
+	return transaction, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers larger than this are dropped instead of pooled so one huge
+// interchange does not pin its memory for the life of the process
+const maxPooledBuffer = 4 << 20
+
+// Reusable request body buffers
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// Read r into a pooled buffer; the caller must releaseBuffer it when done
+// and must not keep references to its bytes afterwards
+func readPooled(r io.Reader) (*bytes.Buffer, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := buf.ReadFrom(r); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Return a buffer to the pool
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// Scratch state reused across X12 parses
+type x12Scratch struct {
+	segments []Segment
+}
+
+var x12ScratchPool = sync.Pool{
+	New: func() any { return &x12Scratch{segments: make([]Segment, 0, 256)} },
+}
+
+// Outbound writers; their buffers are reused across interchanges
+var x12WriterPool = sync.Pool{
+	New: func() any { return new(x12Writer) },
+}
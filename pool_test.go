@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// An interchange of sets 856s, each with one shipment
+func benchInterchange(sets int) []byte {
+	var b strings.Builder
+	b.WriteString("ISA*00*          *00*          *ZZ*ACME           *ZZ*EDIGATEWAY     *240502*0900*U*00401*000000001*0*T*>~\n")
+	b.WriteString("GS*SH*ACME*EDIGATEWAY*20240502*0900*1*X*004010~\n")
+	for i := 1; i <= sets; i++ {
+		fmt.Fprintf(&b, "ST*856*%04d~\nBSN*00*SHP%d*20240502*0900~\nTD5**2*UPSN~\nREF*BM*BOL-%d~\nN1*ST*Store 12~\nLIN**VN*SKU-%d~\nSN1**4*EA~\nSE*8*%04d~\n", i, i, i, i, i)
+	}
+	fmt.Fprintf(&b, "GE*%d*1~\nIEA*1*000000001~\n", sets)
+	return []byte(b.String())
+}
+
+// parseX12 without the pooled scratch space, as before pooling
+func parseX12Unpooled(data []byte) ([]X12Interchange, error) {
+	segments, d, err := splitSegments(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	p := x12Parser{d: d, keep: true}
+	for _, seg := range segments {
+		if _, err := p.feed(seg); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return p.done, nil
+}
+
+func TestParseX12PooledMatchesUnpooled(t *testing.T) {
+	data := benchInterchange(50)
+	for i := 0; i < 3; i++ {
+		pooled, err := parseX12(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpooled, err := parseX12Unpooled(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(pooled) != fmt.Sprint(unpooled) {
+			t.Fatalf("pooled parse differs:\n%v\n%v", pooled, unpooled)
+		}
+	}
+}
+
+func BenchmarkReadPooled(b *testing.B) {
+	data := benchInterchange(500)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		buf, err := readPooled(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		releaseBuffer(buf)
+	}
+}
+
+func BenchmarkReadUnpooled(b *testing.B) {
+	data := benchInterchange(500)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadAll(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseX12Pooled(b *testing.B) {
+	data := benchInterchange(500)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := parseX12(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseX12Unpooled(b *testing.B) {
+	data := benchInterchange(500)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := parseX12Unpooled(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Item loops of one 856, the bulk of what an outbound writer writes
+func writeBenchItems(w *x12Writer) string {
+	for i := 0; i < 500; i++ {
+		writeItem(w, i+2, 1, Item{SKU: fmt.Sprint("SKU-", i), Quantity: 4, UOM: "EA", Carton: "00012345670000000001"})
+	}
+	return w.String()
+}
+
+func BenchmarkX12WriterPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := newX12Writer(defaultDelimiters)
+		writeBenchItems(w)
+		w.release()
+	}
+}
+
+func BenchmarkX12WriterUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeBenchItems(&x12Writer{d: defaultDelimiters})
+	}
+}
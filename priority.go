@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Priority lanes keep a flood of routine documents from delaying
+// time-critical ones, such as ASNs for trucks already on the road. Every
+// received transaction has a priority: its document rule's, else its
+// partner's, else its type's in PRIORITY_TYPES, else normal. Asynchronous
+// jobs and Kafka writes wait in the lane of their priority, each lane with
+// its own bounded workers, and with KAFKA_PRIORITY_LANES the events of high
+// and low priority transactions go to topics of their own.
+var (
+	priorityTypes, priorityTypesErr = parsePriorityTypes(getEnv("PRIORITY_TYPES", ""))
+	kafkaPriorityLanes              = getEnvBool("KAFKA_PRIORITY_LANES", false)
+)
+
+// Lanes, most urgent first
+var priorities = []string{priorityHigh, priorityNormal, priorityLow}
+
+var (
+	priorityQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edi_priority_queue_depth",
+		Help: "Work waiting for a worker, by pool (jobs or kafka) and priority lane.",
+	}, []string{"pool", "priority"})
+	priorityWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "edi_priority_wait_seconds",
+		Help:    "Time work waited for a worker, by pool (jobs or kafka) and priority lane.",
+		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"pool", "priority"})
+)
+
+func validPriority(priority string) bool {
+	switch priority {
+	case "", priorityHigh, priorityNormal, priorityLow:
+		return true
+	}
+	return false
+}
+
+// Lane of a priority; empty and unknown ones are normal
+func lane(priority string) string {
+	if priority == priorityHigh || priority == priorityLow {
+		return priority
+	}
+	return priorityNormal
+}
+
+// Priority of each transaction type from PRIORITY_TYPES, comma separated
+// type=priority pairs such as "856=high,846=low"
+func parsePriorityTypes(spec string) (map[string]string, error) {
+	types := map[string]string{}
+	for _, entry := range splitList(spec) {
+		txType, priority, ok := strings.Cut(entry, "=")
+		txType, priority = strings.TrimSpace(txType), strings.TrimSpace(priority)
+		if !ok || txType == "" || priority == "" || !validPriority(priority) {
+			return nil, fmt.Errorf("PRIORITY_TYPES: %q is not type=priority with priority high, normal or low", entry)
+		}
+		types[txType] = priority
+	}
+	return types, nil
+}
+
+// Give a received transaction no document rule prioritized the priority of
+// its partner or its type
+func classifyPriority(ctx context.Context, t *Transaction) {
+	if t.Priority != "" {
+		return
+	}
+	if t.PartnerID != "" {
+		if p, err := loadPartner(ctx, t.PartnerID); err == nil && p.Priority != "" {
+			t.Priority = p.Priority
+			return
+		}
+	}
+	t.Priority = priorityTypes[t.Type]
+}
+
+// Priority of a job, before its documents are parsed: the submitting
+// partner's, else the highest in PRIORITY_TYPES of the X12 sets it
+// carries, where sets of other types count as normal
+func jobPriority(ctx context.Context, files []jobFile) string {
+	if id := partnerHint(ctx); id != "" {
+		if p, err := loadPartner(ctx, id); err == nil && p.Priority != "" {
+			return p.Priority
+		}
+	}
+	if len(priorityTypes) == 0 {
+		return priorityNormal
+	}
+	best, found := indexOf(priorities, priorityNormal), false
+	for _, f := range files {
+		for _, txType := range sniffX12Types(f.data) {
+			if i := indexOf(priorities, lane(priorityTypes[txType])); !found || i < best {
+				best, found = i, true
+			}
+		}
+	}
+	return priorities[best]
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Transaction set identifiers (ST01) of an X12 interchange, found without
+// parsing it
+func sniffX12Types(data []byte) []string {
+	d, err := detectDelimiters(data)
+	if err != nil {
+		return nil
+	}
+	sep, term := d.Element, d.Segment
+	marker := []byte{'S', 'T', sep}
+	var types []string
+	for i := 0; ; {
+		n := bytes.Index(data[i:], marker)
+		if n < 0 {
+			return types
+		}
+		i += n
+		if prev := data[i-1]; prev == term || prev == '\n' || prev == '\r' {
+			rest := data[i+len(marker):]
+			if end := bytes.IndexAny(rest, string([]byte{sep, term})); end > 0 {
+				types = append(types, string(rest[:end]))
+			}
+		}
+		i += len(marker)
+	}
+}
+
+// Topic of an event about t on its lane: high and low priority events go
+// to <topic>.high and <topic>.low with KAFKA_PRIORITY_LANES
+func laneTopic(topic string, t Transaction) string {
+	if !kafkaPriorityLanes || lane(t.Priority) == priorityNormal {
+		return topic
+	}
+	return topic + "." + lane(t.Priority)
+}
+
+// A topic with its lane topics, when there are any
+func laneTopics(topic string) []string {
+	if !kafkaPriorityLanes {
+		return []string{topic}
+	}
+	return []string{topic, topic + "." + priorityHigh, topic + "." + priorityLow}
+}
+
+// Bounded slots for one pool of work, per lane, so each lane has workers no
+// other lane can take
+type priorityLanes struct {
+	pool  string
+	slots map[string]chan struct{}
+}
+
+func newPriorityLanes(pool string, high, normal, low int) *priorityLanes {
+	return &priorityLanes{pool: pool, slots: map[string]chan struct{}{
+		priorityHigh:   make(chan struct{}, atLeastOne(high)),
+		priorityNormal: make(chan struct{}, atLeastOne(normal)),
+		priorityLow:    make(chan struct{}, atLeastOne(low)),
+	}}
+}
+
+// Wait for a slot in the lane of priority
+func (l *priorityLanes) acquire(ctx context.Context, priority string) (func(), error) {
+	priority = lane(priority)
+	depth := priorityQueueDepth.WithLabelValues(l.pool, priority)
+	start := time.Now()
+	depth.Inc()
+	select {
+	case l.slots[priority] <- struct{}{}:
+	case <-ctx.Done():
+		depth.Dec()
+		return nil, ctx.Err()
+	}
+	depth.Dec()
+	priorityWait.WithLabelValues(l.pool, priority).Observe(time.Since(start).Seconds())
+	inFlightGauge.WithLabelValues(l.pool).Inc()
+	return func() {
+		inFlightGauge.WithLabelValues(l.pool).Dec()
+		<-l.slots[priority]
+	}, nil
+}
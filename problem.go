@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error responses are RFC 7807 problem details (application/problem+json)
+// with a machine-readable code, the offending fields of validation errors
+// and the request's correlation ID.
+
+// Error codes of problem responses
+const (
+	codeValidationFailed     = "VALIDATION_FAILED"
+	codeUnprocessable        = "UNPROCESSABLE_DOCUMENT"
+	codeDuplicateInterchange = "DUPLICATE_INTERCHANGE"
+	codeInterchangeRejected  = "INTERCHANGE_REJECTED" // envelope in error, answered with a TA1
+	codePartnerUnknown       = "PARTNER_UNKNOWN"
+	codePartnerDeactivated   = "PARTNER_DEACTIVATED"
+	codeSenderMismatch       = "SENDER_MISMATCH"
+	codeSignatureInvalid     = "SIGNATURE_INVALID"
+	codeRequestReplayed      = "REQUEST_REPLAYED"
+	codePolicyVetoed         = "POLICY_VETOED"
+	codeSNIPFailed           = "SNIP_VALIDATION_FAILED"
+	codeNotFound             = "NOT_FOUND"
+	codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	codeConflict             = "CONFLICT"
+	codeForbidden            = "FORBIDDEN"
+	codeGone                 = "GONE"
+	codePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	codeUnsupportedMedia     = "UNSUPPORTED_MEDIA_TYPE"
+	codeRateLimited          = "RATE_LIMITED"
+	codeQuotaExceeded        = "QUOTA_EXCEEDED"
+	codeUnavailable          = "SERVICE_UNAVAILABLE"
+	codeDownstreamFailed     = "DOWNSTREAM_FAILED"
+	codeDownstreamTimeout    = "DOWNSTREAM_TIMEOUT"
+	codeInternal             = "INTERNAL_ERROR"
+)
+
+// Code of an error without one of its own
+func defaultErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeValidationFailed
+	case http.StatusUnprocessableEntity:
+		return codeUnprocessable
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return codeForbidden
+	case http.StatusGone:
+		return codeGone
+	case http.StatusRequestEntityTooLarge:
+		return codePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codeUnsupportedMedia
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	case http.StatusBadGateway:
+		return codeDownstreamFailed
+	case http.StatusGatewayTimeout:
+		return codeDownstreamTimeout
+	}
+	return codeInternal
+}
+
+// Error reported to the caller with an HTTP status; Code defaults from the
+// status
+type httpError struct {
+	Status     int
+	Code       string
+	Message    string
+	Fields     []fieldError
+	RetryAfter time.Duration // sent as Retry-After when set
+}
+
+func (e *httpError) Error() string {
+	return e.Message
+}
+
+// What is wrong with one field of a request
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+var errPartnerUnknown = &httpError{Status: http.StatusNotFound, Code: codePartnerUnknown, Message: "Partner not found"}
+
+// Code of err when it is an httpError, for results that report errors
+// without a response of their own
+func errorCode(err error) string {
+	var he *httpError
+	if !errors.As(err, &he) {
+		return ""
+	}
+	if he.Code != "" {
+		return he.Code
+	}
+	return defaultErrorCode(he.Status)
+}
+
+// Problem details response body
+type problem struct {
+	Type          string       `json:"type"`
+	Title         string       `json:"title"`
+	Status        int          `json:"status"`
+	Code          string       `json:"code"`
+	Detail        string       `json:"detail,omitempty"`
+	CorrelationID string       `json:"correlation_id,omitempty"`
+	Errors        []fieldError `json:"errors,omitempty"`
+}
+
+// Validation messages name their field first, e.g. "limit must be a
+// positive number" or "windows[1].start must be HH:MM"
+var fieldMessage = regexp.MustCompile(`^([a-z][a-z0-9_]*(?:\[\d+\])?(?:\.[a-z][a-z0-9_]*(?:\[\d+\])?)*) ((?:must|is|are|needs|cannot) .*)$`)
+
+// Write a problem response, like http.Error
+func writeProblem(w http.ResponseWriter, detail string, status int) {
+	writeError(w, &httpError{Status: status, Message: detail})
+}
+
+// Write err as a problem response, hiding internal details. Timeouts talking
+// to Kafka, the database or a partner are 504 DOWNSTREAM_TIMEOUT.
+func writeError(w http.ResponseWriter, err error) {
+	var he *httpError
+	if !errors.As(err, &he) {
+		log.Printf("ERROR: %v\n", err)
+		he = &httpError{Status: http.StatusInternalServerError, Message: "Internal error"}
+		if isTimeout(err) {
+			he = &httpError{Status: http.StatusGatewayTimeout, Message: "Timed out waiting for a downstream service"}
+		}
+	}
+	p := problem{
+		Title:         http.StatusText(he.Status),
+		Status:        he.Status,
+		Code:          he.Code,
+		Detail:        he.Message,
+		CorrelationID: w.Header().Get("X-Correlation-ID"),
+		Errors:        he.Fields,
+	}
+	if p.Code == "" {
+		p.Code = defaultErrorCode(he.Status)
+	}
+	if p.Errors == nil && p.Code == codeValidationFailed {
+		if m := fieldMessage.FindStringSubmatch(he.Message); m != nil {
+			p.Errors = []fieldError{{Field: m[1], Message: m[2]}}
+		}
+	}
+	p.Type = "urn:edigateway:problem:" + strings.ToLower(strings.ReplaceAll(p.Code, "_", "-"))
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if he.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(he.RetryAfter.Seconds()))))
+	} else if he.Status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.WriteHeader(he.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Whether err is a deadline or network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Problem responses for requests no route matches
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, "No such endpoint "+r.URL.Path, http.StatusNotFound)
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r.Method+" is not allowed on "+r.URL.Path, http.StatusMethodNotAllowed)
+}
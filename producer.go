@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Producer delivery guarantees. The defaults favour durability: a write
+// counts only once every in-sync replica has it, and failed writes are
+// retried before the transaction is reported as failed.
+var (
+	kafkaRequiredAcks      = getEnv("KAFKA_REQUIRED_ACKS", "all")
+	kafkaMaxAttempts       = getEnvInt("KAFKA_MAX_ATTEMPTS", 10)
+	kafkaWriteTimeout      = getEnvDuration("KAFKA_WRITE_TIMEOUT", 10*time.Second)
+	kafkaMinInsyncReplicas = getEnvInt("KAFKA_MIN_INSYNC_REPLICAS", 2)
+)
+
+// Producer batching. A batch of a partition is written once it holds
+// KAFKA_BATCH_SIZE messages or KAFKA_BATCH_BYTES, or KAFKA_LINGER after its
+// first message. With KAFKA_ASYNC events are written in the background
+// through the event outbox, holding at most KAFKA_BUFFER unconfirmed events.
+var (
+	kafkaBatchSize   = getEnvInt("KAFKA_BATCH_SIZE", 100)
+	kafkaBatchBytes  = getEnvInt("KAFKA_BATCH_BYTES", 200<<20) // also the largest message
+	kafkaLinger      = getEnvDuration("KAFKA_LINGER", 10*time.Millisecond)
+	kafkaCompression = getEnv("KAFKA_COMPRESSION", "snappy")
+	kafkaAsync       = getEnvBool("KAFKA_ASYNC", true)
+	kafkaBuffer      = getEnvInt("KAFKA_BUFFER", 10000)
+)
+
+// Acknowledgements a write waits for: all in-sync replicas, the leader only,
+// or none
+func parseRequiredAcks(s string) (kafka.RequiredAcks, error) {
+	switch s {
+	case "all", "-1":
+		return kafka.RequireAll, nil
+	case "one", "1":
+		return kafka.RequireOne, nil
+	case "none", "0":
+		return kafka.RequireNone, nil
+	}
+	return 0, fmt.Errorf("KAFKA_REQUIRED_ACKS must be all, one or none, not %q", s)
+}
+
+// Codec batches are compressed with: none, gzip, snappy, lz4 or zstd
+func parseCompression(s string) (kafka.Compression, error) {
+	switch s {
+	case "none", "":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	}
+	return 0, fmt.Errorf("KAFKA_COMPRESSION must be none, gzip, snappy, lz4 or zstd, not %q", s)
+}
+
+// Check the producer settings and say what they guarantee
+func checkProducerConfig() (kafka.RequiredAcks, kafka.Compression, error) {
+	acks, err := parseRequiredAcks(kafkaRequiredAcks)
+	if err != nil {
+		return acks, 0, err
+	}
+	compression, err := parseCompression(kafkaCompression)
+	if err != nil {
+		return acks, 0, err
+	}
+	if kafkaMaxAttempts < 1 {
+		return acks, 0, fmt.Errorf("KAFKA_MAX_ATTEMPTS must be positive, not %d", kafkaMaxAttempts)
+	}
+	if kafkaBatchSize < 1 || kafkaBatchBytes < 1 {
+		return acks, 0, fmt.Errorf("KAFKA_BATCH_SIZE and KAFKA_BATCH_BYTES must be positive, not %d and %d", kafkaBatchSize, kafkaBatchBytes)
+	}
+	if kafkaAsync && kafkaBuffer < kafkaBatchSize {
+		return acks, 0, fmt.Errorf("KAFKA_BUFFER must be at least KAFKA_BATCH_SIZE (%d), not %d", kafkaBatchSize, kafkaBuffer)
+	}
+	if acks != kafka.RequireAll {
+		log.Printf("ALERT: KAFKA_REQUIRED_ACKS=%s: events acknowledged by the gateway can be lost when a broker fails", kafkaRequiredAcks)
+	}
+	log.Printf("Kafka producer: acks=%s attempts=%d write timeout=%s batch=%d/%dB linger=%s compression=%s async=%t",
+		kafkaRequiredAcks, kafkaMaxAttempts, kafkaWriteTimeout, kafkaBatchSize, kafkaBatchBytes, kafkaLinger, kafkaCompression, kafkaAsync)
+	return acks, compression, nil
+}
+
+// With acks=all a write is only as safe as the replicas that must have it:
+// report topics whose min.insync.replicas is below KAFKA_MIN_INSYNC_REPLICAS.
+// Problems are only logged, as brokers may not allow describing configs.
+func checkTopicReplication(ctx context.Context, acks kafka.RequiredAcks, brokers []string, topics []string) {
+	if acks != kafka.RequireAll || kafkaMinInsyncReplicas <= 1 || len(topics) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req := &kafka.DescribeConfigsRequest{}
+	for _, topic := range topics {
+		req.Resources = append(req.Resources, kafka.DescribeConfigRequestResource{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: topic,
+			ConfigNames:  []string{"min.insync.replicas"},
+		})
+	}
+	resp, err := describeConfigs(ctx, &kafka.Client{Addr: kafka.TCP(brokers...)}, req)
+	if err != nil {
+		log.Printf("ERROR: describe topic configs: %v\n", err)
+		return
+	}
+	for _, res := range resp.Resources {
+		if res.Error != nil {
+			log.Printf("ERROR: topic %s: %v\n", res.ResourceName, res.Error)
+			continue
+		}
+		for _, entry := range res.ConfigEntries {
+			if entry.ConfigName != "min.insync.replicas" {
+				continue
+			}
+			if n, err := strconv.Atoi(entry.ConfigValue); err == nil && n < kafkaMinInsyncReplicas {
+				log.Printf("ALERT: topic %s has min.insync.replicas=%d (want %d): a write acknowledged by a single replica is lost if that broker fails",
+					res.ResourceName, n, kafkaMinInsyncReplicas)
+			}
+		}
+	}
+}
+
+// kafka-go panics instead of failing when the transport answers with an
+// error message, e.g. when no broker is reachable
+func describeConfigs(ctx context.Context, client *kafka.Client, req *kafka.DescribeConfigsRequest) (resp *kafka.DescribeConfigsResponse, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("describe configs: %v", p)
+		}
+	}()
+	return client.DescribeConfigs(ctx, req)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Where events go: kafka, memory (kept in process, see /admin/events) or
+// none. memory and none let the gateway run without a broker, e.g. in tests
+// and local development.
+var eventsBackend = getEnv("EVENTS_BACKEND", "kafka")
+
+// Events kept by the memory backend, oldest dropped first
+var memoryEventsMax = getEnvInt("MEMORY_EVENTS_MAX", 10000)
+
+// Writes published events to a topic
+type eventPublisher interface {
+	publish(ctx context.Context, topic string, msgs ...kafka.Message) error
+}
+
+// Publisher behind publishEvent and the outbound consumer; nil when running
+// without events, e.g. at the edge
+var publisher eventPublisher
+
+// Kafka writers of the topic router
+type kafkaPublisher struct {
+	router *topicRouter
+}
+
+func (p kafkaPublisher) publish(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	if kafkaAsync {
+		return enqueueEvents(ctx, p.router, topic, msgs)
+	}
+	return p.router.writer(topic).WriteMessages(ctx, msgs...)
+}
+
+// An event kept by memoryPublisher
+type publishedEvent struct {
+	Offset      int64             `json:"offset"`
+	Topic       string            `json:"topic"`
+	Key         string            `json:"key"`
+	Headers     map[string]string `json:"headers"`
+	Value       json.RawMessage   `json:"value"`
+	PublishedAt time.Time         `json:"published_at"`
+}
+
+// Keeps the latest published events in memory instead of writing them to
+// Kafka
+type memoryPublisher struct {
+	mu     sync.Mutex
+	max    int
+	next   int64
+	events []publishedEvent
+}
+
+func newMemoryPublisher(max int) *memoryPublisher {
+	return &memoryPublisher{max: max}
+}
+
+func (p *memoryPublisher) publish(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, msg := range msgs {
+		e := publishedEvent{Offset: p.next, Topic: topic, Key: string(msg.Key), Headers: map[string]string{}, PublishedAt: time.Now().UTC()}
+		for _, h := range msg.Headers {
+			e.Headers[h.Key] = string(h.Value)
+		}
+		// Registry-framed values are not JSON; keep them as a JSON string
+		if json.Valid(msg.Value) {
+			e.Value = append(json.RawMessage(nil), msg.Value...)
+		} else {
+			e.Value, _ = json.Marshal(msg.Value)
+		}
+		p.events = append(p.events, e)
+		p.next++
+	}
+	if len(p.events) > p.max {
+		p.events = append([]publishedEvent(nil), p.events[len(p.events)-p.max:]...)
+	}
+	return nil
+}
+
+// Events after offset matching topic, event type and tenant, each when set
+func (p *memoryPublisher) list(after int64, topic, eventType, tenant string, limit int) []publishedEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	events := []publishedEvent{}
+	for _, e := range p.events {
+		if e.Offset <= after || (topic != "" && e.Topic != topic) || (eventType != "" && e.Headers["event_type"] != eventType) {
+			continue
+		}
+		if tenant != allTenants && e.Headers["tenant_id"] != tenant {
+			continue
+		}
+		events = append(events, e)
+		if len(events) == limit {
+			break
+		}
+	}
+	return events
+}
+
+// Set up the configured events backend; the topic router is built for the
+// memory backend too, so events land on the topics they would in Kafka
+func initEvents() error {
+	switch eventsBackend {
+	case "kafka":
+		if err := initKafka(); err != nil {
+			return err
+		}
+		publisher = kafkaPublisher{router: kafkaRouter}
+	case "memory":
+		classes, err := parseEventTopics(getEnv("KAFKA_EVENT_TOPICS", ""), getEnv("KAFKA_TOPIC", ""))
+		if err != nil {
+			return err
+		}
+		if kafkaRouter, err = newTopicRouter(nil, classes, getEnv("KAFKA_TOPIC_ROUTES", "")); err != nil {
+			return err
+		}
+		publisher = newMemoryPublisher(memoryEventsMax)
+		if faultInjection {
+			publisher = faultyPublisher{next: publisher}
+		}
+	case "none":
+	default:
+		return fmt.Errorf("EVENTS_BACKEND must be kafka, memory or none, not %q", eventsBackend)
+	}
+	return nil
+}
+
+// List the events the memory backend kept, oldest first: topic, type and
+// after (an offset) narrow the list, so a test can poll for what is new
+func listEventsHandler(w http.ResponseWriter, r *http.Request) {
+	mem, ok := publisher.(*memoryPublisher)
+	if !ok {
+		writeProblem(w, "Events are only kept with EVENTS_BACKEND=memory", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	after := int64(-1)
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeProblem(w, "after must be an event offset", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeProblem(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxViewPage {
+		limit = maxViewPage
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mem.list(after, q.Get("topic"), q.Get("type"), tenantID(r.Context()), limit))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm/clause"
+)
+
+// Inbound payloads received while the database is unavailable are written to
+// INBOUND_QUEUE_DIR and processed once it recovers
+var inboundQueueDir = getEnv("INBOUND_QUEUE_DIR", "/var/lib/edigateway/queue")
+
+var inboundQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "inbound_queued_payloads",
+	Help: "Inbound payloads waiting on disk for the database to recover.",
+})
+
+// One queued request: a raw body, or the documents of a multipart submission
+type queuedPayload struct {
+	ID            string            `json:"id"`
+	ReceivedAt    time.Time         `json:"received_at"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	TenantID      string            `json:"tenant_id"`
+	PartnerHint   string            `json:"partner_hint,omitempty"`
+	Channel       *channelIdentity  `json:"channel,omitempty"`
+	Signature     *requestSignature `json:"signature,omitempty"`
+	Submission    *Submission       `json:"submission,omitempty"`
+	Files         []queuedFile      `json:"files"`
+	Raw           bool              `json:"raw"` // whether the body came from POST /inbound
+}
+
+type queuedFile struct {
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+func initInboundQueue() error {
+	if err := os.MkdirAll(inboundQueueDir, 0o750); err != nil {
+		return err
+	}
+	names, err := queuedFiles()
+	if err != nil {
+		return err
+	}
+	inboundQueued.Set(float64(len(names)))
+	return nil
+}
+
+// Whether inbound requests should be queued rather than processed
+func queueInbound() bool {
+	return !edgeMode && dbBreaker.open()
+}
+
+// Write the payload atomically and answer 202 Accepted
+func acceptQueued(w http.ResponseWriter, r *http.Request, sub *Submission, files []jobFile, raw bool) {
+	q := queuedPayload{
+		ID:            uuid.New().String(),
+		ReceivedAt:    time.Now().UTC(),
+		CorrelationID: correlationID(r.Context()),
+		TenantID:      tenantID(r.Context()),
+		PartnerHint:   partnerHint(r.Context()),
+		Submission:    sub,
+		Raw:           raw,
+	}
+	if ch := channelFrom(r.Context()); ch.Partner != "" {
+		q.Channel = &ch
+	}
+	if sig, ok := requestSignatureFrom(r.Context()); ok {
+		q.Signature = &sig
+	}
+	for _, f := range files {
+		q.Files = append(q.Files, queuedFile{Name: f.name, ContentType: f.contentType, Data: f.data})
+	}
+	b, err := json.Marshal(q)
+	if err == nil {
+		name := fmt.Sprintf("%d-%s.json", q.ReceivedAt.UnixNano(), q.ID)
+		tmp := filepath.Join(inboundQueueDir, "."+name)
+		if err = os.WriteFile(tmp, b, 0o640); err == nil {
+			err = os.Rename(tmp, filepath.Join(inboundQueueDir, name))
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: queue: %v\n", err)
+		w.Header().Set("Retry-After", "5")
+		writeProblem(w, "Database unavailable, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	inboundQueued.Inc()
+	w.Header().Set("X-Queue-ID", q.ID)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Database unavailable: payload queued as %s and will be processed when it recovers\n", q.ID)
+}
+
+// Queued payload file names, oldest first
+func queuedFiles() ([]string, error) {
+	entries, err := os.ReadDir(inboundQueueDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Process queued payloads whenever the database is available
+func runInboundQueue(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := drainInboundQueue(ctx); err != nil {
+			log.Printf("Inbound queue paused after %d payloads: %v", n, err)
+		} else if n > 0 {
+			log.Printf("Inbound queue processed %d payloads", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Process queued payloads oldest first, stopping while the database is down
+func drainInboundQueue(ctx context.Context) (int, error) {
+	names, err := queuedFiles()
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range names {
+		if dbBreaker.open() {
+			return i, errDBUnavailable
+		}
+		path := filepath.Join(inboundQueueDir, name)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return i, err
+		}
+		var q queuedPayload
+		if err := json.Unmarshal(b, &q); err != nil {
+			log.Printf("ERROR: queue: %s is unreadable, leaving it in place: %v\n", name, err)
+			continue
+		}
+		if err := processQueued(ctx, q); err != nil {
+			return i, err
+		}
+		if err := os.Remove(path); err != nil {
+			return i, err
+		}
+		inboundQueued.Dec()
+	}
+	return len(names), nil
+}
+
+// Run a queued payload through the pipeline. The payload stays queued when
+// nothing could be saved because the database went away again.
+func processQueued(ctx context.Context, q queuedPayload) error {
+	ctx = withPartnerHint(withCorrelationID(ctx, q.CorrelationID), q.PartnerHint)
+	if q.Channel != nil {
+		ctx = withChannel(ctx, *q.Channel)
+	}
+	if q.Signature != nil {
+		ctx = withRequestSignature(ctx, *q.Signature)
+	}
+	if q.TenantID == "" {
+		q.TenantID = defaultTenant // queued before tenants existed
+	}
+	ctx = withTenant(ctx, q.TenantID)
+	if q.Submission != nil {
+		if err := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(q.Submission).Error; err != nil {
+			return err
+		}
+	}
+	var results []batchResult
+	for _, f := range q.Files {
+		if q.Raw && singleJSON(detectFormat(f.ContentType, f.Data), f.Data) {
+			t, err := ingestJSON(ctx, f.ContentType, f.Data)
+			res := batchResult{Format: formatJSON, ID: t.ID, Status: "created"}
+			if err != nil {
+				res = batchResult{Format: formatJSON, Status: "failed", Error: err.Error()}
+			}
+			results = append(results, res)
+			continue
+		}
+		results = append(results, processDocument(ctx, q.Submission, f.Name, f.ContentType, f.Data)...)
+	}
+	created := 0
+	for _, res := range results {
+		if res.Status != "failed" {
+			created++
+		} else {
+			log.Printf("ERROR: queued payload %s: %s %s\n", q.ID, res.File, res.Error)
+		}
+	}
+	if created == 0 && dbBreaker.degraded() {
+		return errDBUnavailable
+	}
+	return nil
+}
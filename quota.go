@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Quotas sharing the gateway's capacity out between tenants, so one cannot
+// exhaust it for the others. TENANT_MAX_* apply to every tenant and
+// TENANT_QUOTAS overrides them as tenant.quota=limit pairs, e.g.
+// "acme.documents_per_day=50000,acme.storage_bytes=0"; 0 lifts a quota.
+// Usage is read from the database every QUOTA_REFRESH_INTERVAL, which
+// replicas share, and counted by each replica in between.
+var (
+	tenantMaxStorage           = int64(getEnvInt("TENANT_MAX_STORAGE_BYTES", 0))
+	tenantMaxDocumentsPerDay   = int64(getEnvInt("TENANT_MAX_DOCUMENTS_PER_DAY", 0))
+	tenantMaxDeliveriesPerHour = int64(getEnvInt("TENANT_MAX_DELIVERIES_PER_HOUR", 0))
+	quotaRefreshInterval       = getEnvDuration("QUOTA_REFRESH_INTERVAL", time.Minute)
+
+	tenantQuotas, tenantQuotasErr = parseTenantQuotas(getEnv("TENANT_QUOTAS", ""))
+)
+
+const (
+	quotaStorage    = "storage_bytes"       // archived payloads and attachments
+	quotaDocuments  = "documents_per_day"   // transactions received since midnight UTC
+	quotaDeliveries = "deliveries_per_hour" // delivery attempts in the clock hour
+)
+
+var quotaNames = []string{quotaStorage, quotaDocuments, quotaDeliveries}
+
+var (
+	quotaUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edi_tenant_quota_used",
+		Help: "Usage of each tenant quota in its current window.",
+	}, []string{"tenant", "quota"})
+	quotaLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edi_tenant_quota_limit",
+		Help: "Limit of each tenant quota; absent when unlimited.",
+	}, []string{"tenant", "quota"})
+	quotaExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edi_tenant_quota_exceeded_total",
+		Help: "Documents, uploads and deliveries refused because their tenant was over a quota.",
+	}, []string{"tenant", "quota"})
+)
+
+// Per-tenant overrides of TENANT_QUOTAS, by tenant and quota
+func parseTenantQuotas(s string) (map[string]map[string]int64, error) {
+	out := map[string]map[string]int64{}
+	for _, pair := range splitList(s) {
+		key, value, ok := strings.Cut(pair, "=")
+		tenant, quota, dotted := strings.Cut(strings.TrimSpace(key), ".")
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if !ok || !dotted || err != nil || n < 0 {
+			return nil, fmt.Errorf("TENANT_QUOTAS: %q is not tenant.quota=limit", pair)
+		}
+		if !knownTenant(tenant) {
+			return nil, fmt.Errorf("TENANT_QUOTAS: unknown tenant %s", tenant)
+		}
+		if !validQuota(quota) {
+			return nil, fmt.Errorf("TENANT_QUOTAS: quota must be one of %s, not %q", strings.Join(quotaNames, ", "), quota)
+		}
+		if out[tenant] == nil {
+			out[tenant] = map[string]int64{}
+		}
+		out[tenant][quota] = n
+	}
+	return out, nil
+}
+
+func validQuota(quota string) bool {
+	for _, q := range quotaNames {
+		if q == quota {
+			return true
+		}
+	}
+	return false
+}
+
+// Limit of a tenant's quota; 0 when unlimited
+func tenantQuotaLimit(tenant, quota string) int64 {
+	if n, ok := tenantQuotas[tenant][quota]; ok {
+		return n
+	}
+	switch quota {
+	case quotaStorage:
+		return tenantMaxStorage
+	case quotaDocuments:
+		return tenantMaxDocumentsPerDay
+	}
+	return tenantMaxDeliveriesPerHour
+}
+
+// Window a quota counts usage over: from start to end, with a zero end for
+// storage, which never resets
+func quotaWindow(quota string, now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	switch quota {
+	case quotaDocuments:
+		start = now.Truncate(24 * time.Hour)
+		return start, start.Add(24 * time.Hour)
+	case quotaDeliveries:
+		start = now.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	}
+	return time.Time{}, time.Time{}
+}
+
+// Usage of one quota in the window starting at start
+type quotaCounter struct {
+	start time.Time
+	used  int64
+}
+
+var quotaUsage = struct {
+	sync.Mutex
+	counters map[string]*quotaCounter // by tenant and quota
+}{counters: map[string]*quotaCounter{}}
+
+// Counter of a tenant's quota for the current window, reset when the window
+// turns. Callers hold quotaUsage.
+func quotaCounterFor(tenant, quota string, now time.Time) *quotaCounter {
+	start, _ := quotaWindow(quota, now)
+	key := tenant + "/" + quota
+	c, ok := quotaUsage.counters[key]
+	if !ok || !c.start.Equal(start) {
+		c = &quotaCounter{start: start}
+		quotaUsage.counters[key] = c
+	}
+	return c
+}
+
+// Take n from a tenant's quota, or report how long until the window resets
+// when that would go over it: full is set when the tenant is over
+func takeQuota(tenant, quota string, n int64, now time.Time) (full bool, limit int64, wait time.Duration) {
+	limit = tenantQuotaLimit(tenant, quota)
+	quotaUsage.Lock()
+	defer quotaUsage.Unlock()
+	c := quotaCounterFor(tenant, quota, now)
+	if limit > 0 && (c.used >= limit || c.used+n > limit) {
+		quotaExceeded.WithLabelValues(tenant, quota).Inc()
+		if _, end := quotaWindow(quota, now); !end.IsZero() {
+			wait = end.Sub(now)
+		}
+		return true, limit, wait
+	}
+	c.used += n
+	quotaUsed.WithLabelValues(tenant, quota).Set(float64(c.used))
+	return false, limit, 0
+}
+
+// Count n more of a tenant's stored bytes, whether or not that goes over
+func addStorageUsage(tenant string, n int64) {
+	quotaUsage.Lock()
+	defer quotaUsage.Unlock()
+	c := quotaCounterFor(tenant, quotaStorage, time.Now())
+	c.used += n
+	quotaUsed.WithLabelValues(tenant, quotaStorage).Set(float64(c.used))
+}
+
+// Admit one inbound transaction against the tenant's quotas: 429 over
+// documents per day, 507 when its storage is full
+func checkTenantQuotas(ctx context.Context) error {
+	if edgeMode {
+		return nil
+	}
+	tenant, now := tenantID(ctx), time.Now()
+	if full, limit, _ := takeQuota(tenant, quotaStorage, 0, now); full {
+		return &httpError{Status: http.StatusInsufficientStorage, Code: codeQuotaExceeded,
+			Message: fmt.Sprintf("Tenant %s is over its storage quota of %d bytes", tenant, limit)}
+	}
+	if full, limit, wait := takeQuota(tenant, quotaDocuments, 1, now); full {
+		return &httpError{Status: http.StatusTooManyRequests, Code: codeQuotaExceeded, RetryAfter: wait,
+			Message: fmt.Sprintf("Tenant %s is over its quota of %d documents per day", tenant, limit)}
+	}
+	return nil
+}
+
+// Admit an upload of size bytes against the tenant's storage quota
+func checkStorageQuota(ctx context.Context, size int64) error {
+	tenant := tenantID(ctx)
+	if full, limit, _ := takeQuota(tenant, quotaStorage, size, time.Now()); full {
+		return &httpError{Status: http.StatusInsufficientStorage, Code: codeQuotaExceeded,
+			Message: fmt.Sprintf("Tenant %s is over its storage quota of %d bytes", tenant, limit)}
+	}
+	return nil
+}
+
+// Admit one delivery attempt to partnerID against the tenant's quota.
+// Deliveries over it wait for the next hour like those of an open breaker.
+func takeDeliveryQuota(ctx context.Context, partnerID string) error {
+	tenant, now := tenantID(ctx), time.Now()
+	if full, limit, wait := takeQuota(tenant, quotaDeliveries, 1, now); full {
+		return &deliveryPausedError{partnerID: partnerID, until: now.Add(wait),
+			reason: fmt.Sprintf("tenant %s is over its quota of %d deliveries per hour", tenant, limit)}
+	}
+	return nil
+}
+
+// Usage of one quota from the database
+func storedQuotaUsage(ctx context.Context, quota string, now time.Time) (int64, error) {
+	start, _ := quotaWindow(quota, now)
+	var n int64
+	switch quota {
+	case quotaDocuments:
+		err := db.WithContext(ctx).Model(&Transaction{}).Where("date >= ?", start).Count(&n).Error
+		return n, err
+	case quotaDeliveries:
+		err := db.WithContext(ctx).Model(&Delivery{}).Where("created_at >= ?", start).Count(&n).Error
+		return n, err
+	}
+	// Payloads are stored once for all the transactions they carry
+	blobs := db.WithContext(ctx).Model(&RawPayload{}).Select("storage_key, MAX(size) AS size").Group("storage_key")
+	if err := db.WithContext(ctx).Table("(?) AS blobs", blobs).Select("COALESCE(SUM(size), 0)").Scan(&n).Error; err != nil {
+		return 0, err
+	}
+	var attached int64
+	err := db.WithContext(ctx).Model(&Attachment{}).Select("COALESCE(SUM(size), 0)").Scan(&attached).Error
+	return n + attached, err
+}
+
+// Replace every tenant's counted usage with what the database holds
+func refreshQuotaUsage(now time.Time) error {
+	for _, tenant := range tenants {
+		ctx := withTenant(context.Background(), tenant)
+		for _, quota := range quotaNames {
+			n, err := storedQuotaUsage(ctx, quota, now)
+			if err != nil {
+				return fmt.Errorf("tenant %s %s: %w", tenant, quota, err)
+			}
+			quotaUsage.Lock()
+			quotaCounterFor(tenant, quota, now).used = n
+			quotaUsage.Unlock()
+			quotaUsed.WithLabelValues(tenant, quota).Set(float64(n))
+			if limit := tenantQuotaLimit(tenant, quota); limit > 0 {
+				quotaLimit.WithLabelValues(tenant, quota).Set(float64(limit))
+			}
+		}
+	}
+	return nil
+}
+
+// Refresh quota usage now and every interval
+func runQuotaRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := refreshQuotaUsage(time.Now()); err != nil {
+			log.Printf("ERROR: quota usage: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// One quota of the caller's tenant
+type quotaStatus struct {
+	Quota    string     `json:"quota"`
+	Limit    int64      `json:"limit"` // 0 is unlimited
+	Used     int64      `json:"used"`
+	ResetsAt *time.Time `json:"resets_at,omitempty"` // end of the window; storage never resets
+}
+
+// Quotas of a tenant and their usage
+type tenantQuotaReport struct {
+	TenantID string        `json:"tenant_id"`
+	Quotas   []quotaStatus `json:"quotas"`
+}
+
+// Report the caller's tenant quotas and usage
+func tenantQuotasHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, now := tenantID(r.Context()), time.Now()
+	report := tenantQuotaReport{TenantID: tenant}
+	quotaUsage.Lock()
+	for _, quota := range quotaNames {
+		s := quotaStatus{Quota: quota, Limit: tenantQuotaLimit(tenant, quota), Used: quotaCounterFor(tenant, quota, now).used}
+		if _, end := quotaWindow(quota, now); !end.IsZero() {
+			s.ResetsAt = &end
+		}
+		report.Quotas = append(report.Quotas, s)
+	}
+	quotaUsage.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
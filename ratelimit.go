@@ -0,0 +1,238 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Rate limit defaults; a rate of 0 disables that limit
+var (
+	globalRateLimit = getEnvFloat("RATE_LIMIT_RPS", 0)
+	globalRateBurst = getEnvInt("RATE_LIMIT_BURST", 100)
+	keyRateLimit    = getEnvFloat("RATE_LIMIT_KEY_RPS", 0)
+	keyRateBurst    = getEnvInt("RATE_LIMIT_KEY_BURST", 20)
+)
+
+var throttledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "throttled_requests_total",
+	Help: "Requests rejected with 429 by the rate limiter.",
+}, []string{"scope", "partner"})
+
+// Classic token bucket refilled continuously at rate tokens per second
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Add the tokens earned since the last take. A now from before it, taken by
+// a caller before the bucket was created or used, earns nothing.
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// Take one token, or report how long until one is available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// Take n tokens, going into debt when there are fewer, and report how long
+// until the debt is paid off. Unlike take, n may exceed the burst.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Per-caller buckets plus one shared by everyone
+type rateLimiter struct {
+	global *tokenBucket
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	limits  map[string]cachedLimit // API key -> partner limits
+	misses  map[string]time.Time   // API keys of no partner -> when to look again
+}
+
+type cachedLimit struct {
+	partner string
+	tenant  string
+	rate    float64
+	burst   int
+	expires time.Time
+}
+
+var limiter = &rateLimiter{
+	buckets: map[string]*tokenBucket{},
+	limits:  map[string]cachedLimit{},
+	misses:  map[string]time.Time{},
+}
+
+// How long an API key of no partner is remembered as such, and how many are,
+// so made-up keys neither query the database each time nor fill the cache
+const (
+	limitMissTTL   = 10 * time.Second
+	limitMissesMax = 10000
+)
+
+func init() {
+	if globalRateLimit > 0 {
+		limiter.global = newTokenBucket(globalRateLimit, globalRateBurst)
+	}
+}
+
+// Resolve an API key to its partner, tenant and limits, cached for a minute.
+// Keys of no partner are remembered for limitMissTTL.
+func (l *rateLimiter) limitFor(apiKey string, now time.Time) cachedLimit {
+	l.mu.Lock()
+	c, ok := l.limits[apiKey]
+	retry, missed := l.misses[apiKey]
+	l.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c
+	}
+	c = cachedLimit{rate: keyRateLimit, burst: keyRateBurst, expires: now.Add(time.Minute)}
+	if missed && now.Before(retry) {
+		return c
+	}
+	var p Partner
+	if db != nil && db.WithContext(allTenantsContext()).Where("api_key = ?", apiKey).Limit(1).Find(&p).RowsAffected > 0 {
+		c.partner, c.tenant = p.ID, p.TenantID
+		if p.RateLimit > 0 {
+			c.rate, c.burst = p.RateLimit, p.RateBurst
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c.partner != "" {
+		l.limits[apiKey] = c
+		delete(l.misses, apiKey)
+	} else if missed || len(l.misses) < limitMissesMax {
+		l.misses[apiKey] = now.Add(limitMissTTL)
+	}
+	return c
+}
+
+// Bucket for a caller, created on first use
+func (l *rateLimiter) bucket(key string, rate float64, burst int) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = newTokenBucket(rate, burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// Drop buckets that have been idle long enough to be full again, and
+// expired API keys and misses
+func (l *rateLimiter) sweep(idle time.Duration) {
+	now := time.Now()
+	cutoff := now.Add(-idle)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, c := range l.limits {
+		if !now.Before(c.expires) {
+			delete(l.limits, k)
+		}
+	}
+	for k, retry := range l.misses {
+		if !now.Before(retry) {
+			delete(l.misses, k)
+		}
+	}
+	for k, b := range l.buckets {
+		b.mu.Lock()
+		stale := b.last.Before(cutoff)
+		b.mu.Unlock()
+		if stale {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Reject requests over the global or per-caller rate with 429 and Retry-After.
+// Callers are identified by the partner owning their X-API-Key, else by
+// client address, so unknown keys share their address's bucket.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		partner, key := "anonymous", "ip:"+clientIP(r)
+		rate, burst := keyRateLimit, keyRateBurst
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			if c := limiter.limitFor(apiKey, now); c.partner != "" {
+				partner, key, rate, burst = c.partner, "partner:"+c.partner, c.rate, c.burst
+			}
+		}
+		if rate > 0 {
+			if ok, wait := limiter.bucket(key, rate, burst).take(now); !ok {
+				throttle(w, "partner", partner, wait)
+				return
+			}
+		}
+		if limiter.global != nil {
+			if ok, wait := limiter.global.take(now); !ok {
+				throttle(w, "global", partner, wait)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func throttle(w http.ResponseWriter, scope, partner string, wait time.Duration) {
+	throttledCounter.WithLabelValues(scope, partner).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeProblem(w, "Rate limit exceeded", http.StatusTooManyRequests)
+}
+
+// Periodically forget idle callers
+func runLimiterSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		limiter.sweep(interval)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T) {
+	setForTest(t, &limiter, &rateLimiter{buckets: map[string]*tokenBucket{}, limits: map[string]cachedLimit{}, misses: map[string]time.Time{}})
+}
+
+// Made-up API keys are limited with the address they come from
+func TestUnknownKeysShareAddressBucket(t *testing.T) {
+	setForTest(t, &db, nil)
+	setForTest(t, &keyRateLimit, 0.001)
+	setForTest(t, &keyRateBurst, 1)
+	newTestLimiter(t)
+	h := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", "/partners", nil)
+		r.RemoteAddr = "192.0.2.7:4000"
+		r.Header.Set("X-API-Key", fmt.Sprint("made-up-", i))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("request %d: %d, want %d", i, w.Code, want)
+		}
+	}
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets, want the address's only", len(limiter.buckets))
+	}
+}
+
+func TestUnknownKeysCachedBriefly(t *testing.T) {
+	setForTest(t, &db, nil)
+	newTestLimiter(t)
+	now := time.Now()
+	limiter.limitFor("made-up", now)
+	if retry, ok := limiter.misses["made-up"]; !ok || !retry.Equal(now.Add(limitMissTTL)) {
+		t.Fatalf("miss cached until %v %v", retry, ok)
+	}
+	for i := 0; len(limiter.misses) < limitMissesMax; i++ {
+		limiter.misses[fmt.Sprint("key-", i)] = now.Add(limitMissTTL)
+	}
+	limiter.limitFor("one-more", now)
+	if len(limiter.misses) != limitMissesMax {
+		t.Errorf("%d misses cached, want at most %d", len(limiter.misses), limitMissesMax)
+	}
+	limiter.misses = map[string]time.Time{"stale": time.Now().Add(-time.Second)}
+	limiter.sweep(time.Minute)
+	if len(limiter.misses) != 0 {
+		t.Errorf("expired misses kept: %v", limiter.misses)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Daily reconciliation: per partner, the documents received from it and sent
+// to it on a day, how many were acknowledged, rejected or are still pending,
+// and the interchange control numbers involved, so "did you get interchange
+// 000012345?" has an answer. After RECONCILIATION_AT each day the day before
+// is summarized, stored and sent to the report targets.
+var (
+	reconciliationAt                      = getEnv("RECONCILIATION_AT", "01:00") // time of day, empty turns scheduled reports off
+	reconciliationZone, reconciliationErr = loadReconciliationZone(getEnv("RECONCILIATION_TIMEZONE", "UTC"))
+	reconciliationWebhook                 = getEnv("RECONCILIATION_WEBHOOK_URL", "")
+	reconciliationEmail                   = getEnv("RECONCILIATION_EMAIL", "") // comma separated; needs SMTP_ADDR
+)
+
+func loadReconciliationZone(name string) (*time.Location, error) {
+	zone, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC, fmt.Errorf("RECONCILIATION_TIMEZONE: %w", err)
+	}
+	if reconciliationAt != "" {
+		if _, err := time.Parse("15:04", reconciliationAt); err != nil {
+			return zone, fmt.Errorf("RECONCILIATION_AT must be HH:MM, not %q", reconciliationAt)
+		}
+	}
+	return zone, nil
+}
+
+// A stored daily report of a tenant
+type ReconciliationReport struct {
+	ID          uint   `gorm:"primaryKey"`
+	TenantID    string `gorm:"uniqueIndex:idx_reconciliation_reports_tenant_date"`
+	Date        string `gorm:"uniqueIndex:idx_reconciliation_reports_tenant_date"` // YYYY-MM-DD in RECONCILIATION_TIMEZONE
+	Partners    string // JSON array of partnerReconciliation
+	GeneratedAt time.Time
+	NotifiedAt  *time.Time
+}
+
+// The reconciliation of a day
+type reconciliationReport struct {
+	Date        string                  `json:"date"`
+	From        time.Time               `json:"from"`
+	To          time.Time               `json:"to"`
+	GeneratedAt time.Time               `json:"generated_at"`
+	Stored      bool                    `json:"stored"` // generated on schedule, rather than now
+	Partners    []partnerReconciliation `json:"partners"`
+}
+
+// What was exchanged with one partner on the day
+type partnerReconciliation struct {
+	PartnerID string             `json:"partner_id"`
+	Received  reconciliationSide `json:"received"`
+	Sent      reconciliationSide `json:"sent"`
+}
+
+// Documents of one direction. Received documents are acknowledged once
+// processed, rejected when rejected in review and pending while held; sent
+// documents count as the partner's 997 or 999 left them.
+type reconciliationSide struct {
+	Documents      int64            `json:"documents"`
+	Acknowledged   int64            `json:"acknowledged"`
+	Rejected       int64            `json:"rejected"`
+	Pending        int64            `json:"pending"`
+	ByStatus       map[string]int64 `json:"by_status"`
+	Interchanges   int              `json:"interchanges"`
+	ControlNumbers []string         `json:"control_numbers"`                  // consecutive numbers as ranges, e.g. 000012340-000012345
+	Voided         []string         `json:"voided_control_numbers,omitempty"` // sent: taken but never delivered
+}
+
+func newReconciliationSide() reconciliationSide {
+	return reconciliationSide{ByStatus: map[string]int64{}, ControlNumbers: []string{}}
+}
+
+// Midnight to midnight of date in RECONCILIATION_TIMEZONE
+func reconciliationDay(date string) (from, to time.Time, err error) {
+	from, err = time.ParseInLocation("2006-01-02", date, reconciliationZone)
+	if err != nil {
+		return from, to, errors.New("date must be YYYY-MM-DD")
+	}
+	return from, from.AddDate(0, 0, 1), nil
+}
+
+// Summarize the documents exchanged on date with every partner, or only
+// with partnerID when set
+func buildReconciliation(ctx context.Context, date, partnerID string, now time.Time) (reconciliationReport, error) {
+	from, to, err := reconciliationDay(date)
+	if err != nil {
+		return reconciliationReport{}, err
+	}
+	report := reconciliationReport{Date: date, From: from.UTC(), To: to.UTC(), GeneratedAt: now.UTC(), Partners: []partnerReconciliation{}}
+	byPartner := map[string]*partnerReconciliation{}
+	partner := func(id string) *partnerReconciliation {
+		if byPartner[id] == nil {
+			byPartner[id] = &partnerReconciliation{PartnerID: id, Received: newReconciliationSide(), Sent: newReconciliationSide()}
+		}
+		return byPartner[id]
+	}
+	scoped := func(model interface{}) *gorm.DB {
+		q := db.WithContext(ctx).Model(model)
+		if partnerID != "" {
+			q = q.Where("partner_id = ?", partnerID)
+		}
+		return q
+	}
+
+	// Outbound transactions are the ones posted to a partner's outbox
+	var rows []struct {
+		PartnerID          string
+		Status             string
+		InterchangeControl string
+		Sent               bool
+		N                  int64
+	}
+	if err := scoped(&Transaction{}).
+		Select("partner_id, status, interchange_control, id IN (SELECT transaction_id FROM mailbox_messages WHERE box = ?) AS sent, count(*) AS n", mailboxOutbox).
+		Where("date >= ? AND date < ? AND status <> ?", from, to, statusValidated).
+		Group("partner_id, status, interchange_control, sent").Scan(&rows).Error; err != nil {
+		return report, err
+	}
+	received := map[string][]string{}
+	for _, row := range rows {
+		p := partner(row.PartnerID)
+		side := &p.Received
+		if row.Sent {
+			side = &p.Sent
+		}
+		side.Documents += row.N
+		side.ByStatus[row.Status] += row.N
+		switch {
+		case row.Status == statusRejected:
+			side.Rejected += row.N
+		case row.Sent && row.Status == statusAcknowledged, !row.Sent && row.Status != statusHeld:
+			side.Acknowledged += row.N
+		default:
+			side.Pending += row.N
+		}
+		if !row.Sent && row.InterchangeControl != "" {
+			received[row.PartnerID] = append(received[row.PartnerID], row.InterchangeControl)
+		}
+	}
+	for id, numbers := range received {
+		p := partner(id)
+		p.Received.ControlNumbers = compactControlNumbers(numbers)
+		p.Received.Interchanges = countDistinct(numbers)
+	}
+
+	var ledger []ControlNumber
+	if err := scoped(&ControlNumber{}).Where("created_at >= ? AND created_at < ?", from, to).Order("partner_id, number").Find(&ledger).Error; err != nil {
+		return report, err
+	}
+	sent, voided := map[string][]string{}, map[string][]string{}
+	for _, c := range ledger {
+		n := fmt.Sprintf("%09d", c.Number)
+		switch c.Status {
+		case controlUsed:
+			sent[c.PartnerID] = append(sent[c.PartnerID], n)
+		case controlVoided:
+			voided[c.PartnerID] = append(voided[c.PartnerID], n)
+		}
+	}
+	for id, numbers := range sent {
+		p := partner(id)
+		p.Sent.ControlNumbers = compactControlNumbers(numbers)
+		p.Sent.Interchanges = countDistinct(numbers)
+	}
+	for id, numbers := range voided {
+		partner(id).Sent.Voided = compactControlNumbers(numbers)
+	}
+
+	for _, p := range byPartner {
+		report.Partners = append(report.Partners, *p)
+	}
+	sort.Slice(report.Partners, func(i, j int) bool { return report.Partners[i].PartnerID < report.Partners[j].PartnerID })
+	return report, nil
+}
+
+func countDistinct(values []string) int {
+	seen := map[string]bool{}
+	for _, v := range values {
+		seen[v] = true
+	}
+	return len(seen)
+}
+
+// Sort and deduplicate control numbers, joining consecutive numeric ones of
+// the same width into ranges
+func compactControlNumbers(numbers []string) []string {
+	type number struct {
+		raw string
+		n   int64
+		ok  bool
+	}
+	seen := map[string]bool{}
+	var list []number
+	for _, raw := range numbers {
+		raw = strings.TrimSpace(raw)
+		if raw == "" || seen[raw] {
+			continue
+		}
+		seen[raw] = true
+		n, err := strconv.ParseInt(raw, 10, 64)
+		list = append(list, number{raw, n, err == nil})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ok != list[j].ok {
+			return list[i].ok
+		}
+		if list[i].ok && list[i].n != list[j].n {
+			return list[i].n < list[j].n
+		}
+		return list[i].raw < list[j].raw
+	})
+	out := []string{}
+	for i := 0; i < len(list); {
+		j := i
+		for j+1 < len(list) && list[i].ok && list[j+1].ok && list[j+1].n == list[j].n+1 && len(list[j+1].raw) == len(list[i].raw) {
+			j++
+		}
+		if j > i {
+			out = append(out, list[i].raw+"-"+list[j].raw)
+		} else {
+			out = append(out, list[i].raw)
+		}
+		i = j + 1
+	}
+	return out
+}
+
+// The report as stored
+func (s ReconciliationReport) report() (reconciliationReport, error) {
+	from, to, err := reconciliationDay(s.Date)
+	if err != nil {
+		return reconciliationReport{}, err
+	}
+	report := reconciliationReport{Date: s.Date, From: from.UTC(), To: to.UTC(), GeneratedAt: s.GeneratedAt.UTC(), Stored: true}
+	return report, json.Unmarshal([]byte(s.Partners), &report.Partners)
+}
+
+// The day before now's in RECONCILIATION_TIMEZONE
+func previousDay(now time.Time) string {
+	return now.In(reconciliationZone).AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// Periodically store and send yesterday's reconciliation of every tenant
+// once it is past RECONCILIATION_AT
+func runReconciliationReports(ctx context.Context, interval time.Duration) {
+	if reconciliationAt == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if now.In(reconciliationZone).Format("15:04") < reconciliationAt {
+			continue
+		}
+		for _, tenant := range tenants {
+			tctx := withAuditor(withTenant(ctx, tenant), systemAuditor("system", "reconciliation"))
+			if err := storeReconciliation(tctx, previousDay(now), now); err != nil {
+				log.Printf("ERROR: reconciliation of tenant %s: %v\n", tenant, err)
+			}
+		}
+	}
+}
+
+// Generate, store and send the tenant's report of date unless it exists;
+// replicas racing for it store it once
+func storeReconciliation(ctx context.Context, date string, now time.Time) error {
+	var n int64
+	if err := db.WithContext(ctx).Model(&ReconciliationReport{}).Where("date = ?", date).Count(&n).Error; err != nil || n > 0 {
+		return err
+	}
+	report, err := buildReconciliation(ctx, date, "", now)
+	if err != nil {
+		return err
+	}
+	partners, _ := json.Marshal(report.Partners)
+	stored := ReconciliationReport{Date: date, Partners: string(partners), GeneratedAt: now}
+	res := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&stored)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return res.Error
+	}
+	report.Stored = true
+	sendReconciliation(ctx, report)
+	if err := db.WithContext(ctx).Model(&stored).Update("notified_at", now).Error; err != nil {
+		log.Printf("ERROR: reconciliation %s: %v\n", date, err)
+	}
+	return nil
+}
+
+// Send a report to RECONCILIATION_WEBHOOK_URL and RECONCILIATION_EMAIL, and
+// each partner's part to its reconciliation_email
+func sendReconciliation(ctx context.Context, report reconciliationReport) {
+	tenant := tenantID(ctx)
+	if reconciliationWebhook != "" {
+		body, _ := json.Marshal(struct {
+			Event    string `json:"event"`
+			TenantID string `json:"tenant_id"`
+			reconciliationReport
+		}{"reconciliation_report", tenant, report})
+		go postNotification(reconciliationWebhook, body, "reconciliation "+report.Date+" webhook")
+	}
+	if smtpAddr == "" {
+		if reconciliationEmail != "" {
+			log.Printf("Reconciliation %s: SMTP_ADDR is not set, not emailing", report.Date)
+		}
+		return
+	}
+	if to := splitList(reconciliationEmail); len(to) > 0 {
+		go sendEmail(to, fmt.Sprintf("EDI reconciliation %s", report.Date), reconciliationText(report))
+	}
+	var partners []Partner
+	if err := db.WithContext(ctx).Where("reconciliation_email <> ''").Find(&partners).Error; err != nil {
+		log.Printf("ERROR: reconciliation %s: %v\n", report.Date, err)
+		return
+	}
+	for _, p := range partners {
+		if to := splitList(p.ReconciliationEmail); len(to) > 0 {
+			go sendEmail(to, fmt.Sprintf("EDI reconciliation %s: %s", report.Date, p.ID), reconciliationText(report.only(p.ID)))
+		}
+	}
+}
+
+// The report narrowed to one partner, which has an empty entry when nothing
+// was exchanged with it
+func (report reconciliationReport) only(partnerID string) reconciliationReport {
+	for _, p := range report.Partners {
+		if p.PartnerID == partnerID {
+			report.Partners = []partnerReconciliation{p}
+			return report
+		}
+	}
+	report.Partners = []partnerReconciliation{{PartnerID: partnerID, Received: newReconciliationSide(), Sent: newReconciliationSide()}}
+	return report
+}
+
+// Plain text form of a report for email
+func reconciliationText(report reconciliationReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Reconciliation of %s (%s to %s)\r\n", report.Date, report.From.Format(time.RFC3339), report.To.Format(time.RFC3339))
+	for _, p := range report.Partners {
+		fmt.Fprintf(&b, "\r\nPartner %s\r\n", p.PartnerID)
+		for _, side := range []struct {
+			name string
+			s    reconciliationSide
+		}{{"Received", p.Received}, {"Sent", p.Sent}} {
+			fmt.Fprintf(&b, "  %s: %d documents in %d interchanges, %d acknowledged, %d rejected, %d pending\r\n",
+				side.name, side.s.Documents, side.s.Interchanges, side.s.Acknowledged, side.s.Rejected, side.s.Pending)
+			if len(side.s.ControlNumbers) > 0 {
+				fmt.Fprintf(&b, "    control numbers: %s\r\n", strings.Join(side.s.ControlNumbers, ", "))
+			}
+			if len(side.s.Voided) > 0 {
+				fmt.Fprintf(&b, "    voided: %s\r\n", strings.Join(side.s.Voided, ", "))
+			}
+		}
+	}
+	return b.String()
+}
+
+func (p *Partner) validateReconciliation() error {
+	for _, addr := range splitList(p.ReconciliationEmail) {
+		if !strings.Contains(addr, "@") {
+			return errors.New("reconciliation_email must be email addresses")
+		}
+	}
+	return nil
+}
+
+// The reconciliation of date (YYYY-MM-DD, default yesterday): the stored
+// report when there is one, unless refresh=true, else generated now.
+// partner_id narrows it to one partner; partner API keys only see their own.
+func reconciliationHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now()
+	date := q.Get("date")
+	if date == "" {
+		date = previousDay(now)
+	}
+	if _, _, err := reconciliationDay(date); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	partnerID := q.Get("partner_id")
+	if own := auditorFrom(r.Context()).partner; own != "" {
+		if partnerID != "" && partnerID != own {
+			writeProblem(w, "Partner API keys only see their own reconciliation", http.StatusForbidden)
+			return
+		}
+		partnerID = own
+	}
+	var report reconciliationReport
+	var stored ReconciliationReport
+	res := db.WithContext(r.Context()).Where("date = ?", date).Limit(1).Find(&stored)
+	if res.Error != nil {
+		log.Printf("ERROR: %v\n", res.Error)
+		writeProblem(w, "Failed to fetch reconciliation", http.StatusInternalServerError)
+		return
+	}
+	var err error
+	if res.RowsAffected > 0 && q.Get("refresh") != "true" {
+		report, err = stored.report()
+	} else {
+		report, err = buildReconciliation(r.Context(), date, partnerID, now)
+	}
+	if err == nil && partnerID != "" {
+		report = report.only(partnerID)
+	}
+	if err != nil {
+		log.Printf("ERROR: reconciliation %s: %v\n", date, err)
+		writeProblem(w, "Failed to build reconciliation", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
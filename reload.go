@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Partner profiles, maps, layouts and schedules are read from the database
+// for each document, so a change applies to the next one. Routing rules are
+// cached by each replica, which reloads them when it sees a newer
+// configuration version, checking every CONFIG_RELOAD_INTERVAL.
+var configReloadInterval = getEnvDuration("CONFIG_RELOAD_INTERVAL", 30*time.Second)
+
+var configVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "edi_config_version",
+	Help: "Newest configuration version this replica has loaded.",
+})
+
+// Newest configuration version loaded into the routing rules
+var loadedConfigVersion atomic.Uint64
+
+// One change to the configuration documents are processed with. Its ID is
+// the configuration version: transactions record the version current when
+// they were processed, and the audit log has what the change was.
+type ConfigChange struct {
+	ID           uint      `json:"version" gorm:"primaryKey"`
+	TenantID     string    `json:"tenant_id" gorm:"index"`
+	ResourceType string    `json:"resource_type"` // as in the audit log, or reload
+	ResourceID   string    `json:"resource_id,omitempty"`
+	Actor        string    `json:"actor"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Topic for received transactions of a partner and type, either of which
+// may be *. Enabled rules take precedence over KAFKA_TOPIC_ROUTES for the
+// same partner and type, and a change applies without a restart.
+type RoutingRule struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	PartnerID string    `json:"partner_id"`
+	Type      string    `json:"type"`
+	Topic     string    `json:"topic"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (rule *RoutingRule) validate() error {
+	rule.PartnerID, rule.Type, rule.Topic = strings.TrimSpace(rule.PartnerID), strings.TrimSpace(rule.Type), strings.TrimSpace(rule.Topic)
+	if rule.PartnerID == "" || rule.Type == "" {
+		return errors.New("partner_id and type are required; use * to match any")
+	}
+	if rule.Topic == "" || strings.ContainsAny(rule.Topic, " ,/=") {
+		return errors.New("topic is required and may not contain spaces, commas, slashes or =")
+	}
+	return nil
+}
+
+// Outcome of POST /admin/reload
+type configReload struct {
+	Version      uint `json:"version"`
+	RoutingRules int  `json:"routing_rules"` // enabled rules of the tenant loaded
+}
+
+// Record a configuration change by the actor of ctx. Like the audit log
+// this is bookkeeping: the change is saved, so a failure is only logged.
+func recordConfigChange(ctx context.Context, resourceType, resourceID string) uint {
+	c := ConfigChange{ResourceType: resourceType, ResourceID: resourceID, Actor: auditorFrom(ctx).actor}
+	if err := db.WithContext(ctx).Create(&c).Error; err != nil {
+		log.Printf("ERROR: config change: %v\n", err)
+	}
+	return c.ID
+}
+
+// Newest configuration version of ctx's tenant, or of every tenant
+func currentConfigVersion(ctx context.Context) (uint, error) {
+	var version uint
+	err := db.WithContext(ctx).Model(&ConfigChange{}).Select("COALESCE(MAX(id), 0)").Scan(&version).Error
+	return version, err
+}
+
+// Configuration version to stamp on a transaction being processed
+func processingConfigVersion(ctx context.Context) uint {
+	version, err := currentConfigVersion(ctx)
+	if err != nil {
+		log.Printf("ERROR: config version: %v\n", err)
+	}
+	return version
+}
+
+// Serializes reloads, so the router never goes back to older rules
+var reloadMu sync.Mutex
+
+// Load the enabled routing rules of every tenant into the topic router,
+// returning them
+func reloadConfig(ctx context.Context) ([]RoutingRule, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	ctx = withTenant(ctx, allTenants)
+	version, err := currentConfigVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rules []RoutingRule
+	if err := db.WithContext(ctx).Where("disabled = ?", false).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	if kafkaRouter != nil {
+		kafkaRouter.setRules(rules)
+	}
+	loadedConfigVersion.Store(uint64(version))
+	configVersion.Set(float64(version))
+	return rules, nil
+}
+
+// Reload the configuration whenever another replica, or a change made
+// directly in the database and announced with POST /admin/reload, has
+// moved the version past the one loaded
+func runConfigWatch(ctx context.Context, interval time.Duration) {
+	if _, err := reloadConfig(ctx); err != nil {
+		log.Printf("ERROR: config reload: %v\n", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		version, err := currentConfigVersion(withTenant(ctx, allTenants))
+		if err != nil {
+			log.Printf("ERROR: config version: %v\n", err)
+			continue
+		}
+		if uint64(version) <= loadedConfigVersion.Load() {
+			continue
+		}
+		rules, err := reloadConfig(ctx)
+		if err != nil {
+			log.Printf("ERROR: config reload: %v\n", err)
+			continue
+		}
+		log.Printf("Configuration reloaded at version %d, %d routing rules", loadedConfigVersion.Load(), len(rules))
+	}
+}
+
+// Replace the rules of a topic router, registering the event schema of
+// topics it has not published to before
+func (r *topicRouter) setRules(rules []RoutingRule) {
+	byTenant := map[string]map[string]string{}
+	for _, rule := range rules {
+		if byTenant[rule.TenantID] == nil {
+			byTenant[rule.TenantID] = map[string]string{}
+		}
+		byTenant[rule.TenantID][rule.PartnerID+"/"+rule.Type] = rule.Topic
+	}
+	r.rulesMu.Lock()
+	r.rules = byTenant
+	if r.registered == nil {
+		r.registered = map[string]bool{}
+	}
+	var unregistered []string
+	for _, rule := range rules {
+		topic := rule.Topic
+		if kafkaTenantTopics {
+			topic = rule.TenantID + "." + topic
+		}
+		for _, topic := range laneTopics(topic) {
+			if !r.registered[topic] {
+				r.registered[topic] = true
+				unregistered = append(unregistered, topic)
+			}
+		}
+	}
+	r.rulesMu.Unlock()
+	if eventsBackend != "kafka" {
+		return
+	}
+	for _, topic := range unregistered {
+		if err := registerEventSchema(topic); err != nil {
+			log.Printf("ERROR: schema registry, topic %s: %v\n", topic, err)
+		}
+	}
+}
+
+// Topic of a tenant's routing rule for key (partner/type), if any
+func (r *topicRouter) rule(tenant, key string) (string, bool) {
+	r.rulesMu.RLock()
+	defer r.rulesMu.RUnlock()
+	topic, ok := r.rules[tenant][key]
+	return topic, ok
+}
+
+// Look up the routing rule of a request, writing the problem when it fails
+func requestRoutingRule(w http.ResponseWriter, r *http.Request) *RoutingRule {
+	var rule RoutingRule
+	err := db.WithContext(r.Context()).First(&rule, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Routing rule not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch routing rule", http.StatusInternalServerError)
+		return nil
+	}
+	return &rule
+}
+
+// Validate, save and load a routing rule, writing the problem when it fails
+func saveRoutingRule(w http.ResponseWriter, r *http.Request, rule *RoutingRule, existing *RoutingRule) bool {
+	if err := rule.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if !rule.Disabled {
+		var n int64
+		err := db.WithContext(r.Context()).Model(&RoutingRule{}).
+			Where("partner_id = ? AND type = ? AND disabled = ? AND id <> ?", rule.PartnerID, rule.Type, false, rule.ID).Count(&n).Error
+		if err != nil {
+			log.Printf("ERROR: %v\n", err)
+			writeProblem(w, "Failed to fetch routing rules", http.StatusInternalServerError)
+			return false
+		} else if n > 0 {
+			writeProblem(w, "Another routing rule covers this partner and type", http.StatusConflict)
+			return false
+		}
+	}
+	q := db.WithContext(r.Context())
+	var err error
+	if existing == nil {
+		err = q.Create(rule).Error
+	} else {
+		err = q.Omit("CreatedAt").Save(rule).Error
+	}
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save routing rule", http.StatusInternalServerError)
+		return false
+	}
+	var before interface{}
+	if existing != nil {
+		before = existing
+	}
+	id := strconv.FormatUint(uint64(rule.ID), 10)
+	auditChange(r.Context(), auditAction(existing != nil), "routing_rule", id, before, rule)
+	recordConfigChange(r.Context(), "routing_rule", id)
+	if _, err := reloadConfig(r.Context()); err != nil {
+		log.Printf("ERROR: config reload: %v\n", err)
+	}
+	return true
+}
+
+// List routing rules
+func listRoutingRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules := []RoutingRule{}
+	if err := db.WithContext(r.Context()).Order("id").Find(&rules).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch routing rules", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// Add a routing rule
+func createRoutingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule RoutingRule
+	if err := decodeJSON(w, r, &rule); err != nil {
+		writeError(w, err)
+		return
+	}
+	rule.ID = 0
+	if !saveRoutingRule(w, r, &rule, nil) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// Replace a routing rule
+func updateRoutingRuleHandler(w http.ResponseWriter, r *http.Request) {
+	existing := requestRoutingRule(w, r)
+	if existing == nil {
+		return
+	}
+	var rule RoutingRule
+	if err := decodeJSON(w, r, &rule); err != nil {
+		writeError(w, err)
+		return
+	}
+	rule.ID, rule.TenantID, rule.CreatedAt = existing.ID, existing.TenantID, existing.CreatedAt
+	if !saveRoutingRule(w, r, &rule, existing) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// List configuration versions, newest first; limit defaults to 50
+func listConfigVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeProblem(w, "limit must be 1 to 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	changes := []ConfigChange{}
+	if err := db.WithContext(r.Context()).Order("id DESC").Limit(limit).Find(&changes).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch configuration versions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// Record a new configuration version, so every replica reloads, and reload
+// this one now; for changes made directly in the database
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	reload := configReload{Version: recordConfigChange(r.Context(), "reload", "")}
+	if reload.Version == 0 {
+		writeProblem(w, "Failed to record configuration version", http.StatusInternalServerError)
+		return
+	}
+	rules, err := reloadConfig(r.Context())
+	if err != nil {
+		log.Printf("ERROR: config reload: %v\n", err)
+		writeProblem(w, "Failed to reload configuration", http.StatusInternalServerError)
+		return
+	}
+	for _, rule := range rules {
+		if rule.TenantID == tenantID(r.Context()) {
+			reload.RoutingRules++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reload)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Replay targets
+const (
+	replayKafka    = "kafka"    // re-emit the Kafka event
+	replayDelivery = "delivery" // re-run outbound delivery to the partner
+)
+
+// Audit entry recording who replayed which transaction, where and when
+type Replay struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TenantID      string    `json:"tenant_id" gorm:"index"`
+	TransactionID string    `json:"transaction_id" gorm:"index"`
+	Target        string    `json:"target"`
+	Actor         string    `json:"actor"`
+	ClientIP      string    `json:"client_ip"`
+	Reason        string    `json:"reason,omitempty"`
+	Status        string    `json:"status"` // replayed or failed
+	Error         string    `json:"error,omitempty"`
+	DeliveryID    string    `json:"delivery_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Body of a replay request. Filters only apply to bulk replays.
+type replayRequest struct {
+	Targets   []string   `json:"targets"` // kafka and/or delivery; default kafka
+	Reason    string     `json:"reason"`
+	PartnerID string     `json:"partner_id"`
+	Status    string     `json:"status"`
+	From      *time.Time `json:"from"`
+	To        *time.Time `json:"to"`
+	Limit     int        `json:"limit"`
+}
+
+const maxReplayBatch = 10000
+
+func decodeReplayRequest(w http.ResponseWriter, r *http.Request) (replayRequest, error) {
+	var req replayRequest
+	if err := decodeJSON(w, r, &req); err != nil && err != errEmptyBody {
+		return req, err
+	}
+	if err := req.checkTargets(); err != nil {
+		return req, &httpError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	return req, nil
+}
+
+// Default to a Kafka replay and reject unknown targets
+func (req *replayRequest) checkTargets() error {
+	if len(req.Targets) == 0 {
+		req.Targets = []string{replayKafka}
+	}
+	for _, target := range req.Targets {
+		if target != replayKafka && target != replayDelivery {
+			return fmt.Errorf("Unknown replay target %q", target)
+		}
+	}
+	return nil
+}
+
+// Replay one transaction
+func replayTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeReplayRequest(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var t Transaction
+	err = db.WithContext(r.Context()).First(&t, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch transaction", http.StatusInternalServerError)
+		return
+	}
+	txs := []Transaction{t}
+	if err := readItems(r.Context(), txs); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch line items", http.StatusInternalServerError)
+		return
+	}
+	actor, _, _ := requestActor(r)
+	writeReplays(w, replayTransactions(r.Context(), txs, req, actor, clientIP(r)))
+}
+
+// Replay every transaction matching the partner, status and date filters
+func bulkReplayHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeReplayRequest(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	transactions, err := findReplayTransactions(r.Context(), req)
+	if errors.Is(err, errNoReplayFilter) {
+		writeProblem(w, "At least one of partner_id, status, from or to is required", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+	actor, _, _ := requestActor(r)
+	writeReplays(w, replayTransactions(r.Context(), transactions, req, actor, clientIP(r)))
+}
+
+var errNoReplayFilter = errors.New("at least one of partner_id, status, from or to is required")
+
+// Transactions matching a bulk replay's filters, ordered by partner
+func findReplayTransactions(ctx context.Context, req replayRequest) ([]Transaction, error) {
+	if req.PartnerID == "" && req.Status == "" && req.From == nil && req.To == nil {
+		return nil, errNoReplayFilter
+	}
+	if req.Limit <= 0 || req.Limit > maxReplayBatch {
+		req.Limit = maxReplayBatch
+	}
+	query := db.WithContext(ctx).Order("partner_id, date").Limit(req.Limit)
+	if req.PartnerID != "" {
+		query = query.Where("partner_id = ?", req.PartnerID)
+	}
+	if req.Status != "" {
+		query = query.Where("status = ?", req.Status)
+	}
+	if req.From != nil {
+		query = query.Where("date >= ?", *req.From)
+	}
+	if req.To != nil {
+		query = query.Where("date < ?", *req.To)
+	}
+	var transactions []Transaction
+	if err := query.Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+	return transactions, readItems(ctx, transactions)
+}
+
+// List the replay audit trail of a transaction
+func listReplaysHandler(w http.ResponseWriter, r *http.Request) {
+	var replays []Replay
+	if err := db.WithContext(r.Context()).Where("transaction_id = ?", mux.Vars(r)["id"]).Order("id").Find(&replays).Error; err != nil {
+		writeProblem(w, "Failed to fetch replays", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replays)
+}
+
+// Run the requested targets for each transaction (ordered by partner) and
+// record an audit entry per transaction and target
+func replayTransactions(ctx context.Context, txs []Transaction, req replayRequest, actor, ip string) []Replay {
+	var replays []Replay
+	entry := func(t Transaction, target string, err error) Replay {
+		rep := Replay{TransactionID: t.ID, Target: target, Actor: actor, ClientIP: ip, Reason: req.Reason, Status: "replayed"}
+		if err != nil {
+			rep.Status, rep.Error = "failed", err.Error()
+		}
+		return rep
+	}
+	for _, target := range req.Targets {
+		switch target {
+		case replayKafka:
+			for _, t := range txs {
+				replays = append(replays, entry(t, target, republish(ctx, t)))
+			}
+		case replayDelivery:
+			for rest := txs; len(rest) > 0; {
+				n := 1
+				for n < len(rest) && rest[n].PartnerID == rest[0].PartnerID {
+					n++
+				}
+				group := rest[:n]
+				rest = rest[n:]
+				partner, err := loadPartner(ctx, group[0].PartnerID)
+				var d Delivery
+				if err == nil {
+					d, err = deliverOutbound(ctx, partner, group)
+				}
+				for _, t := range group {
+					rep := entry(t, target, err)
+					rep.DeliveryID = d.ID
+					replays = append(replays, rep)
+				}
+			}
+		}
+	}
+	if len(replays) > 0 {
+		if err := db.WithContext(ctx).Create(&replays).Error; err != nil {
+			log.Printf("ERROR: replay audit: %v\n", err)
+		}
+	}
+	for _, rep := range replays {
+		auditChange(ctx, auditReplay, "transaction", rep.TransactionID, nil, rep)
+	}
+	return replays
+}
+
+// Re-emit a transaction's event. Edge nodes only forward to central, which
+// ignores transactions it already has, so replays must run there.
+func republish(ctx context.Context, t Transaction) error {
+	if edgeMode {
+		return errors.New("edge nodes do not publish; replay on the central gateway")
+	}
+	return publishTransaction(ctx, eventTransactionReplayed, t)
+}
+
+// Respond 200 when every replay succeeded and 207 Multi-Status otherwise
+func writeReplays(w http.ResponseWriter, replays []Replay) {
+	status := http.StatusOK
+	for _, rep := range replays {
+		if rep.Status != "replayed" {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(replays)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Rows a report returns at most, and how long its query may run
+var (
+	reportMaxRows = getEnvInt("REPORT_MAX_ROWS", 10000)
+	reportTimeout = getEnvDuration("REPORT_TIMEOUT", 30*time.Second)
+)
+
+// The named queries analysts may run, from REPORT_QUERIES_FILE
+var reportQueries, reportQueriesErr = loadReportQueries(getEnv("REPORT_QUERIES_FILE", ""))
+
+// A named, parameterized read-only SQL query. SQL binds its parameters as
+// @name and must filter on @tenant, which is always the caller's tenant:
+// raw SQL is not scoped to a tenant the way model queries are.
+type reportQuery struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	SQL         string                 `json:"-"`
+	Params      map[string]reportParam `json:"params,omitempty"`
+	MaxRows     int                    `json:"max_rows,omitempty"` // at most REPORT_MAX_ROWS
+}
+
+// A parameter of a report query
+type reportParam struct {
+	Type        string `json:"type"` // string, int, number, bool or time (RFC 3339)
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// The file's form of a query, with its SQL
+type reportQueryFile struct {
+	Description string                 `json:"description"`
+	SQL         string                 `json:"sql"`
+	Params      map[string]reportParam `json:"params"`
+	MaxRows     int                    `json:"max_rows"`
+}
+
+var (
+	reportNamePattern  = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	reportParamPattern = regexp.MustCompile(`@([A-Za-z_][A-Za-z0-9_]*)`)
+	reportWritePattern = regexp.MustCompile(`(?i)\b(insert|update|delete|merge|drop|alter|create|truncate|grant|revoke|copy|call|do|vacuum|set|lock)\b`)
+)
+
+// Load the named queries of a JSON file mapping each name to its sql,
+// description, params and max_rows. Queries must be a single SELECT (or
+// WITH) statement that filters on @tenant and binds only declared params.
+func loadReportQueries(path string) (map[string]reportQuery, error) {
+	queries := map[string]reportQuery{}
+	if path == "" {
+		return queries, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("REPORT_QUERIES_FILE: %w", err)
+	}
+	var file map[string]reportQueryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("REPORT_QUERIES_FILE: %w", err)
+	}
+	for name, f := range file {
+		q := reportQuery{Name: name, Description: f.Description, SQL: strings.TrimSpace(f.SQL), Params: f.Params, MaxRows: f.MaxRows}
+		if err := q.validate(); err != nil {
+			return nil, fmt.Errorf("REPORT_QUERIES_FILE: query %s: %w", name, err)
+		}
+		queries[name] = q
+	}
+	return queries, nil
+}
+
+func (q *reportQuery) validate() error {
+	if !reportNamePattern.MatchString(q.Name) {
+		return errors.New("name must be lower case letters, digits and _")
+	}
+	stmt := strings.TrimSuffix(q.SQL, ";")
+	lower := strings.ToLower(stmt)
+	if !strings.HasPrefix(lower, "select") && !strings.HasPrefix(lower, "with") {
+		return errors.New("sql must be a SELECT statement")
+	}
+	if strings.Contains(stmt, ";") || strings.Contains(stmt, "--") || strings.Contains(stmt, "/*") {
+		return errors.New("sql must be a single statement without comments")
+	}
+	if w := reportWritePattern.FindString(stmt); w != "" {
+		return fmt.Errorf("sql must only read, not %s", strings.ToUpper(w))
+	}
+	q.SQL = stmt
+	used := map[string]bool{}
+	for _, m := range reportParamPattern.FindAllStringSubmatch(stmt, -1) {
+		used[m[1]] = true
+	}
+	if !used["tenant"] {
+		return errors.New("sql must filter on @tenant")
+	}
+	for _, reserved := range []string{"tenant", "format"} {
+		if _, ok := q.Params[reserved]; ok {
+			return fmt.Errorf("%s cannot be a param", reserved)
+		}
+	}
+	for name := range used {
+		if _, ok := q.Params[name]; !ok && name != "tenant" {
+			return fmt.Errorf("sql uses @%s, which is not in params", name)
+		}
+	}
+	for name, p := range q.Params {
+		if !used[name] {
+			return fmt.Errorf("param %s is not used by the sql", name)
+		}
+		switch p.Type {
+		case "", "string", "int", "number", "bool", "time":
+		default:
+			return fmt.Errorf("param %s: type must be string, int, number, bool or time", name)
+		}
+		if p.Default != "" {
+			if _, err := p.parse(p.Default); err != nil {
+				return fmt.Errorf("param %s: default must be %s", name, p.typeName())
+			}
+		}
+	}
+	if q.MaxRows < 0 {
+		return errors.New("max_rows must not be negative")
+	}
+	return nil
+}
+
+// Value of the parameter given as v
+func (p reportParam) parse(v string) (interface{}, error) {
+	switch p.Type {
+	case "", "string":
+		return v, nil
+	case "int":
+		return strconv.ParseInt(v, 10, 64)
+	case "number":
+		return strconv.ParseFloat(v, 64)
+	case "bool":
+		return strconv.ParseBool(v)
+	case "time":
+		return time.Parse(time.RFC3339Nano, v)
+	}
+	return nil, fmt.Errorf("unknown type %s", p.Type)
+}
+
+// Bind a report's parameters from a request's query string
+func (q reportQuery) bind(ctx context.Context, values map[string][]string) (map[string]interface{}, error) {
+	args := map[string]interface{}{"tenant": tenantID(ctx)}
+	for name := range values {
+		if _, ok := q.Params[name]; !ok && name != "format" {
+			return nil, fmt.Errorf("report %s has no param %s", q.Name, name)
+		}
+	}
+	for name, p := range q.Params {
+		v := p.Default
+		if given, ok := values[name]; ok && len(given) > 0 {
+			v = given[0]
+		} else if p.Required {
+			return nil, fmt.Errorf("param %s is required", name)
+		}
+		if v == "" && p.Type != "" && p.Type != "string" {
+			// An optional typed param without a value is NULL, e.g. for
+			// (@since IS NULL OR sent_at >= @since)
+			args[name] = nil
+			continue
+		}
+		arg, err := p.parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("param %s must be %s", name, p.typeName())
+		}
+		args[name] = arg
+	}
+	return args, nil
+}
+
+func (p reportParam) typeName() string {
+	switch p.Type {
+	case "int":
+		return "an integer"
+	case "number":
+		return "a number"
+	case "bool":
+		return "true or false"
+	case "time":
+		return "an RFC 3339 time"
+	}
+	return "a string"
+}
+
+// Rows of a report run
+type reportResult struct {
+	Query     string                   `json:"query"`
+	Columns   []string                 `json:"columns"`
+	Rows      []map[string]interface{} `json:"rows"`
+	Truncated bool                     `json:"truncated"` // more rows matched than max_rows
+}
+
+// Run a report in a read-only transaction (on PostgreSQL) bounded by
+// REPORT_TIMEOUT
+func runReport(ctx context.Context, q reportQuery, args map[string]interface{}) (reportResult, error) {
+	res := reportResult{Query: q.Name, Rows: []map[string]interface{}{}}
+	limit := reportMaxRows
+	if q.MaxRows > 0 && q.MaxRows < limit {
+		limit = q.MaxRows
+	}
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if db.Dialector.Name() == "postgres" {
+			if err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", reportTimeout.Milliseconds())).Error; err != nil {
+				return err
+			}
+		}
+		rows, err := tx.Raw(q.SQL, args).Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if res.Columns, err = rows.Columns(); err != nil {
+			return err
+		}
+		for rows.Next() {
+			if len(res.Rows) == limit {
+				res.Truncated = true
+				break
+			}
+			values := make([]interface{}, len(res.Columns))
+			ptrs := make([]interface{}, len(values))
+			for i := range values {
+				ptrs[i] = &values[i]
+			}
+			if err := rows.Scan(ptrs...); err != nil {
+				return err
+			}
+			row := make(map[string]interface{}, len(values))
+			for i, v := range values {
+				switch t := v.(type) {
+				case []byte:
+					v = string(t)
+				case time.Time:
+					v = t.UTC().Format(time.RFC3339Nano)
+				}
+				row[res.Columns[i]] = v
+			}
+			res.Rows = append(res.Rows, row)
+		}
+		return rows.Err()
+	}, &sql.TxOptions{ReadOnly: db.Dialector.Name() == "postgres"})
+	return res, err
+}
+
+// List the reports that can be run, with their parameters
+func listReportQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	reports := make([]reportQuery, 0, len(reportQueries))
+	for _, q := range reportQueries {
+		reports = append(reports, q)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// Run a named report for the caller's tenant with the parameters in the
+// query string, as JSON or, with format=csv or Accept: text/csv, as CSV
+func runReportQueryHandler(w http.ResponseWriter, r *http.Request) {
+	q, ok := reportQueries[mux.Vars(r)["name"]]
+	if !ok {
+		writeProblem(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	args, err := q.bind(r.Context(), r.URL.Query())
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := runReport(r.Context(), q, args)
+	if isTimeout(err) {
+		writeProblem(w, fmt.Sprintf("Report %s did not finish within %s", q.Name, reportTimeout), http.StatusGatewayTimeout)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: report %s: %v\n", q.Name, err)
+		writeProblem(w, "Failed to run report", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Report %s run by %s for tenant %s: %d rows", q.Name, auditorFrom(r.Context()).actor, tenantID(r.Context()), len(res.Rows))
+	w.Header().Set("X-Report-Truncated", strconv.FormatBool(res.Truncated))
+	if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", q.Name+".csv"))
+		cw := csv.NewWriter(w)
+		cw.Write(res.Columns)
+		for _, row := range res.Rows {
+			record := make([]string, len(res.Columns))
+			for i, c := range res.Columns {
+				if v := row[c]; v != nil {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReportBindOptionalParams(t *testing.T) {
+	q := reportQuery{Name: "acks", Params: map[string]reportParam{
+		"since":   {Type: "time"},
+		"limit":   {Type: "int", Default: "10"},
+		"partner": {},
+		"late":    {Type: "bool"},
+	}}
+	ctx := withTenant(context.Background(), defaultTenant)
+	tests := []struct {
+		name   string
+		values map[string][]string
+		want   map[string]interface{}
+	}{
+		{"omitted", nil, map[string]interface{}{"tenant": defaultTenant, "since": nil, "limit": int64(10), "partner": "", "late": nil}},
+		{"given empty", map[string][]string{"since": {""}, "late": {""}}, map[string]interface{}{"tenant": defaultTenant, "since": nil, "limit": int64(10), "partner": "", "late": nil}},
+		{"given", map[string][]string{"since": {"2024-05-02T09:00:00Z"}, "limit": {"5"}, "partner": {"acme"}, "late": {"true"}},
+			map[string]interface{}{"tenant": defaultTenant, "since": time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC), "limit": int64(5), "partner": "acme", "late": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := q.bind(ctx, tt.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("bound %#v, want %#v", args, tt.want)
+			}
+		})
+	}
+	if _, err := q.bind(ctx, map[string][]string{"limit": {"ten"}}); err == nil {
+		t.Error("badly typed param bound")
+	}
+}
+
+// An omitted optional param reaches the database as NULL
+func TestReportOptionalParamIsNull(t *testing.T) {
+	startBulkGateway(t)
+	ctx := withTenant(context.Background(), defaultTenant)
+	for i, err := range processTransactions(ctx, bulkTransactions("report", 2)) {
+		if err != nil {
+			t.Fatalf("save %d: %v", i, err)
+		}
+	}
+	q := reportQuery{Name: "count", Params: map[string]reportParam{"since": {Type: "time"}}}
+	args, err := q.bind(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := db.Raw("SELECT count(*) FROM transactions WHERE tenant_id = @tenant AND (@since IS NULL OR date >= @since)", args).Scan(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d transactions without since, want 2", n)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Largest JSON body accepted by the management API
+var apiMaxBodySize = int64(getEnvInt("API_MAX_BODY_SIZE", 1<<20))
+
+// Reject inbound JSON transactions with fields the canonical model does not
+// have instead of dropping them
+var inboundStrictJSON = getEnvBool("INBOUND_STRICT_JSON", true)
+
+// Reported for an empty body; handlers whose body is optional allow it
+var errEmptyBody = &httpError{Status: http.StatusBadRequest, Message: "Invalid JSON: empty request body"}
+
+func tooLargeError(limit int64) *httpError {
+	return &httpError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Payload is over the limit of %d bytes", limit)}
+}
+
+// Whether a Content-Type is JSON (application/json or a +json type)
+func jsonMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// Decode a management API request body into v: one JSON object of at most
+// API_MAX_BODY_SIZE bytes without unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return decodeJSONBody(w, r, v, apiMaxBodySize, true)
+}
+
+// Decode a JSON request body of at most limit bytes into v. A declared
+// Content-Type must be JSON (415); a body over the limit is 413 and
+// malformed JSON, with unknown fields when strict, is 400.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, limit int64, strict bool) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !jsonMediaType(ct) {
+		return &httpError{Status: http.StatusUnsupportedMediaType, Message: "Content-Type must be application/json"}
+	}
+	if r.ContentLength > limit {
+		return tooLargeError(limit)
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return jsonError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return tooLargeError(tooLarge.Limit)
+		}
+		return &httpError{Status: http.StatusBadRequest, Message: "Invalid JSON: unexpected data after the object"}
+	}
+	return nil
+}
+
+// Decode inbound JSON: one transaction or a list of them. Unknown fields are
+// rejected unless INBOUND_STRICT_JSON is off.
+func decodeInboundJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if inboundStrictJSON {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return jsonError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &httpError{Status: http.StatusBadRequest, Message: "Invalid JSON: unexpected data after the document"}
+	}
+	return nil
+}
+
+// Clear what only the gateway records on a transaction decoded from a
+// client's JSON: the signature check is signatureMiddleware's to set, the
+// rule, topic and priority come from document rules and partner settings,
+// and the hold, origin and submission from how it was received
+func clearServerFields(t *Transaction) {
+	t.SignatureStatus, t.Signature, t.SignatureNonce, t.SignedAt, t.BodySHA256 = "", "", "", nil, ""
+	t.RuleID, t.Topic, t.Priority = 0, "", ""
+	t.HoldReason, t.Origin, t.SubmissionID = "", "", ""
+}
+
+// Say what is wrong with a JSON body without echoing it
+func jsonError(err error) *httpError {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == io.EOF:
+		return errEmptyBody
+	case errors.As(err, &tooLarge):
+		return tooLargeError(tooLarge.Limit)
+	case errors.As(err, &syntax):
+		return &httpError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid JSON at byte %d", syntax.Offset)}
+	case errors.As(err, &typ) && typ.Field != "":
+		return &httpError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid JSON: %s must be %s", typ.Field, typ.Type),
+			Fields: []fieldError{{Field: typ.Field, Message: "must be " + typ.Type.String()}}}
+	case errors.As(err, &typ):
+		return &httpError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid JSON: expected %s", typ.Type)}
+	case err == io.ErrUnexpectedEOF:
+		return &httpError{Status: http.StatusBadRequest, Message: "Invalid JSON: unexpected end of body"}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return &httpError{Status: http.StatusBadRequest, Message: "Invalid JSON: " + strings.TrimPrefix(err.Error(), "json: "),
+			Fields: []fieldError{{Field: field, Message: "is not a known field"}}}
+	}
+	return &httpError{Status: http.StatusBadRequest, Message: "Invalid JSON"}
+}
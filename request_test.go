@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fields only the gateway sets are ignored in inbound JSON
+func TestInboundJSONIgnoresServerFields(t *testing.T) {
+	setForTest(t, &databaseDriver, "sqlite")
+	setForTest(t, &eventsBackend, "memory")
+	t.Setenv("DATABASE_DSN", filepath.Join(t.TempDir(), "edi.db"))
+	srv := startGateway(t)
+	if status := doJSON(t, "POST", srv.URL+"/partners", map[string]string{"id": "acme", "name": "Acme"}, nil); status != http.StatusCreated {
+		t.Fatalf("create partner: %d", status)
+	}
+	body := `{"partner_id":"acme","type":"856","ship_to":"Store 12","carrier":"UPSN","bol":"BOL-1","items":"[]",` +
+		`"signature_status":"verified","signature":"abcd","signature_nonce":"n-1","signed_at":"2024-05-02T09:00:00Z","body_sha256":"0123",` +
+		`"priority":"high","topic":"edi.elsewhere","rule_id":7,"hold_reason":"none","origin":"edge-1","submission_id":"sub-1"}`
+	if status := doRequest(t, "POST", srv.URL+"/inbound", "application/json", strings.NewReader(body), nil); status != http.StatusOK {
+		t.Fatalf("inbound: %d", status)
+	}
+	var saved Transaction
+	if err := db.WithContext(withTenant(context.Background(), defaultTenant)).First(&saved, "partner_id = ?", "acme").Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.SignatureStatus != "" || saved.Signature != "" || saved.SignatureNonce != "" || saved.SignedAt != nil || saved.BodySHA256 != "" {
+		t.Errorf("signature fields were kept: %+v", saved)
+	}
+	if saved.Priority != "" || saved.Topic != "" || saved.RuleID != 0 || saved.HoldReason != "" || saved.Origin != "" || saved.SubmissionID != "" {
+		t.Errorf("rule, priority or origin fields were kept: %+v", saved)
+	}
+}
+
+func TestPartnerX12VersionValidated(t *testing.T) {
+	setForTest(t, &databaseDriver, "sqlite")
+	setForTest(t, &eventsBackend, "memory")
+	t.Setenv("DATABASE_DSN", filepath.Join(t.TempDir(), "edi.db"))
+	srv := startGateway(t)
+	if status := doJSON(t, "POST", srv.URL+"/partners", map[string]string{"id": "acme", "name": "Acme", "x12_version": "4010"}, nil); status != http.StatusBadRequest {
+		t.Errorf("create with x12_version 4010: %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := doJSON(t, "POST", srv.URL+"/partners", map[string]string{"id": "acme", "name": "Acme", "x12_version": "005010"}, nil); status != http.StatusCreated {
+		t.Fatalf("create with x12_version 005010: %d", status)
+	}
+	if status := doJSON(t, "PUT", srv.URL+"/partners/acme", map[string]string{"name": "Acme", "x12_version": "5010"}, nil); status != http.StatusBadRequest {
+		t.Errorf("update with x12_version 5010: %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Connection pool, retry and circuit breaker settings for the central database
+var (
+	dbMaxOpenConns     = getEnvInt("DB_MAX_OPEN_CONNS", 25)
+	dbMaxIdleConns     = getEnvInt("DB_MAX_IDLE_CONNS", 10)
+	dbConnMaxLifetime  = getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute)
+	dbConnMaxIdleTime  = getEnvDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute)
+	dbRetryAttempts    = atLeastOne(getEnvInt("DB_RETRY_ATTEMPTS", 3))
+	dbRetryBackoff     = getEnvDuration("DB_RETRY_BACKOFF", 100*time.Millisecond)
+	dbBreakerThreshold = atLeastOne(getEnvInt("DB_BREAKER_THRESHOLD", 5))
+	dbBreakerCooldown  = getEnvDuration("DB_BREAKER_COOLDOWN", 10*time.Second)
+)
+
+// Returned without touching the database while the circuit breaker is open
+var errDBUnavailable = errors.New("database unavailable")
+
+var dbCircuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "db_circuit_open",
+	Help: "1 while the database circuit breaker is open.",
+})
+
+// Apply the pool settings to the underlying sql.DB
+func configurePool(gdb *gorm.DB) error {
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(dbMaxOpenConns)
+	sqlDB.SetMaxIdleConns(dbMaxIdleConns)
+	sqlDB.SetConnMaxLifetime(dbConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(dbConnMaxIdleTime)
+	return nil
+}
+
+// Whether err is worth retrying: lost or refused connections, timeouts,
+// server shutdown or overload, serialization failures and deadlocks
+func isTransientDBError(err error) bool {
+	if err == nil || errors.Is(err, errDBUnavailable) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08") || // connection exception
+			strings.HasPrefix(pgErr.Code, "53") || // insufficient resources
+			strings.HasPrefix(pgErr.Code, "57P") || // shutdown, cannot connect now
+			pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || pgconn.Timeout(err) || pgconn.SafeToRetry(err) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Run op, retrying transient failures with exponential backoff
+func withDBRetry(ctx context.Context, op func() error) error {
+	backoff := dbRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if attempt == dbRetryAttempts || !isTransientDBError(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Opens after dbBreakerThreshold consecutive transient failures and fails
+// queries fast for dbBreakerCooldown. One probe is then let through: success
+// closes the breaker, failure opens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var dbBreaker = &circuitBreaker{}
+
+// Whether a query may run now
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < dbBreakerThreshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Whether the database is currently considered unavailable
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= dbBreakerThreshold && (b.probing || time.Now().Before(b.openUntil))
+}
+
+// Whether the last query failed with a transient error
+func (b *circuitBreaker) degraded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures > 0
+}
+
+// Record the outcome of a query
+func (b *circuitBreaker) record(err error) {
+	if errors.Is(err, errDBUnavailable) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !isTransientDBError(err) {
+		if b.failures >= dbBreakerThreshold {
+			dbCircuitOpen.Set(0)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= dbBreakerThreshold {
+		b.openUntil = time.Now().Add(dbBreakerCooldown)
+		dbCircuitOpen.Set(1)
+	}
+}
+
+// Route every GORM operation through the breaker
+func registerBreaker(gdb *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		if !dbBreaker.allow() {
+			tx.AddError(errDBUnavailable)
+		}
+	}
+	after := func(tx *gorm.DB) {
+		dbBreaker.record(tx.Error)
+	}
+	cb := gdb.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("breaker:before_create", before),
+		cb.Create().After("gorm:create").Register("breaker:after_create", after),
+		cb.Query().Before("gorm:query").Register("breaker:before_query", before),
+		cb.Query().After("gorm:query").Register("breaker:after_query", after),
+		cb.Update().Before("gorm:update").Register("breaker:before_update", before),
+		cb.Update().After("gorm:update").Register("breaker:after_update", after),
+		cb.Delete().Before("gorm:delete").Register("breaker:before_delete", before),
+		cb.Delete().After("gorm:delete").Register("breaker:after_delete", after),
+		cb.Row().Before("gorm:row").Register("breaker:before_row", before),
+		cb.Row().After("gorm:row").Register("breaker:after_row", after),
+		cb.Raw().Before("gorm:raw").Register("breaker:before_raw", before),
+		cb.Raw().After("gorm:raw").Register("breaker:after_raw", after),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
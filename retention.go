@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Transactions are kept for the keep_days of the most specific retention
+// policy matching their partner and type, else RETENTION_DAYS (0 keeps
+// them forever). Expired ones are archived to the archive store as CSV and
+// deleted with their rows by a run every RETENTION_INTERVAL.
+var (
+	retentionDays     = getEnvInt("RETENTION_DAYS", 0)
+	retentionInterval = getEnvDuration("RETENTION_INTERVAL", 24*time.Hour)
+	retentionBatch    = atLeastOne(getEnvInt("RETENTION_BATCH", 500))
+)
+
+// How expired rows are archived before they are deleted
+const (
+	retentionArchiveCSV  = "csv"  // gzipped CSV in the archive store
+	retentionArchiveNone = "none" // deleted without a copy
+)
+
+// Triggers and states of retention runs
+const (
+	retentionScheduled = "schedule"
+	retentionManual    = "manual"
+
+	retentionRunning   = "running"
+	retentionCompleted = "completed"
+	retentionFailed    = "failed"
+)
+
+var retentionRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_retention_transactions_total",
+	Help: "Transactions deleted by retention runs.",
+}, []string{"tenant"})
+
+// How long transactions of a partner, a type or both are kept
+type RetentionPolicy struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	PartnerID string    `json:"partner_id,omitempty"` // "" covers every partner
+	Type      string    `json:"type,omitempty"`       // e.g. 810 or 997; "" covers every type
+	KeepDays  int       `json:"keep_days"`
+	Archive   string    `json:"archive,omitempty"` // csv (default) or none
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (p *RetentionPolicy) validate() error {
+	if p.KeepDays < 1 {
+		return errors.New("keep_days must be at least 1")
+	}
+	switch p.Archive {
+	case "", retentionArchiveCSV, retentionArchiveNone:
+	default:
+		return errors.New("archive must be csv or none")
+	}
+	return nil
+}
+
+// Policies matching more transactions yield to those matching fewer: a
+// partner and type over a partner over a type over neither
+func (p RetentionPolicy) specificity() int {
+	n := 0
+	if p.PartnerID != "" {
+		n += 2
+	}
+	if p.Type != "" {
+		n++
+	}
+	return n
+}
+
+// Whether some transactions are covered by both p and q
+func (p RetentionPolicy) overlaps(q RetentionPolicy) bool {
+	return (p.PartnerID == "" || q.PartnerID == "" || p.PartnerID == q.PartnerID) && (p.Type == "" || q.Type == "" || p.Type == q.Type)
+}
+
+// One retention run of a tenant, what it found and what it archived
+type RetentionRun struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	TenantID     string     `json:"tenant_id" gorm:"index;uniqueIndex:idx_retention_runs_slot"`
+	Slot         *time.Time `json:"-" gorm:"uniqueIndex:idx_retention_runs_slot"` // interval a scheduled run is for, claimed by one replica
+	Trigger      string     `json:"trigger"`
+	Actor        string     `json:"actor"`
+	DryRun       bool       `json:"dry_run"` // only counts what is expired
+	Status       string     `json:"status"`
+	Transactions int64      `json:"transactions"` // expired, and deleted unless a dry run
+	Results      string     `json:"-"`            // JSON array of retentionResult
+	Error        string     `json:"error,omitempty"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+
+	Policies []retentionResult `json:"policies" gorm:"-"`
+}
+
+// What one policy expired in a run
+type retentionResult struct {
+	PolicyID     string    `json:"policy_id"` // "default" for RETENTION_DAYS
+	PartnerID    string    `json:"partner_id,omitempty"`
+	Type         string    `json:"type,omitempty"`
+	Cutoff       time.Time `json:"cutoff"` // transactions dated before it expired
+	Transactions int64     `json:"transactions"`
+	Files        []string  `json:"files,omitempty"` // archive keys of the CSV files
+	Error        string    `json:"error,omitempty"`
+}
+
+type retentionRunRequest struct {
+	DryRun bool `json:"dry_run"`
+}
+
+func (run *RetentionRun) parse() {
+	run.Policies = []retentionResult{}
+	if run.Results != "" {
+		json.Unmarshal([]byte(run.Results), &run.Policies)
+	}
+}
+
+// Rows archived with an expired transaction, by table; the rest of its rows
+// are only deleted
+var retentionArchived = []struct {
+	table string
+	model interface{}
+	key   string // column holding the transaction ID
+}{
+	{"transactions", &Transaction{}, "id"},
+	{"line_items", &LineItem{}, "transaction_id"},
+	{"transaction_events", &TransactionEvent{}, "transaction_id"},
+	{"attachments", &Attachment{}, "transaction_id"},
+}
+
+var retentionDeleted = []interface{}{
+	&LineItem{}, &TransactionEvent{}, &Attachment{}, &StatusLink{}, &Replay{}, &MailboxMessage{}, &Shipment{}, &Invoice{},
+}
+
+// Enabled policies of ctx's tenant, with RETENTION_DAYS as the policy
+// covering everything when none does
+func retentionPolicies(ctx context.Context) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	if err := db.WithContext(ctx).Where("disabled = ?", false).Order("created_at").Find(&policies).Error; err != nil {
+		return nil, err
+	}
+	if retentionDays > 0 {
+		for _, p := range policies {
+			if p.specificity() == 0 {
+				return policies, nil
+			}
+		}
+		policies = append(policies, RetentionPolicy{ID: "default", KeepDays: retentionDays})
+	}
+	return policies, nil
+}
+
+// Transactions p applies to, leaving out those of more specific policies
+func retentionScope(q *gorm.DB, p RetentionPolicy, policies []RetentionPolicy) *gorm.DB {
+	if p.PartnerID != "" {
+		q = q.Where("partner_id = ?", p.PartnerID)
+	}
+	if p.Type != "" {
+		q = q.Where("type = ?", p.Type)
+	}
+	for _, other := range policies {
+		if other.ID == p.ID || other.specificity() <= p.specificity() || !p.overlaps(other) {
+			continue
+		}
+		switch {
+		case other.PartnerID != "" && other.Type != "":
+			q = q.Where("NOT (partner_id = ? AND type = ?)", other.PartnerID, other.Type)
+		case other.PartnerID != "":
+			q = q.Where("partner_id <> ?", other.PartnerID)
+		default:
+			q = q.Where("type <> ?", other.Type)
+		}
+	}
+	return q
+}
+
+// Rows of model whose key is one of ids as gzipped CSV, values as stored:
+// encrypted columns stay encrypted
+func exportRows(ctx context.Context, model interface{}, key string, ids []string) ([]byte, int, error) {
+	rows, err := db.WithContext(ctx).Model(model).Where(key+" IN ?", ids).Order(key).Rows()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	cw := csv.NewWriter(zw)
+	cw.Write(columns)
+	n := 0
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, 0, err
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			switch t := v.(type) {
+			case nil:
+			case []byte:
+				record[i] = string(t)
+			case time.Time:
+				record[i] = t.UTC().Format(time.RFC3339Nano)
+			default:
+				record[i] = fmt.Sprint(t)
+			}
+		}
+		cw.Write(record)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return nil, 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), n, nil
+}
+
+// Archive a batch of expired transactions and their rows, one file per
+// table with rows
+func archiveExpired(ctx context.Context, run *RetentionRun, batch int, ids []string) ([]string, error) {
+	if archive == nil {
+		return nil, errors.New("archival is disabled; set archive to none to delete without a copy")
+	}
+	var keys []string
+	for _, a := range retentionArchived {
+		data, n, err := exportRows(ctx, a.model, a.key, ids)
+		if err != nil {
+			return keys, fmt.Errorf("export %s: %w", a.table, err)
+		}
+		if n == 0 {
+			continue
+		}
+		key := fmt.Sprintf("retention/%s/%s/run-%d/%s-%04d.csv.gz", run.TenantID, run.StartedAt.Format("2006/01/02"), run.ID, a.table, batch)
+		if err := archive.Put(ctx, key, data); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Delete transactions and every row that belongs to them, then the files
+// of their attachments
+func deleteExpired(ctx context.Context, ids []string) error {
+	var attachments []Attachment
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if db.Dialector.Name() == "postgres" {
+			// Lets retention past the append-only trigger of transaction_events
+			if err := tx.Exec("SET LOCAL edigateway.retention = 'on'").Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("transaction_id IN ?", ids).Find(&attachments).Error; err != nil {
+			return err
+		}
+		for _, model := range retentionDeleted {
+			if err := tx.Where("transaction_id IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("id IN ?", ids).Delete(&Transaction{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if archive == nil {
+			break
+		}
+		if err := archive.Delete(ctx, a.StorageKey); err != nil && !errors.Is(err, errBlobNotFound) {
+			log.Printf("ERROR: retention: attachment %s: %v\n", a.ID, err)
+		}
+	}
+	return nil
+}
+
+// Expire the transactions of one policy, batch by batch
+func applyRetentionPolicy(ctx context.Context, run *RetentionRun, p RetentionPolicy, policies []RetentionPolicy, batch *int) retentionResult {
+	res := retentionResult{PolicyID: p.ID, PartnerID: p.PartnerID, Type: p.Type, Cutoff: run.StartedAt.AddDate(0, 0, -p.KeepDays)}
+	expired := func() *gorm.DB {
+		return retentionScope(db.WithContext(ctx).Model(&Transaction{}).Where("date < ?", res.Cutoff), p, policies)
+	}
+	if run.DryRun {
+		if err := expired().Count(&res.Transactions).Error; err != nil {
+			res.Error = err.Error()
+		}
+		return res
+	}
+	for {
+		var ids []string
+		if err := expired().Order("date").Limit(retentionBatch).Pluck("id", &ids).Error; err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if len(ids) == 0 {
+			return res
+		}
+		*batch++
+		if p.Archive != retentionArchiveNone {
+			keys, err := archiveExpired(ctx, run, *batch, ids)
+			res.Files = append(res.Files, keys...)
+			if err != nil {
+				res.Error = err.Error()
+				return res
+			}
+		}
+		if err := deleteExpired(ctx, ids); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Transactions += int64(len(ids))
+		retentionRemoved.WithLabelValues(run.TenantID).Add(float64(len(ids)))
+	}
+}
+
+// Apply every policy of the run's tenant and record the outcome. A policy
+// that fails leaves the others to run.
+func executeRetention(ctx context.Context, run *RetentionRun) {
+	policies, err := retentionPolicies(ctx)
+	batch := 0
+	if err == nil {
+		for _, p := range policies {
+			res := applyRetentionPolicy(ctx, run, p, policies, &batch)
+			run.Transactions += res.Transactions
+			run.Policies = append(run.Policies, res)
+			if res.Error != "" {
+				log.Printf("ERROR: retention run %d policy %s: %s\n", run.ID, p.ID, res.Error)
+				err = errors.New("policy " + p.ID + ": " + res.Error)
+			}
+		}
+	}
+	now := time.Now().UTC()
+	run.FinishedAt, run.Status = &now, retentionCompleted
+	if err != nil {
+		run.Status, run.Error = retentionFailed, err.Error()
+	}
+	results, _ := json.Marshal(run.Policies)
+	run.Results = string(results)
+	if err := db.WithContext(ctx).Model(run).Updates(map[string]interface{}{
+		"status": run.Status, "transactions": run.Transactions, "results": run.Results, "error": run.Error, "finished_at": now,
+	}).Error; err != nil {
+		log.Printf("ERROR: retention run %d: %v\n", run.ID, err)
+	}
+	if run.Transactions > 0 && !run.DryRun {
+		log.Printf("Retention run %d of tenant %s removed %d transactions", run.ID, run.TenantID, run.Transactions)
+	}
+}
+
+func newRetentionRun(ctx context.Context, trigger string, dryRun bool, now time.Time) RetentionRun {
+	return RetentionRun{TenantID: tenantID(ctx), Trigger: trigger, Actor: auditorFrom(ctx).actor, DryRun: dryRun,
+		Status: retentionRunning, StartedAt: now.UTC(), Policies: []retentionResult{}}
+}
+
+// Run retention for every tenant once per RETENTION_INTERVAL. Each
+// interval's run is claimed by the first replica to record it.
+func runRetention(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		slot := now.Truncate(interval).UTC()
+		for _, tenant := range tenants {
+			tctx := withAuditor(withTenant(ctx, tenant), systemAuditor("system", "retention"))
+			run := newRetentionRun(tctx, retentionScheduled, false, now)
+			run.Slot = &slot
+			res := db.WithContext(tctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&run)
+			if res.Error != nil {
+				log.Printf("ERROR: retention run of tenant %s: %v\n", tenant, res.Error)
+				continue
+			} else if res.RowsAffected == 0 {
+				continue // another replica runs this interval
+			}
+			executeRetention(tctx, &run)
+		}
+	}
+}
+
+// Look up the retention policy of a request, writing the problem when it
+// fails
+func requestRetentionPolicy(w http.ResponseWriter, r *http.Request) *RetentionPolicy {
+	var p RetentionPolicy
+	err := db.WithContext(r.Context()).First(&p, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Retention policy not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch retention policy", http.StatusInternalServerError)
+		return nil
+	}
+	return &p
+}
+
+// Whether another enabled policy already covers exactly p's partner and type
+func duplicateRetentionPolicy(ctx context.Context, p RetentionPolicy) (bool, error) {
+	if p.Disabled {
+		return false, nil
+	}
+	var n int64
+	err := db.WithContext(ctx).Model(&RetentionPolicy{}).
+		Where("partner_id = ? AND type = ? AND disabled = ? AND id <> ?", p.PartnerID, p.Type, false, p.ID).Count(&n).Error
+	return n > 0, err
+}
+
+// Validate and save a retention policy, writing the problem when it fails
+func saveRetentionPolicy(w http.ResponseWriter, r *http.Request, p *RetentionPolicy, existing *RetentionPolicy) bool {
+	if err := p.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if dup, err := duplicateRetentionPolicy(r.Context(), *p); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch retention policies", http.StatusInternalServerError)
+		return false
+	} else if dup {
+		writeProblem(w, "Another retention policy covers this partner and type", http.StatusConflict)
+		return false
+	}
+	q := db.WithContext(r.Context())
+	var err error
+	if existing == nil {
+		err = q.Create(p).Error
+	} else {
+		err = q.Omit("CreatedAt").Save(p).Error
+	}
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save retention policy", http.StatusInternalServerError)
+		return false
+	}
+	var before interface{}
+	if existing != nil {
+		before = existing
+	}
+	auditChange(r.Context(), auditAction(existing != nil), "retention_policy", p.ID, before, p)
+	return true
+}
+
+// List retention policies
+func listRetentionPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies := []RetentionPolicy{}
+	if err := db.WithContext(r.Context()).Order("created_at").Find(&policies).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch retention policies", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// Add a retention policy
+func createRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var p RetentionPolicy
+	if err := decodeJSON(w, r, &p); err != nil {
+		writeError(w, err)
+		return
+	}
+	p.ID = uuid.New().String()
+	if !saveRetentionPolicy(w, r, &p, nil) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Fetch one retention policy
+func getRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestRetentionPolicy(w, r)
+	if p == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// Replace a retention policy
+func updateRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	existing := requestRetentionPolicy(w, r)
+	if existing == nil {
+		return
+	}
+	var p RetentionPolicy
+	if err := decodeJSON(w, r, &p); err != nil {
+		writeError(w, err)
+		return
+	}
+	p.ID, p.TenantID, p.CreatedAt = existing.ID, existing.TenantID, existing.CreatedAt
+	if !saveRetentionPolicy(w, r, &p, existing) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// List retention runs, newest first; limit defaults to 50
+func listRetentionRunsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeProblem(w, "limit must be 1 to 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	runs := []RetentionRun{}
+	if err := db.WithContext(r.Context()).Order("id DESC").Limit(limit).Find(&runs).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch retention runs", http.StatusInternalServerError)
+		return
+	}
+	for i := range runs {
+		runs[i].parse()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// Fetch one retention run
+func getRetentionRunHandler(w http.ResponseWriter, r *http.Request) {
+	var run RetentionRun
+	err := db.WithContext(r.Context()).First(&run, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Retention run not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch retention run", http.StatusInternalServerError)
+		return
+	}
+	run.parse()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// Start a retention run of the caller's tenant in the background, unless
+// one started within the last day is still running
+func triggerRetentionRunHandler(w http.ResponseWriter, r *http.Request) {
+	var req retentionRunRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	now := time.Now()
+	var running int64
+	if err := db.WithContext(r.Context()).Model(&RetentionRun{}).Where("status = ? AND started_at > ?", retentionRunning, now.Add(-24*time.Hour)).Count(&running).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch retention runs", http.StatusInternalServerError)
+		return
+	} else if running > 0 {
+		writeProblem(w, "A retention run is in progress", http.StatusConflict)
+		return
+	}
+	ctx := detachedContext(r)
+	run := newRetentionRun(ctx, retentionManual, req.DryRun, now)
+	if err := db.WithContext(ctx).Create(&run).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to start retention run", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/admin/retention/runs/%d", run.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+	go executeRetention(ctx, &run)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Classes of the event taxonomy. Each class has its own topic so consumers
+// subscribe only to what they need.
+const (
+	eventClassInbound  = "inbound"  // transactions received or replayed
+	eventClassOutbound = "outbound" // transactions delivered to their partner
+	eventClassAcks     = "acks"     // acknowledgments received from partners
+	eventClassFailures = "failures" // rejected transactions and failed deliveries
+)
+
+var eventClasses = []string{eventClassInbound, eventClassOutbound, eventClassAcks, eventClassFailures}
+
+var defaultEventTopics = map[string]string{
+	eventClassInbound:  "edi.inbound.received",
+	eventClassOutbound: "edi.outbound.delivered",
+	eventClassAcks:     "edi.acks",
+	eventClassFailures: "edi.failures",
+}
+
+// Class of an event about t
+func eventClass(eventType string, t Transaction) string {
+	switch eventType {
+	case eventTransactionFailed, eventDeliveryFailed:
+		return eventClassFailures
+	case eventTransactionDelivered:
+		return eventClassOutbound
+	}
+	if t.Type == "997" || t.Type == "999" {
+		return eventClassAcks
+	}
+	return eventClassInbound
+}
+
+// Topic of each event class from KAFKA_EVENT_TOPICS, comma separated
+// class=topic pairs. Classes not listed use single, the legacy KAFKA_TOPIC,
+// when set and the taxonomy's default topic otherwise.
+func parseEventTopics(spec, single string) (map[string]string, error) {
+	classes := map[string]string{}
+	for _, class := range eventClasses {
+		classes[class] = defaultEventTopics[class]
+		if single != "" {
+			classes[class] = single
+		}
+	}
+	for _, entry := range splitList(spec) {
+		class, topic, ok := strings.Cut(entry, "=")
+		class, topic = strings.TrimSpace(class), strings.TrimSpace(topic)
+		if _, known := defaultEventTopics[class]; !ok || !known || topic == "" {
+			return nil, fmt.Errorf("KAFKA_EVENT_TOPICS: %q is not class=topic with class inbound, outbound, acks or failures", entry)
+		}
+		classes[class] = topic
+	}
+	return classes, nil
+}
+
+// Routes events to the topic of their class. Received transactions (the
+// inbound and acks classes) can be routed further by partner and
+// transaction type with KAFKA_TOPIC_ROUTES: comma separated
+// partner/type=topic pairs where either side may be *, e.g.
+// "*/856=edi.asn,*/850=edi.orders,acme/*=edi.acme". The most specific route
+// wins (partner/type, partner/*, */type); routing rules in the database
+// come before these at each step. With KAFKA_PRIORITY_LANES, received
+// transactions of high and low priority go to the .high and .low topic of
+// the one they are routed to.
+type topicRouter struct {
+	brokers     []string
+	classes     map[string]string // event class -> topic
+	routes      map[string]string
+	acks        kafka.RequiredAcks
+	compression kafka.Compression
+
+	mu      sync.Mutex
+	writers map[string]*kafka.Writer // one pooled writer per topic
+
+	rulesMu    sync.RWMutex
+	rules      map[string]map[string]string // tenant -> partner/type -> topic, from RoutingRule
+	registered map[string]bool              // topics of rules whose schema was registered
+}
+
+func newTopicRouter(brokers []string, classes map[string]string, spec string) (*topicRouter, error) {
+	routes, err := parseTopicRoutes(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &topicRouter{brokers: brokers, classes: classes, routes: routes, writers: map[string]*kafka.Writer{}}, nil
+}
+
+func parseTopicRoutes(spec string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, entry := range splitList(spec) {
+		match, topic, ok := strings.Cut(entry, "=")
+		partner, txType, ok2 := strings.Cut(strings.TrimSpace(match), "/")
+		topic = strings.TrimSpace(topic)
+		if !ok || !ok2 || partner == "" || txType == "" || topic == "" {
+			return nil, fmt.Errorf("KAFKA_TOPIC_ROUTES: %q is not partner/type=topic", entry)
+		}
+		routes[partner+"/"+txType] = topic
+	}
+	return routes, nil
+}
+
+// Topic for an event about t
+func (r *topicRouter) topicFor(eventType string, t Transaction) string {
+	class := eventClass(eventType, t)
+	if class != eventClassInbound && class != eventClassAcks {
+		return r.classes[class]
+	}
+	if t.Topic != "" {
+		return laneTopic(t.Topic, t) // set by a document rule
+	}
+	partner := t.PartnerID
+	if partner == "" {
+		partner = defaultPartner.ID
+	}
+	for _, key := range []string{partner + "/" + t.Type, partner + "/*", "*/" + t.Type} {
+		if topic, ok := r.rule(t.TenantID, key); ok {
+			return laneTopic(topic, t)
+		}
+		if topic, ok := r.routes[key]; ok {
+			return laneTopic(topic, t)
+		}
+	}
+	return laneTopic(r.classes[class], t)
+}
+
+// Every topic events may be published to
+func (r *topicRouter) topics() []string {
+	seen := map[string]bool{}
+	var list []string
+	add := func(topic string) {
+		if !seen[topic] {
+			seen[topic] = true
+			list = append(list, topic)
+		}
+	}
+	for _, class := range eventClasses {
+		if class != eventClassInbound && class != eventClassAcks {
+			add(r.classes[class])
+			continue
+		}
+		for _, topic := range laneTopics(r.classes[class]) {
+			add(topic)
+		}
+	}
+	for _, route := range r.routes {
+		for _, topic := range laneTopics(route) {
+			add(topic)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Close the writers, waiting for the asynchronous writes they hold
+func (r *topicRouter) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for topic, w := range r.writers {
+		if err := w.Close(); err != nil {
+			log.Printf("ERROR: closing writer of %s: %v\n", topic, err)
+		}
+		delete(r.writers, topic)
+	}
+}
+
+// Writer for topic, created on first use
+func (r *topicRouter) writer(topic string) *kafka.Writer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.writers[topic]
+	if !ok {
+		w = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:      r.brokers,
+			Topic:        topic,
+			BatchSize:    kafkaBatchSize,
+			BatchBytes:   kafkaBatchBytes,
+			BatchTimeout: kafkaLinger,
+			ErrorLogger:  log.New(os.Stderr, "KAFKA ERROR: ", log.LstdFlags), // Log Kafka errors
+		})
+		// WriterConfig cannot express acks=none, and its default balancer
+		// ignores message keys: set both on the writer itself
+		w.RequiredAcks = r.acks
+		w.MaxAttempts = kafkaMaxAttempts
+		w.WriteTimeout = kafkaWriteTimeout
+		w.Balancer = &kafka.Hash{} // same key, same partition, so per-key order holds
+		w.Compression = r.compression
+		w.Transport = kafkaTransport()
+		if kafkaAsync {
+			// Writes return at once; the outbox learns the outcome
+			w.Async = true
+			w.Completion = eventsWritten
+		}
+		r.writers[topic] = w
+	}
+	return w
+}
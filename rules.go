@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Document rules decide what happens to each received transaction. Enabled
+// rules are read from the database for each document and tried in position
+// order; the first whose partner, type and conditions all match sets the
+// transaction's topic, acknowledgment, hold and priority, and the
+// transaction records which rule it was.
+type DocumentRule struct {
+	ID         uint            `json:"id" gorm:"primaryKey"`
+	TenantID   string          `json:"tenant_id" gorm:"index"`
+	Name       string          `json:"name"`
+	Position   int             `json:"position"`
+	PartnerID  string          `json:"partner_id,omitempty"` // empty or * for any partner
+	Type       string          `json:"type,omitempty"`       // empty or * for any transaction type
+	Conditions []ruleCondition `json:"conditions,omitempty" gorm:"serializer:json"`
+
+	// Actions of a matching rule
+	Topic           string `json:"topic,omitempty"`            // events go here instead of the routed topic
+	AutoAcknowledge *bool  `json:"auto_acknowledge,omitempty"` // false leaves its interchange unacknowledged
+	Hold            bool   `json:"hold"`                       // save it Held for review instead of publishing
+	Priority        string `json:"priority,omitempty"`         // high, normal or low
+
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// One condition of a rule on a value of the transaction: partner_id, a
+// header field (ship_to, carrier, bol, type, po_number, number), an item
+// field as items.sku, true when any item matches, or an X12 element of the
+// set such as TDS.01 or N1*ST.04
+type ruleCondition struct {
+	Field  string   `json:"field"`
+	Op     string   `json:"op"` // eq, ne, in, contains, prefix, gt, gte, lt, lte, exists or missing
+	Value  string   `json:"value,omitempty"`
+	Values []string `json:"values,omitempty"` // for in
+}
+
+// Priorities a rule can give
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var documentRuleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_document_rule_matches_total",
+	Help: "Received transactions each document rule matched.",
+}, []string{"tenant", "rule"})
+
+func (rule *DocumentRule) validate() error {
+	rule.Name, rule.PartnerID, rule.Type, rule.Topic = strings.TrimSpace(rule.Name), strings.TrimSpace(rule.PartnerID), strings.TrimSpace(rule.Type), strings.TrimSpace(rule.Topic)
+	if rule.Name == "" {
+		return errors.New("name is required")
+	}
+	for i := range rule.Conditions {
+		if err := rule.Conditions[i].validate(); err != nil {
+			return fmt.Errorf("conditions[%d]: %w", i, err)
+		}
+	}
+	if rule.Topic != "" && strings.ContainsAny(rule.Topic, " ,/=") {
+		return errors.New("topic may not contain spaces, commas, slashes or =")
+	}
+	if !validPriority(rule.Priority) {
+		return errors.New("priority must be high, normal or low")
+	}
+	if rule.Topic == "" && rule.AutoAcknowledge == nil && !rule.Hold && rule.Priority == "" {
+		return errors.New("a rule needs an action: topic, auto_acknowledge, hold or priority")
+	}
+	return nil
+}
+
+func (c *ruleCondition) validate() error {
+	c.Field = strings.TrimSpace(c.Field)
+	if _, isX12 := x12Ref(c.Field, nil); !isX12 && !conditionField(c.Field) {
+		return fmt.Errorf("unknown field %q", c.Field)
+	}
+	switch c.Op {
+	case "eq", "ne", "contains", "prefix", "exists", "missing":
+	case "in":
+		if len(c.Values) == 0 {
+			return errors.New("in needs values")
+		}
+	case "gt", "gte", "lt", "lte":
+		if _, err := strconv.ParseFloat(c.Value, 64); err != nil {
+			return fmt.Errorf("%s needs a numeric value, not %q", c.Op, c.Value)
+		}
+	default:
+		return fmt.Errorf("op must be eq, ne, in, contains, prefix, gt, gte, lt, lte, exists or missing, not %q", c.Op)
+	}
+	return nil
+}
+
+// Whether name is a canonical field conditions can test
+func conditionField(name string) bool {
+	switch name {
+	case "partner_id", "po_number", "number":
+		return true
+	}
+	if _, ok := headerField(&Transaction{}, name); ok {
+		return true
+	}
+	item, ok := strings.CutPrefix(name, "items.")
+	if !ok {
+		return false
+	}
+	_, ok = itemField(&Item{}, item)
+	return ok
+}
+
+// Values a condition's field has in t: one for header fields and X12
+// elements, one per item for item fields
+func conditionValues(t *Transaction, field string) []string {
+	if v, isX12 := x12Ref(field, t.set); isX12 {
+		return []string{v}
+	}
+	switch field {
+	case "partner_id":
+		return []string{t.PartnerID}
+	case "po_number":
+		return []string{t.refs.PONumber}
+	case "number":
+		return []string{t.refs.Number}
+	}
+	if v, ok := headerField(t, field); ok {
+		return []string{v}
+	}
+	items, _ := t.Items()
+	values := make([]string, len(items))
+	for i := range items {
+		values[i], _ = itemField(&items[i], strings.TrimPrefix(field, "items."))
+	}
+	return values
+}
+
+func (c ruleCondition) matches(t *Transaction) bool {
+	values := conditionValues(t, c.Field)
+	if c.Op == "missing" {
+		for _, v := range values {
+			if v != "" {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if c.matchesValue(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ruleCondition) matchesValue(v string) bool {
+	switch c.Op {
+	case "eq":
+		return v == c.Value
+	case "ne":
+		return v != c.Value
+	case "in":
+		for _, want := range c.Values {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	case "contains":
+		return strings.Contains(v, c.Value)
+	case "prefix":
+		return strings.HasPrefix(v, c.Value)
+	case "exists":
+		return v != ""
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	limit, _ := strconv.ParseFloat(c.Value, 64)
+	if err != nil {
+		return false
+	}
+	switch c.Op {
+	case "gt":
+		return n > limit
+	case "gte":
+		return n >= limit
+	case "lt":
+		return n < limit
+	}
+	return n <= limit
+}
+
+// Whether a rule applies to t
+func (rule DocumentRule) matches(t *Transaction) bool {
+	if rule.PartnerID != "" && rule.PartnerID != "*" && rule.PartnerID != t.PartnerID {
+		return false
+	}
+	if rule.Type != "" && rule.Type != "*" && rule.Type != t.Type {
+		return false
+	}
+	for _, c := range rule.Conditions {
+		if !c.matches(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply the first matching document rule to a newly received transaction,
+// then give it the priority of its partner or type if the rule set none
+func applyDocumentRules(ctx context.Context, t *Transaction) error {
+	if edgeMode {
+		return nil
+	}
+	var rules []DocumentRule
+	if err := db.WithContext(ctx).Where("disabled = ?", false).Order("position, id").Find(&rules).Error; err != nil {
+		log.Printf("ERROR: document rules: %v\n", err)
+		return &httpError{Status: http.StatusServiceUnavailable, Message: "Failed to fetch document rules"}
+	}
+	for _, rule := range rules {
+		if !rule.matches(t) {
+			continue
+		}
+		documentRuleMatches.WithLabelValues(tenantID(ctx), strconv.FormatUint(uint64(rule.ID), 10)).Inc()
+		t.RuleID, t.Topic, t.Priority = rule.ID, rule.Topic, rule.Priority
+		if rule.AutoAcknowledge != nil && !*rule.AutoAcknowledge {
+			t.skipAck = true
+		}
+		if rule.Hold {
+			t.Status, t.HoldReason = statusHeld, fmt.Sprintf("document rule %d (%s)", rule.ID, rule.Name)
+		}
+		break
+	}
+	classifyPriority(ctx, t)
+	return nil
+}
+
+// Look up the document rule of a request, writing the problem when it fails
+func requestDocumentRule(w http.ResponseWriter, r *http.Request) *DocumentRule {
+	var rule DocumentRule
+	err := db.WithContext(r.Context()).First(&rule, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Document rule not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch document rule", http.StatusInternalServerError)
+		return nil
+	}
+	return &rule
+}
+
+// Validate and save a document rule, writing the problem when it fails
+func saveDocumentRule(w http.ResponseWriter, r *http.Request, rule *DocumentRule, existing *DocumentRule) bool {
+	if err := rule.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	q := db.WithContext(r.Context())
+	var err error
+	if existing == nil {
+		err = q.Create(rule).Error
+	} else {
+		err = q.Omit("CreatedAt").Save(rule).Error
+	}
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save document rule", http.StatusInternalServerError)
+		return false
+	}
+	var before interface{}
+	if existing != nil {
+		before = existing
+	}
+	id := strconv.FormatUint(uint64(rule.ID), 10)
+	auditChange(r.Context(), auditAction(existing != nil), "document_rule", id, before, rule)
+	recordConfigChange(r.Context(), "document_rule", id)
+	if rule.Topic != "" && eventsBackend == "kafka" {
+		if err := registerEventSchema(tenantTopic(r.Context(), rule.Topic)); err != nil {
+			log.Printf("ERROR: schema registry, topic %s: %v\n", rule.Topic, err)
+		}
+	}
+	return true
+}
+
+// List document rules in the order they are tried
+func listDocumentRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules := []DocumentRule{}
+	if err := db.WithContext(r.Context()).Order("position, id").Find(&rules).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch document rules", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// Add a document rule
+func createDocumentRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule DocumentRule
+	if err := decodeJSON(w, r, &rule); err != nil {
+		writeError(w, err)
+		return
+	}
+	rule.ID = 0
+	if !saveDocumentRule(w, r, &rule, nil) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// Fetch one document rule
+func getDocumentRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule := requestDocumentRule(w, r)
+	if rule == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// Replace a document rule
+func updateDocumentRuleHandler(w http.ResponseWriter, r *http.Request) {
+	existing := requestDocumentRule(w, r)
+	if existing == nil {
+		return
+	}
+	var rule DocumentRule
+	if err := decodeJSON(w, r, &rule); err != nil {
+		writeError(w, err)
+		return
+	}
+	rule.ID, rule.TenantID, rule.CreatedAt = existing.ID, existing.TenantID, existing.CreatedAt
+	if !saveDocumentRule(w, r, &rule, existing) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
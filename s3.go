@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Minimal S3-compatible client (AWS S3, MinIO) using SigV4 path-style requests
+type s3Store struct {
+	endpoint  string // e.g. https://s3.us-east-1.amazonaws.com or http://minio:9000
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Store() *s3Store {
+	return &s3Store{
+		endpoint:  strings.TrimRight(getEnv("S3_ENDPOINT", "http://minio:9000"), "/"),
+		bucket:    getEnv("S3_BUCKET", "edi-archive"),
+		region:    getEnv("S3_REGION", "us-east-1"),
+		accessKey: getEnv("S3_ACCESS_KEY", ""),
+		secretKey: getEnv("S3_SECRET_KEY", ""),
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Send a signed request for an object and turn non-2xx responses into errors
+func (s *s3Store) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	return s.send(ctx, method, s.endpoint+"/"+s.bucket+"/"+escapeKey(key), key, body)
+}
+
+func (s *s3Store) send(ctx context.Context, method, rawURL, key string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("s3 %s %s: %w", method, key, errBlobNotFound)
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// Object found by a bucket listing
+type s3Object struct {
+	Key  string
+	Size int64
+}
+
+// Objects whose keys start with prefix, in key order
+func (s *s3Store) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		// SigV4 wants the sorted query Encode gives, with %20 for spaces
+		rawQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+		resp, err := s.send(ctx, http.MethodGet, s.endpoint+"/"+s.bucket+"?"+rawQuery, prefix, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		objects = append(objects, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Stream an object instead of reading it whole
+func (s *s3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// AWS Signature Version 4
+func (s *s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
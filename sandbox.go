@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Status of a transaction a sandbox partner sent, checked but not saved
+const statusValidated = "Validated"
+
+type sandboxKey struct{}
+
+// Context whose documents are only validated, whatever partner they name
+func withSandbox(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sandboxKey{}, true)
+}
+
+// Whether documents for partnerID are validated without being saved,
+// archived or published: the partner is in sandbox mode, or the request is
+func sandboxed(ctx context.Context, partnerID string) bool {
+	if on, _ := ctx.Value(sandboxKey{}).(bool); on {
+		return true
+	}
+	if partnerID == "" {
+		return false
+	}
+	p, err := loadPartner(ctx, partnerID)
+	return err == nil && p.Sandbox
+}
+
+// What a sandbox submission would have produced
+type sandboxReport struct {
+	PartnerID       string        `json:"partner_id"`
+	Results         []batchResult `json:"results"`                   // validated or failed, per transaction
+	Acknowledgments []string      `json:"acknowledgments,omitempty"` // the 997 or 999 of each X12 interchange
+}
+
+// Check one split transaction of a sandboxed document the way admitSplit
+// would before saving it, or report false when it is not sandboxed
+func validateSandboxed(ctx context.Context, s splitResult, file, format string) (batchResult, bool) {
+	t := s.Transaction
+	if !sandboxed(ctx, t.PartnerID) {
+		return batchResult{}, false
+	}
+	res := batchResult{
+		File:               file,
+		Format:             format,
+		InterchangeControl: t.InterchangeControl,
+		ControlNumber:      t.ControlNumber,
+		Type:               t.Type,
+		Status:             "validated",
+		Annotations:        t.annotations,
+	}
+	err := s.Err
+	if err == nil {
+		err = checkPartnerActive(ctx, &t)
+	}
+	if err == nil {
+		err = checkSender(ctx, &t)
+	}
+	if err == nil {
+		err = checkSignatureRequired(ctx, &t)
+	}
+	if err != nil {
+		res.Status, res.Error, res.Code, res.Findings = "failed", err.Error(), resultCode(err), snipFindings(err)
+	}
+	return res, true
+}
+
+// Handle a submission from a partner in sandbox mode: every document is
+// parsed, mapped and validated like a production one and the report says
+// what would have been created, with the 997s or 999s the partner would
+// get back. Nothing is saved, archived, queued or published.
+func sandboxInboundHandler(w http.ResponseWriter, r *http.Request) {
+	var files []jobFile
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r.Body = http.MaxBytesReader(w, r.Body, inboundMaxBuffered)
+		var err error
+		if files, _, err = readSubmission(r, mediaType == "multipart/mixed"); err != nil {
+			writeError(w, err)
+			return
+		}
+	} else {
+		in, err := readInbound(w, r, false)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer in.release()
+		files = []jobFile{{contentType: r.Header.Get("Content-Type"), data: in.buf.Bytes()}}
+	}
+
+	ctx := withSandbox(detachedContext(r))
+	report := sandboxReport{PartnerID: partnerHint(ctx), Results: []batchResult{}}
+	now := time.Now()
+	for _, f := range files {
+		results := processDocument(ctx, nil, f.name, f.contentType, f.data)
+		report.Results = append(report.Results, results...)
+		report.Acknowledgments = append(report.Acknowledgments, interchangeAcks(f.contentType, f.data, results, now, true)...)
+	}
+	log.Printf("Sandbox submission from partner %s: %d transactions checked", report.PartnerID, len(report.Results))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Sandbox", "true")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Whether a request is submitted as a partner in sandbox mode
+func sandboxRequest(r *http.Request) bool {
+	id := partnerHint(r.Context())
+	return id != "" && sandboxed(r.Context(), id)
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Processing windows of a partner: when its outbound documents transmit,
+// when it (or we) cannot take them and the cutoffs that close each batch
+type PartnerSchedule struct {
+	PartnerID string    `json:"partner_id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	TimeZone  string    `json:"time_zone,omitempty"` // IANA zone daily windows keep their wall time in, default UTC
+	Windows   string    `json:"-"`                   // JSON array of ScheduleWindow
+	UpdatedAt time.Time `json:"updated_at"`
+
+	LastFlushAt *time.Time `json:"last_flush_at,omitempty"` // last delivery window the batch scheduler acted on
+
+	ParsedWindows []ScheduleWindow `json:"windows" gorm:"-"`
+}
+
+// Kinds of schedule window
+const (
+	windowDelivery    = "delivery"    // outbound documents transmit
+	windowMaintenance = "maintenance" // the partner's or our endpoint is down
+	windowCutoff      = "cutoff"      // documents received later go in the next batch
+)
+
+// A one-off or repeating window. Repeats that are whole days keep the wall
+// time of Start in the schedule's time zone across DST changes.
+type ScheduleWindow struct {
+	Kind     string     `json:"kind"`
+	Name     string     `json:"name,omitempty"`
+	Start    time.Time  `json:"start"`              // first occurrence
+	Duration string     `json:"duration,omitempty"` // e.g. 2h; empty for an instant
+	Every    string     `json:"every,omitempty"`    // repeat interval, e.g. 4h, 24h or 168h; empty for one-off
+	Weekdays []string   `json:"weekdays,omitempty"` // only repeat on these days: MO, TU, WE, TH, FR, SA, SU
+	Until    *time.Time `json:"until,omitempty"`    // last possible start
+}
+
+// One occurrence of a window
+type scheduleOccurrence struct {
+	PartnerID string    `json:"partner_id"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+var icalWeekdays = map[string]time.Weekday{"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday,
+	"WE": time.Wednesday, "TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday}
+
+const oneDay = 24 * time.Hour
+
+func (s *PartnerSchedule) location() *time.Location {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (s *PartnerSchedule) validate() error {
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("time_zone: unknown zone %q", s.TimeZone)
+	}
+	for i, win := range s.ParsedWindows {
+		switch win.Kind {
+		case windowDelivery, windowMaintenance, windowCutoff:
+		default:
+			return fmt.Errorf("window %d: kind must be delivery, maintenance or cutoff", i+1)
+		}
+		if win.Start.IsZero() {
+			return fmt.Errorf("window %d: start is required", i+1)
+		}
+		dur, err := win.duration()
+		if err != nil || dur < 0 {
+			return fmt.Errorf("window %d: duration must be a positive duration like 2h", i+1)
+		}
+		if win.Kind == windowMaintenance && dur == 0 {
+			return fmt.Errorf("window %d: maintenance windows need a duration", i+1)
+		}
+		every, err := win.every()
+		if err != nil || win.Every != "" && every < time.Minute {
+			return fmt.Errorf("window %d: every must be a duration of at least 1m", i+1)
+		}
+		if every > 0 && dur > every {
+			return fmt.Errorf("window %d: duration is longer than every", i+1)
+		}
+		for _, d := range win.Weekdays {
+			if _, ok := icalWeekdays[d]; !ok {
+				return fmt.Errorf("window %d: unknown weekday %q", i+1, d)
+			}
+		}
+		if len(win.Weekdays) > 0 && (every == 0 || every%oneDay != 0) {
+			return fmt.Errorf("window %d: weekdays need every to be whole days", i+1)
+		}
+		if win.Until != nil && win.Until.Before(win.Start) {
+			return fmt.Errorf("window %d: until is before start", i+1)
+		}
+	}
+	return nil
+}
+
+func (win *ScheduleWindow) duration() (time.Duration, error) {
+	if win.Duration == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(win.Duration)
+}
+
+func (win *ScheduleWindow) every() (time.Duration, error) {
+	if win.Every == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(win.Every)
+}
+
+// Start of the nth occurrence, before any weekday filter
+func (win *ScheduleWindow) nth(start time.Time, every time.Duration, n int) time.Time {
+	if every%oneDay == 0 {
+		return start.AddDate(0, 0, n*int(every/oneDay))
+	}
+	return start.Add(time.Duration(n) * every)
+}
+
+// Occurrences overlapping [from, to), at most limit of them
+func (win *ScheduleWindow) occurrences(loc *time.Location, from, to time.Time, limit int) []scheduleOccurrence {
+	dur, _ := win.duration()
+	every, _ := win.every()
+	start := win.Start.In(loc)
+	var out []scheduleOccurrence
+	add := func(t time.Time) {
+		out = append(out, scheduleOccurrence{Kind: win.Kind, Name: win.Name, Start: t, End: t.Add(dur)})
+	}
+	if every == 0 {
+		if start.Before(to) && !start.Add(dur).Before(from) {
+			add(start)
+		}
+		return out
+	}
+	n := 0
+	if skip := from.Sub(start) - dur; skip > 0 {
+		n = int(skip/every) - 1 // an occurrence more or less across DST changes
+		if n < 0 {
+			n = 0
+		}
+	}
+	for ; len(out) < limit; n++ {
+		t := win.nth(start, every, n)
+		if !t.Before(to) || win.Until != nil && t.After(*win.Until) {
+			break
+		}
+		if t.Add(dur).Before(from) || !win.onWeekday(t) {
+			continue
+		}
+		add(t)
+	}
+	return out
+}
+
+func (win *ScheduleWindow) onWeekday(t time.Time) bool {
+	if len(win.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range win.Weekdays {
+		if icalWeekdays[d] == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+const maxOccurrences = 1000
+
+// Occurrences of every window in [from, to), in start order
+func (s *PartnerSchedule) occurrences(from, to time.Time) []scheduleOccurrence {
+	loc := s.location()
+	out := []scheduleOccurrence{}
+	for i := range s.ParsedWindows {
+		for _, o := range s.ParsedWindows[i].occurrences(loc, from, to, maxOccurrences) {
+			o.PartnerID = s.PartnerID
+			out = append(out, o)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	if len(out) > maxOccurrences {
+		out = out[:maxOccurrences]
+	}
+	return out
+}
+
+// Schedule of a partner; nil when none is configured
+func loadPartnerSchedule(ctx context.Context, partnerID string) (*PartnerSchedule, error) {
+	if partnerID == "" || db == nil {
+		return nil, nil
+	}
+	var s PartnerSchedule
+	res := db.WithContext(ctx).Where("partner_id = ?", partnerID).Limit(1).Find(&s)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	if err := s.parse(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *PartnerSchedule) parse() error {
+	if err := json.Unmarshal([]byte(s.Windows), &s.ParsedWindows); err != nil {
+		return fmt.Errorf("partner %s schedule: %w", s.PartnerID, err)
+	}
+	return nil
+}
+
+// Fetch a partner's schedule
+func getScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := loadPartnerSchedule(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch schedule", http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		writeProblem(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// Create or replace a partner's schedule
+func putScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	partnerID := mux.Vars(r)["id"]
+	if _, err := loadPartner(r.Context(), partnerID); errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, errPartnerUnknown)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+		return
+	}
+	var s PartnerSchedule
+	if err := decodeJSON(w, r, &s); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before, err := loadPartnerSchedule(r.Context(), partnerID)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch schedule", http.StatusInternalServerError)
+		return
+	}
+	s.PartnerID, s.LastFlushAt = partnerID, nil
+	if before != nil {
+		s.LastFlushAt = before.LastFlushAt
+	}
+	if s.ParsedWindows == nil {
+		s.ParsedWindows = []ScheduleWindow{}
+	}
+	windows, _ := json.Marshal(s.ParsedWindows)
+	s.Windows = string(windows)
+	if err := db.WithContext(r.Context()).Save(&s).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditAction(before != nil), "partner_schedule", partnerID, before, s)
+	recordConfigChange(r.Context(), "partner_schedule", partnerID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// Time range of an occurrences or calendar request, default the next 7 days
+func scheduleRange(r *http.Request) (from, to time.Time, err error) {
+	from, to = time.Now(), time.Now().Add(7*oneDay)
+	for param, v := range map[string]*time.Time{"from": &from, "to": &to} {
+		if s := r.URL.Query().Get(param); s != "" {
+			if *v, err = time.Parse(time.RFC3339, s); err != nil {
+				return from, to, errors.New(param + " must be an RFC 3339 time")
+			}
+		}
+	}
+	if !to.After(from) || to.Sub(from) > 366*oneDay {
+		return from, to, errors.New("to must be after from and at most a year later")
+	}
+	return from, to, nil
+}
+
+// List when a partner's windows occur between from and to
+func scheduleOccurrencesHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := scheduleRange(r)
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := loadPartnerSchedule(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch schedule", http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		writeProblem(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.occurrences(from, to))
+}
+
+// iCalendar feed of one partner's schedule
+func partnerCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := loadPartnerSchedule(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch schedule", http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		writeProblem(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	writeCalendar(w, "EDI schedule: "+s.PartnerID, []PartnerSchedule{*s})
+}
+
+// iCalendar feed of every partner schedule of the tenant
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	var schedules []PartnerSchedule
+	if err := db.WithContext(r.Context()).Order("partner_id").Find(&schedules).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch schedules", http.StatusInternalServerError)
+		return
+	}
+	for i := range schedules {
+		if err := schedules[i].parse(); err != nil {
+			log.Printf("ERROR: %v\n", err)
+			writeProblem(w, "Failed to fetch schedules", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeCalendar(w, "EDI schedules", schedules)
+}
+
+// Write schedules as an RFC 5545 calendar, one recurring event per window
+func writeCalendar(w http.ResponseWriter, name string, schedules []PartnerSchedule) {
+	var b strings.Builder
+	line := func(s string) {
+		// Fold lines longer than 75 octets
+		for len(s) > 75 {
+			cut := 75
+			for cut > 1 && s[cut]&0xC0 == 0x80 {
+				cut-- // keep UTF-8 sequences whole
+			}
+			b.WriteString(s[:cut] + "\r\n")
+			s = " " + s[cut:]
+		}
+		b.WriteString(s + "\r\n")
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//edigateway//schedules//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:" + icalText(name))
+	for _, s := range schedules {
+		loc := s.location()
+		for i, win := range s.ParsedWindows {
+			dur, _ := win.duration()
+			every, _ := win.every()
+			summary := s.PartnerID + " " + win.Kind
+			if win.Name != "" {
+				summary += ": " + win.Name
+			}
+			line("BEGIN:VEVENT")
+			line(fmt.Sprintf("UID:%s-%d-%s@edigateway", icalText(s.PartnerID), i+1, win.Kind))
+			line("DTSTAMP:" + stamp)
+			if s.TimeZone != "" {
+				line("DTSTART;TZID=" + loc.String() + ":" + win.Start.In(loc).Format("20060102T150405"))
+			} else {
+				line("DTSTART:" + win.Start.UTC().Format("20060102T150405Z"))
+			}
+			line(fmt.Sprintf("DURATION:PT%dM", int(dur/time.Minute)))
+			if every > 0 {
+				line("RRULE:" + icalRecurrence(win, every))
+			}
+			line("SUMMARY:" + icalText(summary))
+			line("CATEGORIES:" + strings.ToUpper(win.Kind))
+			if win.Kind == windowMaintenance {
+				line("TRANSP:OPAQUE")
+			} else {
+				line("TRANSP:TRANSPARENT")
+			}
+			line("END:VEVENT")
+		}
+	}
+	line("END:VCALENDAR")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// RRULE for a window repeating every interval
+func icalRecurrence(win ScheduleWindow, every time.Duration) string {
+	var rule string
+	switch {
+	case every%(7*oneDay) == 0 && len(win.Weekdays) == 0:
+		rule = fmt.Sprintf("FREQ=WEEKLY;INTERVAL=%d", every/(7*oneDay))
+	case every%oneDay == 0:
+		rule = fmt.Sprintf("FREQ=DAILY;INTERVAL=%d", every/oneDay)
+	case every%time.Hour == 0:
+		rule = fmt.Sprintf("FREQ=HOURLY;INTERVAL=%d", every/time.Hour)
+	default:
+		rule = fmt.Sprintf("FREQ=MINUTELY;INTERVAL=%d", every/time.Minute)
+	}
+	if len(win.Weekdays) > 0 {
+		rule += ";BYDAY=" + strings.Join(win.Weekdays, ",")
+	}
+	if win.Until != nil {
+		rule += ";UNTIL=" + win.Until.UTC().Format("20060102T150405Z")
+	}
+	return rule
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func icalText(s string) string {
+	return icalEscaper.Replace(s)
+}
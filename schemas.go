@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Schema of one event type, generated from the Go type of its envelope so
+// it describes exactly what is published. Events are JSON on the wire; the
+// Avro schema describes the same JSON for generating bindings.
+type eventSchema struct {
+	EventType  string                 `json:"event_type"`
+	Direction  string                 `json:"direction"` // published, or consumed from KAFKA_OUTBOUND_TOPIC
+	Version    int                    `json:"version"`   // schema_version of the envelope
+	Topics     []string               `json:"topics"`    // class topics of the caller's tenant; partner routes may add others
+	JSONSchema map[string]interface{} `json:"json_schema"`
+	AvroSchema map[string]interface{} `json:"avro_schema"`
+}
+
+// Every event type the gateway publishes or consumes, with its envelope
+var eventTypes = []struct {
+	eventType string
+	direction string
+	envelope  interface{}
+}{
+	{eventTransactionCreated, "published", eventEnvelope{}},
+	{eventTransactionReplayed, "published", eventEnvelope{}},
+	{eventTransactionDelivered, "published", eventEnvelope{}},
+	{eventTransactionFailed, "published", eventEnvelope{}},
+	{eventDeliveryFailed, "published", eventEnvelope{}},
+	{eventOutboundAccepted, "published", outboundResult{}},
+	{eventOutboundRejected, "published", outboundResult{}},
+	{eventOutboundRequested, "consumed", outboundRequest{}},
+}
+
+// Base topics an event type goes to or comes from
+func eventTypeTopics(eventType string) []string {
+	classes := defaultEventTopics
+	if kafkaRouter != nil {
+		classes = kafkaRouter.classes
+	}
+	switch eventType {
+	case eventTransactionCreated, eventTransactionReplayed:
+		return []string{classes[eventClassInbound], classes[eventClassAcks]}
+	case eventTransactionDelivered:
+		return []string{classes[eventClassOutbound]}
+	case eventTransactionFailed, eventDeliveryFailed:
+		return []string{classes[eventClassFailures]}
+	case eventOutboundAccepted, eventOutboundRejected:
+		if outboundTopic != "" {
+			return []string{outboundResultsTopic}
+		}
+	case eventOutboundRequested:
+		if outboundTopic != "" {
+			return []string{outboundTopic}
+		}
+	}
+	return nil
+}
+
+var (
+	eventSchemasOnce sync.Once
+	eventSchemaList  []eventSchema
+)
+
+// Schemas of every event type, generated once
+func eventSchemas() []eventSchema {
+	eventSchemasOnce.Do(func() {
+		for _, e := range eventTypes {
+			eventSchemaList = append(eventSchemaList, eventSchema{
+				EventType:  e.eventType,
+				Direction:  e.direction,
+				Version:    eventSchemaVersion,
+				JSONSchema: eventJSONSchema(e.eventType, reflect.TypeOf(e.envelope)),
+				AvroSchema: avroSet{}.add(reflect.TypeOf(e.envelope), "").(map[string]interface{}),
+			})
+		}
+	})
+	return eventSchemaList
+}
+
+// Standalone JSON Schema (draft-07) of an envelope: the schemas generated
+// for the API description, with nested types under definitions and
+// event_type and schema_version fixed
+func eventJSONSchema(eventType string, t reflect.Type) map[string]interface{} {
+	defs := schemaSet{}
+	defs.add(t)
+	root := defs[schemaName(t)].(map[string]interface{})
+	delete(defs, schemaName(t))
+	props := root["properties"].(map[string]interface{})
+	props["event_type"] = map[string]interface{}{"const": eventType}
+	props["schema_version"] = map[string]interface{}{"const": eventSchemaVersion}
+	schema := map[string]interface{}{
+		"$schema":    "http://json-schema.org/draft-07/schema#",
+		"title":      "edigateway." + eventType + ".v1",
+		"type":       "object",
+		"required":   []string{"schema_version", "event_id", "event_type", "data"},
+		"properties": props,
+	}
+	if len(defs) > 0 {
+		schema["definitions"] = map[string]interface{}(defs)
+	}
+	rewriteRefs(schema)
+	return schema
+}
+
+// Point the API description's component references at definitions
+func rewriteRefs(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" {
+				v[k] = strings.Replace(ref, "#/components/schemas/", "#/definitions/", 1)
+				continue
+			}
+			rewriteRefs(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			rewriteRefs(child)
+		}
+	}
+}
+
+// Avro schemas of Go types as encoding/json marshals them. Records are
+// defined where first used and referred to by name after. Times are RFC
+// 3339 strings; fields that can be absent or null (omitempty, pointers,
+// slices, maps) are unions with null, defaulting to null.
+type avroSet map[string]bool
+
+func (s avroSet) add(t reflect.Type, name string) interface{} {
+	switch {
+	case t == timeType:
+		return "string"
+	case t.Kind() == reflect.Pointer:
+		return s.add(t.Elem(), name)
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "long"
+	case reflect.Float32, reflect.Float64:
+		return "double"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string" // base64
+		}
+		return map[string]interface{}{"type": "array", "items": s.add(t.Elem(), name+"Item")}
+	case reflect.Map:
+		return map[string]interface{}{"type": "map", "values": s.add(t.Elem(), name+"Value")}
+	case reflect.Struct:
+		if t.Name() != "" {
+			name = schemaName(t)
+		}
+		if s[name] {
+			return name
+		}
+		s[name] = true
+		var fields []interface{}
+		s.fields(t, name, &fields)
+		return map[string]interface{}{"type": "record", "name": name, "namespace": "edigateway", "fields": fields}
+	}
+	return "string" // interface{}: any JSON value, as text
+}
+
+func (s avroSet) fields(t reflect.Type, record string, fields *[]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			s.fields(ft, record, fields)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		var typ interface{}
+		if opts == "string" || strings.Contains(opts, ",string") {
+			typ = "string"
+		} else {
+			typ = s.add(f.Type, record+f.Name) // names anonymous structs
+		}
+		field := map[string]interface{}{"name": name, "type": typ}
+		switch f.Type.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+			field["type"], field["default"] = []interface{}{"null", typ}, nil
+		default:
+			if strings.Contains(","+opts, ",omitempty") {
+				field["type"], field["default"] = []interface{}{"null", typ}, nil
+			}
+		}
+		*fields = append(*fields, field)
+	}
+}
+
+// An event type's schemas with its topics for the tenant of ctx
+func withTopics(ctx context.Context, s eventSchema) eventSchema {
+	s.Topics = []string{}
+	for _, topic := range eventTypeTopics(s.EventType) {
+		s.Topics = append(s.Topics, tenantTopic(ctx, topic))
+	}
+	return s
+}
+
+// List the schemas of every event type
+func listSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]eventSchema, 0, len(eventTypes))
+	for _, s := range eventSchemas() {
+		list = append(list, withTopics(r.Context(), s))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// One event type's schemas or, with format json or avro, just that schema
+// as a document code generators can read
+func getSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	eventType := mux.Vars(r)["event_type"]
+	for _, s := range eventSchemas() {
+		if s.EventType != eventType {
+			continue
+		}
+		switch r.URL.Query().Get("format") {
+		case "":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(withTopics(r.Context(), s))
+		case "json":
+			w.Header().Set("Content-Type", "application/schema+json")
+			json.NewEncoder(w).Encode(s.JSONSchema)
+		case "avro":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.AvroSchema)
+		default:
+			writeProblem(w, "format must be json or avro", http.StatusBadRequest)
+		}
+		return
+	}
+	writeProblem(w, "Unknown event type "+eventType, http.StatusNotFound)
+}
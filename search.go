@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Mail server for saved search notifications, host:port; email targets are
+// ignored when unset
+var (
+	smtpAddr     = getEnv("SMTP_ADDR", "")
+	smtpFrom     = getEnv("SMTP_FROM", "edi-gateway@localhost")
+	smtpUsername = getEnv("SMTP_USERNAME", "")
+	smtpPassword = getEnv("SMTP_PASSWORD", "")
+)
+
+// Matching transactions returned by a search run, newest first
+const searchResultLimit = 100
+
+// Whether ship-to names and item descriptions are indexed for text search
+// even though they are encrypted at rest. Off by default with
+// FIELD_ENCRYPTION_KEYS set, as the index would hold them in clear.
+var searchSensitive = getEnvBool("SEARCH_INDEX_SENSITIVE", false)
+
+// Words text search finds a transaction by: its header references, BOL,
+// carrier, SKUs, PO numbers and cartons, plus the ship-to and item
+// descriptions unless those are encrypted at rest. Lower case, each once.
+func searchText(t Transaction) string {
+	fields := []string{t.refs.PONumber, t.refs.Number, t.BOL, t.Carrier}
+	sensitive := fieldKeys == nil || searchSensitive
+	if sensitive {
+		fields = append(fields, t.ShipTo)
+	}
+	items, _ := t.Items()
+	for _, it := range items {
+		fields = append(fields, it.SKU, it.PONumber, it.Carton)
+		if sensitive {
+			fields = append(fields, it.Description)
+		}
+	}
+	seen := map[string]bool{}
+	var words []string
+	for _, f := range fields {
+		for _, w := range strings.Fields(strings.ToLower(f)) {
+			if !seen[w] {
+				seen[w] = true
+				words = append(words, w)
+			}
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// Transaction search criteria. Ages are Go durations measured from the time
+// the search runs.
+type transactionFilter struct {
+	PartnerID     string `json:"partner_id,omitempty"`
+	Type          string `json:"type,omitempty"` // e.g. 856
+	Status        string `json:"status,omitempty"`
+	Format        string `json:"format,omitempty"`
+	ControlNumber string `json:"control_number,omitempty"` // ST02 or ISA13
+	Query         string `json:"q,omitempty"`              // words in references, SKUs and PO numbers, see searchText
+	OlderThan     string `json:"older_than,omitempty"`     // e.g. 4h: processed before then
+	NewerThan     string `json:"newer_than,omitempty"`     // e.g. 24h: processed since then
+	Unacked       bool   `json:"unacked,omitempty"`        // sent in an interchange still waiting for its 997 or 999
+}
+
+func (f transactionFilter) validate() error {
+	for name, v := range map[string]string{"older_than": f.OlderThan, "newer_than": f.NewerThan} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return errors.New(name + " must be a positive duration such as 4h")
+		}
+	}
+	return nil
+}
+
+// Add the filter's conditions to a query on transactions
+func (f transactionFilter) apply(q *gorm.DB, now time.Time) *gorm.DB {
+	for column, v := range map[string]string{"partner_id": f.PartnerID, "type": f.Type, "status": f.Status, "format": f.Format} {
+		if v != "" {
+			q = q.Where("transactions."+column+" = ?", v)
+		}
+	}
+	if f.ControlNumber != "" {
+		q = q.Where("(transactions.control_number = ? OR transactions.interchange_control = ?)", f.ControlNumber, f.ControlNumber)
+	}
+	if words := strings.Fields(strings.ToLower(f.Query)); len(words) > 0 {
+		if db.Dialector.Name() == "postgres" {
+			// search_vector is generated from search_text and GIN indexed
+			q = q.Where("transactions.search_vector @@ plainto_tsquery('simple', ?)", strings.Join(words, " "))
+		} else {
+			for _, w := range words {
+				q = q.Where("transactions.search_text LIKE ?", "%"+w+"%")
+			}
+		}
+	}
+	if d, err := time.ParseDuration(f.OlderThan); err == nil && f.OlderThan != "" {
+		q = q.Where("transactions.date < ?", now.Add(-d))
+	}
+	if d, err := time.ParseDuration(f.NewerThan); err == nil && f.NewerThan != "" {
+		q = q.Where("transactions.date >= ?", now.Add(-d))
+	}
+	if f.Unacked {
+		// Through the index of the transactions each interchange carried
+		q = q.Where(`EXISTS (SELECT 1 FROM outbound_ack_transactions JOIN outbound_acks ON outbound_acks.id = outbound_ack_transactions.ack_id
+			WHERE outbound_ack_transactions.transaction_id = transactions.id AND outbound_acks.status IN ?)`,
+			[]string{ackPending, ackOverdue})
+	}
+	return q
+}
+
+// A transaction search saved by an operator. Searches with every_minutes set
+// run on that schedule and report their matches to the notify targets,
+// turning the search into a lightweight monitor.
+type SavedSearch struct {
+	ID            string            `json:"id" gorm:"primaryKey"`
+	TenantID      string            `json:"tenant_id" gorm:"index"`
+	Name          string            `json:"name"`
+	Filter        transactionFilter `json:"filter" gorm:"embedded;embeddedPrefix:filter_"`
+	EveryMinutes  int               `json:"every_minutes,omitempty"`  // 0 only runs on request
+	NotifyWebhook string            `json:"notify_webhook,omitempty"` // POSTed a search_matched event
+	NotifySlack   string            `json:"notify_slack,omitempty"`   // Slack incoming webhook URL
+	NotifyEmail   string            `json:"notify_email,omitempty"`   // comma separated addresses; needs SMTP_ADDR
+	Disabled      bool              `json:"disabled"`
+	LastRunAt     *time.Time        `json:"last_run_at,omitempty"`
+	LastCount     int64             `json:"last_count"`
+	LastError     string            `json:"last_error,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+func (s *SavedSearch) validate() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return errors.New("name is required")
+	}
+	if s.EveryMinutes < 0 {
+		return errors.New("every_minutes must not be negative")
+	}
+	for name, v := range map[string]string{"notify_webhook": s.NotifyWebhook, "notify_slack": s.NotifySlack} {
+		if v != "" && !strings.HasPrefix(v, "https://") && !strings.HasPrefix(v, "http://") {
+			return errors.New(name + " must be an http(s) URL")
+		}
+	}
+	for _, addr := range splitList(s.NotifyEmail) {
+		if !strings.Contains(addr, "@") {
+			return errors.New("notify_email must be email addresses")
+		}
+	}
+	return s.Filter.validate()
+}
+
+// The outcome of running a saved search
+type searchRun struct {
+	SearchID     string        `json:"search_id"`
+	RanAt        time.Time     `json:"ran_at"`
+	Count        int64         `json:"count"`
+	Transactions []Transaction `json:"transactions"` // the newest matches, at most 100
+	Notified     []string      `json:"notified,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+func runSearch(ctx context.Context, s *SavedSearch, now time.Time) (searchRun, error) {
+	run := searchRun{SearchID: s.ID, RanAt: now, Transactions: []Transaction{}}
+	q := s.Filter.apply(db.WithContext(ctx).Model(&Transaction{}), now)
+	if err := q.Count(&run.Count).Error; err != nil {
+		return run, err
+	}
+	if run.Count > 0 {
+		if err := q.Order("transactions.date DESC").Limit(searchResultLimit).Find(&run.Transactions).Error; err != nil {
+			return run, err
+		}
+		if err := readItems(ctx, run.Transactions); err != nil {
+			return run, err
+		}
+	}
+	return run, nil
+}
+
+// Run a search and, when it matched anything, send the results to its
+// notify targets
+func runAndNotify(ctx context.Context, s *SavedSearch, now time.Time) searchRun {
+	run, err := runSearch(ctx, s, now)
+	if err != nil {
+		log.Printf("ERROR: search %s: %v\n", s.ID, err)
+		run.Error = err.Error()
+	} else if run.Count > 0 {
+		run.Notified = notifySearch(*s, run)
+	}
+	s.LastCount, s.LastError = run.Count, run.Error
+	if err := db.WithContext(ctx).Model(s).UpdateColumns(map[string]interface{}{"last_count": run.Count, "last_error": run.Error}).Error; err != nil {
+		log.Printf("ERROR: search %s: %v\n", s.ID, err)
+	}
+	return run
+}
+
+// Send a run to the search's targets in the background, returning the
+// kinds notified
+func notifySearch(s SavedSearch, run searchRun) []string {
+	var notified []string
+	summary := fmt.Sprintf("Saved search %q matched %d transactions", s.Name, run.Count)
+	ids := make([]string, len(run.Transactions))
+	for i, t := range run.Transactions {
+		ids[i] = t.ID
+	}
+	if s.NotifyWebhook != "" {
+		body, _ := json.Marshal(struct {
+			Event          string            `json:"event"`
+			SearchID       string            `json:"search_id"`
+			Name           string            `json:"name"`
+			Filter         transactionFilter `json:"filter"`
+			Count          int64             `json:"count"`
+			TransactionIDs []string          `json:"transaction_ids"`
+			RanAt          time.Time         `json:"ran_at"`
+		}{"search_matched", s.ID, s.Name, s.Filter, run.Count, ids, run.RanAt})
+		go postNotification(s.NotifyWebhook, body, "search "+s.ID+" webhook")
+		notified = append(notified, "webhook")
+	}
+	if s.NotifySlack != "" {
+		text := summary
+		if len(ids) > 0 {
+			shown := ids
+			if len(shown) > 10 {
+				shown = shown[:10]
+			}
+			text += ":\n• " + strings.Join(shown, "\n• ")
+			if len(ids) > len(shown) || run.Count > int64(len(ids)) {
+				text += "\n…"
+			}
+		}
+		body, _ := json.Marshal(map[string]string{"text": text})
+		go postNotification(s.NotifySlack, body, "search "+s.ID+" Slack")
+		notified = append(notified, "slack")
+	}
+	if to := splitList(s.NotifyEmail); len(to) > 0 {
+		if smtpAddr == "" {
+			log.Printf("Search %s: SMTP_ADDR is not set, not emailing %s", s.ID, s.NotifyEmail)
+		} else {
+			go sendSearchEmail(to, summary, ids, run.Count)
+			notified = append(notified, "email")
+		}
+	}
+	return notified
+}
+
+// POST a JSON notification, retrying a few times like job callbacks
+func postNotification(url string, body []byte, what string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for attempt, delay := 1, time.Second; attempt <= 3; attempt, delay = attempt+1, delay*2 {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		log.Printf("Notification for %s attempt %d failed: %v", what, attempt, err)
+		time.Sleep(delay)
+	}
+}
+
+func sendSearchEmail(to []string, summary string, ids []string, count int64) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s.\r\n\r\n", summary)
+	for _, id := range ids {
+		fmt.Fprintf(&body, "%s\r\n", id)
+	}
+	if count > int64(len(ids)) {
+		fmt.Fprintf(&body, "... and %d more\r\n", count-int64(len(ids)))
+	}
+	sendEmail(to, summary, body.String())
+}
+
+// Send a plain text email through SMTP_ADDR
+func sendEmail(to []string, subject, body string) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n", smtpFrom, strings.Join(to, ", "), subject)
+	msg.WriteString(body)
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		host := smtpAddr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+	}
+	if err := smtp.SendMail(smtpAddr, auth, smtpFrom, to, msg.Bytes()); err != nil {
+		log.Printf("ERROR: email to %s: %v\n", strings.Join(to, ", "), err)
+	}
+}
+
+// Periodically run the scheduled searches that are due
+func runSavedSearches(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := runDueSearches(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: saved searches: %v\n", err)
+		}
+	}
+}
+
+func runDueSearches(ctx context.Context, now time.Time) error {
+	var searches []SavedSearch
+	if err := db.WithContext(withTenant(ctx, allTenants)).Where("every_minutes > 0 AND disabled = ?", false).Find(&searches).Error; err != nil {
+		return err
+	}
+	for i := range searches {
+		s := &searches[i]
+		if s.LastRunAt != nil && now.Sub(*s.LastRunAt) < time.Duration(s.EveryMinutes)*time.Minute {
+			continue
+		}
+		sctx := withAuditor(withTenant(ctx, s.TenantID), systemAuditor("system", "search"))
+		if claimSearchRun(sctx, s, now) {
+			runAndNotify(sctx, s, now)
+		}
+	}
+	return nil
+}
+
+// Move last_run_at from the value read, failing when another instance
+// already did
+func claimSearchRun(ctx context.Context, s *SavedSearch, now time.Time) bool {
+	q := db.WithContext(ctx).Model(&SavedSearch{}).Where("id = ?", s.ID)
+	if s.LastRunAt == nil {
+		q = q.Where("last_run_at IS NULL")
+	} else {
+		q = q.Where("last_run_at = ?", *s.LastRunAt)
+	}
+	res := q.UpdateColumn("last_run_at", now)
+	if res.Error != nil {
+		log.Printf("ERROR: search %s: %v\n", s.ID, res.Error)
+		return false
+	}
+	s.LastRunAt = &now
+	return res.RowsAffected == 1
+}
+
+// Look up the saved search of a request, writing the problem when it fails
+func requestSearch(w http.ResponseWriter, r *http.Request) *SavedSearch {
+	var s SavedSearch
+	err := db.WithContext(r.Context()).First(&s, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Saved search not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch saved search", http.StatusInternalServerError)
+		return nil
+	}
+	return &s
+}
+
+// List saved searches
+func listSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	searches := []SavedSearch{}
+	if err := db.WithContext(r.Context()).Order("created_at").Find(&searches).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch saved searches", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searches)
+}
+
+// Save a search
+func createSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var s SavedSearch
+	if err := decodeJSON(w, r, &s); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.ID, s.LastRunAt, s.LastCount, s.LastError = uuid.New().String(), nil, 0, ""
+	if err := db.WithContext(r.Context()).Create(&s).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save search", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "saved_search", s.ID, nil, s)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// Fetch one saved search
+func getSearchHandler(w http.ResponseWriter, r *http.Request) {
+	s := requestSearch(w, r)
+	if s == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// Replace a saved search
+func updateSearchHandler(w http.ResponseWriter, r *http.Request) {
+	existing := requestSearch(w, r)
+	if existing == nil {
+		return
+	}
+	var s SavedSearch
+	if err := decodeJSON(w, r, &s); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.validate(); err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.ID, s.TenantID, s.CreatedAt = existing.ID, existing.TenantID, existing.CreatedAt
+	s.LastRunAt, s.LastCount, s.LastError = existing.LastRunAt, existing.LastCount, existing.LastError
+	if err := db.WithContext(r.Context()).Omit("CreatedAt").Save(&s).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save search", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditUpdate, "saved_search", s.ID, existing, s)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// Run a saved search without notifying anyone. limit caps the transactions
+// returned, at most 100.
+func searchResultsHandler(w http.ResponseWriter, r *http.Request) {
+	s := requestSearch(w, r)
+	if s == nil {
+		return
+	}
+	limit := searchResultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeProblem(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	run, err := runSearch(r.Context(), s, time.Now())
+	if err != nil {
+		log.Printf("ERROR: search %s: %v\n", s.ID, err)
+		writeProblem(w, "Failed to run saved search", http.StatusInternalServerError)
+		return
+	}
+	if limit < len(run.Transactions) {
+		run.Transactions = run.Transactions[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// Run a saved search now and notify its targets of any matches, as its
+// schedule would
+func runSearchHandler(w http.ResponseWriter, r *http.Request) {
+	s := requestSearch(w, r)
+	if s == nil {
+		return
+	}
+	ctx := detachedContext(r)
+	now := time.Now()
+	if !claimSearchRun(ctx, s, now) {
+		writeProblem(w, "Saved search is running", http.StatusConflict)
+		return
+	}
+	run := runAndNotify(ctx, s, now)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// Read a transaction filter from query parameters named like its JSON
+func filterFromQuery(q url.Values) (transactionFilter, error) {
+	f := transactionFilter{
+		PartnerID:     q.Get("partner_id"),
+		Type:          q.Get("type"),
+		Status:        q.Get("status"),
+		Format:        q.Get("format"),
+		ControlNumber: q.Get("control_number"),
+		Query:         q.Get("q"),
+		OlderThan:     q.Get("older_than"),
+		NewerThan:     q.Get("newer_than"),
+	}
+	if v := q.Get("unacked"); v != "" {
+		unacked, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, errors.New("unacked must be true or false")
+		}
+		f.Unacked = unacked
+	}
+	return f, f.validate()
+}
+
+// Search transactions, newest first. Filters: partner_id, type, status,
+// format, control_number, q (text), unacked, older_than, newer_than, from
+// and to (RFC 3339), before (the date of the last transaction of the
+// previous page) and limit.
+func searchTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := filterFromQuery(q)
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	query := f.apply(db.WithContext(r.Context()).Model(&Transaction{}), now)
+	for param, op := range map[string]string{"from": ">=", "to": "<", "before": "<"} {
+		if v := q.Get(param); v != "" {
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				writeProblem(w, param+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			query = query.Where("transactions.date "+op+" ?", ts)
+		}
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeProblem(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxViewPage {
+		limit = maxViewPage
+	}
+	transactions := []Transaction{}
+	if err := query.Order("transactions.date DESC").Limit(limit).Find(&transactions).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to search transactions", http.StatusInternalServerError)
+		return
+	}
+	if err := readItems(r.Context(), transactions); err != nil {
+		writeProblem(w, "Failed to fetch line items", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
+
+// Fill search_text for transactions saved before text search, or all of
+// them with rebuild (after changing SEARCH_INDEX_SENSITIVE or the keys)
+func indexTransactions(ctx context.Context, batch int, rebuild bool) (int, error) {
+	scoped := db.WithContext(withTenant(ctx, allTenants))
+	indexed, after := 0, ""
+	for {
+		var txs []Transaction
+		q := scoped.Where("id > ?", after).Order("id").Limit(batch)
+		if !rebuild {
+			q = q.Where("(search_text IS NULL OR search_text = '')")
+		}
+		if err := q.Find(&txs).Error; err != nil {
+			return indexed, err
+		}
+		if len(txs) == 0 {
+			return indexed, nil
+		}
+		if err := readItems(ctx, txs); err != nil {
+			return indexed, err
+		}
+		refs, err := storedRefs(scoped, txs)
+		if err != nil {
+			return indexed, err
+		}
+		for _, t := range txs {
+			t.refs = refs[t.ID]
+			if err := scoped.Model(&Transaction{}).Where("id = ?", t.ID).UpdateColumn("search_text", searchText(t)).Error; err != nil {
+				return indexed, fmt.Errorf("transaction %s: %w", t.ID, err)
+			}
+			indexed++
+		}
+		after = txs[len(txs)-1].ID
+	}
+}
+
+// Header references of saved transactions, recovered from the order,
+// shipment and invoice views
+func storedRefs(q *gorm.DB, txs []Transaction) (map[string]documentRefs, error) {
+	ids := make([]string, len(txs))
+	for i, t := range txs {
+		ids[i] = t.ID
+	}
+	refs := map[string]documentRefs{}
+	var orders []Order
+	if err := q.Select("order_transaction_id, po_number").Where("order_transaction_id IN ?", ids).Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	for _, o := range orders {
+		refs[o.OrderTransactionID] = documentRefs{PONumber: o.PONumber}
+	}
+	var shipments []Shipment
+	if err := q.Select("transaction_id, shipment_number").Where("transaction_id IN ?", ids).Find(&shipments).Error; err != nil {
+		return nil, err
+	}
+	for _, sh := range shipments {
+		refs[sh.TransactionID] = documentRefs{Number: sh.ShipmentNumber}
+	}
+	var invoices []Invoice
+	if err := q.Select("transaction_id, invoice_number, po_number").Where("transaction_id IN ?", ids).Find(&invoices).Error; err != nil {
+		return nil, err
+	}
+	for _, inv := range invoices {
+		refs[inv.TransactionID] = documentRefs{PONumber: inv.PONumber, Number: inv.InvoiceNumber}
+	}
+	return refs, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// unacked finds transactions by the index of tracked interchanges, not by
+// what transaction_ids happen to contain
+func TestSearchUnacked(t *testing.T) {
+	startBulkGateway(t)
+	ctx := withTenant(context.Background(), defaultTenant)
+	txs := bulkTransactions("sent", 4)
+	for i, err := range processTransactions(ctx, txs) {
+		if err != nil {
+			t.Fatalf("save %d: %v", i, err)
+		}
+	}
+	for i, a := range []OutboundAck{
+		{PartnerID: "acme", ControlNumber: 1, Status: ackPending, TransactionIDs: `["sent-0"]`},
+		{PartnerID: "acme", ControlNumber: 2, Status: ackOverdue, TransactionIDs: `["sent-1"]`},
+		{PartnerID: "acme", ControlNumber: 3, Status: ackAccepted, TransactionIDs: `["sent-2"]`},
+	} {
+		a.SentAt, a.DueAt = time.Now(), time.Now().Add(time.Hour)
+		if err := db.WithContext(ctx).Create(&a).Error; err != nil {
+			t.Fatalf("ack %d: %v", i, err)
+		}
+		if err := linkAckTransactions(db.WithContext(ctx), a); err != nil {
+			t.Fatalf("ack %d: %v", i, err)
+		}
+	}
+	var ids []string
+	q := transactionFilter{Unacked: true}.apply(db.WithContext(ctx).Model(&Transaction{}), time.Now())
+	if err := q.Order("transactions.id").Pluck("transactions.id", &ids).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sent-0", "sent-1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("unacked %v, want %v", ids, want)
+	}
+}
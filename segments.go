@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Archived X12 of a transaction as support reads it: its set's segments
+// with element names and code meanings from the dictionary, HL loops
+// nested under their parents, and the canonical fields each element set
+
+// One element of a segment; empty elements are left out
+type elementNode struct {
+	Ref        string   `json:"ref"` // e.g. BEG03
+	Name       string   `json:"name,omitempty"`
+	Value      string   `json:"value"`
+	Meaning    string   `json:"meaning,omitempty"`    // of a code
+	Components []string `json:"components,omitempty"` // of a composite element
+	Fields     []string `json:"fields,omitempty"`     // canonical fields read from it
+}
+
+// One segment, with the segments of its HL loop as children
+type segmentNode struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name,omitempty"`
+	Position int            `json:"position,omitempty"` // in its set, ST being 1
+	Elements []elementNode  `json:"elements"`
+	Children []*segmentNode `json:"children,omitempty"`
+}
+
+type segmentDelimiters struct {
+	Element    string `json:"element"`
+	Component  string `json:"component"`
+	Repetition string `json:"repetition,omitempty"`
+	Segment    string `json:"segment"`
+}
+
+// Segment tree of a transaction's set within its envelopes
+type segmentTree struct {
+	TransactionID string            `json:"transaction_id"`
+	Type          string            `json:"type"`
+	Name          string            `json:"name,omitempty"`
+	ControlNumber string            `json:"control_number"`
+	Delimiters    segmentDelimiters `json:"delimiters"`
+	ISA           *segmentNode      `json:"isa"`
+	GS            *segmentNode      `json:"gs"`
+	Segments      []*segmentNode    `json:"segments"` // ST to SE
+	GE            *segmentNode      `json:"ge,omitempty"`
+	IEA           *segmentNode      `json:"iea,omitempty"`
+	Error         string            `json:"error,omitempty"` // of the set, when it failed to parse
+}
+
+// Set of a payload that carried t: the one with its control numbers, or the
+// only one
+func payloadSet(t Transaction, data []byte) (X12Interchange, X12Group, X12Set, error) {
+	interchanges, err := parseX12(data)
+	if err != nil {
+		return X12Interchange{}, X12Group{}, X12Set{}, &httpError{Status: http.StatusUnprocessableEntity, Message: err.Error()}
+	}
+	var onlyIC X12Interchange
+	var onlyGroup X12Group
+	var onlySet X12Set
+	sets := 0
+	for _, ic := range interchanges {
+		for _, g := range ic.Groups {
+			for _, set := range g.Sets {
+				sets++
+				onlyIC, onlyGroup, onlySet = ic, g, set
+				if (t.InterchangeControl == "" || strings.TrimSpace(ic.ControlNumber()) == strings.TrimSpace(t.InterchangeControl)) &&
+					strings.TrimSpace(set.ControlNumber()) == strings.TrimSpace(t.ControlNumber) {
+					return ic, g, set, nil
+				}
+			}
+		}
+	}
+	if sets == 1 {
+		return onlyIC, onlyGroup, onlySet, nil
+	}
+	return X12Interchange{}, X12Group{}, X12Set{}, &httpError{Status: http.StatusUnprocessableEntity,
+		Message: fmt.Sprintf("Set %s is not in the transaction's payload", t.ControlNumber)}
+}
+
+// Segment tree of a transaction's archived X12 in direction
+func transactionSegments(ctx context.Context, id, direction string) (segmentTree, error) {
+	var t Transaction
+	err := db.WithContext(ctx).First(&t, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return segmentTree{}, &httpError{Status: http.StatusNotFound, Message: "Transaction not found"}
+	} else if err != nil {
+		return segmentTree{}, err
+	}
+	meta, data, err := archivedPayload(ctx, t.ID, direction)
+	if err != nil {
+		return segmentTree{}, err
+	}
+	if detectFormat(meta.ContentType, data) != formatX12 {
+		return segmentTree{}, &httpError{Status: http.StatusUnprocessableEntity, Message: "Raw payload is not X12"}
+	}
+	ic, g, set, err := payloadSet(t, data)
+	if err != nil {
+		return segmentTree{}, err
+	}
+	d := ic.Delimiters
+	tree := segmentTree{
+		TransactionID: t.ID,
+		Type:          set.Type(),
+		Name:          x12SetNames[set.Type()],
+		ControlNumber: set.ControlNumber(),
+		Delimiters:    segmentDelimiters{Element: string(d.Element), Component: string(d.Component), Segment: string(d.Segment)},
+		ISA:           newSegmentNode(ic.ISA, 0, d, nil),
+		GS:            newSegmentNode(g.GS, 0, d, nil),
+		Segments:      []*segmentNode{},
+	}
+	if d.Repetition != 0 {
+		tree.Delimiters.Repetition = string(d.Repetition)
+	}
+	if len(g.GE) > 0 {
+		tree.GE = newSegmentNode(g.GE, 0, d, nil)
+	}
+	if len(ic.IEA) > 0 {
+		tree.IEA = newSegmentNode(ic.IEA, 0, d, nil)
+	}
+	fields := map[int]map[int][]string{}
+	if set.Err != nil {
+		tree.Error = set.Err.Error()
+	} else if translated, err := translateX12Set(withSandbox(withMappingDebug(ctx)), ic, set); err == nil {
+		fields = annotatedElements(translated.annotations)
+	}
+	hls := map[string]*segmentNode{}
+	var loop *segmentNode // HL whose loop is open
+	for i, seg := range set.Segments {
+		node := newSegmentNode(seg, i+1, d, fields[i+1])
+		switch {
+		case seg[0] == "HL":
+			if parent := hls[seg.el(2)]; parent != nil {
+				parent.Children = append(parent.Children, node)
+			} else {
+				tree.Segments = append(tree.Segments, node)
+			}
+			hls[seg.el(1)], loop = node, node
+		case loop != nil && seg[0] != "CTT" && seg[0] != "SE":
+			loop.Children = append(loop.Children, node)
+		default:
+			loop = nil
+			tree.Segments = append(tree.Segments, node)
+		}
+	}
+	return tree, nil
+}
+
+// Canonical fields by segment position and element index, from annotations
+// such as N1*ST.02
+func annotatedElements(annotations []fieldAnnotation) map[int]map[int][]string {
+	out := map[int]map[int][]string{}
+	for _, a := range annotations {
+		dot := strings.LastIndexByte(a.Segment, '.')
+		if a.Position == 0 || dot < 0 {
+			continue
+		}
+		i, err := strconv.Atoi(a.Segment[dot+1:])
+		if err != nil {
+			continue
+		}
+		if out[a.Position] == nil {
+			out[a.Position] = map[int][]string{}
+		}
+		out[a.Position][i] = append(out[a.Position][i], a.Field)
+	}
+	return out
+}
+
+func newSegmentNode(seg Segment, position int, d X12Delimiters, fields map[int][]string) *segmentNode {
+	id := seg[0]
+	node := &segmentNode{ID: id, Name: x12Names[id], Position: position, Elements: []elementNode{}}
+	for i := 1; i < len(seg); i++ {
+		value := seg[i]
+		if id == "ISA" {
+			value = strings.TrimSpace(value) // fixed width
+		}
+		if value == "" {
+			continue
+		}
+		ref := elementRef(id, i)
+		e := elementNode{Ref: ref, Name: x12Names[ref], Value: value, Meaning: x12Codes[ref][value], Fields: fields[i]}
+		if id != "ISA" && d.Component != 0 && strings.IndexByte(value, d.Component) >= 0 {
+			e.Components = strings.Split(value, string(d.Component))
+		}
+		node.Elements = append(node.Elements, e)
+	}
+	return node
+}
+
+// Human-readable rendering of a segment tree: a line per segment and an
+// indented line per element, with code meanings in parentheses and the
+// canonical fields an element set after an arrow
+func renderSegments(tree segmentTree) string {
+	var b strings.Builder
+	title := tree.Type
+	if tree.Name != "" {
+		title += " " + tree.Name
+	}
+	fmt.Fprintf(&b, "Transaction %s: %s, control number %s\n", tree.TransactionID, title, tree.ControlNumber)
+	if tree.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", tree.Error)
+	}
+	b.WriteString("\n")
+	var write func(n *segmentNode, depth int)
+	write = func(n *segmentNode, depth int) {
+		if n == nil {
+			return
+		}
+		indent := strings.Repeat("  ", depth)
+		position := "    "
+		if n.Position > 0 {
+			position = fmt.Sprintf("%04d", n.Position)
+		}
+		fmt.Fprintf(&b, "%s %s%-3s %s\n", position, indent, n.ID, n.Name)
+		for _, e := range n.Elements {
+			line := fmt.Sprintf("     %s    %-5s %s: %s", indent, e.Ref, e.Name, e.Value)
+			if e.Name == "" {
+				line = fmt.Sprintf("     %s    %-5s %s", indent, e.Ref, e.Value)
+			}
+			if e.Meaning != "" {
+				line += " (" + e.Meaning + ")"
+			}
+			if len(e.Fields) > 0 {
+				line += " → " + strings.Join(e.Fields, ", ")
+			}
+			b.WriteString(line + "\n")
+		}
+		for _, child := range n.Children {
+			write(child, depth+1)
+		}
+	}
+	write(tree.ISA, 0)
+	write(tree.GS, 0)
+	for _, n := range tree.Segments {
+		write(n, 0)
+	}
+	write(tree.GE, 0)
+	write(tree.IEA, 0)
+	return b.String()
+}
+
+// Parsed segment tree of a transaction's archived X12; direction picks the
+// inbound or outbound payload like /raw
+func transactionSegmentsHandler(w http.ResponseWriter, r *http.Request) {
+	tree, err := transactionSegments(r.Context(), mux.Vars(r)["id"], r.URL.Query().Get("direction"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree)
+}
+
+// Annotated plain-text rendering of a transaction's archived X12
+func transactionPrettyHandler(w http.ResponseWriter, r *http.Request) {
+	tree, err := transactionSegments(r.Context(), mux.Vars(r)["id"], r.URL.Query().Get("direction"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(renderSegments(tree)))
+}
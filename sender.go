@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// What happens to a document whose sender is not the partner authenticated
+// by its channel; partners override it with sender_check. Actions are those
+// of the guardrails, plus off.
+var senderCheckDflt = getEnv("INBOUND_SENDER_CHECK", guardrailReject)
+
+const senderCheckOff = "off"
+
+func validSenderCheck(action string) bool {
+	return action == senderCheckOff || validGuardrailAction(action)
+}
+
+var senderMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_sender_mismatches_total",
+	Help: "Documents whose sender did not match the partner authenticated by their channel.",
+}, []string{"partner", "channel", "action"})
+
+// Channels that authenticate a partner
+const (
+	channelAPIKey    = "api_key"
+	channelAS2       = "as2"
+	channelConnector = "connector" // FTP(S) or directory connector of the partner
+)
+
+// Partner a request was authenticated as, and how. Unlike the partner hint,
+// which X-Partner-ID or an unsigned AS2-From can set to anything, this is
+// what documents are checked against.
+type channelIdentity struct {
+	Kind    string `json:"kind"`
+	Partner string `json:"partner"`
+}
+
+type channelKey struct{}
+
+func withChannel(ctx context.Context, ch channelIdentity) context.Context {
+	if ch.Partner == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, channelKey{}, ch)
+}
+
+func channelFrom(ctx context.Context) channelIdentity {
+	ch, _ := ctx.Value(channelKey{}).(channelIdentity)
+	return ch
+}
+
+// Partner authenticated by the request: the owner of its X-API-Key, or for
+// inbound documents the partner whose as2_id is the AS2-From header when the
+// message is signed with one of the partner's certificates. A verified AS2
+// message's body becomes the payload it signed. Unsigned AS2 messages only
+// hint at their partner, returned as hint, like X-Partner-ID. When an API
+// key and an AS2-From are both present they must agree.
+func requestChannel(w http.ResponseWriter, r *http.Request) (ch channelIdentity, hint string, err error) {
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		if partner := limiter.limitFor(apiKey, time.Now()).partner; partner != "" {
+			ch = channelIdentity{Kind: channelAPIKey, Partner: partner}
+		}
+	}
+	from := r.Header.Get("AS2-From")
+	if from == "" || !strings.HasPrefix(r.URL.Path, "/inbound") {
+		return ch, "", nil
+	}
+	var p Partner
+	if err := db.WithContext(r.Context()).Where("as2_id = ?", from).Limit(1).Find(&p).Error; err != nil {
+		log.Printf("ERROR: partner lookup for AS2-From %q: %v\n", from, err)
+		return ch, "", &httpError{Status: http.StatusInternalServerError, Message: "Failed to look up AS2-From"}
+	}
+	switch {
+	case p.ID == "":
+		return ch, "", &httpError{Status: http.StatusForbidden, Code: codePartnerUnknown, Message: "Unknown AS2-From " + from}
+	case ch.Partner != "" && ch.Partner != p.ID:
+		return ch, "", &httpError{Status: http.StatusForbidden, Code: codeSenderMismatch,
+			Message: fmt.Sprintf("AS2-From %s is partner %s, not %s of the API key", from, p.ID, ch.Partner)}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "multipart/signed" {
+		return ch, p.ID, nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, inboundMaxBuffered))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return ch, "", tooLargeError(tooLarge.Limit)
+	} else if err != nil {
+		return ch, "", &httpError{Status: http.StatusBadRequest, Message: "Failed to read request body"}
+	}
+	contentType, payload, err := openSignedAS2(r.Context(), p, r.Header.Get("Content-Type"), body)
+	if err != nil {
+		return ch, "", signatureError(p.ID, "as2", "AS2 message from "+from+": "+err.Error())
+	}
+	r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(payload)), int64(len(payload))
+	r.Header.Set("Content-Type", contentType)
+	return channelIdentity{Kind: channelAS2, Partner: p.ID}, "", nil
+}
+
+// Whether a partner lets its channel submit documents sent by another, e.g.
+// a VAN relaying for its customers
+func (p Partner) allowsSender(id string) bool {
+	for _, allowed := range splitList(p.AllowedSenders) {
+		if allowed == id || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the sender a document names (its envelope's sender ID, or partner_id
+// of canonical formats) against the partner the channel authenticated.
+// Rejected documents return an *httpError; queued ones are marked Held.
+func checkSender(ctx context.Context, t *Transaction) error {
+	ch := channelFrom(ctx)
+	if ch.Partner == "" || (t.sender == "" && t.PartnerID == "") || t.PartnerID == ch.Partner {
+		return nil
+	}
+	p, err := loadPartner(ctx, ch.Partner)
+	if err != nil {
+		p = Partner{ID: ch.Partner}
+	}
+	if t.PartnerID != "" && p.allowsSender(t.PartnerID) {
+		return nil
+	}
+	action := p.SenderCheck
+	if action == "" {
+		action = senderCheckDflt
+	}
+	if action == senderCheckOff {
+		return nil
+	}
+
+	claimed := "partner " + t.PartnerID
+	if t.sender != "" {
+		claimed = "sender ID " + t.sender
+		if t.PartnerID != "" {
+			claimed += " (partner " + t.PartnerID + ")"
+		}
+	}
+	msg := fmt.Sprintf("Document %s does not match partner %s authenticated by %s", claimed, ch.Partner, strings.ReplaceAll(ch.Kind, "_", " "))
+	senderMismatches.WithLabelValues(ch.Partner, ch.Kind, action).Inc()
+	log.Printf("ALERT: %s (action %s)", msg, action)
+	switch action {
+	case guardrailQueue:
+		t.Status, t.HoldReason = statusHeld, msg
+	case guardrailAlert:
+	default:
+		return &httpError{Status: http.StatusForbidden, Code: codeSenderMismatch, Message: msg}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How far a signed request's timestamp may be from our clock, either way
+var signatureClockSkew = getEnvDuration("SIGNATURE_CLOCK_SKEW", 5*time.Minute)
+
+var signatureFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_signature_failures_total",
+	Help: "Signed submissions rejected, by reason.",
+}, []string{"partner", "reason"})
+
+// A nonce seen in a signed request, kept until its timestamp leaves the
+// clock skew window and a replay would be rejected as stale anyway
+type RequestNonce struct {
+	PartnerID string    `gorm:"primaryKey"`
+	Nonce     string    `gorm:"primaryKey"`
+	TenantID  string    `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// Bytes covered by a request signature: method, request URI, timestamp and
+// nonce, one per line, then the body
+func signedContent(r *http.Request, timestamp, nonce string, body []byte) []byte {
+	var b bytes.Buffer
+	for _, s := range []string{r.Method, r.URL.RequestURI(), timestamp, nonce} {
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	b.Write(body)
+	return b.Bytes()
+}
+
+// Outcome of checking a submission's signature, recorded on each
+// transaction it carries so the partner cannot later disown it
+type requestSignature struct {
+	Status     string    `json:"status"`               // signatureVerified or signatureUnsigned
+	Partner    string    `json:"partner_id,omitempty"` // whose key verified it
+	Signature  string    `json:"signature,omitempty"`
+	Nonce      string    `json:"nonce,omitempty"`
+	SignedAt   time.Time `json:"signed_at,omitempty"`
+	BodySHA256 string    `json:"body_sha256,omitempty"`
+}
+
+const (
+	signatureVerified = "verified"
+	signatureUnsigned = "unsigned"
+)
+
+type requestSignatureKey struct{}
+
+func withRequestSignature(ctx context.Context, s requestSignature) context.Context {
+	return context.WithValue(ctx, requestSignatureKey{}, s)
+}
+
+// Signature check of the request in ctx, if it had one
+func requestSignatureFrom(ctx context.Context) (requestSignature, bool) {
+	s, ok := ctx.Value(requestSignatureKey{}).(requestSignature)
+	return s, ok
+}
+
+// Copy the signature check of the request in ctx, if any, onto t
+func recordSignature(ctx context.Context, t *Transaction) {
+	s, ok := requestSignatureFrom(ctx)
+	if !ok {
+		return
+	}
+	t.SignatureStatus = s.Status
+	if s.Status != signatureVerified {
+		return
+	}
+	signedAt := s.SignedAt
+	t.Signature, t.SignatureNonce, t.SignedAt, t.BodySHA256 = s.Signature, s.Nonce, &signedAt, s.BodySHA256
+}
+
+func signatureError(partnerID, reason, msg string) error {
+	signatureFailures.WithLabelValues(partnerID, reason).Inc()
+	return &httpError{Status: http.StatusUnauthorized, Code: codeSignatureInvalid, Message: msg}
+}
+
+// Check a request's X-Signature, the freshness of its X-Signature-Timestamp
+// and that its X-Signature-Nonce was not used before with the partner's key.
+// The signature may be made with any of keys, the partner's signing secrets.
+func verifyRequestSignature(ctx context.Context, p Partner, keys []string, r *http.Request, body []byte, now time.Time) (requestSignature, error) {
+	timestamp, nonce := r.Header.Get("X-Signature-Timestamp"), r.Header.Get("X-Signature-Nonce")
+	if timestamp == "" || nonce == "" {
+		return requestSignature{}, signatureError(p.ID, "missing", "Signed requests need X-Signature-Timestamp and X-Signature-Nonce")
+	}
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return requestSignature{}, signatureError(p.ID, "nonce", "X-Signature-Nonce must be 16 to 128 characters")
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get("X-Signature"), "sha256="))
+	matched := false
+	if err == nil {
+		content := signedContent(r, timestamp, nonce, body)
+		for _, key := range keys {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write(content)
+			if hmac.Equal(got, mac.Sum(nil)) {
+				matched = true
+				break
+			}
+		}
+	}
+	if !matched {
+		return requestSignature{}, signatureError(p.ID, "mismatch", "X-Signature does not match the request")
+	}
+
+	// Only requests we know the partner signed get this far, so nobody else
+	// can use up its nonces
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return requestSignature{}, signatureError(p.ID, "timestamp", "X-Signature-Timestamp must be Unix seconds")
+	}
+	signedAt := time.Unix(secs, 0)
+	if skew := now.Sub(signedAt); skew > signatureClockSkew || skew < -signatureClockSkew {
+		return requestSignature{}, signatureError(p.ID, "stale", "X-Signature-Timestamp is "+skew.Round(time.Second).String()+" from the gateway clock, more than "+signatureClockSkew.String())
+	}
+	res := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&RequestNonce{PartnerID: p.ID, Nonce: nonce, ExpiresAt: signedAt.Add(signatureClockSkew)})
+	if res.Error != nil {
+		log.Printf("ERROR: nonce %s: %v\n", p.ID, res.Error)
+		return requestSignature{}, &httpError{Status: http.StatusServiceUnavailable, Message: "Failed to record the request nonce"}
+	}
+	if res.RowsAffected == 0 {
+		signatureFailures.WithLabelValues(p.ID, "replay").Inc()
+		log.Printf("ALERT: replayed request from partner %s (nonce %s)", p.ID, nonce)
+		return requestSignature{}, &httpError{Status: http.StatusConflict, Code: codeRequestReplayed, Message: "X-Signature-Nonce was already used"}
+	}
+	sum := sha256.Sum256(body)
+	return requestSignature{
+		Status:     signatureVerified,
+		Partner:    p.ID,
+		Signature:  hex.EncodeToString(got),
+		Nonce:      nonce,
+		SignedAt:   signedAt,
+		BodySHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// Partner a submission's signature is checked for: the one its channel
+// authenticated, else the one it names
+func signingPartner(ctx context.Context) string {
+	if ch := channelFrom(ctx); ch.Partner != "" {
+		return ch.Partner
+	}
+	return partnerHint(ctx)
+}
+
+// Verify signed submissions to /inbound routes, whatever their channel, when
+// the submitting partner has a signing_secret or signing_secret credentials,
+// and refuse unsigned ones from partners with require_signature.
+func signatureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := signingPartner(r.Context())
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/inbound") || id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := loadPartner(r.Context(), id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			next.ServeHTTP(w, r) // an unknown X-Partner-ID, left to the pipeline
+			return
+		} else if err != nil {
+			log.Printf("ERROR: partner %s: %v\n", id, err)
+			writeProblem(w, "Failed to fetch partner", http.StatusInternalServerError)
+			return
+		}
+		unsigned := r.Header.Get("X-Signature") == ""
+		if unsigned && p.RequireSignature {
+			writeError(w, signatureError(p.ID, "missing", "Partner "+p.ID+" must sign its requests with X-Signature"))
+			return
+		}
+		keys, err := signingSecrets(r.Context(), p)
+		if err != nil {
+			log.Printf("ERROR: signing secrets %s: %v\n", p.ID, err)
+			writeProblem(w, "Failed to fetch signing secrets", http.StatusServiceUnavailable)
+			return
+		}
+		if len(keys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if unsigned {
+			ctx := withRequestSignature(r.Context(), requestSignature{Status: signatureUnsigned})
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		// The signature covers the whole body, so signed requests are
+		// buffered even where unsigned ones stream
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, inboundMaxBuffered))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, tooLargeError(tooLarge.Limit))
+			return
+		} else if err != nil {
+			writeProblem(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		sig, err := verifyRequestSignature(r.Context(), p, keys, r, body, time.Now())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r.WithContext(withRequestSignature(r.Context(), sig)))
+	})
+}
+
+// Refuse a submission over a channel that cannot carry an X-Signature, such
+// as gRPC, from a partner with require_signature
+func checkUnsignedAllowed(ctx context.Context) error {
+	id := signingPartner(ctx)
+	if id == "" {
+		return nil
+	}
+	p, err := loadPartner(ctx, id)
+	if err != nil || !p.RequireSignature {
+		return nil
+	}
+	return signatureError(p.ID, "missing", "Partner "+p.ID+" must sign its requests with X-Signature, which gRPC submissions cannot carry")
+}
+
+type signatureCheckSkippedKey struct{}
+
+// Context of documents no partner request carries, which the gateway fetched
+// itself or an operator fed it: connectors and backfills
+func withoutSignatureCheck(ctx context.Context) context.Context {
+	return context.WithValue(ctx, signatureCheckSkippedKey{}, true)
+}
+
+func signatureCheckSkipped(ctx context.Context) bool {
+	skip, _ := ctx.Value(signatureCheckSkippedKey{}).(bool)
+	return skip
+}
+
+// Refuse a document of a partner with require_signature unless that partner
+// signed the request carrying it. signatureMiddleware only knows the partner
+// a request names; this is the partner its document turned out to be from,
+// e.g. by its ISA sender.
+func checkSignatureRequired(ctx context.Context, t *Transaction) error {
+	if signatureCheckSkipped(ctx) {
+		return nil
+	}
+	if s, ok := requestSignatureFrom(ctx); ok && s.Status == signatureVerified && s.Partner == t.PartnerID {
+		return nil
+	}
+	return refuseUnsigned(ctx, t.PartnerID)
+}
+
+// Refuse a transaction received elsewhere, by an edge node or the gateway an
+// export came from, of a partner with require_signature unless it records a
+// verified signature
+func checkSignatureRecorded(ctx context.Context, t Transaction) error {
+	if t.SignatureStatus == signatureVerified {
+		return nil
+	}
+	return refuseUnsigned(ctx, t.PartnerID)
+}
+
+// Signature error for unsigned documents of partnerID if it has
+// require_signature
+func refuseUnsigned(ctx context.Context, partnerID string) error {
+	if partnerID == "" {
+		return nil
+	}
+	p, err := loadPartner(ctx, partnerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("partner %s: %w", partnerID, err)
+	}
+	if !p.RequireSignature {
+		return nil
+	}
+	return signatureError(p.ID, "missing", "Partner "+p.ID+" must sign its requests with X-Signature")
+}
+
+// Periodically drop nonces whose requests are past the clock skew window
+func runNoncePurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := db.WithContext(withTenant(ctx, allTenants)).Where("expires_at < ?", time.Now()).Delete(&RequestNonce{}).Error; err != nil {
+			log.Printf("ERROR: nonce purge: %v\n", err)
+		}
+	}
+}
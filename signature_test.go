@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startSignatureGateway(t *testing.T) string {
+	setForTest(t, &databaseDriver, "sqlite")
+	setForTest(t, &eventsBackend, "memory")
+	t.Setenv("DATABASE_DSN", filepath.Join(t.TempDir(), "edi.db"))
+	srv := startGateway(t)
+	for _, p := range []map[string]interface{}{
+		{"id": "acme", "name": "Acme", "isa_id": "ACME", "signing_secret": "acme-secret", "require_signature": true},
+		{"id": "globex", "name": "Globex", "isa_id": "GLOBEX", "signing_secret": "globex-secret"},
+	} {
+		if status := doJSON(t, "POST", srv.URL+"/partners", p, nil); status != http.StatusCreated {
+			t.Fatalf("create partner %s: %d", p["id"], status)
+		}
+	}
+	return srv.URL
+}
+
+// POST body to /inbound, signed with secret for partner when set
+func postInbound(t *testing.T, url, partner, secret, body string) (int, []batchResult) {
+	t.Helper()
+	req, err := http.NewRequest("POST", url+"/inbound", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/edi-x12")
+	if partner != "" {
+		req.Header.Set("X-Partner-ID", partner)
+	}
+	if secret != "" {
+		timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), fmt.Sprintf("nonce-%d", time.Now().UnixNano())
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signedContent(req, timestamp, nonce, []byte(body)))
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+		req.Header.Set("X-Signature-Timestamp", timestamp)
+		req.Header.Set("X-Signature-Nonce", nonce)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var results []batchResult
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusMultiStatus {
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, results
+}
+
+// require_signature holds for the partner a document is from, not only the
+// one a request names
+func TestRequireSignatureOfDocumentPartner(t *testing.T) {
+	url := startSignatureGateway(t)
+	tests := []struct {
+		name, partner, secret, sender string
+		want                          string
+	}{
+		{"unsigned, partner named by the ISA only", "", "", "ACME", "failed"},
+		{"signed by the partner", "acme", "acme-secret", "ACME", "created"},
+		{"signed by another partner", "globex", "globex-secret", "ACME", "failed"},
+		{"partner without the requirement", "", "", "GLOBEX", "created"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			control := fmt.Sprintf("%09d", i+1)
+			status, results := postInbound(t, url, tt.partner, tt.secret, x12ASN(tt.sender, control, "BOL-"+control))
+			if len(results) != 1 {
+				t.Fatalf("inbound: %d %+v", status, results)
+			}
+			if results[0].Status != tt.want {
+				t.Fatalf("status %s, want %s: %+v", results[0].Status, tt.want, results[0])
+			}
+			if tt.want == "failed" && results[0].Code != codeSignatureInvalid {
+				t.Errorf("code %s, want %s", results[0].Code, codeSignatureInvalid)
+			}
+		})
+	}
+}
+
+func TestEdgeSyncRequiresRecordedSignature(t *testing.T) {
+	url := startEdgeCentral(t)
+	env := map[string]interface{}{"node": "edge-1", "transaction": map[string]string{"id": "edge-tx-1", "partner_id": "acme", "type": "856"}}
+	if status := postEdgeSync(t, url, "edge-secret", env); status != http.StatusUnauthorized {
+		t.Errorf("unsigned edge sync: %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+// The signing secret is write-only: masked wherever a partner is read and
+// kept when an update sends the mask back
+func TestSigningSecretMasked(t *testing.T) {
+	url := startSignatureGateway(t)
+	var p Partner
+	if status := doJSON(t, "GET", url+"/partners/acme", nil, &p); status != http.StatusOK || p.SigningSecret != passwordMask {
+		t.Fatalf("get partner: %d %q", status, p.SigningSecret)
+	}
+	p.Name = "Acme Corp"
+	if status := doJSON(t, "PUT", url+"/partners/acme", p, nil); status != http.StatusOK {
+		t.Fatalf("update partner: %d", status)
+	}
+	for _, path := range []string{"/partners", "/partners/acme", "/audit"} {
+		var body string
+		doRequest(t, "GET", url+path, "", nil, &body)
+		if strings.Contains(body, "acme-secret") {
+			t.Errorf("GET %s shows the signing secret: %s", path, body)
+		}
+	}
+	status, results := postInbound(t, url, "acme", "acme-secret", x12ASN("ACME", "000000001", "BOL-1"))
+	if len(results) != 1 || results[0].Status != "created" {
+		t.Errorf("signed with the kept secret: %d %+v", status, results)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Operational aggregates for dashboards and alerts
+type gatewayStats struct {
+	GeneratedAt  time.Time         `json:"generated_at"`
+	From         time.Time         `json:"from"` // window of the transaction counts
+	To           time.Time         `json:"to"`
+	Transactions transactionStats  `json:"transactions"`
+	Deliveries   pendingDeliveries `json:"pending_deliveries"`
+	Acks         ackStats          `json:"acks"`
+	Events       publishStats      `json:"events"`
+}
+
+type transactionStats struct {
+	Total     int64            `json:"total"`
+	ByStatus  map[string]int64 `json:"by_status"`
+	ByPartner map[string]int64 `json:"by_partner"`
+	ByType    map[string]int64 `json:"by_type"`
+}
+
+// Work waiting to go out, whatever its age
+type pendingDeliveries struct {
+	Outbox          int64            `json:"outbox"` // outbox documents not yet delivered or pulled
+	OutboxByPartner map[string]int64 `json:"outbox_by_partner"`
+	OldestOutboxAge float64          `json:"oldest_outbox_age_seconds,omitempty"`
+	Held            int64            `json:"held"`           // transactions held by a guardrail
+	InboundQueued   int              `json:"inbound_queued"` // payloads queued on disk during a database outage
+}
+
+// Outbound documents still waiting for their 997 or 999
+type ackStats struct {
+	Pending          int64      `json:"pending"`
+	Overdue          int64      `json:"overdue"`
+	OldestUnacked    *time.Time `json:"oldest_unacked_sent_at,omitempty"`
+	OldestUnackedAge float64    `json:"oldest_unacked_age_seconds,omitempty"`
+}
+
+// Event publishing since the gateway started. Lag is from a transaction
+// being received to its transaction.created event being published.
+type publishStats struct {
+	Backend         string     `json:"backend"`
+	Published       int64      `json:"published"`
+	Failed          int64      `json:"failed"`
+	LastPublishedAt *time.Time `json:"last_published_at,omitempty"`
+	LastLagSeconds  float64    `json:"last_lag_seconds"`
+	MaxLagSeconds   float64    `json:"max_lag_seconds"`
+}
+
+var (
+	publishMu      sync.Mutex
+	publishTracked publishStats
+)
+
+// Count a publish attempt for the events stats
+func trackPublish(eventType string, t Transaction, err error, now time.Time) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	if err != nil {
+		publishTracked.Failed++
+		return
+	}
+	publishTracked.Published++
+	publishTracked.LastPublishedAt = &now
+	if eventType == eventTransactionCreated && !t.Date.IsZero() {
+		lag := now.Sub(t.Date).Seconds()
+		publishTracked.LastLagSeconds = lag
+		if lag > publishTracked.MaxLagSeconds {
+			publishTracked.MaxLagSeconds = lag
+		}
+	}
+}
+
+// Counts of one column of the rows q matches
+func countsBy(q func() *gorm.DB, column string) (map[string]int64, error) {
+	var rows []struct {
+		Name string
+		N    int64
+	}
+	if err := q().Select(column + " AS name, count(*) AS n").Group(column).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	for _, r := range rows {
+		counts[r.Name] = r.N
+	}
+	return counts, nil
+}
+
+func collectStats(ctx context.Context, from, to, now time.Time) (gatewayStats, error) {
+	s := gatewayStats{GeneratedAt: now.UTC(), From: from.UTC(), To: to.UTC()}
+	txs := func() *gorm.DB {
+		return db.WithContext(ctx).Model(&Transaction{}).Where("date >= ? AND date < ?", from, to)
+	}
+	var err error
+	if s.Transactions.ByStatus, err = countsBy(txs, "status"); err != nil {
+		return s, err
+	}
+	for _, n := range s.Transactions.ByStatus {
+		s.Transactions.Total += n
+	}
+	if s.Transactions.ByPartner, err = countsBy(txs, "partner_id"); err != nil {
+		return s, err
+	}
+	if s.Transactions.ByType, err = countsBy(txs, "type"); err != nil {
+		return s, err
+	}
+
+	outbox := func() *gorm.DB {
+		return db.WithContext(ctx).Model(&MailboxMessage{}).Where("box = ? AND status = ?", mailboxOutbox, mailboxPending)
+	}
+	if s.Deliveries.OutboxByPartner, err = countsBy(outbox, "partner_id"); err != nil {
+		return s, err
+	}
+	for _, n := range s.Deliveries.OutboxByPartner {
+		s.Deliveries.Outbox += n
+	}
+	var oldest MailboxMessage
+	if res := outbox().Order("id").Limit(1).Find(&oldest); res.Error != nil {
+		return s, res.Error
+	} else if res.RowsAffected > 0 {
+		s.Deliveries.OldestOutboxAge = now.Sub(oldest.CreatedAt).Seconds()
+	}
+	if err := db.WithContext(ctx).Model(&Transaction{}).Where("status = ?", statusHeld).Count(&s.Deliveries.Held).Error; err != nil {
+		return s, err
+	}
+	if names, err := queuedFiles(); err == nil {
+		s.Deliveries.InboundQueued = len(names)
+	}
+
+	acks := func() *gorm.DB {
+		return db.WithContext(ctx).Model(&OutboundAck{}).Where("status IN ?", []string{ackPending, ackOverdue})
+	}
+	byStatus, err := countsBy(acks, "status")
+	if err != nil {
+		return s, err
+	}
+	s.Acks.Pending, s.Acks.Overdue = byStatus[ackPending], byStatus[ackOverdue]
+	var unacked OutboundAck
+	if res := acks().Order("sent_at").Limit(1).Find(&unacked); res.Error != nil {
+		return s, res.Error
+	} else if res.RowsAffected > 0 {
+		s.Acks.OldestUnacked, s.Acks.OldestUnackedAge = &unacked.SentAt, now.Sub(unacked.SentAt).Seconds()
+	}
+
+	publishMu.Lock()
+	s.Events = publishTracked
+	publishMu.Unlock()
+	s.Events.Backend = eventsBackend
+	if edgeMode {
+		s.Events.Backend = "none"
+	}
+	return s, nil
+}
+
+// Report operational aggregates of the tenant: transactions by status,
+// partner and type between from and to (RFC 3339, default the last 24
+// hours), pending deliveries, unacknowledged documents and event publishing
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from, to := now.Add(-24*time.Hour), now
+	for param, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(param); v != "" {
+			ts, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				writeProblem(w, param+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*dst = ts
+		}
+	}
+	if !from.Before(to) {
+		writeProblem(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	s, err := collectStats(r.Context(), from, to, now)
+	if err != nil {
+		log.Printf("ERROR: stats: %v\n", err)
+		writeProblem(w, "Failed to collect stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// How long a status link works unless its creator asks for less, and the
+// longest it may be asked to work
+var (
+	statusLinkTTL    = getEnvDuration("STATUS_LINK_TTL", 30*24*time.Hour)
+	statusLinkMaxTTL = getEnvDuration("STATUS_LINK_MAX_TTL", 90*24*time.Hour)
+)
+
+// Prefix of the URL handed out for a status link, e.g.
+// https://edi.example.com; the link is relative when empty
+var statusLinkBaseURL = strings.TrimSuffix(getEnv("STATUS_LINK_BASE_URL", ""), "/")
+
+// A shareable link to the status of one transaction, e.g. for a partner
+// disputing a shipment, that works without an API key. Only the hash of its
+// token is kept; the token itself is returned once, on creation.
+type StatusLink struct {
+	ID            string     `json:"id" gorm:"primaryKey"`
+	TenantID      string     `json:"tenant_id" gorm:"index"`
+	TransactionID string     `json:"transaction_id" gorm:"index"`
+	TokenHash     string     `json:"-" gorm:"uniqueIndex"`
+	Token         string     `json:"token,omitempty" gorm:"-"` // only in the response creating the link
+	URL           string     `json:"url,omitempty" gorm:"-"`
+	Note          string     `json:"note,omitempty"` // who it was shared with, or why
+	CreatedBy     string     `json:"created_by"`     // actor, as in the audit log
+	ExpiresAt     time.Time  `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	Views         int        `json:"views"`
+	LastViewedAt  *time.Time `json:"last_viewed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Body of a request creating a status link
+type statusLinkRequest struct {
+	Note           string `json:"note"`
+	ExpiresInHours int    `json:"expires_in_hours"` // default STATUS_LINK_TTL
+}
+
+// What a status link shows: the transaction's status, its timestamps and
+// the acknowledgment of its interchange, and nothing of its content
+type statusPage struct {
+	TransactionID string        `json:"transaction_id"`
+	Type          string        `json:"type,omitempty"`
+	Status        string        `json:"status"`
+	ReceivedAt    time.Time     `json:"received_at"`
+	Ack           *statusAck    `json:"ack,omitempty"`
+	Timeline      []statusEvent `json:"timeline"`
+	ExpiresAt     time.Time     `json:"link_expires_at"`
+}
+
+// Acknowledgment state of the interchange that carried the transaction
+type statusAck struct {
+	Status  string     `json:"status"` // pending, accepted, partial, rejected or overdue
+	SentAt  time.Time  `json:"sent_at"`
+	DueAt   time.Time  `json:"due_at"`
+	AckedAt *time.Time `json:"acked_at,omitempty"`
+}
+
+// A step in a transaction's timeline
+type statusEvent struct {
+	At     time.Time `json:"at"`
+	Event  string    `json:"event"` // received, delivery, mdn_received, ack_due or acknowledged
+	Status string    `json:"status,omitempty"`
+}
+
+func hashStatusToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Share the status of a transaction through a new link
+func createStatusLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var req statusLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeProblem(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ttl := statusLinkTTL
+	if req.ExpiresInHours < 0 {
+		writeProblem(w, "expires_in_hours must not be negative", http.StatusBadRequest)
+		return
+	} else if req.ExpiresInHours > 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if ttl > statusLinkMaxTTL {
+		writeProblem(w, fmt.Sprintf("Status links must expire within %d hours", int(statusLinkMaxTTL.Hours())), http.StatusBadRequest)
+		return
+	}
+	var t Transaction
+	err := db.WithContext(r.Context()).Select("id").First(&t, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch transaction", http.StatusInternalServerError)
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to create status link", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	link := StatusLink{ID: uuid.New().String(), TransactionID: t.ID, TokenHash: hashStatusToken(token), Note: req.Note,
+		CreatedBy: auditorFrom(r.Context()).actor, ExpiresAt: time.Now().Add(ttl).UTC()}
+	if err := db.WithContext(r.Context()).Create(&link).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to save status link", http.StatusInternalServerError)
+		return
+	}
+	auditChange(r.Context(), auditCreate, "status_link", link.ID, nil, link)
+	link.Token, link.URL = token, statusLinkBaseURL+"/status/"+token
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+// List the status links of a transaction, newest first
+func listStatusLinksHandler(w http.ResponseWriter, r *http.Request) {
+	links := []StatusLink{}
+	if err := db.WithContext(r.Context()).Where("transaction_id = ?", mux.Vars(r)["id"]).Order("created_at DESC").Find(&links).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch status links", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+// Stop a status link from working before it expires
+func revokeStatusLinkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var link StatusLink
+	err := db.WithContext(r.Context()).First(&link, "id = ? AND transaction_id = ?", vars["link"], vars["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Status link not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch status link", http.StatusInternalServerError)
+		return
+	}
+	if link.RevokedAt == nil {
+		before := link
+		now := time.Now().UTC()
+		link.RevokedAt = &now
+		if err := db.WithContext(r.Context()).Model(&link).Update("revoked_at", now).Error; err != nil {
+			log.Printf("ERROR: %v\n", err)
+			writeProblem(w, "Failed to revoke status link", http.StatusInternalServerError)
+			return
+		}
+		auditChange(r.Context(), auditUpdate, "status_link", link.ID, before, link)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
+}
+
+// Status, timestamps and ack state of the transaction a link shares
+func buildStatusPage(ctx context.Context, link StatusLink) (statusPage, error) {
+	var t Transaction
+	if err := db.WithContext(ctx).Select("id", "type", "status", "date").First(&t, "id = ?", link.TransactionID).Error; err != nil {
+		return statusPage{}, err
+	}
+	page := statusPage{TransactionID: t.ID, Type: t.Type, Status: t.Status, ReceivedAt: t.Date.UTC(), ExpiresAt: link.ExpiresAt,
+		Timeline: []statusEvent{{At: t.Date.UTC(), Event: "received"}}}
+	scoped := db.WithContext(ctx)
+	carried := scoped.Model(&DeliveryTransaction{}).Select("delivery_id").Where("transaction_id = ?", t.ID)
+	var deliveries []Delivery
+	if err := scoped.Where("id IN (?)", carried).Order("created_at").Find(&deliveries).Error; err != nil {
+		return page, err
+	}
+	for _, d := range deliveries {
+		page.Timeline = append(page.Timeline, statusEvent{At: d.CreatedAt.UTC(), Event: "delivery", Status: d.Status})
+		if d.MDNReceivedAt != nil {
+			page.Timeline = append(page.Timeline, statusEvent{At: d.MDNReceivedAt.UTC(), Event: "mdn_received", Status: d.MDNDisposition})
+		}
+	}
+	var acks []OutboundAck
+	sent := scoped.Model(&OutboundAckTransaction{}).Select("ack_id").Where("transaction_id = ?", t.ID)
+	if err := scoped.Where("id IN (?)", sent).Order("sent_at DESC").Limit(1).Find(&acks).Error; err != nil {
+		return page, err
+	}
+	if len(acks) == 1 {
+		a := acks[0]
+		page.Ack = &statusAck{Status: a.Status, SentAt: a.SentAt.UTC(), DueAt: a.DueAt.UTC(), AckedAt: a.AckedAt}
+		if a.AckedAt != nil {
+			page.Timeline = append(page.Timeline, statusEvent{At: a.AckedAt.UTC(), Event: "acknowledged", Status: a.Status})
+		} else {
+			page.Timeline = append(page.Timeline, statusEvent{At: a.DueAt.UTC(), Event: "ack_due", Status: a.Status})
+		}
+	}
+	sort.SliceStable(page.Timeline, func(i, j int) bool { return page.Timeline[i].At.Before(page.Timeline[j].At) })
+	return page, nil
+}
+
+var statusPageHTML = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Status of {{.TransactionID}}</title>
+</head>
+<body>
+<h1>{{.TransactionID}}</h1>
+<p>{{if .Type}}{{.Type}} &middot; {{end}}{{.Status}}{{with .Ack}} &middot; ack {{.Status}}{{end}}</p>
+<table>
+<tr><th>Time (UTC)</th><th>Event</th><th>Status</th></tr>
+{{range .Timeline}}<tr><td>{{.At.Format "2006-01-02 15:04:05"}}</td><td>{{.Event}}</td><td>{{.Status}}</td></tr>
+{{end}}</table>
+<p>This link expires {{.ExpiresAt.Format "2006-01-02 15:04"}} UTC.</p>
+</body>
+</html>
+`))
+
+// Show the status a link shares, to anyone holding its token: as JSON, or
+// as a page when the client accepts text/html
+func statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	var link StatusLink
+	err := db.WithContext(withTenant(r.Context(), allTenants)).First(&link, "token_hash = ?", hashStatusToken(mux.Vars(r)["token"])).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Status link not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch status link", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if link.RevokedAt != nil || now.After(link.ExpiresAt) {
+		writeProblem(w, "Status link has expired or was revoked", http.StatusGone)
+		return
+	}
+	ctx := withTenant(r.Context(), link.TenantID)
+	page, err := buildStatusPage(ctx, link)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Status link not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: status link %s: %v\n", link.ID, err)
+		writeProblem(w, "Failed to fetch status", http.StatusInternalServerError)
+		return
+	}
+	if err := db.WithContext(ctx).Model(&link).UpdateColumns(map[string]interface{}{"views": gorm.Expr("views + 1"), "last_viewed_at": now}).Error; err != nil {
+		log.Printf("ERROR: status link %s: %v\n", link.ID, err)
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		statusPageHTML.Execute(w, page)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
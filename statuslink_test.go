@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A status page finds the deliveries and acknowledgment of its transaction
+// through their indexes
+func TestStatusPageTimeline(t *testing.T) {
+	startBulkGateway(t)
+	ctx := withTenant(context.Background(), defaultTenant)
+	tx := bulkTransactions("shared", 1)[0]
+	if err := processTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDelivery(ctx, Delivery{ID: "d-1", PartnerID: "acme", Status: deliveryDelivered}, []string{tx.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDelivery(ctx, Delivery{ID: "d-2", PartnerID: "acme", Status: deliveryDelivered}, []string{"other"}); err != nil {
+		t.Fatal(err)
+	}
+	a := OutboundAck{PartnerID: "acme", ControlNumber: 1, Status: ackPending, TransactionIDs: `["` + tx.ID + `"]`, SentAt: time.Now(), DueAt: time.Now().Add(time.Hour)}
+	if err := db.WithContext(ctx).Create(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := linkAckTransactions(db.WithContext(ctx), a); err != nil {
+		t.Fatal(err)
+	}
+	page, err := buildStatusPage(ctx, StatusLink{TransactionID: tx.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, e := range page.Timeline {
+		events = append(events, e.Event)
+	}
+	if len(events) != 3 || events[0] != "received" || events[1] != "delivery" || events[2] != "ack_due" {
+		t.Errorf("timeline %v", events)
+	}
+	if page.Ack == nil || page.Ack.Status != ackPending {
+		t.Errorf("ack %+v", page.Ack)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Inbound size limits. Payloads are normally read into memory; X12 bodies
+// over INBOUND_STREAM_THRESHOLD are parsed and persisted one transaction set
+// at a time instead, so only the largest set has to fit in memory.
+var (
+	inboundMaxSize         = int64(getEnvInt("INBOUND_MAX_SIZE", 1<<30))           // largest body accepted, streamed X12 included
+	inboundMaxBuffered     = int64(getEnvInt("INBOUND_MAX_BUFFERED_SIZE", 64<<20)) // largest payload, or X12 set, held in memory
+	inboundStreamThreshold = int64(getEnvInt("INBOUND_STREAM_THRESHOLD", 8<<20))   // X12 bodies larger than this are streamed
+)
+
+// Longest single segment the streaming reader accepts
+const maxSegmentLength = 1 << 20
+
+var inboundPayloadBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "edi_inbound_payload_bytes",
+	Help:    "Size of inbound payloads, by whether they were buffered or streamed.",
+	Buckets: prometheus.ExponentialBuckets(1024, 4, 11), // 1 KiB to 1 GiB
+}, []string{"mode"})
+
+var inboundOversize = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edi_inbound_oversize_total",
+	Help: "Inbound payloads refused for being over INBOUND_MAX_SIZE or INBOUND_MAX_BUFFERED_SIZE.",
+}, []string{"tenant"})
+
+// Request body of an inbound submission: the whole payload in a pooled
+// buffer, or a reader to stream a large X12 interchange from
+type inboundBody struct {
+	buf    *bytes.Buffer
+	stream io.Reader // set when the payload is to be streamed; buf then holds only its start
+}
+
+func (in *inboundBody) release() {
+	releaseBuffer(in.buf)
+}
+
+func payloadTooLarge(ctx context.Context, limit int64) error {
+	inboundOversize.WithLabelValues(tenantID(ctx)).Inc()
+	return tooLargeError(limit)
+}
+
+// Map a body read error to 413 when the body hit its limit, else fallback
+func bodyError(ctx context.Context, err error, fallback *httpError) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return payloadTooLarge(ctx, tooLarge.Limit)
+	}
+	return fallback
+}
+
+// Read an inbound request body. The first INBOUND_STREAM_THRESHOLD bytes
+// decide: smaller bodies and, unless allowStream, bodies of any format are
+// read whole up to INBOUND_MAX_BUFFERED_SIZE; bigger X12 bodies are left to
+// stream up to INBOUND_MAX_SIZE. Release the body when done.
+func readInbound(w http.ResponseWriter, r *http.Request, allowStream bool) (*inboundBody, error) {
+	ctx := r.Context()
+	if r.ContentLength > inboundMaxSize {
+		return nil, payloadTooLarge(ctx, inboundMaxSize)
+	}
+	if !allowStream && r.ContentLength > inboundMaxBuffered {
+		return nil, payloadTooLarge(ctx, inboundMaxBuffered)
+	}
+	body := http.MaxBytesReader(w, r.Body, inboundMaxSize)
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	in := &inboundBody{buf: buf}
+	readFailed := &httpError{Status: http.StatusBadRequest, Message: "Failed to read request body"}
+	if _, err := buf.ReadFrom(io.LimitReader(body, inboundStreamThreshold+1)); err != nil {
+		in.release()
+		return nil, bodyError(ctx, err, readFailed)
+	}
+	if int64(buf.Len()) > inboundStreamThreshold {
+		if allowStream && detectFormat(r.Header.Get("Content-Type"), buf.Bytes()) == formatX12 {
+			in.stream = io.MultiReader(bytes.NewReader(buf.Bytes()), body)
+			return in, nil
+		}
+		if _, err := buf.ReadFrom(io.LimitReader(body, inboundMaxBuffered-int64(buf.Len())+1)); err != nil {
+			in.release()
+			return nil, bodyError(ctx, err, readFailed)
+		}
+		if int64(buf.Len()) > inboundMaxBuffered {
+			in.release()
+			return nil, payloadTooLarge(ctx, inboundMaxBuffered)
+		}
+	}
+	inboundPayloadBytes.WithLabelValues("buffered").Observe(float64(buf.Len()))
+	return in, nil
+}
+
+// Reads X12 segments one at a time from a stream
+type x12Reader struct {
+	r   *bufio.Reader
+	d   X12Delimiters
+	raw []byte
+	eof bool
+}
+
+func newX12Reader(r io.Reader) (*x12Reader, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	// Skip what splitSegments trims: whitespace and a UTF-8 byte order mark
+	for {
+		head, _ := br.Peek(3)
+		if bytes.HasPrefix(head, []byte("\xef\xbb\xbf")) {
+			br.Discard(3)
+		} else if len(head) > 0 && strings.IndexByte(" \t\r\n", head[0]) >= 0 {
+			br.Discard(1)
+		} else {
+			break
+		}
+	}
+	head, err := br.Peek(maxISALength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	d, err := detectDelimiters(head)
+	if err != nil {
+		return nil, err
+	}
+	return &x12Reader{r: br, d: d}, nil
+}
+
+// Next segment, with its raw bytes up to and including the terminator. The
+// raw bytes are only valid until the next call. io.EOF at the end.
+func (x *x12Reader) next() (Segment, []byte, error) {
+	for !x.eof {
+		x.raw = x.raw[:0]
+		for {
+			chunk, err := x.r.ReadSlice(x.d.Segment)
+			x.raw = append(x.raw, chunk...)
+			if len(x.raw) > maxSegmentLength {
+				return nil, nil, fmt.Errorf("x12: segment longer than %d bytes", maxSegmentLength)
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF {
+				x.eof = true
+			} else if err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+		text := strings.Trim(strings.TrimSuffix(string(x.raw), string(x.d.Segment)), "\r\n ")
+		if text != "" {
+			return Segment(strings.Split(text, string(x.d.Element))), x.raw, nil
+		}
+	}
+	return nil, nil, io.EOF
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Parse an X12 body from a stream and run each transaction set through the
+// pipeline as soon as its SE arrives. Each set is archived on its own as a
+// one-set interchange. An envelope error ends the stream; the sets before it
+// are already saved and reported with the error. size is the body's
+// Content-Length, or -1, for the guardrails.
+func processX12Stream(ctx context.Context, file, contentType string, body io.Reader, size int64) []batchResult {
+	results := []batchResult{}
+	fail := func(err error) []batchResult {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			err = payloadTooLarge(ctx, tooLarge.Limit)
+		}
+		var envErr *envelopeError
+		if errors.As(err, &envErr) {
+			return append(results, rejectInterchange(ctx, file, contentType, nil, envErr))
+		}
+		return append(results, batchResult{File: file, Format: formatX12, Status: "failed", Error: err.Error(), Code: resultCode(err)})
+	}
+	counted := &countingReader{r: body}
+	defer func() { inboundPayloadBytes.WithLabelValues("streamed").Observe(float64(counted.n)) }()
+	x, err := newX12Reader(counted)
+	if err != nil {
+		return fail(err)
+	}
+	p := x12Parser{d: x.d}
+	var isa, gs []byte
+	var set bytes.Buffer
+	dups := map[string]error{}
+	now := time.Now()
+	for {
+		seg, raw, err := x.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+		switch seg[0] {
+		case "ISA":
+			isa = append(isa[:0], raw...)
+		case "GS":
+			gs = append(gs[:0], raw...)
+		case "ST":
+			set.Reset()
+		}
+		if p.set != nil || seg[0] == "ST" {
+			set.Write(raw)
+		}
+		closed, err := p.feed(seg)
+		if err != nil {
+			return fail(err)
+		}
+		if int64(set.Len()) > inboundMaxBuffered && (p.set != nil || closed != nil) {
+			open := p.set
+			if open == nil {
+				open = closed
+			}
+			return fail(fmt.Errorf("x12: set %s is over the limit of %d bytes", open.ControlNumber(), inboundMaxBuffered))
+		}
+		if closed == nil {
+			continue
+		}
+		docSize := size
+		if docSize < 0 {
+			docSize = counted.n
+		}
+		ic := *p.ic
+		data := oneSetInterchange(x.d, isa, gs, set.Bytes(), p.group.GS.el(6), ic.ControlNumber())
+		results = append(results, admitStreamedSet(ctx, file, contentType, ic, *closed, data, int(docSize), now, dups))
+	}
+	if err := p.finish(); err != nil {
+		return fail(err)
+	}
+	if len(results) == 0 {
+		return fail(errors.New("no transactions found"))
+	}
+	return results
+}
+
+// A set's raw segments wrapped in its ISA and GS with matching trailers, so
+// the archived payload can be read back like any interchange
+func oneSetInterchange(d X12Delimiters, isa, gs, set []byte, group, interchange string) []byte {
+	var b bytes.Buffer
+	b.Write(isa)
+	b.Write(gs)
+	b.Write(set)
+	fmt.Fprintf(&b, "\nGE%c1%c%s%c\nIEA%c1%c%s%c\n", d.Element, d.Element, group, d.Segment, d.Element, d.Element, interchange, d.Segment)
+	return b.Bytes()
+}
+
+// Translate, archive and process one streamed set like processDocument does
+// for a set of a buffered payload
+func admitStreamedSet(ctx context.Context, file, contentType string, ic X12Interchange, set X12Set, data []byte, size int, now time.Time, dups map[string]error) batchResult {
+	t, err := translateX12Set(ctx, ic, set)
+	t.Date = now
+	if err != nil {
+		t.Type, t.ControlNumber, t.InterchangeControl = set.Type(), set.ControlNumber(), ic.ControlNumber()
+	}
+	t.Format = formatX12
+	s := splitResult{Transaction: t, Err: err}
+	if res, ok := validateSandboxed(ctx, s, file, formatX12); ok {
+		return res
+	}
+	if s.Err == nil {
+		s.Err = checkDuplicateInterchange(ctx, s.Transaction, dups)
+	}
+	archived := false
+	if s.Err == nil {
+		newInboundTransaction(ctx, &s.Transaction, now)
+		if sampleArchive(ctx, s.Transaction.PartnerID, s.Transaction.ID) {
+			archived = true
+			if err := archivePayload(ctx, "inbound", contentType, data, s.Transaction.ID); err != nil {
+				log.Printf("ERROR: archive: %v\n", err)
+				s.Err = errArchiveFailed
+			}
+		}
+	}
+	res, limited := admitSplit(ctx, s, file, formatX12, size)
+	// Failures are always kept for debugging, even when sampled out
+	if res.Status == "failed" && s.Transaction.ID != "" && !archived && !limited {
+		if err := archivePayload(ctx, "inbound", contentType, data, s.Transaction.ID); err != nil {
+			log.Printf("ERROR: archive: %v\n", err)
+		}
+	}
+	return res
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Several documents submitted in one multipart request. Every transaction
+// created from the request carries the submission ID.
+type Submission struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	TenantID  string    `json:"tenant_id" gorm:"index"`
+	PartnerID string    `json:"partner_id,omitempty" gorm:"index"` // applied to transactions without a partner
+	Reference string    `json:"reference,omitempty" gorm:"index"`  // sender's own reference, e.g. a WMS run ID
+	Metadata  string    `json:"-"`                                 // JSON object of all metadata parts
+	Documents int       `json:"documents"`
+	CreatedAt time.Time `json:"created_at"`
+
+	ParsedMetadata map[string]interface{} `json:"metadata,omitempty" gorm:"-"`
+	Transactions   []Transaction          `json:"transactions,omitempty" gorm:"-"`
+}
+
+// Read a multipart/mixed or multipart/form-data body. Parts with a file name,
+// or any part of multipart/mixed, are documents. A part named "metadata" holds
+// a JSON object and other named form fields are metadata values; metadata may
+// come before or after the documents.
+func readSubmission(r *http.Request, mixed bool) ([]jobFile, *Submission, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, &httpError{Status: http.StatusBadRequest, Message: "Invalid multipart body"}
+	}
+	var files []jobFile
+	meta := map[string]interface{}{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, bodyError(r.Context(), err, &httpError{Status: http.StatusBadRequest, Message: "Invalid multipart body"})
+		}
+		if name := partName(part); name == "metadata" {
+			if err := json.NewDecoder(part).Decode(&meta); err != nil {
+				return nil, nil, &httpError{Status: http.StatusBadRequest, Message: "Invalid JSON in metadata part"}
+			}
+			continue
+		} else if name != "" && part.FileName() == "" && !mixed {
+			value, err := io.ReadAll(io.LimitReader(part, 64*1024))
+			if err != nil {
+				return nil, nil, &httpError{Status: http.StatusBadRequest, Message: "Invalid multipart body"}
+			}
+			meta[name] = string(value)
+			continue
+		} else if part.FileName() == "" && !mixed {
+			continue
+		}
+		f, err := readPart(part)
+		if err != nil {
+			return nil, nil, bodyError(r.Context(), err, &httpError{Status: http.StatusBadRequest, Message: "Failed to read uploaded file"})
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, nil, &httpError{Status: http.StatusBadRequest, Message: "No files uploaded"}
+	}
+
+	sub := &Submission{ID: uuid.New().String(), Documents: len(files), ParsedMetadata: meta}
+	sub.PartnerID, _ = meta["partner_id"].(string)
+	sub.Reference, _ = meta["reference"].(string)
+	if len(meta) > 0 {
+		b, _ := json.Marshal(meta)
+		sub.Metadata = string(b)
+	}
+	return files, sub, nil
+}
+
+// Name from Content-Disposition whatever its disposition; FormName only
+// reports form-data parts
+func partName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["name"]
+}
+
+func readPart(part *multipart.Part) (jobFile, error) {
+	buf, err := readPooled(part)
+	if err != nil {
+		return jobFile{}, err
+	}
+	defer releaseBuffer(buf)
+	name := part.FileName()
+	if name == "" {
+		name = part.Header.Get("Content-ID")
+	}
+	return newJobFile(name, part.Header.Get("Content-Type"), buf.Bytes()), nil
+}
+
+// Fetch a submission with its linked transactions
+func getSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	var sub Submission
+	err := db.WithContext(r.Context()).First(&sub, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Submission not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch submission", http.StatusInternalServerError)
+		return
+	}
+	if sub.Metadata != "" {
+		json.Unmarshal([]byte(sub.Metadata), &sub.ParsedMetadata)
+	}
+	if err := db.WithContext(r.Context()).Where("submission_id = ?", sub.ID).Order("date").Find(&sub.Transactions).Error; err != nil {
+		writeProblem(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+	if err := readItems(r.Context(), sub.Transactions); err != nil {
+		writeProblem(w, "Failed to fetch transactions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
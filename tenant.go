@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Business units sharing the gateway. Every row carries a tenant_id and every
+// query is scoped to the tenant in its context.
+var (
+	defaultTenant = getEnv("DEFAULT_TENANT", "default")
+	tenants       = splitList(getEnv("TENANTS", defaultTenant))
+
+	// Publish to and consume from <tenant>.<topic> rather than sharing topics
+	// and telling tenants apart by the tenant_id header
+	kafkaTenantTopics = getEnvBool("KAFKA_TENANT_TOPICS", false)
+)
+
+// Scope of background work that spans tenants, such as purging the archive
+const allTenants = "*"
+
+var errNoTenant = errors.New("query without a tenant scope")
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, id)
+}
+
+// Tenant of the request or job; empty when none was resolved
+func tenantID(ctx context.Context) string {
+	id, _ := ctx.Value(tenantKey{}).(string)
+	return id
+}
+
+// Context for work across every tenant
+func allTenantsContext() context.Context {
+	return withTenant(context.Background(), allTenants)
+}
+
+func knownTenant(id string) bool {
+	for _, t := range tenants {
+		if t == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Topic of ctx's tenant for a base topic
+func tenantTopic(ctx context.Context, topic string) string {
+	if !kafkaTenantTopics {
+		return topic
+	}
+	return tenantID(ctx) + "." + topic
+}
+
+// Every tenant's topic for a base topic
+func tenantTopics(topic string) []string {
+	if !kafkaTenantTopics {
+		return []string{topic}
+	}
+	list := make([]string, len(tenants))
+	for i, t := range tenants {
+		list[i] = t + "." + topic
+	}
+	return list
+}
+
+// Tenant owning a per-tenant topic; empty for shared topics
+func topicTenant(topic string) string {
+	if !kafkaTenantTopics {
+		return ""
+	}
+	id, _, _ := strings.Cut(topic, ".")
+	return id
+}
+
+// Resolve the tenant from the API key's partner, else X-Tenant-ID, else
+// DEFAULT_TENANT. A key may not be used for another tenant. Status links
+// carry their tenant in their token.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/status/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := resolveTenant(r.Header.Get("X-Tenant-ID"), r.Header.Get("X-API-Key"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), id)))
+	})
+}
+
+func resolveTenant(header, apiKey string) (string, error) {
+	id := header
+	if apiKey != "" {
+		if owner := limiter.limitFor(apiKey, time.Now()).tenant; owner != "" {
+			if id != "" && id != owner {
+				return "", &httpError{Status: http.StatusForbidden, Message: fmt.Sprintf("API key does not belong to tenant %s", id)}
+			}
+			id = owner
+		}
+	}
+	if id == "" {
+		id = defaultTenant
+	}
+	if !knownTenant(id) {
+		return "", &httpError{Status: http.StatusForbidden, Message: fmt.Sprintf("Unknown tenant %s", id)}
+	}
+	return id, nil
+}
+
+// Scope every GORM operation on a model with a TenantID to the statement's
+// tenant: creates and updates stamp it, everything filters on it. Operations
+// without a tenant fail rather than reading or writing across tenants.
+func registerTenantScope(gdb *gorm.DB) error {
+	create := func(tx *gorm.DB) {
+		field := tenantField(tx)
+		if field == nil {
+			return
+		}
+		tenant := tenantID(tx.Statement.Context)
+		if tenant == "" {
+			tx.AddError(errNoTenant)
+			return
+		}
+		each(tx.Statement.ReflectValue, func(rv reflect.Value) {
+			if tenant == allTenants {
+				// Cross-tenant work keeps the tenant of the row it writes
+				if _, zero := field.ValueOf(tx.Statement.Context, rv); zero {
+					tx.AddError(errNoTenant)
+				}
+				return
+			}
+			if err := field.Set(tx.Statement.Context, rv, tenant); err != nil {
+				tx.AddError(err)
+			}
+		})
+	}
+	scope := func(tx *gorm.DB) {
+		if tenantField(tx) == nil {
+			return
+		}
+		switch tenant := tenantID(tx.Statement.Context); tenant {
+		case "":
+			tx.AddError(errNoTenant)
+		case allTenants:
+		default:
+			tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+				clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "tenant_id"}, Value: tenant},
+			}})
+		}
+	}
+	update := func(tx *gorm.DB) {
+		field := tenantField(tx)
+		if field == nil {
+			return
+		}
+		scope(tx)
+		// A struct update must not move the row to another tenant
+		if tenant := tenantID(tx.Statement.Context); tx.Error == nil && tenant != allTenants {
+			each(tx.Statement.ReflectValue, func(rv reflect.Value) {
+				if err := field.Set(tx.Statement.Context, rv, tenant); err != nil {
+					tx.AddError(err)
+				}
+			})
+		}
+	}
+	cb := gdb.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("tenant:create", create),
+		cb.Query().Before("gorm:query").Register("tenant:query", scope),
+		cb.Update().Before("gorm:update").Register("tenant:update", update),
+		cb.Delete().Before("gorm:delete").Register("tenant:delete", scope),
+		cb.Row().Before("gorm:row").Register("tenant:row", scope),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TenantID field of the statement's model, nil for models without one
+func tenantField(tx *gorm.DB) *schema.Field {
+	if tx.Statement.Schema == nil {
+		return nil
+	}
+	return tx.Statement.Schema.LookUpField("TenantID")
+}
+
+// Call fn for the struct, or each struct of the slice, in rv
+func each(rv reflect.Value, fn func(reflect.Value)) {
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			fn(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		fn(rv)
+	}
+}
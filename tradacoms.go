@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ANA TRADACOMS, still used by UK grocery retailers. A transmission
+// (STX..END) holds files, each a header message, detail messages and a
+// trailer message (MHD..MTR). Segments are TAG=elements' with elements
+// separated by +, components by : and ? as the release character.
+const (
+	tradacomsElement    = '+'
+	tradacomsComponent  = ':'
+	tradacomsRelease    = '?'
+	tradacomsTerminator = '\''
+)
+
+// Layout of one TRADACOMS file type the gateway reads and writes
+type tradacomsFile struct {
+	header, detail, trailer string // message types
+	typCode, typName        string // TYP transaction code of the header
+	line, lineTrailer       string // detail segments: one per item, and the line count
+	fileTrailer             string // trailer segment counting the detail messages
+	offset                  int    // ILD carries a second sequence number before the product
+}
+
+var tradacomsFiles = []tradacomsFile{
+	{header: "ORDHDR", detail: "ORDERS", trailer: "ORDTLR", typCode: "0430", typName: "NEW-ORDERS", line: "OLD", lineTrailer: "OTR", fileTrailer: "OFT"},
+	{header: "DELHDR", detail: "DELIVR", trailer: "DELTLR", typCode: "0600", typName: "DELIVERY NOTIFICATIONS", line: "DLD", lineTrailer: "DTR", fileTrailer: "DFT"},
+	{header: "INVFIL", detail: "INVOIC", trailer: "INVTLR", typCode: "0700", typName: "INVOICES", line: "ILD", lineTrailer: "TLR", fileTrailer: "TOT", offset: 1},
+}
+
+// File of a detail message type, nil for header, trailer and other messages
+func tradacomsFileFor(detail string) *tradacomsFile {
+	for i := range tradacomsFiles {
+		if tradacomsFiles[i].detail == detail {
+			return &tradacomsFiles[i]
+		}
+	}
+	return nil
+}
+
+// File a canonical transaction type is written in; anything that is not an
+// order or invoice goes out as a delivery notification, like the 856 default
+func tradacomsFileForType(txType string) *tradacomsFile {
+	switch txType {
+	case "850", "ORDERS":
+		return &tradacomsFiles[0]
+	case "810", "INVOIC":
+		return &tradacomsFiles[2]
+	}
+	return &tradacomsFiles[1]
+}
+
+// TRADACOMS segment: tag followed by data elements, each a list of components
+type tradacomsSegment struct {
+	tag      string
+	elements [][]string
+}
+
+// Component j of element i (1-based like the standard), or "" when absent
+func (s tradacomsSegment) el(i, j int) string {
+	if i >= 1 && i <= len(s.elements) && j < len(s.elements[i-1]) {
+		return s.elements[i-1][j]
+	}
+	return ""
+}
+
+// First non-empty component of element i
+func (s tradacomsSegment) first(i int) string {
+	if i >= 1 && i <= len(s.elements) {
+		for _, c := range s.elements[i-1] {
+			if c != "" {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// One STX..END transmission
+type TradacomsTransmission struct {
+	STX      tradacomsSegment
+	Messages []TradacomsMessage
+}
+
+// One MHD..MTR message; Err is set when the message envelope is invalid
+type TradacomsMessage struct {
+	Segments []tradacomsSegment
+	Err      error
+}
+
+func (m TradacomsMessage) Type() string      { return m.Segments[0].el(2, 0) }
+func (m TradacomsMessage) Reference() string { return m.Segments[0].el(1, 0) }
+
+func (tr TradacomsTransmission) SenderCode() string { return tr.STX.el(2, 0) }
+func (tr TradacomsTransmission) Reference() string  { return tr.STX.el(5, 0) }
+
+// Split TRADACOMS data into segments, honouring the release character
+func splitTradacoms(data []byte) ([]tradacomsSegment, error) {
+	data = bytes.TrimLeft(data, " \t\r\n\ufeff")
+	var segments []tradacomsSegment
+	var seg tradacomsSegment
+	var el []string
+	var cur []byte
+	inTag := true
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == tradacomsRelease:
+			if i+1 < len(data) {
+				i++
+				cur = append(cur, data[i])
+			}
+		case inTag && c == '=':
+			seg.tag, cur, inTag = string(cur), cur[:0], false
+		case !inTag && c == tradacomsComponent:
+			el = append(el, string(cur))
+			cur = cur[:0]
+		case !inTag && c == tradacomsElement:
+			seg.elements = append(seg.elements, append(el, string(cur)))
+			el, cur = nil, cur[:0]
+		case c == tradacomsTerminator:
+			if inTag {
+				return nil, fmt.Errorf("segment %q has no tag", string(cur))
+			}
+			seg.elements = append(seg.elements, append(el, string(cur)))
+			segments = append(segments, seg)
+			seg, el, cur, inTag = tradacomsSegment{}, nil, cur[:0], true
+		case c == '\r' || c == '\n':
+			// Line breaks between segments are not data
+			if !inTag || len(cur) > 0 {
+				cur = append(cur, c)
+			}
+		default:
+			cur = append(cur, c)
+		}
+	}
+	if len(bytes.TrimSpace(cur)) > 0 || !inTag {
+		return nil, fmt.Errorf("unterminated segment at end of data")
+	}
+	return segments, nil
+}
+
+// Parse one or more STX..END transmissions. Envelope errors fail the whole
+// payload; MHD/MTR mismatches only fail the affected message.
+func parseTradacoms(data []byte) ([]TradacomsTransmission, error) {
+	segments, err := splitTradacoms(data)
+	if err != nil {
+		return nil, err
+	}
+	var out []TradacomsTransmission
+	var tr *TradacomsTransmission
+	var msg *TradacomsMessage
+	for _, seg := range segments {
+		switch seg.tag {
+		case "STX":
+			if tr != nil {
+				return nil, fmt.Errorf("STX %s: missing END", tr.Reference())
+			}
+			tr = &TradacomsTransmission{STX: seg}
+		case "END":
+			if tr == nil {
+				return nil, fmt.Errorf("END without STX")
+			}
+			if msg != nil {
+				return nil, fmt.Errorf("MHD %s: missing MTR", msg.Reference())
+			}
+			if n, err := strconv.Atoi(seg.el(1, 0)); err != nil || n != len(tr.Messages) {
+				return nil, fmt.Errorf("STX %s: END count %s, found %d messages", tr.Reference(), seg.el(1, 0), len(tr.Messages))
+			}
+			out = append(out, *tr)
+			tr = nil
+		case "MHD":
+			if tr == nil {
+				return nil, fmt.Errorf("MHD outside a transmission")
+			}
+			if msg != nil {
+				return nil, fmt.Errorf("MHD %s: missing MTR", msg.Reference())
+			}
+			msg = &TradacomsMessage{Segments: []tradacomsSegment{seg}}
+		case "MTR":
+			if msg == nil {
+				return nil, fmt.Errorf("MTR without MHD")
+			}
+			msg.Segments = append(msg.Segments, seg)
+			if n, err := strconv.Atoi(seg.el(1, 0)); err != nil || n != len(msg.Segments) {
+				msg.Err = fmt.Errorf("MHD %s: MTR count %s, found %d segments", msg.Reference(), seg.el(1, 0), len(msg.Segments))
+			}
+			tr.Messages = append(tr.Messages, *msg)
+			msg = nil
+		default:
+			if msg == nil {
+				return nil, fmt.Errorf("segment %s outside a message", seg.tag)
+			}
+			msg.Segments = append(msg.Segments, seg)
+		}
+	}
+	if tr != nil {
+		return nil, fmt.Errorf("STX %s: missing END", tr.Reference())
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no STX transmission found")
+	}
+	return out, nil
+}
+
+// Translate one detail message (ORDERS, DELIVR or INVOIC) into the canonical
+// transaction model
+func translateTradacomsMessage(ctx context.Context, tr TradacomsTransmission, msg TradacomsMessage) (Transaction, error) {
+	if msg.Err != nil {
+		return Transaction{}, msg.Err
+	}
+	f := tradacomsFileFor(msg.Type())
+	t := Transaction{
+		Type:               msg.Type(),
+		ControlNumber:      msg.Reference(),
+		InterchangeControl: tr.Reference(),
+		PartnerID:          partnerIDForSender(ctx, tr.SenderCode()),
+		sender:             tr.SenderCode(),
+	}
+	var items []Item
+	var po string
+	for _, seg := range msg.Segments {
+		switch seg.tag {
+		case "CLO": // customer location: code, then name
+			t.ShipTo = seg.first(2)
+			if t.ShipTo == "" {
+				t.ShipTo = seg.first(1)
+			}
+		case "ORD": // ORDERS order number
+			po = seg.el(1, 0)
+		case "DEL": // DELIVR delivery note number
+			t.BOL = seg.el(1, 0)
+		case "ORF": // DELIVR order reference for the following lines
+			po = seg.el(2, 0)
+		case "ODD": // INVOIC order and delivery references
+			po = seg.el(2, 0)
+			if t.BOL == "" {
+				t.BOL = seg.el(3, 0)
+			}
+		case f.line: // SEQA [SEQB] SPRO SACU CPRO UNOR QTY TDES
+			o := f.offset
+			it := Item{
+				SKU:         seg.first(2 + o),
+				Quantity:    parseQty(seg.el(6+o, 0)),
+				UOM:         seg.el(6+o, 2),
+				Description: seg.el(7+o, 0),
+				PONumber:    po,
+			}
+			if it.SKU == "" {
+				it.SKU = seg.first(4 + o)
+			}
+			items = append(items, it)
+		}
+	}
+	if items != nil {
+		list, err := json.Marshal(items)
+		if err != nil {
+			return Transaction{}, err
+		}
+		t.ItemList = string(list)
+	}
+	if err := applyPartnerMap(ctx, "inbound", &t, nil); err != nil {
+		return Transaction{annotations: t.annotations}, err // shows the failing rule
+	}
+	return t, nil
+}
+
+// Split parsed transmissions into transactions, one per detail message.
+// Header and trailer messages only carry file totals and are skipped unless
+// their envelope is invalid.
+func splitTradacomsTransmissions(ctx context.Context, transmissions []TradacomsTransmission, now time.Time) []splitResult {
+	var out []splitResult
+	for _, tr := range transmissions {
+		for _, msg := range tr.Messages {
+			if tradacomsFileFor(msg.Type()) == nil && msg.Err == nil {
+				continue
+			}
+			t, err := translateTradacomsMessage(ctx, tr, msg)
+			t.Date = now
+			if err != nil {
+				t.Type, t.ControlNumber, t.InterchangeControl = msg.Type(), msg.Reference(), tr.Reference()
+			}
+			out = append(out, splitResult{Transaction: t, Err: err})
+		}
+	}
+	return out
+}
+
+// Builds TRADACOMS segments and keeps the message segment count
+type tradacomsWriter struct {
+	sb       bytes.Buffer
+	messages int
+	segments int // in the current message
+}
+
+var tradacomsEscaper = strings.NewReplacer("?", "??", "+", "?+", ":", "?:", "'", "?'", "=", "?=")
+
+// Write one segment; each element is a list of components. Trailing empty
+// elements and components are dropped.
+func (w *tradacomsWriter) seg(tag string, elements ...[]string) {
+	for len(elements) > 0 && strings.Join(elements[len(elements)-1], "") == "" {
+		elements = elements[:len(elements)-1]
+	}
+	w.sb.WriteString(tag)
+	w.sb.WriteByte('=')
+	for i, el := range elements {
+		if i > 0 {
+			w.sb.WriteByte(tradacomsElement)
+		}
+		for len(el) > 0 && el[len(el)-1] == "" {
+			el = el[:len(el)-1]
+		}
+		for j, c := range el {
+			if j > 0 {
+				w.sb.WriteByte(tradacomsComponent)
+			}
+			w.sb.WriteString(tradacomsEscaper.Replace(c))
+		}
+	}
+	w.sb.WriteByte(tradacomsTerminator)
+	w.sb.WriteByte('\n')
+	w.segments++
+}
+
+func (w *tradacomsWriter) openMessage(msgType string) {
+	w.messages++
+	w.segments = 0
+	w.seg("MHD", tc(fmt.Sprint(w.messages)), tc(msgType, "9"))
+}
+
+func (w *tradacomsWriter) closeMessage() {
+	w.seg("MTR", tc(fmt.Sprint(w.segments+1)))
+}
+
+// Components of one element
+func tc(components ...string) []string {
+	return components
+}
+
+// Build a TRADACOMS transmission for a partner, with one file per message
+// type in the order the transactions first use them. Returns the
+// transmission and its sender's reference.
+func buildTradacomsTransmission(ctx context.Context, p Partner, transactions []Transaction) (string, string, error) {
+	control, err := nextControlNumber(ctx, &p)
+	if err != nil {
+		return "", "", err
+	}
+	var files []*tradacomsFile
+	byFile := map[*tradacomsFile][]Transaction{}
+	for _, t := range transactions {
+		f := tradacomsFileForType(t.Type)
+		if byFile[f] == nil {
+			files = append(files, f)
+		}
+		byFile[f] = append(byFile[f], t)
+	}
+	app := ""
+	if len(files) == 1 {
+		app = files[0].header
+	}
+	now := time.Now()
+	ref := fmt.Sprint(control)
+	w := &tradacomsWriter{}
+	w.seg("STX", tc("ANAA", "1"), tc(senderID), tc(p.ISAID, p.Name), tc(now.Format("060102"), now.Format("150405")), tc(ref), nil, tc(app))
+	for n, f := range files {
+		w.openMessage(f.header)
+		w.seg("TYP", tc(f.typCode), tc(f.typName))
+		w.seg("SDT", tc(senderID))
+		w.seg("CDT", tc(p.ISAID), tc(p.Name))
+		w.seg("FIL", tc(fmt.Sprint(control)), tc(fmt.Sprint(n+1)), tc(now.Format("060102")))
+		w.closeMessage()
+		for _, t := range byFile[f] {
+			if err := writeTradacomsDetail(ctx, w, f, t, now); err != nil {
+				settleControlNumber(ctx, p.ID, control, controlVoided, "", err.Error())
+				return "", "", err
+			}
+		}
+		w.openMessage(f.trailer)
+		w.seg(f.fileTrailer, tc(fmt.Sprint(len(byFile[f]))))
+		w.closeMessage()
+	}
+	w.seg("END", tc(fmt.Sprint(w.messages)))
+	return w.sb.String(), ref, nil
+}
+
+// Write one ORDERS, DELIVR or INVOIC message
+func writeTradacomsDetail(ctx context.Context, w *tradacomsWriter, f *tradacomsFile, t Transaction, now time.Time) error {
+	if err := applyPartnerMap(ctx, "outbound", &t, nil); err != nil {
+		return err
+	}
+	items, err := t.Items()
+	if err != nil {
+		return err
+	}
+	date := t.Date
+	if date.IsZero() {
+		date = now
+	}
+	w.openMessage(f.detail)
+	w.seg("CLO", nil, tc(t.ShipTo))
+	lines := 0
+	writeLines := func(items []Item) {
+		for _, it := range items {
+			lines++
+			el := make([][]string, 0, 8)
+			el = append(el, tc(fmt.Sprint(lines)))
+			if f.offset > 0 {
+				el = append(el, tc("1"))
+			}
+			el = append(el, tc(it.SKU), nil, nil, nil, tc(formatQty(it.Quantity), "", it.UOM), tc(it.Description))
+			w.seg(f.line, el...)
+		}
+	}
+	groups := groupBy(items, func(it Item) string { return it.PONumber })
+	switch f.detail {
+	case "ORDERS":
+		po := ""
+		if len(groups) > 0 {
+			po = groups[0].key
+		}
+		w.seg("ORD", tc(po, "", date.Format("060102")))
+		writeLines(items)
+	case "DELIVR":
+		w.seg("DEL", tc(t.BOL, date.Format("060102")))
+		for i, g := range groups {
+			w.seg("ORF", tc(fmt.Sprint(i+1)), tc(g.key))
+			writeLines(g.items)
+		}
+	case "INVOIC":
+		w.seg("IRF", tc(shipmentID(t), date.Format("060102")))
+		for i, g := range groups {
+			w.seg("ODD", tc(fmt.Sprint(i+1)), tc(g.key), tc(t.BOL))
+			writeLines(g.items)
+		}
+	}
+	w.seg(f.lineTrailer, tc(fmt.Sprint(lines)))
+	w.closeMessage()
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Translate one X12 transaction set into the canonical transaction model
+func translateX12Set(ctx context.Context, ic X12Interchange, set X12Set) (Transaction, error) {
+	if set.Err != nil {
+		return Transaction{}, set.Err
+	}
+	t := Transaction{
+		Type:               set.Type(),
+		ControlNumber:      set.ControlNumber(),
+		InterchangeControl: ic.ControlNumber(),
+		PartnerID:          partnerIDForSender(ctx, ic.SenderID()),
+		sender:             ic.SenderID(),
+		set:                &set,
+	}
+	var items []Item
+	var current *Item
+	var po, carton string
+	var poRef, cartonRef string // elements po and carton came from, for annotations
+	var poAt, cartonAt int
+	debug := mappingDebug(ctx)
+	// Annotate field with the element ref of the segment at index i
+	note := func(field, value string, i int, ref string) {
+		if debug && value != "" {
+			t.annotations = append(t.annotations, fieldAnnotation{Field: field, Value: value, Segment: ref, Position: i + 1})
+		}
+	}
+	segments := set.Segments
+	if hipaaSet(t.Type) {
+		if err := validateHIPAA(ctx, ic, set, t.PartnerID); err != nil {
+			return Transaction{}, err
+		}
+		items, segments = translateHIPAASet(&t, set, ic.Delimiters), nil
+	}
+	note("type", t.Type, 0, "ST.01")
+	// Annotate the item just added
+	noteItem := func(seg Segment, i int, fields ...string) {
+		if !debug {
+			return
+		}
+		n := len(items) - 1
+		for j := 0; j+1 < len(fields); j += 2 {
+			v, _ := itemField(current, fields[j])
+			note(fmt.Sprintf("items[%d].%s", n, fields[j]), v, i, seg[0]+"."+fields[j+1])
+		}
+		note(fmt.Sprintf("items[%d].po_number", n), current.PONumber, poAt, poRef)
+		note(fmt.Sprintf("items[%d].carton", n), current.Carton, cartonAt, cartonRef)
+	}
+	for i, seg := range segments {
+		switch seg[0] {
+		case "BEG": // 850 purchase order number
+			po, poRef, poAt = seg.el(3), "BEG.03", i
+			t.refs.PONumber = po
+		case "BAK", "BCH": // 855 acknowledgment, 860 change; element 3 is the PO
+			po, poRef, poAt = seg.el(3), seg[0]+".03", i
+			t.refs.PONumber = po
+		case "BIG": // 810 invoice; BIG04 is the PO
+			po, poRef, poAt = seg.el(4), "BIG.04", i
+			t.refs.PONumber, t.refs.Number = po, seg.el(2)
+		case "BSN": // 856 shipment identification
+			t.refs.Number = seg.el(2)
+		case "N1":
+			if seg.el(1) == "ST" {
+				t.ShipTo = seg.el(2)
+				note("ship_to", t.ShipTo, i, "N1*ST.02")
+			}
+		case "TD5":
+			t.Carrier = seg.el(3)
+			note("carrier", t.Carrier, i, "TD5.03")
+		case "REF":
+			if seg.el(1) == "BM" {
+				t.BOL = seg.el(2)
+				note("bol", t.BOL, i, "REF*BM.02")
+			}
+		case "PRF":
+			po, poRef, poAt = seg.el(1), "PRF.01", i
+		case "MAN":
+			carton, cartonRef, cartonAt = seg.el(2), "MAN.02", i
+		case "LIN": // 856 item
+			items = append(items, Item{SKU: productID(seg, 2), PONumber: po, Carton: carton})
+			current = &items[len(items)-1]
+			noteItem(seg, i, "sku", fmt.Sprintf("%02d", productElement(seg, 2)))
+		case "SN1":
+			if current != nil {
+				current.Quantity = parseQty(seg.el(2))
+				current.UOM = seg.el(3)
+				n := len(items) - 1
+				note(fmt.Sprintf("items[%d].quantity", n), seg.el(2), i, "SN1.02")
+				note(fmt.Sprintf("items[%d].uom", n), current.UOM, i, "SN1.03")
+			}
+		case "PO1", "IT1": // 850 / 810 line
+			items = append(items, Item{
+				SKU:      productID(seg, 6),
+				Quantity: parseQty(seg.el(2)),
+				UOM:      seg.el(3),
+				PONumber: po,
+			})
+			current = &items[len(items)-1]
+			noteItem(seg, i, "sku", fmt.Sprintf("%02d", productElement(seg, 6)), "quantity", "02", "uom", "03")
+		case "PID":
+			if current != nil && seg.el(5) != "" {
+				current.Description = seg.el(5)
+				note(fmt.Sprintf("items[%d].description", len(items)-1), current.Description, i, "PID.05")
+			}
+		}
+	}
+	if items != nil {
+		list, err := json.Marshal(items)
+		if err != nil {
+			return Transaction{}, err
+		}
+		t.ItemList = string(list)
+	}
+	if t.Type == "997" || t.Type == "999" {
+		t.ack = parseFunctionalAck(set)
+	}
+	if err := applyPartnerMap(ctx, "inbound", &t, &set); err != nil {
+		return Transaction{annotations: t.annotations}, err // shows the failing rule
+	}
+	return t, nil
+}
+
+// First product ID from qualifier/value pairs starting at element i
+func productID(seg Segment, i int) string {
+	if n := productElement(seg, i); n > 0 {
+		return seg[n]
+	}
+	return ""
+}
+
+// Element holding that product ID, or 0
+func productElement(seg Segment, i int) int {
+	for ; i+1 < len(seg); i += 2 {
+		if seg[i+1] != "" {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func parseQty(s string) float64 {
+	q, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return q
+}
+
+// Partner whose ISA ID matches the interchange sender, if any
+func partnerIDForSender(ctx context.Context, sender string) string {
+	if db == nil {
+		return "" // offline CLI
+	}
+	var p Partner
+	if err := db.WithContext(ctx).Select("id").Where("isa_id = ?", sender).Limit(1).Find(&p).Error; err != nil {
+		log.Printf("ERROR: partner lookup for sender %q: %v\n", sender, err)
+	}
+	return p.ID
+}
+
+// Transaction split out of an interchange, or why it could not be
+type splitResult struct {
+	Transaction Transaction
+	Err         error
+}
+
+// Split parsed interchanges into transactions, one per transaction set
+func splitInterchanges(ctx context.Context, interchanges []X12Interchange, now time.Time) []splitResult {
+	var out []splitResult
+	for _, ic := range interchanges {
+		for _, g := range ic.Groups {
+			for _, set := range g.Sets {
+				t, err := translateX12Set(ctx, ic, set)
+				t.Date = now
+				if err != nil {
+					t.Type, t.ControlNumber, t.InterchangeControl = set.Type(), set.ControlNumber(), ic.ControlNumber()
+				}
+				out = append(out, splitResult{Transaction: t, Err: err})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Types of transaction events
+const (
+	txEventImported       = "imported" // state when event sourcing was introduced
+	txEventReceived       = "received"
+	txEventReleased       = "released"
+	txEventForwarded      = "forwarded"
+	txEventDelivered      = "delivered"
+	txEventAwaitingMDN    = "awaiting_mdn"
+	txEventDeliveryFailed = "delivery_failed"
+	txEventMDNReceived    = "mdn_received"
+	txEventAcknowledged   = "acknowledged"
+	txEventRejected       = "rejected"
+)
+
+// One state transition of a transaction. Events are only appended, never
+// updated, and only deleted with their transaction by retention (on
+// PostgreSQL a trigger rejects anything else): a transaction's status is
+// the status of its latest event that set one, and the status column only
+// caches it for search and listing.
+type TransactionEvent struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TenantID      string    `json:"tenant_id" gorm:"index"`
+	TransactionID string    `json:"transaction_id" gorm:"index"`
+	Type          string    `json:"type"`
+	Status        string    `json:"status,omitempty"` // set by the event; "" leaves the status as it was
+	Actor         string    `json:"actor"`
+	Delta         string    `json:"-"` // JSON object of the fields the event set
+	CreatedAt     time.Time `json:"created_at" gorm:"index"`
+
+	Changes json.RawMessage `json:"delta,omitempty" gorm:"-"`
+}
+
+// Event of a transaction, by the actor of ctx
+func newTransactionEvent(ctx context.Context, transactionID, eventType, status string, delta map[string]interface{}) TransactionEvent {
+	e := TransactionEvent{TransactionID: transactionID, Type: eventType, Status: status, Actor: auditorFrom(ctx).actor}
+	if status != "" {
+		if delta == nil {
+			delta = map[string]interface{}{}
+		}
+		delta["status"] = status
+	}
+	if len(delta) > 0 {
+		data, _ := json.Marshal(delta)
+		e.Delta = string(data)
+	}
+	return e
+}
+
+// What the received event of an inbound transaction records, with the
+// document rule it matched
+func receivedDelta(t Transaction) map[string]interface{} {
+	delta := map[string]interface{}{"partner_id": t.PartnerID, "type": t.Type, "format": t.Format}
+	if t.RuleID != 0 {
+		delta["rule_id"] = t.RuleID
+	}
+	return delta
+}
+
+// Append the event of a transaction just created in tx, whose status is
+// already the one the event sets
+func appendReceivedEvent(ctx context.Context, tx *gorm.DB, t Transaction, delta map[string]interface{}) error {
+	e := newTransactionEvent(ctx, t.ID, txEventReceived, t.Status, delta)
+	return tx.Create(&e).Error
+}
+
+// Append an event to a transaction's stream and, when it sets a status,
+// derive the transaction's status from the stream again
+func recordTransactionEvent(ctx context.Context, transactionID, eventType, status string, delta map[string]interface{}) error {
+	e := newTransactionEvent(ctx, transactionID, eventType, status, delta)
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&e).Error; err != nil {
+			return err
+		}
+		if status == "" {
+			return nil
+		}
+		latest := tx.Session(&gorm.Session{NewDB: true}).Model(&TransactionEvent{}).Select("status").
+			Where("transaction_id = ? AND status <> ''", transactionID).Order("id DESC").Limit(1)
+		return tx.Model(&Transaction{}).Where("id = ?", transactionID).Update("status", latest).Error
+	})
+}
+
+// Record the same event for each of a delivery's transactions, logging
+// failures: the delivery itself is already recorded
+func recordDeliveryEvents(ctx context.Context, ids []string, eventType string, delta map[string]interface{}) {
+	for _, id := range ids {
+		if err := recordTransactionEvent(ctx, id, eventType, "", delta); err != nil {
+			log.Printf("ERROR: transaction %s %s event: %v\n", id, eventType, err)
+		}
+	}
+}
+
+// Status a stream of events leaves a transaction in
+func statusFromEvents(events []TransactionEvent) string {
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Status != "" {
+			return events[i].Status
+		}
+	}
+	return ""
+}
+
+// A transaction's event stream and the status derived from it
+type transactionHistory struct {
+	TransactionID string             `json:"transaction_id"`
+	Status        string             `json:"status"`
+	Events        []TransactionEvent `json:"events"`
+}
+
+// List the state transitions of a transaction, oldest first
+func listTransactionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var t Transaction
+	err := db.WithContext(r.Context()).Select("id", "status").First(&t, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch transaction", http.StatusInternalServerError)
+		return
+	}
+	h := transactionHistory{TransactionID: id, Events: []TransactionEvent{}}
+	if err := db.WithContext(r.Context()).Where("transaction_id = ?", id).Order("id").Find(&h.Events).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch events", http.StatusInternalServerError)
+		return
+	}
+	for i := range h.Events {
+		if h.Events[i].Delta != "" {
+			h.Events[i].Changes = json.RawMessage(h.Events[i].Delta)
+		}
+	}
+	if h.Status = statusFromEvents(h.Events); h.Status == "" {
+		h.Status = t.Status // received before events were recorded
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
+
+// A transaction as it stood at AsOf: its document, which does not change
+// once received, with the status it had then and the fields its events had
+// set by then
+type transactionSnapshot struct {
+	Transaction
+	AsOf   time.Time              `json:"as_of"`
+	State  map[string]interface{} `json:"state"`  // the deltas of the events up to as_of, merged
+	Events []TransactionEvent     `json:"events"` // up to as_of, oldest first
+}
+
+// Status changes of a transaction recorded by the audit log, oldest first
+func auditedStatuses(ctx context.Context, id string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := db.WithContext(ctx).Where("resource_type = ? AND resource_id = ? AND action IN ?", "transaction", id, []string{auditUpdate, auditRelease}).
+		Order("id").Find(&entries).Error
+	return entries, err
+}
+
+// Status field of an audited JSON state, "" if it has none
+func auditedStatus(state string) string {
+	var fields struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal([]byte(state), &fields)
+	return fields.Status
+}
+
+// Replay a transaction's events up to asOf. Transactions received before
+// events were recorded start with an imported event, dated when they were
+// received, holding the status they had when events were introduced: until
+// a later event sets one, their status comes from the status changes in the
+// audit log.
+func transactionAt(ctx context.Context, t Transaction, events []TransactionEvent, asOf time.Time) (transactionSnapshot, error) {
+	snap := transactionSnapshot{Transaction: t, AsOf: asOf, State: map[string]interface{}{}, Events: []TransactionEvent{}}
+	for _, e := range events {
+		if e.CreatedAt.After(asOf) {
+			break
+		}
+		var delta map[string]interface{}
+		if json.Unmarshal([]byte(e.Delta), &delta) == nil {
+			for k, v := range delta {
+				snap.State[k] = v
+			}
+			e.Changes = json.RawMessage(e.Delta)
+		}
+		snap.Events = append(snap.Events, e)
+	}
+	snap.Status = statusFromEvents(snap.Events)
+	if len(events) == 0 || events[0].Type != txEventImported || len(snap.Events) > 1 && statusFromEvents(snap.Events[1:]) != "" {
+		return snap, nil
+	}
+	entries, err := auditedStatuses(ctx, t.ID)
+	if err != nil {
+		return snap, err
+	}
+	snap.Status = events[0].Status
+	for i, a := range entries {
+		if a.CreatedAt.After(asOf) {
+			if before := auditedStatus(a.Before); i == 0 && before != "" {
+				snap.Status = before
+			}
+			break
+		}
+		if after := auditedStatus(a.After); after != "" {
+			snap.Status = after
+		}
+	}
+	snap.State["status"] = snap.Status
+	return snap, nil
+}
+
+// Fetch a transaction or, with as_of (RFC 3339), the state it was in then
+func getTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	var asOf *time.Time
+	q := r.URL.Query()
+	if v := q.Get("as_of") + q.Get("asOf"); v != "" {
+		ts, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeProblem(w, "as_of must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		asOf = &ts
+	}
+	var t Transaction
+	err := db.WithContext(r.Context()).First(&t, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Transaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch transaction", http.StatusInternalServerError)
+		return
+	}
+	txs := []Transaction{t}
+	if err := readItems(r.Context(), txs); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch line items", http.StatusInternalServerError)
+		return
+	}
+	t = txs[0]
+	if asOf == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+		return
+	}
+	if asOf.Before(t.Date) {
+		writeProblem(w, "Transaction "+t.ID+" was received at "+t.Date.UTC().Format(time.RFC3339)+", after as_of", http.StatusNotFound)
+		return
+	}
+	var events []TransactionEvent
+	if err := db.WithContext(r.Context()).Where("transaction_id = ?", t.ID).Order("id").Find(&events).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch events", http.StatusInternalServerError)
+		return
+	}
+	snap, err := transactionAt(r.Context(), t, events, *asOf)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
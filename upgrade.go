@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Result of analysing a partner's archived documents for a version upgrade
+type upgradeReport struct {
+	PartnerID   string           `json:"partner_id"`
+	From        string           `json:"from"`
+	To          string           `json:"to"`
+	Documents   int              `json:"documents"`
+	Unparsable  int              `json:"unparsable"`
+	Versions    map[string]int   `json:"versions_seen"` // GS08 -> interchanges
+	Sets        map[string]int   `json:"transaction_sets"`
+	Segments    []segmentUsage   `json:"segments"`
+	Findings    []upgradeFinding `json:"findings"`
+	segmentRefs map[string]*segmentUsage
+}
+
+// Usage of one segment within one transaction set type
+type segmentUsage struct {
+	Set         string         `json:"set"`
+	Segment     string         `json:"segment"`
+	Occurrences int            `json:"occurrences"`
+	MaxLengths  map[string]int `json:"max_element_lengths"` // element position -> longest value seen
+}
+
+// Something that changes or breaks when the partner moves versions
+type upgradeFinding struct {
+	Rule        string `json:"rule"`
+	Severity    string `json:"severity"` // break, change or info
+	Occurrences int    `json:"occurrences"`
+	Detail      string `json:"detail"`
+	Example     string `json:"example,omitempty"`
+}
+
+// Analyse up to ?limit= archived payloads of a partner and report what would
+// need attention moving from ?from= (default 004010) to ?to= (default 005010)
+func upgradeReportHandler(w http.ResponseWriter, r *http.Request) {
+	partnerID := mux.Vars(r)["id"]
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		from = "004010"
+	}
+	if to == "" {
+		to = "005010"
+	}
+	if !isX12Version(from) || !isX12Version(to) {
+		writeProblem(w, "Versions must look like 004010", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 500
+	}
+	if archive == nil {
+		writeProblem(w, "Archival is disabled", http.StatusNotFound)
+		return
+	}
+
+	var keys []string
+	err = db.WithContext(r.Context()).Model(&RawPayload{}).
+		Joins("JOIN transactions ON transactions.id = raw_payloads.transaction_id").
+		Where("transactions.partner_id = ?", partnerID).
+		Distinct("raw_payloads.storage_key").Limit(limit).Pluck("raw_payloads.storage_key", &keys).Error
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch documents", http.StatusInternalServerError)
+		return
+	}
+
+	rep := &upgradeReport{
+		PartnerID:   partnerID,
+		From:        from,
+		To:          to,
+		Versions:    map[string]int{},
+		Sets:        map[string]int{},
+		segmentRefs: map[string]*segmentUsage{},
+	}
+	findings := map[string]*upgradeFinding{}
+	for _, key := range keys {
+		data, err := archive.Get(r.Context(), key)
+		if err != nil {
+			continue
+		}
+		interchanges, err := parseX12(data)
+		if err != nil {
+			rep.Unparsable++
+			continue
+		}
+		rep.Documents++
+		for _, ic := range interchanges {
+			analyseInterchange(rep, findings, ic, from, to)
+		}
+	}
+
+	for _, u := range rep.segmentRefs {
+		rep.Segments = append(rep.Segments, *u)
+	}
+	sort.Slice(rep.Segments, func(i, j int) bool {
+		if rep.Segments[i].Set != rep.Segments[j].Set {
+			return rep.Segments[i].Set < rep.Segments[j].Set
+		}
+		return rep.Segments[i].Segment < rep.Segments[j].Segment
+	})
+	for _, f := range findings {
+		rep.Findings = append(rep.Findings, *f)
+	}
+	severity := map[string]int{"break": 0, "change": 1, "info": 2}
+	sort.Slice(rep.Findings, func(i, j int) bool {
+		a, b := rep.Findings[i], rep.Findings[j]
+		if severity[a.Severity] != severity[b.Severity] {
+			return severity[a.Severity] < severity[b.Severity]
+		}
+		return a.Rule < b.Rule
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+// Collect usage and findings for one interchange
+func analyseInterchange(rep *upgradeReport, findings map[string]*upgradeFinding, ic X12Interchange, from, to string) {
+	note := func(rule, severity, detail, example string) {
+		f, ok := findings[rule]
+		if !ok {
+			f = &upgradeFinding{Rule: rule, Severity: severity, Detail: detail, Example: example}
+			findings[rule] = f
+		}
+		f.Occurrences++
+	}
+	upgrading5010 := from < "005010" && to >= "005010"
+
+	if upgrading5010 && ic.ISA.el(11) == "U" {
+		note("ISA11_REPETITION_SEPARATOR", "change",
+			"ISA11 changes from the standards identifier 'U' to the repetition separator in 00501 envelopes", "")
+	}
+	if ic.ISA.el(12) != to[:5] {
+		note("ISA12_VERSION", "change", fmt.Sprintf("ISA12 must change from %s to %s", ic.ISA.el(12), to[:5]), "")
+	}
+	// Characters that become the repetition separator split values in two
+	repetition := "^"
+	for _, g := range ic.Groups {
+		version := g.GS.el(8)
+		rep.Versions[version]++
+		if version != to {
+			note("GS08_VERSION", "change", fmt.Sprintf("GS08 must change from %s to %s", version, to), "")
+		}
+		for _, set := range g.Sets {
+			rep.Sets[set.Type()]++
+			if upgrading5010 && set.Type() == "997" {
+				note("ACK_997_TO_999", "info",
+					"997 remains valid in 005010 but many 5010 partners expect 999 implementation acknowledgments", "")
+			}
+			for _, seg := range set.Segments {
+				recordSegment(rep, set.Type(), seg)
+				if !upgrading5010 {
+					continue
+				}
+				for i, el := range seg[1:] {
+					if strings.Contains(el, repetition) {
+						note("REPETITION_SEPARATOR_IN_DATA", "break",
+							fmt.Sprintf("data contains '%s', which 00501 envelopes commonly use as the repetition separator", repetition),
+							fmt.Sprintf("%s%02d=%q", seg[0], i+1, el))
+					}
+				}
+			}
+		}
+	}
+}
+
+func recordSegment(rep *upgradeReport, set string, seg Segment) {
+	key := set + "/" + seg[0]
+	u, ok := rep.segmentRefs[key]
+	if !ok {
+		u = &segmentUsage{Set: set, Segment: seg[0], MaxLengths: map[string]int{}}
+		rep.segmentRefs[key] = u
+	}
+	u.Occurrences++
+	for i, el := range seg[1:] {
+		pos := fmt.Sprintf("%02d", i+1)
+		if len(el) > u.MaxLengths[pos] {
+			u.MaxLengths[pos] = len(el)
+		}
+	}
+}
+
+func isX12Version(v string) bool {
+	_, err := strconv.Atoi(v)
+	return len(v) == 6 && err == nil
+}
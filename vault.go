@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Minimal HashiCorp Vault client keeping secrets in a KV version 2 engine.
+// Each secret is written once under its own path and referenced with its
+// version, so values never change under a reference and are cached.
+type vaultSecrets struct {
+	addr      string // e.g. https://vault:8200
+	token     string
+	namespace string // Vault Enterprise namespace, if any
+	mount     string // path of the KV engine
+	prefix    string // secrets are kept under mount/prefix/<tenant>/<partner>/
+	client    *http.Client
+	cache     sync.Map // ref to value
+}
+
+func newVaultSecrets() *vaultSecrets {
+	return &vaultSecrets{
+		addr:      strings.TrimRight(getEnv("VAULT_ADDR", "http://vault:8200"), "/"),
+		token:     getEnv("VAULT_TOKEN", ""),
+		namespace: getEnv("VAULT_NAMESPACE", ""),
+		mount:     strings.Trim(getEnv("VAULT_MOUNT", "secret"), "/"),
+		prefix:    strings.Trim(getEnv("VAULT_PREFIX", "edi-gateway/partners"), "/"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (v *vaultSecrets) put(ctx context.Context, c *PartnerCredential, value string) error {
+	path := strings.Join([]string{v.prefix, tenantID(ctx), c.PartnerID, uuid.NewString()}, "/")
+	body, _ := json.Marshal(map[string]interface{}{"data": map[string]string{"value": value}})
+	var out struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodPost, path, nil, body, &out); err != nil {
+		return err
+	}
+	c.Ref = path + "?version=" + strconv.Itoa(out.Data.Version)
+	v.cache.Store(c.Ref, value)
+	return nil
+}
+
+func (v *vaultSecrets) get(ctx context.Context, c PartnerCredential) (string, error) {
+	if value, ok := v.cache.Load(c.Ref); ok {
+		return value.(string), nil
+	}
+	path, version, _ := strings.Cut(c.Ref, "?version=")
+	if path == "" {
+		return "", fmt.Errorf("credential %d has no vault reference", c.ID)
+	}
+	var out struct {
+		Data struct {
+			Data struct {
+				Value string `json:"value"`
+			} `json:"data"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, path, url.Values{"version": {version}}, nil, &out); err != nil {
+		return "", err
+	}
+	v.cache.Store(c.Ref, out.Data.Data.Value)
+	return out.Data.Data.Value, nil
+}
+
+// Call the KV engine's data endpoint of path and decode the response into out
+func (v *vaultSecrets) do(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) error {
+	u := v.addr + "/v1/" + v.mount + "/data/" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("vault %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Read models aggregating transactions into business documents: the order
+// with its acknowledgments, changes, shipments and invoices, the shipment
+// with its cartons and the invoice. They are maintained as transactions are
+// saved, so they cover transactions received since they were introduced.
+
+// Header references of a translated document that the canonical transaction
+// does not keep
+type documentRefs struct {
+	PONumber string // BEG03, BAK03, BCH03, BIG04 or the ORDERS BGM
+	Number   string // shipment (BSN02) or invoice (BIG02) number
+}
+
+// Business document kinds of transaction types
+const (
+	kindOrder       = "order"
+	kindOrderAck    = "order_ack"
+	kindOrderChange = "order_change"
+	kindShipment    = "shipment"
+	kindInvoice     = "invoice"
+)
+
+func documentKind(txType string) string {
+	switch txType {
+	case "850", "ORDERS":
+		return kindOrder
+	case "855", "ORDRSP":
+		return kindOrderAck
+	case "860", "ORDCHG":
+		return kindOrderChange
+	case "856", "DESADV", "DELIVR":
+		return kindShipment
+	case "810", "INVOIC":
+		return kindInvoice
+	}
+	return ""
+}
+
+// Order states, from the documents seen for it
+const (
+	orderOpen             = "open"
+	orderAcknowledged     = "acknowledged"
+	orderChanged          = "changed"
+	orderPartiallyShipped = "partially_shipped"
+	orderShipped          = "shipped"
+	orderInvoiced         = "invoiced"
+)
+
+// A purchase order of a partner and every document referencing it
+type Order struct {
+	ID                 uint      `json:"id" gorm:"primaryKey"`
+	TenantID           string    `json:"tenant_id" gorm:"index"`
+	PartnerID          string    `json:"partner_id" gorm:"uniqueIndex:idx_orders_partner_po"`
+	PONumber           string    `json:"po_number" gorm:"uniqueIndex:idx_orders_partner_po"`
+	Status             string    `json:"status" gorm:"index"`
+	OrderTransactionID string    `json:"order_transaction_id,omitempty"` // the 850 or ORDERS
+	OrderedQuantity    float64   `json:"ordered_quantity"`
+	ShippedQuantity    float64   `json:"shipped_quantity"`
+	InvoicedQuantity   float64   `json:"invoiced_quantity"`
+	History            string    `json:"-"` // JSON array of orderDocument
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at" gorm:"index"`
+
+	Documents []orderDocument `json:"documents" gorm:"-"`
+	Shipments []Shipment      `json:"shipments,omitempty" gorm:"-"`
+	Invoices  []Invoice       `json:"invoices,omitempty" gorm:"-"`
+}
+
+// One transaction referencing an order
+type orderDocument struct {
+	TransactionID string    `json:"transaction_id"`
+	Type          string    `json:"type"`
+	Kind          string    `json:"kind"`
+	Date          time.Time `json:"date"`
+	Quantity      float64   `json:"quantity"` // of the order's lines
+}
+
+// A shipment notice (856, DESADV or DELIVR) and its cartons
+type Shipment struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	TenantID       string    `json:"tenant_id" gorm:"index"`
+	PartnerID      string    `json:"partner_id" gorm:"index"`
+	TransactionID  string    `json:"transaction_id" gorm:"uniqueIndex"`
+	ShipmentNumber string    `json:"shipment_number,omitempty" gorm:"index"` // BSN02, else the BOL
+	BOL            string    `json:"bol,omitempty"`
+	Carrier        string    `json:"carrier,omitempty"`
+	ShipTo         string    `json:"ship_to,omitempty" gorm:"serializer:encrypted"`
+	PONumbers      string    `json:"po_numbers"` // JSON array
+	Cartons        string    `json:"cartons"`    // JSON array of carton IDs
+	CartonCount    int       `json:"carton_count"`
+	Lines          int       `json:"lines"`
+	Quantity       float64   `json:"quantity"`
+	Status         string    `json:"status" gorm:"index"` // of the transaction, e.g. Processed or Acknowledged
+	ShippedAt      time.Time `json:"shipped_at" gorm:"index"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// An invoice (810 or INVOIC)
+type Invoice struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TenantID      string    `json:"tenant_id" gorm:"index"`
+	PartnerID     string    `json:"partner_id" gorm:"index"`
+	TransactionID string    `json:"transaction_id" gorm:"uniqueIndex"`
+	InvoiceNumber string    `json:"invoice_number,omitempty" gorm:"index"`
+	PONumber      string    `json:"po_number,omitempty" gorm:"index"`
+	Lines         int       `json:"lines"`
+	Quantity      float64   `json:"quantity"`
+	Status        string    `json:"status" gorm:"index"`
+	InvoicedAt    time.Time `json:"invoiced_at" gorm:"index"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Update the views with a saved transaction. Like the ledger this is
+// bookkeeping: failures are logged and never fail the transaction.
+func projectTransaction(ctx context.Context, t Transaction) {
+	kind := documentKind(t.Type)
+	if kind == "" || t.PartnerID == "" || db == nil {
+		return
+	}
+	if err := project(ctx, kind, t); err != nil {
+		log.Printf("ERROR: views %s %s: %v\n", t.Type, t.ID, err)
+	}
+}
+
+func project(ctx context.Context, kind string, t Transaction) error {
+	items, err := t.Items()
+	if err != nil {
+		return err
+	}
+	// Quantity per PO; lines without a PO count against the header PO
+	var pos []string
+	quantities := map[string]float64{}
+	var total float64
+	cartons := []string{}
+	seen := map[string]bool{}
+	for _, it := range items {
+		po := it.PONumber
+		if po == "" {
+			po = t.refs.PONumber
+		}
+		if _, ok := quantities[po]; !ok && po != "" {
+			pos = append(pos, po)
+		}
+		quantities[po] += it.Quantity
+		total += it.Quantity
+		if it.Carton != "" && !seen[it.Carton] {
+			seen[it.Carton] = true
+			cartons = append(cartons, it.Carton)
+		}
+	}
+	if len(pos) == 0 && t.refs.PONumber != "" {
+		pos = []string{t.refs.PONumber}
+	}
+
+	scoped := db.WithContext(ctx)
+	switch kind {
+	case kindShipment:
+		number := t.refs.Number
+		if number == "" {
+			number = t.BOL
+		}
+		poList, _ := json.Marshal(append([]string{}, pos...))
+		cartonList, _ := json.Marshal(cartons)
+		s := Shipment{PartnerID: t.PartnerID, TransactionID: t.ID, ShipmentNumber: number, BOL: t.BOL, Carrier: t.Carrier,
+			ShipTo: t.ShipTo, PONumbers: string(poList), Cartons: string(cartonList), CartonCount: len(cartons),
+			Lines: len(items), Quantity: total, Status: t.Status, ShippedAt: t.Date}
+		if err := scoped.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "transaction_id"}}, UpdateAll: true}).Create(&s).Error; err != nil {
+			return err
+		}
+	case kindInvoice:
+		po := t.refs.PONumber
+		if po == "" && len(pos) > 0 {
+			po = pos[0]
+		}
+		inv := Invoice{PartnerID: t.PartnerID, TransactionID: t.ID, InvoiceNumber: t.refs.Number, PONumber: po,
+			Lines: len(items), Quantity: total, Status: t.Status, InvoicedAt: t.Date}
+		if err := scoped.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "transaction_id"}}, UpdateAll: true}).Create(&inv).Error; err != nil {
+			return err
+		}
+	}
+	for _, po := range pos {
+		doc := orderDocument{TransactionID: t.ID, Type: t.Type, Kind: kind, Date: t.Date, Quantity: quantities[po]}
+		if err := addOrderDocument(ctx, t.PartnerID, po, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record a document against an order, creating the order if it is the first
+func addOrderDocument(ctx context.Context, partnerID, po string, doc orderDocument) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		o := Order{PartnerID: partnerID, PONumber: po, Status: orderOpen, History: "[]"}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&o).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&o, "partner_id = ? AND po_number = ?", partnerID, po).Error; err != nil {
+			return err
+		}
+		if err := o.parse(); err != nil {
+			return err
+		}
+		for _, d := range o.Documents {
+			if d.TransactionID == doc.TransactionID {
+				return nil // already projected, e.g. a replay
+			}
+		}
+		o.Documents = append(o.Documents, doc)
+		sort.SliceStable(o.Documents, func(i, j int) bool { return o.Documents[i].Date.Before(o.Documents[j].Date) })
+		switch doc.Kind {
+		case kindOrder:
+			o.OrderTransactionID, o.OrderedQuantity = doc.TransactionID, doc.Quantity
+		case kindShipment:
+			o.ShippedQuantity += doc.Quantity
+		case kindInvoice:
+			o.InvoicedQuantity += doc.Quantity
+		}
+		o.Status = o.derivedStatus()
+		history, _ := json.Marshal(o.Documents)
+		o.History = string(history)
+		return tx.Model(&o).Select("status", "order_transaction_id", "ordered_quantity", "shipped_quantity",
+			"invoiced_quantity", "history", "updated_at").Updates(&o).Error
+	})
+}
+
+// Furthest state the order's documents show
+func (o *Order) derivedStatus() string {
+	kinds := map[string]bool{}
+	for _, d := range o.Documents {
+		kinds[d.Kind] = true
+	}
+	switch {
+	case kinds[kindInvoice]:
+		return orderInvoiced
+	case kinds[kindShipment] && o.OrderedQuantity > o.ShippedQuantity:
+		return orderPartiallyShipped
+	case kinds[kindShipment]:
+		return orderShipped
+	case kinds[kindOrderChange]:
+		return orderChanged
+	case kinds[kindOrderAck]:
+		return orderAcknowledged
+	}
+	return orderOpen
+}
+
+func (o *Order) parse() error {
+	o.Documents = []orderDocument{}
+	if o.History == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(o.History), &o.Documents)
+}
+
+// Carry a transaction's new status, e.g. from its acknowledgment, to its
+// shipment or invoice
+func updateViewStatus(ctx context.Context, transactionID, status string) {
+	for _, model := range []interface{}{&Shipment{}, &Invoice{}} {
+		if err := db.WithContext(ctx).Model(model).Where("transaction_id = ?", transactionID).Update("status", status).Error; err != nil {
+			log.Printf("ERROR: views %s: %v\n", transactionID, err)
+		}
+	}
+}
+
+const maxViewPage = 1000
+
+// Filters and paging shared by the view lists: partner_id, status, from and
+// to (RFC 3339, on the given date column), before (an ID) and limit
+func viewQuery(r *http.Request, dateColumn string, filters map[string]string) (*gorm.DB, error) {
+	q := r.URL.Query()
+	query := db.WithContext(r.Context()).Order("id DESC")
+	filters["partner_id"], filters["status"] = "partner_id", "status"
+	for param, column := range filters {
+		if v := q.Get(param); v != "" {
+			query = query.Where(column+" = ?", v)
+		}
+	}
+	for param, op := range map[string]string{"from": ">=", "to": "<"} {
+		if v := q.Get(param); v != "" {
+			ts, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New(param + " must be an RFC 3339 time")
+			}
+			query = query.Where(dateColumn+" "+op+" ?", ts)
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("before must be an ID")
+		}
+		query = query.Where("id < ?", id)
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("limit must be a positive number")
+		}
+		limit = n
+	}
+	if limit > maxViewPage {
+		limit = maxViewPage
+	}
+	return query.Limit(limit), nil
+}
+
+// List orders, newest activity first. Filters: partner_id, status, po_number,
+// from, to (last update), before and limit.
+func listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := viewQuery(r, "updated_at", map[string]string{"po_number": "po_number"})
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	orders := []Order{}
+	if err := query.Find(&orders).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
+	for i := range orders {
+		if err := orders[i].parse(); err != nil {
+			log.Printf("ERROR: order %d: %v\n", orders[i].ID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// Fetch an order with its documents, shipments and invoices
+func getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var o Order
+	err := db.WithContext(r.Context()).First(&o, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if err := o.parse(); err != nil {
+		log.Printf("ERROR: order %d: %v\n", o.ID, err)
+	}
+	var ids []string
+	for _, d := range o.Documents {
+		ids = append(ids, d.TransactionID)
+	}
+	o.Shipments, o.Invoices = []Shipment{}, []Invoice{}
+	if len(ids) > 0 {
+		scoped := db.WithContext(r.Context())
+		if err := scoped.Where("transaction_id IN ?", ids).Order("shipped_at").Find(&o.Shipments).Error; err != nil {
+			log.Printf("ERROR: %v\n", err)
+			writeProblem(w, "Failed to fetch shipments", http.StatusInternalServerError)
+			return
+		}
+		if err := scoped.Where("transaction_id IN ?", ids).Order("invoiced_at").Find(&o.Invoices).Error; err != nil {
+			log.Printf("ERROR: %v\n", err)
+			writeProblem(w, "Failed to fetch invoices", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// List shipments, newest first. Filters: partner_id, status, shipment_number,
+// bol, carrier, from, to (ship date), before and limit.
+func listShipmentsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := viewQuery(r, "shipped_at", map[string]string{"shipment_number": "shipment_number", "bol": "bol", "carrier": "carrier"})
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shipments := []Shipment{}
+	if err := query.Find(&shipments).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch shipments", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipments)
+}
+
+// Fetch one shipment
+func getShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	var s Shipment
+	err := db.WithContext(r.Context()).First(&s, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Shipment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch shipment", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// List invoices, newest first. Filters: partner_id, status, invoice_number,
+// po_number, from, to (invoice date), before and limit.
+func listInvoicesHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := viewQuery(r, "invoiced_at", map[string]string{"invoice_number": "invoice_number", "po_number": "po_number"})
+	if err != nil {
+		writeProblem(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	invoices := []Invoice{}
+	if err := query.Find(&invoices).Error; err != nil {
+		log.Printf("ERROR: %v\n", err)
+		writeProblem(w, "Failed to fetch invoices", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+// Fetch one invoice
+func getInvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	var inv Invoice
+	err := db.WithContext(r.Context()).First(&inv, "id = ?", mux.Vars(r)["id"]).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(w, "Invoice not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeProblem(w, "Failed to fetch invoice", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// X12 separator characters
+type X12Delimiters struct {
+	Element    byte
+	Component  byte
+	Repetition byte
+	Segment    byte
+}
+
+var defaultDelimiters = X12Delimiters{Element: '*', Component: '>', Repetition: '^', Segment: '~'}
+
+// Sender identity used on outbound envelopes
+var (
+	senderQualifier = getEnv("EDI_SENDER_QUALIFIER", "ZZ")
+	senderID        = getEnv("EDI_SENDER_ID", "EDIGATEWAY")
+	usageIndicator  = getEnv("EDI_USAGE_INDICATOR", "P") // P=production, T=test
+)
+
+// Builds X12 segments and keeps the transaction set segment count
+type x12Writer struct {
+	sb       bytes.Buffer
+	d        X12Delimiters
+	segments int
+}
+
+// Get a pooled writer; call release once its output has been taken
+func newX12Writer(d X12Delimiters) *x12Writer {
+	w := x12WriterPool.Get().(*x12Writer)
+	w.sb.Reset()
+	w.d = d
+	w.segments = 0
+	return w
+}
+
+func (w *x12Writer) release() {
+	if w.sb.Cap() <= maxPooledBuffer {
+		x12WriterPool.Put(w)
+	}
+}
+
+// Write one segment, dropping trailing empty elements
+func (w *x12Writer) seg(id string, elements ...string) {
+	for len(elements) > 0 && elements[len(elements)-1] == "" {
+		elements = elements[:len(elements)-1]
+	}
+	w.sb.WriteString(id)
+	for _, e := range elements {
+		w.sb.WriteByte(w.d.Element)
+		w.sb.WriteString(e)
+	}
+	w.sb.WriteByte(w.d.Segment)
+	w.sb.WriteByte('\n')
+	w.segments++
+}
+
+func (w *x12Writer) String() string {
+	return w.sb.String()
+}
+
+// Interchange and group envelope values
+type x12Envelope struct {
+	ReceiverQualifier string
+	ReceiverID        string
+	ReceiverGSID      string
+	FunctionalID      string // GS01, e.g. SH for 856
+	Version           string // 004010 or 005010
+	ControlNumber     int64
+	Time              time.Time
+	Test              bool // ISA15 T whatever EDI_USAGE_INDICATOR says
+}
+
+// Write the ISA and GS headers
+func (w *x12Writer) openEnvelope(env x12Envelope) {
+	w.openInterchange(env)
+	w.openGroup(env)
+}
+
+// Write the ISA header
+func (w *x12Writer) openInterchange(env x12Envelope) {
+	version := isaVersion(env.Version)
+	repetition := "U"
+	if version >= "00501" {
+		repetition = string(w.d.Repetition)
+	}
+	usage := usageIndicator
+	if env.Test {
+		usage = "T"
+	}
+	w.seg("ISA",
+		"00", pad("", 10), "00", pad("", 10),
+		pad(senderQualifier, 2), pad(senderID, 15),
+		pad(env.ReceiverQualifier, 2), pad(env.ReceiverID, 15),
+		env.Time.Format("060102"), env.Time.Format("1504"),
+		repetition, version, fmt.Sprintf("%09d", env.ControlNumber),
+		"0", usage, string(w.d.Component))
+}
+
+// Outbound X12 versions a partner can be given
+func validX12Version(v string) bool {
+	return v == "004010" || v == "005010"
+}
+
+// ISA12 for a GS08 version: its first five digits, e.g. 00401 for 004010 or
+// 005010X222A1. A version too short to have them, e.g. from a partner's
+// malformed GS, gets 00401.
+func isaVersion(version string) string {
+	if len(version) < 5 {
+		return "00401"
+	}
+	if _, err := strconv.Atoi(version[:5]); err != nil {
+		return "00401"
+	}
+	return version[:5]
+}
+
+// Write the GS header
+func (w *x12Writer) openGroup(env x12Envelope) {
+	w.seg("GS", env.FunctionalID, senderID, env.ReceiverGSID,
+		env.Time.Format("20060102"), env.Time.Format("1504"),
+		fmt.Sprint(env.ControlNumber), "X", env.Version)
+}
+
+// Write the GE and IEA trailers
+func (w *x12Writer) closeEnvelope(env x12Envelope, sets int) {
+	w.seg("GE", fmt.Sprint(sets), fmt.Sprint(env.ControlNumber))
+	w.closeInterchange(env, 1)
+}
+
+// Write the IEA trailer
+func (w *x12Writer) closeInterchange(env x12Envelope, groups int) {
+	w.seg("IEA", fmt.Sprint(groups), fmt.Sprintf("%09d", env.ControlNumber))
+}
+
+// Left-justify s in a fixed-width field
+func pad(s string, n int) string {
+	if len(s) >= n {
+		return s[:n]
+	}
+	return s + strings.Repeat(" ", n-len(s))
+}
+
+// One X12 segment; element 0 is the segment ID so s[1] is the first element
+type Segment []string
+
+// Element at position i, or "" when absent
+func (s Segment) el(i int) string {
+	if i < len(s) {
+		return s[i]
+	}
+	return ""
+}
+
+// Parsed ISA..IEA interchange
+type X12Interchange struct {
+	Delimiters X12Delimiters
+	ISA        Segment
+	Groups     []X12Group
+	IEA        Segment
+}
+
+// Parsed GS..GE functional group
+type X12Group struct {
+	GS   Segment
+	Sets []X12Set
+	GE   Segment
+}
+
+// Parsed ST..SE transaction set
+type X12Set struct {
+	Segments []Segment
+	Version  string // GS08 of the group, e.g. 005010X222A1
+	Err      error  // set-level envelope error (bad SE count or control number)
+}
+
+// Transaction set identifier (ST01), e.g. 850 or 856
+func (s X12Set) Type() string {
+	return s.Segments[0].el(1)
+}
+
+// Transaction set control number (ST02)
+func (s X12Set) ControlNumber() string {
+	return s.Segments[0].el(2)
+}
+
+// Sender ID (ISA06) without padding
+func (ic X12Interchange) SenderID() string {
+	return strings.TrimSpace(ic.ISA.el(6))
+}
+
+// Interchange control number (ISA13)
+func (ic X12Interchange) ControlNumber() string {
+	return ic.ISA.el(13)
+}
+
+// Longest ISA segment read for its separators: 106 characters when every
+// field has its fixed width, with room for senders that pad them wrongly
+const maxISALength = 512
+
+// Read the ISA segment a payload starts with and the separators it
+// declares. The element separator follows "ISA"; the component separator
+// (ISA16) and the segment terminator follow the sixteenth element separator,
+// so fields padded short or long do not throw them off; any of them may be a
+// control character or, for the terminator, a line feed. ISA11 is the
+// repetition separator from 00501 on.
+func readISA(data []byte) (Segment, X12Delimiters, error) {
+	if len(data) < 4 || string(data[:3]) != "ISA" {
+		return nil, X12Delimiters{}, fmt.Errorf("x12: payload does not start with an ISA segment")
+	}
+	d := X12Delimiters{Element: data[3]}
+	if !validSeparator(d.Element) {
+		isa := fixedISA(data)
+		ic := X12Interchange{Delimiters: defaultDelimiters, ISA: isa}
+		return isa, d, &envelopeError{Note: ta1InvalidElementSeparator, Interchange: ic,
+			Err: fmt.Errorf("x12: interchange %s: %q cannot separate elements", ic.ControlNumber(), d.Element)}
+	}
+	if len(data) > maxISALength {
+		data = data[:maxISALength]
+	}
+	end, seps := -1, 0
+	for i := 3; i < len(data); i++ {
+		if data[i] == d.Element {
+			if seps++; seps == 16 {
+				end = i + 2 // past ISA16, at the terminator
+				break
+			}
+		}
+	}
+	if end < 0 || end >= len(data) {
+		return nil, d, fmt.Errorf("x12: payload does not start with a complete ISA segment")
+	}
+	d.Component, d.Segment = data[end-1], data[end]
+	isa := Segment(strings.Split(string(data[:end]), string(d.Element)))
+	if rep := isa.el(11); len(rep) == 1 {
+		d.Repetition = rep[0]
+	}
+	ic := X12Interchange{Delimiters: defaultDelimiters, ISA: isa}
+	switch {
+	case d.Element == d.Segment:
+		return isa, d, &envelopeError{Note: ta1InvalidElementSeparator, Interchange: ic,
+			Err: fmt.Errorf("x12: interchange %s: %q cannot separate elements", ic.ControlNumber(), d.Element)}
+	case !validSeparator(d.Component) || d.Component == d.Element || d.Component == d.Segment:
+		return isa, d, &envelopeError{Note: ta1InvalidComponentSeparator, Interchange: ic,
+			Err: fmt.Errorf("x12: interchange %s: %q cannot separate components", ic.ControlNumber(), d.Component)}
+	case !validSeparator(d.Segment):
+		return isa, d, &envelopeError{Note: ta1InvalidStructure, Interchange: ic,
+			Err: fmt.Errorf("x12: interchange %s: %q cannot terminate segments", ic.ControlNumber(), d.Segment)}
+	}
+	return isa, d, nil
+}
+
+// Widths of ISA01 to ISA16 in a correctly padded ISA
+var isaWidths = []int{2, 10, 2, 10, 2, 15, 2, 15, 6, 4, 1, 5, 9, 1, 1, 1}
+
+// An ISA read at the fixed offsets of its standard layout, for when its
+// element separator cannot be trusted to split it
+func fixedISA(data []byte) Segment {
+	isa, at := Segment{"ISA"}, 4
+	for _, width := range isaWidths {
+		if at+width > len(data) {
+			break
+		}
+		isa = append(isa, string(data[at:at+width]))
+		at += width + 1
+	}
+	return isa
+}
+
+// Whether a character can separate X12 data: not a letter, digit or space,
+// which values are made of
+func validSeparator(c byte) bool {
+	return !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == ' ')
+}
+
+// Read the separators declared by the ISA segment a payload starts with
+func detectDelimiters(data []byte) (X12Delimiters, error) {
+	_, d, err := readISA(data)
+	return d, err
+}
+
+// Split a payload into segments using the delimiters declared in its ISA,
+// appending to dst. All elements share one copy of the payload.
+func splitSegments(dst []Segment, data []byte) ([]Segment, X12Delimiters, error) {
+	data = bytes.TrimLeft(data, " \t\r\n\ufeff")
+	d, err := detectDelimiters(data)
+	if err != nil {
+		return dst, d, err
+	}
+	rest := string(data)
+	for rest != "" {
+		raw := rest
+		if i := strings.IndexByte(rest, d.Segment); i >= 0 {
+			raw, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+		raw = strings.Trim(raw, "\r\n ")
+		if raw == "" {
+			continue
+		}
+		dst = append(dst, Segment(strings.Split(raw, string(d.Element))))
+	}
+	return dst, d, nil
+}
+
+// Parse one or more interchanges, checking envelope counts and control numbers.
+// Transaction set problems are recorded on the set so the rest can still be used.
+func parseX12(data []byte) ([]X12Interchange, error) {
+	scratch := x12ScratchPool.Get().(*x12Scratch)
+	defer func() {
+		for i := range scratch.segments {
+			scratch.segments[i] = nil
+		}
+		scratch.segments = scratch.segments[:0]
+		x12ScratchPool.Put(scratch)
+	}()
+	segments, d, err := splitSegments(scratch.segments[:0], data)
+	scratch.segments = segments
+	if err != nil {
+		return nil, err
+	}
+	p := x12Parser{d: d, keep: true}
+	for _, seg := range segments {
+		if _, err := p.feed(seg); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return p.done, nil
+}
+
+// Envelope state of an X12 parse, fed one segment at a time. With keep the
+// sets, groups and interchanges are collected as parseX12 returns them;
+// without it only the open envelopes are held, for streaming.
+type x12Parser struct {
+	d     X12Delimiters
+	keep  bool
+	ic    *X12Interchange
+	group *X12Group
+	set   *X12Set
+	sets  int // closed in the open group
+	grps  int // closed in the open interchange
+	n     int // segments fed
+	done  []X12Interchange
+}
+
+// Feed the next segment, returning the transaction set it closed, if any
+func (p *x12Parser) feed(seg Segment) (*X12Set, error) {
+	p.n++
+	switch seg[0] {
+	case "ISA":
+		if p.ic != nil {
+			return nil, p.envelopeError(ta1PrematureEnd, "x12: segment %d: ISA before IEA", p.n)
+		}
+		if len(seg) != 17 {
+			p.ic = &X12Interchange{Delimiters: p.d, ISA: seg}
+			return nil, p.envelopeError(ta1InvalidStructure, "x12: segment %d: ISA has %d elements, want 16", p.n, len(seg)-1)
+		}
+		p.ic, p.grps = &X12Interchange{Delimiters: p.d, ISA: seg}, 0
+		if note, err := checkISA(seg); err != nil {
+			return nil, p.envelopeError(note, "x12: segment %d: %v", p.n, err)
+		}
+	case "GS":
+		if p.ic == nil || p.group != nil {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: segment %d: unexpected GS", p.n)
+		}
+		p.group, p.sets = &X12Group{GS: seg}, 0
+	case "ST":
+		if p.group == nil || p.set != nil {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: segment %d: unexpected ST", p.n)
+		}
+		p.set = &X12Set{Segments: []Segment{seg}, Version: p.group.GS.el(8)}
+	case "SE":
+		set := p.set
+		if set == nil {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: segment %d: SE without ST", p.n)
+		}
+		set.Segments = append(set.Segments, seg)
+		if n := fmt.Sprint(len(set.Segments)); seg.el(1) != n {
+			set.Err = fmt.Errorf("x12: set %s: SE01 is %s but set has %s segments", set.ControlNumber(), seg.el(1), n)
+		} else if seg.el(2) != set.ControlNumber() {
+			set.Err = fmt.Errorf("x12: set %s: SE02 %s does not match ST02", set.ControlNumber(), seg.el(2))
+		}
+		if p.keep {
+			p.group.Sets = append(p.group.Sets, *set)
+		}
+		p.sets++
+		p.set = nil
+		return set, nil
+	case "GE":
+		group := p.group
+		if group == nil || p.set != nil {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: segment %d: unexpected GE", p.n)
+		}
+		if seg.el(1) != fmt.Sprint(p.sets) {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: group %s: GE01 is %s but group has %d sets", group.GS.el(6), seg.el(1), p.sets)
+		}
+		if seg.el(2) != group.GS.el(6) {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: group %s: GE02 %s does not match GS06", group.GS.el(6), seg.el(2))
+		}
+		group.GE = seg
+		if p.keep {
+			p.ic.Groups = append(p.ic.Groups, *group)
+		}
+		p.grps++
+		p.group = nil
+	case "IEA":
+		ic := p.ic
+		if ic == nil || p.group != nil {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: segment %d: unexpected IEA", p.n)
+		}
+		if seg.el(1) != fmt.Sprint(p.grps) {
+			return nil, p.envelopeError(ta1InvalidGroupCount, "x12: interchange %s: IEA01 is %s but interchange has %d groups", ic.ControlNumber(), seg.el(1), p.grps)
+		}
+		if seg.el(2) != ic.ControlNumber() {
+			return nil, p.envelopeError(ta1ControlMismatch, "x12: interchange %s: IEA02 %s does not match ISA13", ic.ControlNumber(), seg.el(2))
+		}
+		ic.IEA = seg
+		if p.keep {
+			p.done = append(p.done, *ic)
+		}
+		p.ic = nil
+	default:
+		if p.set == nil {
+			return nil, p.envelopeError(ta1InvalidContent, "x12: segment %d: %s outside a transaction set", p.n, seg[0])
+		}
+		p.set.Segments = append(p.set.Segments, seg)
+	}
+	return nil, nil
+}
+
+// Check nothing is left open at the end of the payload
+func (p *x12Parser) finish() error {
+	if p.ic != nil {
+		return p.envelopeError(ta1PrematureEnd, "x12: interchange %s: missing IEA", p.ic.ControlNumber())
+	}
+	return nil
+}
+
+// Error in the envelope of the open interchange, reported in a TA1 with the
+// note code; a plain error while no interchange is open, as there is no
+// sender to answer
+func (p *x12Parser) envelopeError(note, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if p.ic == nil {
+		return err
+	}
+	return &envelopeError{Note: note, Interchange: X12Interchange{Delimiters: p.d, ISA: p.ic.ISA}, Err: err}
+}
+
+// Interchange whose envelope is in error, and the TA1 note code (TA105)
+// saying how
+type envelopeError struct {
+	Note        string
+	Interchange X12Interchange // its ISA only
+	Err         error
+}
+
+func (e *envelopeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *envelopeError) Unwrap() error {
+	return e.Err
+}
+
+// Check the fixed fields of an ISA segment, returning the TA1 note code of
+// the first one in error
+func checkISA(isa Segment) (string, error) {
+	digits := func(s string, n int) bool {
+		if len(s) != n {
+			return false
+		}
+		for _, c := range s {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case strings.TrimSpace(isa.el(6)) == "":
+		return ta1InvalidSender, errors.New("ISA06 sender ID is blank")
+	case strings.TrimSpace(isa.el(8)) == "":
+		return ta1InvalidReceiver, errors.New("ISA08 receiver ID is blank")
+	case !digits(isa.el(9), 6):
+		return ta1InvalidDate, fmt.Errorf("ISA09 date %q is not YYMMDD", isa.el(9))
+	case !digits(isa.el(10), 4):
+		return ta1InvalidTime, fmt.Errorf("ISA10 time %q is not HHMM", isa.el(10))
+	case !digits(isa.el(12), 5):
+		return ta1InvalidVersion, fmt.Errorf("ISA12 version %q is not 5 digits", isa.el(12))
+	case !digits(isa.el(13), 9):
+		return ta1InvalidControl, fmt.Errorf("ISA13 control number %q is not 9 digits", isa.el(13))
+	case isa.el(14) != "0" && isa.el(14) != "1":
+		return ta1InvalidAckRequested, fmt.Errorf("ISA14 acknowledgment requested %q is not 0 or 1", isa.el(14))
+	case isa.el(15) != "P" && isa.el(15) != "T":
+		return ta1InvalidTestIndicator, fmt.Errorf("ISA15 usage indicator %q is not P or T", isa.el(15))
+	}
+	return "", nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestISAVersion(t *testing.T) {
+	for version, want := range map[string]string{
+		"004010": "00401", "005010": "00501", "005010X222A1": "00501", "00401": "00401",
+		"4010": "00401", "": "00401", "ABCDEF": "00401",
+	} {
+		if got := isaVersion(version); got != want {
+			t.Errorf("isaVersion(%q) = %q, want %q", version, got, want)
+		}
+	}
+}
+
+// A short GS08, here an acknowledged group's, makes a valid ISA rather than
+// a panic
+func TestOpenInterchangeShortVersion(t *testing.T) {
+	w := newX12Writer(defaultDelimiters)
+	defer w.release()
+	w.openInterchange(x12Envelope{ReceiverQualifier: "ZZ", ReceiverID: "ACME", Version: "401", ControlNumber: 1, Time: time.Now()})
+	if isa := w.String(); !strings.Contains(isa, "*U*00401*000000001*") {
+		t.Errorf("ISA: %q", isa)
+	}
+}
+
+func TestBuild856RejectsInvalidVersion(t *testing.T) {
+	if _, err := build856Interchange(context.Background(), Partner{ID: "acme", X12Version: "4010"}, nil); err == nil || !strings.Contains(err.Error(), "x12_version") {
+		t.Errorf("got %v, want an x12_version error", err)
+	}
+}
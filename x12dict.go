@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Element of a segment in the X12 base standard
+type x12Element struct {
+	Mandatory bool
+	Type      string // AN, ID, N0, N2, R, DT, TM or C (composite)
+	Min, Max  int
+}
+
+// Elements of the segments the validator knows, from the 005010 base
+// standard. Each element is "M|O|X type min max"; composites are "M C" or
+// "O C". Segments not listed are unrecognized in sets checked against it.
+var x12SegmentSpecs = map[string]string{
+	"ST":  "M ID 3 3|M AN 4 9|O AN 1 35",
+	"SE":  "M N0 1 10|M AN 4 9",
+	"BHT": "M ID 4 4|M ID 2 2|O AN 1 50|O DT 8 8|O TM 4 8|O ID 2 2",
+	"NM1": "M ID 2 3|M ID 1 1|O AN 1 60|O AN 1 35|O AN 1 25|O AN 1 10|O AN 1 10|X ID 1 2|X AN 2 80|X ID 2 2|O ID 2 3|O AN 1 60",
+	"N1":  "M ID 2 3|X AN 1 60|X ID 1 2|X AN 2 80|O ID 2 2|O ID 2 3",
+	"N2":  "M AN 1 60|O AN 1 60",
+	"N3":  "M AN 1 55|O AN 1 55",
+	"N4":  "O AN 2 30|O ID 2 2|O ID 3 15|O ID 2 3|X ID 1 2|X AN 1 30|O ID 2 3",
+	"REF": "M ID 2 3|X AN 1 50|X AN 1 80|O C",
+	"PER": "M ID 2 2|O AN 1 60|X ID 2 2|X AN 1 256|X ID 2 2|X AN 1 256|X ID 2 2|X AN 1 256|O AN 1 20",
+	"HL":  "M AN 1 12|O AN 1 12|M ID 1 2|O ID 1 1",
+	"PRV": "M ID 1 3|X ID 2 3|X AN 1 50|O ID 2 2|O C|O ID 3 3",
+	"CUR": "M ID 2 3|M ID 3 3|O R 4 10|O ID 2 3|O ID 3 3|O ID 3 3|X ID 3 3|X DT 8 8|X TM 4 8",
+	"SBR": "M ID 1 1|O ID 2 2|O AN 1 50|O AN 1 60|O ID 1 3|O ID 1 1|O ID 1 1|O ID 2 2|O ID 1 2",
+	"PAT": "O ID 2 2|O ID 1 1|O ID 2 2|O ID 1 1|X ID 2 3|X AN 1 35|X ID 2 2|X R 1 10|O ID 1 1",
+	"DMG": "O ID 2 3|X AN 1 35|O ID 1 1|O ID 1 1|O C|O ID 1 2|O ID 2 3|O ID 2 3|O R 1 15|O ID 1 3|O AN 1 50",
+	"CLM": "M AN 1 38|O R 1 18|O ID 1 2|O ID 1 2|O C|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 3|O C|O ID 2 3|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 2|O ID 1 2",
+	"DTP": "M ID 3 3|M ID 2 3|M AN 1 35",
+	"DTM": "M ID 3 3|X DT 8 8|X TM 4 8|O ID 2 2|X ID 2 3|X AN 1 35",
+	"PWK": "M ID 2 2|O ID 1 2|O N0 1 2|O ID 1 2|X ID 1 2|X AN 2 80|O AN 1 80|O C|O ID 1 2",
+	"CN1": "M ID 2 2|O R 1 18|O R 1 9|O AN 1 50|O R 1 6|O AN 1 30",
+	"AMT": "M ID 1 3|M R 1 18|O ID 1 1",
+	"QTY": "M ID 2 2|X R 1 15|O C|X AN 1 30",
+	"K3":  "M AN 1 80|O ID 1 2|O C",
+	"NTE": "O ID 3 3|M AN 1 80",
+	"CR1": "O ID 2 2|O R 1 10|O ID 1 1|O ID 1 1|O ID 2 2|O R 1 15|O AN 1 35|O AN 1 35|O AN 1 80|O AN 1 80",
+	"CR2": "O N0 1 9|O R 1 15|O N0 1 3|O N0 1 3|O ID 2 2|O R 1 15|O R 1 15|O ID 1 1|O ID 1 1|O AN 1 80|O AN 1 80|O ID 1 1",
+	"CR3": "O ID 1 1|O ID 2 2|O R 1 15|O ID 1 1|O AN 1 80",
+	"CRC": "M ID 2 3|M ID 1 1|M ID 2 3|O ID 2 3|O ID 2 3|O ID 2 3|O ID 2 3",
+	"CL1": "O ID 1 1|O ID 1 1|O ID 1 2",
+	"DN1": "O R 1 15|O R 1 15|O ID 1 1|O AN 1 80",
+	"DN2": "M AN 1 50|M ID 1 2|O R 1 15|O ID 2 3|O AN 1 35|O ID 2 3|O ID 1 2|O R 1 15|O ID 1 1",
+	"HI":  "M C|O C|O C|O C|O C|O C|O C|O C|O C|O C|O C|O C",
+	"HCP": "M ID 2 2|O R 1 18|O R 1 18|O AN 1 50|O R 1 9|O AN 1 50|O R 1 18|O ID 2 2|O AN 1 48|O ID 2 2|O R 1 15|O ID 1 2|O ID 1 2|O ID 1 2|O ID 1 2",
+	"OI":  "O ID 2 2|O ID 2 2|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1",
+	"MOA": "O R 1 10|O R 1 18|O AN 1 50|O AN 1 50|O AN 1 50|O AN 1 50|O AN 1 50|O R 1 18|O R 1 18",
+	"MIA": "M R 1 15|O R 1 18|O R 1 15|O R 1 18|O AN 1 50|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 15|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O AN 1 50|O AN 1 50|O AN 1 50|O AN 1 50|O R 1 18",
+	"LX":  "M N0 1 6",
+	"SV1": "M C|M R 1 18|M ID 2 2|O R 1 15|O AN 1 2|O AN 1 2|O C|O R 1 18|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O AN 1 2|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1",
+	"SV2": "O AN 1 48|O C|O R 1 18|O ID 2 2|O R 1 15|O R 1 10|O R 1 18|O ID 1 1|O ID 1 1|O ID 1 1",
+	"SV3": "M C|M R 1 18|O AN 1 2|O C|O ID 1 3|O R 1 15|O AN 1 80|O AN 1 80|O R 1 15|O ID 1 2|O C",
+	"SV5": "M C|M ID 2 2|M R 1 15|O R 1 18|O R 1 18|O ID 1 1|O R 1 18",
+	"TOO": "O ID 1 3|O AN 1 48|O C",
+	"MEA": "O ID 2 2|O ID 1 3|X R 1 20|O C|X R 1 20|X R 1 20|X ID 2 3|X ID 1 2|O ID 1 2|O AN 1 60",
+	"PS1": "M AN 1 50|M R 1 18|O ID 2 2",
+	"LIN": "O AN 1 20|M ID 2 2|M AN 1 48|X ID 2 2|X AN 1 48",
+	"CTP": "O ID 2 2|X ID 3 3|X R 1 17|X R 1 15|X C|O ID 3 3|O R 1 10|O R 1 15|O ID 2 2|O ID 1 1|O R 1 15",
+	"SVD": "M AN 2 80|M R 1 18|O C|O AN 1 48|O R 1 15|O N0 1 6",
+	"CAS": "M ID 1 2|M ID 1 5|M R 1 18|O R 1 15|X ID 1 5|X R 1 18|X R 1 15|X ID 1 5|X R 1 18|X R 1 15|X ID 1 5|X R 1 18|X R 1 15|X ID 1 5|X R 1 18|X R 1 15|X ID 1 5|X R 1 18|X R 1 15",
+	"LQ":  "O ID 1 3|X AN 1 30",
+	"FRM": "M AN 1 20|X ID 1 1|X AN 1 30|X DT 8 8|X R 1 10",
+	"BPR": "M ID 1 2|M R 1 18|M ID 1 1|M ID 3 3|O ID 1 10|X ID 2 2|X AN 3 12|O ID 1 3|X AN 1 35|O AN 10 10|O AN 9 9|X ID 2 2|X AN 3 12|O ID 1 3|X AN 1 35|O DT 8 8|O ID 3 3|X ID 2 2|X AN 3 12|O ID 1 3|X AN 1 35",
+	"TRN": "M ID 1 2|M AN 1 50|O AN 10 10|O AN 1 50",
+	"RDM": "M ID 1 2|O AN 1 60|O AN 1 256|O C|O C",
+	"TS3": "M AN 1 50|M ID 1 2|M DT 8 8|M R 1 15|M R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18",
+	"TS2": "O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18|O R 1 18",
+	"CLP": "M AN 1 38|M ID 1 2|M R 1 18|M R 1 18|O R 1 18|O ID 1 2|O AN 1 50|O AN 1 2|O ID 1 1|O AN 1 4|O AN 1 15|O R 1 10|O R 1 15|O ID 1 1",
+	"SVC": "M C|M R 1 18|O R 1 18|O AN 1 48|O R 1 15|O C|O R 1 15",
+	"PLB": "M AN 1 50|M DT 8 8|M C|M R 1 18|X C|X R 1 18|X C|X R 1 18|X C|X R 1 18|X C|X R 1 18|X C|X R 1 18",
+	"EQ":  "X ID 1 2|X C|O ID 3 3|O ID 1 3|O C",
+	"EB":  "M ID 1 2|O ID 3 3|O ID 1 2|O ID 1 3|O AN 1 50|O ID 1 2|O R 1 18|O R 1 10|O ID 2 2|O R 1 15|O ID 1 1|O ID 1 1|O C|O C",
+	"HSD": "O ID 2 2|O R 1 15|O ID 2 2|O R 1 15|O ID 1 2|O N0 1 3|O ID 1 1|O ID 1 1",
+	"MSG": "M AN 1 264|X ID 2 2|O N0 1 9",
+	"III": "X ID 1 3|X AN 1 30|X ID 1 2|O AN 1 264|O R 1 15|O C",
+	"INS": "M ID 1 1|M ID 2 2|O ID 3 3|O ID 2 3|O ID 1 1|O ID 1 1|O ID 1 1|O ID 2 2|O ID 1 1|O ID 1 1|X ID 2 3|X AN 1 35|O ID 1 1|O ID 1 1|O ID 1 1|O ID 1 1|O N0 1 9",
+	"AAA": "M ID 1 1|O ID 2 2|O ID 2 2|O ID 1 1",
+	"MPI": "M ID 1 1|M ID 2 2|M ID 1 2|O AN 1 80|O ID 2 2|X ID 2 3|X AN 1 35|O N0 1 3",
+	"LS":  "M AN 1 4",
+	"LE":  "M AN 1 4",
+}
+
+var x12Segments = parseSegmentSpecs(x12SegmentSpecs)
+
+// Names of transaction sets, for people reading them
+var x12SetNames = map[string]string{
+	"270": "Eligibility, Coverage or Benefit Inquiry",
+	"271": "Eligibility, Coverage or Benefit Information",
+	"276": "Health Care Claim Status Request",
+	"277": "Health Care Claim Status Notification",
+	"810": "Invoice",
+	"834": "Benefit Enrollment and Maintenance",
+	"835": "Health Care Claim Payment/Advice",
+	"837": "Health Care Claim",
+	"850": "Purchase Order",
+	"855": "Purchase Order Acknowledgment",
+	"856": "Ship Notice/Manifest",
+	"860": "Purchase Order Change Request",
+	"997": "Functional Acknowledgment",
+	"999": "Implementation Acknowledgment",
+}
+
+// Names of segments and their elements: the segment's name, then one name
+// per element in order
+var x12SegmentNameSpecs = map[string]string{
+	"ISA": "Interchange Control Header|Authorization Information Qualifier|Authorization Information|Security Information Qualifier|Security Information|Interchange ID Qualifier|Interchange Sender ID|Interchange ID Qualifier|Interchange Receiver ID|Interchange Date|Interchange Time|Repetition Separator|Interchange Control Version Number|Interchange Control Number|Acknowledgment Requested|Interchange Usage Indicator|Component Element Separator",
+	"GS":  "Functional Group Header|Functional Identifier Code|Application Sender's Code|Application Receiver's Code|Date|Time|Group Control Number|Responsible Agency Code|Version / Release / Industry Identifier Code",
+	"ST":  "Transaction Set Header|Transaction Set Identifier Code|Transaction Set Control Number|Implementation Convention Reference",
+	"SE":  "Transaction Set Trailer|Number of Included Segments|Transaction Set Control Number",
+	"GE":  "Functional Group Trailer|Number of Transaction Sets Included|Group Control Number",
+	"IEA": "Interchange Control Trailer|Number of Included Functional Groups|Interchange Control Number",
+	"TA1": "Interchange Acknowledgment|Interchange Control Number|Interchange Date|Interchange Time|Interchange Acknowledgment Code|Interchange Note Code",
+	"BEG": "Beginning Segment for Purchase Order|Transaction Set Purpose Code|Purchase Order Type Code|Purchase Order Number|Release Number|Date|Contract Number",
+	"BAK": "Beginning Segment for Purchase Order Acknowledgment|Transaction Set Purpose Code|Acknowledgment Type|Purchase Order Number|Date|Release Number|Request Reference Number|Contract Number|Reference Identification|Date",
+	"BCH": "Beginning Segment for Purchase Order Change|Transaction Set Purpose Code|Purchase Order Type Code|Purchase Order Number|Release Number|Change Order Sequence Number|Date",
+	"BSN": "Beginning Segment for Ship Notice|Transaction Set Purpose Code|Shipment Identification|Date|Time|Hierarchical Structure Code|Transaction Type Code",
+	"BIG": "Beginning Segment for Invoice|Invoice Date|Invoice Number|Purchase Order Date|Purchase Order Number|Release Number|Change Order Sequence Number|Transaction Type Code",
+	"BHT": "Beginning of Hierarchical Transaction|Hierarchical Structure Code|Transaction Set Purpose Code|Reference Identification|Date|Time|Transaction Type Code",
+	"HL":  "Hierarchical Level|Hierarchical ID Number|Hierarchical Parent ID Number|Hierarchical Level Code|Hierarchical Child Code",
+	"TD1": "Carrier Details (Quantity and Weight)|Packaging Code|Lading Quantity|Commodity Code Qualifier|Commodity Code|Lading Description|Weight Qualifier|Weight|Unit or Basis for Measurement Code",
+	"TD3": "Carrier Details (Equipment)|Equipment Description Code|Equipment Initial|Equipment Number",
+	"TD5": "Carrier Details (Routing Sequence/Transit Time)|Routing Sequence Code|Identification Code Qualifier|Identification Code|Transportation Method/Type Code|Routing",
+	"REF": "Reference Information|Reference Identification Qualifier|Reference Identification|Description",
+	"DTM": "Date/Time Reference|Date/Time Qualifier|Date|Time|Time Code",
+	"N1":  "Party Identification|Entity Identifier Code|Name|Identification Code Qualifier|Identification Code",
+	"N2":  "Additional Name Information|Name|Name",
+	"N3":  "Party Location|Address Information|Address Information",
+	"N4":  "Geographic Location|City Name|State or Province Code|Postal Code|Country Code",
+	"NM1": "Individual or Organizational Name|Entity Identifier Code|Entity Type Qualifier|Name Last or Organization Name|Name First|Name Middle|Name Prefix|Name Suffix|Identification Code Qualifier|Identification Code",
+	"PER": "Administrative Communications Contact|Contact Function Code|Name|Communication Number Qualifier|Communication Number|Communication Number Qualifier|Communication Number",
+	"CUR": "Currency|Entity Identifier Code|Currency Code",
+	"ITD": "Terms of Sale/Deferred Terms of Sale|Terms Type Code|Terms Basis Date Code|Terms Discount Percent|Terms Discount Due Date|Terms Discount Days Due|Terms Net Due Date|Terms Net Days",
+	"FOB": "F.O.B. Related Instructions|Shipment Method of Payment",
+	"PRF": "Purchase Order Reference|Purchase Order Number|Release Number|Change Order Sequence Number|Date",
+	"LIN": "Item Identification|Assigned Identification|Product/Service ID Qualifier|Product/Service ID|Product/Service ID Qualifier|Product/Service ID",
+	"SN1": "Item Detail (Shipment)|Assigned Identification|Number of Units Shipped|Unit or Basis for Measurement Code|Quantity Shipped to Date|Quantity Ordered|Unit or Basis for Measurement Code",
+	"PO1": "Baseline Item Data|Assigned Identification|Quantity Ordered|Unit or Basis for Measurement Code|Unit Price|Basis of Unit Price Code|Product/Service ID Qualifier|Product/Service ID|Product/Service ID Qualifier|Product/Service ID",
+	"PO4": "Item Physical Details|Pack|Size|Unit or Basis for Measurement Code",
+	"PID": "Product/Item Description|Item Description Type|Product/Process Characteristic Code|Agency Qualifier Code|Product Description Code|Description",
+	"MEA": "Measurements|Measurement Reference ID Code|Measurement Qualifier|Measurement Value|Composite Unit of Measure",
+	"MAN": "Marks and Numbers Information|Marks and Numbers Qualifier|Marks and Numbers",
+	"ACK": "Line Item Acknowledgment|Line Item Status Code|Quantity|Unit or Basis for Measurement Code|Date/Time Qualifier|Date",
+	"IT1": "Baseline Item Data (Invoice)|Assigned Identification|Quantity Invoiced|Unit or Basis for Measurement Code|Unit Price|Basis of Unit Price Code|Product/Service ID Qualifier|Product/Service ID|Product/Service ID Qualifier|Product/Service ID",
+	"SAC": "Service, Promotion, Allowance, or Charge Information|Allowance or Charge Indicator|Service, Promotion, Allowance, or Charge Code|Agency Qualifier Code|Agency Service, Promotion, Allowance, or Charge Code|Amount",
+	"TDS": "Total Monetary Value Summary|Amount|Amount|Amount|Amount",
+	"CTT": "Transaction Totals|Number of Line Items|Hash Total",
+	"AK1": "Functional Group Response Header|Functional Identifier Code|Group Control Number|Version / Release / Industry Identifier Code",
+	"AK2": "Transaction Set Response Header|Transaction Set Identifier Code|Transaction Set Control Number|Implementation Convention Reference",
+	"AK3": "Data Segment Note|Segment ID Code|Segment Position in Transaction Set|Loop Identifier Code|Segment Syntax Error Code",
+	"AK4": "Data Element Note|Position in Segment|Data Element Reference Number|Data Element Syntax Error Code|Copy of Bad Data Element",
+	"AK5": "Transaction Set Response Trailer|Transaction Set Acknowledgment Code|Transaction Set Syntax Error Code",
+	"AK9": "Functional Group Response Trailer|Functional Group Acknowledge Code|Number of Transaction Sets Included|Number of Received Transaction Sets|Number of Accepted Transaction Sets|Functional Group Syntax Error Code",
+	"IK3": "Implementation Data Segment Note|Segment ID Code|Segment Position in Transaction Set|Loop Identifier Code|Implementation Segment Syntax Error Code",
+	"IK4": "Implementation Data Element Note|Position in Segment|Data Element Reference Number|Implementation Data Element Syntax Error Code|Copy of Bad Data Element",
+	"IK5": "Implementation Transaction Set Response Trailer|Transaction Set Acknowledgment Code|Implementation Transaction Set Syntax Error Code",
+	"CLM": "Claim Information|Claim Submitter's Identifier|Monetary Amount|Claim Filing Indicator Code|Non-Institutional Claim Type Code|Health Care Service Location Information|Yes/No Condition or Response Code|Provider Accept Assignment Code|Yes/No Condition or Response Code|Release of Information Code",
+	"SBR": "Subscriber Information|Payer Responsibility Sequence Number Code|Individual Relationship Code|Reference Identification|Name|Insurance Type Code",
+}
+
+// Meanings of the codes of common qualifier elements
+var (
+	purposeCodes = "00 Original|01 Cancellation|04 Change|05 Replace|06 Confirmation|07 Duplicate"
+	ackCodes     = "A Accepted|E Accepted, errors noted|M Rejected, authentication failed|P Partially accepted|R Rejected|W Rejected, assurance failed|X Rejected, content could not be analyzed"
+
+	x12CodeSpecs = map[string]string{
+		"ISA14": "0 No interchange acknowledgment requested|1 Interchange acknowledgment requested",
+		"ISA15": "P Production data|T Test data|I Information",
+		"GS01":  "PO Purchase Order (850)|PR Purchase Order Acknowledgment (855)|PC Purchase Order Change (860)|SH Ship Notice/Manifest (856)|IN Invoice (810)|FA Functional or Implementation Acknowledgment|HC Health Care Claim (837)|HP Health Care Claim Payment/Advice (835)",
+		"TA104": "A Accepted|E Accepted, errors noted|R Rejected",
+		"BEG01": purposeCodes,
+		"BAK01": purposeCodes,
+		"BCH01": purposeCodes,
+		"BSN01": purposeCodes,
+		"BAK02": "AC Acknowledge with detail and change|AD Acknowledge with detail, no change|AK Acknowledge, no detail or change|RD Reject with detail|RJ Rejected, no detail",
+		"HL03":  "S Shipment|O Order|T Tare|P Pack|I Item|20 Information Source|21 Information Receiver|22 Subscriber|23 Dependent",
+		"N101":  "ST Ship To|SF Ship From|BT Bill To|BY Buying Party|SE Selling Party|SU Supplier|VN Vendor|RI Remit To|85 Billing Provider|IL Insured or Subscriber|PR Payer",
+		"REF01": "BM Bill of Lading Number|PO Purchase Order Number|CN Carrier's Reference Number|IA Internal Vendor Number|VN Vendor Order Number|DP Department Number|IV Seller's Invoice Number",
+		"DTM01": "002 Delivery Requested|010 Requested Ship|011 Shipped|017 Estimated Delivery|067 Current Schedule Delivery|068 Current Schedule Ship",
+		"AK501": ackCodes,
+		"AK901": ackCodes,
+		"IK501": ackCodes,
+	}
+)
+
+// Name of each segment and element: the segment ID, and its element
+// references (e.g. BEG03) with their code meanings
+var x12Names, x12Codes = parseNameSpecs(x12SegmentNameSpecs), parseCodeSpecs(x12CodeSpecs)
+
+func parseNameSpecs(specs map[string]string) map[string]string {
+	out := map[string]string{}
+	for id, spec := range specs {
+		for i, name := range strings.Split(spec, "|") {
+			if i == 0 {
+				out[id] = name
+			} else {
+				out[elementRef(id, i)] = name
+			}
+		}
+	}
+	return out
+}
+
+func parseCodeSpecs(specs map[string]string) map[string]map[string]string {
+	out := map[string]map[string]string{}
+	for ref, spec := range specs {
+		codes := map[string]string{}
+		for _, c := range strings.Split(spec, "|") {
+			code, meaning, _ := strings.Cut(c, " ")
+			codes[code] = meaning
+		}
+		out[ref] = codes
+	}
+	return out
+}
+
+// Reference of a segment's element, e.g. BEG03
+func elementRef(segment string, i int) string {
+	return fmt.Sprintf("%s%02d", segment, i)
+}
+
+func parseSegmentSpecs(specs map[string]string) map[string][]x12Element {
+	out := make(map[string][]x12Element, len(specs))
+	for id, spec := range specs {
+		var elements []x12Element
+		for _, e := range strings.Split(spec, "|") {
+			f := strings.Fields(e)
+			el := x12Element{Mandatory: f[0] == "M", Type: f[1]}
+			if len(f) == 4 {
+				el.Min, _ = strconv.Atoi(f[2])
+				el.Max, _ = strconv.Atoi(f[3])
+			}
+			elements = append(elements, el)
+		}
+		out[id] = elements
+	}
+	return out
+}
+
+// Check a segment's elements against the base standard (SNIP level 1):
+// presence of mandatory elements, element count, length, numeric, date and
+// time formats. Repeated elements are checked one repetition at a time.
+func checkSegmentSyntax(seg Segment, d X12Delimiters, report func(element int, code, message string)) {
+	spec := x12Segments[seg[0]]
+	if len(seg)-1 > len(spec) {
+		report(len(spec)+1, ik4TooManyElements, "has "+strconv.Itoa(len(seg)-1)+" elements, at most "+strconv.Itoa(len(spec))+" are defined")
+	}
+	for i, el := range spec {
+		v := seg.el(i + 1)
+		if v == "" {
+			if el.Mandatory && el.Type != "C" {
+				report(i+1, ik4Missing, "is required")
+			} else if el.Mandatory {
+				report(i+1, ik4Missing, "composite is required")
+			}
+			continue
+		}
+		if el.Type == "C" {
+			continue
+		}
+		values := []string{v}
+		if d.Repetition != 0 && d.Repetition != 'U' && strings.IndexByte(v, d.Repetition) >= 0 {
+			values = strings.Split(v, string(d.Repetition))
+		}
+		for _, v := range values {
+			if code, msg := checkElement(el, v); code != "" {
+				report(i+1, code, msg)
+				break
+			}
+		}
+	}
+}
+
+// IK403 codes of element errors
+const (
+	ik4Missing         = "1"
+	ik4TooManyElements = "3"
+	ik4TooShort        = "4"
+	ik4TooLong         = "5"
+	ik4InvalidChar     = "6"
+	ik4InvalidCode     = "7"
+	ik4InvalidDate     = "8"
+	ik4InvalidTime     = "9"
+	ik4PatternFailure  = "I12" // implementation pattern match failure, also used for imbalances
+)
+
+// IK304 codes of segment errors
+const (
+	ik3Unrecognized   = "1"
+	ik3Unexpected     = "2"
+	ik3MissingSegment = "3"
+	ik3LoopOverMax    = "4"
+	ik3SegmentOverMax = "5"
+	ik3ElementErrors  = "8"
+	ik3LoopUnderMin   = "I7"
+)
+
+// Code and reason of the first problem with one element value
+func checkElement(el x12Element, v string) (string, string) {
+	length := len(v)
+	switch el.Type {
+	case "N0", "N2", "R":
+		digits := 0
+		dot := false
+		for i, c := range v {
+			switch {
+			case c >= '0' && c <= '9':
+				digits++
+			case c == '-' && i == 0:
+			case c == '.' && el.Type == "R" && !dot:
+				dot = true
+			default:
+				return ik4InvalidChar, "must be a number"
+			}
+		}
+		if digits == 0 {
+			return ik4InvalidChar, "must be a number"
+		}
+		length = digits // signs and decimal points do not count
+	case "DT":
+		layout := "20060102"
+		if len(v) == 6 {
+			layout = "060102"
+		}
+		if _, err := time.Parse(layout, v); err != nil || (len(v) != 6 && len(v) != 8) {
+			return ik4InvalidDate, "must be a date (CCYYMMDD)"
+		}
+	case "TM":
+		if !validX12Time(v) {
+			return ik4InvalidTime, "must be a time (HHMM[SS[d..]])"
+		}
+	}
+	if length < el.Min {
+		return ik4TooShort, "must be at least " + strconv.Itoa(el.Min) + " characters"
+	}
+	if el.Max > 0 && length > el.Max {
+		return ik4TooLong, "must be at most " + strconv.Itoa(el.Max) + " characters"
+	}
+	return "", ""
+}
+
+func validX12Time(v string) bool {
+	if len(v) < 4 || len(v) > 8 {
+		return false
+	}
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	hh, _ := strconv.Atoi(v[:2])
+	mm, _ := strconv.Atoi(v[2:4])
+	if hh > 23 || mm > 59 {
+		return false
+	}
+	if len(v) >= 6 {
+		if ss, _ := strconv.Atoi(v[4:6]); ss > 59 {
+			return false
+		}
+	}
+	return true
+}